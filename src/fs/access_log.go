@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// every request, to the API and to the apps behind a vhost, over the relay
+// and on the local network, can be written to an access log of its own,
+// in the Combined Log Format of Apache, or in JSON, for tools like
+// fail2ban or goaccess. it's off unless the access_log section of the
+// config has a file. the client is the one the relay forwarded, when
+// over the relay. the JSON lines also have the request id, the host
+// and how long the request took
+
+const (
+	ACCESS_LOG_COMBINED = "combined"
+	ACCESS_LOG_JSON     = "json"
+)
+
+type accessLog struct {
+	out    io.Writer
+	format string
+	sync.Mutex
+}
+
+// nil until initialize_access_log opens the file
+var access_log *accessLog
+
+type accessLogLine struct {
+	Time      string  `json:"time"`
+	Remote    string  `json:"remote"`
+	Method    string  `json:"method"`
+	URI       string  `json:"uri"`
+	Proto     string  `json:"proto"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+	Host      string  `json:"host,omitempty"`
+	Duration  float64 `json:"duration"`
+	RequestID string  `json:"request_id,omitempty"`
+}
+
+func initialize_access_log() {
+	c := config.AccessLog
+	if c.File == "" {
+		return
+	}
+	if c.Format != ACCESS_LOG_COMBINED && c.Format != ACCESS_LOG_JSON {
+		log_warn("No such access log format: %s, writing the combined one", c.Format)
+		c.Format = ACCESS_LOG_COMBINED
+	}
+	out, err := open_rotating_file(c.File, c.MaxSize<<20, 0, c.Keep)
+	if err != nil {
+		log_error("Could not open the access log %s", c.File)
+		debug(2, "Error opening %s: %s", c.File, err.Error())
+		return
+	}
+	access_log = &accessLog{out: out, format: c.Format}
+}
+
+// access_logged writes the requests handled by next to the access log
+func access_logged(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		this := access_log
+		if this == nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		// the handlers change the URL, like for the apps, and the tokens
+		// of guests, users and profiles are not logged
+		line := accessLogLine{Remote: client_ip(request), Method: request.Method, URI: without_tokens(request.URL).RequestURI(), Proto: request.Proto,
+			Referer: request.Referer(), UserAgent: request.UserAgent()}
+		started := time.Now()
+		status_writer := &statusWriter{ResponseWriter: writer}
+		defer func() {
+			line.Status, line.Bytes = status_writer.status, status_writer.sent
+			if line.Status == 0 {
+				line.Status = http.StatusOK
+			}
+			line.Host, line.RequestID = request.Host, request_id_of(request)
+			line.Duration = time.Since(started).Seconds()
+			this.write(started, line)
+		}()
+		next.ServeHTTP(status_writer, request)
+	})
+}
+
+func (this *accessLog) write(started time.Time, line accessLogLine) {
+	var data []byte
+	if this.format == ACCESS_LOG_JSON {
+		line.Time = started.Format(time.RFC3339Nano)
+		data, _ = json.Marshal(line)
+	} else {
+		data = []byte(combined_log_line(started, line))
+	}
+	this.Lock()
+	this.out.Write(append(data, '\n'))
+	this.Unlock()
+}
+
+// combined_log_line is like
+//
+//	10.0.0.2 - - [10/Oct/2018:13:55:36 -0700] "GET /shares HTTP/1.1" 200 2326 "-" "Amahi/1.0"
+func combined_log_line(started time.Time, line accessLogLine) string {
+	size := "-"
+	if line.Bytes > 0 {
+		size = strconv.FormatInt(line.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"", combined_log_field(line.Remote),
+		started.Format("02/Jan/2006:15:04:05 -0700"), line.Method, combined_log_field(line.URI), line.Proto,
+		line.Status, size, combined_log_field(line.Referer), combined_log_field(line.UserAgent))
+}
+
+// combined_log_field escapes quotes and control characters, "-" for
+// nothing, as Apache does
+func combined_log_field(value string) string {
+	if value == "" {
+		return "-"
+	}
+	var escaped bytes.Buffer
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\\':
+			escaped.WriteString("\\" + string(r))
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&escaped, "\\x%02x", r)
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
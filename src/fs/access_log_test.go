@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	saved := access_log
+	defer func() { access_log = saved }()
+	var out bytes.Buffer
+	access_log = &accessLog{out: &out, format: ACCESS_LOG_COMBINED}
+	// like an app behind a vhost
+	handler := access_logged(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		with_request_id(writer, request)
+		request.Host = "wiki.hda"
+		request.URL.Path = "/changed"
+		writer.WriteHeader(http.StatusNotFound)
+		writer.Write([]byte("not here"))
+	}))
+	request := httptest.NewRequest("GET", "/w/index.php?title=Main", nil)
+	request.RemoteAddr = "192.168.1.20:51000"
+	request.Header.Set("User-Agent", `Mozilla "5.0" Vhost/wiki.hda`)
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	combined := regexp.MustCompile(`^192\.168\.1\.20 - - \[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] ` +
+		`"GET /w/index\.php\?title=Main HTTP/1\.1" 404 8 "-" "Mozilla \\"5\.0\\" Vhost/wiki\.hda"\n$`)
+	if !combined.MatchString(out.String()) {
+		t.Errorf("Wrong combined line: %q", out.String())
+	}
+
+	out.Reset()
+	access_log.format = ACCESS_LOG_JSON
+	request = httptest.NewRequest("HEAD", "/shares", nil)
+	request.Header.Set(REQUEST_ID_HEADER, "abc123")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	var line accessLogLine
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil || !strings.HasSuffix(out.String(), "}\n") {
+		t.Fatalf("Not a JSON line: %q", out.String())
+	}
+	if line.Method != "HEAD" || line.URI != "/shares" || line.Status != 404 || line.Host != "wiki.hda" || line.RequestID != "abc123" || line.Time == "" {
+		t.Errorf("Wrong JSON line: %+v", line)
+	}
+
+	// the tokens are not logged
+	out.Reset()
+	request = httptest.NewRequest("GET", "/files?s=Movies&p=a.mkv&guest=g123&user=u456&profile=p789", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil || line.URI != "/files?p=a.mkv&s=Movies" {
+		t.Errorf("Wrong URI with tokens: %q", out.String())
+	}
+
+	// and nothing when it's off
+	access_log = nil
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/shares", nil))
+	if !strings.HasSuffix(out.String(), "}\n") || strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("Logged with the access log off: %q", out.String())
+	}
+}
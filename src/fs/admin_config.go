@@ -0,0 +1,246 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the settings of the config file can be read and changed while running
+// with /admin/config on the local server, by whoever has admin.token, sent
+// as "Authorization: Bearer <token>". a PATCH is JSON like the config
+// file, with only the settings to change, null putting one back to its
+// default. it's checked against the whole config, takes effect right away
+// and is written to the config file, where only those settings change.
+// the secrets, like the keys of the relay and the tokens of the users, are
+// not shown and can only be changed in the file. the settings read only
+// at start, like the ports, take effect on the next one
+
+// the settings that are not shown, nor changed here
+var admin_secrets = []string{"admin", "relay.api_key", "relay.token", "s3.access_key", "s3.secret_key",
+	"ftp.users", "homes.users", "parental.profiles"}
+
+// config_file is where the config was read from, and changes are written
+var config_file = CONFIG_FILE
+
+// one change at a time
+var admin_config_lock sync.Mutex
+
+// admin_allowed says whether request has the admin token
+func admin_allowed(request *http.Request) bool {
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return config.Admin.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.Admin.Token)) == 1
+}
+
+// json_object is v as a JSON object
+func json_object(v interface{}) map[string]interface{} {
+	data, _ := json.Marshal(v)
+	object := make(map[string]interface{})
+	json.Unmarshal(data, &object)
+	return object
+}
+
+// merge_json puts the keys of patch into object, going into the objects
+// in both. a null removes the key
+func merge_json(object, patch map[string]interface{}) {
+	for key, value := range patch {
+		if value == nil {
+			delete(object, key)
+			continue
+		}
+		inner_patch, patch_ok := value.(map[string]interface{})
+		inner, ok := object[key].(map[string]interface{})
+		if patch_ok && ok {
+			merge_json(inner, inner_patch)
+		} else {
+			object[key] = value
+		}
+	}
+}
+
+// secret_in is the first secret of admin_secrets in object, or ""
+func secret_in(object map[string]interface{}) string {
+	for _, secret := range admin_secrets {
+		inner := object
+		parts := strings.Split(secret, ".")
+		for i, part := range parts {
+			value, ok := inner[part]
+			if !ok {
+				break
+			}
+			if i == len(parts)-1 {
+				return secret
+			}
+			if inner, ok = value.(map[string]interface{}); !ok {
+				break
+			}
+		}
+	}
+	return ""
+}
+
+// without_secrets removes the secrets of admin_secrets from object
+func without_secrets(object map[string]interface{}) map[string]interface{} {
+	for _, secret := range admin_secrets {
+		inner := object
+		parts := strings.Split(secret, ".")
+		for _, part := range parts[:len(parts)-1] {
+			inner, _ = inner[part].(map[string]interface{})
+		}
+		delete(inner, parts[len(parts)-1])
+	}
+	return object
+}
+
+// patch_config is c with patch, checked
+func patch_config(c *fsConfig, patch map[string]interface{}) (*fsConfig, error) {
+	object := json_object(c)
+	merge_json(object, patch)
+	data, _ := json.Marshal(object)
+	patched := default_config()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(patched); err != nil {
+		return nil, err
+	}
+	if patched.Debug.Level < 0 || patched.Debug.Level > 5 {
+		return nil, errors.New("debug.level goes from 1 to 5")
+	}
+	if err := check_config_shares(patched.Shares); err != nil {
+		return nil, err
+	}
+	if err := check_parental_config(&patched.Parental); err != nil {
+		return nil, err
+	}
+	if err := new_leveled_logger(nil).configure(patched.Logging.Format, patched.Logging.Level, patched.Logging.Scopes); err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
+
+// save_config_patch writes patch to the config file at path, leaving the
+// rest of it as it is
+func save_config_patch(path string, patch map[string]interface{}) error {
+	object := make(map[string]interface{})
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &object); err != nil {
+			return err
+		}
+	}
+	merge_json(object, patch)
+	data, err = json.MarshalIndent(object, "", "  ")
+	if err != nil {
+		return err
+	}
+	return write_file_atomic(path, append(data, '\n'), 0600)
+}
+
+// apply_config makes the settings of patch kept outside of config take
+// effect, leaving the command line alone otherwise
+func apply_config(c *fsConfig, patch map[string]interface{}) {
+	if _, ok := patch["no_upload"]; ok {
+		no_upload = c.NoUpload
+	}
+	if _, ok := patch["no_delete"]; ok {
+		no_delete = c.NoDelete
+	}
+	if _, ok := patch["debug"]; ok && c.Debug.Level != 0 {
+		debug_level(c.Debug.Level)
+	}
+	if _, ok := patch["logging"]; ok {
+		logger.configure(c.Logging.Format, c.Logging.Level, c.Logging.Scopes)
+	}
+}
+
+// admin_view is the config as shown by /admin/config
+func admin_view() map[string]interface{} {
+	return without_secrets(json_object(config))
+}
+
+// GET /admin/config shows the settings
+func (service *MercuryFsService) admin_config(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	if !admin_allowed(request) {
+		size := json_response(writer, http.StatusUnauthorized, map[string]string{"error": "the admin token is needed"})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" 401 %d \"%s\"", query, size, ua)
+		return
+	}
+	size := json_response(writer, http.StatusOK, admin_view())
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
+
+// PATCH /admin/config changes some settings
+func (service *MercuryFsService) admin_config_change(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	if !admin_allowed(request) {
+		size := json_response(writer, http.StatusUnauthorized, map[string]string{"error": "the admin token is needed"})
+		service.debug_info.requestServed(size)
+		log("\"PATCH %s\" 401 %d \"%s\"", query, size, ua)
+		return
+	}
+	var patch map[string]interface{}
+	err := json.NewDecoder(io.LimitReader(request.Body, 1<<20)).Decode(&patch)
+	if err == nil && len(patch) == 0 {
+		err = errors.New("no settings to change")
+	}
+	if err == nil {
+		if secret := secret_in(patch); secret != "" {
+			err = errors.New(secret + " can only be changed in the config file")
+		}
+	}
+	admin_config_lock.Lock()
+	defer admin_config_lock.Unlock()
+	var patched *fsConfig
+	if err == nil {
+		patched, err = patch_config(config, patch)
+	}
+	if err != nil {
+		size := json_response(writer, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		service.debug_info.requestServed(size)
+		log("\"PATCH %s\" 400 %d \"%s\"", query, size, ua)
+		return
+	}
+	if err := save_config_patch(config_file, patch); err != nil {
+		log_error("Could not save the settings to %s: %s", config_file, err.Error())
+		size := json_response(writer, http.StatusInternalServerError, map[string]string{"error": "the settings could not be saved"})
+		service.debug_info.requestServed(size)
+		log("\"PATCH %s\" 500 %d \"%s\"", query, size, ua)
+		return
+	}
+	config = patched
+	apply_config(patched, patch)
+	keys := []string{}
+	for key := range patch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	log("Settings changed: %s", strings.Join(keys, ", "))
+	size := json_response(writer, http.StatusOK, admin_view())
+	service.debug_info.requestServed(size)
+	log("\"PATCH %s\" 200 %d \"%s\"", query, size, ua)
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminConfig(t *testing.T) {
+	saved_config, saved_file, saved_upload := config, config_file, no_upload
+	defer func() { config, config_file, no_upload = saved_config, saved_file, saved_upload }()
+	dir, _ := ioutil.TempDir("", "admin")
+	defer os.RemoveAll(dir)
+	config_file = filepath.Join(dir, "fs.json")
+	ioutil.WriteFile(config_file, []byte(`{"relay": {"api_key": "secret"}, "scan": {"default": "12h"}, "admin": {"token": "letmein"}}`), 0600)
+	config = default_config()
+	if err := load_config(config_file); err != nil {
+		t.Fatalf("Could not load the config: %s", err)
+	}
+
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/config", service.admin_config).Methods("GET")
+	router.HandleFunc("/admin/config", service.admin_config_change).Methods("PATCH")
+	serve := func(method, token, body string) (int, map[string]interface{}) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, "/admin/config", strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(recorder, request)
+		result := make(map[string]interface{})
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		return recorder.Code, result
+	}
+
+	if code, _ := serve("GET", "", ""); code != 401 {
+		t.Errorf("Shown without the token: %d", code)
+	}
+	if code, _ := serve("GET", "wrong", ""); code != 401 {
+		t.Errorf("Shown with a wrong token: %d", code)
+	}
+	code, shown := serve("GET", "letmein", "")
+	relay, _ := shown["relay"].(map[string]interface{})
+	if code != 200 || shown["scan"].(map[string]interface{})["default"] != "12h" || relay == nil {
+		t.Fatalf("Wrong config: %d %v", code, shown)
+	}
+	if _, ok := relay["api_key"]; ok || shown["admin"] != nil {
+		t.Errorf("Secrets shown: %v", shown)
+	}
+
+	code, shown = serve("PATCH", "letmein", `{"limits": {"max_streams": 3}, "no_upload": true, "app_cache": {"size": 64}}`)
+	if code != 200 || config.Limits.MaxStreams != 3 || config.AppCache.Size != 64 || !no_upload {
+		t.Errorf("Not changed: %d %+v %v", code, config.Limits, no_upload)
+	}
+	if config.Relay.ApiKey != "secret" || config.Scan.Default != "12h" || config.AppCache.MaxAge != "1h" {
+		t.Errorf("Other settings changed: %+v", config)
+	}
+	// only what changed is written
+	data, _ := ioutil.ReadFile(config_file)
+	var saved map[string]interface{}
+	json.Unmarshal(data, &saved)
+	if saved["no_upload"] != true || saved["relay"].(map[string]interface{})["api_key"] != "secret" ||
+		saved["limits"].(map[string]interface{})["max_streams"] != float64(3) || strings.Contains(string(data), "max_age") {
+		t.Errorf("Wrong config file: %s", data)
+	}
+
+	// and a setting goes back to its default
+	serve("PATCH", "letmein", `{"app_cache": {"size": null}}`)
+	if config.AppCache.Size != default_config().AppCache.Size || config.Limits.MaxStreams != 3 {
+		t.Errorf("Not back to the default: %+v", config.AppCache)
+	}
+
+	for _, patch := range []string{`{"relay": {"api_key": "mine"}}`, `{"admin": {"token": ""}}`, `{"nope": 1}`,
+		`{"logging": {"level": "loud"}}`, `{"limits": {"max_streams": "many"}}`, `{}`, `[1]`} {
+		if code, _ := serve("PATCH", "letmein", patch); code != 400 {
+			t.Errorf("%d instead of 400 for %s", code, patch)
+		}
+	}
+	if after, _ := ioutil.ReadFile(config_file); strings.Contains(string(after), "mine") || config.Relay.ApiKey != "secret" {
+		t.Errorf("Changed a secret: %s", after)
+	}
+}
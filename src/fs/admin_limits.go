@@ -0,0 +1,275 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// the limits of the server, scattered over the config file and the code,
+// are in one place with /admin/limits on the local server, behind the
+// admin token like /admin/config. GET shows each of them with the setting
+// it comes from, its value, what is in force right now, null for no
+// limit, and the counters that show how close to it the server is. PUT
+// changes some of them, like {"max_streams": 16, "app_cache": null}, null
+// putting one back to its default. the changes take effect right away and
+// are written to the config file. the limits fixed in the code are shown
+// too, but not changed
+
+// a limit of /admin/limits
+type limitView struct {
+	Name string `json:"name"`
+	// the setting of the config file, "" for a limit fixed in the code
+	Setting string `json:"setting,omitempty"`
+	Unit    string `json:"unit"`
+	Value   int64  `json:"value"`
+	Default int64  `json:"default"`
+	// what is in force now, nil for no limit
+	Effective *int64 `json:"effective"`
+	// the setting is only read at start
+	Restart  bool                   `json:"restart,omitempty"`
+	Counters map[string]interface{} `json:"counters,omitempty"`
+}
+
+// a limit that can be changed, with the path of its setting and where it
+// is in a config
+type adminLimit struct {
+	name    string
+	setting string
+	unit    string
+	restart bool
+	value   func(c *fsConfig) int64
+}
+
+var admin_limits = []adminLimit{
+	{"max_upload", "limits.max_upload", "MB", false, func(c *fsConfig) int64 { return c.Limits.MaxUpload }},
+	{"max_streams", "limits.max_streams", "streams", false, func(c *fsConfig) int64 { return int64(c.Limits.MaxStreams) }},
+	{"max_client_streams", "limits.max_client_streams", "streams", false, func(c *fsConfig) int64 { return int64(c.Limits.MaxClientStreams) }},
+	{"download_bandwidth", "downloads.bandwidth", "kbit/s", false, func(c *fsConfig) int64 { return int64(c.Downloads.Bandwidth) }},
+	{"active_downloads", "downloads.active", "downloads", false, func(c *fsConfig) int64 { return int64(c.Downloads.Active) }},
+	{"transcodes", "transcode.max_sessions", "sessions", false, func(c *fsConfig) int64 { return int64(c.Transcode.MaxSessions) }},
+	{"pregenerate_cache", "transcode.pregenerate.cache_size", "MB", false, func(c *fsConfig) int64 { return c.Transcode.Pregenerate.CacheSize }},
+	{"app_cache", "app_cache.size", "MB", false, func(c *fsConfig) int64 { return c.AppCache.Size }},
+	{"listing_entries", "listing.max_entries", "entries", false, func(c *fsConfig) int64 { return int64(c.Listing.MaxEntries) }},
+	{"relay_streams", "relay.http2.max_concurrent_streams", "streams", true, func(c *fsConfig) int64 { return int64(c.Relay.HTTP2.MaxConcurrentStreams) }},
+}
+
+// the uploads turned down for being over limits.max_upload
+var uploads_rejected int64
+
+func upload_rejected() {
+	atomic.AddInt64(&uploads_rejected, 1)
+}
+
+// max_upload is how big an upload can be, in bytes, 0 for no limit
+func max_upload() int64 {
+	return config.Limits.MaxUpload << 20
+}
+
+// upload_too_big says whether an upload of size bytes is over the limit,
+// counting it if so
+func upload_too_big(size int64) bool {
+	if max := max_upload(); max > 0 && size > max {
+		upload_rejected()
+		return true
+	}
+	return false
+}
+
+// limited is value in force, with 0 for no limit
+func limited(value int64) *int64 {
+	if value <= 0 {
+		return nil
+	}
+	return &value
+}
+
+func limit_value(value int64) *int64 {
+	return &value
+}
+
+// download_counters are how many downloads are in each state
+func download_counters() map[string]interface{} {
+	counters := map[string]interface{}{"queued": 0, "ready": 0, "active": 0}
+	for _, download := range download_queue.list() {
+		counters[download.State] = counters[download.State].(int) + 1
+	}
+	return counters
+}
+
+// limits_view is the limits as shown by /admin/limits
+func limits_view() []limitView {
+	defaults := default_config()
+	views := []limitView{}
+	for _, limit := range admin_limits {
+		view := limitView{Name: limit.name, Setting: limit.setting, Unit: limit.unit, Restart: limit.restart,
+			Value: limit.value(config), Default: limit.value(defaults)}
+		view.Effective = limited(view.Value)
+		switch limit.name {
+		case "max_upload":
+			if no_upload {
+				view.Effective = limit_value(0)
+			}
+			view.Counters = map[string]interface{}{"rejected": atomic.LoadInt64(&uploads_rejected)}
+		case "max_streams", "max_client_streams":
+			view.Counters = stream_limits.status()
+		case "download_bandwidth", "active_downloads":
+			if !downloads_open(schedule_now()) {
+				view.Effective = limit_value(0)
+			} else if limit.name == "active_downloads" && view.Value < 1 {
+				view.Effective = limit_value(1)
+			}
+			view.Counters = download_counters()
+		case "transcodes":
+			view.Counters = map[string]interface{}{"running": transcoders.running()}
+		case "pregenerate_cache":
+			if !config.Transcode.Pregenerate.Enabled {
+				view.Effective = limit_value(0)
+			}
+			status := transcode_pregen.status()
+			view.Counters = map[string]interface{}{"bytes": status["bytes"], "renditions": status["renditions"]}
+		case "app_cache":
+			if view.Value <= 0 {
+				view.Effective = limit_value(0)
+			}
+			view.Counters = app_cache.status()
+		}
+		views = append(views, view)
+	}
+	fixed := []limitView{
+		{Name: "etag_cache", Unit: "entries", Value: ETAG_CACHE_SIZE},
+		{Name: "app_cache_entry", Unit: "bytes", Value: APP_CACHE_MAX_ENTRY},
+		{Name: "chunk", Unit: "bytes", Value: CHUNK_MAX},
+		{Name: "delta_signature", Unit: "bytes", Value: DELTA_MAX_SIGNATURE},
+		{Name: "thumbnail_batch", Unit: "files", Value: THUMBNAIL_BATCH_MAX},
+		{Name: "speedtest", Unit: "MB", Value: SPEEDTEST_MAX_MB},
+		{Name: "path_length", Unit: "bytes", Value: MAX_PATH_LENGTH},
+		{Name: "path_depth", Unit: "levels", Value: MAX_PATH_DEPTH},
+	}
+	for _, view := range fixed {
+		view.Default, view.Effective = view.Value, limit_value(view.Value)
+		if view.Name == "etag_cache" {
+			counters := make(map[string]interface{})
+			for key, value := range etag_cache.status() {
+				counters[key] = value
+			}
+			view.Counters = counters
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// limits_patch turns the limits changed, by name, into a patch of the
+// config, like /admin/config takes
+func limits_patch(limits map[string]interface{}) (map[string]interface{}, error) {
+	if len(limits) == 0 {
+		return nil, errors.New("no limits to change")
+	}
+	settings := make(map[string]string)
+	for _, limit := range admin_limits {
+		settings[limit.name] = limit.setting
+	}
+	names := []string{}
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	patch := make(map[string]interface{})
+	for _, name := range names {
+		setting, ok := settings[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a limit that can be changed", name)
+		}
+		value := limits[name]
+		if number, ok := value.(float64); value != nil && (!ok || number < 0 || number != float64(int64(number))) {
+			return nil, fmt.Errorf("%s must be a whole number, 0 or more, or null", name)
+		}
+		inner := patch
+		parts := strings.Split(setting, ".")
+		for _, part := range parts[:len(parts)-1] {
+			if _, ok := inner[part]; !ok {
+				inner[part] = make(map[string]interface{})
+			}
+			inner = inner[part].(map[string]interface{})
+		}
+		inner[parts[len(parts)-1]] = value
+	}
+	return patch, nil
+}
+
+// GET /admin/limits shows the limits
+func (service *MercuryFsService) admin_limits(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	if !admin_allowed(request) {
+		size := json_response(writer, http.StatusUnauthorized, map[string]string{"error": "the admin token is needed"})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" 401 %d \"%s\"", query, size, ua)
+		return
+	}
+	size := json_response(writer, http.StatusOK, limits_view())
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
+
+// PUT /admin/limits changes some limits
+func (service *MercuryFsService) admin_limits_change(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	if !admin_allowed(request) {
+		size := json_response(writer, http.StatusUnauthorized, map[string]string{"error": "the admin token is needed"})
+		service.debug_info.requestServed(size)
+		log("\"PUT %s\" 401 %d \"%s\"", query, size, ua)
+		return
+	}
+	var limits, patch map[string]interface{}
+	err := json.NewDecoder(io.LimitReader(request.Body, 64<<10)).Decode(&limits)
+	if err == nil {
+		patch, err = limits_patch(limits)
+	}
+	admin_config_lock.Lock()
+	defer admin_config_lock.Unlock()
+	var patched *fsConfig
+	if err == nil {
+		patched, err = patch_config(config, patch)
+	}
+	if err != nil {
+		size := json_response(writer, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		service.debug_info.requestServed(size)
+		log("\"PUT %s\" 400 %d \"%s\"", query, size, ua)
+		return
+	}
+	if err := save_config_patch(config_file, patch); err != nil {
+		log_error("Could not save the limits to %s: %s", config_file, err.Error())
+		size := json_response(writer, http.StatusInternalServerError, map[string]string{"error": "the limits could not be saved"})
+		service.debug_info.requestServed(size)
+		log("\"PUT %s\" 500 %d \"%s\"", query, size, ua)
+		return
+	}
+	config = patched
+	apply_config(patched, patch)
+	names := []string{}
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log("Limits changed: %s", strings.Join(names, ", "))
+	size := json_response(writer, http.StatusOK, limits_view())
+	service.debug_info.requestServed(size)
+	log("\"PUT %s\" 200 %d \"%s\"", query, size, ua)
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminLimits(t *testing.T) {
+	saved_config, saved_file, saved_rejected := config, config_file, uploads_rejected
+	defer func() { config, config_file, uploads_rejected = saved_config, saved_file, saved_rejected }()
+	dir, _ := ioutil.TempDir("", "limits")
+	defer os.RemoveAll(dir)
+	config_file = filepath.Join(dir, "fs.json")
+	ioutil.WriteFile(config_file, []byte(`{"admin": {"token": "letmein"}, "app_cache": {"size": 8}}`), 0600)
+	config = default_config()
+	if err := load_config(config_file); err != nil {
+		t.Fatalf("Could not load the config: %s", err)
+	}
+	uploads_rejected = 0
+
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/limits", service.admin_limits).Methods("GET")
+	router.HandleFunc("/admin/limits", service.admin_limits_change).Methods("PUT")
+	serve := func(method, token, body string) (int, map[string]limitView) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, "/admin/limits", strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(recorder, request)
+		var views []limitView
+		json.Unmarshal(recorder.Body.Bytes(), &views)
+		limits := make(map[string]limitView)
+		for _, view := range views {
+			limits[view.Name] = view
+		}
+		return recorder.Code, limits
+	}
+
+	if code, _ := serve("GET", "", ""); code != 401 {
+		t.Errorf("Shown without the token: %d", code)
+	}
+	code, limits := serve("GET", "letmein", "")
+	app := limits["app_cache"]
+	if code != 200 || app.Value != 8 || app.Default != 32 || app.Setting != "app_cache.size" || app.Effective == nil || *app.Effective != 8 {
+		t.Fatalf("Wrong limits: %d %+v", code, limits)
+	}
+	if upload := limits["max_upload"]; upload.Effective != nil || upload.Counters["rejected"] != float64(0) {
+		t.Errorf("Wrong upload limit: %+v", upload)
+	}
+	if etag := limits["etag_cache"]; etag.Setting != "" || etag.Value != ETAG_CACHE_SIZE || etag.Counters == nil {
+		t.Errorf("Wrong fixed limit: %+v", etag)
+	}
+
+	code, limits = serve("PUT", "letmein", `{"max_upload": 1, "max_streams": 4, "app_cache": null}`)
+	if code != 200 || config.Limits.MaxUpload != 1 || config.Limits.MaxStreams != 4 || config.AppCache.Size != 32 {
+		t.Errorf("Not changed: %d %+v %+v", code, config.Limits, config.AppCache)
+	}
+	if limits["max_streams"].Value != 4 || *limits["max_upload"].Effective != 1 {
+		t.Errorf("Not shown changed: %+v", limits)
+	}
+	data, _ := ioutil.ReadFile(config_file)
+	var saved map[string]interface{}
+	json.Unmarshal(data, &saved)
+	if saved["limits"].(map[string]interface{})["max_upload"] != float64(1) || saved["app_cache"] == nil ||
+		saved["admin"] == nil {
+		t.Errorf("Wrong config file: %s", data)
+	}
+
+	if upload_too_big(1<<20) || !upload_too_big(1<<20+1) {
+		t.Errorf("Wrong upload limit")
+	}
+	if _, limits = serve("GET", "letmein", ""); limits["max_upload"].Counters["rejected"] != float64(1) {
+		t.Errorf("Rejected upload not counted: %+v", limits["max_upload"])
+	}
+
+	for _, body := range []string{`{"etag_cache": 10}`, `{"nope": 1}`, `{"max_streams": -1}`, `{"max_streams": 1.5}`,
+		`{"max_streams": "many"}`, `{}`, `[1]`} {
+		if code, _ := serve("PUT", "letmein", body); code != 400 {
+			t.Errorf("%d instead of 400 for %s", code, body)
+		}
+	}
+	if config.Limits.MaxStreams != 4 {
+		t.Errorf("Changed by a bad request: %+v", config.Limits)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the apps behind a vhost send megabytes of javascript, css, fonts and
+// images, through the uplink of the home every time they are used from
+// afar. their responses that can be cached, to GETs, that are not private
+// and don't set cookies, are kept in memory, up to app_cache.size MB, for
+// as long as the app says, or app_cache.max_age for the static files it
+// says nothing about. they are served from memory with an ETag, so that
+// the clients asking again get a 304 instead of the whole file
+
+// the biggest response kept, in bytes
+const APP_CACHE_MAX_ENTRY = 4 << 20
+
+// the files that don't change, to keep when the app does not say
+var app_cache_static = map[string]bool{
+	".js": true, ".mjs": true, ".css": true, ".map": true, ".png": true, ".jpg": true, ".jpeg": true, ".gif": true,
+	".svg": true, ".ico": true, ".webp": true, ".woff": true, ".woff2": true, ".ttf": true, ".eot": true, ".otf": true,
+}
+
+type appCacheEntry struct {
+	key     string
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+type appCache struct {
+	entries map[string]*list.Element
+	// least recently used last
+	order        *list.List
+	size         int64
+	hits, misses int64
+	sync.Mutex
+}
+
+var app_cache = new_app_cache()
+
+func new_app_cache() *appCache {
+	return &appCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// app_cache_key is what a response to request for vhost is kept as. the
+// gzipped and plain responses are kept apart
+func app_cache_key(vhost string, request *http.Request) string {
+	encoding := ""
+	if strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") {
+		encoding = "gzip"
+	}
+	return vhost + " " + encoding + " " + request.URL.RequestURI()
+}
+
+// app_cache_ttl is how long response can be kept, 0 if it can't. the
+// Vary of the server itself, in vary, is left out
+func app_cache_ttl(request *http.Request, status int, header http.Header, vary map[string]bool) time.Duration {
+	if status != http.StatusOK || header.Get("Set-Cookie") != "" {
+		return 0
+	}
+	// the events an app streams are never the same
+	if strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		return 0
+	}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && name != "Accept-Encoding" && !vary[name] {
+				return 0
+			}
+		}
+	}
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "private" || directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "s-maxage=") || strings.HasPrefix(directive, "max-age="):
+			seconds, _ := strconv.Atoi(directive[strings.Index(directive, "=")+1:])
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return time.Until(at)
+	}
+	if app_cache_static[strings.ToLower(path.Ext(request.URL.Path))] {
+		max_age, _ := time.ParseDuration(config.AppCache.MaxAge)
+		return max_age
+	}
+	return 0
+}
+
+func (this *appCache) get(key string) *appCacheEntry {
+	this.Lock()
+	defer this.Unlock()
+	element, ok := this.entries[key]
+	if !ok {
+		this.misses++
+		return nil
+	}
+	entry := element.Value.(*appCacheEntry)
+	if time.Now().After(entry.expires) {
+		this.remove(element)
+		this.misses++
+		return nil
+	}
+	this.order.MoveToFront(element)
+	this.hits++
+	return entry
+}
+
+func (this *appCache) store(entry *appCacheEntry) {
+	max := config.AppCache.Size << 20
+	this.Lock()
+	defer this.Unlock()
+	if element, ok := this.entries[entry.key]; ok {
+		this.remove(element)
+	}
+	this.entries[entry.key] = this.order.PushFront(entry)
+	this.size += int64(len(entry.body))
+	for this.size > max && this.order.Len() > 0 {
+		this.remove(this.order.Back())
+	}
+}
+
+// remove drops an entry, with the lock held
+func (this *appCache) remove(element *list.Element) {
+	entry := element.Value.(*appCacheEntry)
+	this.order.Remove(element)
+	delete(this.entries, entry.key)
+	this.size -= int64(len(entry.body))
+}
+
+func (this *appCache) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	return map[string]interface{}{"entries": this.order.Len(), "bytes": this.size, "hits": this.hits, "misses": this.misses}
+}
+
+// appCacheRecorder keeps a copy of a response from the app, while sending
+// it, when it can be cached
+type appCacheRecorder struct {
+	http.ResponseWriter
+	request *http.Request
+	vary    map[string]bool
+	entry   *appCacheEntry
+	body    bytes.Buffer
+	skip    bool
+}
+
+func (this *appCacheRecorder) WriteHeader(status int) {
+	if this.entry == nil && !this.skip {
+		ttl := app_cache_ttl(this.request, status, this.Header(), this.vary)
+		length, err := strconv.Atoi(this.Header().Get("Content-Length"))
+		if ttl <= 0 || (err == nil && length > APP_CACHE_MAX_ENTRY) {
+			this.skip = true
+		} else {
+			now := time.Now()
+			this.entry = &appCacheEntry{header: this.Header().Clone(), stored: now, expires: now.Add(ttl)}
+		}
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *appCacheRecorder) Write(data []byte) (int, error) {
+	if this.entry == nil && !this.skip {
+		this.WriteHeader(http.StatusOK)
+	}
+	if this.entry != nil {
+		if this.body.Len()+len(data) > APP_CACHE_MAX_ENTRY {
+			this.entry = nil
+			this.skip = true
+		} else {
+			this.body.Write(data)
+		}
+	}
+	return this.ResponseWriter.Write(data)
+}
+
+func (this *appCacheRecorder) Flush() {
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap is for http.ResponseController
+func (this *appCacheRecorder) Unwrap() http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+// serve answers request for vhost from the cache, or with next, keeping
+// its response when it can be
+func (this *appCache) serve(writer http.ResponseWriter, request *http.Request, vhost string, next http.Handler) {
+	if config.AppCache.Size <= 0 || (request.Method != "GET" && request.Method != "HEAD") ||
+		request.Header.Get("Authorization") != "" || request.Header.Get("Range") != "" {
+		next.ServeHTTP(writer, request)
+		return
+	}
+	key := app_cache_key(vhost, request)
+	if entry := this.get(key); entry != nil {
+		header := writer.Header()
+		for name, values := range entry.header {
+			header[name] = values
+		}
+		if header.Get("ETag") == "" {
+			header.Set("ETag", etag_cache.bytes_etag("app:"+key, entry.body))
+		}
+		header.Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+		header.Set("X-Cache", "HIT")
+		modified, _ := http.ParseTime(header.Get("Last-Modified"))
+		http.ServeContent(writer, request, "", modified, bytes.NewReader(entry.body))
+		return
+	}
+	vary := make(map[string]bool)
+	for _, name := range writer.Header().Values("Vary") {
+		vary[http.CanonicalHeaderKey(name)] = true
+	}
+	writer.Header().Set("X-Cache", "MISS")
+	recorder := &appCacheRecorder{ResponseWriter: writer, request: request, vary: vary}
+	next.ServeHTTP(recorder, request)
+	// a response to a HEAD has no body to keep
+	if recorder.entry != nil && request.Method == "GET" {
+		recorder.entry.key = key
+		recorder.entry.body = recorder.body.Bytes()
+		this.store(recorder.entry)
+	}
+}
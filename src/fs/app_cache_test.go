@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func TestAppCache(t *testing.T) {
+	saved_cache, saved_config := app_cache, config
+	defer func() { app_cache, config = saved_cache, saved_config }()
+	app_cache = new_app_cache()
+	config = default_config()
+
+	fetched := make(map[string]int)
+	app := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fetched[request.URL.Path]++
+		switch request.URL.Path {
+		case "/private.css":
+			writer.Header().Set("Cache-Control", "private")
+		case "/login.js":
+			writer.Header().Set("Set-Cookie", "session=1")
+		case "/lang.json":
+			writer.Header().Set("Cache-Control", "max-age=60")
+			writer.Header().Set("Vary", "Accept-Language")
+		case "/config.json":
+			writer.Header().Set("Cache-Control", "public, max-age=60")
+		}
+		writer.Write([]byte("content of " + request.URL.Path))
+	}))
+	defer app.Close()
+	remote, _ := url.Parse(app.URL)
+	proxy := httputil.NewSingleHostReverseProxy(remote)
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", path, nil)
+		if etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+		// as top_vhost_filter does
+		recorder.Header().Add("Vary", "Session")
+		recorder.Header().Add("Vary", "User-Agent")
+		app_cache.serve(recorder, request, "wiki.hda", proxy)
+		return recorder
+	}
+
+	for _, path := range []string{"/app.js", "/config.json"} {
+		if response := get(path, ""); response.Header().Get("X-Cache") != "MISS" || response.Body.String() != "content of "+path {
+			t.Errorf("Wrong first response for %s: %v %s", path, response.Header(), response.Body.String())
+		}
+		response := get(path, "")
+		if response.Header().Get("X-Cache") != "HIT" || response.Body.String() != "content of "+path || fetched[path] != 1 {
+			t.Errorf("Not served from the cache %s: %v %d", path, response.Header(), fetched[path])
+		}
+		// and not sent again at all
+		if response := get(path, response.Header().Get("ETag")); response.Code != 304 || response.Body.Len() != 0 {
+			t.Errorf("Sent %s again: %d", path, response.Code)
+		}
+	}
+
+	for _, path := range []string{"/index.php", "/private.css", "/login.js", "/lang.json"} {
+		get(path, "")
+		if get(path, ""); fetched[path] != 2 {
+			t.Errorf("Kept %s", path)
+		}
+	}
+
+	config.AppCache.Size = 0
+	get("/other.js", "")
+	if get("/other.js", ""); fetched["/other.js"] != 2 {
+		t.Errorf("Kept a response with the cache off")
+	}
+	if status := app_cache.status(); status["entries"] != 2 || status["hits"] != int64(4) {
+		t.Errorf("Wrong status: %v", status)
+	}
+}
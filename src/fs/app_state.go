@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the apps keep their settings and state, like how a folder is viewed or
+// the last one browsed, on the HDA, to have them on every device, with
+// /state/{app}/{key}. the values are any JSON, up to APP_STATE_MAX_VALUE.
+// each user, known by the User-Token of the home folders, has their own;
+// the requests without one share those of the HDA. a value has an ETag,
+// and a PUT or DELETE with If-Match only changes the value it was read
+// from, so that two devices do not overwrite each other. GET /state/{app}
+// has all of them, and with since=<RFC 3339 time>, those changed after it.
+// they are kept in APP_STATE_DIR, a file by user and app
+
+const APP_STATE_DIR = DATA_DIR + "/state"
+const APP_STATE_MAX_VALUE = 64 << 10
+const APP_STATE_MAX_KEYS = 1000
+
+// the folder of the state without a user, not a valid user name
+const APP_STATE_SHARED = ".shared"
+
+var errStateName = errors.New("apps and keys are named with letters, digits, _, - and ., up to 128")
+var errStateValue = errors.New("the value must be JSON, up to 64 KB")
+var errStateFull = errors.New("too many keys for this app")
+var errStateChanged = errors.New("the value was changed")
+var errStateNotFound = errors.New("no such key")
+var errStateSince = errors.New("since must be an RFC 3339 time")
+
+var state_name_pattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,127}$`)
+
+type stateEntry struct {
+	Value   json.RawMessage `json:"value"`
+	Updated time.Time       `json:"updated"`
+}
+
+func (this *stateEntry) etag() string {
+	return "\"" + strconv.FormatInt(this.Updated.UnixNano(), 36) + "\""
+}
+
+type appState struct {
+	dir string
+	sync.Mutex
+}
+
+var app_state = &appState{dir: APP_STATE_DIR}
+
+func (this *appState) file(user, app string) string {
+	if user == "" {
+		user = APP_STATE_SHARED
+	}
+	return filepath.Join(this.dir, user, app+".json")
+}
+
+// read is the state of app for user. call with the lock held
+func (this *appState) read(user, app string) (map[string]*stateEntry, error) {
+	entries := make(map[string]*stateEntry)
+	data, err := ioutil.ReadFile(this.file(user, app))
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return entries, json.Unmarshal(data, &entries)
+}
+
+// write saves the state of app for user. call with the lock held
+func (this *appState) write(user, app string, entries map[string]*stateEntry) error {
+	file := this.file(user, app)
+	if len(entries) == 0 {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	return write_file_atomic(file, data, 0600)
+}
+
+// list is the state of app for user changed after since, all of it when
+// since is zero
+func (this *appState) list(user, app string, since time.Time) (map[string]*stateEntry, error) {
+	this.Lock()
+	defer this.Unlock()
+	entries, err := this.read(user, app)
+	if err != nil {
+		return nil, err
+	}
+	for key, entry := range entries {
+		if !entry.Updated.After(since) {
+			delete(entries, key)
+		}
+	}
+	return entries, nil
+}
+
+func (this *appState) get(user, app, key string) (*stateEntry, error) {
+	this.Lock()
+	defer this.Unlock()
+	entries, err := this.read(user, app)
+	if err != nil {
+		return nil, err
+	}
+	if entry := entries[key]; entry != nil {
+		return entry, nil
+	}
+	return nil, errStateNotFound
+}
+
+// put sets key to value, if its ETag is if_match, when given
+func (this *appState) put(user, app, key string, value json.RawMessage, if_match string) (*stateEntry, error) {
+	this.Lock()
+	defer this.Unlock()
+	entries, err := this.read(user, app)
+	if err != nil {
+		return nil, err
+	}
+	old := entries[key]
+	if if_match != "" && (old == nil || if_match != "*" && old.etag() != if_match) {
+		return nil, errStateChanged
+	}
+	if old == nil && len(entries) >= APP_STATE_MAX_KEYS {
+		return nil, errStateFull
+	}
+	entry := &stateEntry{Value: value, Updated: time.Now().UTC()}
+	// two changes in a row have different ETags
+	if old != nil && !entry.Updated.After(old.Updated) {
+		entry.Updated = old.Updated.Add(time.Nanosecond)
+	}
+	entries[key] = entry
+	return entry, this.write(user, app, entries)
+}
+
+// remove removes key, if its ETag is if_match, when given
+func (this *appState) remove(user, app, key, if_match string) error {
+	this.Lock()
+	defer this.Unlock()
+	entries, err := this.read(user, app)
+	if err != nil {
+		return err
+	}
+	old := entries[key]
+	if old == nil {
+		return errStateNotFound
+	}
+	if if_match != "" && if_match != "*" && old.etag() != if_match {
+		return errStateChanged
+	}
+	delete(entries, key)
+	return this.write(user, app, entries)
+}
+
+// app_state_status is the status of the answers to err
+func app_state_status(err error) int {
+	switch err {
+	case errStateName, errStateValue, errStateSince:
+		return http.StatusBadRequest
+	case errStateNotFound:
+		return http.StatusNotFound
+	case errStateChanged:
+		return http.StatusPreconditionFailed
+	case errStateFull:
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// app_state_names are the app and key of a request, checked
+func app_state_names(request *http.Request) (string, string, error) {
+	vars := mux.Vars(request)
+	app, key := vars["app"], vars["key"]
+	if _, has_key := vars["key"]; !state_name_pattern.MatchString(app) || has_key && !state_name_pattern.MatchString(key) {
+		return "", "", errStateName
+	}
+	return app, key, nil
+}
+
+// app_state_answer answers a request of /state, with result or err
+func (service *MercuryFsService) app_state_answer(writer http.ResponseWriter, request *http.Request, status int, result interface{}, err error) {
+	if err != nil {
+		status = app_state_status(err)
+		if status == http.StatusInternalServerError {
+			log_error("Error with the state of the apps: %s", err.Error())
+		}
+		result = map[string]string{"error": err.Error()}
+	}
+	size := int64(0)
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		writer.WriteHeader(status)
+	} else {
+		size = json_response(writer, status, result)
+	}
+	service.debug_info.requestServed(size)
+	log("\"%s %s\" %d %d \"%s\"", request.Method, pathForLog(request.URL), status, size, request.Header.Get("User-Agent"))
+}
+
+// GET /state/{app} has the values of an app, by key
+func (service *MercuryFsService) app_state_list(writer http.ResponseWriter, request *http.Request) {
+	app, _, err := app_state_names(request)
+	var since time.Time
+	if value := request.URL.Query().Get("since"); value != "" && err == nil {
+		if since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			err = errStateSince
+		}
+	}
+	var entries map[string]*stateEntry
+	if err == nil {
+		entries, err = app_state.list(home_user_of(request), app, since)
+	}
+	service.app_state_answer(writer, request, http.StatusOK, entries, err)
+}
+
+// GET /state/{app}/{key} has a value
+func (service *MercuryFsService) app_state_get(writer http.ResponseWriter, request *http.Request) {
+	app, key, err := app_state_names(request)
+	var entry *stateEntry
+	if err == nil {
+		entry, err = app_state.get(home_user_of(request), app, key)
+	}
+	if err != nil {
+		service.app_state_answer(writer, request, 0, nil, err)
+		return
+	}
+	writer.Header().Set("ETag", entry.etag())
+	if request.Header.Get("If-None-Match") == entry.etag() {
+		service.app_state_answer(writer, request, http.StatusNotModified, nil, nil)
+		return
+	}
+	service.app_state_answer(writer, request, http.StatusOK, entry, nil)
+}
+
+// PUT /state/{app}/{key} sets a value, the JSON of the body
+func (service *MercuryFsService) app_state_put(writer http.ResponseWriter, request *http.Request) {
+	app, key, err := app_state_names(request)
+	var entry *stateEntry
+	if err == nil {
+		var data []byte
+		data, err = ioutil.ReadAll(io.LimitReader(request.Body, APP_STATE_MAX_VALUE+1))
+		if err == nil && (len(data) > APP_STATE_MAX_VALUE || !json.Valid(data)) {
+			err = errStateValue
+		}
+		if err == nil {
+			entry, err = app_state.put(home_user_of(request), app, key, json.RawMessage(data), request.Header.Get("If-Match"))
+		}
+	}
+	if err == nil {
+		writer.Header().Set("ETag", entry.etag())
+	}
+	service.app_state_answer(writer, request, http.StatusOK, entry, err)
+}
+
+// DELETE /state/{app}/{key} removes a value
+func (service *MercuryFsService) app_state_delete(writer http.ResponseWriter, request *http.Request) {
+	app, key, err := app_state_names(request)
+	if err == nil {
+		err = app_state.remove(home_user_of(request), app, key, request.Header.Get("If-Match"))
+	}
+	service.app_state_answer(writer, request, http.StatusNoContent, nil, err)
+}
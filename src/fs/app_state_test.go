@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppState(t *testing.T) {
+	saved_config, saved_state := config, app_state
+	defer func() { config, app_state = saved_config, saved_state }()
+	config = default_config()
+	config.Homes.Users = map[string]string{"ana": "ana-token", "bob": "bob-token"}
+	dir, _ := ioutil.TempDir("", "state")
+	defer os.RemoveAll(dir)
+	app_state = &appState{dir: dir}
+
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.Use(service.home_access)
+	router.HandleFunc("/state/{app}", service.app_state_list).Methods("GET")
+	router.HandleFunc("/state/{app}/{key}", service.app_state_get).Methods("GET")
+	router.HandleFunc("/state/{app}/{key}", service.app_state_put).Methods("PUT")
+	router.HandleFunc("/state/{app}/{key}", service.app_state_delete).Methods("DELETE")
+	serve := func(method, target, token, body string, headers ...string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			request.Header.Set(USER_TOKEN_HEADER, token)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			request.Header.Set(headers[i], headers[i+1])
+		}
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	put := serve("PUT", "/state/photos/view", "ana-token", `{"grid": true}`)
+	etag := put.Header().Get("ETag")
+	if put.Code != 200 || etag == "" {
+		t.Fatalf("Not saved: %d %s", put.Code, put.Body.String())
+	}
+	serve("PUT", "/state/photos/last_folder", "ana-token", `"/Pictures/2018"`)
+	serve("PUT", "/state/photos/view", "", `{"grid": false}`)
+
+	get := serve("GET", "/state/photos/view", "ana-token", "")
+	var entry stateEntry
+	json.Unmarshal(get.Body.Bytes(), &entry)
+	if get.Code != 200 || string(entry.Value) != `{"grid":true}` || get.Header().Get("ETag") != etag {
+		t.Errorf("Wrong value: %d %s", get.Code, get.Body.String())
+	}
+	if get := serve("GET", "/state/photos/view", "ana-token", "", "If-None-Match", etag); get.Code != 304 {
+		t.Errorf("Sent again: %d", get.Code)
+	}
+	// each user has their own, and the HDA its own
+	if get := serve("GET", "/state/photos/view", "bob-token", ""); get.Code != 404 {
+		t.Errorf("Value of another user: %d %s", get.Code, get.Body.String())
+	}
+	if get := serve("GET", "/state/photos/view", "", ""); !strings.Contains(get.Body.String(), "false") {
+		t.Errorf("Wrong shared value: %s", get.Body.String())
+	}
+
+	// a device with an old value does not overwrite a newer one
+	if put := serve("PUT", "/state/photos/view", "ana-token", `{"grid": false}`, "If-Match", etag); put.Code != 200 {
+		t.Errorf("Not changed: %d", put.Code)
+	}
+	if put := serve("PUT", "/state/photos/view", "ana-token", `{"grid": true}`, "If-Match", etag); put.Code != 412 {
+		t.Errorf("Overwritten: %d", put.Code)
+	}
+
+	since := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+	serve("PUT", "/state/photos/sort", "ana-token", `"name"`)
+	list := serve("GET", "/state/photos", "ana-token", "")
+	entries := make(map[string]stateEntry)
+	json.Unmarshal(list.Body.Bytes(), &entries)
+	if list.Code != 200 || len(entries) != 3 {
+		t.Errorf("Wrong list: %s", list.Body.String())
+	}
+	list = serve("GET", "/state/photos?since="+url.QueryEscape(since.Format(time.RFC3339Nano)), "ana-token", "")
+	entries = make(map[string]stateEntry)
+	json.Unmarshal(list.Body.Bytes(), &entries)
+	if len(entries) != 1 || string(entries["sort"].Value) != `"name"` {
+		t.Errorf("Wrong changes: %s", list.Body.String())
+	}
+
+	if del := serve("DELETE", "/state/photos/sort", "ana-token", ""); del.Code != 204 {
+		t.Errorf("Not removed: %d", del.Code)
+	}
+	if del := serve("DELETE", "/state/photos/sort", "ana-token", ""); del.Code != 404 {
+		t.Errorf("Removed twice: %d", del.Code)
+	}
+
+	for _, c := range []struct {
+		method, target, body string
+		status               int
+	}{{"PUT", "/state/photos/view", "not json", 400}, {"PUT", "/state/.photos/view", "1", 400},
+		{"PUT", "/state/photos/view", `"` + strings.Repeat("a", APP_STATE_MAX_VALUE) + `"`, 400},
+		{"GET", "/state/photos?since=yesterday", "", 400}, {"GET", "/state/photos/view", "", 401}} {
+		token := "ana-token"
+		if c.status == 401 {
+			token = "wrong"
+		}
+		if response := serve(c.method, c.target, token, c.body); response.Code != c.status {
+			t.Errorf("%d instead of %d for %s %s", response.Code, c.status, c.method, c.target)
+		}
+	}
+}
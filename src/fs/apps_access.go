@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net/http"
+)
+
+// apps.access in the config has, by vhost, who may use an app: the users
+// of the home folders and the child profiles, by name, like {"router.hda":
+// ["ann"], "jellyfin.hda": ["ann", "bob", "emma"]}. the apps left out are
+// for everyone. a request for an app is by the profile of its
+// Profile-Token header, or else by the user of its User-Token, the tokens
+// of the files. they are only taken from the headers, as the query is the
+// app's, and are not passed on to the app. a restricted app answers 401
+// without a token, and 403 to those not in its list. /apps only lists the
+// apps the client can use
+
+// app_allowed says if name, a user or a profile, can use the app of vhost.
+// "" is for the clients without a token
+func app_allowed(vhost, name string) bool {
+	names, restricted := config.Apps.Access[vhost]
+	if !restricted {
+		return true
+	}
+	for _, allowed := range names {
+		if name != "" && allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// app_client is who an app request is by, with ok false for a token that
+// is not known
+func app_client(header http.Header) (name string, ok bool) {
+	if token := header.Get(PROFILE_TOKEN_HEADER); token != "" {
+		profile := parental_profile(token)
+		if profile == nil {
+			return "", false
+		}
+		return profile.name, true
+	}
+	if token := header.Get(USER_TOKEN_HEADER); token != "" {
+		user := home_user(token)
+		if profile := user_parental_profile(user); profile != nil {
+			return profile.name, true
+		}
+		return user, user != ""
+	}
+	return "", true
+}
+
+// api_client is who an API request is by, from the tokens found by the
+// middlewares
+func api_client(request *http.Request) string {
+	if profile := parental_profile_of(request); profile != nil {
+		return profile.name
+	}
+	return home_user_of(request)
+}
+
+// app_access_denied answers the requests for the app of vhost by those who
+// cannot use it, and says if it did
+func (service *MercuryFsService) app_access_denied(writer http.ResponseWriter, request *http.Request, vhost string) bool {
+	name, ok := app_client(request.Header)
+	request.Header.Del(PROFILE_TOKEN_HEADER)
+	request.Header.Del(USER_TOKEN_HEADER)
+	status, message := 0, ""
+	switch {
+	case !ok:
+		status, message = http.StatusUnauthorized, "invalid token"
+	case app_allowed(vhost, name):
+		return false
+	case name == "":
+		status, message = http.StatusUnauthorized, "a token is needed for this app"
+	default:
+		status, message = http.StatusForbidden, "not allowed to use this app"
+	}
+	size := json_response(writer, status, map[string]string{"error": message})
+	service.debug_info.requestServed(size)
+	log("App %s: \"%s %s\" %d %d \"%s\"", vhost, request.Method, pathForLog(request.URL), status, size, request.Header.Get("User-Agent"))
+	return true
+}
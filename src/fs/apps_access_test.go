@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAppsAccess(t *testing.T) {
+	saved_config := config
+	defer func() { config = saved_config }()
+	config = default_config()
+	config.Homes.Users = map[string]string{"ann": "ann-token", "bob": "bob-token"}
+	config.Parental.Profiles = map[string]parentalProfile{"emma": {Token: "emma-token", MaxRating: "PG"}}
+	config.Apps.Access = map[string][]string{"router.hda": {"ann"}, "media.hda": {"ann", "emma"}}
+	app := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// the tokens stay on the HDA
+		if request.Header.Get(USER_TOKEN_HEADER) != "" || request.Header.Get(PROFILE_TOKEN_HEADER) != "" {
+			writer.WriteHeader(http.StatusTeapot)
+		}
+	}))
+	defer app.Close()
+	config.Apps.Upstreams = map[string]string{"router.hda": app.URL, "media.hda": app.URL, "notes.hda": app.URL}
+	service := &MercuryFsService{api_router: mux.NewRouter(), debug_info: new(debugInfo)}
+
+	for _, c := range []struct {
+		vhost, user, profile string
+		status               int
+	}{
+		{"notes.hda", "", "", 200},
+		{"notes.hda", "bob-token", "", 200},
+		{"router.hda", "", "", 401},
+		{"router.hda", "nope", "", 401},
+		{"router.hda", "", "emma-token", 403},
+		{"router.hda", "bob-token", "", 403},
+		{"router.hda", "ann-token", "", 200},
+		// the profile is who uses the app
+		{"router.hda", "ann-token", "emma-token", 403},
+		{"media.hda", "", "emma-token", 200},
+		{"media.hda", "", "", 401},
+	} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("User-Agent", "Vhost/"+c.vhost)
+		if c.user != "" {
+			request.Header.Set(USER_TOKEN_HEADER, c.user)
+		}
+		if c.profile != "" {
+			request.Header.Set(PROFILE_TOKEN_HEADER, c.profile)
+		}
+		service.top_vhost_filter(recorder, request)
+		if recorder.Code != c.status {
+			t.Errorf("%d instead of %d for %s by %q %q: %s", recorder.Code, c.status, c.vhost, c.user, c.profile, recorder.Body.String())
+		}
+	}
+
+	// the apps listed are those that can be used
+	apps := &HdaApps{Apps: []*HdaApp{{Name: "Media", Vhost: "media.hda"}, {Name: "Notes", Vhost: "notes.hda"}, {Name: "Router", Vhost: "router.hda"}}}
+	for client, expected := range map[string][]string{
+		"":     {"hda", "notes.hda"},
+		"emma": {"hda", "media.hda", "notes.hda"},
+		"ann":  {"hda", "media.hda", "notes.hda", "router.hda"},
+	} {
+		var listed []map[string]interface{}
+		json.Unmarshal([]byte(apps.to_json(client)), &listed)
+		vhosts := []string{}
+		for _, app := range listed {
+			vhosts = append(vhosts, app["vhost"].(string))
+		}
+		if len(vhosts) != len(expected) {
+			t.Errorf("Wrong apps for %q: %v", client, vhosts)
+			continue
+		}
+		for i := range expected {
+			if vhosts[i] != expected[i] {
+				t.Errorf("Wrong apps for %q: %v", client, vhosts)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the apps are checked every apps.check_interval of the config, 1m by
+// default, with a GET of the top of their vhost, through the proxy's
+// transport, that has to answer within apps.check_timeout. /apps has with
+// each app whether it is reachable, the status and latency of the last
+// check, and when it was made, so that the clients can grey out the apps
+// that are down. an app answering with a 5xx, like the 503 of an Apache
+// whose app is stopped, is not reachable. the apps not checked yet, like
+// those just installed, are checked on the /apps that lists them
+
+const APP_HEALTH_JOB = "app-health"
+
+// appHealth is how an app was at its last check, in the entry of the app
+type appHealth struct {
+	Reachable bool      `json:"reachable"`
+	Status    int       `json:"status,omitempty"`
+	Latency   int64     `json:"latency_ms"`
+	Checked   time.Time `json:"checked"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type appsHealth struct {
+	// by vhost
+	checks map[string]*appHealth
+	sync.Mutex
+}
+
+var apps_health = &appsHealth{checks: make(map[string]*appHealth)}
+
+// probe_app checks the app of vhost
+func probe_app(vhost string) *appHealth {
+	health := &appHealth{Checked: time.Now()}
+	timeout, _ := time.ParseDuration(config.Apps.CheckTimeout)
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	remote, err := app_upstream(vhost)
+	var transport *http.Transport
+	if err == nil {
+		transport, err = app_transport()
+	}
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, "GET", remote.String(), nil)
+	request.Host = vhost
+	request.Header.Set("User-Agent", "Amahi-Anywhere-FS health check")
+	start := time.Now()
+	response, err := transport.RoundTrip(request)
+	health.Latency = time.Since(start).Milliseconds()
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	response.Body.Close()
+	health.Status = response.StatusCode
+	health.Reachable = response.StatusCode < 500
+	return health
+}
+
+// get is the last check of the app of vhost, nil when it was not checked
+func (this *appsHealth) get(vhost string) *appHealth {
+	this.Lock()
+	defer this.Unlock()
+	return this.checks[vhost]
+}
+
+// check checks apps, all at once, or only those not checked yet, and
+// forgets the apps that are gone when they are all checked
+func (this *appsHealth) check(apps []*HdaApp, all bool) string {
+	var wg sync.WaitGroup
+	var reachable, checked int
+	vhosts := make(map[string]bool)
+	for _, app := range apps {
+		vhosts[app.Vhost] = true
+		if !all && this.get(app.Vhost) != nil {
+			continue
+		}
+		checked++
+		wg.Add(1)
+		go func(vhost string) {
+			defer wg.Done()
+			health := probe_app(vhost)
+			this.Lock()
+			this.checks[vhost] = health
+			if health.Reachable {
+				reachable++
+			} else {
+				debug(3, "App %s is unreachable: %d %s", vhost, health.Status, health.Error)
+			}
+			this.Unlock()
+		}(app.Vhost)
+	}
+	wg.Wait()
+	if all {
+		this.Lock()
+		for vhost := range this.checks {
+			if !vhosts[vhost] {
+				delete(this.checks, vhost)
+			}
+		}
+		this.Unlock()
+	}
+	return fmt.Sprintf("%d of %d apps reachable", reachable, checked)
+}
+
+// job checks the apps of the HDA
+func (this *appsHealth) job() jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		apps, err := newHdaApps()
+		if err != nil {
+			return "", err
+		}
+		apps.RLock()
+		list := append([]*HdaApp{}, apps.Apps...)
+		apps.RUnlock()
+		return this.check(list, true), nil
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAppsHealth(t *testing.T) {
+	saved_config, saved_health := config, apps_health
+	defer func() { config, apps_health = saved_config, saved_health }()
+	config = default_config()
+	config.Apps.CheckTimeout = "500ms"
+	apps_health = &appsHealth{checks: make(map[string]*appHealth)}
+	up := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Host != "media.hda" {
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer up.Close()
+	stopped := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer stopped.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-request.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	config.Apps.Upstreams = map[string]string{"media.hda": up.URL, "router.hda": stopped.URL, "slow.hda": slow.URL, "gone.hda": gone.URL}
+	apps := &HdaApps{Apps: []*HdaApp{{Name: "Media", Vhost: "media.hda"}, {Name: "Router", Vhost: "router.hda"}, {Name: "Slow", Vhost: "slow.hda"}, {Name: "Gone", Vhost: "gone.hda"}}}
+
+	start := time.Now()
+	if summary := apps_health.check(apps.Apps, true); summary != "1 of 4 apps reachable" {
+		t.Errorf("Wrong summary: %s", summary)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("The checks waited for the slow app: %s", time.Since(start))
+	}
+	var listed []map[string]interface{}
+	json.Unmarshal([]byte(apps.to_json("")), &listed)
+	byVhost := make(map[string]map[string]interface{})
+	for _, app := range listed {
+		byVhost[app["vhost"].(string)] = app
+	}
+	if media := byVhost["media.hda"]; media["reachable"] != true || media["status"] != 200.0 || media["checked"] == nil || media["latency_ms"] == nil {
+		t.Errorf("Wrong media app: %v", media)
+	}
+	if router := byVhost["router.hda"]; router["reachable"] != false || router["status"] != 503.0 {
+		t.Errorf("Wrong router app: %v", router)
+	}
+	for _, vhost := range []string{"slow.hda", "gone.hda"} {
+		if app := byVhost[vhost]; app["reachable"] != false || app["error"] == nil {
+			t.Errorf("Wrong %s: %v", vhost, app)
+		}
+	}
+	if dashboard := byVhost["hda"]; dashboard == nil || dashboard["reachable"] != nil {
+		t.Errorf("Wrong dashboard: %v", dashboard)
+	}
+
+	// only the new apps are checked with the listing
+	checked := apps_health.get("media.hda").Checked
+	apps.Apps = append(apps.Apps[:2], &HdaApp{Name: "New", Vhost: "new.hda"})
+	config.Apps.Upstreams["new.hda"] = up.URL
+	if summary := apps_health.check(apps.Apps, false); summary != "1 of 1 apps reachable" {
+		t.Errorf("Wrong summary of the new apps: %s", summary)
+	}
+	if !apps_health.get("media.hda").Checked.Equal(checked) || apps_health.get("new.hda") == nil {
+		t.Errorf("Wrong apps checked")
+	}
+	// and the apps removed are forgotten
+	apps_health.check(apps.Apps, true)
+	if apps_health.get("slow.hda") != nil || apps_health.get("media.hda").Checked.Equal(checked) {
+		t.Errorf("Wrong checks after the apps changed")
+	}
+}
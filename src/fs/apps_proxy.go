@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the apps asked for with the User-Agent "Vhost/<vhost>" are proxied to
+// http://<vhost>, or to the URL of apps.upstreams in the config for it,
+// like {"jellyfin.hda": "https://localhost:8920"}. the certificates of the
+// https upstreams are checked with the system CAs and the one of
+// apps.ca_file, or not at all with apps.insecure, for the self-signed ones
+// most apps make. WebSockets are passed through to the app, ws or wss: as
+// HTTP/1.1 upgrades over the local server and the direct connections, and
+// over the relay as the extended CONNECT of HTTP/2 (RFC 8441). responses
+// are streamed as they come, like the server-sent events, not held back
+
+var errAppUpstream = errors.New("invalid app upstream")
+var errAppWebSocket = errors.New("the app did not take the WebSocket")
+
+// parse_upstream is the URL of an app, http or https
+func parse_upstream(target string) (*url.URL, error) {
+	remote, err := url.Parse(target)
+	if err != nil || (remote.Scheme != "http" && remote.Scheme != "https") || remote.Host == "" {
+		return nil, errAppUpstream
+	}
+	return remote, nil
+}
+
+// check_apps_config checks the upstreams and the checks of the config
+func check_apps_config(c *appsConfig) error {
+	for vhost, target := range c.Upstreams {
+		if _, err := parse_upstream(target); err != nil {
+			return fmt.Errorf("invalid upstream %q for %s", target, vhost)
+		}
+	}
+	for _, duration := range []string{c.CheckInterval, c.CheckTimeout} {
+		if d, err := time.ParseDuration(duration); duration != "" && (err != nil || d <= 0) {
+			return fmt.Errorf("invalid apps duration %q", duration)
+		}
+	}
+	return nil
+}
+
+// app_upstream is where the requests for vhost go
+func app_upstream(vhost string) (*url.URL, error) {
+	target := config.Apps.Upstreams[vhost]
+	if target == "" {
+		target = "http://" + vhost
+	}
+	return parse_upstream(target)
+}
+
+// the transport to the apps, made again when its TLS settings change
+var app_transports struct {
+	transport *http.Transport
+	key       string
+	sync.Mutex
+}
+
+// app_transport is the transport to the apps, with the TLS of the config
+func app_transport() (*http.Transport, error) {
+	key := config.Apps.CAFile
+	if config.Apps.Insecure {
+		key = "insecure"
+	}
+	app_transports.Lock()
+	defer app_transports.Unlock()
+	if app_transports.transport != nil && app_transports.key == key {
+		return app_transports.transport, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.Apps.Insecure}
+	if config.Apps.CAFile != "" && !config.Apps.Insecure {
+		pem, err := ioutil.ReadFile(config.Apps.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + config.Apps.CAFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	if app_transports.transport != nil {
+		app_transports.transport.CloseIdleConnections()
+	}
+	app_transports.transport, app_transports.key = transport, key
+	return transport, nil
+}
+
+// app_proxy is the proxy to an app at remote
+func app_proxy(remote *url.URL, transport *http.Transport) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(remote)
+	proxy.Transport = transport
+	proxy.ModifyResponse = harden_app_response
+	// what the app sent so far is sent on right away
+	proxy.FlushInterval = -1
+	return proxy
+}
+
+// is_websocket_connect says if request opens a WebSocket over HTTP/2
+func is_websocket_connect(request *http.Request) bool {
+	return request.Method == http.MethodConnect && strings.EqualFold(request.Header.Get(":protocol"), "websocket")
+}
+
+// is_upgrade says if request switches to another protocol, like a
+// WebSocket, over HTTP/1.1
+func is_upgrade(request *http.Request) bool {
+	for _, value := range request.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return request.Header.Get("Upgrade") != ""
+			}
+		}
+	}
+	return false
+}
+
+// the headers of a WebSocket over HTTP/2 that are not passed to the app,
+// which gets those of an HTTP/1.1 upgrade instead, with the pseudo headers
+var websocket_hop_headers = map[string]bool{
+	"Connection": true, "Upgrade": true, "Sec-Websocket-Key": true, "Sec-Websocket-Accept": true,
+	"Keep-Alive": true, "Te": true, "Trailer": true, "Transfer-Encoding": true,
+}
+
+// websocket_connect passes a WebSocket opened with the extended CONNECT of
+// HTTP/2 to the app at remote, as an HTTP/1.1 upgrade
+func websocket_connect(writer http.ResponseWriter, request *http.Request, remote *url.URL, transport *http.Transport) (int, error) {
+	target := *remote
+	target.Path = strings.TrimSuffix(remote.Path, "/") + request.URL.Path
+	target.RawQuery = request.URL.RawQuery
+	key := make([]byte, 16)
+	rand.Read(key)
+	upstream, _ := http.NewRequestWithContext(request.Context(), http.MethodGet, target.String(), nil)
+	for name, values := range request.Header {
+		if !websocket_hop_headers[http.CanonicalHeaderKey(name)] && !strings.HasPrefix(name, ":") {
+			upstream.Header[name] = values
+		}
+	}
+	upstream.Host = request.Host
+	upstream.Header.Set("Connection", "Upgrade")
+	upstream.Header.Set("Upgrade", "websocket")
+	upstream.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	if upstream.Header.Get("Sec-WebSocket-Version") == "" {
+		upstream.Header.Set("Sec-WebSocket-Version", "13")
+	}
+	response, err := transport.RoundTrip(upstream)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	conn, ok := response.Body.(io.ReadWriteCloser)
+	if response.StatusCode != http.StatusSwitchingProtocols || !ok {
+		response.Body.Close()
+		return http.StatusBadGateway, errAppWebSocket
+	}
+	defer conn.Close()
+	for name, values := range response.Header {
+		if !websocket_hop_headers[http.CanonicalHeaderKey(name)] {
+			writer.Header()[name] = values
+		}
+	}
+	writer.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(writer)
+	controller.Flush()
+	go func() {
+		io.Copy(conn, request.Body)
+		conn.Close()
+	}()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, werr := writer.Write(buf[:n]); werr != nil {
+				break
+			}
+			controller.Flush()
+		}
+		if err != nil {
+			break
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// serve_app proxies request to the app of vhost
+func (service *MercuryFsService) serve_app(writer http.ResponseWriter, request *http.Request, vhost string) {
+	remote, err := app_upstream(vhost)
+	var transport *http.Transport
+	if err == nil {
+		transport, err = app_transport()
+	}
+	if err != nil {
+		debug(2, "Error proxying to %s: %s", vhost, err.Error())
+		http.Error(writer, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	if is_websocket_connect(request) {
+		if status, err := websocket_connect(writer, request, remote, transport); err != nil {
+			debug(2, "WebSocket to %s failed: %s", vhost, err.Error())
+			http.Error(writer, http.StatusText(status), status)
+		}
+		return
+	}
+	proxy := app_proxy(remote, transport)
+	if is_upgrade(request) {
+		// nothing to keep of a WebSocket
+		proxy.ServeHTTP(writer, request)
+		return
+	}
+	app_cache.serve(writer, request, vhost, proxy)
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// appsPipeWriter is the stream of an HTTP/2 response, as a pipe
+type appsPipeWriter struct {
+	header http.Header
+	status int
+	*io.PipeWriter
+}
+
+func (this *appsPipeWriter) Header() http.Header    { return this.header }
+func (this *appsPipeWriter) WriteHeader(status int) { this.status = status }
+func (this *appsPipeWriter) Flush()                 {}
+
+func TestAppsProxy(t *testing.T) {
+	saved_config := config
+	defer func() { config = saved_config }()
+	config = default_config()
+	release := make(chan bool)
+	app := http.NewServeMux()
+	app.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("hello " + request.Host))
+	})
+	app.HandleFunc("/ws", func(writer http.ResponseWriter, request *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(writer, request, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			kind, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(kind, append([]byte("echo "), message...))
+		}
+	})
+	app.HandleFunc("/stream", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("first\n"))
+		writer.(http.Flusher).Flush()
+		<-release
+		writer.Write([]byte("last\n"))
+	})
+	plain := httptest.NewServer(app)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(app)
+	defer secure.Close()
+	config.Apps.Upstreams = map[string]string{"plain.hda": plain.URL, "secure.hda": secure.URL}
+
+	service := &MercuryFsService{api_router: mux.NewRouter(), debug_info: new(debugInfo)}
+	front := httptest.NewServer(http.HandlerFunc(service.top_vhost_filter))
+	defer front.Close()
+	get := func(vhost, path string) (int, string) {
+		request, _ := http.NewRequest("GET", front.URL+path, nil)
+		request.Header.Set("User-Agent", "Vhost/"+vhost)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("No answer: %s", err)
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+
+	// the certificate of an https app is checked
+	if code, body := get("plain.hda", "/"); code != 200 || body != "hello plain.hda" {
+		t.Errorf("Wrong plain app: %d %q", code, body)
+	}
+	if code, _ := get("secure.hda", "/"); code != 502 {
+		t.Errorf("Self-signed app not refused: %d", code)
+	}
+	dir, _ := ioutil.TempDir("", "apps")
+	defer os.RemoveAll(dir)
+	config.Apps.CAFile = filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(config.Apps.CAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw}), 0644)
+	if code, body := get("secure.hda", "/"); code != 200 || body != "hello secure.hda" {
+		t.Errorf("Wrong app with its CA: %d %q", code, body)
+	}
+	config.Apps.CAFile = ""
+	config.Apps.Insecure = true
+	if code, _ := get("secure.hda", "/"); code != 200 {
+		t.Errorf("Insecure app refused: %d", code)
+	}
+	config.Apps.Upstreams["bad.hda"] = "ftp://hda"
+	if code, _ := get("bad.hda", "/"); code != 502 {
+		t.Errorf("Wrong upstream: %d", code)
+	}
+	if check_apps_config(&config.Apps) == nil {
+		t.Errorf("Wrong upstream in the config")
+	}
+
+	// WebSockets, to ws and wss apps
+	for _, vhost := range []string{"plain.hda", "secure.hda"} {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(front.URL, "http")+"/ws", http.Header{"User-Agent": {"Vhost/" + vhost}})
+		if err != nil {
+			t.Errorf("No WebSocket to %s: %s", vhost, err)
+			continue
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("hi"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, message, err := conn.ReadMessage(); err != nil || string(message) != "echo hi" {
+			t.Errorf("Wrong echo from %s: %q %v", vhost, message, err)
+		}
+		conn.Close()
+	}
+
+	// responses come as the app sends them
+	request, _ := http.NewRequest("GET", front.URL+"/stream", nil)
+	request.Header.Set("User-Agent", "Vhost/plain.hda")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("No stream: %s", err)
+	}
+	defer response.Body.Close()
+	first := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(response.Body).ReadString('\n')
+		first <- line
+	}()
+	select {
+	case line := <-first:
+		if line != "first\n" {
+			t.Errorf("Wrong first line: %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("The stream was held back")
+	}
+	close(release)
+
+	// a WebSocket over HTTP/2, with an extended CONNECT
+	in_reader, in_writer := io.Pipe()
+	out_reader, out_writer := io.Pipe()
+	connect, _ := http.NewRequest("CONNECT", "https://secure.hda/ws", in_reader)
+	connect.Header.Set(":protocol", "websocket")
+	connect.Header.Set("Sec-WebSocket-Version", "13")
+	writer := &appsPipeWriter{header: make(http.Header), PipeWriter: out_writer}
+	go func() {
+		service.serve_app(writer, connect, "secure.hda")
+		out_writer.Close()
+	}()
+	// a masked text frame, "hi", and the echo, not masked
+	in_writer.Write([]byte{0x81, 0x82, 1, 2, 3, 4, 'h' ^ 1, 'i' ^ 2})
+	frame := make([]byte, 9)
+	if _, err := io.ReadFull(out_reader, frame); err != nil || string(frame) != "\x81\x07echo hi" || writer.status != 200 {
+		t.Errorf("Wrong echo over HTTP/2: %d %q %v", writer.status, frame, err)
+	}
+	in_writer.Close()
+	io.Copy(ioutil.Discard, out_reader)
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// the users arrange their folders on the HDA, so that all their devices
+// show them the same way: files and folders pinned to the top, in their
+// order, and the sort of the folder, like "-mtime" for the newest first.
+// PUT /files/arrangement?s=<share>&p=<folder> sets them, and the listings
+// of the folder have the place of the pinned entries as "pinned", from 1,
+// and the sort in X-Sort. each user, known by the User-Token of the home
+// folders, has their own; the requests without one share those of the HDA.
+// they are kept in ARRANGEMENTS_DIR, a file by user, and the pins of files
+// that are gone are left out of the listings
+
+const ARRANGEMENTS_DIR = DATA_DIR + "/arrangements"
+const ARRANGEMENT_MAX_PINS = 100
+
+// the sort of a folder, in the header of its listings
+const SORT_HEADER = "X-Sort"
+
+// the sorts of a folder, and the reverse ones with a "-"
+var arrangement_sorts = map[string]bool{"name": true, "mtime": true, "size": true, "type": true}
+
+var errArrangementSort = errors.New("sort must be name, mtime, size or type, with a - for the reverse order")
+var errArrangementPins = errors.New("pinned must be up to 100 different names of files in the folder")
+
+type arrangement struct {
+	Sort   string   `json:"sort,omitempty"`
+	Pinned []string `json:"pinned,omitempty"`
+}
+
+// check says if the arrangement can be kept
+func (this *arrangement) check() error {
+	if this.Sort != "" && !arrangement_sorts[strings.TrimPrefix(this.Sort, "-")] {
+		return errArrangementSort
+	}
+	if len(this.Pinned) > ARRANGEMENT_MAX_PINS {
+		return errArrangementPins
+	}
+	seen := make(map[string]bool, len(this.Pinned))
+	for _, name := range this.Pinned {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") || seen[name] {
+			return errArrangementPins
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// pins is the place of the pinned names, from 1
+func (this *arrangement) pins() map[string]int {
+	if len(this.Pinned) == 0 {
+		return nil
+	}
+	pins := make(map[string]int, len(this.Pinned))
+	for i, name := range this.Pinned {
+		pins[name] = i + 1
+	}
+	return pins
+}
+
+// the arrangements of a user, by share and folder
+type userArrangements map[string]map[string]*arrangement
+
+type folderArrangements struct {
+	dir string
+	sync.Mutex
+}
+
+var arrangements = &folderArrangements{dir: ARRANGEMENTS_DIR}
+
+func (this *folderArrangements) file(user string) string {
+	if user == "" {
+		user = APP_STATE_SHARED
+	}
+	return filepath.Join(this.dir, user+".json")
+}
+
+// read is the arrangements of user. call with the lock held
+func (this *folderArrangements) read(user string) (userArrangements, error) {
+	all := make(userArrangements)
+	data, err := ioutil.ReadFile(this.file(user))
+	if os.IsNotExist(err) {
+		return all, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return all, json.Unmarshal(data, &all)
+}
+
+// arrangement_folder is the folder of a path, the same for the same folder
+func arrangement_folder(folder string) string {
+	return path.Clean("/" + folder)
+}
+
+// get is the arrangement of a folder for user, empty if there is none
+func (this *folderArrangements) get(user, share, folder string) *arrangement {
+	this.Lock()
+	defer this.Unlock()
+	all, err := this.read(user)
+	if err != nil {
+		debug(2, "Error reading the arrangements of %q: %s", user, err.Error())
+		return &arrangement{}
+	}
+	if arranged := all[share][arrangement_folder(folder)]; arranged != nil {
+		return arranged
+	}
+	return &arrangement{}
+}
+
+// set keeps the arrangement of a folder for user, removing it when empty
+func (this *folderArrangements) set(user, share, folder string, arranged *arrangement) error {
+	this.Lock()
+	defer this.Unlock()
+	all, err := this.read(user)
+	if err != nil {
+		return err
+	}
+	folder = arrangement_folder(folder)
+	if arranged.Sort == "" && len(arranged.Pinned) == 0 {
+		delete(all[share], folder)
+		if len(all[share]) == 0 {
+			delete(all, share)
+		}
+	} else {
+		if all[share] == nil {
+			all[share] = make(map[string]*arrangement)
+		}
+		all[share][folder] = arranged
+	}
+	file := this.file(user)
+	if len(all) == 0 {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(this.dir, 0700); err != nil {
+		return err
+	}
+	return write_file_atomic(file, data, 0600)
+}
+
+// arrangement_request checks the folder of a request of /files/arrangement,
+// answering it when it is not one
+func (service *MercuryFsService) arrangement_request(writer http.ResponseWriter, request *http.Request) (share, folder string, ok bool) {
+	q := request.URL.Query()
+	share, folder = q.Get("s"), q.Get("p")
+	full_path, err := service.fullPathToFile(share, folder)
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = os.Stat(full_path); err == nil && !fi.IsDir() {
+			err = errors.New("not a folder")
+		}
+	}
+	if err != nil {
+		size := json_response(writer, http.StatusNotFound, map[string]string{"error": err.Error()})
+		service.debug_info.requestServed(size)
+		log("\"%s %s\" 404 %d \"%s\"", request.Method, pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+		return "", "", false
+	}
+	return share, folder, true
+}
+
+// GET /files/arrangement has the arrangement of a folder
+func (service *MercuryFsService) get_arrangement(writer http.ResponseWriter, request *http.Request) {
+	share, folder, ok := service.arrangement_request(writer, request)
+	if !ok {
+		return
+	}
+	size := json_response(writer, http.StatusOK, arrangements.get(home_user_of(request), share, folder))
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+}
+
+// PUT /files/arrangement sets the arrangement of a folder, like
+// {"sort": "-mtime", "pinned": ["Current", "todo.txt"]}, and {} removes it
+func (service *MercuryFsService) put_arrangement(writer http.ResponseWriter, request *http.Request) {
+	share, folder, ok := service.arrangement_request(writer, request)
+	if !ok {
+		return
+	}
+	arranged := &arrangement{}
+	status := http.StatusOK
+	err := json.NewDecoder(io.LimitReader(request.Body, 64<<10)).Decode(arranged)
+	if err == nil {
+		err = arranged.check()
+	}
+	if err != nil {
+		status = http.StatusBadRequest
+	} else if err = arrangements.set(home_user_of(request), share, folder, arranged); err != nil {
+		log_error("Error saving the arrangement of %s in %s: %s", folder, share, err.Error())
+		status = http.StatusInternalServerError
+	}
+	var result interface{} = arranged
+	if err != nil {
+		result = map[string]string{"error": err.Error()}
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"PUT %s\" %d %d \"%s\"", pathForLog(request.URL), status, size, request.Header.Get("User-Agent"))
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArrangements(t *testing.T) {
+	saved_config, saved_arrangements := config, arrangements
+	defer func() { config, arrangements = saved_config, saved_arrangements }()
+	config = default_config()
+	config.Homes.Users = map[string]string{"ana": "ana-token"}
+	dir, _ := ioutil.TempDir("", "arrangements")
+	defer os.RemoveAll(dir)
+	arrangements = &folderArrangements{dir: filepath.Join(dir, "arrangements")}
+	share := filepath.Join(dir, "docs")
+	os.MkdirAll(filepath.Join(share, "Work", "Current"), 0755)
+	for _, name := range []string{"a.txt", "b.txt", "todo.txt"} {
+		ioutil.WriteFile(filepath.Join(share, "Work", name), []byte(name), 0644)
+	}
+
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Docs", path: share}}}, debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.Use(service.home_access)
+	router.HandleFunc("/files", service.serve_file).Methods("GET")
+	router.HandleFunc("/files/arrangement", service.get_arrangement).Methods("GET")
+	router.HandleFunc("/files/arrangement", service.put_arrangement).Methods("PUT")
+	serve := func(method, target, token, body string, headers ...string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			request.Header.Set(USER_TOKEN_HEADER, token)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			request.Header.Set(headers[i], headers[i+1])
+		}
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+	pinned := func(body string) map[string]int {
+		pins := make(map[string]int)
+		var entries []fileEntry
+		json.Unmarshal([]byte(body), &entries)
+		for _, entry := range entries {
+			pins[entry.Name] = entry.Pinned
+		}
+		return pins
+	}
+
+	before := serve("GET", "/files?s=Docs&p=/Work", "ana-token", "")
+	put := serve("PUT", "/files/arrangement?s=Docs&p=/Work/", "ana-token", `{"sort": "-mtime", "pinned": ["todo.txt", "Current", "gone.txt"]}`)
+	if put.Code != 200 {
+		t.Fatalf("Not arranged: %d %s", put.Code, put.Body.String())
+	}
+	listing := serve("GET", "/files?s=Docs&p=/Work", "ana-token", "")
+	pins := pinned(listing.Body.String())
+	if listing.Header().Get(SORT_HEADER) != "-mtime" || pins["todo.txt"] != 1 || pins["Current"] != 2 || pins["a.txt"] != 0 || len(pins) != 4 {
+		t.Errorf("Wrong arranged listing: %v %s", listing.Header(), listing.Body.String())
+	}
+	if listing.Header().Get("ETag") == before.Header().Get("ETag") {
+		t.Errorf("Same ETag for the arranged listing")
+	}
+	// the streamed listings have them too
+	stream := serve("GET", "/files?s=Docs&p=/Work", "ana-token", "", "Accept", "application/x-ndjson")
+	lines := 0
+	for scanner := bufio.NewScanner(stream.Body); scanner.Scan(); lines++ {
+		var entry fileEntry
+		json.Unmarshal(scanner.Bytes(), &entry)
+		if entry.Name == "Current" && entry.Pinned != 2 {
+			t.Errorf("Wrong streamed entry: %s", scanner.Text())
+		}
+	}
+	if lines != 4 || stream.Header().Get(SORT_HEADER) != "-mtime" {
+		t.Errorf("Wrong streamed listing: %d lines", lines)
+	}
+
+	// the folders of others are not arranged
+	if others := serve("GET", "/files?s=Docs&p=/Work", "", ""); others.Header().Get(SORT_HEADER) != "" || pinned(others.Body.String())["todo.txt"] != 0 {
+		t.Errorf("Arranged without a user: %v", others.Header())
+	}
+	var arranged arrangement
+	get := serve("GET", "/files/arrangement?s=Docs&p=/Work", "ana-token", "")
+	json.Unmarshal(get.Body.Bytes(), &arranged)
+	if arranged.Sort != "-mtime" || len(arranged.Pinned) != 3 {
+		t.Errorf("Wrong arrangement: %s", get.Body.String())
+	}
+
+	// an empty one removes it
+	serve("PUT", "/files/arrangement?s=Docs&p=/Work", "ana-token", `{}`)
+	if _, err := os.Stat(arrangements.file("ana")); !os.IsNotExist(err) {
+		t.Errorf("Arrangement not removed: %v", err)
+	}
+
+	for _, c := range []struct {
+		target, body string
+		status       int
+	}{{"/files/arrangement?s=Docs&p=/Work", `{"sort": "random"}`, 400},
+		{"/files/arrangement?s=Docs&p=/Work", `{"pinned": ["../a.txt"]}`, 400},
+		{"/files/arrangement?s=Docs&p=/Work", `{"pinned": ["a.txt", "a.txt"]}`, 400},
+		{"/files/arrangement?s=Docs&p=/Work/a.txt", `{"sort": "name"}`, 404},
+		{"/files/arrangement?s=Nope&p=/", `{"sort": "name"}`, 404}} {
+		if response := serve("PUT", c.target, "ana-token", c.body); response.Code != c.status {
+			t.Errorf("%d instead of %d for %s %s", response.Code, c.status, c.target, c.body)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// the artwork of the metadata is served by the HDA, so that clients that
+// cannot reach the providers still show posters. every image in metadata
+// gets an id, and is downloaded the first time it is asked for if the
+// prefetch job did not keep it already. smaller sizes are made on demand
+// and kept next to the originals, and expire with them
+
+// widths are rounded up to steps, so that there are few sizes of each image
+const ARTWORK_WIDTH_STEP = 160
+const ARTWORK_MAX_WIDTH = 1920
+const ARTWORK_QUALITY = 85
+
+// larger images are served as they are rather than decoded
+const ARTWORK_MAX_PIXELS = 40 << 20
+
+var errNoArtwork = errors.New("no such artwork")
+
+var artwork_id_pattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// artwork_id is the id of the image at url, as it is kept
+func artwork_id(u string) string {
+	return sha1string(u)
+}
+
+// remember_artwork notes the URL of an image, so it can be downloaded by id
+func (this *metadataPrefetch) remember_artwork(u string) string {
+	id := artwork_id(u)
+	this.Lock()
+	this.known[id] = u
+	this.Unlock()
+	return id
+}
+
+// local_artwork adds the local URLs of the images in metadata to it, as
+// local_artwork, by remote URL
+func (this *metadataPrefetch) local_artwork(metadata string) string {
+	urls := artwork_urls(metadata)
+	if len(urls) == 0 {
+		return metadata
+	}
+	merged := map[string]interface{}{}
+	if json.Unmarshal([]byte(metadata), &merged) != nil {
+		return metadata
+	}
+	local := make(map[string]string)
+	for _, u := range urls {
+		local[u] = "/md/artwork?id=" + this.remember_artwork(u)
+	}
+	merged["local_artwork"] = local
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return metadata
+	}
+	return string(data)
+}
+
+// cached_artwork finds the image of id that was kept, whatever its extension
+func (this *metadataPrefetch) cached_artwork(id string) string {
+	for _, ext := range []string{"", ".jpg", ".jpeg", ".png", ".gif", ".webp"} {
+		full_path := filepath.Join(this.artwork_dir, id+ext)
+		if exists(full_path) {
+			return full_path
+		}
+	}
+	return ""
+}
+
+// fetch_artwork returns where the image of id is kept, downloading it if it
+// is not here yet
+func (this *metadataPrefetch) fetch_artwork(id string) (string, error) {
+	if !artwork_id_pattern.MatchString(id) {
+		return "", errNoArtwork
+	}
+	if full_path := this.cached_artwork(id); full_path != "" {
+		return full_path, nil
+	}
+	this.Lock()
+	u, ok := this.known[id]
+	this.Unlock()
+	if !ok {
+		return "", errNoArtwork
+	}
+	full_path := this.artwork_path(u)
+	if err := this.download_artwork(u, full_path); err != nil {
+		return "", err
+	}
+	this.Lock()
+	this.artwork++
+	this.Unlock()
+	return full_path, nil
+}
+
+// artwork_width rounds a width up to a step, 0 for the original size
+func artwork_width(width int) int {
+	if width <= 0 {
+		return 0
+	}
+	width = (width + ARTWORK_WIDTH_STEP - 1) / ARTWORK_WIDTH_STEP * ARTWORK_WIDTH_STEP
+	if width > ARTWORK_MAX_WIDTH {
+		width = ARTWORK_MAX_WIDTH
+	}
+	return width
+}
+
+// resized_artwork returns the image at full_path at most width wide, as a
+// JPEG next to it, or the image itself if it is small enough or cannot be
+// decoded
+func resized_artwork(full_path string, width int) (string, error) {
+	ext := filepath.Ext(full_path)
+	resized := full_path[:len(full_path)-len(ext)] + "-w" + strconv.Itoa(width) + ".jpg"
+	if exists(resized) {
+		return resized, nil
+	}
+	file, err := os.Open(full_path)
+	if err != nil {
+		return "", err
+	}
+	config, _, err := image.DecodeConfig(file)
+	if err != nil || config.Width <= width || config.Width*config.Height > ARTWORK_MAX_PIXELS {
+		// small enough, or a format that is not known, like webp
+		file.Close()
+		return full_path, nil
+	}
+	file.Seek(0, 0)
+	img, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		return full_path, nil
+	}
+	height := config.Height * width / config.Width
+	if height < 1 {
+		height = 1
+	}
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, scale_image(img, width, height), &jpeg.Options{Quality: ARTWORK_QUALITY}); err != nil {
+		return "", err
+	}
+	if err := write_file_atomic(resized, buffer.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return resized, nil
+}
+
+// scale_image shrinks img to width by height, every pixel the average of the
+// ones it covers
+func scale_image(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, (x+1)*sw/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			offset := y*dst.Stride + x*4
+			for i := range sum {
+				dst.Pix[offset+i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// GET /md/artwork?id=<id>[&w=<width>] serves an image of the metadata,
+// downloading it if needed, at most width wide. u=<url> is the same as the
+// id of url
+func (service *MercuryFsService) serve_artwork(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	id := q.Get("id")
+	if u := q.Get("u"); id == "" && u != "" {
+		id = artwork_id(u)
+	}
+	width, _ := strconv.Atoi(q.Get("w"))
+	full_path, err := metadata_prefetch.fetch_artwork(id)
+	if err == nil {
+		if width = artwork_width(width); width > 0 {
+			full_path, err = resized_artwork(full_path, width)
+		}
+	}
+	if err != nil {
+		status := http.StatusNotFound
+		if err != errNoArtwork {
+			debug(2, "Error serving artwork %s: %s", id, err.Error())
+			status = http.StatusBadGateway
+		}
+		size := json_response(writer, status, map[string]string{"error": err.Error()})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" %d %d \"%s\"", query, status, size, ua)
+		return
+	}
+	file, err := os.Open(full_path)
+	if err != nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	defer file.Close()
+	fi, _ := file.Stat()
+	writer.Header().Set("Cache-Control", "max-age=86400, private")
+	http.ServeContent(writer, request, fi.Name(), fi.ModTime(), file)
+	service.debug_info.requestServed(fi.Size())
+	log("\"GET %s\" 200 %d \"%s\"", query, fi.Size(), ua)
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArtworkProxy(t *testing.T) {
+	poster := image.NewRGBA(image.Rect(0, 0, 400, 600))
+	for y := 0; y < 600; y++ {
+		for x := 0; x < 400; x++ {
+			poster.Set(x, y, color.RGBA{200, 100, 50, 255})
+		}
+	}
+	var encoded bytes.Buffer
+	png.Encode(&encoded, poster)
+	downloads := 0
+	provider := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		downloads++
+		writer.Header().Set("Content-Type", "image/png")
+		writer.Write(encoded.Bytes())
+	}))
+	defer provider.Close()
+
+	dir, _ := ioutil.TempDir("", "artwork")
+	defer os.RemoveAll(dir)
+	saved := metadata_prefetch
+	defer func() { metadata_prefetch = saved }()
+	metadata_prefetch = new_metadata_prefetch(filepath.Join(dir, "artwork"))
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+
+	metadata := metadata_prefetch.local_artwork(`{"title":"Up","poster":"` + provider.URL + `/up.png"}`)
+	var parsed struct {
+		Title        string
+		LocalArtwork map[string]string `json:"local_artwork"`
+	}
+	json.Unmarshal([]byte(metadata), &parsed)
+	local := parsed.LocalArtwork[provider.URL+"/up.png"]
+	if parsed.Title != "Up" || local != "/md/artwork?id="+artwork_id(provider.URL+"/up.png") {
+		t.Fatalf("Wrong local artwork: %s", metadata)
+	}
+
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		service.serve_artwork(recorder, httptest.NewRequest("GET", local+"&w=100", nil))
+		resized, err := jpeg.Decode(recorder.Body)
+		if recorder.Code != 200 || err != nil || resized.Bounds().Dx() != 160 || resized.Bounds().Dy() != 240 {
+			t.Fatalf("Wrong resized artwork: %d %v", recorder.Code, err)
+		}
+		if r, g, b, _ := resized.At(80, 120).RGBA(); r>>8 < 190 || g>>8 < 90 || g>>8 > 110 || b>>8 > 60 {
+			t.Errorf("Wrong colors: %d %d %d", r>>8, g>>8, b>>8)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	service.serve_artwork(recorder, httptest.NewRequest("GET", local, nil))
+	if recorder.Code != 200 || !bytes.Equal(recorder.Body.Bytes(), encoded.Bytes()) {
+		t.Errorf("Wrong original artwork: %d", recorder.Code)
+	}
+	if downloads != 1 {
+		t.Errorf("%d downloads instead of 1", downloads)
+	}
+
+	for _, target := range []string{
+		"/md/artwork?id=" + artwork_id("http://elsewhere/x.jpg"),
+		"/md/artwork?id=../../etc/passwd",
+		"/md/artwork?u=http://elsewhere/x.jpg",
+	} {
+		recorder := httptest.NewRecorder()
+		service.serve_artwork(recorder, httptest.NewRequest("GET", target, nil))
+		if recorder.Code != 404 {
+			t.Errorf("%d instead of 404 for %s", recorder.Code, target)
+		}
+	}
+}
+
+func TestArtworkWidth(t *testing.T) {
+	for width, rounded := range map[int]int{0: 0, -5: 0, 1: 160, 160: 160, 161: 320, 5000: ARTWORK_MAX_WIDTH} {
+		if got := artwork_width(width); got != rounded {
+			t.Errorf("artwork_width(%d) is %d instead of %d", width, got, rounded)
+		}
+	}
+}
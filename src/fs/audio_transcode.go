@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// music is transcoded for streaming over slow or metered connections when
+// asked with transcode=<format>-<kbit/s> on GET /files, like
+// transcode=mp3-192 or transcode=aac-128, and to MP3 for the clients that
+// said they cannot play the original. the first time, the transcode is sent
+// while ffmpeg makes it, so it cannot be seeked; once complete it is kept
+// and served like any file until it's not asked for in a while
+
+const AUDIO_CACHE_DIR = DATA_DIR + "/audio"
+const AUDIO_CACHE_TTL = 30 * 24 * time.Hour
+
+// what music is transcoded to when the client cannot play it
+const AUDIO_DEFAULT_TRANSCODE = "mp3-192"
+
+var errNoAudioEncoder = errors.New("no audio encoder")
+var errBadAudioTranscode = errors.New("bad audio transcode")
+
+type audioFormat struct {
+	codec     string
+	muxer     string
+	mime_type string
+}
+
+var audio_formats = map[string]audioFormat{
+	"mp3": {codec: "libmp3lame", muxer: "mp3", mime_type: "audio/mpeg"},
+	"aac": {codec: "aac", muxer: "adts", mime_type: "audio/aac"},
+}
+
+var audio_bitrates = map[int]bool{64: true, 96: true, 128: true, 160: true, 192: true, 256: true, 320: true}
+
+type audioCache struct {
+	dir string
+	// the transcodes being kept, only one at a time for each
+	making map[string]bool
+	sync.Mutex
+}
+
+var audio_cache = new_audio_cache(AUDIO_CACHE_DIR)
+
+func new_audio_cache(dir string) *audioCache {
+	return &audioCache{dir: dir, making: make(map[string]bool)}
+}
+
+// encode_audio transcodes full_path into out, replaced in tests
+var encode_audio = ffmpeg_audio
+
+func ffmpeg_audio(ctx context.Context, full_path, format string, kbps int, out io.Writer) error {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return errNoAudioEncoder
+	}
+	f := audio_formats[format]
+	command := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-i", full_path, "-map", "0:a:0", "-vn",
+		"-c:a", f.codec, "-b:a", fmt.Sprintf("%dk", kbps), "-f", f.muxer, "-")
+	var stderr bytes.Buffer
+	command.Stdout, command.Stderr = out, &stderr
+	if err := command.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%s: %s", err.Error(), message)
+		}
+		return err
+	}
+	return nil
+}
+
+// parse_audio_transcode parses a transcode like mp3-192
+func parse_audio_transcode(transcode string) (string, int, error) {
+	parts := strings.SplitN(strings.ToLower(transcode), "-", 2)
+	if len(parts) != 2 {
+		return "", 0, errBadAudioTranscode
+	}
+	kbps, err := strconv.Atoi(parts[1])
+	if _, ok := audio_formats[parts[0]]; !ok || err != nil || !audio_bitrates[kbps] {
+		return "", 0, errBadAudioTranscode
+	}
+	return parts[0], kbps, nil
+}
+
+// audio_converter serves the file at full_path transcoded as asked with
+// transcode=, or to MP3
+func audio_converter(writer http.ResponseWriter, request *http.Request, full_path string) (int64, error) {
+	transcode := request.URL.Query().Get("transcode")
+	if transcode == "" {
+		transcode = AUDIO_DEFAULT_TRANSCODE
+	}
+	format, kbps, err := parse_audio_transcode(transcode)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(full_path)
+	if err != nil {
+		return 0, err
+	}
+	return audio_cache.serve(writer, request, full_path, fi, format, kbps)
+}
+
+func init() {
+	converters["audio/mpeg"] = audio_converter
+}
+
+// firstWriteWriter sets the headers of the answer when the first bytes are
+// written, so that nothing is answered if there are none
+type firstWriteWriter struct {
+	writer  http.ResponseWriter
+	headers func(header http.Header)
+	count   int64
+}
+
+func (this *firstWriteWriter) Write(data []byte) (int, error) {
+	if this.count == 0 && len(data) > 0 {
+		this.headers(this.writer.Header())
+		this.writer.WriteHeader(http.StatusOK)
+	}
+	n, err := this.writer.Write(data)
+	this.count += int64(n)
+	return n, err
+}
+
+// serve sends the transcode of full_path, from the cache or as it's made
+func (this *audioCache) serve(writer http.ResponseWriter, request *http.Request, full_path string, fi os.FileInfo, format string, kbps int) (int64, error) {
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%s\x00%d", full_path, fi.Size(), fi.ModTime().UnixNano(), format, kbps)
+	cached := filepath.Join(this.dir, sha1string(key)+"."+format)
+	mime_type := audio_formats[format].mime_type
+	if file, err := os.Open(cached); err == nil {
+		defer file.Close()
+		// kept as long as it's asked for
+		now := time.Now()
+		os.Chtimes(cached, now, now)
+		cfi, _ := file.Stat()
+		writer.Header().Set("Content-Type", mime_type)
+		writer.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
+		http.ServeContent(writer, request, "", fi.ModTime(), file)
+		return cfi.Size(), nil
+	}
+
+	out := &firstWriteWriter{writer: writer, headers: func(header http.Header) {
+		header.Set("Content-Type", mime_type)
+		header.Set("Cache-Control", "no-cache")
+		header.Del("Content-Length")
+	}}
+	var target io.Writer = out
+	// kept as it's made, if no one else is doing it
+	this.Lock()
+	keep := !this.making[cached]
+	this.making[cached] = true
+	this.Unlock()
+	var tmp *os.File
+	if keep {
+		defer func() {
+			this.Lock()
+			delete(this.making, cached)
+			this.Unlock()
+		}()
+		if err := os.MkdirAll(this.dir, 0755); err == nil {
+			tmp, _ = ioutil.TempFile(this.dir, ".transcode-")
+		}
+		if tmp != nil {
+			target = io.MultiWriter(out, tmp)
+		}
+	}
+	err := encode_audio(request.Context(), full_path, format, kbps, target)
+	if tmp != nil {
+		tmp.Close()
+		if err != nil || out.count == 0 || os.Rename(tmp.Name(), cached) != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil && out.count == 0 {
+		return 0, err
+	}
+	if err != nil {
+		// the answer has started, the client sees a truncated file
+		debug(2, "Error transcoding %s: %s", full_path, err.Error())
+	}
+	return out.count, nil
+}
+
+// cleanup is a job removing the transcodes not asked for in a while
+func (this *audioCache) cleanup() jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		fis, err := ioutil.ReadDir(this.dir)
+		if os.IsNotExist(err) {
+			return "no transcodes", nil
+		} else if err != nil {
+			return "", err
+		}
+		removed := 0
+		for i, fi := range fis {
+			progress(int64(i), int64(len(fis)))
+			if time.Since(fi.ModTime()) >= AUDIO_CACHE_TTL && os.Remove(filepath.Join(this.dir, fi.Name())) == nil {
+				removed++
+			}
+		}
+		return fmt.Sprintf("%d of %d transcodes expired", removed, len(fis)), nil
+	}
+}
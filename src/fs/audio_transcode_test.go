@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAudioTranscode(t *testing.T) {
+	saved_cache, saved_encode := audio_cache, encode_audio
+	defer func() { audio_cache, encode_audio = saved_cache, saved_encode }()
+
+	dir, _ := ioutil.TempDir("", "audio")
+	defer os.RemoveAll(dir)
+	audio_cache = new_audio_cache(filepath.Join(dir, "cache"))
+	encoded := 0
+	encode_audio = func(ctx context.Context, full_path, format string, kbps int, out io.Writer) error {
+		encoded++
+		data, _ := ioutil.ReadFile(full_path)
+		fmt.Fprintf(out, "%s-%d:%s", format, kbps, data)
+		return nil
+	}
+	music := filepath.Join(dir, "Music")
+	os.MkdirAll(music, 0755)
+	ioutil.WriteFile(filepath.Join(music, "song.flac"), []byte("lossless"), 0644)
+	ioutil.WriteFile(filepath.Join(music, "notes.txt"), []byte("notes"), 0644)
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Music", path: music}}}, debug_info: new(debugInfo)}
+	get := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		service.serve_file(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+
+	for i := 0; i < 2; i++ {
+		response := get("/files?s=Music&p=/song.flac&transcode=mp3-128")
+		if response.Code != 200 || response.Body.String() != "mp3-128:lossless" || response.Header().Get("Content-Type") != "audio/mpeg" {
+			t.Fatalf("Wrong transcode: %d %q %s", response.Code, response.Body.String(), response.Header().Get("Content-Type"))
+		}
+	}
+	// the second time from the cache, which can be seeked
+	if encoded != 1 {
+		t.Errorf("Transcoded %d times", encoded)
+	}
+	request := httptest.NewRequest("GET", "/files?s=Music&p=/song.flac&transcode=mp3-128", nil)
+	request.Header.Set("Range", "bytes=8-")
+	recorder := httptest.NewRecorder()
+	service.serve_file(recorder, request)
+	if recorder.Code != 206 || recorder.Body.String() != "lossless" {
+		t.Errorf("Wrong range of a transcode: %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	if response := get("/files?s=Music&p=/song.flac&transcode=aac-96"); response.Body.String() != "aac-96:lossless" || response.Header().Get("Content-Type") != "audio/aac" {
+		t.Errorf("Wrong AAC transcode: %q", response.Body.String())
+	}
+	// the original when the transcode is not valid, or not for music
+	for _, target := range []string{"/files?s=Music&p=/song.flac&transcode=mp3-1000", "/files?s=Music&p=/song.flac&transcode=ogg-128"} {
+		if response := get(target); response.Body.String() != "lossless" {
+			t.Errorf("Wrong answer for %s: %q", target, response.Body.String())
+		}
+	}
+	if response := get("/files?s=Music&p=/notes.txt&transcode=mp3-128"); response.Body.String() != "notes" {
+		t.Errorf("Transcoded a text file: %q", response.Body.String())
+	}
+	encode_audio = func(ctx context.Context, full_path, format string, kbps int, out io.Writer) error {
+		return errNoAudioEncoder
+	}
+	if response := get("/files?s=Music&p=/song.flac&transcode=mp3-320"); response.Code != 200 || response.Body.String() != "lossless" {
+		t.Errorf("The original was not served without an encoder: %d %q", response.Code, response.Body.String())
+	}
+
+	if result, _ := audio_cache.cleanup()(func(done, total int64) {}); result != "0 of 2 transcodes expired" {
+		t.Errorf("Wrong cleanup: %s", result)
+	}
+}
@@ -0,0 +1,38 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// buffers bigger than this are left for the GC instead of going back to the pool,
+// so that one huge listing does not pin its memory forever
+const MAX_POOLED_BUFFER = 1 << 20
+
+var buffer_pool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// get_buffer returns an empty buffer from the pool with room for at least size bytes
+func get_buffer(size int) *bytes.Buffer {
+	buf := buffer_pool.Get().(*bytes.Buffer)
+	buf.Reset()
+	buf.Grow(size)
+	return buf
+}
+
+func put_buffer(buf *bytes.Buffer) {
+	if buf.Cap() > MAX_POOLED_BUFFER {
+		return
+	}
+	buffer_pool.Put(buf)
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clients declare what they can handle with a header like
+//
+//	X-Amahi-Capabilities: codecs=h264,aac,mkv; heic=1; thumb=512; preview=jpeg,webp
+//
+// and identify themselves with X-Amahi-Device, so that later requests from the
+// same device (e.g. from a video player that cannot add headers) are handled the same way
+const CAPABILITIES_HEADER = "X-Amahi-Capabilities"
+const DEVICE_HEADER = "X-Amahi-Device"
+
+const DEVICES_FILE = DATA_DIR + "/devices.json"
+
+type clientCapabilities struct {
+	Codecs         []string  `json:"codecs"`
+	Heic           bool      `json:"heic"`
+	MaxThumbnail   int       `json:"max_thumbnail"`
+	PreviewFormats []string  `json:"preview_formats"`
+	LastSeen       time.Time `json:"last_seen"`
+}
+
+// containers that every client can play, so they are never converted
+var universal_formats = map[string]bool{
+	"mp4": true, "m4v": true, "mov": true, "mp3": true, "aac": true, "m4a": true,
+}
+
+// converter serves the file at full_path converted to another format. it must only
+// return an error if nothing was written yet, so that the original can be served instead.
+// converters are registered in the converters map by the subsystems that can convert
+type converter func(writer http.ResponseWriter, request *http.Request, full_path string) (size int64, err error)
+
+// converters by target mime type
+var converters = make(map[string]converter)
+
+func parse_capabilities(header string) *clientCapabilities {
+	caps := new(clientCapabilities)
+	for _, field := range strings.Split(header, ";") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		switch key {
+		case "codecs":
+			caps.Codecs = split_list(value)
+		case "heic":
+			caps.Heic, _ = strconv.ParseBool(value)
+		case "thumb":
+			caps.MaxThumbnail, _ = strconv.Atoi(value)
+		case "preview":
+			caps.PreviewFormats = split_list(value)
+		}
+	}
+	return caps
+}
+
+func split_list(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (this *clientCapabilities) supports(codec string) bool {
+	for _, c := range this.Codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// conversion_for returns the mime type the file should be converted to for this
+// client, or "" if it should be served as is
+func (this *clientCapabilities) conversion_for(file_name string) string {
+	if this == nil {
+		// the client did not say anything, so do not second-guess it
+		return ""
+	}
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(file_name)), ".")
+	mime_type := getContentType(file_name)
+	switch {
+	case ext == "heic" || ext == "heif":
+		if !this.Heic {
+			return "image/jpeg"
+		}
+	case strings.HasPrefix(mime_type, "video/"):
+		if !universal_formats[ext] && !this.supports(ext) {
+			return "application/x-mpegURL"
+		}
+	case strings.HasPrefix(mime_type, "audio/"):
+		if !universal_formats[ext] && !this.supports(ext) {
+			return "audio/mpeg"
+		}
+	}
+	return ""
+}
+
+// deviceRegistry remembers the last capabilities declared by each device
+type deviceRegistry struct {
+	devices map[string]*clientCapabilities
+	file    string
+	sync.RWMutex
+}
+
+var device_registry *deviceRegistry
+var device_registry_once sync.Once
+
+func devices() *deviceRegistry {
+	device_registry_once.Do(func() {
+		device_registry = new_device_registry(DEVICES_FILE)
+	})
+	return device_registry
+}
+
+func new_device_registry(file string) *deviceRegistry {
+	registry := &deviceRegistry{devices: make(map[string]*clientCapabilities), file: file}
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &registry.devices)
+		if err != nil {
+			log_error("Error reading devices file %s: %s", file, err.Error())
+		}
+	}
+	return registry
+}
+
+// capabilities returns the capabilities of the client making the request,
+// or nil if it never declared them
+func (this *deviceRegistry) capabilities(request *http.Request) *clientCapabilities {
+	device := request.Header.Get(DEVICE_HEADER)
+	header := request.Header.Get(CAPABILITIES_HEADER)
+	if header == "" {
+		if device == "" {
+			return nil
+		}
+		this.RLock()
+		defer this.RUnlock()
+		return this.devices[device]
+	}
+
+	caps := parse_capabilities(header)
+	// image formats advertised the standard way count too
+	if strings.Contains(request.Header.Get("Accept"), "image/heic") {
+		caps.Heic = true
+	}
+	if device != "" {
+		caps.LastSeen = time.Now()
+		this.Lock()
+		old := this.devices[device]
+		this.devices[device] = caps
+		changed := old == nil || !same_capabilities(old, caps)
+		this.Unlock()
+		if changed {
+			this.save()
+		}
+	}
+	return caps
+}
+
+func same_capabilities(a, b *clientCapabilities) bool {
+	return a.Heic == b.Heic && a.MaxThumbnail == b.MaxThumbnail &&
+		strings.Join(a.Codecs, ",") == strings.Join(b.Codecs, ",") &&
+		strings.Join(a.PreviewFormats, ",") == strings.Join(b.PreviewFormats, ",")
+}
+
+func (this *deviceRegistry) save() {
+	this.RLock()
+	data, err := json.Marshal(this.devices)
+	this.RUnlock()
+	if err == nil {
+		err = write_file_atomic(this.file, data, 0644)
+	}
+	if err != nil {
+		debug(2, "Error saving devices file %s: %s", this.file, err.Error())
+	}
+}
+
+// converter_for returns the converter to use for this request, if any.
+// clients can always ask for the original with original=1, and for music
+// transcoded with transcode=
+func converter_for(request *http.Request, full_path string) converter {
+	if request.URL.Query().Get("original") == "1" {
+		return nil
+	}
+	if request.URL.Query().Get("transcode") != "" && strings.HasPrefix(getContentType(full_path), "audio/") {
+		return audio_converter
+	}
+	target := devices().capabilities(request).conversion_for(full_path)
+	if target == "" {
+		return nil
+	}
+	return converters[target]
+}
+
+// GET /capabilities is what the HDA can do for the clients: the video
+// transcodes, with the backends that work, and the audio ones
+func (service *MercuryFsService) server_capabilities(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	formats := []string{}
+	for format := range audio_formats {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	bitrates := []int{}
+	for kbps := range audio_bitrates {
+		bitrates = append(bitrates, kbps)
+	}
+	sort.Ints(bitrates)
+	result := map[string]interface{}{
+		"version": VERSION,
+		"video":   transcoders.capabilities(),
+		"audio":   map[string]interface{}{"formats": formats, "bitrates": bitrates},
+	}
+	size := json_response(writer, http.StatusOK, result)
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
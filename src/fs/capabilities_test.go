@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	caps := parse_capabilities("codecs=h264, AAC ,mkv; heic=1; thumb=512; preview=jpeg,webp; bogus")
+	if len(caps.Codecs) != 3 || caps.Codecs[1] != "aac" {
+		t.Errorf("Wrong codecs: %v", caps.Codecs)
+	}
+	if !caps.Heic || caps.MaxThumbnail != 512 || len(caps.PreviewFormats) != 2 {
+		t.Errorf("Wrong capabilities: %#v", caps)
+	}
+}
+
+func TestConversionFor(t *testing.T) {
+	var unknown *clientCapabilities
+	if target := unknown.conversion_for("movie.mkv"); target != "" {
+		t.Errorf("Undeclared client should get the original, got %s", target)
+	}
+
+	caps := parse_capabilities("codecs=h264,aac,flac; heic=0")
+	tests := map[string]string{
+		"movie.mp4":  "",
+		"movie.mkv":  "application/x-mpegURL",
+		"song.flac":  "",
+		"song.wav":   "audio/mpeg",
+		"photo.HEIC": "image/jpeg",
+		"photo.jpg":  "",
+		"notes.txt":  "",
+	}
+	for name, expected := range tests {
+		if target := caps.conversion_for(name); target != expected {
+			t.Errorf("conversion_for(%s) = %q, expected %q", name, target, expected)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// content-defined chunking of the files in the folders listed in the
+// chunking section of the config, for big files that change a little at a
+// time, like office documents or VM images. files are cut with FastCDC, so
+// that an edit only changes the chunks around it, and chunks are named by
+// their SHA-256.
+//
+// to upload a new version, a client cuts it the same way, gets the chunks of
+// the current file (GET /files/chunks), uploads the chunks the server does
+// not have (PUT /files/chunks/data) and commits the list of chunks of the
+// new version (POST /files/chunks). the previous versions of these files
+// are kept as lists of chunks in .chunks at the top of the share, so that
+// the chunks they have in common are only stored once.
+//
+// FastCDC, as clients must do it: gear[i] is the first 8 bytes, big endian,
+// of the SHA-256 of the byte i. the hash starts at 0 after CHUNK_MIN bytes
+// and goes h = h<<1 + gear[byte]. before CHUNK_AVG bytes the chunk ends
+// after the byte where the top 18 bits of h are 0, after it where the top
+// 14 bits are, and at CHUNK_MAX bytes in any case
+
+const CHUNKS_DIR = ".chunks"
+const CHUNK_MANIFEST_EXT = ".chunks"
+
+const CHUNK_MIN = 16 << 10
+const CHUNK_AVG = 64 << 10
+const CHUNK_MAX = 256 << 10
+
+// chunks only referenced by uploads are kept this long
+const CHUNK_GRACE = 24 * time.Hour
+
+var chunk_mask_small = uint64(1<<18-1) << (64 - 18)
+var chunk_mask_large = uint64(1<<14-1) << (64 - 14)
+
+var gear = make_gear()
+
+var chunk_hash_pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+var errNotChunked = errors.New("not in a chunked folder")
+var errBadChunk = errors.New("chunk does not match its hash")
+
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+type chunkManifest struct {
+	ETag   string     `json:"etag,omitempty"`
+	Size   int64      `json:"size"`
+	Chunks []chunkRef `json:"chunks"`
+}
+
+func make_gear() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}
+
+// chunk_cut is where the first chunk of data ends
+func chunk_cut(data []byte) int {
+	n := len(data)
+	if n <= CHUNK_MIN {
+		return n
+	}
+	if n > CHUNK_MAX {
+		n = CHUNK_MAX
+	}
+	normal := CHUNK_AVG
+	if normal > n {
+		normal = n
+	}
+	var h uint64
+	i := CHUNK_MIN
+	for ; i < normal; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&chunk_mask_small == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&chunk_mask_large == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunk_stream cuts the data of reader into chunks, in order
+func chunk_stream(reader io.Reader, chunk func(data []byte) error) error {
+	buf := make([]byte, 2*CHUNK_MAX)
+	filled := 0
+	eof := false
+	for {
+		for !eof && filled < CHUNK_MAX {
+			n, err := reader.Read(buf[filled:])
+			filled += n
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if filled == 0 {
+			return nil
+		}
+		cut := chunk_cut(buf[:filled])
+		if err := chunk(buf[:cut]); err != nil {
+			return err
+		}
+		filled = copy(buf, buf[cut:filled])
+	}
+}
+
+func chunk_hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// chunked_folder says if the file at relative in share is in a folder whose
+// files are chunked
+func chunked_folder(share *HdaShare, relative string) bool {
+	for _, folder := range config.Chunking.Shares[share.name] {
+		folder = "/" + strings.Trim(folder, "/")
+		if folder == "/" || relative == folder || strings.HasPrefix(relative, folder+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// chunkStore is where the chunks of a share are kept
+type chunkStore struct {
+	dir string
+}
+
+func chunk_store(share *HdaShare) *chunkStore {
+	return &chunkStore{dir: filepath.Join(share.path, CHUNKS_DIR)}
+}
+
+func (this *chunkStore) path(hash string) string {
+	return filepath.Join(this.dir, "objects", hash[:2], hash)
+}
+
+func (this *chunkStore) has(hash string) bool {
+	return chunk_hash_pattern.MatchString(hash) && exists(this.path(hash))
+}
+
+// put keeps a chunk, if it's not there already
+func (this *chunkStore) put(hash string, data []byte) error {
+	if !chunk_hash_pattern.MatchString(hash) || chunk_hash(data) != hash {
+		return errBadChunk
+	}
+	if exists(this.path(hash)) {
+		// touch it, so that it's not collected right away
+		now := time.Now()
+		os.Chtimes(this.path(hash), now, now)
+		return nil
+	}
+	return write_file_atomic(this.path(hash), data, 0644)
+}
+
+// current_path is where the chunks of the current version of a file are
+// listed, so that they do not need to be cut again
+func (this *chunkStore) current_path(relative string, fi os.FileInfo) string {
+	key := fmt.Sprintf("%s\x00%d\x00%d", relative, fi.Size(), fi.ModTime().UnixNano())
+	return filepath.Join(this.dir, "files", sha1string(key)+".json")
+}
+
+// manifest of file, the current version of the file at relative
+func (this *chunkStore) manifest(relative, etag string, file *os.File, fi os.FileInfo) (*chunkManifest, error) {
+	manifest := new(chunkManifest)
+	if data, err := ioutil.ReadFile(this.current_path(relative, fi)); err == nil && json.Unmarshal(data, manifest) == nil {
+		manifest.ETag = etag
+		return manifest, nil
+	}
+	manifest = &chunkManifest{Chunks: []chunkRef{}}
+	err := chunk_stream(file, func(data []byte) error {
+		manifest.Chunks = append(manifest.Chunks, chunkRef{Hash: chunk_hash(data), Size: int64(len(data))})
+		manifest.Size += int64(len(data))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	this.remember(relative, fi, manifest)
+	manifest.ETag = etag
+	return manifest, nil
+}
+
+// remember keeps the chunks of the current version of a file
+func (this *chunkStore) remember(relative string, fi os.FileInfo, manifest *chunkManifest) {
+	data, err := json.Marshal(&chunkManifest{Size: manifest.Size, Chunks: manifest.Chunks})
+	if err == nil {
+		write_file_atomic(this.current_path(relative, fi), data, 0644)
+	}
+}
+
+// assemble writes the chunks of manifest to writer, from the store or from
+// current, a file with the chunks listed in current_manifest
+func (this *chunkStore) assemble(manifest *chunkManifest, current io.ReaderAt, current_manifest *chunkManifest, writer io.Writer) error {
+	offsets := make(map[string]int64)
+	if current != nil && current_manifest != nil {
+		offset := int64(0)
+		for _, chunk := range current_manifest.Chunks {
+			offsets[chunk.Hash] = offset
+			offset += chunk.Size
+		}
+	}
+	for _, chunk := range manifest.Chunks {
+		var data []byte
+		var err error
+		if offset, ok := offsets[chunk.Hash]; ok {
+			data = make([]byte, chunk.Size)
+			_, err = current.ReadAt(data, offset)
+		} else {
+			data, err = ioutil.ReadFile(this.path(chunk.Hash))
+		}
+		if err == nil && (int64(len(data)) != chunk.Size || chunk_hash(data) != chunk.Hash) {
+			err = errBadChunk
+		}
+		if err != nil {
+			return fmt.Errorf("chunk %s: %s", chunk.Hash, err.Error())
+		}
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// missing lists the chunks of manifest that are neither in the store nor
+// in current
+func (this *chunkStore) missing(manifest *chunkManifest, current *chunkManifest) []string {
+	have := make(map[string]bool)
+	if current != nil {
+		for _, chunk := range current.Chunks {
+			have[chunk.Hash] = true
+		}
+	}
+	missing := []string{}
+	for _, chunk := range manifest.Chunks {
+		if !have[chunk.Hash] && !this.has(chunk.Hash) {
+			missing = append(missing, chunk.Hash)
+			have[chunk.Hash] = true
+		}
+	}
+	return missing
+}
+
+// save_chunked_version cuts the file at full_path into the store, and lists
+// its chunks in the manifest at version
+func save_chunked_version(share *HdaShare, full_path, version string) error {
+	file, err := os.Open(full_path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	store := chunk_store(share)
+	manifest := &chunkManifest{Chunks: []chunkRef{}}
+	err = chunk_stream(file, func(data []byte) error {
+		hash := chunk_hash(data)
+		manifest.Chunks = append(manifest.Chunks, chunkRef{Hash: hash, Size: int64(len(data))})
+		manifest.Size += int64(len(data))
+		return store.put(hash, data)
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return write_file_atomic(version, data, 0644)
+}
+
+// assemble_version writes the version listed in manifest to path
+func assemble_version(share *HdaShare, manifest *chunkManifest, path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = chunk_store(share).assemble(manifest, nil, nil, file)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// read_chunk_manifest reads the manifest of a version
+func read_chunk_manifest(path string) (*chunkManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(chunkManifest)
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// chunk_gc is a job removing the chunks of the shares that no version uses
+func chunk_gc(shares *HdaShares) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		shares.RLock()
+		list := append([]*HdaShare{}, shares.Shares...)
+		shares.RUnlock()
+		removed, total := 0, 0
+		for _, share := range list {
+			store := chunk_store(share)
+			if !exists(store.dir) {
+				continue
+			}
+			used := make(map[string]bool)
+			filepath.Walk(filepath.Join(share.path, VERSIONS_DIR), func(path string, fi os.FileInfo, err error) error {
+				if err != nil || fi.IsDir() || !strings.HasSuffix(path, CHUNK_MANIFEST_EXT) {
+					return nil
+				}
+				if manifest, err := read_chunk_manifest(path); err == nil {
+					for _, chunk := range manifest.Chunks {
+						used[chunk.Hash] = true
+					}
+				}
+				return nil
+			})
+			filepath.Walk(filepath.Join(store.dir, "objects"), func(path string, fi os.FileInfo, err error) error {
+				if err != nil || fi.IsDir() {
+					return nil
+				}
+				total++
+				if !used[fi.Name()] && time.Since(fi.ModTime()) >= CHUNK_GRACE && os.Remove(path) == nil {
+					removed++
+				}
+				return nil
+			})
+			// the lists of the current versions are made again when needed
+			files, _ := ioutil.ReadDir(filepath.Join(store.dir, "files"))
+			for _, fi := range files {
+				if time.Since(fi.ModTime()) >= CHUNK_GRACE {
+					os.Remove(filepath.Join(store.dir, "files", fi.Name()))
+				}
+			}
+		}
+		return fmt.Sprintf("%d of %d chunks removed", removed, total), nil
+	}
+}
+
+// chunked_file opens a file in a chunked folder for the handlers, answering
+// the request itself when that's not possible
+func (service *MercuryFsService) chunked_file(writer http.ResponseWriter, request *http.Request) (*HdaShare, string, bool) {
+	q := request.URL.Query()
+	share := service.Shares.Get(q.Get("s"))
+	relative := filepath.ToSlash(filepath.Clean("/" + q.Get("p")))
+	if share == nil {
+		http.NotFound(writer, request)
+		return nil, "", false
+	}
+	if _, err := service.fullPathToFile(q.Get("s"), relative); is_path_limit(err) {
+		json_response(writer, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return nil, "", false
+	}
+	if relative == "/" || !chunked_folder(share, relative) {
+		json_response(writer, http.StatusForbidden, map[string]string{"error": errNotChunked.Error()})
+		return nil, "", false
+	}
+	return share, relative, true
+}
+
+// GET /files/chunks?s=<share>&p=<path> lists the chunks of a file
+func (service *MercuryFsService) file_chunks(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	share, relative, ok := service.chunked_file(writer, request)
+	if !ok {
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	file, fi, _ := service.open_share_file(writer, request)
+	if file == nil {
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	defer file.Close()
+	manifest, err := chunk_store(share).manifest(relative, file_etag(request.URL.Query().Get("p"), fi), file, fi)
+	if err != nil {
+		debug(2, "Error cutting %s into chunks: %s", file.Name(), err.Error())
+		writer.WriteHeader(http.StatusInternalServerError)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 500 0 \"%s\"", query, ua)
+		return
+	}
+	writer.Header().Set("ETag", manifest.ETag)
+	size := json_response(writer, http.StatusOK, manifest)
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
+
+// PUT /files/chunks/data?s=<share>&p=<path>&hash=<sha256> uploads a chunk
+func (service *MercuryFsService) upload_chunk(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status := http.StatusNoContent
+	var size int64
+	if no_upload {
+		status = http.StatusForbidden
+		size = json_response(writer, status, map[string]string{"error": "uploads are disabled"})
+	} else if share, _, ok := service.chunked_file(writer, request); !ok {
+		status = http.StatusNotFound
+	} else {
+		data, err := ioutil.ReadAll(io.LimitReader(request.Body, CHUNK_MAX+1))
+		if err == nil && len(data) > CHUNK_MAX {
+			err = errBadChunk
+		}
+		if err == nil {
+			err = chunk_store(share).put(request.URL.Query().Get("hash"), data)
+		}
+		if err != nil {
+			status = http.StatusInternalServerError
+			if err == errBadChunk {
+				status = http.StatusBadRequest
+			}
+			size = json_response(writer, status, map[string]string{"error": err.Error()})
+		} else {
+			writer.WriteHeader(status)
+		}
+	}
+	service.debug_info.requestServed(size)
+	log("\"PUT %s\" %d %d \"%s\"", query, status, size, ua)
+}
+
+// POST /files/chunks?s=<share>&p=<path> makes a new version of a file from
+// the list of its chunks in the body. if some are missing, it answers 409
+// with them. If-Match, when given, must be the etag of the current version
+func (service *MercuryFsService) commit_chunks(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	answer := func(status int, v interface{}) {
+		size := json_response(writer, status, v)
+		service.debug_info.requestServed(size)
+		log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+	}
+	if no_upload {
+		answer(http.StatusForbidden, map[string]string{"error": "uploads are disabled"})
+		return
+	}
+	share, relative, ok := service.chunked_file(writer, request)
+	if !ok {
+		service.debug_info.requestServed(int64(0))
+		log("\"POST %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	manifest := new(chunkManifest)
+	if err := json.NewDecoder(io.LimitReader(request.Body, DELTA_MAX_SIGNATURE)).Decode(manifest); err != nil {
+		answer(http.StatusBadRequest, map[string]string{"error": "bad list of chunks"})
+		return
+	}
+	size := int64(0)
+	for _, chunk := range manifest.Chunks {
+		if !chunk_hash_pattern.MatchString(chunk.Hash) || chunk.Size <= 0 || chunk.Size > CHUNK_MAX {
+			answer(http.StatusBadRequest, map[string]string{"error": "bad chunk " + chunk.Hash})
+			return
+		}
+		size += chunk.Size
+	}
+	if upload_too_big(size) {
+		answer(http.StatusRequestEntityTooLarge, map[string]string{"error": "the upload is too big"})
+		return
+	}
+
+	full_path := filepath.Join(share.path, relative)
+	store := chunk_store(share)
+	// the chunks of the current version are taken from it
+	var current *os.File
+	var current_manifest *chunkManifest
+	mode := os.FileMode(0644)
+	if fi, err := os.Lstat(full_path); err == nil {
+		if !fi.Mode().IsRegular() {
+			answer(http.StatusBadRequest, map[string]string{"error": "not a regular file"})
+			return
+		}
+		if if_match := request.Header.Get("If-Match"); if_match != "" && if_match != file_etag(request.URL.Query().Get("p"), fi) {
+			answer(http.StatusPreconditionFailed, map[string]string{"error": "the file changed"})
+			return
+		}
+		mode = fi.Mode().Perm()
+		if current, err = os.Open(full_path); err == nil {
+			defer current.Close()
+			current_manifest, _ = store.manifest(relative, "", current, fi)
+		}
+	}
+	if missing := store.missing(manifest, current_manifest); len(missing) > 0 {
+		answer(http.StatusConflict, map[string]interface{}{"error": "missing chunks", "missing": missing})
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(full_path), 0755); err != nil {
+		answer(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(full_path), ".chunks-")
+	if err != nil {
+		answer(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	err = store.assemble(manifest, current, current_manifest, tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err == nil {
+		keep_version(service.Shares, full_path)
+		err = os.Rename(tmp.Name(), full_path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		debug(2, "Error putting together %s from chunks: %s", full_path, err.Error())
+		answer(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	etag := ""
+	if fi, err := os.Stat(full_path); err == nil {
+		etag = file_etag(request.URL.Query().Get("p"), fi)
+		writer.Header().Set("ETag", etag)
+		// the list of chunks is known, no need to cut it again
+		manifest.Size = size
+		store.remember(relative, fi, manifest)
+	}
+	answer(http.StatusOK, map[string]interface{}{"size": size, "etag": etag})
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func chunk_list(t *testing.T, data []byte) []chunkRef {
+	chunks := []chunkRef{}
+	err := chunk_stream(bytes.NewReader(data), func(chunk []byte) error {
+		chunks = append(chunks, chunkRef{Hash: chunk_hash(chunk), Size: int64(len(chunk))})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("chunk_stream: %s", err)
+	}
+	return chunks
+}
+
+func TestChunkCut(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	chunks := chunk_list(t, data)
+	total := int64(0)
+	for i, chunk := range chunks {
+		if chunk.Size > CHUNK_MAX || (chunk.Size < CHUNK_MIN && i < len(chunks)-1) {
+			t.Errorf("Chunk %d has %d bytes", i, chunk.Size)
+		}
+		total += chunk.Size
+	}
+	if total != int64(len(data)) || len(chunks) < 8 {
+		t.Fatalf("Wrong chunks: %d of %d bytes", len(chunks), total)
+	}
+
+	// an insertion only changes the chunks around it
+	edited := append(append(append([]byte{}, data[:1<<20]...), "inserted"...), data[1<<20:]...)
+	known := make(map[string]bool)
+	for _, chunk := range chunks {
+		known[chunk.Hash] = true
+	}
+	changed := 0
+	for _, chunk := range chunk_list(t, edited) {
+		if !known[chunk.Hash] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 2 {
+		t.Errorf("%d chunks changed with an insertion", changed)
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	keep, shares := config.Versions.Keep, config.Chunking.Shares
+	defer func() { config.Versions.Keep, config.Chunking.Shares = keep, shares }()
+	config.Versions.Keep = 3
+	config.Chunking.Shares = map[string][]string{"Docs": {"/VMs"}}
+
+	dir, _ := ioutil.TempDir("", "chunked")
+	defer os.RemoveAll(dir)
+	share := &HdaShare{name: "Docs", path: dir}
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{share}}, debug_info: new(debugInfo)}
+	os.MkdirAll(filepath.Join(dir, "VMs"), 0755)
+	full_path := filepath.Join(dir, "VMs", "disk.img")
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	ioutil.WriteFile(full_path, data, 0644)
+
+	serve := func(method, target string, body []byte) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, target, bytes.NewReader(body))
+		switch {
+		case method == "GET":
+			service.file_chunks(recorder, request)
+		case method == "PUT":
+			service.upload_chunk(recorder, request)
+		default:
+			service.commit_chunks(recorder, request)
+		}
+		return recorder
+	}
+
+	if response := serve("GET", "/files/chunks?s=Docs&p=/notes.txt", nil); response.Code != 403 {
+		t.Errorf("Listed the chunks of a file outside the chunked folders: %d", response.Code)
+	}
+	response := serve("GET", "/files/chunks?s=Docs&p=/VMs/disk.img", nil)
+	current := new(chunkManifest)
+	if response.Code != 200 || json.Unmarshal(response.Body.Bytes(), current) != nil || current.Size != int64(len(data)) {
+		t.Fatalf("Wrong chunks of the file: %d %s", response.Code, response.Body.String())
+	}
+
+	// the new version changes the start of the file
+	edited := append([]byte("a new header"), data[10:]...)
+	manifest := &chunkManifest{Chunks: chunk_list(t, edited)}
+	body, _ := json.Marshal(manifest)
+	response = serve("POST", "/files/chunks?s=Docs&p=/VMs/disk.img", body)
+	var conflict struct {
+		Missing []string `json:"missing"`
+	}
+	if response.Code != 409 || json.Unmarshal(response.Body.Bytes(), &conflict) != nil || len(conflict.Missing) != 1 || conflict.Missing[0] != manifest.Chunks[0].Hash {
+		t.Fatalf("Wrong missing chunks: %d %s", response.Code, response.Body.String())
+	}
+	first := edited[:manifest.Chunks[0].Size]
+	if response := serve("PUT", "/files/chunks/data?s=Docs&p=/VMs/disk.img&hash="+strings.Repeat("0", 64), first); response.Code != 400 {
+		t.Errorf("Kept a chunk with the wrong hash: %d", response.Code)
+	}
+	if response := serve("PUT", "/files/chunks/data?s=Docs&p=/VMs/disk.img&hash="+conflict.Missing[0], first); response.Code != 204 {
+		t.Fatalf("Could not upload a chunk: %d %s", response.Code, response.Body.String())
+	}
+	if response := serve("POST", "/files/chunks?s=Docs&p=/VMs/disk.img", body); response.Code != 200 {
+		t.Fatalf("Could not commit the chunks: %d %s", response.Code, response.Body.String())
+	}
+	if got, _ := ioutil.ReadFile(full_path); !bytes.Equal(got, edited) {
+		t.Fatalf("Wrong new version of the file")
+	}
+
+	// the previous version is kept as a list of chunks
+	versions, _ := list_versions(share, "/VMs/disk.img")
+	if len(versions) != 1 || versions[0].Size != int64(len(data)) {
+		t.Fatalf("Wrong versions: %+v", versions)
+	}
+	if !exists(filepath.Join(versions_dir(share, "/VMs/disk.img"), versions[0].ID+CHUNK_MANIFEST_EXT)) {
+		t.Errorf("The previous version was not kept as chunks")
+	}
+	if result, err := chunk_gc(service.Shares)(func(done, total int64) {}); err != nil || !strings.HasPrefix(result, "0 of") {
+		t.Errorf("Collected chunks in use: %s %v", result, err)
+	}
+	if err := restore_version(share, "/VMs/disk.img", versions[0].ID); err != nil {
+		t.Fatalf("restore_version: %s", err)
+	}
+	if got, _ := ioutil.ReadFile(full_path); !bytes.Equal(got, data) {
+		t.Errorf("Restored the wrong contents")
+	}
+	versions, _ = list_versions(share, "/VMs/disk.img")
+	if len(versions) != 1 || versions[0].Size != int64(len(edited)) {
+		t.Errorf("Wrong versions after restoring: %+v", versions)
+	}
+}
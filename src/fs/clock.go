@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// some HDAs have a wrong clock. it is checked against the Date of the
+// answers of the platform and the relay, and against the NTP state of the
+// kernel, and reported in /hda_debug and the log when it's off. the times
+// that come from elsewhere, like the dates of signed S3 requests, and the
+// expiry of guest passes are checked against the clock corrected by the
+// skew found, within CLOCK_TOLERANCE
+
+const CLOCK_SAMPLES = 15
+const CLOCK_SKEW_WARNING = time.Minute
+const CLOCK_TOLERANCE = 15 * time.Minute
+
+type clockCheck struct {
+	// the latest differences between the time of the servers and ours
+	samples []time.Duration
+	warned  bool
+	sync.Mutex
+}
+
+var clock = new(clockCheck)
+
+// observe takes a sample of the skew from the Date of a response to a
+// request sent at sent
+func (this *clockCheck) observe(sent time.Time, response *http.Response) {
+	date, err := http.ParseTime(response.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	received := time.Now()
+	// the server answered about halfway, and the Date is rounded down to
+	// the second
+	local := sent.Add(received.Sub(sent) / 2)
+	sample := date.Add(500 * time.Millisecond).Sub(local)
+
+	this.Lock()
+	this.samples = append(this.samples, sample)
+	if len(this.samples) > CLOCK_SAMPLES {
+		this.samples = this.samples[len(this.samples)-CLOCK_SAMPLES:]
+	}
+	skew := this.median()
+	off := skew > CLOCK_SKEW_WARNING || skew < -CLOCK_SKEW_WARNING
+	warn := off && !this.warned
+	this.warned = off
+	this.Unlock()
+	if warn {
+		log_warn("the clock is off by %s, check NTP", skew.Round(time.Second))
+	}
+}
+
+func (this *clockCheck) median() time.Duration {
+	if len(this.samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, this.samples...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+	return sorted[len(sorted)/2]
+}
+
+// skew is how far behind the clock is, negative when ahead, and whether
+// it was measured at all
+func (this *clockCheck) skew() (time.Duration, bool) {
+	this.Lock()
+	defer this.Unlock()
+	return this.median(), len(this.samples) > 0
+}
+
+// now is the time, corrected by the skew
+func (this *clockCheck) now() time.Time {
+	skew, _ := this.skew()
+	return time.Now().Add(skew)
+}
+
+// trusted says if the clock is known to be right, either measured or
+// kept in sync by NTP
+func (this *clockCheck) trusted() bool {
+	if _, measured := this.skew(); measured {
+		return true
+	}
+	synchronized, _, known := ntp_state()
+	return known && synchronized
+}
+
+// within says if t, from elsewhere, is close enough to now
+func (this *clockCheck) within(t time.Time) bool {
+	d := this.now().Sub(t)
+	return d <= CLOCK_TOLERANCE && d >= -CLOCK_TOLERANCE
+}
+
+func (this *clockCheck) status() map[string]interface{} {
+	skew, measured := this.skew()
+	status := map[string]interface{}{}
+	if measured {
+		status["skew_seconds"] = skew.Seconds()
+	}
+	synchronized, max_error, known := ntp_state()
+	if known {
+		status["ntp_synchronized"] = synchronized
+		status["ntp_max_error_ms"] = max_error.Seconds() * 1000
+	}
+	switch {
+	case skew > CLOCK_SKEW_WARNING || skew < -CLOCK_SKEW_WARNING:
+		status["warning"] = fmt.Sprintf("the clock is off by %s", skew.Round(time.Second))
+	case known && !synchronized:
+		status["warning"] = "the clock is not kept in sync by NTP"
+	}
+	return status
+}
+
+// last_modified is mtime for Last-Modified, but never in the future, which
+// files made while the clock was ahead can be, and caches do not take
+func last_modified(mtime time.Time) time.Time {
+	if now := time.Now(); mtime.After(now) {
+		return now
+	}
+	return mtime
+}
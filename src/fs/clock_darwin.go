@@ -0,0 +1,19 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// ntp_state is not known here, only the skew against the platform is
+func ntp_state() (synchronized bool, max_error time.Duration, known bool) {
+	return false, 0, false
+}
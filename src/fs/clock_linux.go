@@ -0,0 +1,32 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// the clock state of adjtimex when it's not kept in sync
+const TIME_ERROR = 5
+const STA_UNSYNC = 0x40
+
+// ntp_state says if the kernel clock is kept in sync by NTP, with its
+// maximum error, and if that is known at all
+func ntp_state() (synchronized bool, max_error time.Duration, known bool) {
+	var tx syscall.Timex
+	// with no modes, it only reads the state
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return false, 0, false
+	}
+	synchronized = state != TIME_ERROR && tx.Status&STA_UNSYNC == 0
+	return synchronized, time.Duration(int64(tx.Maxerror)) * time.Microsecond, true
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+	saved := clock
+	defer func() { clock = saved }()
+	clock = new(clockCheck)
+
+	if _, measured := clock.skew(); measured {
+		t.Errorf("Skew without samples")
+	}
+	// the platform is an hour ahead
+	ahead := func() *http.Response {
+		response := &http.Response{Header: http.Header{}}
+		response.Header.Set("Date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		return response
+	}
+	for i := 0; i < 3; i++ {
+		clock.observe(time.Now(), ahead())
+	}
+	clock.observe(time.Now(), &http.Response{Header: http.Header{"Date": {"garbage"}}})
+	skew, measured := clock.skew()
+	if !measured || skew < time.Hour-2*time.Second || skew > time.Hour+2*time.Second {
+		t.Fatalf("Wrong skew: %s", skew)
+	}
+	if clock.status()["warning"] != "the clock is off by 1h0m0s" {
+		t.Errorf("Wrong status: %v", clock.status())
+	}
+	if !clock.trusted() || !clock.within(time.Now().Add(time.Hour)) || clock.within(time.Now()) {
+		t.Errorf("Times are not checked against the corrected clock")
+	}
+
+	// S3 requests are checked with it
+	request := httptest.NewRequest("GET", "/bucket/key", nil)
+	request.Header.Set("X-Amz-Date", time.Now().UTC().Format(S3_AMZ_DATE_FORMAT))
+	if s3_fresh(request) {
+		t.Errorf("A request an hour old is fresh")
+	}
+	request.Header.Set("X-Amz-Date", time.Now().Add(time.Hour).UTC().Format(S3_AMZ_DATE_FORMAT))
+	if !s3_fresh(request) {
+		t.Errorf("A request on time is not fresh")
+	}
+
+	// and so are guest passes
+	saved_passes := guest_passes
+	defer func() { guest_passes = saved_passes }()
+	dir, _ := ioutil.TempDir("", "clock")
+	defer os.RemoveAll(dir)
+	guest_passes = &guestPasses{file: filepath.Join(dir, "guest_passes.json")}
+	pass, token, err := guest_passes.issue("Ann", []string{"Movies"}, 2)
+	if err != nil || pass.Expires.Sub(time.Now()) < 170*time.Minute {
+		t.Fatalf("Wrong expiry: %v %v", pass, err)
+	}
+	// once the clock is fixed
+	clock = new(clockCheck)
+	if guest_passes.find(token) == nil {
+		t.Errorf("The pass expired early")
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	if !last_modified(past).Equal(past) {
+		t.Errorf("Past mtime changed")
+	}
+	if future := time.Now().Add(time.Hour); last_modified(future).After(time.Now()) {
+		t.Errorf("Last-Modified in the future")
+	}
+}
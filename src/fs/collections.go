@@ -0,0 +1,418 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// collections are saved searches, like "videos added in the last 30 days"
+// or "files over 1 GB", that are listed like folders with GET
+// /collections/{name}. they are evaluated against the index of the shares
+// every time, so they are always up to date, and only have the shares that
+// were indexed. a collection matches the files that have all of:
+//
+//   - share: in that share, or in any if empty
+//   - path: under that folder
+//   - type: of that mime type, or starting with it, like "video/"
+//   - contains: with that in their name, in any case
+//   - added_within, modified_within: put in the share, or changed, in the
+//     last "30d" or "12h"
+//   - min_size, max_size: in bytes
+//
+// the files are sorted by sort, "added", "mtime" or "size", the latest or
+// biggest first, or "name", and only the first limit are listed
+
+const COLLECTIONS_FILE = DATA_DIR + "/collections.json"
+const COLLECTION_LIMIT = 500
+const COLLECTION_MAX_LIMIT = 5000
+
+var errCollectionName = errors.New("invalid collection name")
+var errCollectionQuery = errors.New("invalid collection query")
+
+var collection_name_pattern = regexp.MustCompile(`^[\p{L}\p{N} _.-]{1,64}$`)
+
+type smartCollection struct {
+	Name           string    `json:"name"`
+	Share          string    `json:"share,omitempty"`
+	Path           string    `json:"path,omitempty"`
+	Type           string    `json:"type,omitempty"`
+	Contains       string    `json:"contains,omitempty"`
+	AddedWithin    string    `json:"added_within,omitempty"`
+	ModifiedWithin string    `json:"modified_within,omitempty"`
+	MinSize        int64     `json:"min_size,omitempty"`
+	MaxSize        int64     `json:"max_size,omitempty"`
+	Sort           string    `json:"sort,omitempty"`
+	Limit          int       `json:"limit,omitempty"`
+	Created        time.Time `json:"created"`
+}
+
+// collectionEntry is a file of a collection, listed like the files of a
+// directory, with where it is
+type collectionEntry struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+	Mtime    string `json:"mtime"`
+	Size     int64  `json:"size"`
+	Share    string `json:"share"`
+	Path     string `json:"path"`
+	added    time.Time
+	mtime    time.Time
+}
+
+type smartCollections struct {
+	file        string
+	collections map[string]*smartCollection
+	sync.Mutex
+}
+
+var collections = new_collections(COLLECTIONS_FILE)
+
+func new_collections(file string) *smartCollections {
+	return &smartCollections{file: file}
+}
+
+// parse_age parses a duration like "12h", or "30d" for days
+func parse_age(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil || days <= 0 {
+			return 0, errCollectionQuery
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(age)
+	if err != nil || duration <= 0 {
+		return 0, errCollectionQuery
+	}
+	return duration, nil
+}
+
+// validate checks a collection and cleans it up
+func (this *smartCollection) validate() error {
+	this.Name = strings.TrimSpace(this.Name)
+	if !collection_name_pattern.MatchString(this.Name) {
+		return errCollectionName
+	}
+	if this.Path != "" {
+		this.Path = path.Clean("/" + this.Path)
+	}
+	for _, age := range []string{this.AddedWithin, this.ModifiedWithin} {
+		if _, err := parse_age(age); age != "" && err != nil {
+			return err
+		}
+	}
+	switch this.Sort {
+	case "", "added", "mtime", "size", "name":
+	default:
+		return errCollectionQuery
+	}
+	if this.MinSize < 0 || this.MaxSize < 0 || this.Limit < 0 || this.Limit > COLLECTION_MAX_LIMIT {
+		return errCollectionQuery
+	}
+	return nil
+}
+
+// matcher is the test of the entries of the index for the collection
+func (this *smartCollection) matcher(now time.Time) func(entry *indexEntry) bool {
+	added, _ := parse_age(this.AddedWithin)
+	modified, _ := parse_age(this.ModifiedWithin)
+	contains := strings.ToLower(this.Contains)
+	return func(entry *indexEntry) bool {
+		switch {
+		case entry.IsDir:
+			return false
+		case this.Path != "" && this.Path != "/" && !strings.HasPrefix(entry.Path, this.Path+"/"):
+			return false
+		case this.Type != "" && entry.MimeType != this.Type && !(strings.HasSuffix(this.Type, "/") && strings.HasPrefix(entry.MimeType, this.Type)):
+			return false
+		case contains != "" && !strings.Contains(strings.ToLower(path.Base(entry.Path)), contains):
+			return false
+		case added > 0 && now.Sub(entry.Added) > added:
+			return false
+		case modified > 0 && now.Sub(entry.Mtime) > modified:
+			return false
+		case this.MinSize > 0 && entry.Size < this.MinSize:
+			return false
+		case this.MaxSize > 0 && entry.Size > this.MaxSize:
+			return false
+		}
+		return true
+	}
+}
+
+// load reads the collections the first time they are needed. call with the
+// lock held
+func (this *smartCollections) load() {
+	if this.collections != nil {
+		return
+	}
+	this.collections = make(map[string]*smartCollection)
+	data, err := ioutil.ReadFile(this.file)
+	if err != nil {
+		return
+	}
+	list := []*smartCollection{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		log_error("Error reading the collections in %s: %s", this.file, err.Error())
+		return
+	}
+	for _, collection := range list {
+		this.collections[collection.Name] = collection
+	}
+}
+
+// save writes the collections. call with the lock held
+func (this *smartCollections) save() error {
+	data, err := json.Marshal(this.sorted())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(this.file), 0755); err != nil {
+		return err
+	}
+	return write_file_atomic(this.file, data, 0644)
+}
+
+// sorted lists copies of the collections by name. call with the lock held
+func (this *smartCollections) sorted() []smartCollection {
+	list := make([]smartCollection, 0, len(this.collections))
+	for _, collection := range this.collections {
+		list = append(list, *collection)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (this *smartCollections) list() []smartCollection {
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	return this.sorted()
+}
+
+func (this *smartCollections) get(name string) *smartCollection {
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	if collection := this.collections[name]; collection != nil {
+		found := *collection
+		return &found
+	}
+	return nil
+}
+
+// put adds a collection, or replaces the one with the same name
+func (this *smartCollections) put(collection *smartCollection) error {
+	if err := collection.validate(); err != nil {
+		return err
+	}
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	collection.Created = time.Now()
+	if old := this.collections[collection.Name]; old != nil {
+		collection.Created = old.Created
+	}
+	this.collections[collection.Name] = collection
+	return this.save()
+}
+
+func (this *smartCollections) remove(name string) (bool, error) {
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	if this.collections[name] == nil {
+		return false, nil
+	}
+	delete(this.collections, name)
+	return true, this.save()
+}
+
+// evaluate lists the files of a collection, leaving out the ones hidden by
+// hide, by share
+func (this *smartCollection) evaluate(shares *HdaShares, hide func(share *HdaShare) listingFilter) ([]collectionEntry, error) {
+	shares.RLock()
+	list := []*HdaShare{}
+	for _, share := range shares.Shares {
+		// the home folders are private
+		if (this.Share == "" || share.name == this.Share) && !is_homes_share(share.name) {
+			list = append(list, share)
+		}
+	}
+	shares.RUnlock()
+	match := this.matcher(time.Now())
+	entries := []collectionEntry{}
+	for _, share := range list {
+		found, err := share_index.search(share.name, match)
+		if err != nil {
+			if this.Share != "" {
+				return nil, err
+			}
+			// the shares not indexed yet are left out
+			continue
+		}
+		hidden := hide(share)
+		for _, entry := range found {
+			name := path.Base(entry.Path)
+			if hidden != nil && hidden(name) {
+				continue
+			}
+			entries = append(entries, collectionEntry{
+				Name:     name,
+				MimeType: entry.MimeType,
+				Mtime:    entry.Mtime.UTC().Format(http.TimeFormat),
+				Size:     entry.Size,
+				Share:    share.name,
+				Path:     entry.Path,
+				added:    entry.Added,
+				mtime:    entry.Mtime,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := &entries[i], &entries[j]
+		switch this.Sort {
+		case "added":
+			if !a.added.Equal(b.added) {
+				return a.added.After(b.added)
+			}
+		case "mtime":
+			if !a.mtime.Equal(b.mtime) {
+				return a.mtime.After(b.mtime)
+			}
+		case "size":
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Share+a.Path < b.Share+b.Path
+	})
+	limit := this.Limit
+	if limit == 0 {
+		limit = COLLECTION_LIMIT
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+// GET /collections lists the collections
+func (service *MercuryFsService) collections_list(writer http.ResponseWriter, request *http.Request) {
+	size := json_response(writer, http.StatusOK, collections.list())
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+}
+
+// POST /collections saves a collection, with the fields of a collection as
+// form values
+func (service *MercuryFsService) collections_save(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	collection := &smartCollection{
+		Name:           request.FormValue("name"),
+		Share:          request.FormValue("share"),
+		Path:           request.FormValue("path"),
+		Type:           request.FormValue("type"),
+		Contains:       request.FormValue("contains"),
+		AddedWithin:    request.FormValue("added_within"),
+		ModifiedWithin: request.FormValue("modified_within"),
+		Sort:           request.FormValue("sort"),
+	}
+	var err error
+	for field, value := range map[string]*int64{"min_size": &collection.MinSize, "max_size": &collection.MaxSize} {
+		if v := request.FormValue(field); v != "" && err == nil {
+			if *value, err = strconv.ParseInt(v, 10, 64); err != nil {
+				err = errCollectionQuery
+			}
+		}
+	}
+	if v := request.FormValue("limit"); v != "" && err == nil {
+		if collection.Limit, err = strconv.Atoi(v); err != nil {
+			err = errCollectionQuery
+		}
+	}
+	if err == nil && collection.Share != "" && service.Shares.Get(collection.Share) == nil {
+		err = errCollectionQuery
+	}
+	if err == nil {
+		err = collections.put(collection)
+	}
+	status, result := http.StatusCreated, interface{}(collection)
+	if err != nil {
+		status = http.StatusInternalServerError
+		if err == errCollectionName || err == errCollectionQuery {
+			status = http.StatusBadRequest
+		}
+		result = map[string]string{"error": err.Error()}
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+}
+
+// GET /collections/{name} lists the files of a collection
+func (service *MercuryFsService) collection_files(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	collection := collections.get(mux.Vars(request)["name"])
+	if collection == nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	profile := parental_profile_of(request)
+	entries, err := collection.evaluate(service.Shares, profile.hide)
+	status, result := http.StatusOK, interface{}(entries)
+	if err != nil {
+		status, result = http.StatusServiceUnavailable, map[string]string{"error": err.Error()}
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" %d %d \"%s\"", query, status, size, ua)
+}
+
+// DELETE /collections/{name} removes a collection
+func (service *MercuryFsService) collections_remove(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status, size := http.StatusNoContent, int64(0)
+	found, err := collections.remove(mux.Vars(request)["name"])
+	switch {
+	case !found:
+		status = http.StatusNotFound
+		http.NotFound(writer, request)
+	case err != nil:
+		status = http.StatusInternalServerError
+		size = json_response(writer, status, map[string]string{"error": err.Error()})
+	default:
+		writer.WriteHeader(status)
+	}
+	service.debug_info.requestServed(size)
+	log("\"DELETE %s\" %d %d \"%s\"", query, status, size, ua)
+}
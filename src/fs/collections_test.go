@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollections(t *testing.T) {
+	saved := collections
+	defer func() { collections = saved }()
+
+	dir, _ := ioutil.TempDir("", "collections")
+	defer os.RemoveAll(dir)
+	collections = new_collections(filepath.Join(dir, "collections.json"))
+	videos := filepath.Join(dir, "Videos")
+	old := time.Now().Add(-90 * 24 * time.Hour)
+	for name, size := range map[string]int{"/new.mkv": 3000, "/Old/old.mp4": 2000, "/Old/notes.txt": 5000, "/big.mp4": 9000} {
+		full_path := filepath.Join(videos, name)
+		os.MkdirAll(filepath.Dir(full_path), 0755)
+		ioutil.WriteFile(full_path, bytes.Repeat([]byte("x"), size), 0644)
+		if strings.HasPrefix(name, "/Old/") {
+			os.Chtimes(full_path, old, old)
+		}
+	}
+	share_index.scan("CollectionVideos", videos, nil, nil, nil)
+	defer share_index.forget("CollectionVideos")
+
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "CollectionVideos", path: videos}}}, debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/collections", service.collections_list).Methods("GET")
+	router.HandleFunc("/collections", service.collections_save).Methods("POST")
+	router.HandleFunc("/collections/{name}", service.collection_files).Methods("GET")
+	router.HandleFunc("/collections/{name}", service.collections_remove).Methods("DELETE")
+	serve := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+	files := func(name string) []string {
+		response := serve("GET", "/collections/"+url.PathEscape(name), nil)
+		var entries []collectionEntry
+		if response.Code != 200 || json.Unmarshal(response.Body.Bytes(), &entries) != nil {
+			t.Fatalf("Could not list %s: %d %s", name, response.Code, response.Body.String())
+		}
+		paths := []string{}
+		for _, entry := range entries {
+			paths = append(paths, entry.Share+":"+entry.Path)
+		}
+		return paths
+	}
+
+	for _, bad := range []url.Values{
+		{"name": {"../x"}},
+		{"name": {"Recent"}, "added_within": {"soon"}},
+		{"name": {"Recent"}, "sort": {"random"}},
+		{"name": {"Recent"}, "min_size": {"big"}},
+		{"name": {"Recent"}, "share": {"Nope"}},
+	} {
+		if response := serve("POST", "/collections", bad); response.Code != 400 {
+			t.Errorf("%d instead of 400 for %v", response.Code, bad)
+		}
+	}
+	for _, good := range []url.Values{
+		{"name": {"Recent videos"}, "type": {"video/"}, "modified_within": {"30d"}, "sort": {"size"}},
+		{"name": {"Big"}, "min_size": {"2500"}, "sort": {"name"}, "limit": {"2"}},
+		{"name": {"Old"}, "share": {"CollectionVideos"}, "path": {"Old"}, "contains": {"OLD"}},
+	} {
+		if response := serve("POST", "/collections", good); response.Code != 201 {
+			t.Fatalf("Could not save %v: %d %s", good, response.Code, response.Body.String())
+		}
+	}
+
+	if got := strings.Join(files("Recent videos"), " "); got != "CollectionVideos:/big.mp4 CollectionVideos:/new.mkv" {
+		t.Errorf("Wrong recent videos: %s", got)
+	}
+	if got := strings.Join(files("Big"), " "); got != "CollectionVideos:/big.mp4 CollectionVideos:/new.mkv" {
+		t.Errorf("Wrong big files: %s", got)
+	}
+	if got := strings.Join(files("Old"), " "); got != "CollectionVideos:/Old/old.mp4" {
+		t.Errorf("Wrong old files: %s", got)
+	}
+
+	// they are kept
+	collections = new_collections(filepath.Join(dir, "collections.json"))
+	var list []smartCollection
+	json.Unmarshal(serve("GET", "/collections", nil).Body.Bytes(), &list)
+	if len(list) != 3 || list[0].Name != "Big" || list[1].Path != "/Old" {
+		t.Errorf("Wrong collections: %+v", list)
+	}
+	if response := serve("DELETE", "/collections/Big", nil); response.Code != 204 {
+		t.Errorf("Could not remove a collection: %d", response.Code)
+	}
+	if response := serve("GET", "/collections/Big", nil); response.Code != 404 {
+		t.Errorf("Listed a removed collection: %d", response.Code)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// the apps already installed keep working as the API changes. the released
+// versions of the Android and iOS apps, which are not updated everywhere,
+// send no X-Amahi-Capabilities, which came later, and are known by their
+// User-Agent, that of their HTTP library. what they depend on that changed
+// since is kept for them:
+//
+//   - they do not know X-Continuation, and would only show the first page
+//     of a big folder, so they get all of it at once
+//
+// and for all the clients, a path without its leading slash, like some of
+// them sent for the folders of a share, is taken from the top of the share,
+// not as the end of the name of the share's directory. compat.agents in the
+// config has more User-Agents of old apps, as regular expressions. the
+// requests of the released apps are in compat_test.go, so that a change
+// that breaks them is seen
+
+var legacy_agents = []*regexp.Regexp{
+	// the Android app, with OkHttp, and before it HttpURLConnection
+	regexp.MustCompile(`^okhttp/[23]\.`),
+	regexp.MustCompile(`^Dalvik/`),
+	// the iOS app, with Alamofire, and NSURLSession
+	regexp.MustCompile(`\bAlamofire/[1-4]\.`),
+	regexp.MustCompile(`^Amahi[^/]*/[0-9.]+ CFNetwork/`),
+}
+
+// check_compat_config checks the User-Agents of the config
+func check_compat_config(c *compatConfig) error {
+	for _, pattern := range c.Agents {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid compat agent %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// is_legacy_client says if request is from an app older than the current
+// API
+func is_legacy_client(request *http.Request) bool {
+	if request.Header.Get(CAPABILITIES_HEADER) != "" {
+		return false
+	}
+	ua := request.Header.Get("User-Agent")
+	if ua == "" {
+		return false
+	}
+	for _, agent := range legacy_agents {
+		if agent.MatchString(ua) {
+			return true
+		}
+	}
+	for _, pattern := range config.Compat.Agents {
+		if agent, err := regexp.Compile(pattern); err == nil && agent.MatchString(ua) {
+			return true
+		}
+	}
+	return false
+}
+
+// compat_shims is a middleware making the requests of older clients what
+// the current API expects
+func (service *MercuryFsService) compat_shims(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		q := request.URL.Query()
+		if p := q.Get("p"); p != "" && !strings.HasPrefix(p, "/") {
+			q.Set("p", "/"+p)
+			request.URL.RawQuery = q.Encode()
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
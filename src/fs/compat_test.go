@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the User-Agents of the released apps and of the players they use
+const (
+	ANDROID_AGENT   = "okhttp/3.10.0"
+	IOS_AGENT       = "Amahi/1.3 (org.amahi.Amahi; build:7; iOS 12.1.0) Alamofire/4.7.3"
+	AVPLAYER_AGENT  = "AppleCoreMedia/1.0.0.16B92 (iPhone; U; CPU OS 12_1 like Mac OS X; en_us)"
+	EXOPLAYER_AGENT = "ExoPlayerLib/2.8.4"
+)
+
+// legacyRequest is a request as a released app makes it, and what it
+// depends on in the answer
+type legacyRequest struct {
+	name    string
+	agent   string
+	method  string
+	target  string
+	headers map[string]string
+	status  int
+	check   func(t *testing.T, recorder *httptest.ResponseRecorder)
+}
+
+// the entries of a listing, as the apps read them
+func legacy_listing(t *testing.T, recorder *httptest.ResponseRecorder) map[string]map[string]interface{} {
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("Not a listing: %s", recorder.Body.String())
+	}
+	byName := make(map[string]map[string]interface{})
+	for _, entry := range entries {
+		for _, field := range []string{"name", "mime_type", "mtime", "size"} {
+			if _, ok := entry[field]; !ok {
+				t.Errorf("No %s in %v", field, entry)
+			}
+		}
+		if _, err := time.Parse(http.TimeFormat, entry["mtime"].(string)); err != nil {
+			t.Errorf("Wrong mtime: %v", entry["mtime"])
+		}
+		byName[entry["name"].(string)] = entry
+	}
+	return byName
+}
+
+func TestLegacyClients(t *testing.T) {
+	saved_config := config
+	defer func() { config = saved_config }()
+	config = default_config()
+	config.Listing.MaxEntries = 3
+	dir, _ := ioutil.TempDir("", "compat")
+	defer os.RemoveAll(dir)
+	movies := filepath.Join(dir, "Movies")
+	os.MkdirAll(filepath.Join(movies, "Kids"), 0755)
+	for _, name := range []string{"a.mkv", "b.mkv", "c.mkv", "d.mkv"} {
+		ioutil.WriteFile(filepath.Join(movies, name), []byte("0123456789"), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(movies, "Kids", "Up.mp4"), []byte("up"), 0644)
+	service, err := NewMercuryFSService(dir, "127.0.0.1:4563")
+	if err != nil {
+		t.Fatalf("No service: %s", err)
+	}
+	serve := func(agent, method, target string, headers map[string]string, body *bytes.Buffer) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		if body == nil {
+			body = new(bytes.Buffer)
+		}
+		request := httptest.NewRequest(method, target, body)
+		request.Header.Set("User-Agent", agent)
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		service.server.Handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	shares := serve(IOS_AGENT, "GET", "/shares", nil, nil)
+	requests := []legacyRequest{
+		{"shares", ANDROID_AGENT, "GET", "/shares", nil, 200, func(t *testing.T, recorder *httptest.ResponseRecorder) {
+			var listed []map[string]interface{}
+			json.Unmarshal(recorder.Body.Bytes(), &listed)
+			if len(listed) != 1 || listed[0]["name"] != "Movies" || listed[0]["mtime"] == nil || listed[0]["tags"] == nil {
+				t.Errorf("Wrong shares: %s", recorder.Body.String())
+			}
+		}},
+		{"shares again", IOS_AGENT, "GET", "/shares", map[string]string{"If-None-Match": shares.Header().Get("ETag")}, 304, nil},
+		{"top of a share", ANDROID_AGENT, "GET", "/files?s=Movies&p=", nil, 200, func(t *testing.T, recorder *httptest.ResponseRecorder) {
+			// all of the folder, whatever listing.max_entries is
+			entries := legacy_listing(t, recorder)
+			if len(entries) != 5 || entries["Kids"]["mime_type"] != "text/directory" || entries["a.mkv"]["size"] != 10.0 {
+				t.Errorf("Wrong listing: %v", entries)
+			}
+			if recorder.Header().Get(CONTINUATION_HEADER) != "" {
+				t.Errorf("Continuation for an old app")
+			}
+		}},
+		{"folder", IOS_AGENT, "GET", "/files?s=Movies&p=/", nil, 200, func(t *testing.T, recorder *httptest.ResponseRecorder) {
+			if entries := legacy_listing(t, recorder); len(entries) != 5 {
+				t.Errorf("Wrong listing: %v", entries)
+			}
+		}},
+		{"folder without a slash", ANDROID_AGENT, "GET", "/files?s=Movies&p=Kids", nil, 200, func(t *testing.T, recorder *httptest.ResponseRecorder) {
+			if entries := legacy_listing(t, recorder); len(entries) != 1 || entries["Up.mp4"] == nil {
+				t.Errorf("Wrong listing: %v", entries)
+			}
+		}},
+		{"file", ANDROID_AGENT, "GET", "/files?s=Movies&p=/a.mkv", nil, 200, func(t *testing.T, recorder *httptest.ResponseRecorder) {
+			if recorder.Body.String() != "0123456789" || recorder.Header().Get("Accept-Ranges") != "bytes" || recorder.Header().Get("ETag") == "" {
+				t.Errorf("Wrong file: %v %q", recorder.Header(), recorder.Body.String())
+			}
+		}},
+		{"player probe", AVPLAYER_AGENT, "GET", "/files?s=Movies&p=/a.mkv", map[string]string{"Range": "bytes=0-1"}, 206, func(t *testing.T, recorder *httptest.ResponseRecorder) {
+			if recorder.Body.String() != "01" || recorder.Header().Get("Content-Range") != "bytes 0-1/10" {
+				t.Errorf("Wrong probe: %v %q", recorder.Header(), recorder.Body.String())
+			}
+		}},
+		{"player", EXOPLAYER_AGENT, "GET", "/files?s=Movies&p=/a.mkv", map[string]string{"Range": "bytes=0-"}, 206, func(t *testing.T, recorder *httptest.ResponseRecorder) {
+			if recorder.Body.String() != "0123456789" || recorder.Header().Get("Content-Range") != "bytes 0-9/10" {
+				t.Errorf("Wrong range: %v %q", recorder.Header(), recorder.Body.String())
+			}
+		}},
+		{"player seek", AVPLAYER_AGENT, "GET", "/files?s=Movies&p=/a.mkv", map[string]string{"Range": "bytes=6-"}, 206, func(t *testing.T, recorder *httptest.ResponseRecorder) {
+			if recorder.Body.String() != "6789" {
+				t.Errorf("Wrong seek: %q", recorder.Body.String())
+			}
+		}},
+		{"missing file", IOS_AGENT, "GET", "/files?s=Movies&p=/nope.mkv", nil, 404, nil},
+		{"missing share", ANDROID_AGENT, "GET", "/files?s=Nope&p=/", nil, 404, nil},
+	}
+	for _, r := range requests {
+		recorder := serve(r.agent, r.method, r.target, r.headers, nil)
+		if recorder.Code != r.status {
+			t.Errorf("%s: %d instead of %d", r.name, recorder.Code, r.status)
+			continue
+		}
+		if r.check != nil {
+			r.check(t, recorder)
+		}
+	}
+
+	// the uploads and deletes, as multipart forms with the file in "file"
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, _ := writer.CreateFormFile("file", "photo.jpg")
+	part.Write([]byte("photo"))
+	writer.Close()
+	upload := serve(ANDROID_AGENT, "POST", "/files?s=Movies&p=/Kids", map[string]string{"Content-Type": writer.FormDataContentType()}, &form)
+	if data, _ := ioutil.ReadFile(filepath.Join(movies, "Kids", "photo.jpg")); upload.Code != 200 || string(data) != "photo" {
+		t.Errorf("Upload failed: %d", upload.Code)
+	}
+	if deleted := serve(IOS_AGENT, "DELETE", "/files?s=Movies&p=/Kids/photo.jpg", nil, nil); deleted.Code != 200 || exists(filepath.Join(movies, "Kids", "photo.jpg")) {
+		t.Errorf("Delete failed: %d", deleted.Code)
+	}
+
+	// the current apps get pages
+	paged := serve(IOS_AGENT, "GET", "/files?s=Movies&p=/", map[string]string{CAPABILITIES_HEADER: "thumb=512"}, nil)
+	if entries := legacy_listing(t, paged); len(entries) != 3 || paged.Header().Get(CONTINUATION_HEADER) == "" {
+		t.Errorf("No pages for a current app: %d", len(entries))
+	}
+	if serve("Mozilla/5.0", "GET", "/files?s=Movies&p=/", nil, nil).Header().Get(CONTINUATION_HEADER) == "" {
+		t.Errorf("No pages for a browser")
+	}
+	config.Compat.Agents = []string{`^AmahiTV/1\.`}
+	if legacy := serve("AmahiTV/1.0", "GET", "/files?s=Movies&p=/", nil, nil); legacy.Header().Get(CONTINUATION_HEADER) != "" {
+		t.Errorf("Pages for an app of the config")
+	}
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// the JSON of the API is gzipped on its way through the relay, for the
+// clients that take it, the apps on a slow uplink mostly waiting for
+// listings. other content types are left alone, the media served is
+// compressed already, and so is the LAN, where the CPU costs more than the
+// bytes. each response is gzipped on its own, with the stream of the
+// relay it goes on, as HTTP/2 has no compression of bodies. the ETag of a
+// gzipped response gets a -gzip suffix, which is taken off If-None-Match
+// before the handlers see it, like Apache does
+
+const COMPRESS_MIN_SIZE = 1024
+
+const COMPRESS_ETAG_SUFFIX = "-gzip"
+
+type compressStats struct {
+	compressed, plain   int64
+	bytes_in, bytes_out int64
+}
+
+var compress_stats = new(compressStats)
+
+var gzip_writers = sync.Pool{New: func() interface{} {
+	writer, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+	return writer
+}}
+
+// accepts_gzip says if the client of request takes gzip
+func accepts_gzip(request *http.Request) bool {
+	for _, value := range request.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(value, ",") {
+			parts := strings.Split(coding, ";")
+			if strings.TrimSpace(parts[0]) != "gzip" {
+				continue
+			}
+			// gzip;q=0 is a no
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// compressible says if a response with header is worth gzipping
+func compressible(status int, header http.Header) bool {
+	if status != http.StatusOK || header.Get("Content-Encoding") != "" {
+		return false
+	}
+	content_type := header.Get("Content-Type")
+	if !strings.HasPrefix(content_type, "application/json") && !strings.HasPrefix(content_type, "application/x-ndjson") {
+		return false
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < COMPRESS_MIN_SIZE {
+		return false
+	}
+	return true
+}
+
+// gzip_etag gives the ETag in header the suffix of the gzipped responses
+func gzip_etag(header http.Header) {
+	if etag := header.Get("ETag"); strings.HasSuffix(etag, "\"") && !strings.HasSuffix(etag, COMPRESS_ETAG_SUFFIX+"\"") {
+		header.Set("ETag", strings.TrimSuffix(etag, "\"")+COMPRESS_ETAG_SUFFIX+"\"")
+	}
+}
+
+// gzipWriter decides on the headers of the response whether to gzip it
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+	in      int64
+	out     *countingWriter
+	// whether the client revalidates a gzipped response
+	revalidates bool
+}
+
+func (this *gzipWriter) WriteHeader(status int) {
+	if this.decided {
+		return
+	}
+	this.decided = true
+	header := this.Header()
+	if compressible(status, header) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", "gzip")
+		gzip_etag(header)
+		this.gz = gzip_writers.Get().(*gzip.Writer)
+		this.out = &countingWriter{writer: this.ResponseWriter}
+		this.gz.Reset(this.out)
+	} else if status == http.StatusNotModified && this.revalidates {
+		gzip_etag(header)
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *gzipWriter) Write(data []byte) (int, error) {
+	if !this.decided {
+		this.WriteHeader(http.StatusOK)
+	}
+	if this.gz == nil {
+		return this.ResponseWriter.Write(data)
+	}
+	this.in += int64(len(data))
+	return this.gz.Write(data)
+}
+
+// Flush sends what is gzipped so far, for the streamed listings
+func (this *gzipWriter) Flush() {
+	if this.gz != nil {
+		this.gz.Flush()
+	}
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (this *gzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := this.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("cannot hijack")
+}
+
+func (this *gzipWriter) Unwrap() http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+// close finishes the gzip stream, if any
+func (this *gzipWriter) close() {
+	if this.gz == nil {
+		atomic.AddInt64(&compress_stats.plain, 1)
+		return
+	}
+	this.gz.Close()
+	this.gz.Reset(nil)
+	gzip_writers.Put(this.gz)
+	this.gz = nil
+	atomic.AddInt64(&compress_stats.compressed, 1)
+	atomic.AddInt64(&compress_stats.bytes_in, this.in)
+	atomic.AddInt64(&compress_stats.bytes_out, this.out.count)
+}
+
+func (this *compressStats) status() map[string]interface{} {
+	result := map[string]interface{}{
+		"enabled":    config.Relay.Compress,
+		"compressed": atomic.LoadInt64(&this.compressed),
+		"plain":      atomic.LoadInt64(&this.plain),
+		"bytes_in":   atomic.LoadInt64(&this.bytes_in),
+		"bytes_out":  atomic.LoadInt64(&this.bytes_out),
+	}
+	if in := atomic.LoadInt64(&this.bytes_in); in > 0 {
+		result["ratio"] = float64(atomic.LoadInt64(&this.bytes_out)) / float64(in)
+	}
+	return result
+}
+
+// compress_json is a middleware gzipping the JSON responses to the
+// requests of the relay that take it
+func (service *MercuryFsService) compress_json(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !config.Relay.Compress || !from_relay(request) || !accepts_gzip(request) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		// the response differs by encoding, for the caches on the way
+		writer.Header().Add("Vary", "Accept-Encoding")
+		gzip_writer := &gzipWriter{ResponseWriter: writer}
+		if inm := request.Header.Get("If-None-Match"); strings.Contains(inm, COMPRESS_ETAG_SUFFIX+"\"") {
+			request.Header.Set("If-None-Match", strings.Replace(inm, COMPRESS_ETAG_SUFFIX+"\"", "\"", -1))
+			gzip_writer.revalidates = true
+		}
+		defer gzip_writer.close()
+		next.ServeHTTP(gzip_writer, request)
+	})
+}
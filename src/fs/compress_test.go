@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for value, expected := range map[string]bool{
+		"":                     false,
+		"gzip":                 true,
+		"deflate, gzip;q=0.5":  true,
+		"br, gzip ; q=0":       false,
+		"identity":             false,
+		"x-gzip, deflate":      false,
+		"deflate,gzip;level=1": true,
+	} {
+		request := httptest.NewRequest("GET", "/shares", nil)
+		if value != "" {
+			request.Header.Set("Accept-Encoding", value)
+		}
+		if accepts_gzip(request) != expected {
+			t.Errorf("Wrong answer for %q", value)
+		}
+	}
+}
+
+func TestCompressJSON(t *testing.T) {
+	saved := config.Relay.Compress
+	defer func() { config.Relay.Compress = saved }()
+	config.Relay.Compress = true
+
+	listing := "[" + strings.Repeat(`{"name":"movie.mkv","size":1234},`, 100) + "{}]"
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	handler := service.compress_json(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, content_type := listing, "application/json"
+		switch request.URL.Path {
+		case "/small":
+			body = "{}"
+		case "/files":
+			content_type = "video/x-matroska"
+		}
+		writer.Header().Set("ETag", `"abc"`)
+		if request.Header.Get("If-None-Match") == `"abc"` {
+			writer.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writer.Header().Set("Content-Type", content_type)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		writer.Write([]byte(body))
+	}))
+	get := func(path string, relay bool, inm string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", path, nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+		if inm != "" {
+			request.Header.Set("If-None-Match", inm)
+		}
+		if relay {
+			request = mark_relay_request(request)
+		}
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	response := get("/shares", true, "")
+	if response.Header().Get("Content-Encoding") != "gzip" || response.Header().Get("Content-Length") != "" ||
+		response.Header().Get("ETag") != `"abc-gzip"` || response.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("Not gzipped: %v", response.Header())
+	}
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(reader)
+	if string(body) != listing || response.Body.Len() >= len(listing) {
+		t.Errorf("Wrong body, %d bytes", response.Body.Len())
+	}
+	// the gzipped one is revalidated
+	if response := get("/shares", true, `"abc-gzip"`); response.Code != 304 || response.Header().Get("ETag") != `"abc-gzip"` {
+		t.Errorf("Not revalidated: %d %v", response.Code, response.Header())
+	}
+
+	// and not the rest
+	for _, path := range []string{"/small", "/files"} {
+		if response := get(path, true, ""); response.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s gzipped", path)
+		}
+	}
+	if response := get("/shares", false, ""); response.Header().Get("Content-Encoding") != "" || response.Body.String() != listing {
+		t.Errorf("Gzipped on the LAN")
+	}
+	config.Relay.Compress = false
+	if response := get("/shares", true, ""); response.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Gzipped when turned off")
+	}
+	if status := compress_stats.status(); status["compressed"].(int64) < 1 || status["ratio"].(float64) >= 1 {
+		t.Errorf("Wrong status: %v", status)
+	}
+}
@@ -0,0 +1,520 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// fsConfig holds the optional settings read from CONFIG_FILE.
+// everything has a sensible default, so the file does not need to exist
+type fsConfig struct {
+	Sftp         sftpConfig         `json:"sftp"`
+	Scan         scanConfig         `json:"scan"`
+	S3           s3Config           `json:"s3"`
+	Ftp          ftpConfig          `json:"ftp"`
+	Relay        relayConfig        `json:"relay"`
+	Trash        trashConfig        `json:"trash"`
+	Versions     versionsConfig     `json:"versions"`
+	Snapshots    snapshotsConfig    `json:"snapshots"`
+	Metadata     metadataConfig     `json:"metadata"`
+	Listing      listingConfig      `json:"listing"`
+	Parental     parentalConfig     `json:"parental"`
+	Local        localConfig        `json:"local"`
+	Platform     platformConfig     `json:"platform"`
+	Chunking     chunkingConfig     `json:"chunking"`
+	Transcode    transcodeConfig    `json:"transcode"`
+	Tiering      tieringConfig      `json:"tiering"`
+	Homes        homesConfig        `json:"homes"`
+	Sync         syncConfig         `json:"sync"`
+	Limits       limitsConfig       `json:"limits"`
+	Headers      headersConfig      `json:"headers"`
+	Availability availabilityConfig `json:"availability"`
+	Direct       directConfig       `json:"direct"`
+	Logging      loggingConfig      `json:"logging"`
+	Downloads    downloadsConfig    `json:"downloads"`
+	AccessLog    accessLogConfig    `json:"access_log"`
+	Debug        debugConfig        `json:"debug"`
+	Power        powerConfig        `json:"power"`
+	AppCache     appCacheConfig     `json:"app_cache"`
+	Apps         appsConfig         `json:"apps"`
+	Admin        adminConfig        `json:"admin"`
+	Shadow       shadowConfig       `json:"shadow"`
+	Export       exportConfig       `json:"export"`
+	Symlinks     symlinksConfig     `json:"symlinks"`
+	Compat       compatConfig       `json:"compat"`
+	// the shares, instead of those of the settings DB, and the address of
+	// the HDA on the local network, "" to look it up
+	Shares    []shareConfig `json:"shares"`
+	LocalAddr string        `json:"local_addr"`
+	// more tags for the shares, by name, like {"Videos": ["movies"]}
+	ShareTags map[string][]string `json:"share_tags"`
+	// ignore uploads and deletes silently, like -nu and -nd
+	NoUpload bool `json:"no_upload"`
+	NoDelete bool `json:"no_delete"`
+}
+
+// the User-Agents of more apps older than the current API, as regular
+// expressions, to keep what they depend on for them
+type compatConfig struct {
+	Agents []string `json:"agents"`
+}
+
+// how the symlinks of the shares are followed, "any", "share" or "never",
+// by default and by share name
+type symlinksConfig struct {
+	Default string            `json:"default"`
+	Shares  map[string]string `json:"shares"`
+}
+
+// a share of the config file: its directory, an absolute path, whether
+// files can be changed in it and whether it's listed, both true when not
+// set, and its tags, like ["movies"]
+type shareConfig struct {
+	Name     string   `json:"name"`
+	Path     string   `json:"path"`
+	Writable bool     `json:"writable"`
+	Visible  bool     `json:"visible"`
+	Tags     []string `json:"tags"`
+}
+
+func (this *shareConfig) UnmarshalJSON(data []byte) error {
+	type plain shareConfig
+	share := plain{Writable: true, Visible: true}
+	if err := json.Unmarshal(data, &share); err != nil {
+		return err
+	}
+	*this = shareConfig(share)
+	return nil
+}
+
+// a percent of the reads, GET and HEAD requests, are sent as well to the
+// fs at url, "" for none, like a new version under test, to compare what
+// it answers and how long it takes, waiting for it up to timeout, a Go
+// duration
+type shadowConfig struct {
+	URL     string  `json:"url"`
+	Percent float64 `json:"percent"`
+	Timeout string  `json:"timeout"`
+}
+
+// a share made into a static site, its listing and the thumbnails of its
+// photos and videos when thumbnails is set, in dir, to host elsewhere,
+// every interval, a Go duration
+type exportConfig struct {
+	Share      string `json:"share"`
+	Dir        string `json:"dir"`
+	Interval   string `json:"interval"`
+	Thumbnails bool   `json:"thumbnails"`
+}
+
+// the responses of the apps kept in memory, up to size MB, 0 for none,
+// and how long the static files are kept when the app does not say, a Go
+// duration
+type appCacheConfig struct {
+	Size   int64  `json:"size"`
+	MaxAge string `json:"max_age"`
+}
+
+// where the apps are, by vhost, like {"jellyfin.hda":
+// "https://localhost:8920"}, http://<vhost> for the others, and how the
+// certificates of the https ones are checked: with the CAs of ca_file as
+// well as those of the system, or not at all when insecure. they are
+// checked every check_interval, a Go duration, "" to never check them,
+// and have check_timeout to answer. access has the users and profiles
+// that may use an app, by vhost, the others being for everyone
+type appsConfig struct {
+	Upstreams     map[string]string   `json:"upstreams"`
+	Insecure      bool                `json:"insecure"`
+	CAFile        string              `json:"ca_file"`
+	CheckInterval string              `json:"check_interval"`
+	CheckTimeout  string              `json:"check_timeout"`
+	Access        map[string][]string `json:"access"`
+}
+
+// the disks of the shares not used for spin_down, a Go duration, are put
+// to sleep, "" to leave them be
+type powerConfig struct {
+	SpinDown string `json:"spin_down"`
+}
+
+// the profiles of pprof on the local server, for debugging, and the
+// verbosity of the debug lines, from 1 to 5 like -d, 0 to leave it
+type debugConfig struct {
+	Pprof bool `json:"pprof"`
+	Level int  `json:"level"`
+}
+
+// the token of /admin/config, "" to turn it off
+type adminConfig struct {
+	Token string `json:"token"`
+}
+
+// the access log: its file, "" for none, its format, "combined" or
+// "json", rotated at max_size MB, keeping keep of them
+type accessLogConfig struct {
+	File    string `json:"file"`
+	Format  string `json:"format"`
+	MaxSize int64  `json:"max_size"`
+	Keep    int    `json:"keep"`
+}
+
+// the queued downloads: at what hours they are served, like
+// "23:00-07:00", "" for any time, within how many kbit/s in all, 0 for no
+// limit, and how many are served at a time
+type downloadsConfig struct {
+	Hours     string `json:"hours"`
+	Bandwidth int    `json:"bandwidth"`
+	Active    int    `json:"active"`
+}
+
+// the log: its file, "" for LOGFILE, its format, "text", "json" or
+// "logfmt", its level, "" for info, or debug in development, and the
+// levels of scopes, like {"relay": "debug"}. it's rotated at max_size MB
+// or max_age, a Go duration, "" or 0 for no limit, keeping keep of them.
+// the requests slower than slow_request, a Go duration, are logged with
+// where the time went, "" to not trace them
+type loggingConfig struct {
+	File        string            `json:"file"`
+	Format      string            `json:"format"`
+	Level       string            `json:"level"`
+	Scopes      map[string]string `json:"scopes"`
+	MaxSize     int64             `json:"max_size"`
+	MaxAge      string            `json:"max_age"`
+	Keep        int               `json:"keep"`
+	SlowRequest string            `json:"slow_request"`
+}
+
+// the hours at which shares can be used, by share, like {"Backups":
+// "22:00-06:00"}, in local time, with windows separated by commas. the
+// other shares can always be used
+type availabilityConfig struct {
+	Shares map[string]string `json:"shares"`
+}
+
+// the security headers of the responses, for the JSON API, the files served
+// and the apps behind a vhost, "" to leave one out, and the headers of the
+// apps that are not passed along
+type headersConfig struct {
+	API   map[string]string `json:"api"`
+	Files map[string]string `json:"files"`
+	Apps  map[string]string `json:"apps"`
+	Strip []string          `json:"strip"`
+}
+
+// how many files are streamed at a time, in all and to a client, and how
+// big an upload can be, in MB, 0 for no limit
+type limitsConfig struct {
+	MaxStreams       int   `json:"max_streams"`
+	MaxClientStreams int   `json:"max_client_streams"`
+	MaxUpload        int64 `json:"max_upload"`
+}
+
+// how long the change feeds remember deleted files, as a Go duration, for
+// the sync clients that were away
+type syncConfig struct {
+	TombstoneRetention string `json:"tombstone_retention"`
+}
+
+// the share with the home folders of the users, "" for none, and the
+// users, by name, with the token their apps send
+type homesConfig struct {
+	Share string            `json:"share"`
+	Users map[string]string `json:"users"`
+}
+
+// the directory on a secondary disk where the files of the shares not used
+// in a while go, and how long that is for each share, like {"Movies":
+// "4320h"}. shares that are not listed keep their files
+type tieringConfig struct {
+	Archive string            `json:"archive"`
+	Shares  map[string]string `json:"shares"`
+}
+
+// the encoder to transcode videos with, like "libx264", or the backend,
+// like "vaapi" or "software", instead of the first that works, how many
+// videos are transcoded at a time, the device of VAAPI, and how many
+// qualities the adaptive transcodes have
+type transcodeConfig struct {
+	Encoder       string       `json:"encoder"`
+	Backend       string       `json:"backend"`
+	MaxSessions   int          `json:"max_sessions"`
+	VaapiDevice   string       `json:"vaapi_device"`
+	AdaptiveRungs int          `json:"adaptive_rungs"`
+	Pregenerate   pregenConfig `json:"pregenerate"`
+}
+
+// the videos transcoded ahead of time, at hours like "01:00-06:00", ""
+// for any time: those added in the last recent, a Go duration, and those
+// watched min_plays times, 0 for neither, at quality, "" for the one a
+// transcode would get, in up to cache_size MB
+type pregenConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Hours     string `json:"hours"`
+	Recent    string `json:"recent"`
+	MinPlays  int    `json:"min_plays"`
+	Quality   string `json:"quality"`
+	CacheSize int64  `json:"cache_size"`
+}
+
+// the folders, by share, whose files are uploaded and kept as chunks, like
+// {"docs": ["/Office", "/VMs"]}, with "/" for the whole share
+type chunkingConfig struct {
+	Shares map[string][]string `json:"shares"`
+}
+
+// where the state of the HDA is reported, "" for nowhere, and how full a
+// disk is, in percent, for an alert
+type platformConfig struct {
+	URL       string `json:"url"`
+	DiskAlert int    `json:"disk_alert"`
+}
+
+// the local server speaks TLS when tls is set, with tls_cert and tls_key,
+// or else with a self-signed certificate that is rotated automatically
+type localConfig struct {
+	TLS     bool   `json:"tls"`
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+}
+
+// the child profiles, by name, with the token their apps send and the
+// highest rating they can watch, like "PG" or "TV-14"
+type parentalConfig struct {
+	Profiles map[string]parentalProfile `json:"profiles"`
+	// the profile of the requests without a user or a profile token
+	Default string `json:"default"`
+}
+
+// directories with more than max_entries entries are listed a page at a
+// time, 0 for no limit. the extended attributes in xattrs, like
+// "user.comment", are in the listings that have the owners and modes
+type listingConfig struct {
+	MaxEntries int      `json:"max_entries"`
+	Xattrs     []string `json:"xattrs"`
+}
+
+// how long metadata lookups are cached, as Go durations. negative_ttl is
+// for the lookups that found nothing. "0" does not cache them
+type metadataConfig struct {
+	CacheTTL    string `json:"cache_ttl"`
+	NegativeTTL string `json:"negative_ttl"`
+}
+
+// scheduled snapshots of the shares on btrfs or ZFS, every interval (a Go
+// duration), keeping the last keep of them
+type snapshotsConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+	Keep     int    `json:"keep"`
+}
+
+// how many previous versions of a file are kept when it's overwritten,
+// 0 to keep none
+type versionsConfig struct {
+	Keep int `json:"keep"`
+}
+
+// deleted files are kept in the trash of their share for retention, as a
+// Go duration. "0" deletes them right away
+type trashConfig struct {
+	Retention string `json:"retention"`
+}
+
+// credentials for the relay, overriding the API key from the settings DB
+// and the built-in token. they are read again on SIGHUP
+type relayConfig struct {
+	ApiKey string `json:"api_key"`
+	Token  string `json:"token"`
+	// a relay of the user's own, see relay_protocol.go
+	Protocol string           `json:"protocol"`
+	Host     string           `json:"host"`
+	Port     string           `json:"port"`
+	TLS      relayTLSConfig   `json:"tls"`
+	HTTP2    relayHTTP2Config `json:"http2"`
+	// gzip the JSON sent through the relay to the clients that take it
+	Compress bool `json:"compress"`
+	// how many connections to keep to the relay, and the host:port of the
+	// relays to make them to, in turns, instead of the one built in
+	Connections int      `json:"connections"`
+	Endpoints   []string `json:"endpoints"`
+}
+
+// the HTTP/2 settings of the connection to the relay: how many requests
+// at a time, how much the relay can send before the HDA reads it, for a
+// stream and in all, in bytes, and, as Go durations, how long an idle
+// connection is kept ("0" for ever) and how long a quiet one goes before
+// it is pinged ("0" for never). 0 is the default of http2 for the others
+type relayHTTP2Config struct {
+	MaxConcurrentStreams uint32 `json:"max_concurrent_streams"`
+	StreamWindow         int32  `json:"stream_window"`
+	ConnectionWindow     int32  `json:"connection_window"`
+	MaxReadFrameSize     uint32 `json:"max_read_frame_size"`
+	IdleTimeout          string `json:"idle_timeout"`
+	ReadIdleTimeout      string `json:"read_idle_timeout"`
+}
+
+// how to connect to the relay over TLS: without it, the PEM file of the
+// CAs to trust instead of those of the system, the name in its
+// certificate if not its host, or without checking the certificate
+type relayTLSConfig struct {
+	Disabled   bool   `json:"disabled"`
+	CAFile     string `json:"ca_file"`
+	ServerName string `json:"server_name"`
+	Insecure   bool   `json:"insecure"`
+}
+
+// direct connections to the local server through a port mapped on the
+// router, to this external port, or the same as the local one, with the
+// router at gateway, or the one of the default route
+type directConfig struct {
+	Enabled      bool   `json:"enabled"`
+	ExternalPort int    `json:"external_port"`
+	Gateway      string `json:"gateway"`
+}
+
+type sftpConfig struct {
+	Enabled        bool   `json:"enabled"`
+	Port           string `json:"port"`
+	HostKey        string `json:"host_key"`
+	AuthorizedKeys string `json:"authorized_keys"`
+}
+
+// the S3 gateway is only started when enabled and both keys are set
+type s3Config struct {
+	Enabled   bool   `json:"enabled"`
+	Port      string `json:"port"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+// FTP is for legacy devices; users are name/password pairs.
+// passive_ports is a range like "50000-50100" and public_ip the
+// address announced to clients behind NAT
+type ftpConfig struct {
+	Enabled      bool              `json:"enabled"`
+	Port         string            `json:"port"`
+	PassivePorts string            `json:"passive_ports"`
+	PublicIP     string            `json:"public_ip"`
+	Users        map[string]string `json:"users"`
+	TLSCert      string            `json:"tls_cert"`
+	TLSKey       string            `json:"tls_key"`
+	RequireTLS   bool              `json:"require_tls"`
+}
+
+// how often shares are re-indexed, as Go durations ("1h", "168h").
+// a share's name takes precedence over its tags, and tags over the default.
+// shares that cannot be watched for changes are scanned at least every fallback
+type scanConfig struct {
+	Default  string            `json:"default"`
+	Fallback string            `json:"fallback"`
+	Tags     map[string]string `json:"tags"`
+	Shares   map[string]string `json:"shares"`
+}
+
+var config = default_config()
+
+func default_config() *fsConfig {
+	c := new(fsConfig)
+	c.Sftp.Port = "4564"
+	c.Sftp.HostKey = DATA_DIR + "/sftp_host_key"
+	c.Sftp.AuthorizedKeys = DATA_DIR + "/authorized_keys"
+	c.S3.Port = "4565"
+	c.Ftp.Port = "2121"
+	c.Ftp.PassivePorts = "50000-50100"
+	c.Relay.HTTP2.MaxConcurrentStreams = 500
+	c.Relay.HTTP2.StreamWindow = 4 << 20
+	c.Relay.HTTP2.ConnectionWindow = 32 << 20
+	c.Relay.HTTP2.MaxReadFrameSize = 1 << 20
+	c.Relay.HTTP2.IdleTimeout = "0"
+	c.Relay.HTTP2.ReadIdleTimeout = "10s"
+	c.Relay.Compress = true
+	c.Relay.Connections = 1
+	c.Trash.Retention = "720h"
+	c.Versions.Keep = 5
+	c.Snapshots.Interval = "24h"
+	c.Snapshots.Keep = 7
+	c.Metadata.CacheTTL = "720h"
+	c.Metadata.NegativeTTL = "24h"
+	c.Listing.MaxEntries = 5000
+	c.Platform.URL = PLATFORM_API_URL
+	c.Platform.DiskAlert = 90
+	c.Transcode.MaxSessions = 2
+	c.Transcode.VaapiDevice = "/dev/dri/renderD128"
+	c.Transcode.AdaptiveRungs = 3
+	c.Transcode.Pregenerate.Hours = "01:00-06:00"
+	c.Transcode.Pregenerate.Recent = "168h"
+	c.Transcode.Pregenerate.MinPlays = 3
+	c.Transcode.Pregenerate.CacheSize = 20 << 10
+	c.Sync.TombstoneRetention = "2160h"
+	c.Limits.MaxStreams = 32
+	c.Limits.MaxClientStreams = 8
+	c.Headers = default_security_headers()
+	c.Logging.Format = LOG_FORMAT_TEXT
+	c.Logging.MaxSize = 50
+	c.Logging.Keep = 5
+	c.Logging.SlowRequest = "5s"
+	c.Downloads.Active = 1
+	c.AppCache.Size = 32
+	c.AppCache.MaxAge = "1h"
+	c.Apps.CheckInterval = "1m"
+	c.Apps.CheckTimeout = "3s"
+	c.Shadow.Timeout = "30s"
+	c.Export.Interval = "24h"
+	c.Export.Thumbnails = true
+	c.Symlinks.Default = SYMLINKS_ANY
+	c.AccessLog.Format = ACCESS_LOG_COMBINED
+	c.AccessLog.MaxSize = 50
+	c.AccessLog.Keep = 5
+	c.Scan.Default = "24h"
+	c.Scan.Fallback = "15m"
+	c.Scan.Tags = map[string]string{
+		"movies": "1h", "movie": "1h", "tv": "1h", "music": "1h", "photos": "1h", "pictures": "1h", "videos": "1h",
+		"backups": "168h", "backup": "168h", "archives": "168h", "archive": "168h",
+	}
+	c.Scan.Shares = map[string]string{}
+	return c
+}
+
+// load_config reads the config file at path over the defaults.
+// a missing file is not an error
+func load_config(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c := default_config()
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return err
+	}
+	if err := check_config_shares(c.Shares); err != nil {
+		return err
+	}
+	if err := check_symlinks_config(&c.Symlinks); err != nil {
+		return err
+	}
+	if err := check_compat_config(&c.Compat); err != nil {
+		return err
+	}
+	if err := check_apps_config(&c.Apps); err != nil {
+		return err
+	}
+	if err := check_parental_config(&c.Parental); err != nil {
+		return err
+	}
+	config = c
+	return nil
+}
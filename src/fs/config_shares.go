@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the fs runs without the rest of Amahi, on any Linux box or in Docker,
+// when the config file has "shares", even an empty list: they are the
+// shares, instead of those of the settings DB, which is not used at all.
+// there are no apps then, the local address is local_addr or the one of
+// the network interface, and the relay is only used with relay.api_key.
+// the shares that are not writable are read only, for every way in: the
+// API, SFTP, FTP, S3 and gRPC. /admin/shares changes them in the file
+
+// the requests of the API that change the files of share s
+var share_writes = map[string]bool{
+	"POST /files":                  true,
+	"DELETE /files":                true,
+	"PATCH /files/delta":           true,
+	"POST /files/chunks":           true,
+	"PUT /files/chunks/data":       true,
+	"POST /files/versions/restore": true,
+	"POST /trash/restore":          true,
+	"DELETE /trash":                true,
+}
+
+// standalone says whether the shares are those of the config file
+func standalone() bool {
+	return config.Shares != nil
+}
+
+// check_config_shares checks the shares of a config
+func check_config_shares(shares []shareConfig) error {
+	names := make(map[string]bool)
+	for _, share := range shares {
+		if !valid_share_name(share.Name) {
+			return fmt.Errorf("share %q: %s", share.Name, errShareName.Error())
+		}
+		if names[share.Name] {
+			return fmt.Errorf("share %q: %s", share.Name, errShareExists.Error())
+		}
+		if !filepath.IsAbs(share.Path) {
+			return fmt.Errorf("share %q: the path of a share must be absolute", share.Name)
+		}
+		names[share.Name] = true
+	}
+	return nil
+}
+
+// update_config_shares reads the shares of the config file
+func (this *HdaShares) update_config_shares() error {
+	shares := make([]*HdaShare, 0, len(config.Shares))
+	for _, declared := range config.Shares {
+		if !declared.Visible {
+			continue
+		}
+		share := &HdaShare{name: declared.Name, path: filepath.Clean(declared.Path),
+			tags: strings.Join(declared.Tags, ", "), read_only: !declared.Writable}
+		if fi, err := os.Stat(share.path); err == nil {
+			share.updated_at = fi.ModTime()
+		}
+		shares = append(shares, share)
+	}
+	this.set_shares(shares)
+	return nil
+}
+
+// save_config_shares makes shares those of the config file, writing them
+// to it
+func save_config_shares(shares []shareConfig) error {
+	admin_config_lock.Lock()
+	defer admin_config_lock.Unlock()
+	patch := map[string]interface{}{"shares": shares}
+	patched, err := patch_config(config, patch)
+	if err != nil {
+		return err
+	}
+	if err := save_config_patch(config_file, patch); err != nil {
+		return err
+	}
+	config = patched
+	return nil
+}
+
+// read_only says whether the file at full_path is in a read only share,
+// or in one whose disk is not mounted
+func (this *HdaShares) read_only(full_path string) bool {
+	share, _ := this.owner(full_path)
+	return share != nil && (share.read_only || share_offline(share))
+}
+
+// share_write_access is a middleware turning down the changes to the
+// files of read only shares
+func (service *MercuryFsService) share_write_access(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !share_writes[endpoint_of(request)] {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		service.Shares.RLock()
+		share := find_share(service.Shares.Shares, request.URL.Query().Get("s"))
+		read_only := share != nil && share.read_only
+		service.Shares.RUnlock()
+		if !read_only {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		size := json_response(writer, http.StatusForbidden, map[string]string{"error": "the share is read only"})
+		service.debug_info.requestServed(size)
+		log("\"%s %s\" 403 %d \"%s\"", request.Method, pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+	})
+}
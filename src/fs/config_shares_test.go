@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigShares(t *testing.T) {
+	saved_config, saved_file := config, config_file
+	defer func() { config, config_file = saved_config, saved_file }()
+	dir, _ := ioutil.TempDir("", "standalone")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"movies", "docs", "old"} {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+	}
+	config_file = filepath.Join(dir, "fs.json")
+	ioutil.WriteFile(config_file, []byte(`{"admin": {"token": "letmein"}, "local_addr": "10.0.0.5", "shares": [
+		{"name": "Movies", "path": "`+dir+`/movies", "writable": false, "tags": ["movies"]},
+		{"name": "Docs", "path": "`+dir+`/docs"},
+		{"name": "Old", "path": "`+dir+`/old", "visible": false}]}`), 0600)
+	config = default_config()
+	if err := load_config(config_file); err != nil {
+		t.Fatalf("Could not load the config: %s", err)
+	}
+	if !standalone() || !config.Shares[1].Writable || !config.Shares[1].Visible || config.Shares[2].Visible {
+		t.Fatalf("Wrong shares: %+v", config.Shares)
+	}
+	if addr, err := GetLocalAddr(""); err != nil || addr != "10.0.0.5" {
+		t.Errorf("Wrong local address: %s %v", addr, err)
+	}
+
+	shares, err := NewHdaShares("")
+	if err != nil {
+		t.Fatalf("NewHdaShares failed: %s", err)
+	}
+	var listed []shareEntry
+	json.Unmarshal([]byte(shares.to_json()), &listed)
+	if len(listed) != 2 || listed[0].Name != "Movies" || !listed[0].ReadOnly || listed[0].Tags[0] != "movies" || listed[1].ReadOnly {
+		t.Errorf("Wrong listing: %+v", listed)
+	}
+	if !shares.read_only(filepath.Join(dir, "movies", "a.mkv")) || shares.read_only(filepath.Join(dir, "docs", "a.txt")) {
+		t.Errorf("Wrong read only shares")
+	}
+
+	service := &MercuryFsService{Shares: shares, debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.Use(service.share_write_access)
+	ok := func(writer http.ResponseWriter, request *http.Request) { writer.WriteHeader(http.StatusOK) }
+	router.HandleFunc("/files", ok).Methods("GET", "POST", "DELETE")
+	router.HandleFunc("/admin/shares", service.share_admin_add).Methods("POST")
+	router.HandleFunc("/admin/shares/{name}", service.share_admin_change).Methods("PATCH")
+	router.HandleFunc("/admin/shares/{name}", service.share_admin_remove).Methods("DELETE")
+	serve := func(method, target, body string) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer letmein")
+		router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	for _, c := range []struct {
+		method, target string
+		status         int
+	}{{"GET", "/files?s=Movies&p=/a.mkv", 200}, {"POST", "/files?s=Movies&p=/", 403},
+		{"DELETE", "/files?s=Movies&p=/a.mkv", 403}, {"DELETE", "/files?s=Docs&p=/a.txt", 200}} {
+		if status := serve(c.method, c.target, ""); status != c.status {
+			t.Errorf("%d instead of %d for %s %s", status, c.status, c.method, c.target)
+		}
+	}
+
+	// the shares are changed in the config file
+	if status := serve("POST", "/admin/shares", `{"name": "Music", "path": "`+dir+`/music", "tags": "music, audio"}`); status != 201 {
+		t.Errorf("Share not added: %d", status)
+	}
+	serve("PATCH", "/admin/shares/Old", `{"hidden": false}`)
+	serve("DELETE", "/admin/shares/Docs", "")
+	c := default_config()
+	data, _ := ioutil.ReadFile(config_file)
+	json.Unmarshal(data, c)
+	names := []string{}
+	for _, share := range c.Shares {
+		names = append(names, share.Name)
+	}
+	if strings.Join(names, ",") != "Movies,Old,Music" || c.Shares[0].Writable || len(c.Shares[2].Tags) != 2 || c.Admin.Token != "letmein" {
+		t.Errorf("Wrong shares in the config file: %s", data)
+	}
+	if shares.Get("Old") == nil || shares.Get("Music") == nil || shares.Get("Docs") != nil {
+		t.Errorf("Shares not read again: %s", shares.to_json())
+	}
+
+	for _, bad := range []string{`{"shares": [{"name": "a", "path": "rel"}]}`,
+		`{"shares": [{"name": "a", "path": "/a"}, {"name": "a", "path": "/b"}]}`, `{"shares": [{"name": ".a", "path": "/a"}]}`} {
+		ioutil.WriteFile(config_file, []byte(bad), 0600)
+		if err := load_config(config_file); err == nil {
+			t.Errorf("Loaded %s", bad)
+		}
+	}
+}
@@ -10,32 +10,158 @@
 package main
 
 import (
+	"net/http"
+	"runtime"
+	rdebug "runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// the counters of a server, in the metrics registry, see metrics.go
 type debugInfo struct {
-	last time.Time
-
-	num_requests_received, num_requests_served, num_bytes_served int64
+	// the server counted, relay unless set
+	server string
+	last   time.Time
 
 	sync.RWMutex
 }
 
+func (this *debugInfo) server_name() string {
+	if this.server == "" {
+		return "relay"
+	}
+	return this.server
+}
+
 func (this *debugInfo) everything() (last_served_time time.Time, num_received, num_served, bytes_served int64) {
 	this.RLock()
 	last_served_time = this.last
-	num_received = this.num_requests_received
-	num_served = this.num_requests_served
-	bytes_served = this.num_bytes_served
 	this.RUnlock()
+	server := this.server_name()
+	num_received = int64(metric_received.value(server))
+	num_served = int64(metric_served.value(server))
+	bytes_served = int64(metric_bytes.value(server))
 	return
 }
 
+func (this *debugInfo) requestReceived() {
+	metric_received.inc(this.server_name())
+}
+
 func (this *debugInfo) requestServed(bytes_served int64) {
+	server := this.server_name()
+	metric_served.inc(server)
+	metric_bytes.add(float64(bytes_served), server)
 	this.Lock()
-	this.num_requests_served++
-	this.num_bytes_served += bytes_served
 	this.last = time.Now()
 	this.Unlock()
 }
+
+// share_requests are the requests and bytes served by share
+func (this *debugInfo) share_requests() map[string]map[string]int64 {
+	server := this.server_name()
+	shares := make(map[string]map[string]int64)
+	for share, requests := range metric_share_requests.values_of(server) {
+		shares[share] = map[string]int64{"requests": int64(requests), "bytes": int64(metric_share_bytes.value(server, share))}
+	}
+	return shares
+}
+
+// memory_status is the memory of the process and its garbage collection
+func memory_status() (memory, gc map[string]interface{}) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	memory = map[string]interface{}{
+		"sys":           stats.Sys,
+		"alloc":         stats.Alloc,
+		"total_alloc":   stats.TotalAlloc,
+		"heap_inuse":    stats.HeapInuse,
+		"heap_idle":     stats.HeapIdle,
+		"heap_released": stats.HeapReleased,
+		"heap_objects":  stats.HeapObjects,
+		"stack_inuse":   stats.StackInuse,
+		"mallocs":       stats.Mallocs,
+		"frees":         stats.Frees,
+	}
+	gc_stats := rdebug.GCStats{PauseQuantiles: make([]time.Duration, 5)}
+	rdebug.ReadGCStats(&gc_stats)
+	quantiles := []float64{}
+	for _, pause := range gc_stats.PauseQuantiles {
+		quantiles = append(quantiles, float64(pause)/float64(time.Millisecond))
+	}
+	gc = map[string]interface{}{
+		"num_gc":         gc_stats.NumGC,
+		"pause_total_ms": float64(gc_stats.PauseTotal) / float64(time.Millisecond),
+		// min, 25%, 50%, 75% and max
+		"pause_quantiles_ms": quantiles,
+		"cpu_fraction":       stats.GCCPUFraction,
+		"next_gc":            stats.NextGC,
+	}
+	if gc_stats.NumGC > 0 {
+		gc["last_gc"] = gc_stats.LastGC.Format(time.RFC3339)
+	}
+	return
+}
+
+// the requests being served, for the transfers of /hda_debug
+type activeRequest struct {
+	method, path, client, server string
+	started                      time.Time
+	writer                       *statusWriter
+	body                         *countingBody
+}
+
+type activeRequests struct {
+	next     uint64
+	requests map[uint64]*activeRequest
+	sync.Mutex
+}
+
+var active_requests = &activeRequests{requests: make(map[uint64]*activeRequest)}
+
+type transferStatus struct {
+	Method   string  `json:"method"`
+	Path     string  `json:"path"`
+	Client   string  `json:"client"`
+	Server   string  `json:"server"`
+	Age      float64 `json:"age"`
+	Sent     int64   `json:"sent"`
+	Received int64   `json:"received"`
+	// in bytes per second
+	Rate float64 `json:"rate"`
+}
+
+func (this *activeRequests) add(server string, request *http.Request, writer *statusWriter, body *countingBody) uint64 {
+	this.Lock()
+	defer this.Unlock()
+	this.next++
+	this.requests[this.next] = &activeRequest{method: request.Method, path: pathForLog(request.URL), client: client_ip(request),
+		server: server, started: time.Now(), writer: writer, body: body}
+	return this.next
+}
+
+func (this *activeRequests) remove(id uint64) {
+	this.Lock()
+	delete(this.requests, id)
+	this.Unlock()
+}
+
+// status is the requests being served, the oldest first
+func (this *activeRequests) status() []transferStatus {
+	this.Lock()
+	defer this.Unlock()
+	now := time.Now()
+	transfers := []transferStatus{}
+	for _, active := range this.requests {
+		transfer := transferStatus{Method: active.method, Path: active.path, Client: active.client, Server: active.server,
+			Age: now.Sub(active.started).Seconds(), Sent: atomic.LoadInt64(&active.writer.sent), Received: atomic.LoadInt64(&active.body.count)}
+		if transfer.Age > 0 {
+			transfer.Rate = float64(transfer.Sent+transfer.Received) / transfer.Age
+		}
+		transfers = append(transfers, transfer)
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].Age > transfers[j].Age })
+	return transfers
+}
@@ -0,0 +1,555 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// delta transfers, in the style of rsync/librsync, so that a big file that
+// changed a little does not have to be transferred again completely.
+//
+// to upload, a client gets the signature of the file on the server
+// (GET /files/signature), computes the delta of its new version against it
+// and sends it with PATCH /files/delta. to download, the client sends the
+// signature of its old copy with POST /files/delta and gets the delta back.
+//
+// a signature has a weak rolling checksum and an md5 for every block of the
+// file. a delta is a stream of binary ops, all numbers big endian:
+//
+//	"ADLT" 1                    header and version
+//	'C' offset:u64 length:u32   copy length bytes of the old file at offset
+//	'L' length:u32 data         literal data
+//	'E' sha256:[32]byte         end, with the checksum of the new file
+
+const DELTA_MAGIC = "ADLT"
+const DELTA_VERSION = 1
+
+const DELTA_MIN_BLOCK = 512
+const DELTA_MAX_BLOCK = 1 << 20
+
+// the signature of a client is read in memory, so limit its size
+const DELTA_MAX_SIGNATURE = 64 << 20
+
+var errBadDelta = errors.New("malformed delta")
+var errDeltaChecksum = errors.New("delta result does not match its checksum")
+
+type blockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+type fileSignature struct {
+	BlockSize int              `json:"block_size"`
+	FileSize  int64            `json:"file_size"`
+	ETag      string           `json:"etag,omitempty"`
+	Blocks    []blockSignature `json:"blocks"`
+}
+
+// rollingChecksum is the weak checksum of rsync, which can slide over the
+// data a byte at a time
+type rollingChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+func (this *rollingChecksum) write(data []byte) {
+	for _, c := range data {
+		this.add(c)
+	}
+}
+
+// add appends a byte to the window
+func (this *rollingChecksum) add(c byte) {
+	this.a += uint32(c)
+	this.b += this.a
+	this.n++
+}
+
+// remove drops the first byte of the window
+func (this *rollingChecksum) remove(c byte) {
+	this.a -= uint32(c)
+	this.b -= this.n * uint32(c)
+	this.n--
+}
+
+func (this *rollingChecksum) sum() uint32 {
+	return this.a&0xffff | this.b<<16
+}
+
+func strong_sum(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// delta_block_size picks a block size around the square root of the file
+// size, like rsync does
+func delta_block_size(size int64) int {
+	block := int(math.Sqrt(float64(size))+1023) &^ 1023
+	if block < 2048 {
+		return 2048
+	}
+	if block > DELTA_MAX_BLOCK {
+		return DELTA_MAX_BLOCK
+	}
+	return block
+}
+
+func make_signature(reader io.Reader, block_size int) (*fileSignature, error) {
+	sig := &fileSignature{BlockSize: block_size, Blocks: []blockSignature{}}
+	buf := make([]byte, block_size)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			var weak rollingChecksum
+			weak.write(buf[:n])
+			sig.Blocks = append(sig.Blocks, blockSignature{Weak: weak.sum(), Strong: strong_sum(buf[:n])})
+			sig.FileSize += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+type deltaWriter struct {
+	writer *bufio.Writer
+	// a pending copy, so that consecutive blocks go in one op
+	offset, length int64
+}
+
+func (this *deltaWriter) header() error {
+	_, err := this.writer.WriteString(DELTA_MAGIC + string([]byte{DELTA_VERSION}))
+	return err
+}
+
+func (this *deltaWriter) copy(offset, length int64) error {
+	if this.length > 0 && this.offset+this.length == offset && this.length+length <= math.MaxUint32 {
+		this.length += length
+		return nil
+	}
+	if err := this.flush(); err != nil {
+		return err
+	}
+	this.offset, this.length = offset, length
+	return nil
+}
+
+func (this *deltaWriter) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := this.flush(); err != nil {
+		return err
+	}
+	var op [5]byte
+	op[0] = 'L'
+	binary.BigEndian.PutUint32(op[1:], uint32(len(data)))
+	this.writer.Write(op[:])
+	_, err := this.writer.Write(data)
+	return err
+}
+
+func (this *deltaWriter) flush() error {
+	if this.length == 0 {
+		return nil
+	}
+	var op [13]byte
+	op[0] = 'C'
+	binary.BigEndian.PutUint64(op[1:], uint64(this.offset))
+	binary.BigEndian.PutUint32(op[9:], uint32(this.length))
+	this.length = 0
+	_, err := this.writer.Write(op[:])
+	return err
+}
+
+func (this *deltaWriter) end(sum []byte) error {
+	if err := this.flush(); err != nil {
+		return err
+	}
+	this.writer.WriteByte('E')
+	this.writer.Write(sum)
+	return this.writer.Flush()
+}
+
+// make_delta writes the delta that turns the file with the signature sig
+// into the data of reader
+func make_delta(sig *fileSignature, reader io.Reader, writer io.Writer) error {
+	bs := sig.BlockSize
+	if bs < 1 || bs > DELTA_MAX_BLOCK {
+		return errBadDelta
+	}
+	blocks := make(map[uint32][]int, len(sig.Blocks))
+	for i, block := range sig.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], i)
+	}
+	// only the last block may be shorter
+	last_size := int(sig.FileSize - int64(bs)*int64(len(sig.Blocks)-1))
+
+	sum := sha256.New()
+	input := bufio.NewReaderSize(io.TeeReader(reader, sum), 256<<10)
+	out := &deltaWriter{writer: bufio.NewWriterSize(writer, 64<<10)}
+	if err := out.header(); err != nil {
+		return err
+	}
+
+	// buf holds the pending literal data, buf[lit:start], followed by the
+	// window being matched, buf[start:]
+	buf := make([]byte, 0, 3*bs)
+	lit, start := 0, 0
+	eof := false
+	var weak rollingChecksum
+	fill := func() error {
+		for !eof && len(buf)-start < bs {
+			if len(buf) == cap(buf) {
+				copy(buf, buf[lit:])
+				buf = buf[:len(buf)-lit]
+				start -= lit
+				lit = 0
+			}
+			c, err := input.ReadByte()
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			} else {
+				buf = append(buf, c)
+				weak.add(c)
+			}
+		}
+		return nil
+	}
+	find := func(window []byte) int {
+		candidates, ok := blocks[weak.sum()]
+		if !ok {
+			return -1
+		}
+		strong := ""
+		for _, i := range candidates {
+			size := bs
+			if i == len(sig.Blocks)-1 {
+				size = last_size
+			}
+			if size != len(window) {
+				continue
+			}
+			if strong == "" {
+				strong = strong_sum(window)
+			}
+			if strong == sig.Blocks[i].Strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for {
+		if err := fill(); err != nil {
+			return err
+		}
+		window := buf[start:]
+		if len(window) == 0 {
+			break
+		}
+		if i := find(window); i >= 0 {
+			if err := out.literal(buf[lit:start]); err != nil {
+				return err
+			}
+			if err := out.copy(int64(i)*int64(bs), int64(len(window))); err != nil {
+				return err
+			}
+			start += len(window)
+			lit = start
+			weak = rollingChecksum{}
+			continue
+		}
+		// slide the window by one byte, which becomes literal data
+		weak.remove(buf[start])
+		start++
+		if start-lit >= bs {
+			if err := out.literal(buf[lit:start]); err != nil {
+				return err
+			}
+			lit = start
+		}
+	}
+	if err := out.literal(buf[lit:start]); err != nil {
+		return err
+	}
+	return out.end(sum.Sum(nil))
+}
+
+// apply_delta writes to writer the result of applying delta to basis
+func apply_delta(basis io.ReaderAt, delta io.Reader, writer io.Writer) (int64, error) {
+	input := bufio.NewReader(delta)
+	header := make([]byte, len(DELTA_MAGIC)+1)
+	if _, err := io.ReadFull(input, header); err != nil || string(header) != DELTA_MAGIC+string([]byte{DELTA_VERSION}) {
+		return 0, errBadDelta
+	}
+	sum := sha256.New()
+	output := io.MultiWriter(writer, sum)
+	var size int64
+	var op [12]byte
+	for {
+		kind, err := input.ReadByte()
+		if err != nil {
+			return size, errBadDelta
+		}
+		var n int64
+		switch kind {
+		case 'C':
+			if _, err := io.ReadFull(input, op[:12]); err != nil {
+				return size, errBadDelta
+			}
+			offset := int64(binary.BigEndian.Uint64(op[:8]))
+			length := int64(binary.BigEndian.Uint32(op[8:12]))
+			if offset < 0 {
+				return size, errBadDelta
+			}
+			n, err = io.Copy(output, io.NewSectionReader(basis, offset, length))
+			if err == nil && n != length {
+				err = errBadDelta
+			}
+		case 'L':
+			if _, err := io.ReadFull(input, op[:4]); err != nil {
+				return size, errBadDelta
+			}
+			length := int64(binary.BigEndian.Uint32(op[:4]))
+			n, err = io.CopyN(output, input, length)
+			if err == io.EOF {
+				err = errBadDelta
+			}
+		case 'E':
+			expected := make([]byte, sha256.Size)
+			if _, err := io.ReadFull(input, expected); err != nil {
+				return size, errBadDelta
+			}
+			if !bytes.Equal(expected, sum.Sum(nil)) {
+				return size, errDeltaChecksum
+			}
+			return size, nil
+		default:
+			return size, errBadDelta
+		}
+		size += n
+		if err != nil {
+			return size, err
+		}
+	}
+}
+
+// the same etag as files served with GET /files
+func file_etag(path string, fi os.FileInfo) string {
+	return etag_cache.file_etag(path, fi)
+}
+
+// open_share_file opens a regular file of a share for the delta handlers,
+// answering the request itself when that's not possible
+func (service *MercuryFsService) open_share_file(writer http.ResponseWriter, request *http.Request) (*os.File, os.FileInfo, string) {
+	q := request.URL.Query()
+	full_path, err := service.fullPathToFile(q.Get("s"), q.Get("p"))
+	if is_path_limit(err) {
+		json_response(writer, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return nil, nil, ""
+	}
+	if err != nil {
+		debug(2, "File not found: %s", err)
+		http.NotFound(writer, request)
+		return nil, nil, ""
+	}
+	// checked before opening it, as opening a FIFO blocks
+	if fi, err := os.Stat(full_path); err == nil && !fi.Mode().IsRegular() {
+		http.Error(writer, "not a regular file", http.StatusBadRequest)
+		return nil, nil, ""
+	}
+	file, err := os.Open(full_path)
+	if err != nil {
+		debug(2, "Error opening %s: %s", full_path, err.Error())
+		http.NotFound(writer, request)
+		return nil, nil, ""
+	}
+	fi, err := file.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		file.Close()
+		http.Error(writer, "not a regular file", http.StatusBadRequest)
+		return nil, nil, ""
+	}
+	return file, fi, full_path
+}
+
+// signature of a file, for the client to make a delta of its new version
+func (service *MercuryFsService) file_signature(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	file, fi, _ := service.open_share_file(writer, request)
+	if file == nil {
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	defer file.Close()
+
+	block_size := delta_block_size(fi.Size())
+	if b, err := strconv.Atoi(request.URL.Query().Get("block")); err == nil {
+		block_size = b
+		if block_size < DELTA_MIN_BLOCK {
+			block_size = DELTA_MIN_BLOCK
+		} else if block_size > DELTA_MAX_BLOCK {
+			block_size = DELTA_MAX_BLOCK
+		}
+	}
+	sig, err := make_signature(file, block_size)
+	if err != nil {
+		debug(2, "Error making the signature of %s: %s", file.Name(), err.Error())
+		writer.WriteHeader(http.StatusInternalServerError)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 500 0 \"%s\"", query, ua)
+		return
+	}
+	sig.ETag = file_etag(request.URL.Query().Get("p"), fi)
+	writer.Header().Set("ETag", sig.ETag)
+	size := json_response(writer, http.StatusOK, sig)
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
+
+// delta download: the body is the signature of the client's copy, and the
+// answer is the delta to turn it into the file on the server
+func (service *MercuryFsService) download_delta(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	sig := new(fileSignature)
+	if err := json.NewDecoder(io.LimitReader(request.Body, DELTA_MAX_SIGNATURE)).Decode(sig); err != nil || sig.BlockSize < DELTA_MIN_BLOCK || sig.BlockSize > DELTA_MAX_BLOCK {
+		http.Error(writer, "bad signature", http.StatusBadRequest)
+		service.debug_info.requestServed(int64(0))
+		log("\"POST %s\" 400 0 \"%s\"", query, ua)
+		return
+	}
+	file, fi, _ := service.open_share_file(writer, request)
+	if file == nil {
+		service.debug_info.requestServed(int64(0))
+		log("\"POST %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	defer file.Close()
+
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("ETag", file_etag(request.URL.Query().Get("p"), fi))
+	counter := &countingWriter{writer: writer}
+	if err := make_delta(sig, file, counter); err != nil {
+		// the answer has started, the client sees a truncated delta
+		debug(2, "Error making the delta of %s: %s", file.Name(), err.Error())
+	}
+	service.debug_info.requestServed(counter.count)
+	log("\"POST %s\" 200 %d \"%s\"", query, counter.count, ua)
+}
+
+// delta upload: the body is a delta against the current file, whose etag
+// must be in If-Match, so that it's not applied to a different version
+func (service *MercuryFsService) upload_delta(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	if no_upload {
+		debug(2, "NOTICE: Running in no-upload mode.")
+		writer.WriteHeader(http.StatusForbidden)
+		service.debug_info.requestServed(int64(0))
+		log("\"PATCH %s\" 403 0 \"%s\"", query, ua)
+		return
+	}
+	file, fi, full_path := service.open_share_file(writer, request)
+	if file == nil {
+		service.debug_info.requestServed(int64(0))
+		log("\"PATCH %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	defer file.Close()
+
+	path := request.URL.Query().Get("p")
+	if_match := request.Header.Get("If-Match")
+	if if_match == "" {
+		http.Error(writer, "If-Match is required", http.StatusPreconditionRequired)
+		service.debug_info.requestServed(int64(0))
+		log("\"PATCH %s\" 428 0 \"%s\"", query, ua)
+		return
+	} else if if_match != file_etag(path, fi) {
+		writer.WriteHeader(http.StatusPreconditionFailed)
+		service.debug_info.requestServed(int64(0))
+		log("\"PATCH %s\" 412 0 \"%s\"", query, ua)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(full_path), ".delta-")
+	if err != nil {
+		debug(2, "Error creating the delta output for %s: %s", full_path, err.Error())
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		service.debug_info.requestServed(int64(0))
+		log("\"PATCH %s\" 503 0 \"%s\"", query, ua)
+		return
+	}
+	size, err := apply_delta(file, request.Body, tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), fi.Mode().Perm())
+	}
+	if err == nil {
+		keep_version(service.Shares, full_path)
+		err = os.Rename(tmp.Name(), full_path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		status := http.StatusInternalServerError
+		if err == errBadDelta || err == errDeltaChecksum {
+			status = http.StatusBadRequest
+		}
+		debug(2, "Error applying a delta to %s: %s", full_path, err.Error())
+		http.Error(writer, err.Error(), status)
+		service.debug_info.requestServed(int64(0))
+		log("\"PATCH %s\" %d 0 \"%s\"", query, status, ua)
+		return
+	}
+
+	etag := ""
+	if fi, err := os.Stat(full_path); err == nil {
+		etag = file_etag(path, fi)
+		writer.Header().Set("ETag", etag)
+	}
+	n := json_response(writer, http.StatusOK, map[string]interface{}{"size": size, "etag": etag})
+	service.debug_info.requestServed(n)
+	log("\"PATCH %s\" 200 %d \"%s\"", query, size, ua)
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (this *countingWriter) Write(p []byte) (int, error) {
+	n, err := this.writer.Write(p)
+	this.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	old := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(old)
+
+	changed := append([]byte{}, old...)
+	copy(changed[1000:], "changed in place")
+	changed = append(changed[:50000], append([]byte("inserted"), changed[50000:]...)...)
+	changed = append(changed[:200000], changed[210000:]...)
+	changed = append(changed, "appended"...)
+
+	for name, data := range map[string][]byte{"same": old, "changed": changed, "empty": {}} {
+		sig, err := make_signature(bytes.NewReader(old), 2048)
+		if err != nil {
+			t.Fatalf("make_signature: %s", err)
+		}
+		var delta bytes.Buffer
+		if err := make_delta(sig, bytes.NewReader(data), &delta); err != nil {
+			t.Fatalf("%s: make_delta: %s", name, err)
+		}
+		if delta.Len() > len(data)/10+1024 {
+			t.Errorf("%s: delta of %d bytes is too big", name, delta.Len())
+		}
+		var result bytes.Buffer
+		size, err := apply_delta(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), &result)
+		if err != nil {
+			t.Fatalf("%s: apply_delta: %s", name, err)
+		}
+		if size != int64(len(data)) || !bytes.Equal(result.Bytes(), data) {
+			t.Errorf("%s: the delta does not rebuild the data", name)
+		}
+	}
+}
+
+func TestDeltaChecksum(t *testing.T) {
+	old := make([]byte, 4*DELTA_MIN_BLOCK)
+	rand.New(rand.NewSource(2)).Read(old)
+	sig, _ := make_signature(bytes.NewReader(old), DELTA_MIN_BLOCK)
+	var delta bytes.Buffer
+	make_delta(sig, bytes.NewReader(append(old, "new"...)), &delta)
+
+	// applied to a different file, the result does not match
+	other := make([]byte, len(old))
+	_, err := apply_delta(bytes.NewReader(other), bytes.NewReader(delta.Bytes()), &bytes.Buffer{})
+	if err != errDeltaChecksum {
+		t.Errorf("Delta applied to the wrong file: %v", err)
+	}
+	// and truncated deltas are rejected
+	_, err = apply_delta(bytes.NewReader(nil), bytes.NewReader(delta.Bytes()[:delta.Len()-1]), &bytes.Buffer{})
+	if err != errBadDelta {
+		t.Errorf("Truncated delta accepted: %v", err)
+	}
+}
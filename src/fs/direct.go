@@ -0,0 +1,252 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// direct connections: with direct.enabled in the config file, the router
+// is asked to map a public port to the local server, with NAT-PMP or UPnP
+// (see port_mapping.go), so that clients can reach the HDA without the
+// relay for bulk transfers, like 4K videos. the public address is sent to
+// the relay in the HDA info, with the fingerprints of the certificate to
+// pin, as it is only done with local TLS on, and a token, which the
+// clients that got it from the relay send in X-Direct-Token. requests
+// from public addresses without it are refused, as the local server
+// trusts its network, and with it they only reach the routes of the files,
+// not the ones only on the local network, gRPC or the apps. the token is
+// made again on every renewal, the relay being told, and the previous one
+// works until its lease was up. without a mapping, or when it cannot be
+// renewed, nothing is sent and the clients stay on the relay
+
+const DIRECT_JOB = "direct-connection"
+const DIRECT_LEASE = time.Hour
+const DIRECT_TOKEN_HEADER = "X-Direct-Token"
+
+type directConnection struct {
+	mapper             portMapper
+	internal, external int
+	ip                 net.IP
+	token              string
+	mapped, expires    time.Time
+	// the token of the lease before, still good until it was up
+	previous         string
+	previous_expires time.Time
+	last_error       string
+	sync.Mutex
+}
+
+var direct_connection = new(directConnection)
+
+// refresh maps the port, or renews the mapping, before it expires
+func (this *directConnection) refresh() (string, error) {
+	if !local_tls.enabled() {
+		return "", errNoLocalTLS
+	}
+	this.Lock()
+	defer this.Unlock()
+	if this.mapper == nil {
+		mapper, err := find_port_mapper()
+		if err != nil {
+			return this.failed(err)
+		}
+		this.mapper = mapper
+	}
+	this.internal, _ = strconv.Atoi(LOCAL_SERVER_PORT)
+	external := config.Direct.ExternalPort
+	if this.external != 0 {
+		// the one mapped before, even when the router picked another
+		external = this.external
+	} else if external == 0 {
+		external = this.internal
+	}
+	port, err := this.mapper.add(this.internal, external, DIRECT_LEASE)
+	if err != nil {
+		return this.failed(err)
+	}
+	ip, err := this.mapper.external_ip()
+	if err != nil {
+		return this.failed(err)
+	}
+	if !public_ip(ip) {
+		// a router behind another NAT, the address is of no use
+		return this.failed(&net.AddrError{Err: "the router has no public address", Addr: ip.String()})
+	}
+	if this.up() {
+		this.previous, this.previous_expires = this.token, this.expires
+	}
+	this.external, this.ip = port, ip
+	token := make([]byte, 24)
+	rand.Read(token)
+	this.token = hex.EncodeToString(token)
+	this.mapped = time.Now()
+	this.expires = this.mapped.Add(DIRECT_LEASE)
+	this.last_error = ""
+	return "mapped " + this.addr() + " with " + this.mapper.name(), nil
+}
+
+// failed drops the mapping. call with the lock held
+func (this *directConnection) failed(err error) (string, error) {
+	this.ip = nil
+	this.last_error = err.Error()
+	// the router is looked for again next time
+	this.mapper = nil
+	return "", err
+}
+
+// addr is the public address. call with the lock held
+func (this *directConnection) addr() string {
+	return net.JoinHostPort(this.ip.String(), strconv.Itoa(this.external))
+}
+
+// up says if there is a mapping. call with the lock held
+func (this *directConnection) up() bool {
+	return this.ip != nil && time.Now().Before(this.expires)
+}
+
+// close removes the mapping, on the way out
+func (this *directConnection) close() {
+	this.Lock()
+	defer this.Unlock()
+	if this.mapper != nil && this.ip != nil {
+		this.mapper.remove(this.internal, this.external)
+		this.ip = nil
+	}
+}
+
+func (this *directConnection) job() jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		result, err := this.refresh()
+		if err == nil && relay != nil {
+			// the clients get the new token from the relay
+			if err := relay.announce_all(); err != nil {
+				log_warn("The relay was not told of the new direct token: %s", err.Error())
+			}
+		}
+		return result, err
+	}
+}
+
+// info is what the relay tells the clients, if there is a mapping
+func (this *directConnection) info() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	if !this.up() {
+		return nil
+	}
+	return map[string]interface{}{"addr": this.addr(), "token": this.token, "expires": this.expires}
+}
+
+// status is the info for /hda_debug, without the token
+func (this *directConnection) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	status := map[string]interface{}{"enabled": config.Direct.Enabled, "mapped": this.up()}
+	if this.up() {
+		status["addr"] = this.addr()
+		status["method"] = this.mapper.name()
+		status["expires"] = this.expires
+	}
+	if this.last_error != "" {
+		status["error"] = this.last_error
+	}
+	return status
+}
+
+// allows says whether token is the token of the direct connections, or
+// the one before while its lease lasts
+func (this *directConnection) allows(token string) bool {
+	this.Lock()
+	defer this.Unlock()
+	if this.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(this.token)) == 1 {
+		return true
+	}
+	return this.previous != "" && time.Now().Before(this.previous_expires) &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(this.previous)) == 1
+}
+
+// the routes direct connections reach, with what is under them: the files
+// and their media. "/shares" is the list alone
+var direct_routes = []string{"/files", "/transcode", "/subtitles", "/md", "/music", "/photos", "/collections", "/capabilities", "/speedtest"}
+
+// direct_route says if request is for the routes of the files. the apps
+// behind a vhost and gRPC are not
+func direct_route(request *http.Request) bool {
+	if strings.Contains(request.Header.Get("User-Agent"), "Vhost/") {
+		return false
+	}
+	p := path.Clean(request.URL.Path)
+	if p == "/shares" {
+		return true
+	}
+	for _, route := range direct_routes {
+		if p == route || strings.HasPrefix(p, route+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+var private_networks = func() []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "fc00::/7", "fe80::/10", "::1/128"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// public_ip says if ip is reachable from the internet
+func public_ip(ip net.IP) bool {
+	if ip == nil || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range private_networks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// direct_access is a middleware of the local server holding the requests
+// from public addresses to the token and to the routes of the files
+func direct_access(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		host, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			host = request.RemoteAddr
+		}
+		if !public_ip(net.ParseIP(host)) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		status, message := http.StatusUnauthorized, "direct connections need a token"
+		if direct_connection.allows(request.Header.Get(DIRECT_TOKEN_HEADER)) {
+			if direct_route(request) {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			status, message = http.StatusForbidden, "only on the local network"
+		}
+		size := json_response(writer, status, map[string]string{"error": message})
+		log("\"%s %s\" %d %d \"%s\" from %s", request.Method, pathForLog(request.URL), status, size, request.Header.Get("User-Agent"), host)
+	})
+}
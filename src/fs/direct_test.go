@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a router speaking NAT-PMP, which maps to the port after the one asked
+func fake_nat_pmp(t *testing.T, removed chan int) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		request := make([]byte, 16)
+		for {
+			n, addr, err := conn.ReadFrom(request)
+			if err != nil {
+				return
+			}
+			switch {
+			case n == 2 && request[1] == NAT_PMP_OP_EXTERNAL:
+				conn.WriteTo([]byte{0, 128, 0, 0, 0, 0, 0, 1, 203, 0, 113, 7}, addr)
+			case n == 12 && request[1] == NAT_PMP_OP_TCP:
+				response := make([]byte, 16)
+				response[1] = 130
+				copy(response[8:10], request[4:6])
+				external := binary.BigEndian.Uint16(request[6:8])
+				if binary.BigEndian.Uint32(request[8:12]) == 0 {
+					removed <- int(binary.BigEndian.Uint16(request[4:6]))
+				} else {
+					external++
+				}
+				binary.BigEndian.PutUint16(response[10:12], external)
+				copy(response[12:16], request[8:12])
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return conn
+}
+
+func TestNatPMP(t *testing.T) {
+	removed := make(chan int, 1)
+	router := fake_nat_pmp(t, removed)
+	defer router.Close()
+	nat_pmp := &natPMP{gateway: router.LocalAddr().String()}
+
+	if ip, err := nat_pmp.external_ip(); err != nil || ip.String() != "203.0.113.7" {
+		t.Errorf("Wrong external address: %v %v", ip, err)
+	}
+	if port, err := nat_pmp.add(4563, 4563, time.Hour); err != nil || port != 4564 {
+		t.Errorf("Wrong mapping: %d %v", port, err)
+	}
+	if err := nat_pmp.remove(4563, 4564); err != nil || <-removed != 4563 {
+		t.Errorf("Not removed: %v", err)
+	}
+}
+
+func TestUPnP(t *testing.T) {
+	calls := []string{}
+	router := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/rootDesc.xml":
+			writer.Write([]byte(`<?xml version="1.0"?><root><device><deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device><deviceList><device><serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>/ctl/IPConn</controlURL>
+</service></serviceList></device></deviceList></device></deviceList></device></root>`))
+		case "/ctl/IPConn":
+			body, _ := ioutil.ReadAll(request.Body)
+			calls = append(calls, request.Header.Get("SOAPAction"))
+			switch {
+			case strings.Contains(string(body), "GetExternalIPAddress"):
+				writer.Write([]byte(`<s:Envelope><s:Body><u:GetExternalIPAddressResponse><NewExternalIPAddress>198.51.100.2</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`))
+			case strings.Contains(string(body), "<NewInternalClient>127.0.0.1</NewInternalClient>"):
+				writer.Write([]byte(`<s:Envelope><s:Body><u:AddPortMappingResponse/></s:Body></s:Envelope>`))
+			default:
+				writer.WriteHeader(500)
+				writer.Write([]byte(`<s:Envelope><s:Body><s:Fault><detail><UPnPError><errorCode>714</errorCode><errorDescription>NoSuchEntryInArray</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`))
+			}
+		}
+	}))
+	defer router.Close()
+
+	igd, err := new_upnp(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := igd.external_ip(); err != nil || ip.String() != "198.51.100.2" {
+		t.Errorf("Wrong external address: %v %v", ip, err)
+	}
+	if port, err := igd.add(4563, 4563, time.Hour); err != nil || port != 4563 {
+		t.Errorf("Wrong mapping: %d %v", port, err)
+	}
+	if err := igd.remove(4563, 4563); err == nil || !strings.Contains(err.Error(), "714") {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if calls[0] != `"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"` {
+		t.Errorf("Wrong calls: %v", calls)
+	}
+}
+
+func TestDefaultGateway(t *testing.T) {
+	saved := route_file
+	defer func() { route_file = saved }()
+	dir, _ := ioutil.TempDir("", "direct")
+	defer os.RemoveAll(dir)
+	route_file = filepath.Join(dir, "route")
+	ioutil.WriteFile(route_file, []byte("Iface\tDestination\tGateway\tFlags\n"+
+		"eth0\t0001A8C0\t00000000\t0001\n"+
+		"eth0\t00000000\t0101A8C0\t0003\n"), 0644)
+	if gateway, err := default_gateway(); err != nil || gateway.String() != "192.168.1.1" {
+		t.Errorf("Wrong gateway: %v %v", gateway, err)
+	}
+}
+
+type fakeMapper struct {
+	ip     string
+	mapped int
+}
+
+func (this *fakeMapper) name() string { return "fake" }
+
+func (this *fakeMapper) external_ip() (net.IP, error) { return net.ParseIP(this.ip), nil }
+
+func (this *fakeMapper) add(internal, external int, lease time.Duration) (int, error) {
+	if this.ip == "" {
+		return 0, errors.New("the router said no")
+	}
+	this.mapped = external
+	return external, nil
+}
+
+func (this *fakeMapper) remove(internal, external int) error {
+	this.mapped = 0
+	return nil
+}
+
+func TestDirectConnection(t *testing.T) {
+	saved_tls, saved_direct := local_tls, direct_connection
+	defer func() { local_tls, direct_connection = saved_tls, saved_direct }()
+	dir, _ := ioutil.TempDir("", "direct")
+	defer os.RemoveAll(dir)
+	local_tls = new_local_tls(dir)
+	mapper := &fakeMapper{ip: "203.0.113.7"}
+	direct_connection = &directConnection{mapper: mapper}
+
+	// only with local TLS
+	if _, err := direct_connection.refresh(); err != errNoLocalTLS {
+		t.Errorf("Mapped without TLS: %v", err)
+	}
+	local_tls.enable("", "")
+	if _, err := direct_connection.refresh(); err != nil || mapper.mapped != 4563 {
+		t.Fatalf("Not mapped: %v", err)
+	}
+	var info map[string]interface{}
+	json.Unmarshal([]byte(new(HdaInfo).to_json()), &info)
+	direct, _ := info["direct"].(map[string]interface{})
+	if direct["addr"] != "203.0.113.7:4563" || direct["token"] == "" {
+		t.Fatalf("Wrong info: %v", info)
+	}
+
+	handler := direct_access(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	token := direct["token"].(string)
+	for _, c := range []struct {
+		remote, token, path, ua string
+		code                    int
+	}{
+		{"192.168.1.10:5000", "", "/shares", "", 200},
+		{"[::1]:5000", "", "/shares", "", 200},
+		{"192.168.1.10:5000", "", "/metrics", "", 200},
+		{"198.51.100.20:5000", "", "/shares", "", 401},
+		{"198.51.100.20:5000", "wrong", "/shares", "", 401},
+		{"198.51.100.20:5000", token, "/shares", "", 200},
+		{"198.51.100.20:5000", token, "/files?s=Movies&p=/a.mkv", "", 200},
+		{"198.51.100.20:5000", token, "/transcode/abc/index.m3u8", "", 200},
+		{"198.51.100.20:5000", token, "/shares/refresh", "", 403},
+		{"198.51.100.20:5000", token, "/metrics", "", 403},
+		{"198.51.100.20:5000", token, "/network/mounts", "", 403},
+		{"198.51.100.20:5000", token, "/admin/config", "", 403},
+		{"198.51.100.20:5000", token, "/files/../relay/rotate", "", 403},
+		{"198.51.100.20:5000", token, "/filesystem", "", 403},
+		{"198.51.100.20:5000", token, "/amahi.fs.FileService/List", "", 403},
+		{"198.51.100.20:5000", token, "/files", "Mozilla/5.0 Vhost/wiki.home", 403},
+	} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", c.path, nil)
+		request.RemoteAddr = c.remote
+		request.Header.Set("User-Agent", c.ua)
+		if c.token != "" {
+			request.Header.Set(DIRECT_TOKEN_HEADER, c.token)
+		}
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != c.code {
+			t.Errorf("%d instead of %d for %s from %s with %q", recorder.Code, c.code, c.path, c.remote, c.token)
+		}
+	}
+
+	// a new token on every renewal, the one before good for its lease
+	direct_connection.refresh()
+	if direct_connection.token == token || !direct_connection.allows(token) || !direct_connection.allows(direct_connection.token) {
+		t.Errorf("Token not rotated")
+	}
+	direct_connection.previous_expires = time.Now().Add(-time.Second)
+	if direct_connection.allows(token) {
+		t.Errorf("Token of an expired lease allowed")
+	}
+
+	// a router behind another NAT is of no use
+	mapper.ip = "100.64.1.2"
+	if _, err := direct_connection.refresh(); err == nil || direct_connection.info() != nil {
+		t.Errorf("Mapped behind a carrier NAT")
+	}
+	if status := direct_connection.status(); status["mapped"] != false || status["error"] == nil {
+		t.Errorf("Wrong status: %v", status)
+	}
+	direct_connection.mapper = mapper
+	mapper.ip = "203.0.113.7"
+	direct_connection.refresh()
+	direct_connection.close()
+	if mapper.mapped != 0 || direct_connection.info() != nil {
+		t.Errorf("Not removed")
+	}
+}
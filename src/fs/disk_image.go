@@ -0,0 +1,307 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// read-only browsing of the ISO 9660 filesystem in .iso and .img files on
+// the shares, so that a file can be pulled out of an image without mounting
+// it. the Joliet names are used when the image has them, or else the Rock
+// Ridge names, or else the plain 8.3 ones. images with other filesystems,
+// like FAT or UDF only, are not supported
+
+const ISO_SECTOR = 2048
+
+// directories larger than this are not read
+const ISO_MAX_DIRECTORY = 16 << 20
+
+var errNotISO = errors.New("not an ISO 9660 image")
+var errImagePath = errors.New("no such file in the image")
+
+type isoEntry struct {
+	name   string
+	dir    bool
+	extent int64
+	size   int64
+	mtime  time.Time
+}
+
+type isoImage struct {
+	file   io.ReaderAt
+	size   int64
+	root   isoEntry
+	joliet bool
+}
+
+// open_iso reads the volume descriptors of an image
+func open_iso(file io.ReaderAt, size int64) (*isoImage, error) {
+	image := &isoImage{file: file, size: size}
+	found := false
+	descriptor := make([]byte, ISO_SECTOR)
+	for sector := int64(16); sector < 16+64; sector++ {
+		if _, err := file.ReadAt(descriptor, sector*ISO_SECTOR); err != nil {
+			break
+		}
+		if string(descriptor[1:6]) != "CD001" {
+			break
+		}
+		kind := descriptor[0]
+		if kind == 255 {
+			break
+		}
+		joliet := kind == 2 && descriptor[88] == '%' && descriptor[89] == '/' &&
+			(descriptor[90] == '@' || descriptor[90] == 'C' || descriptor[90] == 'E')
+		if (kind == 1 && !found) || joliet {
+			root, ok := image.record(descriptor[156:190], joliet)
+			if !ok || !root.dir {
+				continue
+			}
+			image.root, image.joliet, found = root, joliet, true
+		}
+	}
+	if !found {
+		return nil, errNotISO
+	}
+	return image, nil
+}
+
+// iso_time is a recording date of a directory record
+func iso_time(data []byte) time.Time {
+	if data[0] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(data[6]))*15*60)
+	return time.Date(1900+int(data[0]), time.Month(data[1]), int(data[2]), int(data[3]), int(data[4]), int(data[5]), 0, zone)
+}
+
+// rock_ridge_name finds the alternate name in the system use area of a
+// record, "" if there is none
+func rock_ridge_name(data []byte) string {
+	name := ""
+	for len(data) >= 4 {
+		length := int(data[2])
+		if length < 4 || length > len(data) {
+			break
+		}
+		// NM entries with the continue flag are parts of one name
+		if string(data[:2]) == "NM" && length > 5 && data[4]&0x06 == 0 {
+			name += string(data[5:length])
+		}
+		data = data[length:]
+	}
+	return name
+}
+
+// record decodes a directory record, false if it is not valid
+func (this *isoImage) record(data []byte, joliet bool) (isoEntry, bool) {
+	if len(data) < 34 || int(data[0]) > len(data) {
+		return isoEntry{}, false
+	}
+	length, id_length := int(data[0]), int(data[32])
+	if 33+id_length > length {
+		return isoEntry{}, false
+	}
+	entry := isoEntry{
+		dir:    data[25]&0x02 != 0,
+		extent: int64(binary.LittleEndian.Uint32(data[2:6])),
+		size:   int64(binary.LittleEndian.Uint32(data[10:14])),
+		mtime:  iso_time(data[18:25]),
+	}
+	id := data[33 : 33+id_length]
+	switch {
+	case id_length == 1 && (id[0] == 0 || id[0] == 1):
+		// . and ..
+		return entry, true
+	case !joliet:
+		system_use := 33 + id_length
+		if id_length%2 == 0 {
+			system_use++
+		}
+		if system_use < length {
+			entry.name = rock_ridge_name(data[system_use:length])
+		}
+		if entry.name != "" {
+			break
+		}
+		entry.name = string(id)
+		if !entry.dir {
+			entry.name = strings.TrimSuffix(strings.Split(entry.name, ";")[0], ".")
+		}
+	default:
+		chars := make([]uint16, len(id)/2)
+		for i := range chars {
+			chars[i] = binary.BigEndian.Uint16(id[2*i:])
+		}
+		entry.name = string(utf16.Decode(chars))
+		if i := strings.LastIndexByte(entry.name, ';'); i > 0 && !entry.dir {
+			entry.name = entry.name[:i]
+		}
+	}
+	return entry, entry.extent*ISO_SECTOR+entry.size <= this.size
+}
+
+// list reads the entries of a directory
+func (this *isoImage) list(dir isoEntry) ([]isoEntry, error) {
+	if dir.size > ISO_MAX_DIRECTORY {
+		return nil, errImagePath
+	}
+	data := make([]byte, dir.size)
+	if _, err := this.file.ReadAt(data, dir.extent*ISO_SECTOR); err != nil {
+		return nil, err
+	}
+	entries := []isoEntry{}
+	for offset := 0; offset < len(data); {
+		length := int(data[offset])
+		if length == 0 {
+			// records do not cross sectors, the rest of this one is padding
+			offset = (offset/ISO_SECTOR + 1) * ISO_SECTOR
+			continue
+		}
+		if offset+length > len(data) {
+			break
+		}
+		entry, ok := this.record(data[offset:offset+length], this.joliet)
+		offset += length
+		if ok && entry.name != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// find looks up a path in the image, "/" being the root
+func (this *isoImage) find(p string) (isoEntry, error) {
+	entry := this.root
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if !entry.dir {
+			return isoEntry{}, errImagePath
+		}
+		entries, err := this.list(entry)
+		if err != nil {
+			return isoEntry{}, err
+		}
+		// names on plain ISO 9660 are upper case, the exact name wins
+		match := -1
+		for i := range entries {
+			if entries[i].name == name {
+				match = i
+				break
+			}
+			if match < 0 && strings.EqualFold(entries[i].name, name) {
+				match = i
+			}
+		}
+		if match < 0 {
+			return isoEntry{}, errImagePath
+		}
+		entry = entries[match]
+	}
+	return entry, nil
+}
+
+// open returns the contents of a file in the image
+func (this *isoImage) open(entry isoEntry) *io.SectionReader {
+	return io.NewSectionReader(this.file, entry.extent*ISO_SECTOR, entry.size)
+}
+
+// GET /files/image?s=<share>&p=<image>[&path=<path>] lists a directory in
+// a disk image, the root by default, or serves a file in it
+func (service *MercuryFsService) serve_image_file(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	full_path, err := service.fullPathToFile(q.Get("s"), q.Get("p"))
+	var file *os.File
+	if err == nil {
+		file, err = os.Open(full_path)
+	}
+	var fi os.FileInfo
+	if err == nil {
+		if fi, err = file.Stat(); err == nil && !fi.Mode().IsRegular() {
+			file.Close()
+			err = errNotISO
+		}
+	}
+	if err != nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	defer file.Close()
+	if service.parental_block(writer, request, parental_profile_of(request), q.Get("s"), full_path) {
+		return
+	}
+	var entry isoEntry
+	image, err := open_iso(file, fi.Size())
+	if err == nil {
+		entry, err = image.find(q.Get("path"))
+	}
+	if err != nil {
+		status := http.StatusNotFound
+		switch err {
+		case errNotISO:
+			status = http.StatusUnsupportedMediaType
+		case errImagePath:
+		default:
+			debug(2, "Error reading the image %s: %s", full_path, err.Error())
+			status = http.StatusInternalServerError
+		}
+		size := json_response(writer, status, map[string]string{"error": err.Error()})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" %d %d \"%s\"", query, status, size, ua)
+		return
+	}
+
+	if !entry.dir {
+		writer.Header().Set("Content-Type", getContentType(entry.name))
+		http.ServeContent(writer, request, entry.name, entry.mtime, image.open(entry))
+		service.debug_info.requestServed(entry.size)
+		log("\"GET %s\" 200 %d \"%s\"", query, entry.size, ua)
+		return
+	}
+	entries, err := image.list(entry)
+	if err != nil {
+		debug(2, "Error listing the image %s: %s", full_path, err.Error())
+		size := json_response(writer, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" 500 %d \"%s\"", query, size, ua)
+		return
+	}
+	file_infos := make([]fileInfo, 0, len(entries))
+	for _, e := range entries {
+		info := fileInfo{name: e.name, mtime: e.mtime, mime_type: "text/directory"}
+		if !e.dir {
+			info.mime_type, info.size = getContentType(e.name), e.size
+		}
+		file_infos = append(file_infos, info)
+	}
+	sort.Sort(&fileSorter{files: file_infos})
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
+	writer.WriteHeader(http.StatusOK)
+	size, _ := write_listing(writer, file_infos)
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
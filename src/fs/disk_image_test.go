@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+// iso_record is a directory record, with extra in its system use area
+func iso_record(id []byte, extent, size int, dir bool, extra []byte) []byte {
+	length := 33 + len(id)
+	if len(id)%2 == 0 {
+		length++
+	}
+	system_use := length
+	length += len(extra)
+	if length%2 == 1 {
+		length++
+	}
+	record := make([]byte, length)
+	record[0] = byte(length)
+	binary.LittleEndian.PutUint32(record[2:], uint32(extent))
+	binary.BigEndian.PutUint32(record[6:], uint32(extent))
+	binary.LittleEndian.PutUint32(record[10:], uint32(size))
+	binary.BigEndian.PutUint32(record[14:], uint32(size))
+	copy(record[18:], []byte{120, 5, 1, 12, 0, 0, 0})
+	if dir {
+		record[25] = 2
+	}
+	record[28] = 1
+	record[32] = byte(len(id))
+	copy(record[33:], id)
+	copy(record[system_use:], extra)
+	return record
+}
+
+func ucs2(name string) []byte {
+	data := []byte{}
+	for _, c := range utf16.Encode([]rune(name)) {
+		data = append(data, byte(c>>8), byte(c))
+	}
+	return data
+}
+
+// test_iso is an image with HELLO.TXT and DOCS/README.TXT, which has the
+// Rock Ridge name "Read me first.txt", and Joliet names if joliet
+func test_iso(joliet bool) []byte {
+	hello, readme := []byte("hello, world\n"), []byte("read me\n")
+	image := make([]byte, 26*ISO_SECTOR)
+	copy(image[24*ISO_SECTOR:], hello)
+	copy(image[25*ISO_SECTOR:], readme)
+	directory := func(sector, parent int, records ...[]byte) {
+		data := append(iso_record([]byte{0}, sector, ISO_SECTOR, true, nil), iso_record([]byte{1}, parent, ISO_SECTOR, true, nil)...)
+		for _, record := range records {
+			data = append(data, record...)
+		}
+		copy(image[sector*ISO_SECTOR:], data)
+	}
+	descriptor := func(sector int, kind byte, root int) {
+		d := image[sector*ISO_SECTOR:]
+		d[0] = kind
+		copy(d[1:], "CD001\x01")
+		copy(d[156:], iso_record([]byte{0}, root, ISO_SECTOR, true, nil))
+	}
+
+	descriptor(16, 1, 20)
+	nm := append([]byte{'N', 'M', 22, 1, 0}, "Read me first.txt"...)
+	directory(20, 20, iso_record([]byte("DOCS"), 21, ISO_SECTOR, true, nil), iso_record([]byte("HELLO.TXT;1"), 24, len(hello), false, nil))
+	directory(21, 20, iso_record([]byte("README.TXT;1"), 25, len(readme), false, nm))
+	terminator := 17
+	if joliet {
+		descriptor(17, 2, 22)
+		copy(image[17*ISO_SECTOR+88:], "%/E")
+		directory(22, 22, iso_record(ucs2("Docs"), 23, ISO_SECTOR, true, nil), iso_record(ucs2("Hello.txt;1"), 24, len(hello), false, nil))
+		directory(23, 22, iso_record(ucs2("Read me.txt;1"), 25, len(readme), false, nil))
+		terminator = 18
+	}
+	copy(image[terminator*ISO_SECTOR:], "\xffCD001\x01")
+	return image
+}
+
+func TestDiskImage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "images")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "backup.iso"), test_iso(false), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "joliet.img"), test_iso(true), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "disk.img"), make([]byte, 40*ISO_SECTOR), 0644)
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Backups", path: dir}}}, debug_info: new(debugInfo)}
+	get := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		service.serve_image_file(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+	listing := func(target string) []string {
+		recorder := get(target)
+		entries := []struct {
+			Name      string
+			Mime_type string
+			Size      int64
+		}{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &entries); err != nil {
+			t.Fatalf("Wrong listing of %s: %d %s", target, recorder.Code, recorder.Body.String())
+		}
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name+" "+entry.Mime_type)
+		}
+		return names
+	}
+
+	if names := listing("/files/image?s=Backups&p=/backup.iso"); len(names) != 2 || names[0] != "DOCS text/directory" || names[1] != "HELLO.TXT text/plain" {
+		t.Errorf("Wrong root: %v", names)
+	}
+	if names := listing("/files/image?s=Backups&p=/backup.iso&path=/docs"); len(names) != 1 || names[0] != "Read me first.txt text/plain" {
+		t.Errorf("Wrong Rock Ridge names: %v", names)
+	}
+	if recorder := get("/files/image?s=Backups&p=/backup.iso&path=/docs/Read%20me%20first.txt"); recorder.Body.String() != "read me\n" {
+		t.Errorf("Wrong file: %d %q", recorder.Code, recorder.Body.String())
+	}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/files/image?s=Backups&p=/backup.iso&path=hello.txt", nil)
+	request.Header.Set("Range", "bytes=7-")
+	service.serve_image_file(recorder, request)
+	if recorder.Code != 206 || recorder.Body.String() != "world\n" {
+		t.Errorf("Wrong range: %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	if names := listing("/files/image?s=Backups&p=/joliet.img&path=Docs"); len(names) != 1 || names[0] != "Read me.txt text/plain" {
+		t.Errorf("Wrong Joliet names: %v", names)
+	}
+	for target, status := range map[string]int{
+		"/files/image?s=Backups&p=/disk.img":                         415,
+		"/files/image?s=Backups&p=/backup.iso&path=/missing.txt":     404,
+		"/files/image?s=Backups&p=/backup.iso&path=/HELLO.TXT/x":     404,
+		"/files/image?s=Backups&p=/":                                 404,
+		"/files/image?s=Backups&p=/missing.iso":                      404,
+		"/files/image?s=Backups&p=/backup.iso&path=../../etc/passwd": 404,
+	} {
+		if recorder := get(target); recorder.Code != status {
+			t.Errorf("%d instead of %d for %s", recorder.Code, status, target)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// a disk that is asleep takes 10 seconds or more to spin up, longer than
+// the clients wait for a listing. the first listing of a share not used
+// in a while looks at the directory in the background first: when that
+// takes over DISK_WAKE_SLOW, the disk is taken as spinning up, the
+// listing gets a 202 with a Retry-After of how long the disk took the
+// last time, and the clients following the events of the share get a
+// "waking" event, and an "awake" one once it's up, to show a spinner
+// instead of an error. the listings meanwhile get the 202 right away
+
+const DISK_WAKE_SLOW = 2 * time.Second
+
+// disks do not go to sleep sooner than this
+const DISK_WAKE_IDLE = 5 * time.Minute
+
+// how long spinning up takes, until a disk was seen doing it
+const DISK_WAKE_RETRY = 10 * time.Second
+
+// probe_path reads a bit of what is at full_path, replaced in tests
+var probe_path = func(full_path string) {
+	file, err := os.Open(full_path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if fi, err := file.Stat(); err == nil && fi.IsDir() {
+		file.Readdirnames(1)
+	}
+}
+
+type diskWakes struct {
+	slow, idle time.Duration
+	// when the shares were last used, when the ones waking up started,
+	// and how long they took the last time
+	used   map[string]time.Time
+	waking map[string]time.Time
+	took   map[string]time.Duration
+	sync.Mutex
+}
+
+var disk_wakes = new_disk_wakes(DISK_WAKE_SLOW, DISK_WAKE_IDLE)
+
+func new_disk_wakes(slow, idle time.Duration) *diskWakes {
+	return &diskWakes{slow: slow, idle: idle, used: make(map[string]time.Time),
+		waking: make(map[string]time.Time), took: make(map[string]time.Duration)}
+}
+
+// retry_after is how long the disk of share has left to wake up, with
+// the lock held
+func (this *diskWakes) retry_after(share string, started time.Time) time.Duration {
+	took := this.took[share]
+	if took == 0 {
+		took = DISK_WAKE_RETRY
+	}
+	if left := took - time.Since(started); left > time.Second {
+		return left
+	}
+	return time.Second
+}
+
+// wait looks at full_path of share, when it was not used in a while, or
+// the disk might be asleep, for up to slow. it says if the disk is still
+// waking up, and for how long, calling woke once it's up
+func (this *diskWakes) wait(share, full_path string, asleep bool, woke func()) (time.Duration, bool) {
+	now := time.Now()
+	this.Lock()
+	if started, ok := this.waking[share]; ok {
+		defer this.Unlock()
+		return this.retry_after(share, started), true
+	}
+	last, used := this.used[share]
+	this.used[share] = now
+	if used && now.Sub(last) < this.idle && !asleep {
+		this.Unlock()
+		return 0, false
+	}
+	this.waking[share] = now
+	this.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		probe_path(full_path)
+		close(done)
+		took := time.Since(now)
+		this.Lock()
+		delete(this.waking, share)
+		if took >= this.slow {
+			this.took[share] = took
+		}
+		this.Unlock()
+		woke()
+		if took >= this.slow {
+			log("Share %s woke up in %s", share, took.Round(time.Millisecond))
+			events.publish(fileEvent{Share: share, Path: "/", Op: "awake", Time: time.Now()})
+		}
+	}()
+	select {
+	case <-done:
+		return 0, false
+	case <-time.After(this.slow):
+	}
+	events.publish(fileEvent{Share: share, Path: "/", Op: "waking", Time: time.Now()})
+	this.Lock()
+	defer this.Unlock()
+	return this.retry_after(share, now), true
+}
+
+func (this *diskWakes) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	waking := []string{}
+	for share := range this.waking {
+		waking = append(waking, share)
+	}
+	took := make(map[string]float64)
+	for share, d := range this.took {
+		took[share] = d.Seconds()
+	}
+	return map[string]interface{}{"waking": waking, "spin_up_seconds": took}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskWake(t *testing.T) {
+	saved_wakes, saved_probe := disk_wakes, probe_path
+	defer func() { disk_wakes, probe_path = saved_wakes, saved_probe }()
+	disk_wakes = new_disk_wakes(50*time.Millisecond, time.Hour)
+	spinning := make(chan bool)
+	var probes int32
+	probe_path = func(full_path string) {
+		atomic.AddInt32(&probes, 1)
+		if full_path == "/mnt/movies/" {
+			<-spinning
+		}
+	}
+	ch := events.subscribe("Movies", "")
+	defer events.unsubscribe(ch)
+
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Movies", path: "/mnt/movies"}}}, debug_info: new(debugInfo)}
+	handler := service.power_access(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("listing"))
+	}))
+	get := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+
+	// the disk takes long to answer
+	response := get("/files?s=Movies&p=/")
+	if response.Code != 202 || response.Header().Get("Retry-After") != "10" {
+		t.Fatalf("Not waking: %d %s", response.Code, response.Body.String())
+	}
+	if event := <-ch; event.Op != "waking" || event.Share != "Movies" {
+		t.Errorf("Wrong event: %+v", event)
+	}
+	// meanwhile, right away
+	if response := get("/files?s=Movies&p=/"); response.Code != 202 || atomic.LoadInt32(&probes) != 1 {
+		t.Errorf("Looked at the disk again: %d", response.Code)
+	}
+	// files are not listings
+	if response := get("/files?s=Movies&p=/a.mkv"); response.Code != 200 {
+		t.Errorf("Turned down a file: %d", response.Code)
+	}
+
+	close(spinning)
+	if event := <-ch; event.Op != "awake" {
+		t.Errorf("Wrong event: %+v", event)
+	}
+	if response := get("/files?s=Movies&p=/"); response.Code != 200 || response.Body.String() != "listing" {
+		t.Errorf("Not listed once awake: %d", response.Code)
+	}
+	// used a moment ago, so not looked at
+	if atomic.LoadInt32(&probes) != 1 {
+		t.Errorf("Looked at a disk in use: %d", probes)
+	}
+	if took := disk_wakes.status()["spin_up_seconds"].(map[string]float64)["Movies"]; took < 0.05 {
+		t.Errorf("Wrong spin up time: %f", took)
+	}
+}
@@ -0,0 +1,448 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// big downloads over a slow upstream, like a few movies to a phone before
+// a trip, are queued instead of taking the whole link. a client queues a
+// file with POST /downloads and gets it with GET /downloads/<id> when it's
+// its turn: the first config.Downloads.Active of the queue are served, all
+// of them together within config.Downloads.Bandwidth, and only at the
+// hours of config.Downloads.Hours, if any. a download cut off, by the end
+// of the hours or by the client, goes on with a range request. the queue,
+// with when each download starts and is done, is in GET /downloads and in
+// the jobs, as download-<id>
+
+const DOWNLOADS_JOB = "download-queue-cleanup"
+
+// how much is written at a time, between the waits of the pacing
+const DOWNLOAD_CHUNK = 32 << 10
+
+// downloads whose turn came and that are not fetched for this long are
+// dropped, to make room for the others
+const DOWNLOAD_IDLE = 30 * time.Minute
+
+// how far ahead the start and end of downloads are worked out
+const DOWNLOAD_HORIZON = 31 * 24 * time.Hour
+
+var errNoSuchDownload = errors.New("no such download")
+var errDownloadsClosed = errors.New("downloads are paused now")
+
+type queuedDownload struct {
+	ID    string `json:"id"`
+	URL   string `json:"url"`
+	Share string `json:"share"`
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Sent  int64  `json:"sent"`
+	// "queued", "ready" once it's its turn, or "active" while fetched
+	State    string     `json:"state"`
+	Position int        `json:"position"`
+	Queued   time.Time  `json:"queued"`
+	Starts   *time.Time `json:"starts,omitempty"`
+	ETA      *time.Time `json:"eta,omitempty"`
+
+	full_path string
+	// when it was last fetched, or its turn came
+	touched time.Time
+	// the requests fetching it
+	fetching int
+}
+
+type downloadQueue struct {
+	downloads []*queuedDownload
+	// when the pacing lets the next chunk be written
+	next time.Time
+	sync.Mutex
+}
+
+var download_queue = new_download_queue()
+
+func new_download_queue() *downloadQueue {
+	return &downloadQueue{}
+}
+
+// download_windows are the hours of the downloads, nil for any time, and
+// false when they cannot be read
+func download_windows() ([]timeWindow, bool) {
+	if config.Downloads.Hours == "" {
+		return nil, true
+	}
+	windows, err := parse_windows(config.Downloads.Hours)
+	return windows, err == nil
+}
+
+func windows_open(windows []timeWindow, now time.Time) bool {
+	if windows == nil {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range windows {
+		if window.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// downloads_open says if the downloads are served at now
+func downloads_open(now time.Time) bool {
+	windows, ok := download_windows()
+	return ok && windows_open(windows, now)
+}
+
+// open_times are the times at which the hours of the downloads have been
+// open for each of seconds, in order, from now. those past
+// DOWNLOAD_HORIZON are nil
+func open_times(now time.Time, seconds []float64) []*time.Time {
+	times := make([]*time.Time, len(seconds))
+	windows, ok := download_windows()
+	if !ok {
+		return times
+	}
+	at, open, i := now, 0.0, 0
+	for i < len(seconds) && at.Sub(now) < DOWNLOAD_HORIZON {
+		next := at.Truncate(time.Minute).Add(time.Minute)
+		if windows == nil {
+			next = now.Add(DOWNLOAD_HORIZON)
+		}
+		if windows_open(windows, at) {
+			span := next.Sub(at).Seconds()
+			for ; i < len(seconds) && seconds[i] <= open+span; i++ {
+				t := at.Add(time.Duration((seconds[i] - open) * float64(time.Second)))
+				times[i] = &t
+			}
+			open += span
+		}
+		at = next
+	}
+	return times
+}
+
+// update works out the state, position, start and end of the downloads at
+// now, with the lock held. the queue is taken to go at the whole
+// bandwidth, a download getting its turn when one ahead of it is done
+func (this *downloadQueue) update(now time.Time) {
+	active := config.Downloads.Active
+	if active < 1 {
+		active = 1
+	}
+	open := downloads_open(now)
+	rate := float64(config.Downloads.Bandwidth) * 1000 / 8
+	ends, left := make([]float64, len(this.downloads)), 0.0
+	for i, download := range this.downloads {
+		left += float64(download.Size - download.Sent)
+		if rate > 0 {
+			ends[i] = left / rate
+		}
+		download.Position = i + 1
+		state := "queued"
+		switch {
+		case download.fetching > 0:
+			state = "active"
+		case i < active && open:
+			state = "ready"
+		}
+		if state == "ready" && download.State == "queued" {
+			download.touched = now
+		}
+		download.State = state
+	}
+	starts := make([]float64, len(this.downloads))
+	for i := range starts {
+		if i >= active {
+			starts[i] = ends[i-active]
+		}
+	}
+	start_times, end_times := open_times(now, starts), open_times(now, ends)
+	for i, download := range this.downloads {
+		download.Starts, download.ETA = start_times[i], nil
+		if rate > 0 {
+			download.ETA = end_times[i]
+		} else if i >= active {
+			// not known without a bandwidth
+			download.Starts = nil
+		}
+	}
+}
+
+func (this *downloadQueue) add(share, path, full_path string, size int64) queuedDownload {
+	this.Lock()
+	defer this.Unlock()
+	for _, download := range this.downloads {
+		if download.full_path == full_path {
+			this.update(schedule_now())
+			return *download
+		}
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	download := &queuedDownload{ID: hex.EncodeToString(id), Share: share, Path: path, Size: size, State: "queued",
+		Queued: time.Now(), full_path: full_path, touched: time.Now()}
+	download.URL = "/downloads/" + download.ID
+	this.downloads = append(this.downloads, download)
+	this.update(schedule_now())
+	return *download
+}
+
+func (this *downloadQueue) find(id string) (int, *queuedDownload) {
+	for i, download := range this.downloads {
+		if download.ID == id {
+			return i, download
+		}
+	}
+	return -1, nil
+}
+
+func (this *downloadQueue) remove(id string) bool {
+	this.Lock()
+	defer this.Unlock()
+	i, download := this.find(id)
+	if download != nil {
+		this.downloads = append(this.downloads[:i], this.downloads[i+1:]...)
+	}
+	return download != nil
+}
+
+func (this *downloadQueue) list() []queuedDownload {
+	this.Lock()
+	defer this.Unlock()
+	this.update(schedule_now())
+	downloads := []queuedDownload{}
+	for _, download := range this.downloads {
+		downloads = append(downloads, *download)
+	}
+	return downloads
+}
+
+// begin starts fetching a download, if it's its turn, or returns it as it
+// is with errDownloadsClosed
+func (this *downloadQueue) begin(id string) (*queuedDownload, queuedDownload, error) {
+	this.Lock()
+	defer this.Unlock()
+	now := schedule_now()
+	this.update(now)
+	_, download := this.find(id)
+	if download == nil {
+		return nil, queuedDownload{}, errNoSuchDownload
+	}
+	download.touched = now
+	if download.State == "queued" || !share_open(download.Share, now) {
+		return nil, *download, errDownloadsClosed
+	}
+	download.fetching++
+	download.State = "active"
+	return download, *download, nil
+}
+
+// end is when a request fetching download is over. the download is done
+// once all of it was sent
+func (this *downloadQueue) end(download *queuedDownload) {
+	this.Lock()
+	defer this.Unlock()
+	download.fetching--
+	download.touched = schedule_now()
+	if download.Sent >= download.Size {
+		if i, found := this.find(download.ID); found != nil {
+			this.downloads = append(this.downloads[:i], this.downloads[i+1:]...)
+		}
+	}
+}
+
+func (this *downloadQueue) progress(download *queuedDownload, sent int64) {
+	this.Lock()
+	download.Sent = sent
+	this.Unlock()
+}
+
+// pace waits for the turn of n bytes, so that all the downloads together
+// go at the bandwidth of the config
+func (this *downloadQueue) pace(n int) {
+	kbps := config.Downloads.Bandwidth
+	if kbps <= 0 {
+		return
+	}
+	this.Lock()
+	now := time.Now()
+	if this.next.Before(now) {
+		this.next = now
+	}
+	at := this.next
+	this.next = this.next.Add(time.Duration(int64(n) * 8 * int64(time.Second) / int64(kbps*1000)))
+	this.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// jobs are the downloads as jobs, for GET /jobs
+func (this *downloadQueue) jobs() []job {
+	jobs := []job{}
+	for _, download := range this.list() {
+		jobs = append(jobs, job{Name: "download-" + download.ID, State: download.State, NextRun: download.Starts,
+			Result: download.Share + ":" + download.Path, Done: download.Sent, Total: download.Size,
+			Position: download.Position, ETA: download.ETA})
+	}
+	return jobs
+}
+
+// cleanup is a job dropping the downloads whose turn came a while ago and
+// that were not fetched
+func (this *downloadQueue) cleanup() jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		this.Lock()
+		defer this.Unlock()
+		now := schedule_now()
+		this.update(now)
+		kept := []*queuedDownload{}
+		for _, download := range this.downloads {
+			if download.State != "ready" || now.Sub(download.touched) < DOWNLOAD_IDLE {
+				kept = append(kept, download)
+			}
+		}
+		dropped := len(this.downloads) - len(kept)
+		this.downloads = kept
+		this.update(now)
+		return fmt.Sprintf("%d downloads dropped, %d queued", dropped, len(kept)), nil
+	}
+}
+
+// pacedWriter writes a download a chunk at a time, at the pace of the
+// queue, until the hours of the downloads are over
+type pacedWriter struct {
+	http.ResponseWriter
+	queue    *downloadQueue
+	download *queuedDownload
+	// where in the file it's at
+	offset int64
+}
+
+func (this *pacedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if !downloads_open(schedule_now()) {
+			return written, errDownloadsClosed
+		}
+		chunk := p
+		if len(chunk) > DOWNLOAD_CHUNK {
+			chunk = chunk[:DOWNLOAD_CHUNK]
+		}
+		this.queue.pace(len(chunk))
+		n, err := this.ResponseWriter.Write(chunk)
+		written += n
+		this.offset += int64(n)
+		this.queue.progress(this.download, this.offset)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// POST /downloads?s=<share>&p=<path> queues a file to download
+func (service *MercuryFsService) queue_download(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	full_path, err := service.fullPathToFile(q.Get("s"), q.Get("p"))
+	var fi os.FileInfo
+	if err == nil {
+		if fi, err = os.Stat(full_path); err == nil && !fi.Mode().IsRegular() {
+			err = errNoSuchDownload
+		}
+	}
+	if err != nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"POST %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	if service.parental_block(writer, request, parental_profile_of(request), q.Get("s"), full_path) {
+		return
+	}
+	download := download_queue.add(q.Get("s"), q.Get("p"), full_path, fi.Size())
+	size := json_response(writer, http.StatusCreated, download)
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" 201 %d \"%s\"", query, size, ua)
+}
+
+// GET /downloads is the queue of downloads
+func (service *MercuryFsService) list_downloads(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	size := json_response(writer, http.StatusOK, download_queue.list())
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
+
+// GET /downloads/{id} is the file of a download, when it's its turn, or a
+// 503 with its position and when it starts
+func (service *MercuryFsService) fetch_download(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	download, state, err := download_queue.begin(mux.Vars(request)["id"])
+	var file *os.File
+	if err == nil {
+		if file, err = os.Open(download.full_path); err != nil {
+			download_queue.end(download)
+			download_queue.remove(download.ID)
+		}
+	}
+	if err != nil {
+		status := http.StatusNotFound
+		result := map[string]interface{}{"error": err.Error()}
+		if err == errDownloadsClosed {
+			status = http.StatusServiceUnavailable
+			result["position"], result["starts"] = state.Position, state.Starts
+			retry := time.Minute
+			if state.Starts != nil && state.Starts.Sub(schedule_now()) > time.Second {
+				retry = state.Starts.Sub(schedule_now())
+			}
+			writer.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+		}
+		size := json_response(writer, status, result)
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" %d %d \"%s\"", query, status, size, ua)
+		return
+	}
+	defer file.Close()
+	fi, _ := file.Stat()
+	paced := &pacedWriter{ResponseWriter: writer, queue: download_queue, download: download, offset: range_start(request)}
+	http.ServeContent(paced, request, filepath.Base(download.full_path), fi.ModTime(), file)
+	download_queue.end(download)
+	sent := paced.offset - range_start(request)
+	service.debug_info.requestServed(sent)
+	log("\"GET %s\" 200 %d \"%s\"", query, sent, ua)
+}
+
+// DELETE /downloads/{id} takes a download off the queue
+func (service *MercuryFsService) cancel_download(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status := http.StatusNoContent
+	if !download_queue.remove(mux.Vars(request)["id"]) {
+		status = http.StatusNotFound
+	}
+	writer.WriteHeader(status)
+	service.debug_info.requestServed(int64(0))
+	log("\"DELETE %s\" %d 0 \"%s\"", query, status, ua)
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadQueue(t *testing.T) {
+	saved_config, saved_queue, saved_now := config, download_queue, schedule_now
+	defer func() { config, download_queue, schedule_now = saved_config, saved_queue, saved_now }()
+	config = default_config()
+	// 1MB/s
+	config.Downloads.Bandwidth = 8000
+	download_queue = new_download_queue()
+	now := time.Date(2018, 5, 1, 12, 0, 0, 0, time.Local)
+	schedule_now = func() time.Time { return now }
+
+	dir, _ := ioutil.TempDir("", "downloads")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "Movies"), 0755)
+	movie := bytes.Repeat([]byte("0123456789"), 20000)
+	ioutil.WriteFile(filepath.Join(dir, "Movies", "a.mkv"), movie, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "Movies", "b.mkv"), movie, 0644)
+
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Movies", path: filepath.Join(dir, "Movies")}}}, debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/downloads", service.queue_download).Methods("POST")
+	router.HandleFunc("/downloads", service.list_downloads).Methods("GET")
+	router.HandleFunc("/downloads/{id}", service.fetch_download).Methods("GET")
+	router.HandleFunc("/downloads/{id}", service.cancel_download).Methods("DELETE")
+	serve := func(method, target string, header ...string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, target, nil)
+		if len(header) == 2 {
+			request.Header.Set(header[0], header[1])
+		}
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+	queue := func(path string) queuedDownload {
+		var download queuedDownload
+		response := serve("POST", "/downloads?s=Movies&p="+path)
+		if response.Code != 201 || json.Unmarshal(response.Body.Bytes(), &download) != nil {
+			t.Fatalf("Could not queue %s: %d %s", path, response.Code, response.Body.String())
+		}
+		return download
+	}
+
+	a, b := queue("/a.mkv"), queue("/b.mkv")
+	if serve("POST", "/downloads?s=Movies&p=/c.mkv").Code != 404 {
+		t.Errorf("Queued a file that is not there")
+	}
+	var downloads []queuedDownload
+	json.Unmarshal(serve("GET", "/downloads").Body.Bytes(), &downloads)
+	if len(downloads) != 2 || downloads[0].State != "ready" || downloads[1].State != "queued" || downloads[1].Position != 2 {
+		t.Fatalf("Wrong queue: %+v", downloads)
+	}
+	// 200KB each at 1MB/s
+	if !downloads[0].Starts.Equal(now) || !downloads[0].ETA.Equal(now.Add(200*time.Millisecond)) ||
+		!downloads[1].Starts.Equal(*downloads[0].ETA) || !downloads[1].ETA.Equal(now.Add(400*time.Millisecond)) {
+		t.Errorf("Wrong times: %v %v %v %v", downloads[0].Starts, downloads[0].ETA, downloads[1].Starts, downloads[1].ETA)
+	}
+
+	// the jobs have them too
+	jobs := download_queue.jobs()
+	if len(jobs) != 2 || jobs[1].Name != "download-"+b.ID || jobs[1].Position != 2 || jobs[1].Total != 200000 || !jobs[1].ETA.Equal(*downloads[1].ETA) {
+		t.Errorf("Wrong jobs: %+v", jobs)
+	}
+
+	response := serve("GET", b.URL)
+	if response.Code != 503 || response.Header().Get("Retry-After") == "" || !bytes.Contains(response.Body.Bytes(), []byte(`"position":2`)) {
+		t.Errorf("Served a download before its turn: %d %s", response.Code, response.Body.String())
+	}
+
+	// paced, and resumed
+	start := time.Now()
+	response = serve("GET", a.URL, "Range", "bytes=100000-")
+	if response.Code != 206 || !bytes.Equal(response.Body.Bytes(), movie[100000:]) {
+		t.Fatalf("Wrong download: %d", response.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("Not paced: %s", elapsed)
+	}
+	downloads = download_queue.list()
+	if len(downloads) != 1 || downloads[0].ID != b.ID || downloads[0].State != "ready" {
+		t.Errorf("Wrong queue after a download: %+v", downloads)
+	}
+
+	// outside of the hours, they wait for the next ones
+	config.Downloads.Hours = "01:00-06:00"
+	if response := serve("GET", b.URL); response.Code != 503 {
+		t.Errorf("Served a download outside of the hours: %d", response.Code)
+	}
+	downloads = download_queue.list()
+	if opens := time.Date(2018, 5, 2, 1, 0, 0, 0, time.Local); downloads[0].State != "queued" || !downloads[0].Starts.Equal(opens) {
+		t.Errorf("Wrong start: %+v", downloads[0])
+	}
+
+	// and are dropped when not fetched once it's their turn
+	now = time.Date(2018, 5, 2, 2, 0, 0, 0, time.Local)
+	download_queue.list()
+	now = now.Add(DOWNLOAD_IDLE)
+	if result, _ := download_queue.cleanup()(func(done, total int64) {}); result != "1 downloads dropped, 0 queued" {
+		t.Errorf("Wrong cleanup: %s", result)
+	}
+	if serve("DELETE", b.URL).Code != 404 {
+		t.Errorf("Deleted a download not queued")
+	}
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a panic in a handler is recovered, logged with its stack and answered
+// with a 500, and the server goes on. the errors (5xx answers and panics)
+// of each endpoint are counted by the hour, for the last
+// ERROR_BUDGET_HOURS, and shown in /hda_debug, so that a feature failing
+// now and then shows up before users complain
+
+const ERROR_BUDGET_HOURS = 24
+
+type endpointHour struct {
+	Hour     time.Time `json:"hour"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`
+	Panics   int64     `json:"panics,omitempty"`
+}
+
+type endpointErrors struct {
+	Endpoint string         `json:"endpoint"`
+	Requests int64          `json:"requests"`
+	Errors   int64          `json:"errors"`
+	Panics   int64          `json:"panics"`
+	Hours    []endpointHour `json:"hours"`
+}
+
+type errorBudget struct {
+	// the hours with requests, oldest first, by endpoint
+	endpoints map[string][]endpointHour
+	sync.Mutex
+}
+
+var error_budget = &errorBudget{endpoints: make(map[string][]endpointHour)}
+
+// record counts a request to endpoint answered with status
+func (this *errorBudget) record(endpoint string, status int, panicked bool) {
+	hour := time.Now().Truncate(time.Hour)
+	this.Lock()
+	defer this.Unlock()
+	hours := this.endpoints[endpoint]
+	if len(hours) == 0 || !hours[len(hours)-1].Hour.Equal(hour) {
+		hours = append(hours, endpointHour{Hour: hour})
+	}
+	last := &hours[len(hours)-1]
+	last.Requests++
+	if status >= 500 || panicked {
+		last.Errors++
+	}
+	if panicked {
+		last.Panics++
+	}
+	this.endpoints[endpoint] = recent_hours(hours, hour)
+}
+
+// recent_hours drops the hours older than ERROR_BUDGET_HOURS before now
+func recent_hours(hours []endpointHour, now time.Time) []endpointHour {
+	oldest := now.Add(-(ERROR_BUDGET_HOURS - 1) * time.Hour)
+	for len(hours) > 0 && hours[0].Hour.Before(oldest) {
+		hours = hours[1:]
+	}
+	return hours
+}
+
+// status has the endpoints with errors first, the most first
+func (this *errorBudget) status() []endpointErrors {
+	now := time.Now().Truncate(time.Hour)
+	this.Lock()
+	defer this.Unlock()
+	result := []endpointErrors{}
+	for endpoint, hours := range this.endpoints {
+		hours = recent_hours(hours, now)
+		if len(hours) == 0 {
+			delete(this.endpoints, endpoint)
+			continue
+		}
+		e := endpointErrors{Endpoint: endpoint, Hours: append([]endpointHour{}, hours...)}
+		for _, hour := range hours {
+			e.Requests += hour.Requests
+			e.Errors += hour.Errors
+			e.Panics += hour.Panics
+		}
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Errors != result[j].Errors {
+			return result[i].Errors > result[j].Errors
+		}
+		return result[i].Endpoint < result[j].Endpoint
+	})
+	return result
+}
+
+// endpoint_of is the method and route of a request, like
+// "GET /transcode/{session}/{file}"
+func endpoint_of(request *http.Request) string {
+	if route := mux.CurrentRoute(request); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return request.Method + " " + template
+		}
+	}
+	return request.Method + " " + request.URL.Path
+}
+
+// statusWriter keeps the status and size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	sent   int64
+}
+
+func (this *statusWriter) WriteHeader(status int) {
+	if this.status == 0 {
+		this.status = status
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *statusWriter) Write(data []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	n, err := this.ResponseWriter.Write(data)
+	// read by /hda_debug while the request is served
+	atomic.AddInt64(&this.sent, int64(n))
+	return n, err
+}
+
+// ReadFrom keeps files sent with sendfile
+func (this *statusWriter) ReadFrom(reader io.Reader) (int64, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if from, ok := this.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = from.ReadFrom(reader)
+	} else {
+		n, err = io.Copy(this.ResponseWriter, reader)
+	}
+	atomic.AddInt64(&this.sent, n)
+	return n, err
+}
+
+func (this *statusWriter) Flush() {
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack is needed by the websockets of /events
+func (this *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := this.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
+
+func (this *statusWriter) Unwrap() http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+// recover_errors is a middleware recovering the panics of the handlers, and
+// counting the errors by endpoint, and the requests in the metrics
+func (service *MercuryFsService) recover_errors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		endpoint := endpoint_of(request)
+		status_writer := &statusWriter{ResponseWriter: writer}
+		service.debug_info.requestReceived()
+		started := time.Now()
+		body := &countingBody{ReadCloser: request.Body}
+		if request.Body != nil {
+			request.Body = body
+		}
+		active := active_requests.add(service.debug_info.server_name(), request, status_writer, body)
+		defer active_requests.remove(active)
+		defer func() {
+			service.debug_info.observe_request(request, status_writer.status, status_writer.sent, body.count, time.Since(started))
+		}()
+		defer func() {
+			err := recover()
+			if err == http.ErrAbortHandler {
+				// the handler gave up on the client on purpose
+				error_budget.record(endpoint, status_writer.status, false)
+				panic(err)
+			}
+			if err != nil {
+				log_error("Panic in \"%s %s\": %v", request.Method, pathForLog(request.URL), err)
+				stack := make([]byte, 64<<10)
+				debug(2, "%s", stack[:runtime.Stack(stack, false)])
+				if status_writer.status == 0 {
+					size := json_response(status_writer, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+					service.debug_info.requestServed(size)
+				}
+			}
+			error_budget.record(endpoint, status_writer.status, err != nil)
+		}()
+		next.ServeHTTP(status_writer, request)
+	})
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorBudget(t *testing.T) {
+	saved := error_budget
+	defer func() { error_budget = saved }()
+	error_budget = &errorBudget{endpoints: make(map[string][]endpointHour)}
+
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/md/{kind}", func(writer http.ResponseWriter, request *http.Request) {
+		if mux.Vars(request)["kind"] == "broken" {
+			var m map[string]string
+			m["boom"] = "panic"
+		}
+		if _, ok := writer.(http.Flusher); !ok {
+			t.Errorf("Responses cannot be flushed")
+		}
+		writer.Write([]byte("ok"))
+	}).Methods("GET")
+	router.HandleFunc("/files", func(writer http.ResponseWriter, request *http.Request) {
+		http.Error(writer, "disk gone", http.StatusServiceUnavailable)
+	}).Methods("GET")
+	router.Use(service.recover_errors)
+	request := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+
+	if response := request("/md/broken"); response.Code != 500 || !strings.Contains(response.Body.String(), "internal error") {
+		t.Errorf("Wrong answer to a panic: %d %s", response.Code, response.Body.String())
+	}
+	// and the server goes on
+	for i := 0; i < 3; i++ {
+		if response := request("/md/movie"); response.Code != 200 {
+			t.Errorf("%d after a panic", response.Code)
+		}
+	}
+	request("/files?s=Movies&p=/")
+
+	status := error_budget.status()
+	if len(status) != 2 {
+		t.Fatalf("Wrong endpoints: %v", status)
+	}
+	// as many errors, by name
+	files, md := status[0], status[1]
+	if md.Endpoint != "GET /md/{kind}" || md.Requests != 4 || md.Errors != 1 || md.Panics != 1 || len(md.Hours) != 1 {
+		t.Errorf("Wrong errors of the metadata: %+v", md)
+	}
+	if files.Endpoint != "GET /files" || files.Errors != 1 || files.Panics != 0 {
+		t.Errorf("Wrong errors of the files: %+v", files)
+	}
+
+	// only the last hours are kept
+	now := time.Now().Truncate(time.Hour)
+	hours := []endpointHour{{Hour: now.Add(-ERROR_BUDGET_HOURS * time.Hour)}, {Hour: now.Add(-time.Hour)}, {Hour: now}}
+	if kept := recent_hours(hours, now); len(kept) != 2 {
+		t.Errorf("Wrong hours kept: %v", kept)
+	}
+}
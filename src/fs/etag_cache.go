@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash/maphash"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// a cache of the ETags of files and of JSON responses, so that the sha1 of
+// big listings is not computed again for every request. every entry has a
+// stamp of its source, the mtime and size of a file or a fast hash of a
+// response, and is computed again when the stamp changes. files changed in
+// the shares get their ETag refreshed in the background, by the watcher
+
+const ETAG_CACHE_SIZE = 4096
+
+type etagStamp struct {
+	hash uint64
+	size int64
+}
+
+type etagEntry struct {
+	key   string
+	stamp etagStamp
+	etag  string
+}
+
+type etagCache struct {
+	entries map[string]*list.Element
+	// least recently used last
+	order        *list.List
+	max          int
+	seed         maphash.Seed
+	hits, misses int64
+	sync.Mutex
+}
+
+var etag_cache = new_etag_cache(ETAG_CACHE_SIZE)
+
+func new_etag_cache(max int) *etagCache {
+	return &etagCache{entries: make(map[string]*list.Element), order: list.New(), max: max, seed: maphash.MakeSeed()}
+}
+
+// get returns the ETag of key, with compute when the stamp of its source
+// has changed
+func (this *etagCache) get(key string, stamp etagStamp, compute func() string) string {
+	this.Lock()
+	if element, ok := this.entries[key]; ok {
+		entry := element.Value.(*etagEntry)
+		if entry.stamp == stamp {
+			this.order.MoveToFront(element)
+			this.hits++
+			this.Unlock()
+			return entry.etag
+		}
+	}
+	this.misses++
+	this.Unlock()
+
+	etag := compute()
+	this.store(key, stamp, etag)
+	return etag
+}
+
+func (this *etagCache) store(key string, stamp etagStamp, etag string) {
+	this.Lock()
+	defer this.Unlock()
+	if element, ok := this.entries[key]; ok {
+		element.Value = &etagEntry{key: key, stamp: stamp, etag: etag}
+		this.order.MoveToFront(element)
+		return
+	}
+	this.entries[key] = this.order.PushFront(&etagEntry{key: key, stamp: stamp, etag: etag})
+	for this.order.Len() > this.max {
+		oldest := this.order.Back()
+		this.order.Remove(oldest)
+		delete(this.entries, oldest.Value.(*etagEntry).key)
+	}
+}
+
+func (this *etagCache) forget(key string) {
+	this.Lock()
+	defer this.Unlock()
+	if element, ok := this.entries[key]; ok {
+		this.order.Remove(element)
+		delete(this.entries, key)
+	}
+}
+
+// bytes_etag is the ETag of a response, data, identified by key
+func (this *etagCache) bytes_etag(key string, data []byte) string {
+	stamp := etagStamp{hash: maphash.Bytes(this.seed, data), size: int64(len(data))}
+	return this.get("bytes:"+key, stamp, func() string { return `"` + sha1bytes(data) + `"` })
+}
+
+// string_etag is bytes_etag for a response in a string
+func (this *etagCache) string_etag(key, data string) string {
+	stamp := etagStamp{hash: maphash.String(this.seed, data), size: int64(len(data))}
+	return this.get("bytes:"+key, stamp, func() string { return `"` + sha1string(data) + `"` })
+}
+
+// listing_etag is bytes_etag for a directory listing, which is encoded as
+// it goes instead of being held in memory. it returns its size too
+func (this *etagCache) listing_etag(key string, file_infos []fileInfo) (string, int64) {
+	var hash maphash.Hash
+	hash.SetSeed(this.seed)
+	size, _ := write_listing(&hash, file_infos)
+	stamp := etagStamp{hash: hash.Sum64(), size: size}
+	etag := this.get("bytes:"+key, stamp, func() string {
+		sum := sha1.New()
+		write_listing(sum, file_infos)
+		return `"` + hex.EncodeToString(sum.Sum(nil)) + `"`
+	})
+	return etag, size
+}
+
+// file_etag is the ETag of the file at path, as requested, from its mtime
+func (this *etagCache) file_etag(path string, fi os.FileInfo) string {
+	stamp := etagStamp{hash: uint64(fi.ModTime().UnixNano()), size: fi.Size()}
+	return this.get("file:"+path, stamp, func() string {
+		mtime := fi.ModTime().UTC().Format(http.TimeFormat)
+		return `"` + sha1string(path+mtime) + `"`
+	})
+}
+
+// refresh is a watcher listener computing the ETags of changed files ahead
+// of the requests for them
+func (this *etagCache) refresh(share *HdaShare, event fileEvent) {
+	if event.IsDir {
+		return
+	}
+	if event.Op != "create" && event.Op != "modify" {
+		this.forget("file:" + event.Path)
+		return
+	}
+	this.Lock()
+	_, known := this.entries["file:"+event.Path]
+	this.Unlock()
+	// only what has been asked for before is worth refreshing
+	if !known {
+		return
+	}
+	if fi, err := os.Stat(share.path + event.Path); err == nil && fi.Mode().IsRegular() {
+		this.file_etag(event.Path, fi)
+	}
+}
+
+func (this *etagCache) status() map[string]int64 {
+	this.Lock()
+	defer this.Unlock()
+	return map[string]int64{"entries": int64(this.order.Len()), "hits": this.hits, "misses": this.misses}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEtagCache(t *testing.T) {
+	cache := new_etag_cache(2)
+	data := []byte(`[{"name": "a"}]`)
+	if etag := cache.bytes_etag("/files?p=/", data); etag != `"`+sha1bytes(data)+`"` {
+		t.Errorf("Wrong ETag: %s", etag)
+	}
+	cache.bytes_etag("/files?p=/", data)
+	if status := cache.status(); status["hits"] != 1 || status["misses"] != 1 {
+		t.Errorf("Wrong stats: %v", status)
+	}
+	// a new listing for the same request is hashed again
+	changed := []byte(`[{"name": "b"}]`)
+	if etag := cache.bytes_etag("/files?p=/", changed); etag != `"`+sha1bytes(changed)+`"` {
+		t.Errorf("Stale ETag: %s", etag)
+	}
+	if cache.string_etag("/shares", "[]") != `"`+sha1string("[]")+`"` {
+		t.Errorf("Wrong ETag for a string")
+	}
+	cache.string_etag("/apps", "[]")
+	if status := cache.status(); status["entries"] != 2 {
+		t.Errorf("The cache grew past its size: %v", status)
+	}
+
+	// files changed in a share are refreshed ahead of time
+	dir, _ := ioutil.TempDir("", "etag")
+	defer os.RemoveAll(dir)
+	share := &HdaShare{name: "Docs", path: dir}
+	full_path := filepath.Join(dir, "a.txt")
+	ioutil.WriteFile(full_path, []byte("one"), 0644)
+	fi, _ := os.Stat(full_path)
+	before := cache.file_etag("/a.txt", fi)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(full_path, later, later)
+	cache.refresh(share, fileEvent{Share: "Docs", Path: "/a.txt", Op: "modify"})
+	fi, _ = os.Stat(full_path)
+	misses := cache.status()["misses"]
+	if after := cache.file_etag("/a.txt", fi); after == before || cache.status()["misses"] != misses {
+		t.Errorf("The ETag was not refreshed: %s %s", before, after)
+	}
+	cache.refresh(share, fileEvent{Share: "Docs", Path: "/a.txt", Op: "delete"})
+	if cache.status()["entries"] != 1 {
+		t.Errorf("A deleted file is still cached")
+	}
+}
+
+// with a 1MB listing, compare hashing every response to using the cache
+func BenchmarkEtagCache(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 1<<20; i++ {
+		fmt.Fprintf(&buf, `{"name": "file-%06d.mkv", "mime_type": "video/x-matroska", "size": %d},`, i, i*1000)
+	}
+	data := buf.Bytes()
+	b.Run("sha1", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				sha1bytes(data)
+			}
+		})
+	})
+	b.Run("cached", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		cache := new_etag_cache(ETAG_CACHE_SIZE)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				cache.bytes_etag("/files?s=Movies&p=/", data)
+			}
+		})
+	})
+}
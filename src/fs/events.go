@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file change notifications for clients, so they do not need to poll
+// directory ETags. /events is a WebSocket when the client asks for an
+// upgrade and Server-Sent Events otherwise (over the relay, which is
+// HTTP/2, upgrades are not possible).
+//
+// changes to the list of shares go to every client, as a "shares" event
+// with the shares added, changed and removed. the changes in the home
+// folders only go to their user, with the path in the home
+
+const EVENTS_BUFFER = 256
+const EVENTS_KEEPALIVE = 30 * time.Second
+
+type fileEvent struct {
+	Share string    `json:"share"`
+	Path  string    `json:"path"`
+	Op    string    `json:"op"`
+	IsDir bool      `json:"is_dir,omitempty"`
+	Time  time.Time `json:"time"`
+	// for "shares" events
+	Shares *sharesDiff `json:"shares,omitempty"`
+}
+
+type sharesDiff struct {
+	Added   []shareEntry `json:"added"`
+	Changed []shareEntry `json:"changed"`
+	Removed []string     `json:"removed"`
+}
+
+// eventHub fans out file events to the connected clients
+type eventHub struct {
+	subscribers map[chan fileEvent]eventSubscription
+	sync.RWMutex
+}
+
+// eventSubscription is the share a client asked for, "" for all, and its
+// user, if any
+type eventSubscription struct {
+	share, user string
+}
+
+var events = new_event_hub()
+
+func new_event_hub() *eventHub {
+	return &eventHub{subscribers: make(map[chan fileEvent]eventSubscription)}
+}
+
+// subscribe returns a channel with the events of one share, or of all of
+// them if share is empty, as seen by user
+func (this *eventHub) subscribe(share, user string) chan fileEvent {
+	ch := make(chan fileEvent, EVENTS_BUFFER)
+	this.Lock()
+	this.subscribers[ch] = eventSubscription{share: share, user: user}
+	this.Unlock()
+	return ch
+}
+
+func (this *eventHub) unsubscribe(ch chan fileEvent) {
+	this.Lock()
+	delete(this.subscribers, ch)
+	this.Unlock()
+}
+
+// publish never blocks: a client that does not keep up misses events
+func (this *eventHub) publish(event fileEvent) {
+	this.RLock()
+	defer this.RUnlock()
+	for ch, subscription := range this.subscribers {
+		event := event
+		if event.Op != "shares" {
+			if subscription.share != "" && subscription.share != event.Share {
+				continue
+			}
+			if is_homes_share(event.Share) && event.Path != "/" {
+				relative, ok := home_event_path(subscription.user, event.Path)
+				if !ok {
+					continue
+				}
+				event.Path = relative
+			}
+		}
+		select {
+		case ch <- event:
+		default:
+			debug(3, "events: dropping event for a slow client")
+		}
+	}
+}
+
+// home_event_path is the path in the home of user of path in the home
+// share, if it is in that home
+func home_event_path(user, path string) (string, bool) {
+	if user == "" {
+		return "", false
+	}
+	home := "/" + user
+	if path == home {
+		return "/", true
+	}
+	if strings.HasPrefix(path, home+"/") {
+		return path[len(home):], true
+	}
+	return "", false
+}
+
+var events_upgrader = websocket.Upgrader{
+	// mobile apps do not send an Origin, and access is already restricted by session
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func (service *MercuryFsService) serve_events(writer http.ResponseWriter, request *http.Request) {
+	share := request.URL.Query().Get("s")
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	if share != "" && service.Shares.Get(share) == nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+
+	ch := events.subscribe(share, home_user_of(request))
+	defer events.unsubscribe(ch)
+
+	if websocket.IsWebSocketUpgrade(request) {
+		log("\"GET %s\" 101 0 \"%s\"", query, ua)
+		service.events_websocket(writer, request, ch)
+	} else {
+		log("\"GET %s\" 200 0 \"%s\"", query, ua)
+		service.events_sse(writer, request, ch)
+	}
+	service.debug_info.requestServed(int64(0))
+}
+
+func (service *MercuryFsService) events_websocket(writer http.ResponseWriter, request *http.Request, ch chan fileEvent) {
+	conn, err := events_upgrader.Upgrade(writer, request, nil)
+	if err != nil {
+		debug(2, "events: websocket upgrade failed: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	// the client does not send anything, but reading notices when it goes away
+	closed := make(chan bool)
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(EVENTS_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-ch:
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (service *MercuryFsService) events_sse(writer http.ResponseWriter, request *http.Request, ch chan fileEvent) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	header := writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache, private")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(EVENTS_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-ch:
+			data, _ := json.Marshal(event)
+			if _, err := fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event.Op, data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := writer.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		case <-request.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
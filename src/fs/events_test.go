@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventHub(t *testing.T) {
+	hub := new_event_hub()
+	all := hub.subscribe("", "")
+	movies := hub.subscribe("Movies", "")
+	defer hub.unsubscribe(all)
+	defer hub.unsubscribe(movies)
+
+	hub.publish(fileEvent{Share: "Music", Path: "/a.mp3", Op: "create"})
+	hub.publish(fileEvent{Share: "Movies", Path: "/b.mkv", Op: "delete"})
+	if len(all) != 2 || len(movies) != 1 {
+		t.Fatalf("Wrong number of events: %d and %d", len(all), len(movies))
+	}
+	if event := <-movies; event.Path != "/b.mkv" {
+		t.Errorf("Wrong event: %#v", event)
+	}
+}
+
+func TestHomesEvents(t *testing.T) {
+	saved := config.Homes
+	defer func() { config.Homes = saved }()
+	config.Homes.Share = "Users"
+	hub := new_event_hub()
+	anyone := hub.subscribe("", "")
+	ann := hub.subscribe("", "ann")
+	defer hub.unsubscribe(anyone)
+	defer hub.unsubscribe(ann)
+
+	hub.publish(fileEvent{Share: "Users", Path: "/bob/secret.txt", Op: "create"})
+	hub.publish(fileEvent{Share: "Users", Path: "/ann/notes.txt", Op: "modify"})
+	hub.publish(fileEvent{Share: "Users", Path: "/annie/notes.txt", Op: "modify"})
+	hub.publish(fileEvent{Share: "Users", Path: "/", Op: "awake"})
+	if len(anyone) != 1 || len(ann) != 2 {
+		t.Fatalf("Wrong number of events: %d and %d", len(anyone), len(ann))
+	}
+	if event := <-ann; event.Path != "/notes.txt" {
+		t.Errorf("Wrong path in the home: %#v", event)
+	}
+}
+
+func TestShareWatcher(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "events")
+	defer os.RemoveAll(dir)
+	err := os.MkdirAll(filepath.Join(dir, "share", "sub"), 0777)
+	if err != nil {
+		t.Fatalf("Mkdir failed: %s", err.Error())
+	}
+	shares, err := NewHdaShares(dir)
+	if err != nil {
+		t.Fatalf("NewHdaShares failed: %s", err.Error())
+	}
+	sw := new_share_watcher(shares)
+	if sw == nil {
+		t.Skip("fsnotify is not available")
+	}
+	defer sw.close()
+	sw.listen(publish_event)
+	sw.sync()
+
+	ch := events.subscribe("share", "")
+	defer events.unsubscribe(ch)
+	ioutil.WriteFile(filepath.Join(dir, "share", "sub", "new.txt"), []byte("new"), 0644)
+
+	select {
+	case event := <-ch:
+		if event.Op != "create" || event.Path != "/sub/new.txt" {
+			t.Errorf("Wrong event: %#v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("No event for a new file")
+	}
+}
+
+func TestSharesEvents(t *testing.T) {
+	saved, saved_homes := events, config.Homes
+	defer func() { events, config.Homes = saved, saved_homes }()
+	events = new_event_hub()
+	config.Homes.Share = "Users"
+
+	dir, _ := ioutil.TempDir("", "events")
+	defer os.RemoveAll(dir)
+	shares := &HdaShares{}
+	shares.set_shares([]*HdaShare{{name: "Movies", path: dir}, {name: "Docs", path: dir, tags: "docs"}})
+	// the clients of one share see them too
+	ch := events.subscribe("Movies", "")
+	defer events.unsubscribe(ch)
+
+	shares.set_shares([]*HdaShare{{name: "Movies", path: dir}, {name: "Docs", path: dir, tags: "work"}, {name: "Music", path: dir}, {name: "Users", path: dir}})
+	shares.set_shares([]*HdaShare{{name: "Docs", path: dir, tags: "work"}, {name: "Music", path: dir}, {name: "Users", path: dir}})
+	// no event without a change
+	shares.set_shares([]*HdaShare{{name: "Docs", path: dir, tags: "work"}, {name: "Music", path: dir}, {name: "Users", path: dir}})
+
+	first, second := <-ch, <-ch
+	if first.Op != "shares" || len(first.Shares.Added) != 1 || first.Shares.Added[0].Name != "Music" || len(first.Shares.Changed) != 1 || first.Shares.Changed[0].Tags[0] != "work" {
+		t.Errorf("Wrong first change: %+v", first.Shares)
+	}
+	if len(second.Shares.Removed) != 1 || second.Shares.Removed[0] != "Movies" || len(second.Shares.Added) != 0 {
+		t.Errorf("Wrong second change: %+v", second.Shares)
+	}
+	select {
+	case event := <-ch:
+		t.Errorf("Event without a change: %+v", event.Shares)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -10,13 +10,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +31,10 @@ type fileInfo struct {
 	mime_type string
 	mtime     time.Time
 	size      int64
+	// the place of a pinned entry, from 1, 0 for the others
+	pinned int
+	// the owner and mode, when asked for
+	posix *posixEntry
 }
 
 type fileSorter struct {
@@ -43,16 +53,62 @@ func (fi *fileSorter) Swap(i, j int) {
 
 // Less is part of sort.Interface.
 func (fi *fileSorter) Less(i, j int) bool {
-	return strings.ToLower(fi.files[i].name) < strings.ToLower(fi.files[j].name)
+	return file_name_less(fi.files[i].name, fi.files[j].name)
+}
+
+// file_name_less orders names regardless of case, and names that only differ
+// in case by their bytes, so that pages of a listing do not overlap
+func file_name_less(a, b string) bool {
+	la, lb := strings.ToLower(a), strings.ToLower(b)
+	if la != lb {
+		return la < lb
+	}
+	return a < b
+}
+
+// rough size of the JSON for one entry, not counting the name
+const FILE_INFO_JSON_SIZE = 110
+
+// fileEntry is a file as listed in JSON
+type fileEntry struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+	Mtime    string `json:"mtime"`
+	Size     int64  `json:"size"`
+	Pinned   int    `json:"pinned,omitempty"`
+	*posixEntry
+}
+
+func (this *fileInfo) entry() fileEntry {
+	return fileEntry{Name: this.name, MimeType: this.mime_type, Mtime: this.mtime.Format(http.TimeFormat), Size: this.size, Pinned: this.pinned,
+		posixEntry: this.posix}
 }
 
 func (this *fileInfo) to_json() string {
-	name, _ := json.Marshal(this.name)
-	return fmt.Sprintf(`{"name": %s, "mime_type": "%s", "mtime": "%s", "size": %d}`, string(name), this.mime_type, this.mtime.Format(http.TimeFormat), this.size)
+	data, _ := json.Marshal(this.entry())
+	return string(data)
+}
+
+// write_listing writes the entries to w as a JSON array, one at a time,
+// and returns the number of bytes written
+func write_listing(w io.Writer, file_infos []fileInfo) (int64, error) {
+	counter := &countingWriter{writer: w}
+	encoder := json.NewEncoder(counter)
+	io.WriteString(counter, "[")
+	for i := range file_infos {
+		if i > 0 {
+			io.WriteString(counter, ",")
+		}
+		if err := encoder.Encode(file_infos[i].entry()); err != nil {
+			return counter.count, err
+		}
+	}
+	_, err := io.WriteString(counter, "]")
+	return counter.count, err
 }
 
 func directory_fileInfos(fis []os.FileInfo, full_path string) []fileInfo {
-	file_infos := []fileInfo{}
+	file_infos := make([]fileInfo, 0, len(fis))
 	for i := range fis {
 		if fis[i].Name()[0] == '.' {
 			continue
@@ -65,8 +121,11 @@ func directory_fileInfos(fis []os.FileInfo, full_path string) []fileInfo {
 			fileInfo.mime_type = "text/directory"
 			fileInfo.size = 0
 		} else {
-			fileInfo.mime_type = getContentType(fis[i].Name())
-			fileInfo.size = fis[i].Size()
+			// archived files are listed as they were
+			fi := stub_info(fis[i], full_path)
+			fileInfo.mime_type = getContentType(fi.Name())
+			fileInfo.size = fi.Size()
+			fileInfo.mtime = fi.ModTime()
 		}
 		file_infos = append(file_infos, fileInfo)
 	}
@@ -78,110 +137,322 @@ func directory_fileInfos(fis []os.FileInfo, full_path string) []fileInfo {
 	return file_infos
 }
 
+// the entries of directories with at least PARALLEL_STAT_MIN of them are
+// stat'ed by listing_stat_workers at a time, which is most of the time of a
+// listing on network and USB disks
+const PARALLEL_STAT_MIN = 64
+
+var listing_stat_workers = 16
+
+// lstat is os.Lstat, replaced in benchmarks
+var lstat = os.Lstat
+
+// read_listing reads up to n (0 for all) entries of the directory open in
+// osFile at full_path, like Readdir, leaving out the hidden ones
+func read_listing(osFile *os.File, full_path string, n int) ([]os.FileInfo, error) {
+	names, err := osFile.Readdirnames(n)
+	kept := names[:0]
+	for _, name := range names {
+		if name[0] != '.' {
+			kept = append(kept, name)
+		}
+	}
+	return stat_names(full_path, kept), err
+}
+
+// stat_names stats the files in dir, leaving out the ones that are gone
+func stat_names(dir string, names []string) []os.FileInfo {
+	fis := make([]os.FileInfo, len(names))
+	stat := func(i int) {
+		if fi, err := lstat(filepath.Join(dir, names[i])); err == nil {
+			fis[i] = fi
+		}
+	}
+	workers := listing_stat_workers
+	if len(names) < PARALLEL_STAT_MIN || workers < 2 {
+		for i := range names {
+			stat(i)
+		}
+	} else {
+		var wg sync.WaitGroup
+		next := int64(-1)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := atomic.AddInt64(&next, 1); i < int64(len(names)); i = atomic.AddInt64(&next, 1) {
+					stat(int(i))
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	kept := fis[:0]
+	for _, fi := range fis {
+		if fi != nil {
+			kept = append(kept, fi)
+		}
+	}
+	return kept
+}
+
 func dirToJSON(osFile *os.File, full_path string) (string, error) {
-	fis, err := osFile.Readdir(0)
-	if err != nil {
-		return "", err
+	js, _, err := dirPageToJSON(osFile, full_path, "", 0, nil)
+	return js, err
+}
+
+// listingFilter says if a file is left out of a listing, by name
+type listingFilter func(name string) bool
+
+// visible leaves out the files hidden by filter, if any
+func (filter listingFilter) visible(fis []os.FileInfo) []os.FileInfo {
+	if filter == nil {
+		return fis
+	}
+	kept := fis[:0]
+	for _, fi := range fis {
+		if fi.IsDir() || !filter(fi.Name()) {
+			kept = append(kept, fi)
+		}
 	}
+	return kept
+}
+
+// listings of directories with more entries than config.Listing.MaxEntries
+// are returned a page at a time, each with a continuation token for the
+// next one. sorted listings continue after the last name of the page, and
+// streamed ones, which are in disk order, after as many entries
 
-	file_infos := directory_fileInfos(fis, full_path)
+var errBadContinuation = errors.New("invalid continuation token")
+
+func encode_continuation(kind, value string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(kind + ":" + value))
+}
 
-	if len(file_infos) == 0 {
-		return "[]", nil
+// decode_continuation returns the value in a token of kind, "" for no token
+func decode_continuation(token, kind string) (string, error) {
+	if token == "" {
+		return "", nil
 	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || !strings.HasPrefix(string(data), kind+":") {
+		return "", errBadContinuation
+	}
+	return string(data[len(kind)+1:]), nil
+}
 
-	ss := []string{}
-	for i := range file_infos {
-		temp := file_infos[i].to_json()
-		ss = append(ss, temp)
+// dirPage returns up to limit (0 for all) entries of the directory, sorted,
+// after the ones before continuation and without the ones hidden, and the
+// continuation of the next page, "" if this is the last one
+func dirPage(osFile *os.File, full_path, continuation string, limit int, hidden listingFilter) ([]fileInfo, string, error) {
+	after, err := decode_continuation(continuation, "n")
+	if err != nil {
+		return nil, "", err
+	}
+	fis, err := read_listing(osFile, full_path, 0)
+	if err != nil {
+		return nil, "", err
 	}
 
-	result := "[\n"
-	result += strings.Join(ss, ",\n ")
-	result += "\n]"
-	return result, nil
+	file_infos := directory_fileInfos(hidden.visible(fis), full_path)
+	if continuation != "" {
+		first := sort.Search(len(file_infos), func(i int) bool { return file_name_less(after, file_infos[i].name) })
+		file_infos = file_infos[first:]
+	}
+	next := ""
+	if limit > 0 && len(file_infos) > limit {
+		file_infos = file_infos[:limit]
+		next = encode_continuation("n", file_infos[limit-1].name)
+	}
+	return file_infos, next, nil
 }
 
-func getContentType(fileName string) string {
-	encodingMap := map[string]string{
-		".pdf":  "application/pdf",
-		".ogx":  "application/ogg",
-		".anx":  "application/annodex",
-		".txt":  "text/plain",
-		".jpg":  "image/jpeg",
-		".jpeg": "image/jpeg",
-		".tif":  "image/tiff",
-		".tiff": "image/tiff",
-		".png":  "image/png",
-		".svg":  "image/svg+xml",
-		".mp3":  "audio/mpeg",
-		".aac":  "audio/aac",
-		".oga":  "audio/ogg",
-		".ogg":  "audio/ogg",
-		".spx":  "audio/ogg",
-		".wav":  "audio/vnd.wave",
-		".flac": "audio/flac",
-		".axa":  "audio/annodex",
-		".m4a":  "audio/mp4",
-		".mka":  "audio/x-matroska",
-		".axv":  "video/annodex",
-		".ogv":  "video/ogg",
-		".mov":  "video/quicktime",
-		".mkv":  "video/x-matroska",
-		".mk3d": "video/x-matroska-3d",
-		".mp4":  "video/mp4",
-		".m4v":  "video/x-m4v",
-		".mpeg": "video/mpeg",
-		".mpg":  "video/mpeg",
-		".ts":   "video/mpeg",
-		".avi":  "video/divx",
-		".qt":   "video/quicktime",
-		".wmv":  "video/x-ms-wmv",
-		".wtv":  "video/x-ms-wtv",
-		".flv":  "video/x-flv",
-		".3gp":  "video/3gpp",
-		".webm":  "video/webm",
-		".epub": "application/epub+zip",
-		".mobi": "application/x-mobipocket",
-		".zip":  "application/zip",
-		".doc":  "application/msword",
-		".dot":  "application/msword",
-		".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
-		".dotx": "application/vnd.openxmlformats-officedocument.wordprocessingml.template",
-		".docm": "application/vnd.ms-word.document.macroEnabled.12",
-		".dotm": "application/vnd.ms-word.template.macroEnabled.12",
-		".xls":  "application/vnd.ms-excel",
-		".xlt":  "application/vnd.ms-excel",
-		".xla":  "application/vnd.ms-excel",
-		".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
-		".xltx": "application/vnd.openxmlformats-officedocument.spreadsheetml.template",
-		".xlsm": "application/vnd.ms-excel.sheet.macroEnabled.12",
-		".xltm": "application/vnd.ms-excel.template.macroEnabled.12",
-		".xlam": "application/vnd.ms-excel.addin.macroEnabled.12",
-		".xlsb": "application/vnd.ms-excel.sheet.binary.macroEnabled.12",
-		".ppt":  "application/vnd.ms-powerpoint",
-		".pot":  "application/vnd.ms-powerpoint",
-		".pps":  "application/vnd.ms-powerpoint",
-		".ppa":  "application/vnd.ms-powerpoint",
-		".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
-		".potx": "application/vnd.openxmlformats-officedocument.presentationml.template",
-		".ppsx": "application/vnd.openxmlformats-officedocument.presentationml.slideshow",
-		".ppam": "application/vnd.ms-powerpoint.addin.macroEnabled.12",
-		".pptm": "application/vnd.ms-powerpoint.presentation.macroEnabled.12",
-		".potm": "application/vnd.ms-powerpoint.presentation.macroEnabled.12",
-		".ppsm": "application/vnd.ms-powerpoint.slideshow.macroEnabled.12",
-		".html": "text/html",
-		".htm":  "text/html",
-		// subtitle stuff, with others below
-		".srt":  "application/x-subrip",
-		".sub":  "text/vnd.dvb.subtitle",
+// dirPageToJSON is dirPage as JSON
+func dirPageToJSON(osFile *os.File, full_path, continuation string, limit int, hidden listingFilter) (string, string, error) {
+	file_infos, next, err := dirPage(osFile, full_path, continuation, limit, hidden)
+	if err != nil {
+		return "", "", err
 	}
+	var buf bytes.Buffer
+	_, err = write_listing(&buf, file_infos)
+	return buf.String(), next, err
+}
 
+// number of entries read from the directory at a time when streaming
+const NDJSON_BATCH_SIZE = 256
+
+// dirToNDJSON writes the directory entries to w as newline-delimited JSON,
+// one object per line, as they are read from disk. entries are not sorted,
+// so that huge directories do not need to be held in memory.
+// it returns the number of bytes written.
+func dirToNDJSON(osFile *os.File, full_path string, w io.Writer) (int64, error) {
+	return dirPageToNDJSON(osFile, full_path, w, "", 0, nil, nil, false)
+}
+
+// dirPageToNDJSON streams up to limit (0 for all) entries, after the ones
+// before continuation and without the ones hidden, with their place in pins,
+// and their owner and mode with posix. when there are more, the last line is an object with the continuation of
+// the next page
+func dirPageToNDJSON(osFile *os.File, full_path string, w io.Writer, continuation string, limit int, hidden listingFilter, pins map[string]int, posix bool) (int64, error) {
+	offset, err := decode_continuation(continuation, "o")
+	if err != nil {
+		return 0, err
+	}
+	skip := int64(0)
+	if offset != "" {
+		if skip, err = strconv.ParseInt(offset, 10, 64); err != nil || skip < 0 {
+			return 0, errBadContinuation
+		}
+	}
+	var written int64
+	// entries seen so far, in disk order, and sent in this page
+	var seen, sent int64
+	more := false
+	flusher, _ := w.(http.Flusher)
+	buf := get_buffer(NDJSON_BATCH_SIZE * FILE_INFO_JSON_SIZE)
+	defer put_buffer(buf)
+	encoder := json.NewEncoder(buf)
+	for {
+		fis, err := read_listing(osFile, full_path, NDJSON_BATCH_SIZE)
+		fis = hidden.visible(fis)
+		buf.Reset()
+		for i := range fis {
+			if fis[i].Name()[0] == '.' {
+				continue
+			}
+			seen++
+			if seen <= skip {
+				continue
+			}
+			if limit > 0 && sent == int64(limit) {
+				more = true
+				break
+			}
+			sent++
+			fileInfo := fileInfo{
+				name:   fis[i].Name(),
+				mtime:  fis[i].ModTime(),
+				pinned: pins[fis[i].Name()],
+			}
+			if fis[i].IsDir() || isSymlinkDir(fis[i], full_path) {
+				fileInfo.mime_type = "text/directory"
+			} else {
+				fi := stub_info(fis[i], full_path)
+				fileInfo.mime_type = getContentType(fi.Name())
+				fileInfo.size = fi.Size()
+				fileInfo.mtime = fi.ModTime()
+			}
+			if posix {
+				fileInfo.posix = posix_entry(filepath.Join(full_path, fis[i].Name()), fis[i])
+			}
+			encoder.Encode(fileInfo.entry())
+		}
+		if more {
+			encoder.Encode(map[string]string{"continuation": encode_continuation("o", strconv.FormatInt(skip+sent, 10))})
+		}
+		if buf.Len() > 0 {
+			n, werr := w.Write(buf.Bytes())
+			written += int64(n)
+			if werr != nil {
+				return written, werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF || more {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+var encodingMap = map[string]string{
+	".pdf":  "application/pdf",
+	".ogx":  "application/ogg",
+	".anx":  "application/annodex",
+	".txt":  "text/plain",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".png":  "image/png",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".svg":  "image/svg+xml",
+	".mp3":  "audio/mpeg",
+	".aac":  "audio/aac",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".spx":  "audio/ogg",
+	".wav":  "audio/vnd.wave",
+	".flac": "audio/flac",
+	".axa":  "audio/annodex",
+	".m4a":  "audio/mp4",
+	".mka":  "audio/x-matroska",
+	".axv":  "video/annodex",
+	".ogv":  "video/ogg",
+	".mov":  "video/quicktime",
+	".mkv":  "video/x-matroska",
+	".mk3d": "video/x-matroska-3d",
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".mpeg": "video/mpeg",
+	".mpg":  "video/mpeg",
+	".ts":   "video/mpeg",
+	".avi":  "video/divx",
+	".qt":   "video/quicktime",
+	".wmv":  "video/x-ms-wmv",
+	".wtv":  "video/x-ms-wtv",
+	".flv":  "video/x-flv",
+	".3gp":  "video/3gpp",
+	".webm":  "video/webm",
+	".epub": "application/epub+zip",
+	".mobi": "application/x-mobipocket",
+	".zip":  "application/zip",
+	".doc":  "application/msword",
+	".dot":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".dotx": "application/vnd.openxmlformats-officedocument.wordprocessingml.template",
+	".docm": "application/vnd.ms-word.document.macroEnabled.12",
+	".dotm": "application/vnd.ms-word.template.macroEnabled.12",
+	".xls":  "application/vnd.ms-excel",
+	".xlt":  "application/vnd.ms-excel",
+	".xla":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".xltx": "application/vnd.openxmlformats-officedocument.spreadsheetml.template",
+	".xlsm": "application/vnd.ms-excel.sheet.macroEnabled.12",
+	".xltm": "application/vnd.ms-excel.template.macroEnabled.12",
+	".xlam": "application/vnd.ms-excel.addin.macroEnabled.12",
+	".xlsb": "application/vnd.ms-excel.sheet.binary.macroEnabled.12",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pot":  "application/vnd.ms-powerpoint",
+	".pps":  "application/vnd.ms-powerpoint",
+	".ppa":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".potx": "application/vnd.openxmlformats-officedocument.presentationml.template",
+	".ppsx": "application/vnd.openxmlformats-officedocument.presentationml.slideshow",
+	".ppam": "application/vnd.ms-powerpoint.addin.macroEnabled.12",
+	".pptm": "application/vnd.ms-powerpoint.presentation.macroEnabled.12",
+	".potm": "application/vnd.ms-powerpoint.presentation.macroEnabled.12",
+	".ppsm": "application/vnd.ms-powerpoint.slideshow.macroEnabled.12",
+	".html": "text/html",
+	".htm":  "text/html",
+	// subtitle stuff, with others below
+	".srt":  "application/x-subrip",
+	".sub":  "text/vnd.dvb.subtitle",
+}
+
+func init() {
 	sub_extensions := []string{".idx", ".sub", ".srt", ".ssa", ".ass", ".smi", ".utf", ".utf8", ".utf-8", ".rt", ".aqt", ".usf", ".jss", ".cdg", ".psb", ".mpsub", ".mpl2", ".pjs", ".dks", ".stl", ".vtt"}
 	for _, e := range sub_extensions {
 		encodingMap[e] = "application/x-subtitle"
 	}
+}
 
+func getContentType(fileName string) string {
 	extension := filepath.Ext(fileName)
 	result := encodingMap[strings.ToLower(extension)]
 
@@ -10,8 +10,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDirToJson(t *testing.T) {
@@ -22,7 +28,7 @@ func TestDirToJson(t *testing.T) {
 	}
 	defer file.Close()
 
-	testData, err := dirToJSON(file)
+	testData, err := dirToJSON(file, ".")
 	if err != nil {
 		t.Error(err.Error())
 		return
@@ -39,7 +45,7 @@ func TestDirToJson(t *testing.T) {
 	}
 	defer os.Remove(".test")
 
-	testData2, err := dirToJSON(file)
+	testData2, err := dirToJSON(file, ".")
 	if err != nil {
 		t.Fatalf("Second dirToJSON failed: %s", err.Error())
 	}
@@ -49,6 +55,210 @@ func TestDirToJson(t *testing.T) {
 	}
 }
 
+func TestDirToNDJSON(t *testing.T) {
+	file, err := os.Open(".")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer file.Close()
+
+	var buf bytes.Buffer
+	size, err := dirToNDJSON(file, ".", &buf)
+	if err != nil {
+		t.Fatalf("dirToNDJSON failed: %s", err.Error())
+	}
+	if size != int64(buf.Len()) {
+		t.Errorf("Reported size %d does not match written size %d", size, buf.Len())
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) == 0 {
+		t.Fatal("Empty data returned")
+	}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Errorf("Invalid JSON line %q: %s", line, err.Error())
+		}
+	}
+}
+
+func TestDirectoryPages(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pages")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "B", "b", "c", "D", "e", "f", ".hidden"} {
+		ioutil.WriteFile(dir+"/"+name, nil, 0644)
+	}
+
+	// sorted pages follow each other by name
+	names, continuation := []string{}, ""
+	for pages := 0; pages == 0 || continuation != ""; pages++ {
+		if pages > 3 {
+			t.Fatalf("Too many pages")
+		}
+		file, _ := os.Open(dir)
+		js, next, err := dirPageToJSON(file, dir, continuation, 3, nil)
+		file.Close()
+		if err != nil {
+			t.Fatalf("dirPageToJSON: %s", err)
+		}
+		var page []map[string]interface{}
+		json.Unmarshal([]byte(js), &page)
+		for _, entry := range page {
+			names = append(names, entry["name"].(string))
+		}
+		continuation = next
+	}
+	if strings.Join(names, ",") != "a,B,b,c,D,e,f" {
+		t.Errorf("Wrong pages: %v", names)
+	}
+
+	// streamed pages end with the continuation
+	seen, continuation := map[string]bool{}, ""
+	for pages := 0; pages == 0 || continuation != ""; pages++ {
+		if pages > 3 {
+			t.Fatalf("Too many pages")
+		}
+		file, _ := os.Open(dir)
+		var buf bytes.Buffer
+		_, err := dirPageToNDJSON(file, dir, &buf, continuation, 3, nil, nil, false)
+		file.Close()
+		if err != nil {
+			t.Fatalf("dirPageToNDJSON: %s", err)
+		}
+		continuation = ""
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var entry map[string]string
+			json.Unmarshal([]byte(line), &entry)
+			if entry["continuation"] != "" {
+				continuation = entry["continuation"]
+			} else if seen[entry["name"]] {
+				t.Errorf("%s listed twice", entry["name"])
+			} else {
+				seen[entry["name"]] = true
+			}
+		}
+	}
+	if len(seen) != 7 {
+		t.Errorf("Wrong entries: %v", seen)
+	}
+
+	file, _ := os.Open(dir)
+	defer file.Close()
+	if _, _, err := dirPageToJSON(file, dir, encode_continuation("o", "3"), 3, nil); err != errBadContinuation {
+		t.Errorf("A streaming continuation was taken for a sorted listing: %v", err)
+	}
+}
+
+func TestFileInfoToJSON(t *testing.T) {
+	names := []string{"plain.txt", `quote".txt`, `back\\slash`, "tab\tnew\nline", "ünïcödé.mp3", "bad\xffutf8"}
+	for _, name := range names {
+		fi := fileInfo{name: name, mime_type: "text/plain", mtime: time.Now(), size: 42}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(fi.to_json()), &entry); err != nil {
+			t.Errorf("Invalid JSON for %q: %s", name, err.Error())
+			continue
+		}
+		if name != "bad\xffutf8" && entry["name"] != name {
+			t.Errorf("Name %q came back as %q", name, entry["name"])
+		}
+	}
+}
+
+func BenchmarkDirToJSON(b *testing.B) {
+	dir, err := ioutil.TempDir("", "amahi-bench")
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 5000; i++ {
+		f, err := os.Create(fmt.Sprintf("%s/file-%05d.mkv", dir, i))
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		f.Close()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		file, err := os.Open(dir)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		_, err = dirToJSON(file, dir)
+		file.Close()
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func TestParallelStat(t *testing.T) {
+	saved_lstat, saved_workers := lstat, listing_stat_workers
+	defer func() { lstat, listing_stat_workers = saved_lstat, saved_workers }()
+	dir, _ := ioutil.TempDir("", "amahi-stat")
+	defer os.RemoveAll(dir)
+	for i := 0; i < 3*PARALLEL_STAT_MIN; i++ {
+		ioutil.WriteFile(fmt.Sprintf("%s/file-%03d.txt", dir, i), bytes.Repeat([]byte("x"), i), 0644)
+	}
+	ioutil.WriteFile(dir+"/.hidden", nil, 0644)
+	// a file deleted while the directory is read
+	lstat = func(name string) (os.FileInfo, error) {
+		if strings.HasSuffix(name, "file-100.txt") {
+			return nil, os.ErrNotExist
+		}
+		return os.Lstat(name)
+	}
+	listings := []string{}
+	for _, workers := range []int{1, 16} {
+		listing_stat_workers = workers
+		file, _ := os.Open(dir)
+		js, err := dirToJSON(file, dir)
+		file.Close()
+		var entries []fileEntry
+		if err != nil || json.Unmarshal([]byte(js), &entries) != nil || len(entries) != 3*PARALLEL_STAT_MIN-1 || entries[150].Size != 151 {
+			t.Fatalf("Wrong listing with %d workers: %v %d entries", workers, err, len(entries))
+		}
+		listings = append(listings, js)
+	}
+	if listings[0] != listings[1] {
+		t.Errorf("Different listings with parallel stats")
+	}
+}
+
+// a directory on a slow disk, with every stat taking 100µs, by how many
+// are made at a time
+func BenchmarkDirToJSONSlowDisk(b *testing.B) {
+	saved_lstat, saved_workers := lstat, listing_stat_workers
+	defer func() { lstat, listing_stat_workers = saved_lstat, saved_workers }()
+	dir, err := ioutil.TempDir("", "amahi-bench")
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 1000; i++ {
+		ioutil.WriteFile(fmt.Sprintf("%s/file-%05d.mkv", dir, i), nil, 0644)
+	}
+	lstat = func(name string) (os.FileInfo, error) {
+		time.Sleep(100 * time.Microsecond)
+		return os.Lstat(name)
+	}
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			listing_stat_workers = workers
+			for i := 0; i < b.N; i++ {
+				file, _ := os.Open(dir)
+				_, err := dirToJSON(file, dir)
+				file.Close()
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+	}
+}
+
 func TestGetContentType(t *testing.T) {
 	testName := "test.pdf"
 
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the owner, group and mode of the files, to find why the users cannot get
+// to some of them over Samba without a shell on the HDA. listings have them
+// with posix=1, and the extended attributes of listing.xattrs in the config
+// as well, like user.comment. GET /files/stat?s=<share>&p=<path> has them
+// for a file or folder, and PUT /files/permissions?s=<share>&p=<path>, with
+// the admin token, changes them for it, with {"mode": "0664", "owner":
+// "alice", "group": "users"}, any of them left out. the changes of a whole
+// folder are done with /admin/permissions, on the local server
+
+// posixEntry is how a file is on disk, in the entry of the file
+type posixEntry struct {
+	Mode   string            `json:"mode"`
+	Owner  string            `json:"owner"`
+	Group  string            `json:"group"`
+	Uid    int               `json:"uid"`
+	Gid    int               `json:"gid"`
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+}
+
+// the names of the users and groups, by id, looked up once in a while
+const POSIX_NAMES_TTL = 5 * time.Minute
+
+type posixNames struct {
+	users  map[int]string
+	groups map[int]string
+	read   time.Time
+	sync.Mutex
+}
+
+var posix_names = &posixNames{}
+
+// name is the name of a user or group, or its id when it has none
+func (this *posixNames) name(id int, group bool) string {
+	this.Lock()
+	defer this.Unlock()
+	if this.users == nil || time.Since(this.read) > POSIX_NAMES_TTL {
+		this.users, this.groups, this.read = make(map[int]string), make(map[int]string), time.Now()
+	}
+	names := this.users
+	if group {
+		names = this.groups
+	}
+	if name, ok := names[id]; ok {
+		return name
+	}
+	name := strconv.Itoa(id)
+	if group {
+		if g, err := user.LookupGroupId(name); err == nil {
+			name = g.Name
+		}
+	} else if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	names[id] = name
+	return name
+}
+
+// posix_entry is how the file at path is, with fi from Lstat
+func posix_entry(path string, fi os.FileInfo) *posixEntry {
+	entry := &posixEntry{Mode: octal_mode(fi.Mode()), Uid: -1, Gid: -1}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		entry.Uid, entry.Gid = int(stat.Uid), int(stat.Gid)
+		entry.Owner, entry.Group = posix_names.name(entry.Uid, false), posix_names.name(entry.Gid, true)
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		// the attributes would be those of the target
+		return entry
+	}
+	for _, name := range config.Listing.Xattrs {
+		if value, ok := get_xattr(path, name); ok {
+			if entry.Xattrs == nil {
+				entry.Xattrs = make(map[string]string)
+			}
+			entry.Xattrs[name] = value
+		}
+	}
+	return entry
+}
+
+// wants_posix says if the client asked for the owners and modes
+func wants_posix(request *http.Request) bool {
+	return request.URL.Query().Get("posix") == "1"
+}
+
+// stat_entry is the entry of the file at full_path, with how it is on disk
+func stat_entry(full_path string) (fileEntry, error) {
+	fi, err := os.Lstat(full_path)
+	if err != nil {
+		return fileEntry{}, err
+	}
+	info := fileInfo{name: fi.Name(), mtime: fi.ModTime(), mime_type: "text/directory"}
+	if !fi.IsDir() && !isSymlinkDir(fi, filepath.Dir(full_path)) {
+		target := stub_info(fi, filepath.Dir(full_path))
+		info.mime_type, info.size, info.mtime = getContentType(fi.Name()), target.Size(), target.ModTime()
+	}
+	info.posix = posix_entry(full_path, fi)
+	return info.entry(), nil
+}
+
+// GET /files/stat has a file or folder, with its owner, group and mode
+func (service *MercuryFsService) file_stat(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	full_path, err := service.fullPathToFile(q.Get("s"), q.Get("p"))
+	var entry fileEntry
+	if err == nil {
+		entry, err = stat_entry(full_path)
+	}
+	if err != nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(0)
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	size := json_response(writer, http.StatusOK, entry)
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
+
+var errPermissionsFile = errors.New("no such file or folder in the share")
+var errPermissionsReadOnly = errors.New("the share is read only")
+var errPermissionsLink = errors.New("links have no mode of their own")
+
+// PUT /files/permissions changes the owner, group or mode of a file or
+// folder, with the admin token
+func (service *MercuryFsService) file_permissions(writer http.ResponseWriter, request *http.Request) {
+	if service.share_admin_denied(writer, request) {
+		return
+	}
+	q := request.URL.Query()
+	var body permissionsRequest
+	err := json.NewDecoder(io.LimitReader(request.Body, 64<<10)).Decode(&body)
+	var full_path string
+	var fi os.FileInfo
+	if err == nil {
+		if full_path, err = service.fullPathToFile(q.Get("s"), q.Get("p")); err != nil {
+			err = errPermissionsFile
+		} else if fi, err = os.Lstat(full_path); err != nil {
+			err = errPermissionsFile
+		} else if service.Shares.read_only(full_path) {
+			err = errPermissionsReadOnly
+		}
+	}
+	var change *permissionsChange
+	if err == nil {
+		// the mode is that of the folder, for a folder
+		body.DirMode = body.Mode
+		change, err = permissions_change(full_path, &body)
+	}
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 && (change.has_mode || change.has_dir) {
+		err = errPermissionsLink
+	}
+	if err == nil {
+		err = change.apply(full_path, fi)
+	}
+	var entry fileEntry
+	if err == nil {
+		entry, err = stat_entry(full_path)
+		log("Changed the permissions of %s", full_path)
+	}
+	service.share_admin_answer(writer, request, http.StatusOK, entry, err)
+}
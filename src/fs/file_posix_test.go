@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// posixFileEntry is a fileEntry as read by the apps, whose posixEntry
+// cannot be made by json through its pointer
+type posixFileEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	posixEntry
+}
+
+func TestFilePosix(t *testing.T) {
+	saved_config := config
+	defer func() { config = saved_config }()
+	config = default_config()
+	config.Admin.Token = "letmein"
+	config.Listing.Xattrs = []string{"user.comment"}
+	dir, _ := ioutil.TempDir("", "posix")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "Docs", "Taxes"), 0750)
+	report := filepath.Join(dir, "Docs", "report.pdf")
+	ioutil.WriteFile(report, []byte("report"), 0600)
+	os.Symlink("report.pdf", filepath.Join(dir, "Docs", "latest.pdf"))
+	xattrs := syscall.Setxattr(report, "user.comment", []byte("for the accountant"), 0) == nil
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Docs", path: filepath.Join(dir, "Docs")}}}, debug_info: new(debugInfo)}
+	uid, gid := os.Getuid(), os.Getgid()
+
+	recorder := httptest.NewRecorder()
+	service.file_stat(recorder, httptest.NewRequest("GET", "/files/stat?s=Docs&p=/report.pdf", nil))
+	var stat posixFileEntry
+	json.Unmarshal(recorder.Body.Bytes(), &stat)
+	if recorder.Code != 200 || stat.Mode != "0600" || stat.Uid != uid || stat.Gid != gid || stat.Owner == "" || stat.Size != 6 {
+		t.Fatalf("Wrong stat: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if xattrs && stat.Xattrs["user.comment"] != "for the accountant" {
+		t.Errorf("Wrong xattrs: %v", stat.Xattrs)
+	}
+	recorder = httptest.NewRecorder()
+	service.file_stat(recorder, httptest.NewRequest("GET", "/files/stat?s=Docs&p=/nope.pdf", nil))
+	if recorder.Code != 404 {
+		t.Errorf("Stat of a missing file: %d", recorder.Code)
+	}
+
+	// in the listings when asked for, and only then
+	listing := func(target string, ndjson bool) map[string]posixFileEntry {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", target, nil)
+		if ndjson {
+			request.Header.Set("Accept", "application/x-ndjson")
+		}
+		service.serve_file(recorder, request)
+		entries := []posixFileEntry{}
+		if ndjson {
+			scanner := bufio.NewScanner(recorder.Body)
+			for scanner.Scan() {
+				var entry posixFileEntry
+				json.Unmarshal(scanner.Bytes(), &entry)
+				entries = append(entries, entry)
+			}
+		} else {
+			json.Unmarshal(recorder.Body.Bytes(), &entries)
+		}
+		byName := make(map[string]posixFileEntry)
+		for _, entry := range entries {
+			byName[entry.Name] = entry
+		}
+		return byName
+	}
+	if plain := listing("/files?s=Docs&p=/", false); len(plain) != 3 || plain["report.pdf"].Mode != "" {
+		t.Errorf("Wrong plain listing: %+v", plain)
+	}
+	for _, ndjson := range []bool{false, true} {
+		entries := listing("/files?s=Docs&p=/&posix=1", ndjson)
+		if entries["Taxes"].Mode != "0750" || entries["report.pdf"].Mode != "0600" || entries["report.pdf"].Owner == "" {
+			t.Errorf("Wrong listing, ndjson %v: %+v", ndjson, entries)
+		}
+		if xattrs && entries["report.pdf"].Xattrs["user.comment"] != "for the accountant" {
+			t.Errorf("No xattrs in the listing, ndjson %v", ndjson)
+		}
+		if link := entries["latest.pdf"]; link.Mode == "" || link.Xattrs != nil {
+			t.Errorf("Wrong link: %+v", link)
+		}
+	}
+
+	change := func(target, body, token string) (int, string) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("PUT", target, strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		service.file_permissions(recorder, request)
+		return recorder.Code, recorder.Body.String()
+	}
+	if code, _ := change("/files/permissions?s=Docs&p=/report.pdf", `{"mode": "0644"}`, ""); code != 401 {
+		t.Errorf("Changed without the token: %d", code)
+	}
+	code, body := change("/files/permissions?s=Docs&p=/report.pdf", `{"mode": "0644", "group": "`+stat.Group+`"}`, "letmein")
+	if fi, _ := os.Stat(report); code != 200 || fi.Mode().Perm() != 0644 || !strings.Contains(body, `"mode":"0644"`) {
+		t.Errorf("Mode not changed: %d %s", code, body)
+	}
+	if code, _ := change("/files/permissions?s=Docs&p=/Taxes", `{"mode": "2775"}`, "letmein"); code != 200 {
+		t.Errorf("Mode of the folder not changed: %d", code)
+	} else if fi, _ := os.Stat(filepath.Join(dir, "Docs", "Taxes")); fi.Mode()&os.ModeSetgid == 0 {
+		t.Errorf("Wrong mode of the folder: %s", fi.Mode())
+	}
+	for target, expected := range map[string]int{
+		"/files/permissions?s=Docs&p=/nope.pdf":   404,
+		"/files/permissions?s=Docs&p=/latest.pdf": 400,
+		"/files/permissions?s=Nope&p=/report.pdf": 404,
+	} {
+		if code, body := change(target, `{"mode": "0644"}`, "letmein"); code != expected {
+			t.Errorf("%d instead of %d for %s: %s", code, expected, target, body)
+		}
+	}
+	if code, _ := change("/files/permissions?s=Docs&p=/report.pdf", `{"mode": "9999"}`, "letmein"); code != 400 {
+		t.Errorf("Invalid mode: %d", code)
+	}
+	service.Shares.Shares[0].read_only = true
+	if code, _ := change("/files/permissions?s=Docs&p=/report.pdf", `{"mode": "0600"}`, "letmein"); code != 403 {
+		t.Errorf("Changed in a read only share: %d", code)
+	}
+}
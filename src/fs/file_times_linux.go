@@ -0,0 +1,33 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// access_time is when a file was last read, or its mtime if not known
+func access_time(fi os.FileInfo) time.Time {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+	}
+	return fi.ModTime()
+}
+
+// change_time is when a file was last changed in any way, like when it was
+// copied or moved in, or its mtime if not known
+func change_time(fi os.FileInfo) time.Time {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
+	}
+	return fi.ModTime()
+}
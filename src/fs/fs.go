@@ -10,25 +10,19 @@
 package main
 
 import (
-	"crypto/tls"
 	// this is required for the side effect that it will register sha384/512 algorithms.
 	// should not be needed in the future https://codereview.appspot.com/87670045/
 	_ "crypto/sha512"
-	"errors"
 	"flag"
 	"fmt"
 	"github.com/amahi/go-metadata"
-	"hda_api_key"
 	"io/ioutil"
-	"math/rand"
 	"net"
-	"net/http"
-	"net/http/httputil"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strconv"
-	"strings"
 	"time"
 	"golang.org/x/net/http2"
 )
@@ -43,8 +37,9 @@ const VERSION = "1.70"
 var no_delete = false
 var no_upload = false
 
-// profiling info
-// func init() { go func() { http.ListenAndServe(":4242", nil) }() }
+// the profiles of net/http/pprof are served by the local server, at
+// /debug/pprof/, with -pprof or debug.pprof in the config
+var pprof_enabled = false
 
 func main() {
 
@@ -71,19 +66,40 @@ func main() {
 		flag.StringVar(&relay_port, "pfe-port", PFE_PORT, "port the pfe is using")
 		flag.BoolVar(&no_delete, "nd", false, "ignore delete requests silently")
 		flag.BoolVar(&no_upload, "nu", false, "ignore upload requests silently")
+		flag.StringVar(&config_file, "c", CONFIG_FILE, "configuration file")
+		flag.BoolVar(&pprof_enabled, "pprof", false, "serve the profiles of pprof on the local server")
 	}
 	flag.Parse()
 
-	api_key := ""
-	if PRODUCTION || (!PRODUCTION && (api_key_flag == "")) {
-		// no command line override - get it from the db
-		key, err := hda_api_key.HDA_API_key(MYSQL_CREDENTIALS)
-		if err != nil {
-			cleanQuit(2, "Amahi API key was not found")
-		}
-		api_key = key
-	} else {
-		api_key = api_key_flag
+	err := load_config(config_file)
+	if err != nil {
+		cleanQuit(2, fmt.Sprintf("Error reading configuration file %s: %s", config_file, err.Error()))
+	}
+
+	pprof_enabled = pprof_enabled || config.Debug.Pprof
+	no_delete = no_delete || config.NoDelete
+	no_upload = no_upload || config.NoUpload
+
+	// a relay of the user's own, unless the command line says otherwise
+	flags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { flags[f.Name] = true })
+	if config.Relay.Host != "" && !flags["pfe"] {
+		relay_host = config.Relay.Host
+	}
+	if config.Relay.Port != "" && !flags["pfe-port"] {
+		relay_port = config.Relay.Port
+	}
+	if config.Debug.Level != 0 && !flags["d"] {
+		dbg = config.Debug.Level
+	}
+	if _, err := relay_protocol(); err != nil {
+		cleanQuit(2, err.Error())
+	}
+
+	relay = &relayLink{host: relay_host, port: relay_port, config_file: config_file, api_key_flag: api_key_flag}
+	relay.creds, err = relay.relay_credentials()
+	if err != nil && err != errNoApiKey {
+		cleanQuit(2, err.Error())
 	}
 
 	if dbg < 1 || dbg > 5 {
@@ -96,6 +112,7 @@ func main() {
 	if (no_upload) { fmt.Printf("NOTICE: running without uploading content!\n") }
 
 	initialize_logging()
+	initialize_access_log()
 
 	metadata, err := metadata.Init(100000, METADATA_FILE, TMDB_API_KEY, TVRAGE_API_KEY, TVDB_API_KEY)
 	if err != nil {
@@ -110,14 +127,92 @@ func main() {
 		os.Remove(PID_FILE)
 		os.Exit(1)
 	}
-	// start ONE delayed, background metadata prefill of the cache
 	service.metadata = metadata
-
-	go service.Shares.start_metadata_prefill(metadata)
+	relay.service = service
+	relay.add_links()
+
+	// periodic re-indexing and metadata prefill of the shares, and
+	// watching them for changes
+	share_index.keep_tombstones(TOMBSTONES_DIR)
+	share_watcher = new_share_watcher(service.Shares)
+	if share_watcher != nil {
+		share_watcher.listen(publish_event)
+		share_watcher.listen(share_index.apply)
+		share_watcher.listen(metadata_prefetcher(metadata))
+		share_watcher.listen(etag_cache.refresh)
+		share_watcher.listen(service.Shares.root_changed)
+	}
+	if config.Local.TLS {
+		if err := local_tls.enable(config.Local.TLSCert, config.Local.TLSKey); err != nil {
+			log_warn("Local TLS could not be enabled: %s", err.Error())
+		} else {
+			scheduler.add(LOCAL_TLS_JOB, 24*time.Hour, time.Hour, local_tls.job())
+		}
+	}
+	if config.Direct.Enabled {
+		// mapped before connecting to the relay, which is told about it
+		if result, err := direct_connection.refresh(); err != nil {
+			log_warn("No direct connections: %s", err.Error())
+		} else {
+			log("Direct connections %s", result)
+		}
+		scheduler.add(DIRECT_JOB, DIRECT_LEASE/2, DIRECT_LEASE/2, direct_connection.job())
+	}
+	if config.Platform.URL != "" {
+		platform_reporter = new_platform_reporter(config.Platform.URL)
+		scheduler.add(PLATFORM_REPORT_JOB, time.Minute, 30*time.Second, platform_reporter.job(service.Shares, relay.credentials))
+	}
+	if interval, err := time.ParseDuration(config.Apps.CheckInterval); err == nil {
+		scheduler.add(APP_HEALTH_JOB, interval, 0, apps_health.job())
+	}
+	scheduler.add("trash-expiry", time.Hour, 10*time.Minute, trash_expiry(service.Shares))
+	scheduler.add(NETWORK_MOUNTS_JOB, time.Minute, 0, network_mounts.job(service.Shares))
+	scheduler.add(SHARE_MOUNTS_JOB, time.Minute, time.Minute, share_mounts.job(service.Shares))
+	scheduler.add("guest-pass-expiry", 10*time.Minute, time.Minute, guest_passes.expiry())
+	scheduler.add("metadata-cache-cleanup", 24*time.Hour, time.Hour, metadata_cache.cleanup())
+	scheduler.add("thumbnail-cleanup", 24*time.Hour, 2*time.Hour, thumbnail_cache.cleanup())
+	scheduler.add("audio-cache-cleanup", 24*time.Hour, 2*time.Hour, audio_cache.cleanup())
+	scheduler.add(TRANSCODE_JOB, time.Minute, time.Minute, transcoders.cleanup())
+	scheduler.add(SPIN_DOWN_JOB, time.Minute, time.Minute, power.spin_down(service.Shares))
+	scheduler.add(DOWNLOADS_JOB, 5*time.Minute, 5*time.Minute, download_queue.cleanup())
+	if config.Transcode.Pregenerate.Enabled {
+		transcode_pregen.load()
+		scheduler.add(PREGEN_JOB, 15*time.Minute, 10*time.Minute, transcode_pregen.job(service.Shares))
+	}
+	// the video encoders are probed now rather than on the first transcode
+	go transcoders.video_encoder()
+	scheduler.add(TOMBSTONES_JOB, 5*time.Minute, 5*time.Minute, share_index.tombstones_job())
+	if config.Export.Share != "" {
+		if interval, err := time.ParseDuration(config.Export.Interval); err == nil && interval > 0 {
+			scheduler.add(EXPORT_JOB, interval, 5*time.Minute, export_job(service.Shares))
+		} else {
+			log_warn("Invalid export interval %q, the share will not be exported", config.Export.Interval)
+		}
+	}
+	if config.Tiering.Archive != "" {
+		scheduler.add(TIERING_JOB, 24*time.Hour, time.Hour, tiering_job(service.Shares))
+	}
+	scheduler.add("chunk-gc", 24*time.Hour, 3*time.Hour, chunk_gc(service.Shares))
+	scheduler.add(METADATA_PREFETCH_JOB, 15*time.Minute, 2*time.Minute, metadata_prefetch.job(service.Shares, metadata))
+	scheduler.add(MUSIC_LIBRARY_JOB, time.Hour, 3*time.Minute, music_library.job(service.Shares))
+	scheduler.add(PHOTO_LIBRARY_JOB, time.Hour, 4*time.Minute, photo_library.job(service.Shares))
+	if config.Snapshots.Enabled {
+		if interval, err := time.ParseDuration(config.Snapshots.Interval); err == nil {
+			scheduler.add("snapshots", interval, interval, snapshot_job(service.Shares))
+		} else {
+			log_warn("Invalid snapshots interval %q, no snapshots will be taken", config.Snapshots.Interval)
+		}
+	}
+	go scheduler.start(func() {
+		sync_scan_jobs(service.Shares, metadata)
+		if share_watcher != nil {
+			share_watcher.sync()
+		}
+	})
 
 	log("Amahi Anywhere service v%s", VERSION)
 
-	debug(4, "using api-key %s", api_key)
+	debug(4, "using api-key %s", relay.creds.api_key)
 
 	if http2_debug {
 		http2.VerboseLogs = true
@@ -125,105 +220,47 @@ func main() {
 
 	runtime.GOMAXPROCS(1000)
 	go start_local_server(root_dir, metadata)
+	if config.Sftp.Enabled {
+		go start_sftp_server(service)
+	}
+	if config.S3.Enabled {
+		go start_s3_gateway(service)
+	}
+	if config.Ftp.Enabled {
+		go start_ftp_server(service)
+	}
+
+	go relay.rotate_on_hangup()
+
+	// without Amahi nor a key, only the local server
+	if relay.creds.api_key == "" {
+		log("No relay.api_key, serving on the local network only")
+		select {}
+	}
 
 	// Continually connect to the proxy and listen for requests
 	// Reconnect if there is an error
-	for {
-		conn, err := contact_pfe(relay_host, relay_port, api_key, service)
-		if err != nil {
-			log("Error contacting the proxy.")
-			debug(2, "Error contacting the proxy: %s", err)
-		} else {
-			err = service.StartServing(conn)
-			if err != nil {
-				log("Error serving requests")
-				debug(2, "Error in StartServing: %s", err)
-			}
-		}
-		// reconnect fairly quickly, with some randomness
-		sleep_time := time.Duration(2000 + rand.Intn(2000))
-		time.Sleep(sleep_time * time.Millisecond)
-	}
+	relay.run_all()
 	os.Remove(PID_FILE)
 }
 
-// connect to the proxy and send a POST request with the api-key
-func contact_pfe(relay_host, relay_port, api_key string, service *MercuryFsService) (net.Conn, error) {
-
-	relay_location := relay_host + ":" + relay_port
-	log("Contacting Relay at: " + relay_location)
-	addr, err := net.ResolveTCPAddr("tcp", relay_location)
+// connect to the proxy with the protocol of the config file, see
+// relay_protocol.go
+func contact_pfe(relay_host, relay_port string, creds relayCredentials, service *MercuryFsService, index int) (net.Conn, error) {
+	protocol, err := relay_protocol()
 	if err != nil {
-		debug(2, "Error with ResolveTCPAddr: %s", err)
 		return nil, err
 	}
-
-	tcp_conn, err := net.DialTCP("tcp", nil, addr)
+	conn, err := protocol.dial(relay_host, relay_port)
 	if err != nil {
-		debug(2, "Error with initial DialTCP: %s", err)
 		return nil, err
 	}
-
-	tcp_conn.SetKeepAlive(true)
-	tcp_conn.SetLinger(0)
-	service.info.relay_addr = relay_location
-
-	service.TLSConfig = &tls.Config{ ServerName: relay_host }
-
-	if DISABLE_CERT_CHECKING {
-		warning := "WARNING WARNING WARNING: running without checking TLS certs!!"
-		log(warning)
-		log(warning)
-		log(warning)
-		fmt.Println(warning)
-		fmt.Println(warning)
-		fmt.Println(warning)
-		service.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-	}
-
-	// Send the api-key
-	buf := strings.NewReader(service.info.to_json())
-	request, err := http.NewRequest("PUT", "https://"+relay_location+"/fs", buf)
-	if err != nil {
-		debug(2, "Error creating NewRequest:", err)
-		return nil, err
-	}
-
-	request.Header.Add("Api-Key", api_key)
-	request.Header.Add("Authorization", fmt.Sprintf("Token %s", SECRET_TOKEN))
-	raw_request, _ := httputil.DumpRequest(request, true)
-	debug(5, "%s", raw_request)
-
-	var client *httputil.ClientConn
-
-	if DISABLE_HTTPS {
-		warning := "WARNING WARNING: running without TLS!!"
-		log(warning)
-		fmt.Println(warning)
-		conn := tcp_conn
-		client = httputil.NewClientConn(conn, nil)
-	} else {
-		conn := tls.Client(tcp_conn, service.TLSConfig)
-		client = httputil.NewClientConn(conn, nil)
-	}
-
-	response, err := client.Do(request)
+	net_conn, err := protocol.handshake(conn, relay_host, relay_port, creds, service, index)
 	if err != nil {
-		debug(2, "Error writing to connection with Do: %s", err)
+		conn.Close()
 		return nil, err
 	}
-
-	if response.StatusCode != 200 {
-		msg := fmt.Sprintf("Got an error response: %s", response.Status)
-		log(msg)
-		return nil, errors.New(msg)
-	}
-
-	log("Connected to the proxy")
-
-	net_con, _ := client.Hijack()
-
-	return net_con, nil
+	return net_conn, nil
 }
 
 // Clean up and quit
@@ -248,6 +285,9 @@ func setup() error {
 	go func() {
 		for sig := range c {
 			log("Exiting with %v", sig)
+			share_index.save_tombstones()
+			guest_passes.save_accesses()
+			direct_connection.close()
 			os.Remove(PID_FILE)
 			os.Exit(1)
 		}
@@ -290,3 +330,30 @@ func exists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
 }
+
+// write_file_atomic writes data to a temporary file next to path and renames it
+// into place, so that readers never see a partially written file
+func write_file_atomic(path string, data []byte, perm os.FileMode) error {
+	os.MkdirAll(filepath.Dir(path), 0755)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,699 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a small FTP server for the devices that know nothing else (scanners,
+// cameras, old media players). the namespace is the same as for sftp:
+// "/" lists the shares. FTPS is supported with AUTH TLS when a
+// certificate is configured
+
+const FTP_IDLE_TIMEOUT = 5 * time.Minute
+const FTP_DATA_TIMEOUT = 30 * time.Second
+
+var errFtpPortRange = errors.New("invalid passive port range")
+
+func start_ftp_server(service *MercuryFsService) {
+	if len(config.Ftp.Users) == 0 {
+		log("FTP server not started: no users configured")
+		return
+	}
+	var tls_config *tls.Config
+	if config.Ftp.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.Ftp.TLSCert, config.Ftp.TLSKey)
+		if err != nil {
+			log_error("FTP server could not be configured")
+			debug(2, "Error loading the FTP certificate: %s", err.Error())
+			return
+		}
+		tls_config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if _, _, err := parse_port_range(config.Ftp.PassivePorts); err != nil {
+		log_error("FTP server could not be configured: %s", err.Error())
+		return
+	}
+
+	listener, err := net.Listen("tcp", ":"+config.Ftp.Port)
+	if err != nil {
+		log_error("FTP server could not be started")
+		debug(2, "Error on FTP Listen: %s", err.Error())
+		return
+	}
+	defer listener.Close()
+
+	log("Starting FTP server on port %s", config.Ftp.Port)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			debug(2, "FTP accept error: %s", err.Error())
+			continue
+		}
+		session := &ftpSession{vfs: &sftpFS{service: service}, cwd: "/", tls_config: tls_config}
+		session.set_conn(conn)
+		go session.serve()
+	}
+}
+
+// parse_port_range parses "first-last"
+func parse_port_range(ports string) (int, int, error) {
+	parts := strings.SplitN(ports, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errFtpPortRange
+	}
+	first, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	last, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || first < 1024 || last > 65535 || first > last {
+		return 0, 0, errFtpPortRange
+	}
+	return first, last, nil
+}
+
+type ftpSession struct {
+	vfs        *sftpFS
+	conn       net.Conn
+	scanner    *bufio.Scanner
+	tls_config *tls.Config
+	secure     bool
+	// PROT P: data connections use TLS too
+	protect bool
+
+	user      string
+	logged_in bool
+	cwd       string
+
+	passive     net.Listener
+	active      string
+	rest        int64
+	rename_from string
+}
+
+func (this *ftpSession) set_conn(conn net.Conn) {
+	this.conn = conn
+	this.scanner = bufio.NewScanner(conn)
+}
+
+func (this *ftpSession) reply(code int, format string, args ...interface{}) {
+	fmt.Fprintf(this.conn, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+}
+
+func (this *ftpSession) serve() {
+	defer this.conn.Close()
+	defer this.close_passive()
+	debug(3, "FTP connection from %s", this.conn.RemoteAddr())
+	this.reply(220, "Amahi Anywhere FTP server ready")
+
+	for {
+		this.conn.SetDeadline(time.Now().Add(FTP_IDLE_TIMEOUT))
+		if !this.scanner.Scan() {
+			return
+		}
+		line := strings.TrimRight(this.scanner.Text(), "\r")
+		command, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			command, arg = line[:i], line[i+1:]
+		}
+		command = strings.ToUpper(command)
+		if command == "PASS" {
+			debug(5, "FTP %s: PASS ****", this.conn.RemoteAddr())
+		} else {
+			debug(5, "FTP %s: %s", this.conn.RemoteAddr(), line)
+		}
+		if command == "QUIT" {
+			this.reply(221, "Goodbye")
+			return
+		}
+		this.command(command, arg)
+	}
+}
+
+func (this *ftpSession) command(command, arg string) {
+	switch command {
+	case "USER":
+		if config.Ftp.RequireTLS && !this.secure {
+			this.reply(530, "TLS is required, use AUTH TLS")
+			return
+		}
+		this.user, this.logged_in = arg, false
+		this.vfs.user = ""
+		this.reply(331, "Password required")
+		return
+	case "PASS":
+		password, ok := config.Ftp.Users[this.user]
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(arg)) != 1 {
+			log_warn("FTP login failed from %s as %s", this.conn.RemoteAddr(), this.user)
+			this.reply(530, "Login incorrect")
+			return
+		}
+		this.logged_in = true
+		// FTP users get their home folder
+		this.vfs.user = this.user
+		debug(2, "FTP login from %s as %s", this.conn.RemoteAddr(), this.user)
+		this.reply(230, "Logged in")
+		return
+	case "AUTH":
+		this.auth(arg)
+		return
+	case "PBSZ":
+		this.reply(200, "PBSZ=0")
+		return
+	case "PROT":
+		this.prot(arg)
+		return
+	case "FEAT":
+		this.feat()
+		return
+	case "SYST":
+		this.reply(215, "UNIX Type: L8")
+		return
+	case "NOOP":
+		this.reply(200, "OK")
+		return
+	case "OPTS":
+		if strings.ToUpper(arg) == "UTF8 ON" {
+			this.reply(200, "UTF8 mode enabled")
+		} else {
+			this.reply(501, "Option not understood")
+		}
+		return
+	}
+
+	if !this.logged_in {
+		this.reply(530, "Not logged in")
+		return
+	}
+
+	switch command {
+	case "PWD", "XPWD":
+		this.reply(257, "\"%s\" is the current directory", strings.Replace(this.cwd, "\"", "\"\"", -1))
+	case "CWD", "XCWD":
+		this.cd(arg)
+	case "CDUP", "XCUP":
+		this.cd("..")
+	case "TYPE", "MODE", "STRU":
+		// everything is transferred as binary
+		this.reply(200, "OK")
+	case "PASV":
+		this.pasv(false)
+	case "EPSV":
+		this.pasv(true)
+	case "PORT":
+		this.port(arg)
+	case "LIST", "NLST":
+		this.list(arg, command == "NLST")
+	case "RETR":
+		this.retr(arg)
+	case "STOR", "APPE":
+		this.stor(arg, command == "APPE")
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || offset < 0 {
+			this.reply(501, "Invalid offset")
+			return
+		}
+		this.rest = offset
+		this.reply(350, "Restarting at %d", offset)
+	case "SIZE", "MDTM":
+		this.stat(arg, command == "SIZE")
+	case "DELE", "RMD", "XRMD":
+		this.remove(arg, command == "DELE")
+	case "MKD", "XMKD":
+		this.mkdir(arg)
+	case "RNFR":
+		this.rename_from = this.virtual(arg)
+		this.reply(350, "Ready for RNTO")
+	case "RNTO":
+		this.rename(arg)
+	case "ABOR":
+		this.reply(226, "Nothing to abort")
+	default:
+		this.reply(502, "Command not implemented")
+	}
+}
+
+func (this *ftpSession) feat() {
+	features := []string{"SIZE", "MDTM", "REST STREAM", "PASV", "EPSV", "UTF8"}
+	if this.tls_config != nil {
+		features = append(features, "AUTH TLS", "PBSZ", "PROT")
+	}
+	fmt.Fprintf(this.conn, "211-Features:\r\n")
+	for _, f := range features {
+		fmt.Fprintf(this.conn, " %s\r\n", f)
+	}
+	this.reply(211, "End")
+}
+
+func (this *ftpSession) auth(arg string) {
+	if this.tls_config == nil {
+		this.reply(502, "TLS is not configured")
+		return
+	}
+	if mechanism := strings.ToUpper(arg); mechanism != "TLS" && mechanism != "SSL" {
+		this.reply(504, "Unsupported mechanism")
+		return
+	}
+	this.reply(234, "Starting TLS")
+	conn := tls.Server(this.conn, this.tls_config)
+	if err := conn.Handshake(); err != nil {
+		debug(2, "FTP TLS handshake error: %s", err.Error())
+		this.conn.Close()
+		return
+	}
+	this.set_conn(conn)
+	this.secure = true
+}
+
+func (this *ftpSession) prot(arg string) {
+	switch strings.ToUpper(arg) {
+	case "C":
+		if config.Ftp.RequireTLS {
+			this.reply(534, "Data connections must be protected")
+			return
+		}
+		this.protect = false
+	case "P":
+		if !this.secure {
+			this.reply(503, "Use AUTH TLS first")
+			return
+		}
+		this.protect = true
+	default:
+		this.reply(504, "Unsupported protection level")
+		return
+	}
+	this.reply(200, "OK")
+}
+
+// virtual returns the clean path of arg in the FTP namespace
+func (this *ftpSession) virtual(arg string) string {
+	if !strings.HasPrefix(arg, "/") {
+		arg = path.Join(this.cwd, arg)
+	}
+	return path.Clean("/" + arg)
+}
+
+func (this *ftpSession) cd(arg string) {
+	p := this.virtual(arg)
+	full_path, _, err := this.vfs.resolve(p)
+	if err == nil && full_path != "" {
+		var fi os.FileInfo
+		fi, err = os.Stat(full_path)
+		if err == nil && !fi.IsDir() {
+			err = os.ErrNotExist
+		}
+	}
+	if err != nil {
+		this.reply(550, "No such directory")
+		return
+	}
+	this.cwd = p
+	this.reply(250, "Directory changed to %s", p)
+}
+
+func (this *ftpSession) close_passive() {
+	if this.passive != nil {
+		this.passive.Close()
+		this.passive = nil
+	}
+}
+
+func (this *ftpSession) pasv(extended bool) {
+	this.close_passive()
+	this.active = ""
+	first, last, _ := parse_port_range(config.Ftp.PassivePorts)
+	host, _, _ := net.SplitHostPort(this.conn.LocalAddr().String())
+	// try the ports from a random place in the range
+	start := rand.Intn(last - first + 1)
+	for i := 0; i <= last-first; i++ {
+		port := first + (start+i)%(last-first+1)
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		this.passive = listener
+		if extended {
+			this.reply(229, "Entering Extended Passive Mode (|||%d|)", port)
+			return
+		}
+		ip := net.ParseIP(host).To4()
+		if config.Ftp.PublicIP != "" {
+			ip = net.ParseIP(config.Ftp.PublicIP).To4()
+		}
+		if ip == nil {
+			this.close_passive()
+			this.reply(425, "Use EPSV")
+			return
+		}
+		this.reply(227, "Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+		return
+	}
+	this.reply(425, "No passive ports available")
+}
+
+// parse_ftp_port parses the h1,h2,h3,h4,p1,p2 argument of PORT
+func parse_ftp_port(arg string) (string, error) {
+	parts := strings.Split(arg, ",")
+	if len(parts) != 6 {
+		return "", errors.New("invalid PORT argument")
+	}
+	n := make([]int, 6)
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || v < 0 || v > 255 {
+			return "", errors.New("invalid PORT argument")
+		}
+		n[i] = v
+	}
+	ip := fmt.Sprintf("%d.%d.%d.%d", n[0], n[1], n[2], n[3])
+	return net.JoinHostPort(ip, strconv.Itoa(n[4]<<8+n[5])), nil
+}
+
+func (this *ftpSession) port(arg string) {
+	address, err := parse_ftp_port(arg)
+	if err != nil {
+		this.reply(501, "Invalid PORT argument")
+		return
+	}
+	// only connect back to the client, never to a third party
+	host, _, _ := net.SplitHostPort(address)
+	client, _, _ := net.SplitHostPort(this.conn.RemoteAddr().String())
+	if !net.ParseIP(host).Equal(net.ParseIP(client)) {
+		this.reply(504, "PORT must be the client address")
+		return
+	}
+	this.close_passive()
+	this.active = address
+	this.reply(200, "PORT OK")
+}
+
+// data_conn opens the data connection set up with PASV, EPSV or PORT
+func (this *ftpSession) data_conn() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case this.passive != nil:
+		listener := this.passive.(*net.TCPListener)
+		listener.SetDeadline(time.Now().Add(FTP_DATA_TIMEOUT))
+		conn, err = this.accept_client(listener)
+		this.close_passive()
+	case this.active != "":
+		conn, err = net.DialTimeout("tcp", this.active, FTP_DATA_TIMEOUT)
+		this.active = ""
+	default:
+		return nil, errors.New("use PASV or PORT first")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if this.protect {
+		tls_conn := tls.Server(conn, this.tls_config)
+		if err := tls_conn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tls_conn
+	}
+	return conn, nil
+}
+
+// accept_client accepts the data connection of the client, dropping those
+// from other addresses, which would otherwise get the transfer
+func (this *ftpSession) accept_client(listener net.Listener) (net.Conn, error) {
+	client, _, _ := net.SplitHostPort(this.conn.RemoteAddr().String())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if net.ParseIP(host).Equal(net.ParseIP(client)) {
+			return conn, nil
+		}
+		log_warn("FTP data connection from %s dropped, the client is %s", host, client)
+		conn.Close()
+	}
+}
+
+// unprotected refuses the transfers over data connections without TLS
+// when TLS is required, before anything is opened
+func (this *ftpSession) unprotected() bool {
+	if config.Ftp.RequireTLS && !this.protect {
+		this.reply(521, "Data connections must be protected, use PROT P")
+		return true
+	}
+	return false
+}
+
+// transfer runs fn on a new data connection with the usual replies
+func (this *ftpSession) transfer(fn func(conn net.Conn) error) {
+	this.reply(150, "Opening data connection")
+	conn, err := this.data_conn()
+	if err != nil {
+		this.reply(425, "Can't open data connection")
+		return
+	}
+	err = fn(conn)
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		debug(2, "FTP transfer error: %s", err.Error())
+		this.reply(426, "Transfer aborted")
+		return
+	}
+	this.reply(226, "Transfer complete")
+}
+
+// ftp_list_line formats a file the way "ls -l" does, which is what clients parse
+func ftp_list_line(fi os.FileInfo) string {
+	mode := fi.Mode().String()
+	if fi.Mode()&os.ModeSymlink != 0 {
+		mode = "l" + mode[1:]
+	}
+	mtime := fi.ModTime()
+	date := mtime.Format("Jan _2 15:04")
+	if time.Since(mtime) > 180*24*time.Hour || mtime.After(time.Now()) {
+		date = mtime.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 amahi amahi %12d %s %s\r\n", mode, fi.Size(), date, fi.Name())
+}
+
+func (this *ftpSession) list(arg string, names_only bool) {
+	if this.unprotected() {
+		return
+	}
+	// some clients send ls options, e.g. "LIST -la"
+	if strings.HasPrefix(arg, "-") {
+		fields := strings.Fields(arg)
+		arg = ""
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+	}
+	full_path, _, err := this.vfs.resolve(this.virtual(arg))
+	if err != nil {
+		this.reply(550, "No such file or directory")
+		return
+	}
+	var fis []os.FileInfo
+	if full_path == "" {
+		fis = this.vfs.share_list()
+	} else {
+		fi, err := os.Stat(full_path)
+		if err != nil {
+			this.reply(550, "No such file or directory")
+			return
+		}
+		if fi.IsDir() {
+			dir, err := os.Open(full_path)
+			if err == nil {
+				fis, err = dir.Readdir(0)
+				dir.Close()
+			}
+			if err != nil {
+				this.reply(550, "Can't read directory")
+				return
+			}
+			fis = symlinks_listed(this.vfs.service.Shares, full_path, fis)
+		} else {
+			fis = []os.FileInfo{fi}
+		}
+	}
+	this.transfer(func(conn net.Conn) error {
+		w := bufio.NewWriter(conn)
+		for _, fi := range fis {
+			if names_only {
+				fmt.Fprintf(w, "%s\r\n", fi.Name())
+			} else {
+				w.WriteString(ftp_list_line(fi))
+			}
+		}
+		return w.Flush()
+	})
+}
+
+func (this *ftpSession) retr(arg string) {
+	offset := this.rest
+	this.rest = 0
+	if this.unprotected() {
+		return
+	}
+	full_path, _, err := this.vfs.resolve(this.virtual(arg))
+	if err != nil || full_path == "" {
+		this.reply(550, "No such file")
+		return
+	}
+	file, err := os.Open(full_path)
+	if err != nil {
+		this.reply(550, "No such file")
+		return
+	}
+	defer file.Close()
+	if fi, err := file.Stat(); err != nil || fi.IsDir() {
+		this.reply(550, "Not a file")
+		return
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		this.reply(550, "Invalid offset")
+		return
+	}
+	this.transfer(func(conn net.Conn) error {
+		size, err := io.Copy(conn, file)
+		this.vfs.service.debug_info.requestServed(size)
+		return err
+	})
+}
+
+func (this *ftpSession) stor(arg string, append_data bool) {
+	offset := this.rest
+	this.rest = 0
+	if this.unprotected() {
+		return
+	}
+	full_path, top, err := this.vfs.resolve(this.virtual(arg))
+	if err != nil || top || this.vfs.service.Shares.read_only(full_path) {
+		this.reply(550, "Permission denied")
+		return
+	}
+	if no_upload {
+		debug(2, "NOTICE: Running in no-upload mode.")
+		this.reply(550, "Permission denied")
+		return
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if append_data {
+		flags |= os.O_APPEND
+	} else if offset == 0 {
+		flags |= os.O_TRUNC
+		keep_version(this.vfs.service.Shares, full_path)
+	}
+	file, err := os.OpenFile(full_path, flags, 0644)
+	if err != nil {
+		this.reply(550, "Can't create file")
+		return
+	}
+	defer file.Close()
+	if offset > 0 && !append_data {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			this.reply(550, "Invalid offset")
+			return
+		}
+	}
+	this.transfer(func(conn net.Conn) error {
+		_, err := io.Copy(file, conn)
+		return err
+	})
+}
+
+func (this *ftpSession) stat(arg string, size bool) {
+	full_path, _, err := this.vfs.resolve(this.virtual(arg))
+	var fi os.FileInfo
+	if err == nil && full_path != "" {
+		fi, err = os.Stat(full_path)
+	}
+	if err != nil || fi == nil || fi.IsDir() {
+		this.reply(550, "No such file")
+		return
+	}
+	if size {
+		this.reply(213, "%d", fi.Size())
+	} else {
+		this.reply(213, "%s", fi.ModTime().UTC().Format("20060102150405"))
+	}
+}
+
+// remove deletes a file, to the trash, or an empty directory
+func (this *ftpSession) remove(arg string, file bool) {
+	full_path, top, err := this.vfs.resolve(this.virtual(arg))
+	if err != nil || top || no_delete || this.vfs.service.Shares.read_only(full_path) {
+		this.reply(550, "Permission denied")
+		return
+	}
+	if file {
+		err = delete_path_to_trash(this.vfs.service.Shares, full_path)
+	} else {
+		err = os.Remove(full_path)
+	}
+	if err != nil {
+		this.reply(550, "Can't remove %s", arg)
+		return
+	}
+	this.reply(250, "Removed")
+}
+
+func (this *ftpSession) mkdir(arg string) {
+	p := this.virtual(arg)
+	full_path, top, err := this.vfs.resolve(p)
+	if err != nil || top || no_upload || this.vfs.service.Shares.read_only(full_path) {
+		this.reply(550, "Permission denied")
+		return
+	}
+	if err := os.Mkdir(full_path, 0755); err != nil {
+		this.reply(550, "Can't create directory")
+		return
+	}
+	this.reply(257, "\"%s\" created", strings.Replace(p, "\"", "\"\"", -1))
+}
+
+func (this *ftpSession) rename(arg string) {
+	from := this.rename_from
+	this.rename_from = ""
+	if from == "" {
+		this.reply(503, "Use RNFR first")
+		return
+	}
+	source, source_top, err1 := this.vfs.resolve(from)
+	target, target_top, err2 := this.vfs.resolve(this.virtual(arg))
+	if err1 != nil || err2 != nil || source_top || target_top || no_upload ||
+		this.vfs.service.Shares.read_only(source) || this.vfs.service.Shares.read_only(target) {
+		this.reply(550, "Permission denied")
+		return
+	}
+	keep_version(this.vfs.service.Shares, target)
+	if err := os.Rename(source, target); err != nil {
+		this.reply(550, "Can't rename")
+		return
+	}
+	this.reply(250, "Renamed")
+}
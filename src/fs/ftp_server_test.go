@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePortRange(t *testing.T) {
+	first, last, err := parse_port_range("50000-50100")
+	if err != nil || first != 50000 || last != 50100 {
+		t.Errorf("Wrong range: %d-%d %v", first, last, err)
+	}
+	for _, bad := range []string{"", "50000", "100-200", "50100-50000", "a-b"} {
+		if _, _, err := parse_port_range(bad); err == nil {
+			t.Errorf("Invalid range %q accepted", bad)
+		}
+	}
+}
+
+func TestParseFtpPort(t *testing.T) {
+	address, err := parse_ftp_port("192,168,1,20,195,80")
+	if err != nil || address != "192.168.1.20:50000" {
+		t.Errorf("Wrong address: %s %v", address, err)
+	}
+	if _, err := parse_ftp_port("192,168,1,300,195,80"); err == nil {
+		t.Errorf("Invalid PORT argument accepted")
+	}
+}
+
+func TestFtpListLine(t *testing.T) {
+	fi := &shareFileInfo{name: "Movies", mtime: time.Now().Add(-time.Hour)}
+	line := ftp_list_line(fi)
+	if !strings.HasPrefix(line, "drwxr-xr-x ") || !strings.HasSuffix(line, " Movies\r\n") {
+		t.Errorf("Wrong list line: %q", line)
+	}
+}
+
+func TestFtpAcceptClient(t *testing.T) {
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	client, err := net.Dial("tcp", control.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := control.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := &ftpSession{}
+	session.set_conn(conn)
+
+	passive, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer passive.Close()
+	// another host gets there first
+	other, err := (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}).Dial("tcp", passive.Addr().String())
+	if err != nil {
+		t.Skip("No 127.0.0.2 to connect from")
+	}
+	defer other.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		data, _ := session.accept_client(passive)
+		accepted <- data
+	}()
+	// dropped
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := other.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Data connection from another host not dropped")
+	}
+	mine, err := net.Dial("tcp", passive.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mine.Close()
+	data := <-accepted
+	if data == nil || data.RemoteAddr().String() != mine.LocalAddr().String() {
+		t.Errorf("Wrong data connection: %v", data)
+	}
+	if data != nil {
+		data.Close()
+	}
+}
+
+func TestFtpRequireTLS(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = default_config()
+	config.Ftp.RequireTLS = true
+
+	server, client := net.Pipe()
+	defer client.Close()
+	session := &ftpSession{secure: true, logged_in: true}
+	session.set_conn(server)
+	replies := bufio.NewReader(client)
+	// no PROT P: nothing is opened
+	for _, command := range []string{"RETR", "STOR", "LIST"} {
+		go session.command(command, "a.txt")
+		if line, _ := replies.ReadString('\n'); !strings.HasPrefix(line, "521 ") {
+			t.Errorf("%s without PROT P: %q", command, line)
+		}
+	}
+	go session.command("PROT", "C")
+	if line, _ := replies.ReadString('\n'); !strings.HasPrefix(line, "534 ") {
+		t.Errorf("PROT C accepted: %q", line)
+	}
+}
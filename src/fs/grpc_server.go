@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"amahi/fsproto"
+	"context"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// size of the data chunks sent by Read
+const GRPC_CHUNK_SIZE = 64 * 1024
+
+// grpcFileService implements the FileService of amahi/fsproto/fs.proto
+// on top of the same shares, path checks and settings as the REST API
+type grpcFileService struct {
+	fsproto.UnimplementedFileServiceServer
+	service *MercuryFsService
+}
+
+// with_grpc serves gRPC requests (HTTP/2 with an application/grpc content type)
+// with the gRPC server and everything else with handler. h2c lets clients talk
+// HTTP/2 without TLS, which is what gRPC on the local network uses
+func (service *MercuryFsService) with_grpc(handler http.Handler) http.Handler {
+	grpc_server := grpc.NewServer()
+	fsproto.RegisterFileServiceServer(grpc_server, &grpcFileService{service: service})
+
+	mux := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.ProtoMajor == 2 && strings.HasPrefix(request.Header.Get("Content-Type"), "application/grpc") {
+			grpc_server.ServeHTTP(writer, request)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+	return h2c.NewHandler(mux, new(http2.Server))
+}
+
+func (this *grpcFileService) full_path(share, path string) (string, error) {
+	if is_homes_share(share) {
+		// there are no users here
+		return "", status.Error(codes.NotFound, errNoHome.Error())
+	}
+	if !share_open(share, schedule_now()) {
+		return "", status.Error(codes.PermissionDenied, "share not available now")
+	}
+	full_path, err := this.service.fullPathToFile(share, path)
+	if is_path_limit(err) {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	} else if err != nil {
+		return "", status.Error(codes.NotFound, err.Error())
+	}
+	return full_path, nil
+}
+
+func grpc_error(err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return status.Error(codes.NotFound, err.Error())
+	case os.IsPermission(err):
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (this *grpcFileService) ListShares(ctx context.Context, request *fsproto.ListSharesRequest) (*fsproto.ListSharesResponse, error) {
+	shares := this.service.Shares
+	shares.refresh()
+	shares.RLock()
+	defer shares.RUnlock()
+	response := new(fsproto.ListSharesResponse)
+	for _, share := range shares.Shares {
+		if is_homes_share(share.name) {
+			continue
+		}
+		response.Shares = append(response.Shares, &fsproto.Share{
+			Name:  share.name,
+			Mtime: timestamppb.New(share.updated_at),
+			Tags:  share.tags_list(),
+		})
+	}
+	return response, nil
+}
+
+func (this *grpcFileService) List(ctx context.Context, request *fsproto.ListRequest) (*fsproto.ListResponse, error) {
+	full_path, err := this.full_path(request.Share, request.Path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.Open(full_path)
+	if err != nil {
+		return nil, grpc_error(err)
+	}
+	defer dir.Close()
+	fis, err := dir.Readdir(0)
+	if err != nil {
+		return nil, grpc_error(err)
+	}
+	fis = symlinks_listed(this.service.Shares, full_path, fis)
+	response := new(fsproto.ListResponse)
+	for _, fi := range directory_fileInfos(fis, full_path) {
+		response.Entries = append(response.Entries, &fsproto.FileInfo{
+			Name:     fi.name,
+			MimeType: fi.mime_type,
+			Mtime:    timestamppb.New(fi.mtime),
+			Size:     fi.size,
+			IsDir:    fi.mime_type == "text/directory",
+		})
+	}
+	return response, nil
+}
+
+func (this *grpcFileService) Stat(ctx context.Context, request *fsproto.StatRequest) (*fsproto.FileInfo, error) {
+	full_path, err := this.full_path(request.Share, request.Path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(full_path)
+	if err != nil {
+		return nil, grpc_error(err)
+	}
+	info := &fsproto.FileInfo{Name: fi.Name(), Mtime: timestamppb.New(fi.ModTime()), IsDir: fi.IsDir()}
+	if fi.IsDir() {
+		info.MimeType = "text/directory"
+	} else {
+		info.MimeType = getContentType(fi.Name())
+		info.Size = fi.Size()
+	}
+	return info, nil
+}
+
+func (this *grpcFileService) Read(request *fsproto.ReadRequest, stream fsproto.FileService_ReadServer) error {
+	full_path, err := this.full_path(request.Share, request.Path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(full_path)
+	if err != nil {
+		return grpc_error(err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = io.NewSectionReader(file, request.Offset, 1<<62)
+	if request.Length > 0 {
+		reader = io.LimitReader(reader, request.Length)
+	}
+	buf := make([]byte, GRPC_CHUNK_SIZE)
+	var sent int64
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if serr := stream.Send(&fsproto.ReadResponse{Data: buf[:n]}); serr != nil {
+				return serr
+			}
+			sent += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return grpc_error(err)
+		}
+	}
+	this.service.debug_info.requestServed(sent)
+	return nil
+}
+
+func (this *grpcFileService) Write(stream fsproto.FileService_WriteServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if no_upload {
+		debug(2, "NOTICE: Running in no-upload mode.")
+		return status.Error(codes.PermissionDenied, "uploads are disabled")
+	}
+	if strings.Trim(first.Path, "/") == "" {
+		return status.Error(codes.InvalidArgument, "a file path is required")
+	}
+	full_path, err := this.full_path(first.Share, first.Path)
+	if err != nil {
+		return err
+	}
+	if this.service.Shares.read_only(full_path) {
+		return status.Error(codes.PermissionDenied, "the share is read only")
+	}
+	keep_version(this.service.Shares, full_path)
+	file, err := os.OpenFile(full_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return grpc_error(err)
+	}
+	defer file.Close()
+
+	var size int64
+	for message := first; ; {
+		n, err := file.Write(message.Data)
+		size += int64(n)
+		if err != nil {
+			return grpc_error(err)
+		}
+		message, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return stream.SendAndClose(&fsproto.WriteResponse{Size: size})
+}
+
+func (this *grpcFileService) Delete(ctx context.Context, request *fsproto.DeleteRequest) (*fsproto.DeleteResponse, error) {
+	if strings.Trim(request.Path, "/") == "" {
+		return nil, status.Error(codes.InvalidArgument, "shares cannot be deleted")
+	}
+	full_path, err := this.full_path(request.Share, request.Path)
+	if err != nil {
+		return nil, err
+	}
+	if this.service.Shares.read_only(full_path) {
+		return nil, status.Error(codes.PermissionDenied, "the share is read only")
+	}
+	if no_delete {
+		debug(2, "NOTICE: Running in no-delete mode. Would have deleted: %s", full_path)
+		return new(fsproto.DeleteResponse), nil
+	}
+	// deleted files go to the trash of the share
+	err = delete_path_to_trash(this.service.Shares, full_path)
+	if err != nil {
+		return nil, grpc_error(err)
+	}
+	return new(fsproto.DeleteResponse), nil
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"amahi/fsproto"
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGrpcFileService(t *testing.T) {
+	saved_config, saved_upload, saved_delete := config, no_upload, no_delete
+	defer func() { config, no_upload, no_delete = saved_config, saved_upload, saved_delete }()
+	config = default_config()
+	config.Homes.Share = "Homes"
+	dir, _ := ioutil.TempDir("", "grpc")
+	defer os.RemoveAll(dir)
+	docs, archive, homes := filepath.Join(dir, "Docs"), filepath.Join(dir, "Archive"), filepath.Join(dir, "Homes")
+	for _, d := range []string{filepath.Join(docs, "Taxes"), archive, filepath.Join(homes, "alice")} {
+		os.MkdirAll(d, 0755)
+	}
+	ioutil.WriteFile(filepath.Join(docs, "Taxes", "2018.pdf"), []byte("taxes of 2018"), 0644)
+	ioutil.WriteFile(filepath.Join(archive, "old.txt"), []byte("old"), 0644)
+	ioutil.WriteFile(filepath.Join(homes, "alice", "diary.txt"), []byte("dear diary"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "passwords.txt"), []byte("secret"), 0644)
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Docs", path: docs},
+		{name: "Archive", path: archive, read_only: true}, {name: "Homes", path: homes}}}, debug_info: new(debugInfo)}
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	fsproto.RegisterFileServiceServer(server, &grpcFileService{service: service})
+	go server.Serve(listener)
+	defer server.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufconn", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := fsproto.NewFileServiceClient(conn)
+	ctx := context.Background()
+
+	read := func(share, p string) (string, error) {
+		stream, err := client.Read(ctx, &fsproto.ReadRequest{Share: share, Path: p})
+		if err != nil {
+			return "", err
+		}
+		data := ""
+		for {
+			response, err := stream.Recv()
+			if err == io.EOF {
+				return data, nil
+			}
+			if err != nil {
+				return data, err
+			}
+			data += string(response.Data)
+		}
+	}
+	write := func(share, p string, chunks ...string) (int64, error) {
+		stream, err := client.Write(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for i, chunk := range chunks {
+			message := &fsproto.WriteRequest{Data: []byte(chunk)}
+			if i == 0 {
+				message.Share, message.Path = share, p
+			}
+			if err := stream.Send(message); err != nil {
+				break
+			}
+		}
+		response, err := stream.CloseAndRecv()
+		if err != nil {
+			return 0, err
+		}
+		return response.Size, nil
+	}
+
+	// the homes share is not there without users
+	shares, err := client.ListShares(ctx, new(fsproto.ListSharesRequest))
+	if err != nil || len(shares.Shares) != 2 {
+		t.Errorf("Wrong shares: %v %v", shares, err)
+	}
+	list, err := client.List(ctx, &fsproto.ListRequest{Share: "Docs", Path: "/"})
+	if err != nil || len(list.Entries) != 1 || list.Entries[0].Name != "Taxes" || !list.Entries[0].IsDir {
+		t.Errorf("Wrong listing: %v %v", list, err)
+	}
+	if data, err := read("Docs", "/Taxes/2018.pdf"); err != nil || data != "taxes of 2018" {
+		t.Errorf("Wrong file read: %q %v", data, err)
+	}
+
+	// nothing outside of the shares, or in the homes share
+	for _, c := range []struct {
+		share, path string
+		code        codes.Code
+	}{
+		{"Docs", "/../passwords.txt", codes.NotFound},
+		{"Docs", "/Taxes/../../passwords.txt", codes.NotFound},
+		{"Nowhere", "/a.txt", codes.NotFound},
+		{"Homes", "/alice/diary.txt", codes.NotFound},
+	} {
+		if _, err := read(c.share, c.path); status.Code(err) != c.code {
+			t.Errorf("Read of %s %s: %v", c.share, c.path, err)
+		}
+		if _, err := client.List(ctx, &fsproto.ListRequest{Share: c.share, Path: c.path}); status.Code(err) != c.code {
+			t.Errorf("List of %s %s: %v", c.share, c.path, err)
+		}
+		if _, err := write(c.share, c.path, "x"); status.Code(err) != c.code {
+			t.Errorf("Write of %s %s: %v", c.share, c.path, err)
+		}
+		if _, err := client.Delete(ctx, &fsproto.DeleteRequest{Share: c.share, Path: c.path}); status.Code(err) != c.code {
+			t.Errorf("Delete of %s %s: %v", c.share, c.path, err)
+		}
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "passwords.txt")); string(data) != "secret" {
+		t.Errorf("The file outside of the shares was changed: %q", data)
+	}
+	if !exists(filepath.Join(homes, "alice", "diary.txt")) {
+		t.Errorf("The file in the homes share was deleted")
+	}
+
+	// writes, in chunks
+	if size, err := write("Docs", "/Taxes/2019.pdf", "taxes ", "of 2019"); err != nil || size != 13 {
+		t.Errorf("Wrong write: %d %v", size, err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(docs, "Taxes", "2019.pdf")); string(data) != "taxes of 2019" {
+		t.Errorf("Wrong file written: %q", data)
+	}
+	if _, err := write("Docs", "/", "x"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Wrote the top of a share: %v", err)
+	}
+	if _, err := client.Delete(ctx, &fsproto.DeleteRequest{Share: "Docs", Path: "/"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Deleted a share: %v", err)
+	}
+
+	// read only shares
+	if data, err := read("Archive", "/old.txt"); err != nil || data != "old" {
+		t.Errorf("Wrong read of a read only share: %q %v", data, err)
+	}
+	if _, err := write("Archive", "/new.txt", "x"); status.Code(err) != codes.PermissionDenied || exists(filepath.Join(archive, "new.txt")) {
+		t.Errorf("Wrote to a read only share: %v", err)
+	}
+	if _, err := client.Delete(ctx, &fsproto.DeleteRequest{Share: "Archive", Path: "/old.txt"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Deleted from a read only share: %v", err)
+	}
+
+	// no_upload and no_delete
+	no_upload, no_delete = true, true
+	if _, err := write("Docs", "/Taxes/2020.pdf", "x"); status.Code(err) != codes.PermissionDenied || exists(filepath.Join(docs, "Taxes", "2020.pdf")) {
+		t.Errorf("Wrote with no_upload: %v", err)
+	}
+	if _, err := client.Delete(ctx, &fsproto.DeleteRequest{Share: "Docs", Path: "/Taxes/2019.pdf"}); err != nil || !exists(filepath.Join(docs, "Taxes", "2019.pdf")) {
+		t.Errorf("Deleted with no_delete: %v", err)
+	}
+	no_upload, no_delete = false, false
+
+	// deletes go to the trash
+	if _, err := client.Delete(ctx, &fsproto.DeleteRequest{Share: "Docs", Path: "/Taxes/2019.pdf"}); err != nil || exists(filepath.Join(docs, "Taxes", "2019.pdf")) {
+		t.Errorf("Not deleted: %v", err)
+	}
+	items, _ := list_trash(service.Shares.Get("Docs"))
+	if len(items) != 1 || items[0].Path != "/Taxes/2019.pdf" {
+		t.Errorf("Not in the trash: %+v", items)
+	}
+	if _, err := client.Delete(ctx, &fsproto.DeleteRequest{Share: "Docs", Path: "/Taxes/2019.pdf"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Deleted a missing file: %v", err)
+	}
+	// the trash is not listed
+	list, err = client.List(ctx, &fsproto.ListRequest{Share: "Docs", Path: "/"})
+	names := []string{}
+	for _, entry := range list.GetEntries() {
+		names = append(names, entry.Name)
+	}
+	sort.Strings(names)
+	if err != nil || strings.Join(names, ",") != "Taxes" {
+		t.Errorf("Wrong listing after a delete: %v %v", names, err)
+	}
+}
@@ -0,0 +1,408 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// guest passes give a visiting device read only access to some shares for
+// a few hours, say to stream a movie. a pass is issued from the local
+// network, and its token goes with the requests of the guest, in the
+// Guest-Pass header or as guest=<token>. requests with a pass can only read
+// the files of its shares. passes are revoked when they expire, or before
+// that with DELETE, and everything done with them is logged.
+//
+// how many times a pass was used, when last and from where are kept with
+// it and listed, so that the user knows if the guest used it. they are
+// saved with the expiry job, not on every request
+
+const GUEST_PASSES_FILE = DATA_DIR + "/guest_passes.json"
+const GUEST_PASS_HEADER = "Guest-Pass"
+const GUEST_PASS_MAX_HOURS = 7 * 24
+
+// how many addresses are kept for a pass, the latest
+const GUEST_PASS_SOURCES = 20
+
+var errGuestPassHours = fmt.Errorf("hours must be between 1 and %d", GUEST_PASS_MAX_HOURS)
+var errGuestPassShares = errors.New("no shares given")
+
+// what a guest can ask for
+var guest_paths = map[string]bool{
+	"/shares":          true,
+	"/files":           true,
+	"/files/preview":   true,
+	"/files/image":     true,
+	"/files/thumbnail": true,
+	"/subtitles":       true,
+	"/md":              true,
+	"/md/artwork":      true,
+	"/feed":            true,
+}
+
+type guestPass struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Shares []string `json:"shares"`
+	// only a hash of the token is kept
+	TokenHash string    `json:"token_sha1"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	// how it was used
+	Accesses   int64         `json:"accesses"`
+	LastAccess *time.Time    `json:"last_access,omitempty"`
+	Sources    []guestSource `json:"sources,omitempty"`
+}
+
+// guestSource is an address a pass was used from
+type guestSource struct {
+	IP         string    `json:"ip"`
+	Accesses   int64     `json:"accesses"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+type guestPasses struct {
+	file   string
+	passes map[string]*guestPass
+	// accesses not saved yet
+	dirty bool
+	sync.Mutex
+}
+
+var guest_passes = &guestPasses{file: GUEST_PASSES_FILE}
+
+type guestPassKey struct{}
+
+// guest_pass_of returns the pass a request was made with, if any
+func guest_pass_of(request *http.Request) *guestPass {
+	pass, _ := request.Context().Value(guestPassKey{}).(*guestPass)
+	return pass
+}
+
+// allows says if the pass gives access to share
+func (pass *guestPass) allows(share string) bool {
+	for _, name := range pass.Shares {
+		if name == share {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads the passes the first time they are needed. call with the lock held
+func (this *guestPasses) load() {
+	if this.passes != nil {
+		return
+	}
+	this.passes = make(map[string]*guestPass)
+	data, err := ioutil.ReadFile(this.file)
+	if err != nil {
+		return
+	}
+	passes := []*guestPass{}
+	if err := json.Unmarshal(data, &passes); err != nil {
+		log_error("Error reading the guest passes in %s: %s", this.file, err.Error())
+		return
+	}
+	for _, pass := range passes {
+		this.passes[pass.ID] = pass
+	}
+}
+
+// save writes the passes. call with the lock held
+func (this *guestPasses) save() error {
+	data, err := json.Marshal(this.sorted())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(this.file), 0755); err != nil {
+		return err
+	}
+	if err := write_file_atomic(this.file, data, 0600); err != nil {
+		return err
+	}
+	this.dirty = false
+	return nil
+}
+
+// sorted lists the passes, the newest first. call with the lock held
+func (this *guestPasses) sorted() []*guestPass {
+	passes := make([]*guestPass, 0, len(this.passes))
+	for _, pass := range this.passes {
+		passes = append(passes, pass)
+	}
+	sort.Slice(passes, func(i, j int) bool { return passes[i].Created.After(passes[j].Created) })
+	return passes
+}
+
+// issue makes a pass to shares for hours, returning it with its token
+func (this *guestPasses) issue(name string, shares []string, hours int) (*guestPass, string, error) {
+	if hours < 1 || hours > GUEST_PASS_MAX_HOURS {
+		return nil, "", errGuestPassHours
+	}
+	if len(shares) == 0 {
+		return nil, "", errGuestPassShares
+	}
+	// the id is shown and logged, so it's not part of the token
+	secret := make([]byte, 28)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	token := hex.EncodeToString(secret[:24])
+	// with the skew, so that passes do not expire early once the clock is fixed
+	now := clock.now()
+	pass := &guestPass{
+		ID:        hex.EncodeToString(secret[24:]),
+		Name:      name,
+		Shares:    shares,
+		TokenHash: sha1string(token),
+		Created:   now,
+		Expires:   now.Add(time.Duration(hours) * time.Hour),
+	}
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	this.passes[pass.ID] = pass
+	if err := this.save(); err != nil {
+		delete(this.passes, pass.ID)
+		return nil, "", err
+	}
+	log("Guest pass %s issued to %q for %s until %s", pass.ID, name, strings.Join(shares, ", "), pass.Expires.Format(time.RFC3339))
+	return pass, token, nil
+}
+
+// find returns the pass of token, if it has not expired
+func (this *guestPasses) find(token string) *guestPass {
+	hash := sha1string(token)
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	for _, pass := range this.passes {
+		if pass.TokenHash == hash && clock.now().Before(pass.Expires) {
+			return pass
+		}
+	}
+	return nil
+}
+
+// list has copies of the passes, which change as they are used
+func (this *guestPasses) list() []*guestPass {
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	passes := this.sorted()
+	for i, pass := range passes {
+		copied := *pass
+		copied.Sources = append([]guestSource(nil), pass.Sources...)
+		passes[i] = &copied
+	}
+	return passes
+}
+
+// accessed counts a use of pass from ip
+func (this *guestPasses) accessed(pass *guestPass, ip string) {
+	now := time.Now()
+	this.Lock()
+	defer this.Unlock()
+	pass.Accesses++
+	pass.LastAccess = &now
+	this.dirty = true
+	for i := range pass.Sources {
+		if pass.Sources[i].IP == ip {
+			pass.Sources[i].Accesses++
+			pass.Sources[i].LastAccess = now
+			return
+		}
+	}
+	pass.Sources = append(pass.Sources, guestSource{IP: ip, Accesses: 1, LastAccess: now})
+	if len(pass.Sources) > GUEST_PASS_SOURCES {
+		// the one not seen for the longest goes
+		oldest := 0
+		for i := range pass.Sources {
+			if pass.Sources[i].LastAccess.Before(pass.Sources[oldest].LastAccess) {
+				oldest = i
+			}
+		}
+		pass.Sources = append(pass.Sources[:oldest], pass.Sources[oldest+1:]...)
+	}
+}
+
+// save_accesses writes the passes if they were used since the last save
+func (this *guestPasses) save_accesses() error {
+	this.Lock()
+	defer this.Unlock()
+	if !this.dirty {
+		return nil
+	}
+	return this.save()
+}
+
+// revoke removes the pass id before it expires
+func (this *guestPasses) revoke(id string) (bool, error) {
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	pass, ok := this.passes[id]
+	if !ok {
+		return false, nil
+	}
+	delete(this.passes, id)
+	log("Guest pass %s of %q revoked", id, pass.Name)
+	return true, this.save()
+}
+
+// expiry is a job removing the passes that expired
+func (this *guestPasses) expiry() jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		this.Lock()
+		defer this.Unlock()
+		this.load()
+		expired := 0
+		for id, pass := range this.passes {
+			if clock.now().Before(pass.Expires) {
+				continue
+			}
+			delete(this.passes, id)
+			log("Guest pass %s of %q expired", id, pass.Name)
+			expired++
+		}
+		if expired > 0 || this.dirty {
+			if err := this.save(); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("%d guest passes expired, %d left", expired, len(this.passes)), nil
+	}
+}
+
+// guest_access is a middleware restricting the requests made with a guest
+// pass to reading the shares of the pass
+func (service *MercuryFsService) guest_access(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		q := request.URL.Query()
+		token := request.Header.Get(GUEST_PASS_HEADER)
+		if token == "" {
+			token = q.Get("guest")
+		}
+		if token == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if q.Get("guest") != "" {
+			// the token is not logged
+			q.Del("guest")
+			request.URL.RawQuery = q.Encode()
+		}
+		ua := request.Header.Get("User-Agent")
+		query := pathForLog(request.URL)
+
+		status, message := 0, ""
+		pass := guest_passes.find(token)
+		share := q.Get("s")
+		switch {
+		case pass == nil:
+			status, message = http.StatusUnauthorized, "invalid or expired guest pass"
+		case request.Method != "GET" && request.Method != "HEAD":
+			status, message = http.StatusForbidden, "guest passes are read only"
+		case !guest_paths[request.URL.Path]:
+			status, message = http.StatusForbidden, "not allowed with a guest pass"
+		case share != "" && !pass.allows(share), strings.HasPrefix(request.URL.Path, "/files") && share == "":
+			status, message = http.StatusForbidden, "share not allowed with this guest pass"
+		}
+		if status != 0 {
+			size := json_response(writer, status, map[string]string{"error": message})
+			service.debug_info.requestServed(size)
+			if pass != nil {
+				log("Guest pass %s: \"%s %s\" %d %d \"%s\"", pass.ID, request.Method, query, status, size, ua)
+			} else {
+				log("\"%s %s\" %d %d \"%s\"", request.Method, query, status, size, ua)
+			}
+			return
+		}
+		log("Guest pass %s of %q from %s: \"%s %s\"", pass.ID, pass.Name, client_ip(request), request.Method, query)
+		guest_passes.accessed(pass, client_ip(request))
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), guestPassKey{}, pass)))
+	})
+}
+
+// GET /guest/passes lists the passes
+func (service *MercuryFsService) guest_pass_list(writer http.ResponseWriter, request *http.Request) {
+	size := json_response(writer, http.StatusOK, guest_passes.list())
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+}
+
+// POST /guest/passes?name=<name>&s=<share>[&s=<share>...]&hours=<n> issues
+// a pass, the only time its token is returned
+func (service *MercuryFsService) guest_pass_issue(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	status, result := http.StatusOK, interface{}(nil)
+	hours, _ := strconv.Atoi(q.Get("hours"))
+	shares := []string{}
+	for _, name := range q["s"] {
+		if service.Shares.Get(name) == nil {
+			status, result = http.StatusNotFound, map[string]string{"error": "no share " + name}
+			break
+		}
+		shares = append(shares, name)
+	}
+	if status == http.StatusOK {
+		pass, token, err := guest_passes.issue(q.Get("name"), shares, hours)
+		switch {
+		case err == errGuestPassHours || err == errGuestPassShares:
+			status, result = http.StatusBadRequest, map[string]string{"error": err.Error()}
+		case err != nil:
+			status, result = http.StatusInternalServerError, map[string]string{"error": err.Error()}
+		default:
+			// expires_in does not depend on the clocks
+			result = map[string]interface{}{"id": pass.ID, "token": token, "shares": pass.Shares, "expires": pass.Expires, "expires_in": int64(pass.Expires.Sub(clock.now()).Seconds())}
+		}
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+}
+
+// DELETE /guest/passes/{id} revokes a pass
+func (service *MercuryFsService) guest_pass_revoke(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status, size := http.StatusNoContent, int64(0)
+	found, err := guest_passes.revoke(mux.Vars(request)["id"])
+	switch {
+	case err != nil:
+		status = http.StatusInternalServerError
+		size = json_response(writer, status, map[string]string{"error": err.Error()})
+	case !found:
+		status = http.StatusNotFound
+		http.NotFound(writer, request)
+	default:
+		writer.WriteHeader(status)
+	}
+	service.debug_info.requestServed(size)
+	log("\"DELETE %s\" %d %d \"%s\"", query, status, size, ua)
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGuestPasses(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "guest")
+	defer os.RemoveAll(dir)
+	saved := guest_passes
+	defer func() { guest_passes = saved }()
+	guest_passes = &guestPasses{file: filepath.Join(dir, "guest_passes.json")}
+
+	movies, docs := filepath.Join(dir, "movies"), filepath.Join(dir, "docs")
+	os.MkdirAll(movies, 0755)
+	os.MkdirAll(docs, 0755)
+	ioutil.WriteFile(filepath.Join(movies, "Up.mkv"), []byte("movie"), 0644)
+	ioutil.WriteFile(filepath.Join(docs, "taxes.txt"), []byte("private"), 0644)
+	service := &MercuryFsService{
+		Shares:     &HdaShares{Shares: []*HdaShare{{name: "Movies", path: movies}, {name: "Docs", path: docs}}},
+		debug_info: new(debugInfo),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/shares", service.serve_shares).Methods("GET")
+	router.HandleFunc("/files", service.serve_file).Methods("GET")
+	router.HandleFunc("/files", service.delete_file).Methods("DELETE")
+	router.HandleFunc("/jobs", service.jobs_status).Methods("GET")
+	router.HandleFunc("/guest/passes", service.guest_pass_list).Methods("GET")
+	router.HandleFunc("/guest/passes", service.guest_pass_issue).Methods("POST")
+	router.HandleFunc("/guest/passes/{id}", service.guest_pass_revoke).Methods("DELETE")
+	router.Use(service.guest_access)
+	request := func(method, target, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			r.Header.Set(GUEST_PASS_HEADER, token)
+		}
+		router.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	if code := request("POST", "/guest/passes?name=Ann&s=Movies&hours=0", "").Code; code != 400 {
+		t.Errorf("%d instead of 400 for no hours", code)
+	}
+	if code := request("POST", "/guest/passes?name=Ann&s=Music&hours=2", "").Code; code != 404 {
+		t.Errorf("%d instead of 404 for a missing share", code)
+	}
+	recorder := request("POST", "/guest/passes?name=Ann&s=Movies&hours=2", "")
+	issued := struct{ ID, Token string }{}
+	json.Unmarshal(recorder.Body.Bytes(), &issued)
+	if recorder.Code != 200 || issued.Token == "" || issued.ID == "" {
+		t.Fatalf("Pass not issued: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// guests read the shares of their pass, and nothing else
+	recorder = request("GET", "/files?s=Movies&p=/Up.mkv", issued.Token)
+	if recorder.Code != 200 || recorder.Body.String() != "movie" {
+		t.Errorf("Guest could not read: %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = request("GET", "/files?s=Movies&p=/Up.mkv&guest="+issued.Token, "")
+	if recorder.Code != 200 {
+		t.Errorf("Guest could not read with the token in the query: %d", recorder.Code)
+	}
+	recorder = request("GET", "/shares", issued.Token)
+	shares := []struct{ Name string }{}
+	json.Unmarshal(recorder.Body.Bytes(), &shares)
+	if len(shares) != 1 || shares[0].Name != "Movies" {
+		t.Errorf("Guest sees the wrong shares: %s", recorder.Body.String())
+	}
+	for _, denied := range []struct{ method, target string }{
+		{"GET", "/files?s=Docs&p=/taxes.txt"},
+		{"DELETE", "/files?s=Movies&p=/Up.mkv"},
+		{"GET", "/jobs"},
+		{"POST", "/guest/passes?name=Bob&s=Docs&hours=2"},
+	} {
+		if code := request(denied.method, denied.target, issued.Token).Code; code != 403 {
+			t.Errorf("%d instead of 403 for a guest %s %s", code, denied.method, denied.target)
+		}
+	}
+	if code := request("GET", "/files?s=Movies&p=/Up.mkv", "wrong").Code; code != 401 {
+		t.Errorf("%d instead of 401 for a wrong token", code)
+	}
+	if !exists(filepath.Join(movies, "Up.mkv")) {
+		t.Fatalf("A guest deleted a file")
+	}
+
+	// passes are kept, and revoked
+	guest_passes = &guestPasses{file: guest_passes.file}
+	if len(guest_passes.list()) != 1 {
+		t.Fatalf("The pass was not kept")
+	}
+	if code := request("DELETE", "/guest/passes/"+issued.ID, "").Code; code != 204 {
+		t.Errorf("%d instead of 204 revoking", code)
+	}
+	if code := request("GET", "/files?s=Movies&p=/Up.mkv", issued.Token).Code; code != 401 {
+		t.Errorf("%d instead of 401 after revoking", code)
+	}
+	if code := request("DELETE", "/guest/passes/"+issued.ID, "").Code; code != 404 {
+		t.Errorf("%d instead of 404 revoking again", code)
+	}
+}
+
+func TestGuestPassExpiry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "guest")
+	defer os.RemoveAll(dir)
+	passes := &guestPasses{file: filepath.Join(dir, "guest_passes.json")}
+	pass, token, err := passes.issue("Ann", []string{"Movies"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passes.issue("Bob", []string{"Movies"}, 3)
+	if passes.find(token) != pass {
+		t.Fatalf("The pass was not found")
+	}
+
+	pass.Expires = time.Now().Add(-time.Second)
+	if passes.find(token) != nil {
+		t.Errorf("An expired pass was found")
+	}
+	passes.expiry()(func(done, total int64) {})
+	if list := passes.list(); len(list) != 1 || list[0].Name != "Bob" {
+		t.Errorf("Wrong passes left: %v", list)
+	}
+}
+
+func TestGuestPassAccesses(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "guest")
+	defer os.RemoveAll(dir)
+	saved := guest_passes
+	defer func() { guest_passes = saved }()
+	guest_passes = &guestPasses{file: filepath.Join(dir, "guest_passes.json")}
+	pass, token, _ := guest_passes.issue("Ann", []string{"Movies"}, 1)
+
+	service := &MercuryFsService{
+		Shares:     &HdaShares{Shares: []*HdaShare{{name: "Movies", path: dir}}},
+		debug_info: new(debugInfo),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/shares", service.serve_shares).Methods("GET")
+	router.HandleFunc("/guest/passes", service.guest_pass_list).Methods("GET")
+	router.Use(service.guest_access)
+	request := func(remote, token string, relay bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/shares", nil)
+		r.RemoteAddr = remote
+		r.Header.Set(GUEST_PASS_HEADER, token)
+		if relay {
+			r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+			r = mark_relay_request(r)
+		}
+		router.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	request("192.168.1.20:5000", token, false)
+	request("192.168.1.20:5001", token, false)
+	request("10.0.0.1:443", token, true)
+	// not a use of the pass
+	request("192.168.1.20:5000", "wrong", false)
+
+	passes := []*guestPass{}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/guest/passes", nil))
+	json.Unmarshal(recorder.Body.Bytes(), &passes)
+	if len(passes) != 1 || passes[0].Accesses != 3 || passes[0].LastAccess == nil || len(passes[0].Sources) != 2 {
+		t.Fatalf("Wrong accesses: %+v", passes)
+	}
+	if source := passes[0].Sources[1]; source.IP != "203.0.113.7" || source.Accesses != 1 {
+		t.Errorf("Wrong source over the relay: %+v", source)
+	}
+
+	// only the latest addresses are kept
+	for i := 0; i < GUEST_PASS_SOURCES+5; i++ {
+		guest_passes.accessed(pass, fmt.Sprintf("10.1.1.%d", i))
+	}
+	if sources := guest_passes.list()[0].Sources; len(sources) != GUEST_PASS_SOURCES || sources[len(sources)-1].IP != "10.1.1.24" {
+		t.Errorf("Wrong sources kept: %v", sources)
+	}
+
+	// and they are saved
+	if err := guest_passes.save_accesses(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &guestPasses{file: guest_passes.file}
+	if list := loaded.list(); len(list) != 1 || list[0].Accesses != 3+GUEST_PASS_SOURCES+5 {
+		t.Errorf("Accesses not saved: %+v", list)
+	}
+}
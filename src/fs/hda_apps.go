@@ -11,8 +11,7 @@ package main
 
 import (
 	"database/sql"
-	"fmt"
-	"strings"
+	"encoding/json"
 	"sync"
 )
 
@@ -35,30 +34,52 @@ func newHdaApps() (*HdaApps, error) {
 }
 
 func (this *HdaApps) list() error {
+	// no apps without Amahi
+	if standalone() {
+		return nil
+	}
+	newApps, err := read_sql_apps()
+	db_status(err)
+	if err != nil {
+		cache := load_settings_cache()
+		if len(cache.Apps) == 0 {
+			return err
+		}
+		newApps = cache.Apps
+		set_from_cache(&apps_from_cache, true)
+	} else {
+		set_from_cache(&apps_from_cache, false)
+		update_settings_cache(func(cache *settingsCache) {
+			cache.Apps = newApps
+		})
+	}
+
+	this.Lock()
+	this.Apps = newApps
+	this.Unlock()
+
+	return nil
+}
+
+func read_sql_apps() ([]*HdaApp, error) {
 	dbconn, err := sql.Open("mysql", MYSQL_CREDENTIALS)
 	if err != nil {
-		log(err.Error())
-		return err
+		return nil, err
 	}
 	defer dbconn.Close()
 	q := SQL_SELECT_APPS
 	rows, err := dbconn.Query(q)
 	if err != nil {
-		log(err.Error())
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 	newApps := make([]*HdaApp, 0)
 	for rows.Next() {
 		app := new(HdaApp)
 		rows.Scan(&app.Vhost, &app.Name, &app.Logo)
 		newApps = append(newApps, app)
 	}
-
-	this.Lock()
-	this.Apps = newApps
-	this.Unlock()
-
-	return nil
+	return newApps, rows.Err()
 }
 
 func (this *HdaApps) get(shareName string) *HdaApp {
@@ -70,34 +91,40 @@ func (this *HdaApps) get(shareName string) *HdaApp {
 	return nil
 }
 
-func (this *HdaApps) to_json() string {
+// appEntry is an app as listed in JSON, with its last check
+type appEntry struct {
+	Name  string `json:"name"`
+	Vhost string `json:"vhost"`
+	Logo  string `json:"logo"`
+	*appHealth
+}
+
+// the dashboard is always listed first
+var dashboard_app = appEntry{Name: "Dashboard", Vhost: "hda", Logo: "https://wiki.amahi.org/images/8/8a/Dashboard-logo.png"}
+
+// to_json lists the apps client can use, a user or a profile, "" for
+// those without a token
+func (this *HdaApps) to_json(client string) string {
 	if len(this.Apps) < 1 {
 		return "[]"
 	}
 
-	ss := []string{}
 	this.RLock()
-
-	// start by showing the dashboard first
-	ss = append(ss, `{ "name": "Dashboard", "vhost": "hda", "logo": "https://wiki.amahi.org/images/8/8a/Dashboard-logo.png" }`)
-
-	for i := range this.Apps {
-		temp := "{"
-		// NB: 'name' and 'mtime' are used because of API spec
-		if this.Apps[i].Name != "" {
-			temp += fmt.Sprintf(`"name": "%s", `, this.Apps[i].Name)
-		} else {
-			temp += fmt.Sprintf(`"name": "%s", `, this.Apps[i].Vhost)
+	list := make([]appEntry, 0, len(this.Apps)+1)
+	if app_allowed(dashboard_app.Vhost, client) {
+		list = append(list, dashboard_app)
+	}
+	for _, app := range this.Apps {
+		if !app_allowed(app.Vhost, client) {
+			continue
+		}
+		name := app.Name
+		if name == "" {
+			name = app.Vhost
 		}
-		temp += fmt.Sprintf(`"vhost": "%s", `, this.Apps[i].Vhost)
-		temp += fmt.Sprintf(`"logo": "%s"`, this.Apps[i].Logo)
-		temp += "}"
-		ss = append(ss, temp)
+		list = append(list, appEntry{Name: name, Vhost: app.Vhost, Logo: app.Logo, appHealth: apps_health.get(app.Vhost)})
 	}
-
 	this.RUnlock()
-	result := "[\n  "
-	result += strings.Join(ss, ",\n  ")
-	result += "\n]"
-	return result
+	data, _ := json.Marshal(list)
+	return string(data)
 }
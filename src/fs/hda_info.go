@@ -10,6 +10,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"runtime"
 )
@@ -18,6 +19,27 @@ type HdaInfo struct {
 	version, local_addr, relay_addr string
 }
 
+// hdaInfoEntry is the info as sent to the relay
+type hdaInfoEntry struct {
+	Version   string `json:"version"`
+	LocalAddr string `json:"local_addr"`
+	RelayAddr string `json:"relay_addr"`
+	Arch      string `json:"arch"`
+	// the certificates of the local server, for clients to pin
+	LocalTLS map[string]interface{} `json:"local_tls,omitempty"`
+	// the public address of the local server, for clients to skip the relay
+	Direct map[string]interface{} `json:"direct,omitempty"`
+}
+
 func (this *HdaInfo) to_json() string {
-	return fmt.Sprintf(`{"version": "%s", "local_addr": "%s", "relay_addr": "%s", "arch": "%s-%s-%d"}`, this.version, this.local_addr, this.relay_addr, runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+	info := hdaInfoEntry{
+		Version:   this.version,
+		LocalAddr: this.local_addr,
+		RelayAddr: this.relay_addr,
+		Arch:      fmt.Sprintf("%s-%s-%d", runtime.GOOS, runtime.GOARCH, runtime.NumCPU()),
+		LocalTLS:  local_tls.info(),
+		Direct:    direct_connection.info(),
+	}
+	data, _ := json.Marshal(info)
+	return string(data)
 }
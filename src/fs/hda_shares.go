@@ -11,12 +11,14 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/amahi/go-metadata"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
 	"sync"
@@ -28,6 +30,12 @@ type HdaShare struct {
 	updated_at time.Time
 	path       string
 	tags	string
+	// why the share's path cannot be used, empty when it's fine
+	problem string
+	// mounted from another machine, see network_mounts.go
+	network bool
+	// not writable, see config_shares.go
+	read_only bool
 }
 
 type HdaShares struct {
@@ -35,38 +43,161 @@ type HdaShares struct {
 	LastChecked time.Time
 	sync.RWMutex
 	root_dir string
+	overlaps []shareOverlap
+	// when the shares were last read, whether they must be read again,
+	// and how many times they changed
+	refreshed time.Time
+	stale     bool
+	version   uint64
+	// the JSON listings of the shares, by key
+	listings map[string]sharesListing
+}
+
+// the list of shares is read again after SHARES_TTL, or when something
+// tells it changed: a share directory going away, a network share mounted
+// or POST /shares/refresh
+const SHARES_TTL = 30 * time.Second
+
+type sharesListing struct {
+	version    uint64
+	json, etag string
+}
+
+// shareOverlap is a share whose path is inside the path of another share.
+// files under the inner share belong to the inner share only
+type shareOverlap struct {
+	Outer string `json:"outer"`
+	Inner string `json:"inner"`
+	// where the inner share is, relative to the outer one
+	relative string
 }
 
 func NewHdaShares(root_dir string) (*HdaShares, error) {
 	result := new(HdaShares)
 	result.root_dir = root_dir
+
+	// start with the cached shares, if any, and refresh them in the background
+	if root_dir == "" && !standalone() {
+		if cache := load_settings_cache(); len(cache.Shares) > 0 {
+			result.set_shares(cache.hda_shares())
+			set_from_cache(&shares_from_cache, true)
+			go result.update_shares()
+			return result, nil
+		}
+	}
 	err := result.update_shares()
 
 	return result, err
 }
 
 func (this *HdaShares) update_shares() error {
-	if this.root_dir == "" {
-		return this.update_sql_shares()
-	} else {
+	if this.root_dir != "" {
 		return this.update_dir_shares()
+	} else if standalone() {
+		return this.update_config_shares()
+	} else {
+		return this.update_sql_shares()
+	}
+}
+
+// refresh updates the shares when they were read more than SHARES_TTL ago
+// or were invalidated
+func (this *HdaShares) refresh() error {
+	this.Lock()
+	fresh := !this.stale && time.Since(this.refreshed) < SHARES_TTL
+	if !fresh {
+		this.refreshed, this.stale = time.Now(), false
+	}
+	this.Unlock()
+	if fresh {
+		return nil
+	}
+	return this.update_shares()
+}
+
+// invalidate has the shares read again on the next refresh
+func (this *HdaShares) invalidate() {
+	this.Lock()
+	this.stale = true
+	this.Unlock()
+}
+
+// root_changed is the watch listener invalidating the shares when the
+// directory of one goes away
+func (this *HdaShares) root_changed(share *HdaShare, event fileEvent) {
+	if event.Path == "/" && (event.Op == "delete" || event.Op == "rename") {
+		this.invalidate()
 	}
 }
 
+// listing is the JSON of the shares for which keep is true, as made by
+// to_json_of, and its ETag. it is kept as key until the shares change
+func (this *HdaShares) listing(key string, keep func(name string) bool) (string, string) {
+	// the shares closed now are listed as such, and the tags of the config
+	// are listed as they are now
+	key += "#closed=" + strings.Join(closed_shares(), ",") + "#tags=" + share_tags_key()
+	this.RLock()
+	listing, ok := this.listings[key]
+	version := this.version
+	this.RUnlock()
+	if ok && listing.version == version {
+		return listing.json, listing.etag
+	}
+	json := this.to_json_of(keep)
+	listing = sharesListing{version: version, json: json, etag: etag_cache.string_etag(key, json)}
+	this.Lock()
+	if this.version == version {
+		if this.listings == nil {
+			this.listings = make(map[string]sharesListing)
+		}
+		this.listings[key] = listing
+	}
+	this.Unlock()
+	return listing.json, listing.etag
+}
+
 func (this *HdaShares) update_sql_shares() error {
+	newShares, err := read_sql_shares()
+	db_status(err)
+	if err != nil {
+		// keep serving the shares we know about, from before or from the cache
+		this.RLock()
+		known := len(this.Shares) > 0
+		this.RUnlock()
+		if known {
+			return nil
+		}
+		cache := load_settings_cache()
+		if len(cache.Shares) == 0 {
+			return err
+		}
+		this.set_shares(cache.hda_shares())
+		set_from_cache(&shares_from_cache, true)
+		return nil
+	}
+
+	this.set_shares(newShares)
+	set_from_cache(&shares_from_cache, false)
+	update_settings_cache(func(cache *settingsCache) {
+		cache.Shares = cache_shares(newShares)
+	})
+
+	return nil
+}
+
+func read_sql_shares() ([]*HdaShare, error) {
 	dbconn, err := sql.Open("mysql", MYSQL_CREDENTIALS)
 	if err != nil {
-		log(err.Error())
-		return err
+		return nil, err
 	}
 	defer dbconn.Close()
 	q := SQL_SELECT_SHARES
 	debug(5, "share query: %s\n", q)
 	rows, err := dbconn.Query(q)
 	if err != nil {
-		log(err.Error())
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 	newShares := make([]*HdaShare, 0)
 	for rows.Next() {
 		share := new(HdaShare)
@@ -74,13 +205,7 @@ func (this *HdaShares) update_sql_shares() error {
 		debug(5, "share found: %s\n", share.name)
 		newShares = append(newShares, share)
 	}
-
-	this.Lock()
-	this.LastChecked = time.Now()
-	this.Shares = newShares
-	this.Unlock()
-
-	return nil
+	return newShares, rows.Err()
 }
 
 func (this *HdaShares) update_dir_shares() (nil error) {
@@ -115,46 +240,299 @@ func (this *HdaShares) update_dir_shares() (nil error) {
 		}
 	}
 
+	this.set_shares(newShares)
+
+	return
+}
+
+func (this *HdaShares) set_shares(shares []*HdaShare) {
+	// the network shares come after the local ones, which win on names
+	for _, share := range network_mounts.shares() {
+		if find_share(shares, share.name) == nil {
+			shares = append(shares, share)
+		}
+	}
+	overlaps := find_share_overlaps(shares)
+	for _, share := range shares {
+		// network shares are checked by their job, as a dead server hangs it
+		if !share.network {
+			share.problem = check_share_path(share.path)
+		}
+	}
 	this.Lock()
+	old_shares := this.Shares
+	old_problems := make(map[string]string, len(this.Shares))
+	for _, share := range this.Shares {
+		old_problems[share.name] = share.problem
+	}
+	changed := len(overlaps) != len(this.overlaps)
+	for i := 0; !changed && i < len(overlaps); i++ {
+		changed = overlaps[i] != this.overlaps[i]
+	}
 	this.LastChecked = time.Now()
-	this.Shares = newShares
+	if !same_shares(this.Shares, shares) {
+		this.version++
+		this.listings = nil
+	}
+	this.Shares = shares
+	this.overlaps = overlaps
 	this.Unlock()
 
-	return
+	for _, share := range shares {
+		old, known := old_problems[share.name]
+		if share.problem != "" && (!known || old != share.problem) {
+			log_warn("share %s is unavailable: %s (%s)", share.name, share.problem, share.path)
+		} else if share.problem == "" && known && old != "" {
+			log("Share %s is available again", share.name)
+		}
+		// the disk of the share was unplugged, or plugged back
+		if known && (share.problem == SHARE_NOT_MOUNTED) != (old == SHARE_NOT_MOUNTED) {
+			op := "online"
+			if share.problem == SHARE_NOT_MOUNTED {
+				op = "offline"
+			}
+			events.publish(fileEvent{Share: share.name, Path: "/", Op: op, IsDir: true, Time: time.Now()})
+		}
+	}
+	if diff := diff_shares(old_shares, shares); diff != nil {
+		events.publish(fileEvent{Op: "shares", Time: time.Now(), Shares: diff})
+	}
+	if changed {
+		for _, o := range overlaps {
+			log_warn("share %s is inside share %s, its files are only counted in %s", o.Inner, o.Outer, o.Inner)
+		}
+	}
+}
+
+// diff_shares is what changed from the shares before to the shares after,
+// as listed, or nil for nothing. the home share, only listed for users, is
+// left out
+func diff_shares(before, after []*HdaShare) *sharesDiff {
+	diff := &sharesDiff{Added: []shareEntry{}, Changed: []shareEntry{}, Removed: []string{}}
+	for _, share := range after {
+		if is_homes_share(share.name) {
+			continue
+		}
+		entry := share.entry()
+		if old := find_share(before, share.name); old == nil {
+			diff.Added = append(diff.Added, entry)
+		} else if !reflect.DeepEqual(old.entry(), entry) {
+			diff.Changed = append(diff.Changed, entry)
+		}
+	}
+	for _, share := range before {
+		if !is_homes_share(share.name) && find_share(after, share.name) == nil {
+			diff.Removed = append(diff.Removed, share.name)
+		}
+	}
+	if len(diff.Added)+len(diff.Changed)+len(diff.Removed) == 0 {
+		return nil
+	}
+	return diff
+}
+
+// same_shares says if two lists of shares would be listed the same
+func same_shares(a, b []*HdaShare) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].name != b[i].name || a[i].path != b[i].path || a[i].tags != b[i].tags ||
+			!a[i].updated_at.Equal(b[i].updated_at) || a[i].problem != b[i].problem || a[i].read_only != b[i].read_only {
+			return false
+		}
+	}
+	return true
+}
+
+// check_share_path returns what is wrong with the path of a share, if anything
+func check_share_path(path string) string {
+	if path == "" {
+		return "path is not set"
+	}
+	if share_mounts.offline(path) {
+		return SHARE_NOT_MOUNTED
+	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "path does not exist"
+	} else if os.IsPermission(err) {
+		return "path is not readable"
+	} else if err != nil {
+		return err.Error()
+	}
+	if !fi.IsDir() {
+		return "path is not a directory"
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return "path is not readable"
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return "path is not readable"
+	}
+	return ""
+}
+
+// shareProblem is an unavailable share, as shown in /hda_debug
+type shareProblem struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+// unavailable returns the shares found unusable in the last update
+func (this *HdaShares) unavailable() []shareProblem {
+	this.RLock()
+	defer this.RUnlock()
+	problems := []shareProblem{}
+	for _, share := range this.Shares {
+		if share.problem != "" {
+			problems = append(problems, shareProblem{Name: share.name, Path: share.path, Problem: share.problem})
+		}
+	}
+	return problems
+}
+
+// real_path is the cleaned up path of a share, with symlinks resolved
+func real_path(p string) string {
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		p = resolved
+	}
+	return filepath.Clean(p)
+}
+
+// path_inside says if p is inside dir (and not dir itself)
+func path_inside(p, dir string) bool {
+	return strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// find_share_overlaps returns the shares nested inside other shares
+func find_share_overlaps(shares []*HdaShare) []shareOverlap {
+	paths := make([]string, len(shares))
+	for i, share := range shares {
+		if share.path != "" {
+			paths[i] = real_path(share.path)
+		}
+	}
+	overlaps := []shareOverlap{}
+	for i, outer := range shares {
+		for j, inner := range shares {
+			if i != j && paths[i] != "" && paths[j] != "" && path_inside(paths[j], paths[i]) {
+				relative := strings.TrimPrefix(paths[j], paths[i])
+				overlaps = append(overlaps, shareOverlap{Outer: outer.name, Inner: inner.name, relative: relative})
+			}
+		}
+	}
+	return overlaps
+}
+
+// share_overlaps returns a copy of the overlaps found in the last update
+func (this *HdaShares) share_overlaps() []shareOverlap {
+	this.RLock()
+	defer this.RUnlock()
+	return append([]shareOverlap{}, this.overlaps...)
+}
+
+// nested_paths returns the paths of the shares inside the named share,
+// which the named share has to leave out when walking its files
+func (this *HdaShares) nested_paths(name string) []string {
+	this.RLock()
+	defer this.RUnlock()
+	share := this.Get(name)
+	paths := []string{}
+	for _, o := range this.overlaps {
+		if o.Outer == name && share != nil {
+			paths = append(paths, share.path+o.relative)
+		}
+	}
+	return paths
+}
+
+// owner returns the share a file belongs to, the innermost one when shares
+// are nested, and the path of the file relative to it
+func (this *HdaShares) owner(full_path string) (*HdaShare, string) {
+	this.RLock()
+	defer this.RUnlock()
+	var owner *HdaShare
+	for _, share := range this.Shares {
+		if share.path == "" || (full_path != share.path && !path_inside(full_path, share.path)) {
+			continue
+		}
+		if owner == nil || len(share.path) > len(owner.path) {
+			owner = share
+		}
+	}
+	if owner == nil {
+		return nil, ""
+	}
+	return owner, "/" + strings.TrimPrefix(strings.TrimPrefix(full_path, owner.path), "/")
 }
 
 func (this *HdaShares) Get(shareName string) *HdaShare {
-	for i := range this.Shares {
-		if this.Shares[i].name == shareName {
-			return this.Shares[i]
+	return find_share(this.Shares, shareName)
+}
+
+func find_share(shares []*HdaShare, name string) *HdaShare {
+	for i := range shares {
+		if shares[i].name == name {
+			return shares[i]
 		}
 	}
 	return nil
 }
 
+// shareEntry is a share as listed in JSON
+type shareEntry struct {
+	// NB: 'name' and 'mtime' are used because of API spec
+	Name    string   `json:"name"`
+	Mtime   string   `json:"mtime"`
+	Tags    []string `json:"tags"`
+	Status  string   `json:"status"`
+	Problem string   `json:"problem,omitempty"`
+	// when it can be used, if not always
+	Hours    string `json:"hours,omitempty"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+	// what the share has, from its tags, see share_tags.go
+	Category string `json:"category"`
+}
+
 func (this *HdaShares) to_json() string {
-	if len(this.Shares) < 1 {
-		return "[]"
-	}
+	return this.to_json_of(nil)
+}
 
-	ss := []string{}
+// to_json_of is to_json with only the shares named for which keep is true,
+// or all of them when keep is nil
+func (this *HdaShares) to_json_of(keep func(name string) bool) string {
 	this.RLock()
-
+	list := make([]shareEntry, 0, len(this.Shares))
 	for i := range this.Shares {
-		temp := "{"
-		// NB: 'name' and 'mtime' are used because of API spec
-		temp += fmt.Sprintf(`"name": "%s", `, this.Shares[i].name)
-		temp += fmt.Sprintf(`"mtime": "%s", `, this.Shares[i].updated_at.Format(http.TimeFormat))
-		temp += fmt.Sprintf(`"tags": [%s]`, strings.Join(this.Shares[i].tags_list(), ", "))
-		temp += "}"
-		ss = append(ss, temp)
+		if keep != nil && !keep(this.Shares[i].name) {
+			continue
+		}
+		list = append(list, this.Shares[i].entry())
 	}
-
 	this.RUnlock()
-	result := "[\n  "
-	result += strings.Join(ss, ",\n  ")
-	result += "\n]"
-	return result
+	data, _ := json.Marshal(list)
+	return string(data)
+}
+
+func (s *HdaShare) entry() shareEntry {
+	entry := shareEntry{Name: s.name, Mtime: s.updated_at.Format(http.TimeFormat), Tags: s.tags_list(), Status: "ok", ReadOnly: s.read_only,
+		Category: s.category()}
+	if entry.Tags == nil {
+		entry.Tags = []string{}
+	}
+	if s.problem == SHARE_NOT_MOUNTED {
+		entry.Status, entry.Problem = "offline", s.problem
+	} else if s.problem != "" {
+		entry.Status, entry.Problem = "unavailable", s.problem
+	} else if !share_open(s.name, schedule_now()) {
+		entry.Status = "closed"
+	}
+	entry.Hours = share_hours(s.name)
+	return entry
 }
 
 // external interface to the path of a share
@@ -162,35 +540,53 @@ func (s *HdaShare) Path() string {
 	return s.path
 }
 
-// return a list of tags, cleaned up
+var tags_separator = regexp.MustCompile(`(\s*,+\s*)+`)
+
+// return a list of tags, cleaned up, with those of share_tags in the config
 func (s *HdaShare) tags_list() []string {
-	re := regexp.MustCompile(`(\s*,+\s*)+`)
-	ta := re.Split(s.tags, -1)
-	r := []string{};
+	ta := append(tags_separator.Split(s.tags, -1), config.ShareTags[s.name]...)
+	r := make([]string, 0, len(ta))
+	seen := make(map[string]bool, len(ta))
 	for _, tag := range ta {
-		if tag != "" {
-			r = append(r, fmt.Sprintf(`"%s"`, strings.TrimSpace(tag)))
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !seen[strings.ToLower(tag)] {
+			seen[strings.ToLower(tag)] = true
+			r = append(r, tag)
 		}
 	}
 	return r
 }
 
-// start a metadata pre-fill of the database in the background
-func (this *HdaShares) start_metadata_prefill(library *metadata.Library) {
-	// start it up after some time, to prevent overloads
-	time.Sleep(15*time.Second)
-	for i := range this.Shares {
-		path := this.Shares[i].path
-		tags := strings.ToLower(this.Shares[i].tags)
-		debug(5, `checking share "%s" (%s)  with tags: %s\n`, this.Shares[i].name, path, tags)
-		if path == "" || tags == "" {
-			continue
+// metadata_hint is the kind of media in a share, for the metadata library
+func (s *HdaShare) metadata_hint() string {
+	tags := strings.ToLower(strings.Join(s.tags_list(), ","))
+	if strings.Contains(tags, "movie") {
+		return "movie"
+	} else if strings.Contains(tags, "tv") {
+		return "tv"
+	}
+	return ""
+}
+
+// metadata_prefetcher returns a watcher listener that looks up the metadata
+// of new videos in movie and tv shares, so it's ready when clients ask
+func metadata_prefetcher(library *metadata.Library) watchListener {
+	queue := make(chan [2]string, 100)
+	go func() {
+		for item := range queue {
+			metadata_cache.lookup(library, item[0], item[1])
 		}
-		if strings.Contains(tags, "movie") {
-			library.Prefill(path, "movie", 0, true)
-		} else if strings.Contains(tags, "tv") {
-			library.Prefill(path, "tv", 0, true)
+	}()
+	return func(share *HdaShare, event fileEvent) {
+		hint := share.metadata_hint()
+		if event.Op != "create" || event.IsDir || hint == "" ||
+			!strings.HasPrefix(getContentType(event.Path), "video/") {
+			return
+		}
+		select {
+		case queue <- [2]string{filepath.Base(event.Path), hint}:
+		default:
+			// the next scan of the share will prefill it
 		}
 	}
 }
-
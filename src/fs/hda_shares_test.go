@@ -10,8 +10,15 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestUpdateShares(t *testing.T) {
@@ -43,3 +50,150 @@ func TestUpdateShares(t *testing.T) {
 		t.Errorf("Expected 1 shares but got %d shares", len(test.Shares))
 	}
 }
+
+func TestSharesToJSON(t *testing.T) {
+	shares := new(HdaShares)
+	shares.Shares = []*HdaShare{
+		{name: "Movies", updated_at: time.Now(), tags: "movies, video,, "},
+		{name: `Odd "name"`, updated_at: time.Now()},
+	}
+
+	var result []struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal([]byte(shares.to_json()), &result); err != nil {
+		t.Fatalf("Invalid shares JSON: %s", err.Error())
+	}
+	if len(result) != 2 || result[1].Name != `Odd "name"` {
+		t.Errorf("Unexpected shares: %#v", result)
+	}
+	if len(result[0].Tags) != 2 || len(result[1].Tags) != 0 {
+		t.Errorf("Unexpected tags: %#v", result)
+	}
+}
+
+func BenchmarkSharesToJSON(b *testing.B) {
+	shares := new(HdaShares)
+	for i := 0; i < 200; i++ {
+		share := &HdaShare{name: fmt.Sprintf("Share %d", i), updated_at: time.Now(), tags: "movies, tv"}
+		shares.Shares = append(shares.Shares, share)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		shares.to_json()
+	}
+}
+
+func TestShareOverlaps(t *testing.T) {
+	shares := new(HdaShares)
+	shares.set_shares([]*HdaShare{
+		{name: "Media", path: "/srv/media"},
+		{name: "Movies", path: "/srv/media/movies"},
+		{name: "Mediabox", path: "/srv/mediabox"},
+	})
+
+	overlaps := shares.share_overlaps()
+	if len(overlaps) != 1 || overlaps[0].Outer != "Media" || overlaps[0].Inner != "Movies" {
+		t.Fatalf("Unexpected overlaps: %#v", overlaps)
+	}
+	if nested := shares.nested_paths("Media"); len(nested) != 1 || nested[0] != "/srv/media/movies" {
+		t.Errorf("Unexpected nested paths: %v", nested)
+	}
+	if share, relative := shares.owner("/srv/media/movies/a.mkv"); share == nil || share.name != "Movies" || relative != "/a.mkv" {
+		t.Errorf("File should belong to the inner share, got %v %s", share, relative)
+	}
+	if share, relative := shares.owner("/srv/media/song.mp3"); share == nil || share.name != "Media" || relative != "/song.mp3" {
+		t.Errorf("File should belong to the outer share, got %v %s", share, relative)
+	}
+	if share, _ := shares.owner("/srv/other"); share != nil {
+		t.Errorf("File outside the shares has owner %s", share.name)
+	}
+}
+
+func TestUnavailableShares(t *testing.T) {
+	err := os.MkdirAll("test/ok", 0777)
+	if err != nil {
+		t.Fatalf("Mkdir failed: %s", err.Error())
+	}
+	defer os.RemoveAll("test")
+
+	shares := new(HdaShares)
+	shares.set_shares([]*HdaShare{
+		{name: "Ok", path: "test/ok"},
+		{name: "Gone", path: "test/gone"},
+	})
+	problems := shares.unavailable()
+	if len(problems) != 1 || problems[0].Name != "Gone" || problems[0].Problem != "path does not exist" {
+		t.Fatalf("Unexpected problems: %#v", problems)
+	}
+
+	var result []struct {
+		Name    string `json:"name"`
+		Status  string `json:"status"`
+		Problem string `json:"problem"`
+	}
+	if err := json.Unmarshal([]byte(shares.to_json()), &result); err != nil {
+		t.Fatalf("Invalid shares JSON: %s", err.Error())
+	}
+	if result[0].Status != "ok" || result[1].Status != "unavailable" || result[1].Problem == "" {
+		t.Errorf("Unexpected status: %#v", result)
+	}
+}
+
+func TestSharesCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "shares")
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "Movies"), 0755)
+	shares, err := NewHdaShares(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &MercuryFsService{Shares: shares, debug_info: new(debugInfo)}
+	list := func(inm string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/shares", nil)
+		request.Header.Set("If-None-Match", inm)
+		service.serve_shares(recorder, request)
+		return recorder
+	}
+
+	first := list("")
+	etag := first.Header().Get("ETag")
+	if first.Code != 200 || !strings.Contains(first.Body.String(), "Movies") {
+		t.Fatalf("Wrong listing: %d %s", first.Code, first.Body.String())
+	}
+	if response := list(etag); response.Code != 304 {
+		t.Errorf("%d instead of 304", response.Code)
+	}
+
+	// a new share is only seen once the list is old or refreshed
+	os.Mkdir(filepath.Join(dir, "Music"), 0755)
+	if body := list("").Body.String(); strings.Contains(body, "Music") {
+		t.Errorf("The shares were read again: %s", body)
+	}
+	recorder := httptest.NewRecorder()
+	service.refresh_shares(recorder, httptest.NewRequest("POST", "/shares/refresh", nil))
+	if recorder.Code != 204 {
+		t.Errorf("%d refreshing", recorder.Code)
+	}
+	if response := list(etag); response.Code != 200 || !strings.Contains(response.Body.String(), "Music") {
+		t.Errorf("The new share is not listed: %d %s", response.Code, response.Body.String())
+	}
+
+	// reading them again without a change keeps the listing
+	version := shares.version
+	shares.update_shares()
+	if shares.version != version {
+		t.Errorf("Unchanged shares changed the version")
+	}
+
+	// a share going away is seen at once
+	shares.root_changed(shares.Get("Music"), fileEvent{Share: "Music", Path: "/", Op: "delete"})
+	os.Remove(filepath.Join(dir, "Music"))
+	if body := list("").Body.String(); strings.Contains(body, "Music") {
+		t.Errorf("A removed share is listed: %s", body)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// home folders: with a share set in the homes section of the config, each
+// user gets a private folder in it, made the first time it's used, and
+// sees that folder as the whole share. a user is known by the token their
+// apps send in the User-Token header or as user=<token>, FTP users by
+// their login, and SFTP users by the user of their key. requests for the
+// share without a user, and the protocols that have none (S3, gRPC), do not
+// see it at all
+
+const USER_TOKEN_HEADER = "User-Token"
+
+var errNoHome = errors.New("the home share is only for users")
+
+// what can be asked for in the home share, with s and p
+var home_paths = map[string]bool{
+	"/files":                  true,
+	"/files/signature":        true,
+	"/files/delta":            true,
+	"/files/chunks":           true,
+	"/files/chunks/data":      true,
+	"/files/preview":          true,
+	"/files/image":            true,
+	"/files/thumbnail":        true,
+	"/files/recall":           true,
+	"/files/arrangement":      true,
+	"/files/stat":             true,
+	"/files/versions":         true,
+	"/files/versions/restore": true,
+	"/subtitles":              true,
+	"/transcode":              true,
+}
+
+type homeUserKey struct{}
+
+// is_homes_share says if name is the share of the home folders
+func is_homes_share(name string) bool {
+	return config.Homes.Share != "" && name == config.Homes.Share
+}
+
+// valid_home_name says if a user name can be a folder name
+func valid_home_name(user string) bool {
+	return user != "" && !strings.HasPrefix(user, ".") && !strings.ContainsAny(user, "/\\\x00")
+}
+
+// home_user returns the user of token, "" if there is none
+func home_user(token string) string {
+	for user, user_token := range config.Homes.Users {
+		if user_token != "" && valid_home_name(user) && subtle.ConstantTimeCompare([]byte(user_token), []byte(token)) == 1 {
+			return user
+		}
+	}
+	return ""
+}
+
+// home_user_of returns the user a request was made by, if any
+func home_user_of(request *http.Request) string {
+	user, _ := request.Context().Value(homeUserKey{}).(string)
+	return user
+}
+
+// home_folder returns the full path of the home folder of user in share,
+// making it if needed
+func home_folder(share *HdaShare, user string) (string, error) {
+	if !valid_home_name(user) {
+		return "", errNoHome
+	}
+	full_path := filepath.Join(share.path, user)
+	if err := os.MkdirAll(full_path, 0700); err != nil {
+		return "", err
+	}
+	return full_path, nil
+}
+
+// home_relative is the path in the share of relative in the home of user
+func home_relative(user, relative string) string {
+	return path.Join("/"+user, path.Clean("/"+relative))
+}
+
+// home_access is a middleware finding the user of a request, and keeping
+// the requests for the home share inside the home folder of that user
+func (service *MercuryFsService) home_access(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		q := request.URL.Query()
+		token := request.Header.Get(USER_TOKEN_HEADER)
+		if token == "" {
+			token = q.Get("user")
+		}
+		if q.Get("user") != "" {
+			// the token is not logged
+			q.Del("user")
+			request.URL.RawQuery = q.Encode()
+		}
+		user := ""
+		status, message := 0, ""
+		if token != "" {
+			if user = home_user(token); user == "" {
+				status, message = http.StatusUnauthorized, "invalid user token"
+			}
+		}
+		if status == 0 && is_homes_share(q.Get("s")) {
+			share := service.Shares.Get(q.Get("s"))
+			switch {
+			case user == "":
+				status, message = http.StatusForbidden, errNoHome.Error()
+			case !home_paths[request.URL.Path]:
+				status, message = http.StatusForbidden, "not allowed in the home share"
+			case share != nil:
+				if _, err := home_folder(share, user); err != nil {
+					debug(2, "Error making the home of %s: %s", user, err.Error())
+					status, message = http.StatusInternalServerError, err.Error()
+				}
+			}
+			if status == 0 {
+				q.Set("p", home_relative(user, q.Get("p")))
+				request.URL.RawQuery = q.Encode()
+			}
+		}
+		if status != 0 {
+			size := json_response(writer, status, map[string]string{"error": message})
+			service.debug_info.requestServed(size)
+			log("\"%s %s\" %d %d \"%s\"", request.Method, pathForLog(request.URL), status, size, request.Header.Get("User-Agent"))
+			return
+		}
+		if user != "" {
+			request = request.WithContext(context.WithValue(request.Context(), homeUserKey{}, user))
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHomeFolders(t *testing.T) {
+	saved := config.Homes
+	defer func() { config.Homes = saved }()
+
+	dir, _ := ioutil.TempDir("", "homes")
+	defer os.RemoveAll(dir)
+	users, docs := filepath.Join(dir, "Users"), filepath.Join(dir, "Docs")
+	os.MkdirAll(docs, 0755)
+	config.Homes.Share = "Users"
+	config.Homes.Users = map[string]string{"ann": "ann-token", "bob": "bob-token", "../root": "bad-token"}
+	service := &MercuryFsService{
+		Shares:     &HdaShares{Shares: []*HdaShare{{name: "Users", path: users}, {name: "Docs", path: docs}}},
+		debug_info: new(debugInfo),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/shares", service.serve_shares).Methods("GET")
+	router.HandleFunc("/files", service.serve_file).Methods("GET")
+	router.HandleFunc("/files", service.upload_file).Methods("POST")
+	router.HandleFunc("/trash", service.trash_list).Methods("GET")
+	router.Use(service.guest_access, service.home_access)
+	request := func(method, target, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			r.Header.Set(USER_TOKEN_HEADER, token)
+		}
+		router.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	// made the first time
+	if response := request("GET", "/files?s=Users&p=/", "ann-token"); response.Code != 200 {
+		t.Fatalf("Could not list a home: %d %s", response.Code, response.Body.String())
+	}
+	if fi, err := os.Stat(filepath.Join(users, "ann")); err != nil || fi.Mode().Perm() != 0700 {
+		t.Fatalf("No private home: %v %v", fi, err)
+	}
+	ioutil.WriteFile(filepath.Join(users, "ann", "diary.txt"), []byte("dear diary"), 0644)
+	if response := request("GET", "/files?s=Users&p=/diary.txt&user=ann-token", ""); response.Body.String() != "dear diary" {
+		t.Errorf("Could not read in a home: %d %q", response.Code, response.Body.String())
+	}
+
+	// the others cannot see it
+	for _, token := range []string{"bob-token", ""} {
+		for _, target := range []string{"/files?s=Users&p=/diary.txt", "/files?s=Users&p=/ann/diary.txt", "/files?s=Users&p=/../ann/diary.txt"} {
+			if response := request("GET", target, token); strings.Contains(response.Body.String(), "dear diary") {
+				t.Errorf("%s read by %q", target, token)
+			}
+		}
+	}
+	if response := request("GET", "/files?s=Users&p=/", ""); response.Code != 403 {
+		t.Errorf("%d instead of 403 without a user", response.Code)
+	}
+	if response := request("GET", "/trash?s=Users", "ann-token"); response.Code != 403 {
+		t.Errorf("%d instead of 403 for the trash of the homes", response.Code)
+	}
+	for _, token := range []string{"nope", "bad-token"} {
+		if response := request("GET", "/files?s=Docs&p=/", token); response.Code != 401 {
+			t.Errorf("%d instead of 401 for %s", response.Code, token)
+		}
+	}
+	if exists(filepath.Join(dir, "root")) {
+		t.Errorf("A home was made out of the share")
+	}
+
+	// the share is only listed for users
+	if body := request("GET", "/shares", "").Body.String(); strings.Contains(body, "Users") || !strings.Contains(body, "Docs") {
+		t.Errorf("Wrong shares without a user: %s", body)
+	}
+	if body := request("GET", "/shares", "bob-token").Body.String(); !strings.Contains(body, "Users") {
+		t.Errorf("Wrong shares of a user: %s", body)
+	}
+
+	// FTP users get their home, sftp has none
+	ftp := &sftpFS{service: service, user: "bob"}
+	if full_path, top, err := ftp.resolve("/Users/notes.txt"); err != nil || top || full_path != filepath.Join(users, "bob", "notes.txt") {
+		t.Errorf("Wrong FTP path: %s %v %v", full_path, top, err)
+	}
+	if _, top, err := ftp.resolve("/Users"); err != nil || !top {
+		t.Errorf("The home can be changed: %v %v", top, err)
+	}
+	sftp := &sftpFS{service: service}
+	if _, _, err := sftp.resolve("/Users/ann/diary.txt"); !os.IsNotExist(err) {
+		t.Errorf("The homes are seen over sftp: %v", err)
+	}
+	if listing := sftp.share_list(); len(listing) != 1 || listing[0].Name() != "Docs" {
+		t.Errorf("Wrong sftp shares: %v", listing)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// how often the scheduler looks for jobs that are due
+const JOB_TICK = time.Minute
+
+// jobFunc does the work of a job. it can report progress as it goes and
+// returns a short summary of what it did
+type jobFunc func(progress func(done, total int64)) (string, error)
+
+type job struct {
+	Name     string     `json:"name"`
+	Interval string     `json:"interval,omitempty"`
+	State    string     `json:"state"`
+	LastRun  *time.Time `json:"last_run,omitempty"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+	Duration string     `json:"last_duration,omitempty"`
+	Result   string     `json:"last_result,omitempty"`
+	Error    string     `json:"last_error,omitempty"`
+	Done     int64      `json:"done,omitempty"`
+	Total    int64      `json:"total,omitempty"`
+	// of the jobs that wait in a queue, like the downloads
+	Position int        `json:"position,omitempty"`
+	ETA      *time.Time `json:"eta,omitempty"`
+
+	interval time.Duration
+	run      jobFunc
+	// triggered while running, so it has to run once more
+	again bool
+}
+
+// jobScheduler runs periodic background jobs, one at a time so that
+// they do not fight over the disks
+type jobScheduler struct {
+	jobs    map[string]*job
+	kick    chan bool
+	running chan bool
+	sync.RWMutex
+}
+
+var scheduler = new_job_scheduler()
+
+var errNoSuchJob = errors.New("no such job")
+
+func new_job_scheduler() *jobScheduler {
+	return &jobScheduler{
+		jobs:    make(map[string]*job),
+		kick:    make(chan bool, 1),
+		running: make(chan bool, 1),
+	}
+}
+
+// add registers a job to run every interval, with the first run after delay.
+// an interval of zero means the job only runs when triggered.
+// adding an existing job updates its interval and function
+func (this *jobScheduler) add(name string, interval, delay time.Duration, run jobFunc) {
+	this.Lock()
+	defer this.Unlock()
+	j := this.jobs[name]
+	if j == nil {
+		j = &job{Name: name, State: "idle"}
+		if interval > 0 {
+			next := time.Now().Add(delay)
+			j.NextRun = &next
+		}
+		this.jobs[name] = j
+	}
+	if j.interval != interval {
+		j.interval = interval
+		j.Interval = ""
+		if interval > 0 {
+			j.Interval = interval.String()
+			if j.NextRun == nil || j.NextRun.After(time.Now().Add(interval)) {
+				next := time.Now().Add(interval)
+				j.NextRun = &next
+			}
+		}
+	}
+	j.run = run
+}
+
+func (this *jobScheduler) remove(name string) {
+	this.Lock()
+	delete(this.jobs, name)
+	this.Unlock()
+}
+
+// trigger makes a job run as soon as possible
+func (this *jobScheduler) trigger(name string) (job, error) {
+	this.Lock()
+	j := this.jobs[name]
+	if j == nil {
+		this.Unlock()
+		return job{}, errNoSuchJob
+	}
+	now := time.Now()
+	j.NextRun = &now
+	if j.State == "running" {
+		j.again = true
+	} else {
+		j.State = "queued"
+	}
+	result := *j
+	this.Unlock()
+
+	select {
+	case this.kick <- true:
+	default:
+	}
+	return result, nil
+}
+
+func (this *jobScheduler) get(name string) (job, bool) {
+	this.RLock()
+	defer this.RUnlock()
+	j := this.jobs[name]
+	if j == nil {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// status returns a copy of all jobs, sorted by name
+func (this *jobScheduler) status() []job {
+	this.RLock()
+	result := make([]job, 0, len(this.jobs))
+	for _, j := range this.jobs {
+		result = append(result, *j)
+	}
+	this.RUnlock()
+	sort.Slice(result, func(a, b int) bool { return result[a].Name < result[b].Name })
+	return result
+}
+
+// start runs the jobs as they become due. before every round, setup is
+// called so that the caller can add or remove jobs (e.g. as shares change)
+func (this *jobScheduler) start(setup func()) {
+	ticker := time.NewTicker(JOB_TICK)
+	defer ticker.Stop()
+	for {
+		if setup != nil {
+			setup()
+		}
+		this.run_due()
+		select {
+		case <-ticker.C:
+		case <-this.kick:
+		}
+	}
+}
+
+func (this *jobScheduler) run_due() {
+	now := time.Now()
+	this.Lock()
+	due := []*job{}
+	for _, j := range this.jobs {
+		if j.State != "running" && j.NextRun != nil && !j.NextRun.After(now) {
+			j.State = "queued"
+			due = append(due, j)
+		}
+	}
+	this.Unlock()
+	sort.Slice(due, func(a, b int) bool { return due[a].NextRun.Before(*due[b].NextRun) })
+
+	for _, j := range due {
+		this.run(j)
+	}
+}
+
+func (this *jobScheduler) run(j *job) {
+	this.running <- true
+	defer func() { <-this.running }()
+
+	this.Lock()
+	run := j.run
+	start := time.Now()
+	j.State = "running"
+	j.Done, j.Total = 0, 0
+	this.Unlock()
+
+	debug(3, "Job %s starting", j.Name)
+	progress := func(done, total int64) {
+		this.Lock()
+		j.Done, j.Total = done, total
+		this.Unlock()
+	}
+	result, err := run(progress)
+
+	this.Lock()
+	j.State = "idle"
+	j.LastRun = &start
+	j.Duration = time.Since(start).String()
+	j.Result = result
+	j.Error = ""
+	if err != nil {
+		j.Error = err.Error()
+	}
+	j.NextRun = nil
+	if j.interval > 0 {
+		next := start.Add(j.interval)
+		j.NextRun = &next
+	}
+	if j.again {
+		j.again = false
+		now := time.Now()
+		j.NextRun = &now
+		select {
+		case this.kick <- true:
+		default:
+		}
+	}
+	this.Unlock()
+	debug(3, "Job %s finished in %s: %s", j.Name, j.Duration, result)
+}
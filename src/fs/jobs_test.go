@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobScheduler(t *testing.T) {
+	s := new_job_scheduler()
+	runs := 0
+	s.add("test", time.Hour, time.Hour, func(progress func(done, total int64)) (string, error) {
+		runs++
+		progress(1, 1)
+		return "done", nil
+	})
+	s.add("failing", 0, 0, func(progress func(done, total int64)) (string, error) {
+		return "", errors.New("broken")
+	})
+
+	s.run_due()
+	if runs != 0 {
+		t.Fatalf("Job ran before it was due")
+	}
+
+	if _, err := s.trigger("missing"); err != errNoSuchJob {
+		t.Errorf("Expected errNoSuchJob, got %v", err)
+	}
+	s.trigger("test")
+	s.trigger("failing")
+	s.run_due()
+	if runs != 1 {
+		t.Fatalf("Triggered job ran %d times", runs)
+	}
+
+	j, _ := s.get("test")
+	if j.State != "idle" || j.Result != "done" || j.LastRun == nil || j.Done != 1 {
+		t.Errorf("Unexpected job status: %#v", j)
+	}
+	if j.NextRun == nil || j.NextRun.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("Job not rescheduled an interval later: %v", j.NextRun)
+	}
+
+	j, _ = s.get("failing")
+	if j.Error != "broken" || j.NextRun != nil {
+		t.Errorf("Unexpected failing job status: %#v", j)
+	}
+}
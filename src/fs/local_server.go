@@ -11,6 +11,7 @@ package main
 
 import (
 	"net"
+	"net/http/pprof"
 	"github.com/amahi/go-metadata"
 )
 
@@ -23,17 +24,52 @@ func start_local_server(root_dir string, metadata *metadata.Library) {
 		return
 	}
 	service.metadata = metadata
+	service.debug_info.server = "local"
+	// only on the local network
+	service.api_router.HandleFunc("/metrics", service.serve_metrics).Methods("GET")
+	service.api_router.HandleFunc("/relay/rotate", service.rotate_relay).Methods("POST")
+	service.api_router.HandleFunc("/logging", service.logging_status).Methods("GET")
+	service.api_router.HandleFunc("/logging", service.logging_change).Methods("PUT")
+	service.api_router.HandleFunc("/guest/passes", service.guest_pass_list).Methods("GET")
+	service.api_router.HandleFunc("/guest/passes", service.guest_pass_issue).Methods("POST")
+	service.api_router.HandleFunc("/guest/passes/{id}", service.guest_pass_revoke).Methods("DELETE")
+	service.api_router.HandleFunc("/network/mounts", service.network_mounts_list).Methods("GET")
+	service.api_router.HandleFunc("/network/mounts", service.network_mounts_add).Methods("POST")
+	service.api_router.HandleFunc("/network/mounts/{name}", service.network_mounts_remove).Methods("DELETE")
+	service.api_router.HandleFunc("/power/pair", service.power_pair).Methods("POST")
+	service.api_router.HandleFunc("/power/pair/{name}", service.power_unpair).Methods("DELETE")
+	service.api_router.HandleFunc("/admin/config", service.admin_config).Methods("GET")
+	service.api_router.HandleFunc("/admin/config", service.admin_config_change).Methods("PATCH")
+	service.api_router.HandleFunc("/admin/limits", service.admin_limits).Methods("GET")
+	service.api_router.HandleFunc("/admin/limits", service.admin_limits_change).Methods("PUT")
+	service.api_router.HandleFunc("/admin/shares", service.share_admin_list).Methods("GET")
+	service.api_router.HandleFunc("/admin/shares", service.share_admin_add).Methods("POST")
+	service.api_router.HandleFunc("/admin/shares/{name}", service.share_admin_change).Methods("PATCH")
+	service.api_router.HandleFunc("/admin/shares/{name}", service.share_admin_remove).Methods("DELETE")
+	service.api_router.HandleFunc("/admin/permissions", service.admin_permissions).Methods("POST")
+	if pprof_enabled {
+		service.api_router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		service.api_router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		service.api_router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		service.api_router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		service.api_router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	}
+	// the local server also speaks gRPC on the same port
+	service.server.Handler = service.with_grpc(service.server.Handler)
+	// clients from outside come through a port mapped on the router
+	service.server.Handler = direct_access(service.server.Handler)
+	service.server.Handler = access_logged(service.server.Handler)
 
 	addr, err := net.ResolveTCPAddr("tcp", ":"+LOCAL_SERVER_PORT)
 	if err != nil {
-		log("Could not resolve local address")
+		log_error("Could not resolve local address")
 		debug(2, "Error resolving local address: %s", err.Error())
 		return
 	}
 
 	listener, err := net.ListenTCP("tcp", addr)
 	if err != nil {
-		log("Local server could not be started")
+		log_error("Local server could not be started")
 		debug(2, "Error on ListenTCP: %s", err.Error())
 		return
 	}
@@ -41,9 +77,14 @@ func start_local_server(root_dir string, metadata *metadata.Library) {
 
 	for {
 		log("Starting local file server")
-		err = service.server.Serve(listener)
+		if local_tls.enabled() {
+			service.server.TLSConfig = local_tls.tls_config()
+			err = service.server.ServeTLS(listener, "", "")
+		} else {
+			err = service.server.Serve(listener)
+		}
 		if err != nil {
-			log("An error occured in the local file server")
+			log_error("An error occured in the local file server")
 			debug(2, "local file server: %s", err.Error())
 		}
 	}
@@ -0,0 +1,321 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TLS on the local server, with the certificate in the config, or else a
+// self-signed one that is made and rotated here. the fingerprints of the
+// certificate, of the next one once it is made, and of the ones before it
+// are sent to the relay in the HDA info, so that clients can pin them and
+// connect directly on the LAN. the next certificate is made well before it
+// is used, so that clients that only see the info now and then learn it
+// before the switch
+
+const LOCAL_TLS_DIR = DATA_DIR + "/local_tls"
+const LOCAL_TLS_JOB = "local-tls-rotation"
+const LOCAL_TLS_VALIDITY = 397 * 24 * time.Hour
+
+// the next certificate is made this long before the current one expires,
+// and used from LOCAL_TLS_RENEW before it expires
+const LOCAL_TLS_ANNOUNCE = 60 * 24 * time.Hour
+const LOCAL_TLS_RENEW = 30 * 24 * time.Hour
+
+// how many certificates are kept in the history
+const LOCAL_TLS_HISTORY = 10
+
+var errNoLocalTLS = errors.New("local TLS is not enabled")
+
+type tlsFingerprint struct {
+	SHA256    string     `json:"sha256"`
+	SPKI      string     `json:"spki_sha256"`
+	NotBefore time.Time  `json:"not_before"`
+	NotAfter  time.Time  `json:"not_after"`
+	Retired   *time.Time `json:"retired,omitempty"`
+}
+
+type localTLS struct {
+	dir string
+	// the certificate in the config, if any, which is not rotated here
+	cert_file, key_file string
+	current, next       *tls.Certificate
+	history             []tlsFingerprint
+	now                 func() time.Time
+	sync.Mutex
+}
+
+var local_tls = new_local_tls(LOCAL_TLS_DIR)
+
+func new_local_tls(dir string) *localTLS {
+	return &localTLS{dir: dir, now: time.Now}
+}
+
+// fingerprint of a certificate, as clients pin it
+func fingerprint(cert *tls.Certificate) tlsFingerprint {
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	sum := sha256.Sum256(cert.Certificate[0])
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	return tlsFingerprint{
+		SHA256:    hex.EncodeToString(sum[:]),
+		SPKI:      base64.StdEncoding.EncodeToString(spki[:]),
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}
+}
+
+// local_names are the names and addresses the certificate is for
+func local_names() ([]string, []net.IP) {
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+	ips := []net.IP{}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return names, ips
+}
+
+// self_signed makes a certificate valid from now, as PEM
+func self_signed(now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	names, ips := local_names()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Amahi Anywhere", Organization: []string{"Amahi"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(LOCAL_TLS_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), nil
+}
+
+// make_cert makes a certificate and keeps it as name in the directory
+func (this *localTLS) make_cert(name string) (*tls.Certificate, error) {
+	cert_pem, key_pem, err := self_signed(this.now())
+	if err != nil {
+		return nil, err
+	}
+	if err := write_file_atomic(filepath.Join(this.dir, name+".key"), key_pem, 0600); err != nil {
+		return nil, err
+	}
+	if err := write_file_atomic(filepath.Join(this.dir, name+".pem"), cert_pem, 0644); err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(cert_pem, key_pem)
+	return &cert, err
+}
+
+// load_cert reads the certificate kept as name, nil if there is none
+func (this *localTLS) load_cert(name string) *tls.Certificate {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(this.dir, name+".pem"), filepath.Join(this.dir, name+".key"))
+	if err != nil {
+		return nil
+	}
+	return &cert
+}
+
+// save keeps the history, with the lock held
+func (this *localTLS) save() error {
+	data, err := json.MarshalIndent(this.history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return write_file_atomic(filepath.Join(this.dir, "history.json"), data, 0644)
+}
+
+// record adds a certificate to the history, retiring the one in use, with
+// the lock held
+func (this *localTLS) record(cert *tls.Certificate) {
+	fp := fingerprint(cert)
+	for i := range this.history {
+		if this.history[i].SHA256 == fp.SHA256 {
+			return
+		}
+	}
+	now := this.now()
+	for i := range this.history {
+		if this.history[i].Retired == nil {
+			this.history[i].Retired = &now
+		}
+	}
+	this.history = append(this.history, fp)
+	if len(this.history) > LOCAL_TLS_HISTORY {
+		this.history = this.history[len(this.history)-LOCAL_TLS_HISTORY:]
+	}
+}
+
+// enable starts TLS with the certificate in cert_file and key_file, or with
+// a self-signed one if they are ""
+func (this *localTLS) enable(cert_file, key_file string) error {
+	this.Lock()
+	defer this.Unlock()
+	if err := os.MkdirAll(this.dir, 0700); err != nil {
+		return err
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(this.dir, "history.json")); err == nil {
+		json.Unmarshal(data, &this.history)
+	}
+	this.cert_file, this.key_file = cert_file, key_file
+	if cert_file != "" {
+		cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+		if err != nil {
+			return err
+		}
+		this.current = &cert
+	} else {
+		this.current = this.load_cert("cert")
+		this.next = this.load_cert("next")
+		if this.current == nil {
+			cert, err := this.make_cert("cert")
+			if err != nil {
+				return err
+			}
+			this.current = cert
+		}
+	}
+	this.record(this.current)
+	return this.save()
+}
+
+func (this *localTLS) enabled() bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.current != nil
+}
+
+// rotate makes the next certificate when the current one is about to
+// expire, and switches to it later. a certificate from the config is read
+// again instead, in case it was renewed
+func (this *localTLS) rotate() (string, error) {
+	this.Lock()
+	defer this.Unlock()
+	if this.current == nil {
+		return "", errNoLocalTLS
+	}
+	before := fingerprint(this.current).SHA256
+	if this.cert_file != "" {
+		cert, err := tls.LoadX509KeyPair(this.cert_file, this.key_file)
+		if err != nil {
+			return "", err
+		}
+		this.current = &cert
+	} else {
+		left := fingerprint(this.current).NotAfter.Sub(this.now())
+		if left < LOCAL_TLS_ANNOUNCE && this.next == nil {
+			next, err := this.make_cert("next")
+			if err != nil {
+				return "", err
+			}
+			this.next = next
+		}
+		if left < LOCAL_TLS_RENEW && this.next != nil {
+			if err := os.Rename(filepath.Join(this.dir, "next.key"), filepath.Join(this.dir, "cert.key")); err != nil {
+				return "", err
+			}
+			if err := os.Rename(filepath.Join(this.dir, "next.pem"), filepath.Join(this.dir, "cert.pem")); err != nil {
+				return "", err
+			}
+			this.current, this.next = this.next, nil
+		}
+	}
+	this.record(this.current)
+	if err := this.save(); err != nil {
+		return "", err
+	}
+	fp := fingerprint(this.current)
+	if fp.SHA256 != before {
+		log("Local TLS certificate is now %s", fp.SHA256)
+	}
+	return fmt.Sprintf("certificate %s, expires %s", fp.SHA256[:16], fp.NotAfter.Format("2006-01-02")), nil
+}
+
+// job keeps the certificate current
+func (this *localTLS) job() jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		return this.rotate()
+	}
+}
+
+// info is what clients pin, nil if TLS is not enabled
+func (this *localTLS) info() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	if this.current == nil {
+		return nil
+	}
+	info := map[string]interface{}{
+		"current": fingerprint(this.current),
+		"history": append([]tlsFingerprint{}, this.history...),
+	}
+	if this.next != nil {
+		info["next"] = fingerprint(this.next)
+	}
+	return info
+}
+
+// tls_config serves the current certificate, so it can change without a
+// restart
+func (this *localTLS) tls_config() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			this.Lock()
+			defer this.Unlock()
+			if this.current == nil {
+				return nil, errNoLocalTLS
+			}
+			return this.current, nil
+		},
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalTLSRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "local_tls")
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	certs := new_local_tls(filepath.Join(dir, "local_tls"))
+	certs.now = func() time.Time { return now }
+	if certs.enabled() {
+		t.Fatalf("TLS is enabled before it is")
+	}
+	if err := certs.enable("", ""); err != nil {
+		t.Fatalf("Error enabling TLS: %v", err)
+	}
+	first := fingerprint(certs.current)
+
+	// the fingerprint is the one of the certificate served
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", certs.tls_config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(conn.ConnectionState().PeerCertificates[0].Raw)
+	conn.Close()
+	if hex.EncodeToString(sum[:]) != first.SHA256 {
+		t.Errorf("The fingerprint is not the one served")
+	}
+
+	// nothing changes until the certificate is about to expire
+	certs.rotate()
+	if certs.next != nil || len(certs.history) != 1 {
+		t.Fatalf("Rotated too early: %+v", certs.info())
+	}
+	now = first.NotAfter.Add(-LOCAL_TLS_ANNOUNCE + time.Hour)
+	certs.rotate()
+	info := certs.info()
+	next, ok := info["next"].(tlsFingerprint)
+	if !ok || info["current"].(tlsFingerprint).SHA256 != first.SHA256 || next.SHA256 == first.SHA256 {
+		t.Fatalf("The next certificate was not announced: %+v", info)
+	}
+	now = first.NotAfter.Add(-LOCAL_TLS_RENEW + time.Hour)
+	certs.rotate()
+	history := certs.info()["history"].([]tlsFingerprint)
+	if fingerprint(certs.current).SHA256 != next.SHA256 || certs.next != nil || len(history) != 2 ||
+		history[0].Retired == nil || history[1].Retired != nil {
+		t.Fatalf("Wrong rotation: %+v", certs.info())
+	}
+
+	// the certificates and their history are kept
+	certs = new_local_tls(certs.dir)
+	if err := certs.enable("", ""); err != nil || fingerprint(certs.current).SHA256 != next.SHA256 || len(certs.history) != 2 {
+		t.Errorf("The certificate was not kept: %v %+v", err, certs.info())
+	}
+	if fi, err := os.Stat(filepath.Join(certs.dir, "cert.key")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("The key is not private: %v", err)
+	}
+}
+
+func TestHdaInfoLocalTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "local_tls")
+	defer os.RemoveAll(dir)
+	saved := local_tls
+	defer func() { local_tls = saved }()
+	local_tls = new_local_tls(dir)
+	info := &HdaInfo{version: "1.0", local_addr: "192.168.1.10:4563"}
+	parsed := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(info.to_json()), &parsed); err != nil || parsed["local_tls"] != nil {
+		t.Fatalf("Wrong info without TLS: %v %s", err, info.to_json())
+	}
+	local_tls.enable("", "")
+	var pinned struct {
+		LocalTLS struct {
+			Current tlsFingerprint
+			History []tlsFingerprint
+		} `json:"local_tls"`
+	}
+	if err := json.Unmarshal([]byte(info.to_json()), &pinned); err != nil || pinned.LocalTLS.Current.SHA256 == "" ||
+		len(pinned.LocalTLS.History) != 1 || pinned.LocalTLS.Current.SPKI == "" {
+		t.Errorf("Wrong info with TLS: %v %s", err, info.to_json())
+	}
+}
@@ -10,40 +10,380 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	logging "log"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// every line of the log has a level, error, warn, info or debug, the scope
+// it comes from, the name of the file of the code that logs it, like
+// "relay_pool", and the id of the request it is about, if any. the lines
+// are text, as they always were, or JSON or logfmt, as set in the logging
+// section of the config. the level is set for all the scopes and for some,
+// a scope like "relay" being all of "relay_..." too, and can be changed
+// while running with PUT /logging on the local server. debug lines are
+// also filtered by the verbosity of -d. the log file is rotated when it
+// gets to max_size MB or max_age, keeping the last ones as LOGFILE.1, ...
+
 const LOGFILE = "/var/log/amahi-anywhere.log"
 
-var current_debug_level = 3
+const (
+	LOG_ERROR = iota
+	LOG_WARN
+	LOG_INFO
+	LOG_DEBUG
+)
+
+var log_level_names = []string{"error", "warn", "info", "debug"}
+
+const (
+	LOG_FORMAT_TEXT   = "text"
+	LOG_FORMAT_JSON   = "json"
+	LOG_FORMAT_LOGFMT = "logfmt"
+)
+
+// request lines have their id after the path, see pathForLog
+var log_request_id = regexp.MustCompile(`^"[A-Z]+ [^"# ]*#([^" ]+)"`)
 
-var logger *logging.Logger
+type leveledLogger struct {
+	out    io.Writer
+	format string
+	level  int
+	scopes map[string]int
+	// the most verbose of level and scopes
+	max int
+	// of the debug lines, from 1 to 5
+	verbosity int
+	sync.Mutex
+}
+
+// standard output until initialize_logging opens the log file
+var logger = new_leveled_logger(os.Stdout)
+
+func new_leveled_logger(out io.Writer) *leveledLogger {
+	level := LOG_INFO
+	if !PRODUCTION {
+		level = LOG_DEBUG
+	}
+	return &leveledLogger{out: out, format: LOG_FORMAT_TEXT, level: level, max: level, verbosity: 3, scopes: make(map[string]int)}
+}
+
+func parse_log_level(name string) (int, bool) {
+	for level, known := range log_level_names {
+		if strings.EqualFold(name, known) {
+			return level, true
+		}
+	}
+	return 0, false
+}
 
 func initialize_logging() {
-	log_file, err := os.OpenFile(LOGFILE, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	c := config.Logging
+	file := c.File
+	if file == "" {
+		file = LOGFILE
+	}
+	max_age, _ := time.ParseDuration(c.MaxAge)
+	var out io.Writer
+	out, err := open_rotating_file(file, c.MaxSize<<20, max_age, c.Keep)
 	if err != nil {
-		fmt.Println("WARNING: failed to open ", LOGFILE, " defaulting to standard output")
-		log_file = os.Stdout
+		fmt.Println("WARNING: failed to open ", file, " defaulting to standard output")
+		out = os.Stdout
+	}
+	logger.Lock()
+	logger.out = out
+	logger.Unlock()
+	if err := logger.configure(c.Format, c.Level, c.Scopes); err != nil {
+		log_warn("Invalid logging settings, using the defaults: %s", err.Error())
+	}
+}
+
+// configure sets the format, "" to leave it, the level, "" for the
+// default, and the levels of scopes
+func (this *leveledLogger) configure(format, level string, scopes map[string]string) error {
+	if format != "" && format != LOG_FORMAT_TEXT && format != LOG_FORMAT_JSON && format != LOG_FORMAT_LOGFMT {
+		return fmt.Errorf("no such log format: %s", format)
+	}
+	parsed := new_leveled_logger(nil).level
+	if level != "" {
+		var ok bool
+		if parsed, ok = parse_log_level(level); !ok {
+			return fmt.Errorf("no such log level: %s", level)
+		}
+	}
+	levels := make(map[string]int)
+	for scope, name := range scopes {
+		scope_level, ok := parse_log_level(name)
+		if !ok {
+			return fmt.Errorf("no such log level: %s", name)
+		}
+		levels[scope] = scope_level
 	}
+	this.Lock()
+	defer this.Unlock()
+	if format != "" {
+		this.format = format
+	}
+	this.level, this.scopes = parsed, levels
+	this.update_max()
+	return nil
+}
+
+// set_level sets the level of scope, or of all of them with scope "".
+// level "" is the one of all for scope
+func (this *leveledLogger) set_level(scope, level string) error {
+	parsed, ok := parse_log_level(level)
+	if !ok && (level != "" || scope == "") {
+		return fmt.Errorf("no such log level: %s", level)
+	}
+	this.Lock()
+	defer this.Unlock()
+	switch {
+	case scope == "":
+		this.level = parsed
+	case level == "":
+		delete(this.scopes, scope)
+	default:
+		this.scopes[scope] = parsed
+	}
+	this.update_max()
+	return nil
+}
+
+// update_max is with the lock held
+func (this *leveledLogger) update_max() {
+	this.max = this.level
+	for _, level := range this.scopes {
+		if level > this.max {
+			this.max = level
+		}
+	}
+}
+
+// scope_level is the level of scope, from the longest scope set it is in,
+// with the lock held
+func (this *leveledLogger) scope_level(scope string) int {
+	level, longest := this.level, -1
+	for name, scope_level := range this.scopes {
+		if (scope == name || strings.HasPrefix(scope, name+"_")) && len(name) > longest {
+			level, longest = scope_level, len(name)
+		}
+	}
+	return level
+}
+
+// log_scope is the name of the file of the code calling the logging
+// function that called it
+func log_scope() string {
+	_, file, _, ok := runtime.Caller(3)
+	if !ok {
+		return ""
+	}
+	return strings.TrimSuffix(filepath.Base(file), ".go")
+}
+
+// write logs a line at level, debug ones when at most the verbosity
+func (this *leveledLogger) write(level, verbosity int, f string, args ...interface{}) {
+	this.Lock()
+	skip := level > this.max || verbosity > this.verbosity
+	this.Unlock()
+	if skip {
+		return
+	}
+	scope := log_scope()
+	this.Lock()
+	defer this.Unlock()
+	if level > this.scope_level(scope) {
+		return
+	}
+	this.out.Write(this.line(time.Now(), level, scope, fmt.Sprintf(f, args...)))
+}
 
-	logger = logging.New(log_file, "", logging.LstdFlags)
+type logLine struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Scope     string `json:"scope"`
+	Message   string `json:"msg"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// line is a line of the log in the format, with the lock held
+func (this *leveledLogger) line(now time.Time, level int, scope, message string) []byte {
+	if this.format == LOG_FORMAT_TEXT {
+		if level == LOG_WARN {
+			message = "WARNING: " + message
+		}
+		return []byte(now.Format("2006/01/02 15:04:05 ") + strings.TrimSuffix(message, "\n") + "\n")
+	}
+	line := logLine{Time: now.Format(time.RFC3339Nano), Level: log_level_names[level], Scope: scope, Message: message}
+	if match := log_request_id.FindStringSubmatch(message); match != nil {
+		line.RequestID, _ = url.QueryUnescape(match[1])
+	}
+	if this.format == LOG_FORMAT_JSON {
+		data, _ := json.Marshal(line)
+		return append(data, '\n')
+	}
+	fields := []string{"time=" + line.Time, "level=" + line.Level, "scope=" + logfmt_value(scope), "msg=" + logfmt_value(message)}
+	if line.RequestID != "" {
+		fields = append(fields, "request_id="+logfmt_value(line.RequestID))
+	}
+	return []byte(strings.Join(fields, " ") + "\n")
+}
+
+func logfmt_value(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\\n\t") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func (this *leveledLogger) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	scopes := make(map[string]string)
+	for scope, level := range this.scopes {
+		scopes[scope] = log_level_names[level]
+	}
+	return map[string]interface{}{
+		"format":    this.format,
+		"level":     log_level_names[this.level],
+		"scopes":    scopes,
+		"verbosity": this.verbosity,
+	}
 }
 
 func log(f string, args ...interface{}) {
-	logger.Printf(f, args...)
+	logger.write(LOG_INFO, 0, f, args...)
+}
+
+func log_warn(f string, args ...interface{}) {
+	logger.write(LOG_WARN, 0, f, args...)
+}
+
+func log_error(f string, args ...interface{}) {
+	logger.write(LOG_ERROR, 0, f, args...)
 }
 
 func debug_level(level int) {
-	current_debug_level = level
+	logger.Lock()
+	logger.verbosity = level
+	logger.Unlock()
 }
 
 func debug(level int, f string, args ...interface{}) {
-	if PRODUCTION {
-		return
+	logger.write(LOG_DEBUG, level, f, args...)
+}
+
+// rotatingFile is a log file that is moved to path.1 once it gets to
+// max_size bytes or max_age, 0 for no limit, and path.1 to path.2, up to
+// keep of them
+type rotatingFile struct {
+	path     string
+	max_size int64
+	max_age  time.Duration
+	keep     int
+	file     *os.File
+	size     int64
+	opened   time.Time
+	sync.Mutex
+}
+
+func open_rotating_file(path string, max_size int64, max_age time.Duration, keep int) (*rotatingFile, error) {
+	this := &rotatingFile{path: path, max_size: max_size, max_age: max_age, keep: keep}
+	if err := this.open(); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *rotatingFile) open() error {
+	file, err := os.OpenFile(this.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	this.file, this.size, this.opened = file, fi.Size(), time.Now()
+	return nil
+}
+
+// rotate moves the file out of the way and opens a new one, with the lock
+// held
+func (this *rotatingFile) rotate() error {
+	this.file.Close()
+	if this.keep > 0 {
+		for i := this.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", this.path, i), fmt.Sprintf("%s.%d", this.path, i+1))
+		}
+		os.Rename(this.path, this.path+".1")
+	} else {
+		os.Remove(this.path)
 	}
-	if level <= current_debug_level {
-		log(f, args...)
+	return this.open()
+}
+
+func (this *rotatingFile) Write(p []byte) (int, error) {
+	this.Lock()
+	defer this.Unlock()
+	full := this.max_size > 0 && this.size+int64(len(p)) > this.max_size
+	old := this.max_age > 0 && time.Since(this.opened) >= this.max_age
+	if this.size > 0 && (full || old) {
+		if err := this.rotate(); err != nil {
+			// not to lose what is logged
+			return os.Stdout.Write(p)
+		}
+	}
+	n, err := this.file.Write(p)
+	this.size += int64(n)
+	return n, err
+}
+
+// GET /logging is the format and levels of the log
+func (service *MercuryFsService) logging_status(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	size := json_response(writer, http.StatusOK, logger.status())
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
+
+// PUT /logging?level=<level>[&scope=<scope>][&verbosity=<1-5>] changes the
+// level of the log, or of a scope, "" for the one of all
+func (service *MercuryFsService) logging_change(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status, result := http.StatusOK, interface{}(nil)
+	var err error
+	if v := request.FormValue("verbosity"); v != "" {
+		verbosity, verr := strconv.Atoi(v)
+		if verr != nil || verbosity < 1 || verbosity > 5 {
+			err = fmt.Errorf("no such verbosity: %s", v)
+		} else {
+			debug_level(verbosity)
+		}
+	}
+	if _, ok := request.Form["level"]; ok && err == nil {
+		err = logger.set_level(request.FormValue("scope"), request.FormValue("level"))
+	}
+	if err != nil {
+		status, result = http.StatusBadRequest, map[string]string{"error": err.Error()}
+	} else {
+		result = logger.status()
 	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"PUT %s\" %d %d \"%s\"", query, status, size, ua)
 }
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFormats(t *testing.T) {
+	saved := logger
+	defer func() { logger = saved }()
+	var out bytes.Buffer
+	logger = new_leveled_logger(&out)
+	logger.configure(LOG_FORMAT_JSON, "info", nil)
+	log("\"GET %s\" 200 %d \"%s\"", "/files?s=Movies&p=/a%20b.mkv#abc%3A1", 12, "app")
+	var line logLine
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("Not JSON: %s", out.String())
+	}
+	if line.Level != "info" || line.Scope != "logging_test" || line.RequestID != "abc:1" || !strings.HasPrefix(line.Message, "\"GET /files") {
+		t.Errorf("Wrong line: %s", out.String())
+	}
+
+	out.Reset()
+	logger.configure(LOG_FORMAT_LOGFMT, "info", nil)
+	log_warn("share %s is unavailable", "Movies")
+	if got := out.String(); !strings.Contains(got, " level=warn scope=logging_test msg=\"share Movies is unavailable\"\n") {
+		t.Errorf("Wrong logfmt line: %s", got)
+	}
+
+	// text is as it always was
+	out.Reset()
+	logger.configure(LOG_FORMAT_TEXT, "info", nil)
+	log_warn("out of file watches")
+	log("Starting local file server")
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], " WARNING: out of file watches") || !strings.HasSuffix(lines[1], " Starting local file server") {
+		t.Errorf("Wrong text lines: %q", out.String())
+	}
+	if _, err := time.Parse("2006/01/02 15:04:05", lines[1][:19]); err != nil {
+		t.Errorf("Wrong time: %s", lines[1])
+	}
+	if logger.configure("xml", "", nil) == nil || logger.configure("", "loud", nil) == nil {
+		t.Errorf("Took wrong settings")
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	saved := logger
+	defer func() { logger = saved }()
+	var out bytes.Buffer
+	logger = new_leveled_logger(&out)
+	logger.configure(LOG_FORMAT_LOGFMT, "warn", map[string]string{"relay": "error"})
+	debug_level(2)
+	log("not at warn")
+	if out.Len() != 0 {
+		t.Errorf("Logged below the level: %s", out.String())
+	}
+	// logging_test is in the logging scope
+	logger.set_level("logging", "debug")
+	debug(2, "verbose enough")
+	debug(3, "too verbose")
+	if got := out.String(); !strings.Contains(got, "msg=\"verbose enough\"") || strings.Contains(got, "too verbose") {
+		t.Errorf("Wrong debug lines: %s", got)
+	}
+	out.Reset()
+	logger.set_level("logging_test", "error")
+	log_warn("not an error")
+	log_error("an error")
+	if got := out.String(); strings.Contains(got, "not an error") || !strings.Contains(got, "level=error") {
+		t.Errorf("Wrong scope level: %s", got)
+	}
+	if logger.set_level("", "") == nil || logger.set_level("relay", "loud") == nil {
+		t.Errorf("Took a wrong level")
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logging")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fs.log")
+	file, err := open_rotating_file(path, 100, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		file.Write(bytes.Repeat([]byte{byte('a' + i)}, 60))
+	}
+	for name, want := range map[string]string{"fs.log": "g", "fs.log.1": "f", "fs.log.2": "e", "fs.log.3": ""} {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		if want == "" && data != nil || want != "" && string(data) != strings.Repeat(want, 60) {
+			t.Errorf("Wrong %s: %q", name, data)
+		}
+	}
+
+	// and by age
+	file, _ = open_rotating_file(path, 0, time.Hour, 2)
+	file.opened = time.Now().Add(-2 * time.Hour)
+	file.Write([]byte("new"))
+	if data, _ := ioutil.ReadFile(path); string(data) != "new" {
+		t.Errorf("Not rotated by age: %q", data)
+	}
+}
+
+func TestLoggingEndpoint(t *testing.T) {
+	saved := logger
+	defer func() { logger = saved }()
+	logger = new_leveled_logger(ioutil.Discard)
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/logging", service.logging_status).Methods("GET")
+	router.HandleFunc("/logging", service.logging_change).Methods("PUT")
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+		return recorder
+	}
+
+	if response := serve("PUT", "/logging?scope=relay&level=debug&verbosity=5"); response.Code != 200 {
+		t.Errorf("Could not change the level: %d %s", response.Code, response.Body.String())
+	}
+	var status struct {
+		Level     string            `json:"level"`
+		Scopes    map[string]string `json:"scopes"`
+		Verbosity int               `json:"verbosity"`
+	}
+	response := serve("GET", "/logging")
+	if json.Unmarshal(response.Body.Bytes(), &status) != nil || status.Scopes["relay"] != "debug" || status.Verbosity != 5 {
+		t.Errorf("Wrong status: %s", response.Body.String())
+	}
+	for _, target := range []string{"/logging?level=loud", "/logging?verbosity=9"} {
+		if response := serve("PUT", target); response.Code != 400 {
+			t.Errorf("Took %s: %d", target, response.Code)
+		}
+	}
+}
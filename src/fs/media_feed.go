@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /feed has the videos, music and photos added to the shares, the
+// newest first, as RSS, so that the family follows what is new on the HDA
+// in any reader, without the app. with s=<share> it has those of a share,
+// with days=<n> those of the last n days (FEED_DAYS by default), and with
+// format=atom or format=ics it is Atom, or iCal with an event on the day
+// each one was added, for a calendar. the files come from the index of the
+// shares, and the shares not indexed yet are left out. a reader with a
+// guest pass, as ?guest=<token>, has the shares of its pass
+
+const FEED_DAYS = 30
+const FEED_MAX_ITEMS = 100
+
+type feedItem struct {
+	Share string
+	Path  string
+	Added time.Time
+	Type  string
+}
+
+func is_media_type(mime_type string) bool {
+	return strings.HasPrefix(mime_type, "video/") || strings.HasPrefix(mime_type, "audio/") || strings.HasPrefix(mime_type, "image/")
+}
+
+// feed_items are the media of the shares added after since, the newest
+// first, up to FEED_MAX_ITEMS
+func (service *MercuryFsService) feed_items(shares []*HdaShare, since time.Time, profile *parentalProfile) []feedItem {
+	items := []feedItem{}
+	for _, share := range shares {
+		hidden := profile.hide(share)
+		entries, err := share_index.search(share.name, func(entry *indexEntry) bool {
+			return !entry.IsDir && entry.Added.After(since) && is_media_type(entry.MimeType)
+		})
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if hidden != nil && hidden(path.Base(entry.Path)) {
+				continue
+			}
+			items = append(items, feedItem{Share: share.name, Path: entry.Path, Added: entry.Added, Type: entry.MimeType})
+		}
+	}
+	// the same order every time, for the ETag of the feed
+	sort.Slice(items, func(a, b int) bool {
+		if !items[a].Added.Equal(items[b].Added) {
+			return items[a].Added.After(items[b].Added)
+		}
+		return items[a].Share+"\x00"+items[a].Path < items[b].Share+"\x00"+items[b].Path
+	})
+	if len(items) > FEED_MAX_ITEMS {
+		items = items[:FEED_MAX_ITEMS]
+	}
+	return items
+}
+
+// feed_base is the URL of the server, as the request reached it
+func feed_base(request *http.Request) string {
+	scheme := "http"
+	if request.TLS != nil || request.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + request.Host
+}
+
+func (this *feedItem) link(base string) string {
+	return base + "/files?" + url.Values{"s": {this.Share}, "p": {this.Path}}.Encode()
+}
+
+func (this *feedItem) id() string {
+	return sha1string(this.Share + "\x00" + this.Path + "\x00" + strconv.FormatInt(this.Added.UnixNano(), 10))
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title    string `xml:"title"`
+	Link     string `xml:"link"`
+	GUID     string `xml:"guid"`
+	PubDate  string `xml:"pubDate"`
+	Category string `xml:"category"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title    string       `xml:"title"`
+	ID       string       `xml:"id"`
+	Updated  string       `xml:"updated"`
+	Link     atomLink     `xml:"link"`
+	Category atomCategory `xml:"category"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func feed_rss(items []feedItem, title, base string) []byte {
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{Title: title, Link: base, Description: "What is new on the HDA"}}
+	for i := range items {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{Title: path.Base(items[i].Path), Link: items[i].link(base),
+			GUID: items[i].id(), PubDate: items[i].Added.UTC().Format(time.RFC1123Z), Category: items[i].Share})
+	}
+	data, _ := xml.MarshalIndent(feed, "", "  ")
+	return append([]byte(xml.Header), data...)
+}
+
+func feed_atom(items []feedItem, title, base string) []byte {
+	feed := atomFeed{Title: title, ID: base + "/feed", Updated: time.Unix(0, 0).UTC().Format(time.RFC3339)}
+	if len(items) > 0 {
+		feed.Updated = items[0].Added.UTC().Format(time.RFC3339)
+	}
+	for i := range items {
+		feed.Entries = append(feed.Entries, atomEntry{Title: path.Base(items[i].Path), ID: "urn:sha1:" + items[i].id(),
+			Updated: items[i].Added.UTC().Format(time.RFC3339), Link: atomLink{Href: items[i].link(base), Type: items[i].Type},
+			Category: atomCategory{Term: items[i].Share}})
+	}
+	data, _ := xml.MarshalIndent(feed, "", "  ")
+	return append([]byte(xml.Header), data...)
+}
+
+// ics_text is text escaped for iCal
+func ics_text(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(text)
+}
+
+func feed_ics(items []feedItem, title, base string) []byte {
+	var buf bytes.Buffer
+	line := func(format string, args ...interface{}) { fmt.Fprintf(&buf, format+"\r\n", args...) }
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//Amahi//Amahi Anywhere %s//EN", VERSION)
+	line("X-WR-CALNAME:%s", ics_text(title))
+	for i := range items {
+		added := items[i].Added.UTC()
+		line("BEGIN:VEVENT")
+		line("UID:%s@amahi", items[i].id())
+		line("DTSTAMP:%s", added.Format("20060102T150405Z"))
+		line("DTSTART;VALUE=DATE:%s", added.Format("20060102"))
+		line("SUMMARY:%s", ics_text(path.Base(items[i].Path)))
+		line("DESCRIPTION:%s", ics_text(items[i].Share+items[i].Path))
+		line("URL:%s", items[i].link(base))
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return buf.Bytes()
+}
+
+// feed_shares are the shares of a feed, nil for an unknown share
+func (service *MercuryFsService) feed_shares(request *http.Request, name string) []*HdaShare {
+	pass := guest_pass_of(request)
+	service.Shares.RLock()
+	defer service.Shares.RUnlock()
+	shares := []*HdaShare{}
+	for _, share := range service.Shares.Shares {
+		if name != "" && share.name != name || is_homes_share(share.name) || pass != nil && !pass.allows(share.name) {
+			continue
+		}
+		shares = append(shares, share)
+	}
+	if name != "" && len(shares) == 0 {
+		return nil
+	}
+	return shares
+}
+
+func (service *MercuryFsService) serve_feed(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	name := q.Get("s")
+	days := FEED_DAYS
+	if d, err := strconv.Atoi(q.Get("days")); err == nil && d > 0 {
+		days = d
+	}
+	shares := service.feed_shares(request, name)
+	if shares == nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(0)
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	items := service.feed_items(shares, time.Now().AddDate(0, 0, -days), parental_profile_of(request))
+	title := "New on the HDA"
+	if name != "" {
+		title = "New in " + name
+	}
+	base := feed_base(request)
+	var data []byte
+	content_type := "application/rss+xml; charset=utf-8"
+	switch q.Get("format") {
+	case "atom":
+		data, content_type = feed_atom(items, title, base), "application/atom+xml; charset=utf-8"
+	case "ics":
+		data, content_type = feed_ics(items, title, base), "text/calendar; charset=utf-8"
+	default:
+		data = feed_rss(items, title, base)
+	}
+	etag := etag_cache.bytes_etag("feed:"+request.URL.RequestURI(), data)
+	writer.Header().Set("ETag", etag)
+	if request.Header.Get("If-None-Match") == etag {
+		writer.WriteHeader(http.StatusNotModified)
+		service.debug_info.requestServed(0)
+		log("\"GET %s\" 304 0 \"%s\"", query, ua)
+		return
+	}
+	writer.Header().Set("Content-Type", content_type)
+	writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	writer.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(data)
+	service.debug_info.requestServed(int64(len(data)))
+	log("\"GET %s\" 200 %d \"%s\"", query, len(data), ua)
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMediaFeed(t *testing.T) {
+	saved_config, saved_index := config, share_index
+	defer func() { config, share_index = saved_config, saved_index }()
+	config = default_config()
+	share_index = new_hda_index()
+	dir, _ := ioutil.TempDir("", "feed")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "Movies"), 0755)
+	os.MkdirAll(filepath.Join(dir, "Docs"), 0755)
+	for _, name := range []string{"Movies/Up, 2009.mkv", "Movies/song.mp3", "Movies/cover.jpg", "Movies/notes.txt", "Docs/scan.jpg"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+	shares := &HdaShares{Shares: []*HdaShare{{name: "Movies", path: filepath.Join(dir, "Movies")}, {name: "Docs", path: filepath.Join(dir, "Docs")}}}
+	for _, share := range shares.Shares {
+		share_index.scan(share.name, share.path, nil, nil, nil)
+	}
+	service := &MercuryFsService{Shares: shares, debug_info: new(debugInfo)}
+	serve := func(target string, pass *guestPass, headers ...string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", target, nil)
+		if pass != nil {
+			request = request.WithContext(context.WithValue(request.Context(), guestPassKey{}, pass))
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			request.Header.Set(headers[i], headers[i+1])
+		}
+		service.serve_feed(recorder, request)
+		return recorder
+	}
+
+	rss := serve("/feed", nil)
+	var feed rssFeed
+	if err := xml.Unmarshal(rss.Body.Bytes(), &feed); err != nil || rss.Code != 200 {
+		t.Fatalf("Wrong feed: %d %v %s", rss.Code, err, rss.Body.String())
+	}
+	if len(feed.Channel.Items) != 4 || !strings.HasPrefix(rss.Header().Get("Content-Type"), "application/rss+xml") {
+		t.Errorf("Wrong items: %+v", feed.Channel.Items)
+	}
+	for _, item := range feed.Channel.Items {
+		if item.Title == "notes.txt" || !strings.HasPrefix(item.Link, "http://example.com/files?") {
+			t.Errorf("Wrong item: %+v", item)
+		}
+	}
+	if again := serve("/feed", nil, "If-None-Match", rss.Header().Get("ETag")); again.Code != 304 {
+		t.Errorf("Sent again: %d", again.Code)
+	}
+
+	// of a share, and of the shares of a guest pass
+	feed = rssFeed{}
+	xml.Unmarshal(serve("/feed?s=Docs", nil).Body.Bytes(), &feed)
+	if len(feed.Channel.Items) != 1 || feed.Channel.Items[0].Category != "Docs" || feed.Channel.Title != "New in Docs" {
+		t.Errorf("Wrong items of Docs: %+v", feed.Channel)
+	}
+	feed = rssFeed{}
+	xml.Unmarshal(serve("/feed", &guestPass{ID: "g", Shares: []string{"Movies"}}).Body.Bytes(), &feed)
+	if len(feed.Channel.Items) != 3 {
+		t.Errorf("Wrong items of the guest: %+v", feed.Channel.Items)
+	}
+
+	var atom atomFeed
+	xml.Unmarshal(serve("/feed?s=Movies&format=atom", nil).Body.Bytes(), &atom)
+	if len(atom.Entries) != 3 || atom.Entries[0].Link.Href == "" {
+		t.Errorf("Wrong Atom feed: %+v", atom)
+	}
+	ics := serve("/feed?s=Movies&format=ics", nil).Body.String()
+	if strings.Count(ics, "BEGIN:VEVENT") != 3 || !strings.Contains(ics, `SUMMARY:Up\, 2009.mkv`) || !strings.HasSuffix(ics, "END:VCALENDAR\r\n") {
+		t.Errorf("Wrong calendar: %s", ics)
+	}
+	if missing := serve("/feed?s=Nope", nil); missing.Code != 404 {
+		t.Errorf("Feed of an unknown share: %d", missing.Code)
+	}
+}
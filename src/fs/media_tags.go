@@ -0,0 +1,762 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/rwcarlsen/goexif/exif"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the tags embedded in media files: ID3 in music, EXIF in photos and the
+// container metadata of MP4 and Matroska videos. they are merged into the
+// metadata of /md, so that there is something to show offline and for the
+// files the online providers do not know about
+
+type mediaTags struct {
+	Format      string     `json:"format"`
+	Title       string     `json:"title,omitempty"`
+	Artist      string     `json:"artist,omitempty"`
+	Album       string     `json:"album,omitempty"`
+	AlbumArtist string     `json:"album_artist,omitempty"`
+	Track       int        `json:"track,omitempty"`
+	Date        string     `json:"date,omitempty"`
+	Genre       string     `json:"genre,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Show        string     `json:"show,omitempty"`
+	Season      int        `json:"season,omitempty"`
+	Episode     int        `json:"episode,omitempty"`
+	Duration    float64    `json:"duration,omitempty"`
+	Make        string     `json:"make,omitempty"`
+	Model       string     `json:"model,omitempty"`
+	Taken       *time.Time `json:"taken,omitempty"`
+	Orientation int        `json:"orientation,omitempty"`
+	Width       int        `json:"width,omitempty"`
+	Height      int        `json:"height,omitempty"`
+	Latitude    float64    `json:"latitude,omitempty"`
+	Longitude   float64    `json:"longitude,omitempty"`
+}
+
+var errNoTags = errors.New("no embedded tags")
+
+// the most read from a tag, box or element, to bound what a broken or
+// hostile file makes us read
+const MEDIA_TAGS_MAX = 1 << 20
+
+// read_media_tags reads the tags embedded in the file at full_path
+func read_media_tags(full_path string) (*mediaTags, error) {
+	file, err := os.Open(full_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var tags *mediaTags
+	switch strings.ToLower(filepath.Ext(full_path)) {
+	case ".mp3":
+		tags = read_id3(file, fi.Size())
+	case ".mp4", ".m4v", ".m4a", ".mov":
+		tags = read_mp4_tags(file, fi.Size())
+	case ".mkv", ".mka", ".webm":
+		tags = read_matroska_tags(file, fi.Size())
+	case ".jpg", ".jpeg", ".tif", ".tiff":
+		tags = read_exif(file)
+	}
+	if tags == nil || *tags == (mediaTags{Format: tags.Format}) {
+		return nil, errNoTags
+	}
+	return tags, nil
+}
+
+// merge_media_tags adds tags to the metadata from the online providers,
+// filling in what they did not find. without any, the tags are used alone
+func merge_media_tags(metadata string, err error, tags *mediaTags) (string, error) {
+	merged := map[string]interface{}{}
+	if err == nil {
+		if json.Unmarshal([]byte(metadata), &merged) != nil {
+			// not an object, leave it alone
+			return metadata, nil
+		}
+	}
+	merged["embedded"] = tags
+	fill := func(key, value string) {
+		if current, _ := merged[key].(string); current == "" && value != "" {
+			merged[key] = value
+		}
+	}
+	fill("title", tags.Title)
+	fill("artist", tags.Artist)
+	fill("album", tags.Album)
+	fill("genre", tags.Genre)
+	fill("description", tags.Description)
+	if len(tags.Date) >= 4 {
+		fill("year", tags.Date[:4])
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// id3 text encodings, as decode_text names them
+var id3_encodings = []string{"iso-8859-1", "utf-16", "utf-16be", "utf-8"}
+
+// id3_text decodes a text frame, with the first value of lists
+func id3_text(data []byte) string {
+	if len(data) < 1 || int(data[0]) >= len(id3_encodings) {
+		return ""
+	}
+	encoding, text := id3_encodings[data[0]], data[1:]
+	if encoding == "utf-16" {
+		encoding = "utf-16le"
+		if bytes.HasPrefix(text, []byte{0xfe, 0xff}) {
+			encoding = "utf-16be"
+		}
+	}
+	value := decode_text(text, encoding)
+	if i := strings.IndexRune(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+func syncsafe(data []byte) int {
+	return int(data[0]&0x7f)<<21 | int(data[1]&0x7f)<<14 | int(data[2]&0x7f)<<7 | int(data[3]&0x7f)
+}
+
+// leading_int parses the number at the start of "3/12" or "(17)"
+func leading_int(value string) int {
+	value = strings.TrimLeft(value, "(")
+	end := 0
+	for end < len(value) && value[end] >= '0' && value[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(value[:end])
+	return n
+}
+
+type id3Frame struct {
+	id    string
+	value []byte
+}
+
+// id3_frames reads the frames of the ID3v2 tag at the start of file, up to
+// max bytes of them
+func id3_frames(file io.ReaderAt, max int) []id3Frame {
+	header := make([]byte, 10)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:3]) != "ID3" {
+		return nil
+	}
+	version, flags, length := header[3], header[5], syncsafe(header[6:])
+	if length > max {
+		length = max
+	}
+	data := make([]byte, length)
+	n, _ := file.ReadAt(data, 10)
+	data = data[:n]
+	if flags&0x40 != 0 && len(data) >= 4 {
+		// skip the extended header
+		extended := int(binary.BigEndian.Uint32(data))
+		if version == 4 {
+			extended = syncsafe(data)
+		} else {
+			extended += 4
+		}
+		if extended > len(data) {
+			extended = len(data)
+		}
+		data = data[extended:]
+	}
+	id_size, header_size := 4, 10
+	if version == 2 {
+		id_size, header_size = 3, 6
+	}
+	frames := []id3Frame{}
+	for len(data) >= header_size && data[0] != 0 {
+		id := string(data[:id_size])
+		var frame_size int
+		switch version {
+		case 2:
+			frame_size = int(data[3])<<16 | int(data[4])<<8 | int(data[5])
+		case 3:
+			frame_size = int(binary.BigEndian.Uint32(data[4:]))
+		default:
+			frame_size = syncsafe(data[4:])
+		}
+		if frame_size < 0 || header_size+frame_size > len(data) {
+			break
+		}
+		frames = append(frames, id3Frame{id: id, value: data[header_size : header_size+frame_size]})
+		data = data[header_size+frame_size:]
+	}
+	return frames
+}
+
+// read_id3 reads the ID3v2 tag at the start of an MP3, and what's missing
+// from the ID3v1 tag at the end
+func read_id3(file io.ReaderAt, size int64) *mediaTags {
+	tags := &mediaTags{Format: "id3"}
+	for _, frame := range id3_frames(file, MEDIA_TAGS_MAX) {
+		value := frame.value
+		switch frame.id {
+		case "TIT2", "TT2":
+			tags.Title = id3_text(value)
+		case "TPE1", "TP1":
+			tags.Artist = id3_text(value)
+		case "TALB", "TAL":
+			tags.Album = id3_text(value)
+		case "TPE2", "TP2":
+			tags.AlbumArtist = id3_text(value)
+		case "TRCK", "TRK":
+			tags.Track = leading_int(id3_text(value))
+		case "TYER", "TYE", "TDRC":
+			tags.Date = id3_text(value)
+		case "TCON", "TCO":
+			genre := id3_text(value)
+			// "(17)Rock" or just "(17)"
+			if i := strings.Index(genre, ")"); strings.HasPrefix(genre, "(") && i > 0 && i < len(genre)-1 {
+				genre = genre[i+1:]
+			}
+			tags.Genre = genre
+		}
+	}
+
+	v1 := make([]byte, 128)
+	if size >= 128 {
+		if _, err := file.ReadAt(v1, size-128); err == nil && string(v1[:3]) == "TAG" {
+			field := func(data []byte) string {
+				if i := bytes.IndexByte(data, 0); i >= 0 {
+					data = data[:i]
+				}
+				return strings.TrimSpace(decode_text(data, "iso-8859-1"))
+			}
+			if tags.Title == "" {
+				tags.Title = field(v1[3:33])
+			}
+			if tags.Artist == "" {
+				tags.Artist = field(v1[33:63])
+			}
+			if tags.Album == "" {
+				tags.Album = field(v1[63:93])
+			}
+			if tags.Date == "" {
+				tags.Date = field(v1[93:97])
+			}
+			if tags.Track == 0 && v1[125] == 0 {
+				tags.Track = int(v1[126])
+			}
+		}
+	}
+	return tags
+}
+
+// mp4Box is a box (atom) of an MP4 file
+type mp4Box struct {
+	kind        string
+	start, size int64
+	// where the contents start
+	data int64
+}
+
+// mp4_boxes lists the boxes from start to end
+func mp4_boxes(file io.ReaderAt, start, end int64) []mp4Box {
+	boxes := []mp4Box{}
+	header := make([]byte, 16)
+	for start+8 <= end {
+		if _, err := file.ReadAt(header[:8], start); err != nil {
+			break
+		}
+		box := mp4Box{kind: string(header[4:8]), start: start, size: int64(binary.BigEndian.Uint32(header)), data: start + 8}
+		switch box.size {
+		case 0:
+			box.size = end - start
+		case 1:
+			if _, err := file.ReadAt(header[8:16], start+8); err != nil {
+				return boxes
+			}
+			box.size = int64(binary.BigEndian.Uint64(header[8:16]))
+			box.data = start + 16
+		}
+		if box.size < box.data-start || start+box.size > end {
+			break
+		}
+		boxes = append(boxes, box)
+		start += box.size
+	}
+	return boxes
+}
+
+func read_box(file io.ReaderAt, box mp4Box, max int64) []byte {
+	size := box.start + box.size - box.data
+	if size > max {
+		return nil
+	}
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, box.data); err != nil {
+		return nil
+	}
+	return data
+}
+
+// read_mp4_tags reads the iTunes style tags and the duration of an MP4
+func read_mp4_tags(file io.ReaderAt, size int64) *mediaTags {
+	tags := &mediaTags{Format: "mp4"}
+	for _, moov := range mp4_boxes(file, 0, size) {
+		if moov.kind != "moov" {
+			continue
+		}
+		for _, box := range mp4_boxes(file, moov.data, moov.start+moov.size) {
+			switch box.kind {
+			case "mvhd":
+				data := read_box(file, box, MEDIA_TAGS_MAX)
+				if len(data) >= 32 && data[0] == 1 {
+					scale, duration := binary.BigEndian.Uint32(data[20:]), binary.BigEndian.Uint64(data[24:])
+					if scale > 0 {
+						tags.Duration = float64(duration) / float64(scale)
+					}
+				} else if len(data) >= 20 {
+					scale, duration := binary.BigEndian.Uint32(data[12:]), binary.BigEndian.Uint32(data[16:])
+					if scale > 0 {
+						tags.Duration = float64(duration) / float64(scale)
+					}
+				}
+			}
+		}
+	}
+	read_ilst(file, mp4_ilst(file, size), tags)
+	return tags
+}
+
+// mp4_ilst returns the items of the iTunes style tags in moov/udta/meta/ilst
+func mp4_ilst(file io.ReaderAt, size int64) []mp4Box {
+	items := []mp4Box{}
+	for _, moov := range mp4_boxes(file, 0, size) {
+		if moov.kind != "moov" {
+			continue
+		}
+		for _, udta := range mp4_boxes(file, moov.data, moov.start+moov.size) {
+			if udta.kind != "udta" {
+				continue
+			}
+			for _, meta := range mp4_boxes(file, udta.data, udta.start+udta.size) {
+				if meta.kind != "meta" {
+					continue
+				}
+				// meta is a full box, with a version and flags first
+				for _, ilst := range mp4_boxes(file, meta.data+4, meta.start+meta.size) {
+					if ilst.kind == "ilst" {
+						items = append(items, mp4_boxes(file, ilst.data, ilst.start+ilst.size)...)
+					}
+				}
+			}
+		}
+	}
+	return items
+}
+
+func read_ilst(file io.ReaderAt, items []mp4Box, tags *mediaTags) {
+	for _, item := range items {
+		var value []byte
+		for _, data := range mp4_boxes(file, item.data, item.start+item.size) {
+			// a type and a locale before the value
+			if contents := read_box(file, data, MEDIA_TAGS_MAX); data.kind == "data" && len(contents) >= 8 {
+				value = contents[8:]
+				break
+			}
+		}
+		text := strings.TrimSpace(string(bytes.ToValidUTF8(value, nil)))
+		number := func() int {
+			switch {
+			case len(value) >= 4 && item.kind == "trkn":
+				return int(binary.BigEndian.Uint16(value[2:]))
+			case len(value) == 4:
+				return int(binary.BigEndian.Uint32(value))
+			case len(value) == 1:
+				return int(value[0])
+			}
+			return 0
+		}
+		switch item.kind {
+		case "\xa9nam":
+			tags.Title = text
+		case "\xa9ART":
+			tags.Artist = text
+		case "\xa9alb":
+			tags.Album = text
+		case "aART":
+			tags.AlbumArtist = text
+		case "\xa9day":
+			tags.Date = text
+		case "\xa9gen":
+			tags.Genre = text
+		case "desc", "ldes":
+			if tags.Description == "" {
+				tags.Description = text
+			}
+		case "tvsh":
+			tags.Show = text
+		case "tvsn":
+			tags.Season = number()
+		case "tves":
+			tags.Episode = number()
+		case "trkn":
+			tags.Track = number()
+		}
+	}
+}
+
+// matroska element ids
+const (
+	MKV_SEGMENT        = 0x18538067
+	MKV_INFO           = 0x1549A966
+	MKV_TIMECODE_SCALE = 0x2AD7B1
+	MKV_DURATION       = 0x4489
+	MKV_TITLE          = 0x7BA9
+	MKV_DATE_UTC       = 0x4461
+	MKV_TAGS           = 0x1254C367
+	MKV_TAG            = 0x7373
+	MKV_SIMPLE_TAG     = 0x67C8
+	MKV_TAG_NAME       = 0x45A3
+	MKV_TAG_STRING     = 0x4487
+	MKV_CLUSTER        = 0x1F43B675
+)
+
+type mkvElement struct {
+	id   uint64
+	data int64
+	// -1 when unknown
+	size int64
+}
+
+// ebml_vint reads a variable length integer, keeping the length marker for
+// ids. it returns the value and its length, 0 if it's invalid
+func ebml_vint(file io.ReaderAt, offset int64, keep_marker bool) (uint64, int) {
+	first := make([]byte, 1)
+	if _, err := file.ReadAt(first, offset); err != nil || first[0] == 0 {
+		return 0, 0
+	}
+	length := 1
+	for first[0]&(0x80>>uint(length-1)) == 0 {
+		length++
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		return 0, 0
+	}
+	if !keep_marker {
+		data[0] &^= 0x80 >> uint(length-1)
+	}
+	value := uint64(0)
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+// mkv_elements lists the elements from start to end
+func mkv_elements(file io.ReaderAt, start, end int64) []mkvElement {
+	elements := []mkvElement{}
+	for start < end {
+		id, id_length := ebml_vint(file, start, true)
+		if id_length == 0 || id_length > 4 {
+			break
+		}
+		size, size_length := ebml_vint(file, start+int64(id_length), false)
+		if size_length == 0 {
+			break
+		}
+		element := mkvElement{id: id, data: start + int64(id_length+size_length), size: int64(size)}
+		if size == uint64(1)<<(7*uint(size_length))-1 {
+			// unknown size, up to the end of its parent
+			element.size = -1
+		}
+		elements = append(elements, element)
+		if element.size < 0 || element.size > end-element.data {
+			break
+		}
+		start = element.data + element.size
+	}
+	return elements
+}
+
+func read_element(file io.ReaderAt, element mkvElement) []byte {
+	if element.size < 0 || element.size > MEDIA_TAGS_MAX {
+		return nil
+	}
+	data := make([]byte, element.size)
+	if _, err := file.ReadAt(data, element.data); err != nil {
+		return nil
+	}
+	return data
+}
+
+func ebml_uint(data []byte) uint64 {
+	value := uint64(0)
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// read_matroska_tags reads the title, duration and tags of a Matroska file
+func read_matroska_tags(file io.ReaderAt, size int64) *mediaTags {
+	tags := &mediaTags{Format: "matroska"}
+	for _, segment := range mkv_elements(file, 0, size) {
+		if segment.id != MKV_SEGMENT {
+			continue
+		}
+		end := size
+		if segment.size >= 0 && segment.data+segment.size < size {
+			end = segment.data + segment.size
+		}
+		for _, element := range mkv_elements(file, segment.data, end) {
+			switch element.id {
+			case MKV_INFO:
+				read_matroska_info(file, element, tags)
+			case MKV_TAGS:
+				read_matroska_simple_tags(file, element, tags)
+			}
+		}
+	}
+	return tags
+}
+
+func read_matroska_info(file io.ReaderAt, info mkvElement, tags *mediaTags) {
+	if info.size < 0 {
+		return
+	}
+	scale, duration := uint64(1000000), 0.0
+	for _, element := range mkv_elements(file, info.data, info.data+info.size) {
+		data := read_element(file, element)
+		switch element.id {
+		case MKV_TIMECODE_SCALE:
+			scale = ebml_uint(data)
+		case MKV_DURATION:
+			if len(data) == 4 {
+				duration = float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+			} else if len(data) == 8 {
+				duration = math.Float64frombits(binary.BigEndian.Uint64(data))
+			}
+		case MKV_TITLE:
+			tags.Title = strings.TrimSpace(string(bytes.ToValidUTF8(data, nil)))
+		case MKV_DATE_UTC:
+			if len(data) == 8 {
+				// nanoseconds since the start of the millennium
+				date := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(int64(binary.BigEndian.Uint64(data))))
+				tags.Date = date.Format(time.RFC3339)
+			}
+		}
+	}
+	tags.Duration = duration * float64(scale) / 1e9
+}
+
+func read_matroska_simple_tags(file io.ReaderAt, all mkvElement, tags *mediaTags) {
+	if all.size < 0 {
+		return
+	}
+	for _, tag := range mkv_elements(file, all.data, all.data+all.size) {
+		if tag.id != MKV_TAG || tag.size < 0 {
+			continue
+		}
+		for _, simple := range mkv_elements(file, tag.data, tag.data+tag.size) {
+			if simple.id != MKV_SIMPLE_TAG || simple.size < 0 {
+				continue
+			}
+			name, value := "", ""
+			for _, element := range mkv_elements(file, simple.data, simple.data+simple.size) {
+				switch element.id {
+				case MKV_TAG_NAME:
+					name = strings.ToUpper(string(read_element(file, element)))
+				case MKV_TAG_STRING:
+					value = strings.TrimSpace(string(bytes.ToValidUTF8(read_element(file, element), nil)))
+				}
+			}
+			set := func(field *string) {
+				if *field == "" {
+					*field = value
+				}
+			}
+			switch name {
+			case "TITLE":
+				set(&tags.Title)
+			case "ARTIST":
+				set(&tags.Artist)
+			case "ALBUM":
+				set(&tags.Album)
+			case "GENRE":
+				set(&tags.Genre)
+			case "DATE_RELEASED", "DATE_RECORDED":
+				set(&tags.Date)
+			case "DESCRIPTION", "SUMMARY", "COMMENT":
+				set(&tags.Description)
+			case "PART_NUMBER":
+				if tags.Track == 0 {
+					tags.Track = leading_int(value)
+				}
+			}
+		}
+	}
+}
+
+// read_exif reads the camera, time, size and location of a photo
+func read_exif(file io.Reader) *mediaTags {
+	tags := &mediaTags{Format: "exif"}
+	x, err := exif.Decode(file)
+	if err != nil {
+		return tags
+	}
+	text := func(name exif.FieldName) string {
+		tag, err := x.Get(name)
+		if err != nil {
+			return ""
+		}
+		value, _ := tag.StringVal()
+		return strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	}
+	number := func(name exif.FieldName) int {
+		tag, err := x.Get(name)
+		if err != nil {
+			return 0
+		}
+		value, _ := tag.Int(0)
+		return value
+	}
+	tags.Make = text(exif.Make)
+	tags.Model = text(exif.Model)
+	tags.Description = text(exif.ImageDescription)
+	tags.Orientation = number(exif.Orientation)
+	tags.Width = number(exif.PixelXDimension)
+	tags.Height = number(exif.PixelYDimension)
+	if taken, err := x.DateTime(); err == nil {
+		tags.Taken = &taken
+	}
+	if lat, long, err := x.LatLong(); err == nil && !math.IsNaN(lat) && !math.IsNaN(long) {
+		tags.Latitude, tags.Longitude = lat, long
+	}
+	return tags
+}
+
+// the most read of embedded pictures
+const MEDIA_PICTURE_MAX = 16 << 20
+
+var errNoPicture = errors.New("no embedded picture")
+
+// read_media_picture returns the cover art embedded in an MP3 or MP4 file,
+// the front cover if there are several pictures
+func read_media_picture(full_path string) (string, []byte, error) {
+	file, err := os.Open(full_path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	switch strings.ToLower(filepath.Ext(full_path)) {
+	case ".mp3":
+		return id3_picture(file)
+	case ".mp4", ".m4a", ".m4v", ".mov":
+		return mp4_picture(file, fi.Size())
+	}
+	return "", nil, errNoPicture
+}
+
+// id3_terminator is where the text at the start of data ends, with how
+// long the terminator is, for an ID3 text encoding
+func id3_terminator(data []byte, encoding byte) (int, int) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return i, 2
+			}
+		}
+		return -1, 0
+	}
+	return bytes.IndexByte(data, 0), 1
+}
+
+func id3_picture(file io.ReaderAt) (string, []byte, error) {
+	mime_type, picture := "", []byte(nil)
+	for _, frame := range id3_frames(file, MEDIA_PICTURE_MAX) {
+		value := frame.value
+		if (frame.id != "APIC" && frame.id != "PIC") || len(value) < 5 {
+			continue
+		}
+		encoding, frame_mime := value[0], ""
+		if frame.id == "PIC" {
+			// a three letter format in ID3v2.2
+			frame_mime = "image/" + strings.ToLower(string(value[1:4]))
+			value = value[4:]
+		} else {
+			end := bytes.IndexByte(value[1:], 0)
+			if end < 0 {
+				continue
+			}
+			frame_mime = string(value[1 : 1+end])
+			value = value[2+end:]
+		}
+		if len(value) < 1 {
+			continue
+		}
+		kind := value[0]
+		end, length := id3_terminator(value[1:], encoding)
+		if end < 0 {
+			continue
+		}
+		data := value[1+end+length:]
+		if frame_mime == "image/jpg" {
+			frame_mime = "image/jpeg"
+		}
+		if picture == nil || kind == 3 {
+			mime_type, picture = frame_mime, data
+		}
+		if kind == 3 {
+			break
+		}
+	}
+	if picture == nil {
+		return "", nil, errNoPicture
+	}
+	return mime_type, picture, nil
+}
+
+func mp4_picture(file io.ReaderAt, size int64) (string, []byte, error) {
+	for _, item := range mp4_ilst(file, size) {
+		if item.kind != "covr" {
+			continue
+		}
+		for _, data := range mp4_boxes(file, item.data, item.start+item.size) {
+			contents := read_box(file, data, MEDIA_PICTURE_MAX)
+			if data.kind != "data" || len(contents) <= 8 {
+				continue
+			}
+			mime_type := "image/jpeg"
+			if contents[3] == 14 {
+				mime_type = "image/png"
+			}
+			return mime_type, contents[8:], nil
+		}
+	}
+	return "", nil, errNoPicture
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func id3_frame(id, text string) []byte {
+	frame := []byte(id)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(text)+1))
+	frame = append(frame, 0, 0, 0)
+	return append(frame, text...)
+}
+
+func mp4_box(kind string, contents ...[]byte) []byte {
+	data := bytes.Join(contents, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(len(data)+8))
+	return append(append(box, kind...), data...)
+}
+
+func mp4_item(kind string, value []byte) []byte {
+	return mp4_box(kind, mp4_box("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, value))
+}
+
+func mkv_element(id uint64, contents ...[]byte) []byte {
+	data := bytes.Join(contents, nil)
+	element := []byte{}
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> uint(shift)); b != 0 || len(element) > 0 {
+			element = append(element, b)
+		}
+	}
+	// sizes as 8 byte vints
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(data)))
+	size[0] = 0x01
+	return append(append(element, size...), data...)
+}
+
+func TestMediaTags(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tags")
+	defer os.RemoveAll(dir)
+
+	frames := bytes.Join([][]byte{id3_frame("TIT2", "Song"), id3_frame("TPE1", "Band"), id3_frame("TRCK", "3/12")}, nil)
+	mp3 := append([]byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, byte(len(frames))}, frames...)
+	mp3 = append(mp3, make([]byte, 1000)...)
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	copy(v1[63:], "Album")
+	mp3 = append(mp3, v1...)
+
+	mvhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 90000)
+	ilst := mp4_box("ilst", mp4_item("\xa9nam", []byte("Pilot")), mp4_item("tvsh", []byte("Show")), mp4_item("tvsn", []byte{0, 0, 0, 2}))
+	mp4 := append(mp4_box("ftyp", []byte("isom")), mp4_box("mdat", make([]byte, 100))...)
+	mp4 = append(mp4, mp4_box("moov", mp4_box("mvhd", mvhd), mp4_box("udta", mp4_box("meta", []byte{0, 0, 0, 0}, ilst)))...)
+
+	duration := binary.BigEndian.AppendUint64(nil, math.Float64bits(5400000))
+	mkv := append(mkv_element(0x1A45DFA3), mkv_element(MKV_SEGMENT,
+		mkv_element(MKV_INFO, mkv_element(MKV_TITLE, []byte("Home Movie")), mkv_element(MKV_DURATION, duration)),
+		mkv_element(MKV_CLUSTER, make([]byte, 100)),
+		mkv_element(MKV_TAGS, mkv_element(MKV_TAG, mkv_element(MKV_SIMPLE_TAG, mkv_element(MKV_TAG_NAME, []byte("ARTIST")), mkv_element(MKV_TAG_STRING, []byte("Me"))))),
+	)...)
+
+	// a JPEG with the make and model in its EXIF
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x02")
+	tiff = append(tiff, 0x01, 0x0f, 0, 2, 0, 0, 0, 6, 0, 0, 0, 38)
+	tiff = append(tiff, 0x01, 0x10, 0, 2, 0, 0, 0, 4, 'R', '5', 0, 0)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, "Canon\x00"...)
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	jpeg := append([]byte{0xff, 0xd8, 0xff, 0xe1, byte((len(app1) + 2) >> 8), byte(len(app1) + 2)}, app1...)
+	jpeg = append(jpeg, 0xff, 0xd9)
+
+	for name, contents := range map[string][]byte{"a.mp3": mp3, "b.mp4": mp4, "c.mkv": mkv, "d.mp3": make([]byte, 200), "e.jpg": jpeg} {
+		ioutil.WriteFile(filepath.Join(dir, name), contents, 0644)
+	}
+	tags, err := read_media_tags(filepath.Join(dir, "a.mp3"))
+	if err != nil || tags.Title != "Song" || tags.Artist != "Band" || tags.Track != 3 || tags.Album != "Album" {
+		t.Errorf("Wrong ID3 tags: %+v %v", tags, err)
+	}
+	tags, err = read_media_tags(filepath.Join(dir, "b.mp4"))
+	if err != nil || tags.Title != "Pilot" || tags.Show != "Show" || tags.Season != 2 || tags.Duration != 90 {
+		t.Errorf("Wrong MP4 tags: %+v %v", tags, err)
+	}
+	tags, err = read_media_tags(filepath.Join(dir, "c.mkv"))
+	if err != nil || tags.Title != "Home Movie" || tags.Artist != "Me" || tags.Duration != 5400 {
+		t.Errorf("Wrong Matroska tags: %+v %v", tags, err)
+	}
+	tags, err = read_media_tags(filepath.Join(dir, "e.jpg"))
+	if err != nil || tags.Make != "Canon" || tags.Model != "R5" {
+		t.Errorf("Wrong EXIF tags: %+v %v", tags, err)
+	}
+	if _, err := read_media_tags(filepath.Join(dir, "d.mp3")); err != errNoTags {
+		t.Errorf("Found tags in an empty file: %v", err)
+	}
+}
+
+func TestMergeMediaTags(t *testing.T) {
+	tags := &mediaTags{Format: "id3", Title: "Song", Date: "1999-01-01"}
+	merged, err := merge_media_tags(`{"title":"Online","rating":7}`, nil, tags)
+	var result map[string]interface{}
+	json.Unmarshal([]byte(merged), &result)
+	if err != nil || result["title"] != "Online" || result["year"] != "1999" || result["embedded"] == nil {
+		t.Errorf("Wrong merge: %s %v", merged, err)
+	}
+	// without online metadata, the tags are enough
+	merged, err = merge_media_tags("", errors.New("not found"), tags)
+	json.Unmarshal([]byte(merged), &result)
+	if err != nil || result["title"] != "Song" {
+		t.Errorf("Wrong merge: %s %v", merged, err)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// an on-disk cache of the metadata lookups, so that clients asking again
+// for the same file do not wait for TMDb/TheTVDB, nor hit them every time.
+// lookups that found nothing are cached too, for config.Metadata.NegativeTTL,
+// and the ones that failed for METADATA_ERROR_TTL, as the failure may not last
+
+const METADATA_CACHE_DIR = DATA_DIR + "/metadata_cache"
+const METADATA_ERROR_TTL = 15 * time.Minute
+
+var errNoMetadata = errors.New("no metadata found")
+
+// metadataSource is what looks up metadata, the metadata library
+type metadataSource interface {
+	GetMetadata(filename, hint string) (string, error)
+}
+
+type metadataEntry struct {
+	Filename string    `json:"filename"`
+	Hint     string    `json:"hint"`
+	Stored   time.Time `json:"stored"`
+	Found    bool      `json:"found"`
+	Error    string    `json:"error,omitempty"`
+	JSON     string    `json:"json,omitempty"`
+}
+
+type metadataCache struct {
+	dir                         string
+	hits, negative_hits, misses int64
+	sync.Mutex
+}
+
+var metadata_cache = &metadataCache{dir: METADATA_CACHE_DIR}
+
+// metadata_ttl parses one of the TTLs of the config, with "0" disabling it
+func metadata_ttl(value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	if value == "0" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log_warn("Invalid metadata cache TTL %q, using %s", value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// ttl is how long an entry is good for
+func (entry *metadataEntry) ttl() time.Duration {
+	switch {
+	case entry.Found:
+		return metadata_ttl(config.Metadata.CacheTTL, 720*time.Hour)
+	case entry.Error != "":
+		return METADATA_ERROR_TTL
+	}
+	return metadata_ttl(config.Metadata.NegativeTTL, 24*time.Hour)
+}
+
+func (entry *metadataEntry) result() (string, error) {
+	if entry.Found {
+		return entry.JSON, nil
+	}
+	if entry.Error != "" {
+		return "", errors.New(entry.Error)
+	}
+	return "", errNoMetadata
+}
+
+// entry_path is where the entry for filename and hint is kept
+func (this *metadataCache) entry_path(filename, hint string) string {
+	return filepath.Join(this.dir, sha1string(filename+"\x00"+hint)+".json")
+}
+
+// cached returns the entry for filename and hint, if it has not expired
+func (this *metadataCache) cached(filename, hint string) *metadataEntry {
+	data, err := ioutil.ReadFile(this.entry_path(filename, hint))
+	if err != nil {
+		return nil
+	}
+	entry := new(metadataEntry)
+	// the names are checked in case of a hash collision
+	if json.Unmarshal(data, entry) != nil || entry.Filename != filename || entry.Hint != hint ||
+		time.Since(entry.Stored) >= entry.ttl() {
+		return nil
+	}
+	return entry
+}
+
+// fresh says if a lookup of filename would be answered from the cache
+func (this *metadataCache) fresh(filename, hint string) bool {
+	return this.cached(filename, hint) != nil
+}
+
+// lookup returns the metadata of filename, from the cache if it's there and
+// has not expired, or from source
+func (this *metadataCache) lookup(source metadataSource, filename, hint string) (string, error) {
+	if entry := this.cached(filename, hint); entry != nil {
+		this.Lock()
+		if entry.Found {
+			this.hits++
+		} else {
+			this.negative_hits++
+		}
+		this.Unlock()
+		return entry.result()
+	}
+	full_path := this.entry_path(filename, hint)
+	this.Lock()
+	this.misses++
+	this.Unlock()
+
+	entry := &metadataEntry{Filename: filename, Hint: hint, Stored: time.Now()}
+	result, err := source.GetMetadata(filename, hint)
+	switch {
+	case err != nil:
+		entry.Error = err.Error()
+	case strings.TrimSpace(result) != "" && strings.TrimSpace(result) != "{}":
+		entry.Found, entry.JSON = true, result
+	}
+	if entry.ttl() > 0 {
+		if err := this.store(full_path, entry); err != nil {
+			debug(2, "Error caching the metadata of %s: %s", filename, err.Error())
+		}
+	}
+	return entry.result()
+}
+
+func (this *metadataCache) store(full_path string, entry *metadataEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(this.dir, 0755); err != nil {
+		return err
+	}
+	return write_file_atomic(full_path, data, 0644)
+}
+
+// cleanup is a job removing the expired entries of the cache
+func (this *metadataCache) cleanup() jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		fis, err := ioutil.ReadDir(this.dir)
+		if os.IsNotExist(err) {
+			return "no metadata cached", nil
+		} else if err != nil {
+			return "", err
+		}
+		removed := 0
+		for i, fi := range fis {
+			progress(int64(i), int64(len(fis)))
+			if !strings.HasSuffix(fi.Name(), ".json") {
+				continue
+			}
+			full_path := filepath.Join(this.dir, fi.Name())
+			entry := new(metadataEntry)
+			data, err := ioutil.ReadFile(full_path)
+			if err == nil && json.Unmarshal(data, entry) == nil && time.Since(entry.Stored) < entry.ttl() {
+				continue
+			}
+			if os.Remove(full_path) == nil {
+				removed++
+			}
+		}
+		// artwork is kept as long as metadata that was found
+		artwork, _ := ioutil.ReadDir(filepath.Join(this.dir, "artwork"))
+		ttl := metadata_ttl(config.Metadata.CacheTTL, 720*time.Hour)
+		for _, fi := range artwork {
+			if time.Since(fi.ModTime()) >= ttl && os.Remove(filepath.Join(this.dir, "artwork", fi.Name())) == nil {
+				removed++
+			}
+		}
+		return fmt.Sprintf("%d of %d cached lookups and artwork expired", removed, len(fis)+len(artwork)), nil
+	}
+}
+
+func (this *metadataCache) status() map[string]int64 {
+	this.Lock()
+	defer this.Unlock()
+	return map[string]int64{"hits": this.hits, "negative_hits": this.negative_hits, "misses": this.misses}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type fakeMetadata struct {
+	results map[string]string
+	err     error
+	calls   int
+}
+
+func (this *fakeMetadata) GetMetadata(filename, hint string) (string, error) {
+	this.calls++
+	return this.results[filename], this.err
+}
+
+func TestMetadataCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "metadata")
+	defer os.RemoveAll(dir)
+	cache := &metadataCache{dir: dir}
+	source := &fakeMetadata{results: map[string]string{"Up.mkv": `{"title":"Up"}`, "Nothing.mkv": "{}"}}
+
+	for i := 0; i < 2; i++ {
+		if json, err := cache.lookup(source, "Up.mkv", "movie"); err != nil || json != `{"title":"Up"}` {
+			t.Fatalf("Wrong metadata: %q %v", json, err)
+		}
+		if _, err := cache.lookup(source, "Nothing.mkv", "movie"); err != errNoMetadata {
+			t.Fatalf("Found metadata for nothing: %v", err)
+		}
+	}
+	if source.calls != 2 {
+		t.Errorf("The library was asked %d times instead of 2", source.calls)
+	}
+	// the hint is part of the key
+	cache.lookup(source, "Up.mkv", "tv")
+	if source.calls != 3 {
+		t.Errorf("A lookup with another hint was cached")
+	}
+
+	// failures are cached for a short time only
+	source.err = errors.New("no route to host")
+	if _, err := cache.lookup(source, "Down.mkv", "movie"); err == nil || err.Error() != "no route to host" {
+		t.Errorf("Wrong error: %v", err)
+	}
+	cache.lookup(source, "Down.mkv", "movie")
+	if source.calls != 4 {
+		t.Errorf("A failure was not cached")
+	}
+	entry := &metadataEntry{Filename: "Down.mkv", Hint: "movie", Stored: time.Now().Add(-METADATA_ERROR_TTL), Error: "x"}
+	cache.store(cache.entry_path("Down.mkv", "movie"), entry)
+	cache.lookup(source, "Down.mkv", "movie")
+	if source.calls != 5 {
+		t.Errorf("An expired failure was used")
+	}
+
+	// the cleanup only removes what expired
+	entry = &metadataEntry{Filename: "Old.mkv", Hint: "movie", Stored: time.Now().Add(-25 * time.Hour)}
+	cache.store(cache.entry_path("Old.mkv", "movie"), entry)
+	cache.cleanup()(func(done, total int64) {})
+	if exists(cache.entry_path("Old.mkv", "movie")) || !exists(cache.entry_path("Up.mkv", "movie")) {
+		t.Errorf("The cleanup removed the wrong entries")
+	}
+	if status := cache.status(); status["hits"] != 1 || status["negative_hits"] != 2 {
+		t.Errorf("Wrong stats: %v", status)
+	}
+}
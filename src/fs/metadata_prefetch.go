@@ -0,0 +1,279 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the metadata of the videos in movie and tv shares is looked up ahead of
+// time, so that browsing a share for the first time does not wait for it.
+// the prefetch job follows the changes to the index of every media share,
+// looks up the new files and keeps their artwork, a batch at a time so that
+// it does not hold up the other jobs, or hammer the providers
+
+const METADATA_PREFETCH_JOB = "metadata-prefetch"
+const METADATA_PREFETCH_BATCH = 500
+const METADATA_PREFETCH_PAUSE = 250 * time.Millisecond
+
+const ARTWORK_DIR = METADATA_CACHE_DIR + "/artwork"
+const ARTWORK_MAX_SIZE = 10 << 20
+
+type prefetchItem struct {
+	share, path, hint string
+}
+
+type metadataPrefetch struct {
+	// where every share is in the journal of its index
+	cursors map[string]string
+	pending []prefetchItem
+	queued  map[prefetchItem]bool
+	// what the current run is doing, and totals since the start
+	share                             string
+	looked_up, found, failed, artwork int64
+	last_run                          time.Time
+	pause                             time.Duration
+	artwork_dir                       string
+	// the URLs of the artwork seen in metadata, by id
+	known map[string]string
+	sync.Mutex
+}
+
+var metadata_prefetch = new_metadata_prefetch(ARTWORK_DIR)
+
+func new_metadata_prefetch(artwork_dir string) *metadataPrefetch {
+	return &metadataPrefetch{
+		cursors:     make(map[string]string),
+		queued:      make(map[prefetchItem]bool),
+		pause:       METADATA_PREFETCH_PAUSE,
+		artwork_dir: artwork_dir,
+		known:       make(map[string]string),
+	}
+}
+
+// collect queues the videos of the media shares added or changed since the
+// last time, as the index knows them
+func (this *metadataPrefetch) collect(shares *HdaShares) {
+	shares.RLock()
+	list := append([]*HdaShare{}, shares.Shares...)
+	shares.RUnlock()
+	this.Lock()
+	defer this.Unlock()
+	for _, share := range list {
+		hint := share.metadata_hint()
+		if hint == "" {
+			continue
+		}
+		entries, next, _, err := share_index.changes(share.name, this.cursors[share.name])
+		if err != nil {
+			// not indexed yet
+			continue
+		}
+		this.cursors[share.name] = next
+		for _, entry := range entries {
+			if entry.Deleted || entry.IsDir || !strings.HasPrefix(entry.MimeType, "video/") {
+				continue
+			}
+			item := prefetchItem{share: share.name, path: entry.Path, hint: hint}
+			if !this.queued[item] {
+				this.queued[item] = true
+				this.pending = append(this.pending, item)
+			}
+		}
+	}
+}
+
+// next takes the next item to look up
+func (this *metadataPrefetch) next() (prefetchItem, int, bool) {
+	this.Lock()
+	defer this.Unlock()
+	if len(this.pending) == 0 {
+		this.share = ""
+		return prefetchItem{}, 0, false
+	}
+	item := this.pending[0]
+	this.pending = this.pending[1:]
+	delete(this.queued, item)
+	this.share = item.share
+	return item, len(this.pending), true
+}
+
+// job looks up a batch of the pending videos with library, and runs again
+// soon if there are more
+func (this *metadataPrefetch) job(shares *HdaShares, library metadataSource) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		this.collect(shares)
+		looked_up, found := 0, 0
+		for looked_up < METADATA_PREFETCH_BATCH {
+			item, left, ok := this.next()
+			if !ok {
+				break
+			}
+			progress(int64(looked_up), int64(looked_up+left+1))
+			filename := path.Base(item.path)
+			cached := metadata_cache.fresh(filename, item.hint)
+			result, err := metadata_cache.lookup(library, filename, item.hint)
+			this.Lock()
+			switch {
+			case err == nil:
+				this.found++
+				found++
+			case err != errNoMetadata:
+				this.failed++
+			}
+			this.looked_up++
+			this.Unlock()
+			looked_up++
+			if err == nil {
+				this.keep_artwork(result)
+			}
+			if !cached {
+				// go easy on the providers
+				time.Sleep(this.pause)
+			}
+		}
+
+		this.Lock()
+		this.last_run = time.Now()
+		left := len(this.pending)
+		this.Unlock()
+		if left > 0 {
+			scheduler.trigger(METADATA_PREFETCH_JOB)
+		}
+		return fmt.Sprintf("%d videos looked up, %d found, %d left", looked_up, found, left), nil
+	}
+}
+
+// artwork_urls finds the URLs of the images in the metadata of a file
+func artwork_urls(metadata string) []string {
+	var data interface{}
+	if json.Unmarshal([]byte(metadata), &data) != nil {
+		return nil
+	}
+	urls := []string{}
+	var walk func(key string, value interface{})
+	walk = func(key string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for k, value := range v {
+				walk(strings.ToLower(k), value)
+			}
+		case []interface{}:
+			for _, value := range v {
+				walk(key, value)
+			}
+		case string:
+			if !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") {
+				return
+			}
+			for _, kind := range []string{"artwork", "poster", "backdrop", "banner", "fanart", "image", "thumb"} {
+				if strings.Contains(key, kind) {
+					urls = append(urls, v)
+					return
+				}
+			}
+		}
+	}
+	walk("", data)
+	return urls
+}
+
+// artwork_path is where the image at url is kept
+func (this *metadataPrefetch) artwork_path(u string) string {
+	ext := strings.ToLower(path.Ext(u))
+	if parsed, err := url.Parse(u); err == nil {
+		ext = strings.ToLower(path.Ext(parsed.Path))
+	}
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" && ext != ".gif" && ext != ".webp" {
+		ext = ""
+	}
+	return filepath.Join(this.artwork_dir, sha1string(u)+ext)
+}
+
+// keep_artwork downloads the images of metadata that are not here yet
+func (this *metadataPrefetch) keep_artwork(metadata string) {
+	for _, u := range artwork_urls(metadata) {
+		this.remember_artwork(u)
+		full_path := this.artwork_path(u)
+		if exists(full_path) {
+			continue
+		}
+		if err := this.download_artwork(u, full_path); err != nil {
+			debug(2, "Error downloading artwork %s: %s", u, err.Error())
+			continue
+		}
+		this.Lock()
+		this.artwork++
+		this.Unlock()
+	}
+}
+
+func (this *metadataPrefetch) download_artwork(u, full_path string) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", response.Status)
+	}
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "image/") {
+		return fmt.Errorf("not an image: %s", response.Header.Get("Content-Type"))
+	}
+	if err := os.MkdirAll(this.artwork_dir, 0755); err != nil {
+		return err
+	}
+	// clients may ask for the same artwork at the same time
+	file, err := ioutil.TempFile(this.artwork_dir, "."+filepath.Base(full_path))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(file, io.LimitReader(response.Body, ARTWORK_MAX_SIZE+1))
+	file.Close()
+	if err == nil && n > ARTWORK_MAX_SIZE {
+		err = fmt.Errorf("larger than %d bytes", ARTWORK_MAX_SIZE)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), full_path)
+}
+
+func (this *metadataPrefetch) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	status := map[string]interface{}{
+		"pending":   len(this.pending),
+		"looked_up": this.looked_up,
+		"found":     this.found,
+		"failed":    this.failed,
+		"artwork":   this.artwork,
+	}
+	if this.share != "" {
+		status["share"] = this.share
+	}
+	if !this.last_run.IsZero() {
+		status["last_run"] = this.last_run
+	}
+	return status
+}
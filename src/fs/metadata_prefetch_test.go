@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMetadataPrefetch(t *testing.T) {
+	artwork := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "image/jpeg")
+		writer.Write([]byte("jpeg"))
+	}))
+	defer artwork.Close()
+
+	dir, _ := ioutil.TempDir("", "prefetch")
+	defer os.RemoveAll(dir)
+	saved_index, saved_cache := share_index, metadata_cache
+	defer func() { share_index, metadata_cache = saved_index, saved_cache }()
+	share_index = new_hda_index()
+	metadata_cache = &metadataCache{dir: filepath.Join(dir, "cache")}
+
+	movies := filepath.Join(dir, "movies")
+	os.MkdirAll(movies, 0755)
+	ioutil.WriteFile(filepath.Join(movies, "Up.mkv"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(movies, "notes.txt"), []byte("x"), 0644)
+	share := &HdaShare{name: "Movies", path: movies, tags: "movies"}
+	shares := &HdaShares{Shares: []*HdaShare{share, {name: "Docs", path: dir}}}
+	share_index.scan(share.name, share.path, nil, nil, nil)
+
+	source := &fakeMetadata{results: map[string]string{"Up.mkv": `{"title":"Up","artwork":"` + artwork.URL + `/up.jpg"}`}}
+	prefetch := new_metadata_prefetch(filepath.Join(dir, "cache", "artwork"))
+	prefetch.pause = 0
+	run := prefetch.job(shares, source)
+	run(func(done, total int64) {})
+	if source.calls != 1 {
+		t.Fatalf("%d lookups instead of 1", source.calls)
+	}
+	if data, _ := ioutil.ReadFile(prefetch.artwork_path(artwork.URL + "/up.jpg")); string(data) != "jpeg" {
+		t.Errorf("The artwork was not kept: %q", data)
+	}
+
+	// only what's new is looked up the next time
+	ioutil.WriteFile(filepath.Join(movies, "Cars.mp4"), []byte("x"), 0644)
+	share_index.scan(share.name, share.path, nil, nil, nil)
+	run(func(done, total int64) {})
+	if source.calls != 2 {
+		t.Errorf("%d lookups instead of 2", source.calls)
+	}
+	if status := prefetch.status(); status["looked_up"] != int64(2) || status["found"] != int64(1) || status["artwork"] != int64(1) {
+		t.Errorf("Wrong status: %v", status)
+	}
+}
+
+func TestArtworkURLs(t *testing.T) {
+	urls := artwork_urls(`{"title":"Up","poster":"https://img/p.jpg","homepage":"https://up.com","images":[{"url":"x"},"http://img/b.png"]}`)
+	if len(urls) != 2 {
+		t.Errorf("Wrong artwork: %v", urls)
+	}
+}
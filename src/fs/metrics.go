@@ -0,0 +1,325 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the counters of the HDA, kept in a registry and served by the local
+// server in the text format of Prometheus at GET /metrics: the requests by
+// route and status, the bytes served, the throughput of the transfers, the
+// streams, the connections to the relay, the goroutines and the open file
+// descriptors. /hda_debug reads the same counters
+
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// transfers smaller than this say little of the throughput
+const METRICS_THROUGHPUT_MIN = 1 << 20
+
+// in bytes per second, from 100KB/s to 100MB/s
+var throughput_buckets = []float64{1e5, 2.5e5, 5e5, 1e6, 2.5e6, 5e6, 1e7, 2.5e7, 5e7, 1e8}
+
+const (
+	METRIC_COUNTER   = "counter"
+	METRIC_GAUGE     = "gauge"
+	METRIC_HISTOGRAM = "histogram"
+)
+
+type metricValue struct {
+	labels []string
+	value  float64
+	// of histograms
+	counts []uint64
+	count  uint64
+}
+
+type metric struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+	values           map[string]*metricValue
+	// sets the values of gauges when they are read
+	collect func(set func(value float64, labels ...string))
+	sync.Mutex
+}
+
+type metricsRegistry struct {
+	metrics []*metric
+	sync.Mutex
+}
+
+var metrics_registry = new(metricsRegistry)
+
+func (this *metricsRegistry) add(m *metric) *metric {
+	m.values = make(map[string]*metricValue)
+	this.Lock()
+	defer this.Unlock()
+	this.metrics = append(this.metrics, m)
+	return m
+}
+
+func (this *metricsRegistry) counter(name, help string, labels ...string) *metric {
+	return this.add(&metric{name: name, help: help, kind: METRIC_COUNTER, labels: labels})
+}
+
+func (this *metricsRegistry) histogram(name, help string, buckets []float64, labels ...string) *metric {
+	return this.add(&metric{name: name, help: help, kind: METRIC_HISTOGRAM, labels: labels, buckets: buckets})
+}
+
+// gauge is a gauge set by collect every time it's read
+func (this *metricsRegistry) gauge(name, help string, collect func(set func(value float64, labels ...string)), labels ...string) *metric {
+	return this.add(&metric{name: name, help: help, kind: METRIC_GAUGE, labels: labels, collect: collect})
+}
+
+// get is the value of labels, made if needed. call with the lock held
+func (this *metric) get(labels []string) *metricValue {
+	key := strings.Join(labels, "\xff")
+	value := this.values[key]
+	if value == nil {
+		value = &metricValue{labels: append([]string{}, labels...)}
+		if this.kind == METRIC_HISTOGRAM {
+			value.counts = make([]uint64, len(this.buckets))
+		}
+		this.values[key] = value
+	}
+	return value
+}
+
+func (this *metric) inc(labels ...string) {
+	this.add(1, labels...)
+}
+
+func (this *metric) add(delta float64, labels ...string) {
+	this.Lock()
+	defer this.Unlock()
+	this.get(labels).value += delta
+}
+
+// value is the value of labels, the count of histograms
+func (this *metric) value(labels ...string) float64 {
+	this.Lock()
+	defer this.Unlock()
+	value := this.values[strings.Join(labels, "\xff")]
+	if value == nil {
+		return 0
+	}
+	if this.kind == METRIC_HISTOGRAM {
+		return float64(value.count)
+	}
+	return value.value
+}
+
+// values_of are the values of the series whose first labels are labels,
+// by their next label
+func (this *metric) values_of(labels ...string) map[string]float64 {
+	this.Lock()
+	defer this.Unlock()
+	values := make(map[string]float64)
+	for _, value := range this.values {
+		if len(value.labels) > len(labels) && strings.Join(value.labels[:len(labels)], "\xff") == strings.Join(labels, "\xff") {
+			values[value.labels[len(labels)]] += value.value
+		}
+	}
+	return values
+}
+
+func (this *metric) observe(observed float64, labels ...string) {
+	this.Lock()
+	defer this.Unlock()
+	value := this.get(labels)
+	for i, bound := range this.buckets {
+		if observed <= bound {
+			value.counts[i]++
+		}
+	}
+	value.count++
+	value.value += observed
+}
+
+func metric_number(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var metric_label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// series is the name of a series with its labels
+func (this *metric) series(name string, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, label := range this.labels {
+		if i < len(values) {
+			pairs = append(pairs, label+`="`+metric_label_escaper.Replace(values[i])+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (this *metric) write(writer io.Writer) {
+	this.Lock()
+	defer this.Unlock()
+	if this.collect != nil {
+		this.values = make(map[string]*metricValue)
+		this.collect(func(value float64, labels ...string) {
+			this.get(labels).value = value
+		})
+	}
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", this.name, this.help, this.name, this.kind)
+	keys := []string{}
+	for key := range this.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := this.values[key]
+		if this.kind != METRIC_HISTOGRAM {
+			fmt.Fprintf(writer, "%s %s\n", this.series(this.name, value.labels), metric_number(value.value))
+			continue
+		}
+		for i, bound := range this.buckets {
+			fmt.Fprintf(writer, "%s %d\n", this.series(this.name+"_bucket", value.labels, "le", metric_number(bound)), value.counts[i])
+		}
+		fmt.Fprintf(writer, "%s %d\n", this.series(this.name+"_bucket", value.labels, "le", "+Inf"), value.count)
+		fmt.Fprintf(writer, "%s %s\n", this.series(this.name+"_sum", value.labels), metric_number(value.value))
+		fmt.Fprintf(writer, "%s %d\n", this.series(this.name+"_count", value.labels), value.count)
+	}
+}
+
+func (this *metricsRegistry) write(writer io.Writer) {
+	this.Lock()
+	all := append([]*metric{}, this.metrics...)
+	this.Unlock()
+	buffered := bufio.NewWriter(writer)
+	for _, m := range all {
+		m.write(buffered)
+	}
+	buffered.Flush()
+}
+
+// the metrics of the HDA. the server is relay or local
+var (
+	metric_received = metrics_registry.counter("fs_requests_received_total", "Requests received.", "server")
+	metric_served   = metrics_registry.counter("fs_requests_served_total", "Requests served.", "server")
+	metric_bytes    = metrics_registry.counter("fs_bytes_served_total", "Bytes served.", "server")
+	metric_requests = metrics_registry.counter("fs_http_requests_total", "Requests by route and status.", "server", "method", "route", "status")
+	metric_download = metrics_registry.histogram("fs_download_bytes_per_second", "Throughput of the responses of 1MB or more.", throughput_buckets, "path")
+	metric_upload   = metrics_registry.histogram("fs_upload_bytes_per_second", "Throughput of the uploads of 1MB or more.", throughput_buckets, "path")
+	_               = metrics_registry.gauge("fs_active_streams", "Files being streamed.", func(set func(float64, ...string)) {
+		set(float64(stream_limits.status()["open"].(int)))
+	})
+	_ = metrics_registry.gauge("fs_relay_connections", "Connections to the relay by state.", func(set func(float64, ...string)) {
+		if relay == nil {
+			return
+		}
+		states := map[string]float64{RELAY_CONNECTING: 0, RELAY_CONNECTED: 0, RELAY_WAITING: 0}
+		for _, link := range relay.links() {
+			link.Lock()
+			if link.state != "" {
+				states[link.state]++
+			}
+			link.Unlock()
+		}
+		for state, n := range states {
+			set(n, state)
+		}
+	}, "state")
+	_ = metrics_registry.gauge("fs_goroutines", "Goroutines.", func(set func(float64, ...string)) {
+		set(float64(runtime.NumGoroutine()))
+	})
+	_ = metrics_registry.gauge("fs_open_fds", "Open file descriptors.", func(set func(float64, ...string)) {
+		if fds, err := open_fds(); err == nil {
+			set(float64(fds))
+		}
+	})
+
+	// to tell which qualities of the ladder the clients can watch
+	metric_transcode_segments = metrics_registry.counter("fs_transcode_segments_total", "Transcoded segments served by quality.", "quality")
+	metric_transcode_waits    = metrics_registry.counter("fs_transcode_waits_total", "Transcoded segments the clients waited for by quality.", "quality")
+	metric_transcode_stalls   = metrics_registry.counter("fs_transcode_stalls_total", "Stalls reported by the clients by quality.", "quality")
+
+	// what each share is used for, also in /hda_debug
+	metric_share_requests = metrics_registry.counter("fs_share_requests_total", "Requests served by share.", "server", "share")
+	metric_share_bytes    = metrics_registry.counter("fs_share_bytes_total", "Bytes served by share.", "server", "share")
+)
+
+func open_fds() (int, error) {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	return len(fds), err
+}
+
+// countingBody counts what is read of the body of a request
+type countingBody struct {
+	io.ReadCloser
+	count int64
+}
+
+func (this *countingBody) Read(p []byte) (int, error) {
+	n, err := this.ReadCloser.Read(p)
+	// read by /hda_debug while the request is served
+	atomic.AddInt64(&this.count, int64(n))
+	return n, err
+}
+
+// request_path is how a request came, local or relay
+func request_path(request *http.Request) string {
+	if from_relay(request) {
+		return "relay"
+	}
+	return "local"
+}
+
+// observe_request counts a request once served
+func (this *debugInfo) observe_request(request *http.Request, status int, sent, received int64, took time.Duration) {
+	route := endpoint_of(request)[len(request.Method)+1:]
+	metric_requests.inc(this.server_name(), request.Method, route, strconv.Itoa(status))
+	if share := request.URL.Query().Get("s"); share != "" && status < 400 {
+		metric_share_requests.inc(this.server_name(), share)
+		metric_share_bytes.add(float64(sent), this.server_name(), share)
+	}
+	if took <= 0 {
+		return
+	}
+	if sent >= METRICS_THROUGHPUT_MIN {
+		metric_download.observe(float64(sent)/took.Seconds(), request_path(request))
+	}
+	if received >= METRICS_THROUGHPUT_MIN {
+		metric_upload.observe(float64(received)/took.Seconds(), request_path(request))
+	}
+}
+
+// GET /metrics, only on the local server
+func (service *MercuryFsService) serve_metrics(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	writer.WriteHeader(http.StatusOK)
+	counter := &countingWriter{writer: writer}
+	metrics_registry.write(counter)
+	service.debug_info.requestServed(counter.count)
+	log("\"GET %s\" 200 %d \"%s\"", pathForLog(request.URL), counter.count, request.Header.Get("User-Agent"))
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	registry := new(metricsRegistry)
+	requests := registry.counter("test_requests_total", "Requests.", "route")
+	requests.inc(`/files"x`)
+	requests.add(2, "/shares")
+	throughput := registry.histogram("test_bytes_per_second", "Throughput.", []float64{10, 100}, "path")
+	throughput.observe(50, "local")
+	throughput.observe(500, "local")
+	registry.gauge("test_goroutines", "Goroutines.", func(set func(float64, ...string)) { set(7) })
+
+	var out bytes.Buffer
+	registry.write(&out)
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="/files\"x"} 1`,
+		`test_requests_total{route="/shares"} 2`,
+		`test_bytes_per_second_bucket{path="local",le="10"} 0`,
+		`test_bytes_per_second_bucket{path="local",le="100"} 1`,
+		`test_bytes_per_second_bucket{path="local",le="+Inf"} 2`,
+		`test_bytes_per_second_sum{path="local"} 550`,
+		`test_bytes_per_second_count{path="local"} 2`,
+		"# TYPE test_goroutines gauge",
+		"test_goroutines 7",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("No %s in:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestMetricsRequests(t *testing.T) {
+	service := &MercuryFsService{debug_info: &debugInfo{server: "test"}}
+	handler := service.recover_errors(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ioutil.ReadAll(request.Body)
+		writer.WriteHeader(http.StatusCreated)
+		writer.Write(make([]byte, METRICS_THROUGHPUT_MIN))
+		service.debug_info.requestServed(METRICS_THROUGHPUT_MIN)
+	}))
+	uploads := metric_upload.value("local")
+	downloads := metric_download.value("local")
+	request := httptest.NewRequest("PUT", "/files", bytes.NewReader(make([]byte, METRICS_THROUGHPUT_MIN)))
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	last, received, served, bytes_served := service.debug_info.everything()
+	if time.Since(last) > time.Minute || received != 1 || served != 1 || bytes_served != METRICS_THROUGHPUT_MIN {
+		t.Errorf("Wrong counters: %v %d %d %d", last, received, served, bytes_served)
+	}
+	if metric_requests.value("test", "PUT", "/files", "201") != 1 {
+		t.Errorf("Request not counted by route")
+	}
+	if metric_upload.value("local") != uploads+1 || metric_download.value("local") != downloads+1 {
+		t.Errorf("Throughput not observed")
+	}
+
+	recorder := httptest.NewRecorder()
+	service.serve_metrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	if recorder.Header().Get("Content-Type") != METRICS_CONTENT_TYPE || !strings.Contains(body, `fs_http_requests_total{server="test",method="PUT",route="/files",status="201"} 1`) ||
+		!strings.Contains(body, "fs_goroutines ") || !strings.Contains(body, "fs_active_streams ") {
+		t.Errorf("Wrong metrics:\n%s", body)
+	}
+}
@@ -0,0 +1,426 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a music library of the songs in the shares tagged music, by artist and
+// album, from their embedded tags. it follows the index of the shares, and
+// the tags are read again only for the files that changed. an album is the
+// songs with the same album name in a directory, so that compilations are
+// not split by artist
+
+const MUSIC_LIBRARY_JOB = "music-library"
+const UNKNOWN_ARTIST = "Unknown Artist"
+const VARIOUS_ARTISTS = "Various Artists"
+
+// pictures next to the songs used as album art
+var album_art_names = []string{"cover.jpg", "folder.jpg", "front.jpg", "cover.png", "folder.png"}
+
+type musicTrack struct {
+	ID          string  `json:"id"`
+	Share       string  `json:"share"`
+	Path        string  `json:"path"`
+	Title       string  `json:"title"`
+	Artist      string  `json:"artist"`
+	Album       string  `json:"album"`
+	AlbumID     string  `json:"album_id"`
+	AlbumArtist string  `json:"album_artist,omitempty"`
+	Track       int     `json:"track,omitempty"`
+	Year        string  `json:"year,omitempty"`
+	Genre       string  `json:"genre,omitempty"`
+	Duration    float64 `json:"duration,omitempty"`
+
+	size  int64
+	mtime time.Time
+}
+
+type musicAlbum struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Artist string `json:"artist"`
+	Year   string `json:"year,omitempty"`
+	Tracks int    `json:"tracks"`
+	Art    string `json:"art"`
+}
+
+type musicArtist struct {
+	Name   string `json:"name"`
+	Albums int    `json:"albums"`
+	Tracks int    `json:"tracks"`
+}
+
+type musicLibrary struct {
+	// by share and path
+	tracks  map[string]*musicTrack
+	cursors map[string]string
+	sync.RWMutex
+}
+
+var music_library = new_music_library()
+
+func new_music_library() *musicLibrary {
+	return &musicLibrary{tracks: make(map[string]*musicTrack), cursors: make(map[string]string)}
+}
+
+// is_music says if a share is tagged as having music
+func (s *HdaShare) is_music() bool {
+	for _, tag := range s.tags_list() {
+		if strings.ToLower(tag) == "music" {
+			return true
+		}
+	}
+	return false
+}
+
+func library_key(share, path string) string {
+	return share + "\x00" + path
+}
+
+// music_track makes the track of a song, from its tags if it has any
+func music_track(share string, entry indexEntry, tags *mediaTags) *musicTrack {
+	name := path.Base(entry.Path)
+	dir := path.Dir(entry.Path)
+	track := &musicTrack{
+		ID:    sha1string(library_key(share, entry.Path))[:16],
+		Share: share,
+		Path:  entry.Path,
+		Title: strings.TrimSuffix(name, path.Ext(name)),
+		Album: path.Base(dir),
+		size:  entry.Size,
+		mtime: entry.Mtime,
+	}
+	if dir == "/" {
+		track.Album = ""
+	}
+	if tags != nil {
+		if tags.Title != "" {
+			track.Title = tags.Title
+		}
+		if tags.Album != "" {
+			track.Album = tags.Album
+		}
+		track.Artist, track.AlbumArtist = tags.Artist, tags.AlbumArtist
+		track.Track, track.Genre, track.Duration = tags.Track, tags.Genre, tags.Duration
+		if len(tags.Date) >= 4 {
+			track.Year = tags.Date[:4]
+		}
+	}
+	if track.Artist == "" {
+		track.Artist = track.AlbumArtist
+	}
+	if track.Artist == "" {
+		track.Artist = UNKNOWN_ARTIST
+	}
+	track.AlbumID = sha1string(library_key(share, dir) + "\x00" + track.Album)[:16]
+	return track
+}
+
+// update follows the changes to the index of the music shares, reading the
+// tags of the songs that are new or changed
+func (this *musicLibrary) update(shares *HdaShares, progress func(done, total int64)) (int, int) {
+	shares.RLock()
+	list := append([]*HdaShare{}, shares.Shares...)
+	shares.RUnlock()
+	music := make(map[string]bool)
+	changed, removed := 0, 0
+	for _, share := range list {
+		if !share.is_music() || is_homes_share(share.name) {
+			// the home folders are only for their users
+			continue
+		}
+		music[share.name] = true
+		this.RLock()
+		cursor := this.cursors[share.name]
+		this.RUnlock()
+		entries, next, full, err := share_index.changes(share.name, cursor)
+		if err != nil {
+			// not indexed yet
+			continue
+		}
+
+		// the tags are read without holding the lock
+		fresh := make(map[string]*musicTrack)
+		gone := []string{}
+		seen := make(map[string]bool)
+		for i, entry := range entries {
+			if progress != nil && i%100 == 0 {
+				progress(int64(i), int64(len(entries)))
+			}
+			key := library_key(share.name, entry.Path)
+			if entry.IsDir || !strings.HasPrefix(entry.MimeType, "audio/") {
+				continue
+			}
+			if entry.Deleted {
+				gone = append(gone, key)
+				continue
+			}
+			seen[key] = true
+			this.RLock()
+			old := this.tracks[key]
+			this.RUnlock()
+			if old != nil && old.size == entry.Size && old.mtime.Equal(entry.Mtime) {
+				continue
+			}
+			tags, _ := read_media_tags(share.path + entry.Path)
+			fresh[key] = music_track(share.name, entry, tags)
+		}
+
+		this.Lock()
+		for key, track := range fresh {
+			this.tracks[key] = track
+			changed++
+		}
+		for _, key := range gone {
+			if _, ok := this.tracks[key]; ok {
+				delete(this.tracks, key)
+				removed++
+			}
+		}
+		if full {
+			// everything is listed, so what's not there is gone
+			for key, track := range this.tracks {
+				if track.Share == share.name && !seen[key] {
+					delete(this.tracks, key)
+					removed++
+				}
+			}
+		}
+		this.cursors[share.name] = next
+		this.Unlock()
+	}
+
+	// shares that are gone or no longer music
+	this.Lock()
+	for key, track := range this.tracks {
+		if !music[track.Share] {
+			delete(this.tracks, key)
+			removed++
+		}
+	}
+	for name := range this.cursors {
+		if !music[name] {
+			delete(this.cursors, name)
+		}
+	}
+	this.Unlock()
+	return changed, removed
+}
+
+// job keeps the library up to date
+func (this *musicLibrary) job(shares *HdaShares) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		changed, removed := this.update(shares, progress)
+		this.RLock()
+		total := len(this.tracks)
+		this.RUnlock()
+		return fmt.Sprintf("%d songs, %d added or changed, %d removed", total, changed, removed), nil
+	}
+}
+
+func (this *musicLibrary) status() map[string]int {
+	this.RLock()
+	defer this.RUnlock()
+	albums := make(map[string]bool)
+	for _, track := range this.tracks {
+		albums[track.AlbumID] = true
+	}
+	return map[string]int{"songs": len(this.tracks), "albums": len(albums)}
+}
+
+// select_tracks returns the tracks for which keep is true, sorted by album
+// and track number
+func (this *musicLibrary) select_tracks(keep func(*musicTrack) bool) []musicTrack {
+	this.RLock()
+	tracks := []musicTrack{}
+	for _, track := range this.tracks {
+		if keep(track) {
+			tracks = append(tracks, *track)
+		}
+	}
+	this.RUnlock()
+	sort.Slice(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		if a.Album != b.Album {
+			return file_name_less(a.Album, b.Album)
+		}
+		if a.AlbumID != b.AlbumID {
+			return a.AlbumID < b.AlbumID
+		}
+		if a.Track != b.Track {
+			return a.Track < b.Track
+		}
+		return file_name_less(a.Path, b.Path)
+	})
+	return tracks
+}
+
+// albums groups the tracks into albums
+func albums_of(tracks []musicTrack) []musicAlbum {
+	albums := []musicAlbum{}
+	index := make(map[string]int)
+	artists := make(map[string]string)
+	for _, track := range tracks {
+		i, ok := index[track.AlbumID]
+		if !ok {
+			i = len(albums)
+			index[track.AlbumID] = i
+			albums = append(albums, musicAlbum{ID: track.AlbumID, Name: track.Album, Art: "/music/art?album=" + track.AlbumID})
+		}
+		album := &albums[i]
+		album.Tracks++
+		if album.Year == "" {
+			album.Year = track.Year
+		}
+		// the album artist, or the artist of all the songs
+		switch {
+		case track.AlbumArtist != "":
+			album.Artist = track.AlbumArtist
+			artists[album.ID] = ""
+		case artists[album.ID] == "" && album.Artist == "":
+			album.Artist, artists[album.ID] = track.Artist, track.Artist
+		case artists[album.ID] != "" && artists[album.ID] != track.Artist:
+			album.Artist = VARIOUS_ARTISTS
+		}
+	}
+	return albums
+}
+
+func (this *musicLibrary) artists() []musicArtist {
+	tracks := this.select_tracks(func(*musicTrack) bool { return true })
+	by_name := make(map[string]*musicArtist)
+	albums := make(map[string]map[string]bool)
+	for _, track := range tracks {
+		artist := by_name[track.Artist]
+		if artist == nil {
+			artist = &musicArtist{Name: track.Artist}
+			by_name[track.Artist] = artist
+			albums[track.Artist] = make(map[string]bool)
+		}
+		artist.Tracks++
+		albums[track.Artist][track.AlbumID] = true
+	}
+	artists := make([]musicArtist, 0, len(by_name))
+	for name, artist := range by_name {
+		artist.Albums = len(albums[name])
+		artists = append(artists, *artist)
+	}
+	sort.Slice(artists, func(i, j int) bool { return file_name_less(artists[i].Name, artists[j].Name) })
+	return artists
+}
+
+// by_artist says if a track is by artist, as the performer or album artist
+func by_artist(track *musicTrack, artist string) bool {
+	return artist == "" || track.Artist == artist || track.AlbumArtist == artist
+}
+
+// album_art returns the art of an album, embedded in one of its songs or
+// in a picture next to them
+func (this *musicLibrary) album_art(shares *HdaShares, album string) (string, []byte, bool) {
+	tracks := this.select_tracks(func(track *musicTrack) bool { return track.AlbumID == album })
+	dirs := []string{}
+	for _, track := range tracks {
+		share := shares.Get(track.Share)
+		if share == nil {
+			continue
+		}
+		full_path := share.path + track.Path
+		if mime_type, data, err := read_media_picture(full_path); err == nil {
+			return mime_type, data, true
+		}
+		if len(dirs) == 0 || dirs[len(dirs)-1] != filepath.Dir(full_path) {
+			dirs = append(dirs, filepath.Dir(full_path))
+		}
+	}
+	for _, dir := range dirs {
+		for _, name := range album_art_names {
+			if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err == nil {
+				return getContentType(name), data, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// GET /music/artists
+func (service *MercuryFsService) music_artists(writer http.ResponseWriter, request *http.Request) {
+	service.library_response(writer, request, music_library.artists())
+}
+
+// GET /music/albums[?artist=name]
+func (service *MercuryFsService) music_albums(writer http.ResponseWriter, request *http.Request) {
+	artist := request.URL.Query().Get("artist")
+	tracks := music_library.select_tracks(func(track *musicTrack) bool { return by_artist(track, artist) })
+	service.library_response(writer, request, albums_of(tracks))
+}
+
+// GET /music/tracks[?album=id][&artist=name], a page at a time
+func (service *MercuryFsService) music_tracks(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL.Query()
+	album, artist := q.Get("album"), q.Get("artist")
+	offset, err := decode_continuation(q.Get("continuation"), "m")
+	first, _ := strconv.Atoi(offset)
+	if err != nil || first < 0 {
+		size := json_response(writer, http.StatusBadRequest, map[string]string{"error": errBadContinuation.Error()})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" 400 %d \"%s\"", pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+		return
+	}
+	tracks := music_library.select_tracks(func(track *musicTrack) bool {
+		return (album == "" || track.AlbumID == album) && by_artist(track, artist)
+	})
+	if first > len(tracks) {
+		first = len(tracks)
+	}
+	tracks = tracks[first:]
+	if limit := listing_limit(request); limit > 0 && len(tracks) > limit {
+		tracks = tracks[:limit]
+		writer.Header().Set(CONTINUATION_HEADER, encode_continuation("m", strconv.Itoa(first+limit)))
+	}
+	service.library_response(writer, request, tracks)
+}
+
+// GET /music/art?album=id
+func (service *MercuryFsService) music_art(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	album := request.URL.Query().Get("album")
+	mime_type, data, ok := music_library.album_art(service.Shares, album)
+	if !ok {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	writer.Header().Set("Content-Type", mime_type)
+	writer.Header().Set("ETag", etag_cache.bytes_etag(request.URL.RequestURI(), data))
+	writer.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
+	http.ServeContent(writer, request, "", time.Time{}, bytes.NewReader(data))
+	service.debug_info.requestServed(int64(len(data)))
+	log("\"GET %s\" 200 %d \"%s\"", query, len(data), ua)
+}
+
+func (service *MercuryFsService) library_response(writer http.ResponseWriter, request *http.Request, v interface{}) {
+	size := json_response(writer, http.StatusOK, v)
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func id3_song(frames ...[]byte) []byte {
+	data := bytes.Join(frames, nil)
+	song := append([]byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, byte(len(data))}, data...)
+	return append(song, make([]byte, 200)...)
+}
+
+func TestMusicLibrary(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "music")
+	defer os.RemoveAll(dir)
+	saved_index, saved_library := share_index, music_library
+	defer func() { share_index, music_library = saved_index, saved_library }()
+	share_index = new_hda_index()
+	music_library = new_music_library()
+
+	music := filepath.Join(dir, "music")
+	os.MkdirAll(filepath.Join(music, "Alpha"), 0755)
+	os.MkdirAll(filepath.Join(music, "Demos"), 0755)
+	apic := append([]byte("APIC"), 0, 0, 0, 18, 0, 0)
+	apic = append(append(apic, 0), "image/jpeg\x00\x03\x00jpeg"...)
+	ioutil.WriteFile(filepath.Join(music, "Alpha", "01.mp3"), id3_song(id3_frame("TIT2", "One"), id3_frame("TPE1", "Band"),
+		id3_frame("TALB", "Alpha"), id3_frame("TRCK", "1"), apic), 0644)
+	ioutil.WriteFile(filepath.Join(music, "Alpha", "02.mp3"), id3_song(id3_frame("TIT2", "Two"), id3_frame("TPE1", "Guest"),
+		id3_frame("TALB", "Alpha"), id3_frame("TRCK", "2")), 0644)
+	ioutil.WriteFile(filepath.Join(music, "Demos", "Rough.mp3"), make([]byte, 200), 0644)
+	ioutil.WriteFile(filepath.Join(music, "Demos", "cover.png"), []byte("png"), 0644)
+	ioutil.WriteFile(filepath.Join(music, "notes.txt"), []byte("x"), 0644)
+	share := &HdaShare{name: "Music", path: music, tags: "music"}
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{share, {name: "Docs", path: dir}}}, debug_info: new(debugInfo)}
+	share_index.scan(share.name, share.path, nil, nil, nil)
+
+	if changed, removed := music_library.update(service.Shares, nil); changed != 3 || removed != 0 {
+		t.Fatalf("%d changed and %d removed instead of 3 and 0", changed, removed)
+	}
+	artists := music_library.artists()
+	if len(artists) != 3 || artists[0].Name != "Band" || artists[2].Name != UNKNOWN_ARTIST {
+		t.Errorf("Wrong artists: %v", artists)
+	}
+	albums := albums_of(music_library.select_tracks(func(*musicTrack) bool { return true }))
+	if len(albums) != 2 || albums[0].Name != "Alpha" || albums[0].Artist != VARIOUS_ARTISTS || albums[0].Tracks != 2 ||
+		albums[1].Name != "Demos" || albums[1].Artist != UNKNOWN_ARTIST {
+		t.Fatalf("Wrong albums: %v", albums)
+	}
+
+	// the tracks of an album, a page at a time
+	recorder := httptest.NewRecorder()
+	service.music_tracks(recorder, httptest.NewRequest("GET", "/music/tracks?limit=1&album="+albums[0].ID, nil))
+	tracks := []musicTrack{}
+	json.Unmarshal(recorder.Body.Bytes(), &tracks)
+	next := recorder.Header().Get(CONTINUATION_HEADER)
+	if len(tracks) != 1 || tracks[0].Title != "One" || next == "" {
+		t.Fatalf("Wrong first page: %s", recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	service.music_tracks(recorder, httptest.NewRequest("GET", "/music/tracks?limit=1&album="+albums[0].ID+"&continuation="+next, nil))
+	json.Unmarshal(recorder.Body.Bytes(), &tracks)
+	if len(tracks) != 1 || tracks[0].Title != "Two" || tracks[0].Track != 2 || recorder.Header().Get(CONTINUATION_HEADER) != "" {
+		t.Errorf("Wrong second page: %s", recorder.Body.String())
+	}
+
+	// embedded art, or the picture next to the songs
+	recorder = httptest.NewRecorder()
+	service.music_art(recorder, httptest.NewRequest("GET", "/music/art?album="+albums[0].ID, nil))
+	if recorder.Code != 200 || recorder.Body.String() != "jpeg" || recorder.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Wrong embedded art: %d %q", recorder.Code, recorder.Body.String())
+	}
+	if mime_type, data, ok := music_library.album_art(service.Shares, albums[1].ID); !ok || string(data) != "png" || mime_type != "image/png" {
+		t.Errorf("Wrong cover art: %s %q", mime_type, data)
+	}
+	recorder = httptest.NewRecorder()
+	service.music_art(recorder, httptest.NewRequest("GET", "/music/art?album=none", nil))
+	if recorder.Code != 404 {
+		t.Errorf("%d instead of 404 for a missing album", recorder.Code)
+	}
+
+	// only what changed is read again
+	os.Remove(filepath.Join(music, "Demos", "Rough.mp3"))
+	share_index.scan(share.name, share.path, nil, nil, nil)
+	if changed, removed := music_library.update(service.Shares, nil); changed != 0 || removed != 1 {
+		t.Errorf("%d changed and %d removed instead of 0 and 1", changed, removed)
+	}
+	recorder = httptest.NewRecorder()
+	service.music_albums(recorder, httptest.NewRequest("GET", "/music/albums?artist=Guest", nil))
+	albums = nil
+	json.Unmarshal(recorder.Body.Bytes(), &albums)
+	if len(albums) != 1 || albums[0].Name != "Alpha" {
+		t.Errorf("Wrong albums of an artist: %s", recorder.Body.String())
+	}
+}
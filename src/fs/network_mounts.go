@@ -0,0 +1,463 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMB and NFS exports of other machines, mounted by the daemon under
+// MOUNTS_DIR and served as shares like the local ones. the passwords of SMB
+// mounts are only kept in a credentials file readable by root, which is
+// given to mount.cifs. the network-mounts job checks every mount, mounts
+// again the ones that dropped and marks the unreachable ones unavailable
+
+const NETWORK_MOUNTS_FILE = DATA_DIR + "/network_mounts.json"
+const MOUNTS_DIR = DATA_DIR + "/mounts"
+const NETWORK_MOUNTS_JOB = "network-mounts"
+
+// how long a check of a mount can take, as a dead NFS server hangs them
+const MOUNT_CHECK_TIMEOUT = 10 * time.Second
+
+var errMountName = errors.New("invalid name, use letters, digits, spaces, dots, dashes and underscores")
+var errMountSource = errors.New("invalid source, use //host/share for SMB and host:/export for NFS")
+var errMountOptions = errors.New("invalid mount options")
+var errMountExists = errors.New("there is a share with that name already")
+var errMountType = errors.New("invalid type, use smb or nfs")
+var errMountCredentials = errors.New("invalid credentials")
+
+var mount_name_re = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 ._-]{0,63}$`)
+var mount_options_re = regexp.MustCompile(`^[A-Za-z0-9_.-]+(=[A-Za-z0-9_.:/-]+)?(,[A-Za-z0-9_.-]+(=[A-Za-z0-9_.:/-]+)?)*$`)
+
+// the mount options that can be asked for, for SMB and NFS. the mounts are
+// always nosuid and nodev
+var mount_options_allowed = map[string]bool{
+	"ro": true, "rw": true, "noexec": true, "noatime": true, "nodiratime": true, "relatime": true,
+	"soft": true, "hard": true, "timeo": true, "retrans": true, "rsize": true, "wsize": true,
+	"vers": true, "nfsvers": true, "proto": true, "port": true, "sec": true, "nolock": true,
+	"actimeo": true, "uid": true, "gid": true, "file_mode": true, "dir_mode": true,
+	"iocharset": true, "nounix": true, "noserverino": true, "cache": true, "seal": true, "nobrl": true,
+	"mfsymlinks": true,
+}
+
+const MOUNT_FORCED_OPTIONS = "nosuid,nodev"
+
+type networkMount struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Source   string    `json:"source"`
+	Options  string    `json:"options,omitempty"`
+	Tags     string    `json:"tags,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Created  time.Time `json:"created"`
+	// the state of the mount, as last checked
+	Mounted bool      `json:"mounted"`
+	Problem string    `json:"problem,omitempty"`
+	Checked time.Time `json:"checked,omitempty"`
+}
+
+type networkMounts struct {
+	file, dir string
+	mounts    map[string]*networkMount
+	// mount commands, and what is mounted, replaced in tests
+	run     func(name string, args ...string) error
+	mounted func() map[string]bool
+	sync.Mutex
+}
+
+var network_mounts = new_network_mounts(NETWORK_MOUNTS_FILE, MOUNTS_DIR)
+
+func new_network_mounts(file, dir string) *networkMounts {
+	return &networkMounts{
+		file:    file,
+		dir:     dir,
+		run:     func(name string, args ...string) error { return run_command(exec.Command(name, args...)) },
+		mounted: mounted_paths,
+	}
+}
+
+// mounted_paths returns the mount points of the machine
+func mounted_paths() map[string]bool {
+	paths := make(map[string]bool)
+	if file, err := os.Open("/proc/mounts"); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) > 1 {
+				// spaces are escaped as \040
+				paths[strings.Replace(fields[1], `\040`, " ", -1)] = true
+			}
+		}
+		return paths
+	}
+	// no /proc, as on macOS: "<source> on <path> (<options>)"
+	out, err := exec.Command("mount").Output()
+	if err != nil {
+		return paths
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if on := strings.Index(line, " on "); on >= 0 {
+			if end := strings.LastIndex(line, " ("); end > on {
+				paths[line[on+4:end]] = true
+			}
+		}
+	}
+	return paths
+}
+
+// load reads the mounts the first time they are needed. call with the lock held
+func (this *networkMounts) load() {
+	if this.mounts != nil {
+		return
+	}
+	this.mounts = make(map[string]*networkMount)
+	data, err := ioutil.ReadFile(this.file)
+	if err != nil {
+		return
+	}
+	mounts := []*networkMount{}
+	if err := json.Unmarshal(data, &mounts); err != nil {
+		log_error("Error reading the network mounts in %s: %s", this.file, err.Error())
+		return
+	}
+	for _, mount := range mounts {
+		this.mounts[mount.Name] = mount
+	}
+}
+
+// save writes the mounts. call with the lock held
+func (this *networkMounts) save() error {
+	data, err := json.Marshal(this.sorted())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(this.file), 0755); err != nil {
+		return err
+	}
+	return write_file_atomic(this.file, data, 0600)
+}
+
+// sorted lists copies of the mounts by name. call with the lock held
+func (this *networkMounts) sorted() []networkMount {
+	mounts := make([]networkMount, 0, len(this.mounts))
+	for _, mount := range this.mounts {
+		mounts = append(mounts, *mount)
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Name < mounts[j].Name })
+	return mounts
+}
+
+func (this *networkMounts) list() []networkMount {
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	return this.sorted()
+}
+
+// mount_point is where the mount of name is
+func (this *networkMounts) mount_point(name string) string {
+	return filepath.Join(this.dir, name)
+}
+
+func (this *networkMounts) credentials_path(name string) string {
+	return filepath.Join(this.dir, "."+name+".credentials")
+}
+
+// check_mount checks the settings of a new mount
+func check_mount(mount *networkMount) error {
+	if !mount_name_re.MatchString(mount.Name) {
+		return errMountName
+	}
+	switch mount.Type {
+	case "smb":
+		parts := strings.Split(strings.TrimPrefix(mount.Source, "//"), "/")
+		if !strings.HasPrefix(mount.Source, "//") || len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return errMountSource
+		}
+	case "nfs":
+		colon := strings.Index(mount.Source, ":/")
+		if colon < 1 {
+			return errMountSource
+		}
+	default:
+		return errMountType
+	}
+	// a source starting with a dash would be an option of mount
+	if strings.HasPrefix(mount.Source, "-") || strings.ContainsAny(mount.Source, "\x00\n,") {
+		return errMountSource
+	}
+	if mount.Options == "" {
+		return nil
+	}
+	if !mount_options_re.MatchString(mount.Options) {
+		return errMountOptions
+	}
+	for _, option := range strings.Split(mount.Options, ",") {
+		if !mount_options_allowed[strings.SplitN(option, "=", 2)[0]] {
+			return errMountOptions
+		}
+	}
+	return nil
+}
+
+// add mounts a new export, keeping password in its credentials file
+func (this *networkMounts) add(mount *networkMount, password, domain string, shares *HdaShares) error {
+	if err := check_mount(mount); err != nil {
+		return err
+	}
+	// one per line in the credentials file
+	if strings.ContainsAny(mount.Username+password+domain, "\n\x00") {
+		return errMountCredentials
+	}
+	if shares != nil && shares.Get(mount.Name) != nil {
+		return errMountExists
+	}
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	if this.mounts[mount.Name] != nil {
+		return errMountExists
+	}
+	if err := os.MkdirAll(this.dir, 0700); err != nil {
+		return err
+	}
+	if mount.Type == "smb" {
+		credentials := fmt.Sprintf("username=%s\npassword=%s\n", mount.Username, password)
+		if domain != "" {
+			credentials += "domain=" + domain + "\n"
+		}
+		if err := write_file_atomic(this.credentials_path(mount.Name), []byte(credentials), 0600); err != nil {
+			return err
+		}
+	}
+	mount.Created = time.Now()
+	if err := this.mount(mount); err != nil {
+		os.Remove(this.credentials_path(mount.Name))
+		os.Remove(this.mount_point(mount.Name))
+		return err
+	}
+	this.mounts[mount.Name] = mount
+	log("Network share %s mounted from %s", mount.Name, mount.Source)
+	return this.save()
+}
+
+// mount mounts an export. call with the lock held
+func (this *networkMounts) mount(mount *networkMount) error {
+	point := this.mount_point(mount.Name)
+	if err := os.MkdirAll(point, 0755); err != nil {
+		return err
+	}
+	options := MOUNT_FORCED_OPTIONS
+	if mount.Options != "" {
+		options = mount.Options + "," + options
+	}
+	kind := "nfs"
+	if mount.Type == "smb" {
+		kind = "cifs"
+		options += ",credentials=" + this.credentials_path(mount.Name)
+	}
+	// the source and the mount point are never taken for options
+	args := []string{"-t", kind, "-o", options, "--", mount.Source, point}
+	err := this.run("mount", args...)
+	mount.Mounted, mount.Checked, mount.Problem = err == nil, time.Now(), ""
+	if err != nil {
+		mount.Problem = "mount failed: " + err.Error()
+	}
+	return err
+}
+
+// remove unmounts name and forgets it
+func (this *networkMounts) remove(name string) (bool, error) {
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	mount := this.mounts[name]
+	if mount == nil {
+		return false, nil
+	}
+	point := this.mount_point(name)
+	if this.mounted()[point] {
+		// lazily, so that a dead server does not keep it
+		if err := this.run("umount", "-l", point); err != nil {
+			return true, err
+		}
+	}
+	os.Remove(point)
+	os.Remove(this.credentials_path(name))
+	delete(this.mounts, name)
+	log("Network share %s removed", name)
+	return true, this.save()
+}
+
+// check_path_timeout is check_share_path giving up after MOUNT_CHECK_TIMEOUT
+func check_path_timeout(path string) string {
+	done := make(chan string, 1)
+	go func() { done <- check_share_path(path) }()
+	select {
+	case problem := <-done:
+		return problem
+	case <-time.After(MOUNT_CHECK_TIMEOUT):
+		return "server not responding"
+	}
+}
+
+// check checks every mount, mounting again the ones that are not, and says
+// if any of them changed
+func (this *networkMounts) check() (changed bool, summary string) {
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	mounted := this.mounted()
+	up := 0
+	for _, mount := range this.mounts {
+		was_mounted, old_problem := mount.Mounted, mount.Problem
+		if !mounted[this.mount_point(mount.Name)] {
+			this.mount(mount)
+		} else {
+			mount.Mounted, mount.Checked = true, time.Now()
+			mount.Problem = check_path_timeout(this.mount_point(mount.Name))
+		}
+		if mount.Mounted && mount.Problem == "" {
+			up++
+		}
+		if mount.Mounted != was_mounted || mount.Problem != old_problem {
+			changed = true
+			if mount.Problem != "" {
+				log_warn("network share %s is unavailable: %s", mount.Name, mount.Problem)
+			} else {
+				log("Network share %s is available again", mount.Name)
+			}
+		}
+	}
+	if changed {
+		if err := this.save(); err != nil {
+			log_error("Error saving the network mounts: %s", err.Error())
+		}
+	}
+	return changed, fmt.Sprintf("%d of %d network shares available", up, len(this.mounts))
+}
+
+// job checks the mounts, and updates the shares when that changed any
+func (this *networkMounts) job(shares *HdaShares) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		changed, summary := this.check()
+		if changed {
+			shares.update_shares()
+		}
+		return summary, nil
+	}
+}
+
+// shares are the mounts as shares
+func (this *networkMounts) shares() []*HdaShare {
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	shares := []*HdaShare{}
+	for _, mount := range this.sorted() {
+		problem := mount.Problem
+		if !mount.Mounted && problem == "" {
+			problem = "not mounted"
+		}
+		shares = append(shares, &HdaShare{
+			name:       mount.Name,
+			updated_at: mount.Created,
+			path:       this.mount_point(mount.Name),
+			tags:       mount.Tags,
+			problem:    problem,
+			network:    true,
+		})
+	}
+	return shares
+}
+
+// GET /network/mounts lists the network shares
+func (service *MercuryFsService) network_mounts_list(writer http.ResponseWriter, request *http.Request) {
+	if service.share_admin_denied(writer, request) {
+		return
+	}
+	size := json_response(writer, http.StatusOK, network_mounts.list())
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+}
+
+// POST /network/mounts with name, type (smb or nfs), source, and optionally
+// tags, options, and username, password and domain for SMB, as a form
+func (service *MercuryFsService) network_mounts_add(writer http.ResponseWriter, request *http.Request) {
+	if service.share_admin_denied(writer, request) {
+		return
+	}
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	mount := &networkMount{
+		Name:     request.FormValue("name"),
+		Type:     request.FormValue("type"),
+		Source:   request.FormValue("source"),
+		Options:  request.FormValue("options"),
+		Tags:     request.FormValue("tags"),
+		Username: request.FormValue("username"),
+	}
+	status, result := http.StatusCreated, interface{}(mount)
+	service.Shares.update_shares()
+	if err := network_mounts.add(mount, request.PostFormValue("password"), request.FormValue("domain"), service.Shares); err != nil {
+		// what's left is mount failing
+		status = http.StatusBadGateway
+		switch err {
+		case errMountExists:
+			status = http.StatusConflict
+		case errMountName, errMountType, errMountSource, errMountOptions, errMountCredentials:
+			status = http.StatusBadRequest
+		}
+		result = map[string]string{"error": err.Error()}
+	} else {
+		service.Shares.update_shares()
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+}
+
+// DELETE /network/mounts/{name} unmounts a network share
+func (service *MercuryFsService) network_mounts_remove(writer http.ResponseWriter, request *http.Request) {
+	if service.share_admin_denied(writer, request) {
+		return
+	}
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status, size := http.StatusNoContent, int64(0)
+	found, err := network_mounts.remove(mux.Vars(request)["name"])
+	switch {
+	case !found:
+		status = http.StatusNotFound
+		http.NotFound(writer, request)
+	case err != nil:
+		status = http.StatusInternalServerError
+		size = json_response(writer, status, map[string]string{"error": err.Error()})
+	default:
+		service.Shares.update_shares()
+		writer.WriteHeader(status)
+	}
+	service.debug_info.requestServed(size)
+	log("\"DELETE %s\" %d %d \"%s\"", query, status, size, ua)
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNetworkMounts(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mounts")
+	defer os.RemoveAll(dir)
+	saved, saved_config := network_mounts, config
+	defer func() { network_mounts, config = saved, saved_config }()
+	config = default_config()
+	config.Admin.Token = "admin-token"
+	network_mounts = new_network_mounts(filepath.Join(dir, "network_mounts.json"), filepath.Join(dir, "mounts"))
+	commands := []string{}
+	mounted := make(map[string]bool)
+	var failure error
+	network_mounts.run = func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		if failure != nil {
+			return failure
+		}
+		point := args[len(args)-1]
+		mounted[point] = name == "mount"
+		return nil
+	}
+	network_mounts.mounted = func() map[string]bool { return mounted }
+
+	local := filepath.Join(dir, "local")
+	os.MkdirAll(filepath.Join(local, "Movies"), 0755)
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	service.Shares = &HdaShares{root_dir: local}
+	router := mux.NewRouter()
+	router.HandleFunc("/network/mounts", service.network_mounts_list).Methods("GET")
+	router.HandleFunc("/network/mounts", service.network_mounts_add).Methods("POST")
+	router.HandleFunc("/network/mounts/{name}", service.network_mounts_remove).Methods("DELETE")
+	add := func(form url.Values) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/network/mounts", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.Header.Set("Authorization", "Bearer admin-token")
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// not without the admin token
+	for _, request := range []*http.Request{httptest.NewRequest("GET", "/network/mounts", nil),
+		httptest.NewRequest("POST", "/network/mounts?name=NAS&type=nfs&source=nas:/export", nil),
+		httptest.NewRequest("DELETE", "/network/mounts/NAS", nil)} {
+		request.Header.Set("Authorization", "Bearer wrong")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != 401 {
+			t.Errorf("%d instead of 401 for %s %s", recorder.Code, request.Method, request.URL)
+		}
+	}
+
+	for _, bad := range []url.Values{
+		{"name": {"../etc"}, "type": {"nfs"}, "source": {"nas:/export"}},
+		{"name": {"NAS"}, "type": {"afp"}, "source": {"nas:/export"}},
+		{"name": {"NAS"}, "type": {"smb"}, "source": {"nas:/export"}},
+		{"name": {"NAS"}, "type": {"nfs"}, "source": {"nas:/export"}, "options": {"ro;reboot"}},
+		{"name": {"NAS"}, "type": {"nfs"}, "source": {"nas:/export"}, "options": {"ro,suid"}},
+		{"name": {"NAS"}, "type": {"nfs"}, "source": {"nas:/export"}, "options": {"dev"}},
+		{"name": {"NAS"}, "type": {"smb"}, "source": {"//nas/media"}, "options": {"credentials=/etc/shadow"}},
+		{"name": {"NAS"}, "type": {"nfs"}, "source": {"-v:/x"}},
+		{"name": {"NAS"}, "type": {"smb"}, "source": {"//nas/media"}, "password": {"x\nuid=0"}},
+	} {
+		if recorder := add(bad); recorder.Code != 400 {
+			t.Errorf("%d instead of 400 for %v", recorder.Code, bad)
+		}
+	}
+	if recorder := add(url.Values{"name": {"Movies"}, "type": {"nfs"}, "source": {"nas:/export"}}); recorder.Code != 409 {
+		t.Errorf("%d instead of 409 for the name of a local share", recorder.Code)
+	}
+	if len(commands) != 0 {
+		t.Fatalf("Mounted bad requests: %v", commands)
+	}
+
+	recorder := add(url.Values{"name": {"NAS Media"}, "type": {"smb"}, "source": {"//nas/media"}, "tags": {"movies"},
+		"options": {"ro,vers=3.0"}, "username": {"amahi"}, "password": {"s3cret"}})
+	if recorder.Code != 201 || strings.Contains(recorder.Body.String(), "s3cret") {
+		t.Fatalf("Wrong answer adding a mount: %d %s", recorder.Code, recorder.Body.String())
+	}
+	point := network_mounts.mount_point("NAS Media")
+	credentials := network_mounts.credentials_path("NAS Media")
+	if len(commands) != 1 || commands[0] != "mount -t cifs -o ro,vers=3.0,nosuid,nodev,credentials="+credentials+" -- //nas/media "+point {
+		t.Errorf("Wrong mount command: %v", commands)
+	}
+	if fi, err := os.Stat(credentials); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("The credentials are not private: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(network_mounts.file); strings.Contains(string(data), "s3cret") {
+		t.Errorf("The password is in the mounts file")
+	}
+	share := service.Shares.Get("NAS Media")
+	if share == nil || share.path != point || share.tags != "movies" || !share.network || service.Shares.Get("Movies") == nil {
+		t.Fatalf("The mount is not a share: %+v", share)
+	}
+
+	// dropped mounts are mounted again, and the ones that fail are unavailable
+	mounted[point] = false
+	failure = errors.New("host is down")
+	changed, _ := network_mounts.check()
+	service.Shares.update_shares()
+	if !changed || service.Shares.Get("NAS Media").problem != "mount failed: host is down" {
+		t.Errorf("The failed mount is not unavailable: %+v", service.Shares.Get("NAS Media"))
+	}
+	failure = nil
+	network_mounts.job(service.Shares)(func(done, total int64) {})
+	if !mounted[point] || service.Shares.Get("NAS Media").problem != "" {
+		t.Errorf("The mount was not mounted again: %+v", service.Shares.Get("NAS Media"))
+	}
+
+	// mounts are kept
+	network_mounts = new_network_mounts(network_mounts.file, network_mounts.dir)
+	network_mounts.run = func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	}
+	network_mounts.mounted = func() map[string]bool { return mounted }
+	if list := network_mounts.list(); len(list) != 1 || list[0].Username != "amahi" || !list[0].Mounted {
+		t.Fatalf("The mount was not kept: %+v", list)
+	}
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest("DELETE", "/network/mounts/NAS%20Media", nil)
+	request.Header.Set("Authorization", "Bearer admin-token")
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != 204 || commands[len(commands)-1] != "umount -l "+point || service.Shares.Get("NAS Media") != nil {
+		t.Errorf("The mount was not removed: %d %v", recorder.Code, commands)
+	}
+	if _, err := os.Stat(credentials); !os.IsNotExist(err) {
+		t.Errorf("The credentials were left behind")
+	}
+}
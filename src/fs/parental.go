@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parental controls for the child profiles of the config file. a profile
+// is held to the users of the home folders in its users, whatever their
+// apps send, and to the requests with neither a user nor a profile token
+// when it is the default one. otherwise it is known by its token, sent in
+// the Profile-Token header or as profile=<token>. the videos in movie and
+// tv shares rated above the max rating of the profile, from their metadata,
+// are left out of listings and cannot be streamed. the checks are made
+// here, and leaving the tokens out does not get around them
+
+const PROFILE_TOKEN_HEADER = "Profile-Token"
+
+// the keys of the rating in the metadata of the providers
+var rating_keys = []string{"certification", "content_rating", "contentrating", "mpaa", "mpaa_rating", "rating"}
+
+// the youngest age each rating is for
+var rating_ages = map[string]int{
+	"G": 0, "PG": 10, "PG-13": 13, "R": 17, "NC-17": 18, "X": 18,
+	"TV-Y": 0, "TV-G": 0, "TV-Y7": 7, "TV-Y7-FV": 7, "TV-PG": 10, "TV-14": 14, "TV-MA": 17,
+	"U": 0, "UC": 0, "12A": 12, "R18": 18, "NR": -1, "UNRATED": -1, "NOT RATED": -1,
+}
+
+type parentalProfile struct {
+	Token     string `json:"token"`
+	MaxRating string `json:"max_rating"`
+	// videos without a rating are hidden too
+	BlockUnrated bool `json:"block_unrated"`
+	// the users of the home folders always under this profile
+	Users []string `json:"users"`
+	name  string
+}
+
+type parentalProfileKey struct{}
+
+// rating_age is the youngest age a rating is for, -1 if it is not known.
+// ages alone, like "12" or "FSK 16", are taken as they are
+func rating_age(rating string) int {
+	rating = strings.ToUpper(strings.TrimSpace(rating))
+	if age, ok := rating_ages[rating]; ok {
+		return age
+	}
+	for _, prefix := range []string{"FSK", "PEGI", "AGE", "+"} {
+		rating = strings.TrimSpace(strings.TrimPrefix(rating, prefix))
+	}
+	rating = strings.TrimSuffix(rating, "+")
+	if age, err := strconv.Atoi(rating); err == nil && age >= 0 && age <= 21 {
+		return age
+	}
+	return -1
+}
+
+// metadata_rating finds the rating in the metadata of a video
+func metadata_rating(metadata string) string {
+	fields := map[string]interface{}{}
+	if json.Unmarshal([]byte(metadata), &fields) != nil {
+		return ""
+	}
+	lower := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		lower[strings.ToLower(key)] = value
+	}
+	for _, key := range rating_keys {
+		if rating, ok := lower[key].(string); ok && rating_age(rating) >= 0 {
+			return rating
+		}
+	}
+	return ""
+}
+
+// parental_profile returns the profile of token, if there is one
+func parental_profile(token string) *parentalProfile {
+	for name, profile := range config.Parental.Profiles {
+		if profile.Token != "" && subtle.ConstantTimeCompare([]byte(profile.Token), []byte(token)) == 1 {
+			profile.name = name
+			return &profile
+		}
+	}
+	return nil
+}
+
+// parental_profile_named returns the profile called name, if there is one
+func parental_profile_named(name string) *parentalProfile {
+	profile, ok := config.Parental.Profiles[name]
+	if !ok {
+		return nil
+	}
+	profile.name = name
+	return &profile
+}
+
+// user_parental_profile returns the profile user is held to, if any
+func user_parental_profile(user string) *parentalProfile {
+	for name, profile := range config.Parental.Profiles {
+		for _, profile_user := range profile.Users {
+			if user != "" && profile_user == user {
+				profile.name = name
+				return &profile
+			}
+		}
+	}
+	return nil
+}
+
+// check_parental_config checks that the default profile is one of them,
+// and that a user is under one profile at most
+func check_parental_config(c *parentalConfig) error {
+	if _, ok := c.Profiles[c.Default]; c.Default != "" && !ok {
+		return fmt.Errorf("no parental profile %q for the default", c.Default)
+	}
+	users := make(map[string]string)
+	for name, profile := range c.Profiles {
+		for _, user := range profile.Users {
+			if other, ok := users[user]; ok {
+				return fmt.Errorf("user %q is in the parental profiles %q and %q", user, other, name)
+			}
+			users[user] = name
+		}
+	}
+	return nil
+}
+
+// parental_profile_of returns the profile a request was made for, if any
+func parental_profile_of(request *http.Request) *parentalProfile {
+	profile, _ := request.Context().Value(parentalProfileKey{}).(*parentalProfile)
+	return profile
+}
+
+// allows says if the rating is fine for the profile
+func (this *parentalProfile) allows(rating string) bool {
+	age := rating_age(rating)
+	if age < 0 {
+		return !this.BlockUnrated
+	}
+	max := rating_age(this.MaxRating)
+	return max < 0 || age <= max
+}
+
+// blocks checks the video name in share, looking it up with library when
+// it is not cached yet, or only in the cache for a nil library. it returns
+// the rating it found too
+func (this *parentalProfile) blocks(share *HdaShare, name string, library metadataSource) (bool, string) {
+	hint := share.metadata_hint()
+	if hint == "" || !strings.HasPrefix(getContentType(name), "video/") {
+		return false, ""
+	}
+	var result string
+	var err error
+	if library != nil {
+		result, err = metadata_cache.lookup(library, name, hint)
+	} else if entry := metadata_cache.cached(name, hint); entry != nil {
+		result, err = entry.result()
+	} else {
+		err = errNoMetadata
+	}
+	rating := ""
+	if err == nil {
+		rating = metadata_rating(result)
+	}
+	return !this.allows(rating), rating
+}
+
+// hide is the listing filter of a directory of share for the profile. it
+// only uses the cache, as listings do not wait for the providers
+func (this *parentalProfile) hide(share *HdaShare) listingFilter {
+	if this == nil || share == nil || share.metadata_hint() == "" {
+		return nil
+	}
+	return func(name string) bool {
+		blocked, _ := this.blocks(share, name, nil)
+		return blocked
+	}
+}
+
+// parental_access is a middleware finding the profile of a request: the
+// one of its user, or of its token, or the default one without either
+func (service *MercuryFsService) parental_access(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		q := request.URL.Query()
+		token := request.Header.Get(PROFILE_TOKEN_HEADER)
+		if token == "" {
+			token = q.Get("profile")
+		}
+		if q.Get("profile") != "" {
+			// the token is not logged
+			q.Del("profile")
+			request.URL.RawQuery = q.Encode()
+		}
+		user := home_user_of(request)
+		profile := user_parental_profile(user)
+		switch {
+		case profile != nil:
+		case token != "":
+			profile = parental_profile(token)
+		case user == "" && config.Parental.Default != "":
+			profile = parental_profile_named(config.Parental.Default)
+		default:
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if profile == nil {
+			size := json_response(writer, http.StatusUnauthorized, map[string]string{"error": "invalid profile token"})
+			service.debug_info.requestServed(size)
+			log("\"%s %s\" 401 %d \"%s\"", request.Method, pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+			return
+		}
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), parentalProfileKey{}, profile)))
+	})
+}
+
+// metadata_library is the library of the service as a metadata source, nil
+// when there is none
+func (service *MercuryFsService) metadata_library() metadataSource {
+	if service.metadata == nil {
+		return nil
+	}
+	return service.metadata
+}
+
+// parental_block answers 403 for a video the profile of the request is not
+// allowed to watch, and says if it did
+func (service *MercuryFsService) parental_block(writer http.ResponseWriter, request *http.Request, profile *parentalProfile, share_name, full_path string) bool {
+	share := service.Shares.Get(share_name)
+	if profile == nil || share == nil {
+		return false
+	}
+	blocked, rating := profile.blocks(share, filepath.Base(full_path), service.metadata_library())
+	if !blocked {
+		return false
+	}
+	size := json_response(writer, http.StatusForbidden, map[string]string{"error": "blocked by parental controls", "rating": rating})
+	service.debug_info.requestServed(size)
+	log("Profile %s: \"%s %s\" 403 %d \"%s\"", profile.name, request.Method, pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+	return true
+}
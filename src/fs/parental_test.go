@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRatingAge(t *testing.T) {
+	for rating, age := range map[string]int{"PG-13": 13, "tv-ma": 17, " G ": 0, "FSK 16": 16, "12+": 12, "NR": -1, "7.5": -1, "": -1} {
+		if got := rating_age(rating); got != age {
+			t.Errorf("rating_age(%q) is %d instead of %d", rating, got, age)
+		}
+	}
+	if rating := metadata_rating(`{"title":"Up","Rating":"7.9","certification":"PG"}`); rating != "PG" {
+		t.Errorf("Wrong rating: %q", rating)
+	}
+}
+
+func TestParentalControls(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "parental")
+	defer os.RemoveAll(dir)
+	saved_config, saved_cache := config, metadata_cache
+	defer func() { config, metadata_cache = saved_config, saved_cache }()
+	config = default_config()
+	config.Parental.Profiles = map[string]parentalProfile{"kids": {Token: "secret", MaxRating: "PG", BlockUnrated: true}}
+	metadata_cache = &metadataCache{dir: filepath.Join(dir, "cache")}
+
+	movies := filepath.Join(dir, "movies")
+	os.MkdirAll(movies, 0755)
+	for _, name := range []string{"Up.mkv", "Saw.mkv", "Unknown.mkv", "notes.txt"} {
+		ioutil.WriteFile(filepath.Join(movies, name), []byte(name), 0644)
+	}
+	source := &fakeMetadata{results: map[string]string{"Up.mkv": `{"certification":"PG"}`, "Saw.mkv": `{"certification":"R"}`}}
+	metadata_cache.lookup(source, "Up.mkv", "movie")
+	metadata_cache.lookup(source, "Saw.mkv", "movie")
+
+	service := &MercuryFsService{
+		Shares:     &HdaShares{Shares: []*HdaShare{{name: "Movies", path: movies, tags: "movies"}}},
+		debug_info: new(debugInfo),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/files", service.serve_file).Methods("GET")
+	router.Use(service.home_access, service.parental_access)
+	request := func(target, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		if strings.HasPrefix(token, "user:") {
+			r.Header.Set(USER_TOKEN_HEADER, strings.TrimPrefix(token, "user:"))
+		} else if token != "" {
+			r.Header.Set(PROFILE_TOKEN_HEADER, token)
+		}
+		router.ServeHTTP(recorder, r)
+		return recorder
+	}
+	names := func(recorder *httptest.ResponseRecorder) map[string]bool {
+		entries := []struct{ Name string }{}
+		json.Unmarshal(recorder.Body.Bytes(), &entries)
+		found := make(map[string]bool)
+		for _, entry := range entries {
+			found[entry.Name] = true
+		}
+		return found
+	}
+
+	if listed := names(request("/files?s=Movies&p=/", "")); len(listed) != 4 {
+		t.Errorf("Wrong listing without a profile: %v", listed)
+	}
+	if listed := names(request("/files?s=Movies&p=/", "secret")); len(listed) != 2 || !listed["Up.mkv"] || !listed["notes.txt"] {
+		t.Errorf("Wrong listing for the profile: %v", listed)
+	}
+	if code := request("/files?s=Movies&p=/Up.mkv", "secret").Code; code != 200 {
+		t.Errorf("%d instead of 200 for a PG movie", code)
+	}
+	recorder := request("/files?s=Movies&p=/Saw.mkv&profile=secret", "")
+	if recorder.Code != 403 {
+		t.Errorf("%d instead of 403 for an R movie", recorder.Code)
+	}
+	if code := request("/files?s=Movies&p=/Unknown.mkv", "secret").Code; code != 403 {
+		t.Errorf("%d instead of 403 for an unrated movie", code)
+	}
+	if code := request("/files?s=Movies&p=/Saw.mkv", "").Code; code != 200 {
+		t.Errorf("%d instead of 200 without a profile", code)
+	}
+	if code := request("/files?s=Movies&p=/Up.mkv", "wrong").Code; code != 401 {
+		t.Errorf("%d instead of 401 for a wrong token", code)
+	}
+
+	// the users of a profile, and the clients without a token with a
+	// default profile, are held to it without sending its token
+	config.Homes.Users = map[string]string{"emma": "emma-token", "dad": "dad-token"}
+	config.Parental.Profiles = map[string]parentalProfile{"kids": {Token: "secret", MaxRating: "PG", BlockUnrated: true, Users: []string{"emma"}}}
+	if code := request("/files?s=Movies&p=/Saw.mkv", "user:emma-token").Code; code != 403 {
+		t.Errorf("%d instead of 403 for a user of the profile", code)
+	}
+	if code := request("/files?s=Movies&p=/Saw.mkv", "user:dad-token").Code; code != 200 {
+		t.Errorf("%d instead of 200 for another user", code)
+	}
+	config.Parental.Default = "kids"
+	if listed := names(request("/files?s=Movies&p=/", "")); len(listed) != 2 {
+		t.Errorf("Wrong listing without a token: %v", listed)
+	}
+	if listed := names(request("/files?s=Movies&p=/", "user:dad-token")); len(listed) != 4 {
+		t.Errorf("Wrong listing for another user: %v", listed)
+	}
+
+	if check_parental_config(&parentalConfig{Default: "teens"}) == nil {
+		t.Errorf("A default that is not a profile was accepted")
+	}
+	twice := &parentalConfig{Profiles: map[string]parentalProfile{"a": {Users: []string{"emma"}}, "b": {Users: []string{"emma"}}}}
+	if check_parental_config(twice) == nil {
+		t.Errorf("A user in two profiles was accepted")
+	}
+}
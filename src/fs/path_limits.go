@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// limits on the paths asked for, so that pathological requests get a clear
+// error instead of whatever the file system makes of them. the length is
+// PATH_MAX and the name length NAME_MAX on Linux
+
+const MAX_PATH_LENGTH = 4096
+const MAX_NAME_LENGTH = 255
+const MAX_PATH_DEPTH = 64
+
+var errPathTooLong = errors.New("path too long")
+var errNameTooLong = errors.New("file name too long")
+var errPathTooDeep = errors.New("path too deep")
+
+// check_path_limits checks relative, in a share, and where it is on disk
+func check_path_limits(full_path, relative string) error {
+	if len(full_path) > MAX_PATH_LENGTH {
+		return fmt.Errorf("%w: %d bytes, at most %d", errPathTooLong, len(full_path), MAX_PATH_LENGTH)
+	}
+	depth := 0
+	for _, name := range strings.Split(relative, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if len(name) > MAX_NAME_LENGTH {
+			return fmt.Errorf("%w: %d bytes, at most %d", errNameTooLong, len(name), MAX_NAME_LENGTH)
+		}
+		depth++
+	}
+	if depth > MAX_PATH_DEPTH {
+		return fmt.Errorf("%w: %d levels, at most %d", errPathTooDeep, depth, MAX_PATH_DEPTH)
+	}
+	return nil
+}
+
+// is_path_limit says if err is because a path is over the limits
+func is_path_limit(err error) bool {
+	return errors.Is(err, errPathTooLong) || errors.Is(err, errNameTooLong) || errors.Is(err, errPathTooDeep)
+}
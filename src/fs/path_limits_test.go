@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPathLimits(t *testing.T) {
+	service := &MercuryFsService{
+		Shares:     &HdaShares{Shares: []*HdaShare{{name: "Docs", path: "/var/hda/files/docs"}}},
+		debug_info: new(debugInfo),
+	}
+	ok := []string{"/a/b/c.txt", "/" + strings.Repeat("x", MAX_NAME_LENGTH), strings.Repeat("/d", MAX_PATH_DEPTH)}
+	for _, p := range ok {
+		if _, err := service.fullPathToFile("Docs", p); err != nil {
+			t.Errorf("%.40s refused: %s", p, err)
+		}
+	}
+	bad := map[string]error{
+		"/" + strings.Repeat("x", MAX_NAME_LENGTH+1):     errNameTooLong,
+		strings.Repeat("/d", MAX_PATH_DEPTH+1):           errPathTooDeep,
+		strings.Repeat("/"+strings.Repeat("x", 200), 21): errPathTooLong,
+	}
+	for p, expected := range bad {
+		if _, err := service.fullPathToFile("Docs", p); !is_path_limit(err) || !strings.Contains(err.Error(), expected.Error()) {
+			t.Errorf("%.40s: got %v instead of %v", p, err, expected)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	service.serve_file(recorder, httptest.NewRequest("GET", "/files?s=Docs&p="+strings.Repeat("/d", 100), nil))
+	if recorder.Code != 400 || !strings.Contains(recorder.Body.String(), "path too deep") {
+		t.Errorf("Wrong answer to a deep path: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
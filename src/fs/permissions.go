@@ -0,0 +1,325 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// the permissions and owners of a folder are changed with everything in it
+// with POST /admin/permissions on the local server, for the files uploaded
+// by the apps that Samba does not show to the users:
+//
+//	{"share": "Movies", "path": "/", "mode": "0664", "dir_mode": "2775",
+//	 "owner": "alice", "group": "users", "dry_run": true}
+//
+// mode is for the files, dir_mode for the directories, in octal, and owner
+// and group are names or ids; any of them can be left out. with dry_run,
+// the answer has what would change, the first PERMISSIONS_PREVIEW entries
+// and the counts, and nothing is changed. without it, the changes are made
+// by a job, "permissions:<share>", whose progress is in /jobs. the links
+// are left as they are, not to change what they point to
+
+const PERMISSIONS_PREVIEW = 100
+
+var errPermissionsEmpty = errors.New("mode, dir_mode, owner or group is needed")
+var errPermissionsMode = errors.New("the modes are in octal, up to 7777")
+var errPermissionsRunning = errors.New("the permissions of this share are being changed")
+var errPermissionsPath = errors.New("no such folder in the share")
+
+type permissionsRequest struct {
+	Share   string `json:"share"`
+	Path    string `json:"path"`
+	Mode    string `json:"mode"`
+	DirMode string `json:"dir_mode"`
+	Owner   string `json:"owner"`
+	Group   string `json:"group"`
+	DryRun  bool   `json:"dry_run"`
+}
+
+// permissionsChange is what a request changes, -1 for what it leaves
+type permissionsChange struct {
+	root     string
+	mode     os.FileMode
+	dir_mode os.FileMode
+	has_mode bool
+	has_dir  bool
+	uid      int
+	gid      int
+}
+
+// permissionsEntry is how an entry changes
+type permissionsEntry struct {
+	Path    string   `json:"path"`
+	Changes []string `json:"changes"`
+}
+
+type permissionsResult struct {
+	Entries int64              `json:"entries"`
+	Changed int64              `json:"changed"`
+	Errors  int64              `json:"errors"`
+	Error   string             `json:"error,omitempty"`
+	Preview []permissionsEntry `json:"preview,omitempty"`
+}
+
+// permissions_mode is the mode in octal
+func permissions_mode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, errPermissionsMode
+	}
+	// the bits of chmod(2), as os.FileMode has its own for them
+	result := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		result |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		result |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		result |= os.ModeSticky
+	}
+	return result, nil
+}
+
+// octal_mode is mode in octal, like chmod(1)
+func octal_mode(mode os.FileMode) string {
+	bits := uint32(mode & os.ModePerm)
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
+
+// permissions_id is the id of a user or group, by name or id, -1 for none
+func permissions_id(name string, lookup func(string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+func lookup_user(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookup_group(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// permissions_change checks a request, with the root it changes
+func permissions_change(root string, request *permissionsRequest) (*permissionsChange, error) {
+	change := &permissionsChange{root: root, uid: -1, gid: -1}
+	if request.Mode == "" && request.DirMode == "" && request.Owner == "" && request.Group == "" {
+		return nil, errPermissionsEmpty
+	}
+	var err error
+	if request.Mode != "" {
+		if change.mode, err = permissions_mode(request.Mode); err != nil {
+			return nil, err
+		}
+		change.has_mode = true
+	}
+	if request.DirMode != "" {
+		if change.dir_mode, err = permissions_mode(request.DirMode); err != nil {
+			return nil, err
+		}
+		change.has_dir = true
+	}
+	if change.uid, err = permissions_id(request.Owner, lookup_user); err != nil {
+		return nil, err
+	}
+	if change.gid, err = permissions_id(request.Group, lookup_group); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// changes is what changes for an entry, nil for nothing
+func (this *permissionsChange) changes(fi os.FileInfo) []string {
+	var changes []string
+	mode, has_mode := this.mode, this.has_mode
+	if fi.IsDir() {
+		mode, has_mode = this.dir_mode, this.has_dir
+	}
+	current := fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if has_mode && current != mode {
+		changes = append(changes, fmt.Sprintf("mode %s -> %s", octal_mode(current), octal_mode(mode)))
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if this.uid >= 0 && int(stat.Uid) != this.uid {
+			changes = append(changes, fmt.Sprintf("owner %d -> %d", stat.Uid, this.uid))
+		}
+		if this.gid >= 0 && int(stat.Gid) != this.gid {
+			changes = append(changes, fmt.Sprintf("group %d -> %d", stat.Gid, this.gid))
+		}
+	}
+	return changes
+}
+
+// apply changes the entry at path
+func (this *permissionsChange) apply(path string, fi os.FileInfo) error {
+	if this.uid >= 0 || this.gid >= 0 {
+		if err := os.Lchown(path, this.uid, this.gid); err != nil {
+			return err
+		}
+	}
+	mode, has_mode := this.mode, this.has_mode
+	if fi.IsDir() {
+		mode, has_mode = this.dir_mode, this.has_dir
+	}
+	if has_mode {
+		// after chown, which clears the setuid and setgid bits
+		return os.Chmod(path, mode)
+	}
+	return nil
+}
+
+// walk goes over the entries under the root, changing them unless dry_run
+func (this *permissionsChange) walk(dry_run bool, total int64, progress func(done, total int64)) *permissionsResult {
+	result := &permissionsResult{}
+	filepath.Walk(this.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			result.Errors++
+			if result.Error == "" {
+				result.Error = err.Error()
+			}
+			return nil
+		}
+		result.Entries++
+		if progress != nil && result.Entries%1000 == 0 {
+			progress(result.Entries, total)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		changes := this.changes(fi)
+		if changes == nil {
+			return nil
+		}
+		if dry_run {
+			result.Changed++
+			if len(result.Preview) < PERMISSIONS_PREVIEW {
+				rel, _ := filepath.Rel(this.root, path)
+				result.Preview = append(result.Preview, permissionsEntry{Path: filepath.ToSlash(filepath.Join("/", rel)), Changes: changes})
+			}
+			return nil
+		}
+		if err := this.apply(path, fi); err != nil {
+			result.Errors++
+			if result.Error == "" {
+				result.Error = err.Error()
+			}
+			return nil
+		}
+		result.Changed++
+		return nil
+	})
+	return result
+}
+
+func permissions_job_name(share string) string {
+	return "permissions:" + share
+}
+
+// permissions_job changes the permissions, once
+func permissions_job(change *permissionsChange, total int64) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		result := change.walk(false, total, progress)
+		summary := fmt.Sprintf("%d of %d entries changed, %d errors", result.Changed, result.Entries, result.Errors)
+		if result.Errors > 0 && result.Changed == 0 {
+			return summary, errors.New(result.Error)
+		}
+		if result.Error != "" {
+			summary += ", the first: " + result.Error
+		}
+		return summary, nil
+	}
+}
+
+// POST /admin/permissions changes the permissions of a folder, and of
+// everything in it
+func (service *MercuryFsService) admin_permissions(writer http.ResponseWriter, request *http.Request) {
+	if service.share_admin_denied(writer, request) {
+		return
+	}
+	var body permissionsRequest
+	err := json.NewDecoder(io.LimitReader(request.Body, 64<<10)).Decode(&body)
+	share := service.Shares.Get(body.Share)
+	if err == nil && share == nil {
+		err = errShareNotFound
+	}
+	var change *permissionsChange
+	if err == nil {
+		var root string
+		if root, err = service.fullPathToFile(share.name, body.Path); err == nil {
+			if _, err = os.Lstat(root); os.IsNotExist(err) {
+				err = errPermissionsPath
+			} else if err == nil {
+				change, err = permissions_change(root, &body)
+			}
+		}
+	}
+	if err != nil {
+		service.share_admin_answer(writer, request, 0, nil, err)
+		return
+	}
+	if body.DryRun {
+		service.share_admin_answer(writer, request, http.StatusOK, change.walk(true, 0, nil), nil)
+		return
+	}
+	name := permissions_job_name(share.name)
+	if j, ok := scheduler.get(name); ok && (j.State == "running" || j.State == "queued") {
+		service.share_admin_answer(writer, request, 0, nil, errPermissionsRunning)
+		return
+	}
+	// the index knows about how many entries there are
+	total := int64(0)
+	if body.Path == "" || body.Path == "/" {
+		count, _ := share_index.stats(share.name)
+		total = int64(count)
+	}
+	scheduler.add(name, 0, 0, permissions_job(change, total))
+	j, err := scheduler.trigger(name)
+	if err == nil {
+		log("Changing the permissions of %s in %s", body.Path, share.name)
+	}
+	service.share_admin_answer(writer, request, http.StatusAccepted, j, err)
+}
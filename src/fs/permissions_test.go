@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAdminPermissions(t *testing.T) {
+	saved_config, saved_scheduler := config, scheduler
+	defer func() { config, scheduler = saved_config, saved_scheduler }()
+	config = default_config()
+	config.Admin.Token = "letmein"
+	scheduler = new_job_scheduler()
+	dir, _ := ioutil.TempDir("", "permissions")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "Uploads", "Camera"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "Uploads", "a.jpg"), []byte("a"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "Uploads", "Camera", "b.jpg"), []byte("b"), 0644)
+	os.Symlink("/etc/passwd", filepath.Join(dir, "Uploads", "link"))
+
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Photos", path: dir}}}, debug_info: new(debugInfo)}
+	serve := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/admin/permissions", strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer letmein")
+		service.admin_permissions(recorder, request)
+		return recorder
+	}
+	mode := func(name string) os.FileMode {
+		fi, _ := os.Stat(filepath.Join(dir, "Uploads", name))
+		return fi.Mode()
+	}
+	group := strconv.Itoa(os.Getgid())
+
+	preview := serve(`{"share": "Photos", "path": "/Uploads", "mode": "0664", "dir_mode": "2775", "group": "` + group + `", "dry_run": true}`)
+	var result permissionsResult
+	json.Unmarshal(preview.Body.Bytes(), &result)
+	if preview.Code != 200 || result.Entries != 5 || result.Changed != 4 || len(result.Preview) != 4 {
+		t.Fatalf("Wrong preview: %d %s", preview.Code, preview.Body.String())
+	}
+	if result.Preview[0].Path != "/" || result.Preview[0].Changes[0] != "mode 0700 -> 2775" {
+		t.Errorf("Wrong preview of the folder: %+v", result.Preview[0])
+	}
+	if mode("a.jpg").Perm() != 0600 {
+		t.Errorf("Changed by the preview")
+	}
+
+	accepted := serve(`{"share": "Photos", "path": "/Uploads", "mode": "0664", "dir_mode": "2775", "group": "` + group + `"}`)
+	if accepted.Code != 202 {
+		t.Fatalf("Not started: %d %s", accepted.Code, accepted.Body.String())
+	}
+	if busy := serve(`{"share": "Photos", "path": "/", "mode": "0644"}`); busy.Code != 409 {
+		t.Errorf("Started twice: %d", busy.Code)
+	}
+	scheduler.run_due()
+	j, _ := scheduler.get(permissions_job_name("Photos"))
+	if j.Error != "" || !strings.HasPrefix(j.Result, "4 of 5 entries changed") {
+		t.Errorf("Wrong job: %+v", j)
+	}
+	if mode("a.jpg").Perm() != 0664 || mode("Camera/b.jpg").Perm() != 0664 || mode("Camera")&os.ModeSetgid == 0 {
+		t.Errorf("Not changed: %s %s %s", mode("a.jpg"), mode("Camera/b.jpg"), mode("Camera"))
+	}
+	if fi, _ := os.Stat("/etc/passwd"); fi.Mode().Perm() == 0664 {
+		t.Errorf("Changed through a link")
+	}
+
+	for body, status := range map[string]int{`{"share": "Photos", "path": "/"}`: 400,
+		`{"share": "Photos", "path": "/", "mode": "0999"}`: 400, `{"share": "Photos", "path": "/", "owner": "no-such-user-here"}`: 400,
+		`{"share": "Nope", "path": "/", "mode": "0644"}`: 404, `{"share": "Photos", "path": "/gone", "mode": "0644"}`: 404} {
+		if response := serve(body); response.Code != status {
+			t.Errorf("%d instead of %d for %s", response.Code, status, body)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a timeline of the pictures in the shares tagged photos or pictures, by
+// the date they were taken, from their EXIF tags or else their mtime. like
+// the music library, it follows the index of the shares and only reads the
+// tags of the files that changed. the pictures with a GPS position are also
+// grouped into places
+
+const PHOTO_LIBRARY_JOB = "photo-library"
+
+// places are the pictures within a tenth of a degree, some 10km
+const PLACE_PRECISION = 10
+
+type photoItem struct {
+	ID        string    `json:"id"`
+	Share     string    `json:"share"`
+	Path      string    `json:"path"`
+	Taken     time.Time `json:"taken"`
+	Dated     bool      `json:"dated"`
+	Width     int       `json:"width,omitempty"`
+	Height    int       `json:"height,omitempty"`
+	Make      string    `json:"make,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	Latitude  float64   `json:"latitude,omitempty"`
+	Longitude float64   `json:"longitude,omitempty"`
+
+	size  int64
+	mtime time.Time
+}
+
+type photoBucket struct {
+	Year  int `json:"year"`
+	Month int `json:"month"`
+	Count int `json:"count"`
+}
+
+type photoPlace struct {
+	Latitude  float64    `json:"latitude"`
+	Longitude float64    `json:"longitude"`
+	Count     int        `json:"count"`
+	From      time.Time  `json:"from"`
+	To        time.Time  `json:"to"`
+	Cover     *photoItem `json:"cover"`
+}
+
+type photoLibrary struct {
+	// by share and path
+	photos  map[string]*photoItem
+	cursors map[string]string
+	sync.RWMutex
+}
+
+var photo_library = new_photo_library()
+
+func new_photo_library() *photoLibrary {
+	return &photoLibrary{photos: make(map[string]*photoItem), cursors: make(map[string]string)}
+}
+
+// is_photos says if a share is tagged as having pictures
+func (s *HdaShare) is_photos() bool {
+	for _, tag := range s.tags_list() {
+		if tag = strings.ToLower(tag); tag == "photos" || tag == "pictures" {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *photoItem) located() bool {
+	return this.Latitude != 0 || this.Longitude != 0
+}
+
+// photo_item makes the item of a picture, from its tags if it has any
+func photo_item(share string, entry indexEntry, tags *mediaTags) *photoItem {
+	photo := &photoItem{
+		ID:    sha1string(library_key(share, entry.Path))[:16],
+		Share: share,
+		Path:  entry.Path,
+		Taken: entry.Mtime,
+		size:  entry.Size,
+		mtime: entry.Mtime,
+	}
+	if tags != nil {
+		if tags.Taken != nil && !tags.Taken.IsZero() {
+			photo.Taken, photo.Dated = *tags.Taken, true
+		}
+		photo.Width, photo.Height = tags.Width, tags.Height
+		photo.Make, photo.Model = tags.Make, tags.Model
+		photo.Latitude, photo.Longitude = tags.Latitude, tags.Longitude
+	}
+	return photo
+}
+
+// update follows the changes to the index of the photo shares, reading the
+// tags of the pictures that are new or changed
+func (this *photoLibrary) update(shares *HdaShares, progress func(done, total int64)) (int, int) {
+	shares.RLock()
+	list := append([]*HdaShare{}, shares.Shares...)
+	shares.RUnlock()
+	photos := make(map[string]bool)
+	changed, removed := 0, 0
+	for _, share := range list {
+		if !share.is_photos() || is_homes_share(share.name) {
+			// the home folders are only for their users
+			continue
+		}
+		photos[share.name] = true
+		this.RLock()
+		cursor := this.cursors[share.name]
+		this.RUnlock()
+		entries, next, full, err := share_index.changes(share.name, cursor)
+		if err != nil {
+			// not indexed yet
+			continue
+		}
+
+		// the tags are read without holding the lock
+		fresh := make(map[string]*photoItem)
+		gone := []string{}
+		seen := make(map[string]bool)
+		for i, entry := range entries {
+			if progress != nil && i%100 == 0 {
+				progress(int64(i), int64(len(entries)))
+			}
+			key := library_key(share.name, entry.Path)
+			if entry.IsDir || !strings.HasPrefix(entry.MimeType, "image/") {
+				continue
+			}
+			if entry.Deleted {
+				gone = append(gone, key)
+				continue
+			}
+			seen[key] = true
+			this.RLock()
+			old := this.photos[key]
+			this.RUnlock()
+			if old != nil && old.size == entry.Size && old.mtime.Equal(entry.Mtime) {
+				continue
+			}
+			tags, _ := read_media_tags(share.path + entry.Path)
+			fresh[key] = photo_item(share.name, entry, tags)
+		}
+
+		this.Lock()
+		for key, photo := range fresh {
+			this.photos[key] = photo
+			changed++
+		}
+		for _, key := range gone {
+			if _, ok := this.photos[key]; ok {
+				delete(this.photos, key)
+				removed++
+			}
+		}
+		if full {
+			// everything is listed, so what's not there is gone
+			for key, photo := range this.photos {
+				if photo.Share == share.name && !seen[key] {
+					delete(this.photos, key)
+					removed++
+				}
+			}
+		}
+		this.cursors[share.name] = next
+		this.Unlock()
+	}
+
+	// shares that are gone or no longer have photos
+	this.Lock()
+	for key, photo := range this.photos {
+		if !photos[photo.Share] {
+			delete(this.photos, key)
+			removed++
+		}
+	}
+	for name := range this.cursors {
+		if !photos[name] {
+			delete(this.cursors, name)
+		}
+	}
+	this.Unlock()
+	return changed, removed
+}
+
+// job keeps the library up to date
+func (this *photoLibrary) job(shares *HdaShares) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		changed, removed := this.update(shares, progress)
+		this.RLock()
+		total := len(this.photos)
+		this.RUnlock()
+		return fmt.Sprintf("%d pictures, %d added or changed, %d removed", total, changed, removed), nil
+	}
+}
+
+func (this *photoLibrary) status() map[string]int {
+	this.RLock()
+	defer this.RUnlock()
+	located := 0
+	for _, photo := range this.photos {
+		if photo.located() {
+			located++
+		}
+	}
+	return map[string]int{"pictures": len(this.photos), "located": located}
+}
+
+// select_photos returns the pictures for which keep is true, the latest
+// first
+func (this *photoLibrary) select_photos(keep func(*photoItem) bool) []photoItem {
+	this.RLock()
+	photos := []photoItem{}
+	for _, photo := range this.photos {
+		if keep(photo) {
+			photos = append(photos, *photo)
+		}
+	}
+	this.RUnlock()
+	sort.Slice(photos, func(i, j int) bool {
+		a, b := photos[i], photos[j]
+		if !a.Taken.Equal(b.Taken) {
+			return a.Taken.After(b.Taken)
+		}
+		if a.Share != b.Share {
+			return a.Share < b.Share
+		}
+		return file_name_less(a.Path, b.Path)
+	})
+	return photos
+}
+
+// photo_buckets counts the pictures of every month, the latest first
+func photo_buckets(photos []photoItem) []photoBucket {
+	buckets := []photoBucket{}
+	for _, photo := range photos {
+		year, month := photo.Taken.Year(), int(photo.Taken.Month())
+		if n := len(buckets); n > 0 && buckets[n-1].Year == year && buckets[n-1].Month == month {
+			buckets[n-1].Count++
+			continue
+		}
+		buckets = append(buckets, photoBucket{Year: year, Month: month, Count: 1})
+	}
+	return buckets
+}
+
+// photo_places groups the pictures with a position, the places with the
+// most pictures first
+func photo_places(photos []photoItem) []photoPlace {
+	round := func(degrees float64) float64 { return math.Round(degrees*PLACE_PRECISION) / PLACE_PRECISION }
+	index := make(map[[2]float64]int)
+	places := []photoPlace{}
+	for i := range photos {
+		photo := &photos[i]
+		if !photo.located() {
+			continue
+		}
+		key := [2]float64{round(photo.Latitude), round(photo.Longitude)}
+		n, ok := index[key]
+		if !ok {
+			n = len(places)
+			index[key] = n
+			// the latest picture, as they come the latest first
+			places = append(places, photoPlace{Latitude: key[0], Longitude: key[1], To: photo.Taken, Cover: photo})
+		}
+		places[n].Count++
+		places[n].From = photo.Taken
+	}
+	sort.SliceStable(places, func(i, j int) bool { return places[i].Count > places[j].Count })
+	return places
+}
+
+// GET /photos/timeline[?year=y[&month=m]], the buckets of every month and
+// a page of the pictures, the latest first
+func (service *MercuryFsService) photos_timeline(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL.Query()
+	year, _ := strconv.Atoi(q.Get("year"))
+	month, _ := strconv.Atoi(q.Get("month"))
+	offset, err := decode_continuation(q.Get("continuation"), "t")
+	first, _ := strconv.Atoi(offset)
+	if err != nil || first < 0 {
+		size := json_response(writer, http.StatusBadRequest, map[string]string{"error": errBadContinuation.Error()})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" 400 %d \"%s\"", pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+		return
+	}
+	all := photo_library.select_photos(func(*photoItem) bool { return true })
+	photos := []photoItem{}
+	for _, photo := range all {
+		if (year == 0 || photo.Taken.Year() == year) && (month == 0 || int(photo.Taken.Month()) == month) {
+			photos = append(photos, photo)
+		}
+	}
+	if first > len(photos) {
+		first = len(photos)
+	}
+	photos = photos[first:]
+	if limit := listing_limit(request); limit > 0 && len(photos) > limit {
+		photos = photos[:limit]
+		writer.Header().Set(CONTINUATION_HEADER, encode_continuation("t", strconv.Itoa(first+limit)))
+	}
+	service.library_response(writer, request, map[string]interface{}{"buckets": photo_buckets(all), "photos": photos})
+}
+
+// GET /photos/places
+func (service *MercuryFsService) photos_places(writer http.ResponseWriter, request *http.Request) {
+	photos := photo_library.select_photos(func(photo *photoItem) bool { return photo.located() })
+	service.library_response(writer, request, photo_places(photos))
+}
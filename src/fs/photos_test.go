@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// exif_jpeg is a JPEG with only the date it was taken in its EXIF
+func exif_jpeg(taken string) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	tiff = append(tiff, 0x01, 0x32, 0, 2, 0, 0, 0, 20, 0, 0, 0, 26)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, taken+"\x00"...)
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	jpeg := append([]byte{0xff, 0xd8, 0xff, 0xe1, byte((len(app1) + 2) >> 8), byte(len(app1) + 2)}, app1...)
+	return append(jpeg, 0xff, 0xd9)
+}
+
+func TestPhotoTimeline(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "photos")
+	defer os.RemoveAll(dir)
+	saved_index, saved_library := share_index, photo_library
+	defer func() { share_index, photo_library = saved_index, saved_library }()
+	share_index = new_hda_index()
+	photo_library = new_photo_library()
+
+	pictures := filepath.Join(dir, "pictures")
+	os.MkdirAll(filepath.Join(pictures, "2019"), 0755)
+	ioutil.WriteFile(filepath.Join(pictures, "2019", "beach.jpg"), exif_jpeg("2019:07:04 10:00:00"), 0644)
+	ioutil.WriteFile(filepath.Join(pictures, "2019", "party.jpg"), exif_jpeg("2019:07:20 22:00:00"), 0644)
+	ioutil.WriteFile(filepath.Join(pictures, "scan.png"), []byte("png"), 0644)
+	ioutil.WriteFile(filepath.Join(pictures, "notes.txt"), []byte("x"), 0644)
+	scanned := time.Date(2018, 1, 15, 12, 0, 0, 0, time.Local)
+	os.Chtimes(filepath.Join(pictures, "scan.png"), scanned, scanned)
+	share := &HdaShare{name: "Pictures", path: pictures, tags: "pictures"}
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{share, {name: "Docs", path: dir}}}, debug_info: new(debugInfo)}
+	share_index.scan(share.name, share.path, nil, nil, nil)
+
+	if changed, removed := photo_library.update(service.Shares, nil); changed != 3 || removed != 0 {
+		t.Fatalf("%d changed and %d removed instead of 3 and 0", changed, removed)
+	}
+
+	var timeline struct {
+		Buckets []photoBucket
+		Photos  []photoItem
+	}
+	recorder := httptest.NewRecorder()
+	service.photos_timeline(recorder, httptest.NewRequest("GET", "/photos/timeline?limit=1", nil))
+	json.Unmarshal(recorder.Body.Bytes(), &timeline)
+	next := recorder.Header().Get(CONTINUATION_HEADER)
+	if len(timeline.Buckets) != 2 || timeline.Buckets[0] != (photoBucket{2019, 7, 2}) || timeline.Buckets[1] != (photoBucket{2018, 1, 1}) {
+		t.Errorf("Wrong buckets: %v", timeline.Buckets)
+	}
+	if len(timeline.Photos) != 1 || timeline.Photos[0].Path != "/2019/party.jpg" || !timeline.Photos[0].Dated || next == "" {
+		t.Fatalf("Wrong first page: %s", recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	service.photos_timeline(recorder, httptest.NewRequest("GET", "/photos/timeline?year=2019&month=7&limit=1&continuation="+next, nil))
+	json.Unmarshal(recorder.Body.Bytes(), &timeline)
+	if len(timeline.Photos) != 1 || timeline.Photos[0].Path != "/2019/beach.jpg" || recorder.Header().Get(CONTINUATION_HEADER) != "" {
+		t.Errorf("Wrong second page: %s", recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	service.photos_timeline(recorder, httptest.NewRequest("GET", "/photos/timeline?year=2018", nil))
+	json.Unmarshal(recorder.Body.Bytes(), &timeline)
+	if len(timeline.Photos) != 1 || timeline.Photos[0].Dated || !timeline.Photos[0].Taken.Equal(scanned) {
+		t.Errorf("Wrong pictures of 2018: %s", recorder.Body.String())
+	}
+}
+
+func TestPhotoPlaces(t *testing.T) {
+	day := func(d int) *time.Time {
+		taken := time.Date(2020, 5, d, 0, 0, 0, 0, time.UTC)
+		return &taken
+	}
+	photos := []photoItem{}
+	for i, tags := range []*mediaTags{
+		{Taken: day(3), Latitude: 48.8584, Longitude: 2.2945},
+		{Taken: day(2)},
+		{Taken: day(2), Latitude: 40.6892, Longitude: -74.0445},
+		{Taken: day(1), Latitude: 48.8606, Longitude: 2.3376},
+	} {
+		photos = append(photos, *photo_item("Pictures", indexEntry{Path: string(rune('a' + i))}, tags))
+	}
+	places := photo_places(photos)
+	if len(places) != 2 || places[0].Count != 2 || places[0].Latitude != 48.9 || places[0].Longitude != 2.3 {
+		t.Fatalf("Wrong places: %v", places)
+	}
+	if !places[0].From.Equal(*day(1)) || !places[0].To.Equal(*day(3)) || places[0].Cover.Path != "a" {
+		t.Errorf("Wrong place: %+v", places[0])
+	}
+}
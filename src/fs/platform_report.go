@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the state of the HDA is reported to the Amahi platform when it changes,
+// so that it does not need to poll: which shares are available, how full
+// their disks are, and the version of the fs. the report is sent with the
+// same credentials as the relay, again every day even if nothing changed,
+// and at the next check if it failed
+
+// where the reports go by default, "url" in the platform section of the
+// config, with "" to not send them
+const PLATFORM_API_URL = "https://api.amahi.org/api2/hda/fs_status"
+
+const PLATFORM_REPORT_JOB = "platform-report"
+const PLATFORM_REPORT_REFRESH = 24 * time.Hour
+const PLATFORM_REPORT_TIMEOUT = 30 * time.Second
+
+type platformShare struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+	Problem   string `json:"problem,omitempty"`
+}
+
+type platformDisk struct {
+	Path        string   `json:"path"`
+	Shares      []string `json:"shares"`
+	Total       uint64   `json:"total"`
+	UsedPercent int      `json:"used_percent"`
+	Alert       bool     `json:"alert"`
+}
+
+type platformReport struct {
+	Version  string          `json:"version"`
+	Platform string          `json:"platform"`
+	Shares   []platformShare `json:"shares"`
+	Disks    []platformDisk  `json:"disks"`
+}
+
+type platformReporter struct {
+	url string
+	// the last report sent, and when
+	last      []byte
+	last_sent time.Time
+	sent      int64
+	failed    int64
+	last_err  string
+	sync.Mutex
+}
+
+var platform_reporter = new_platform_reporter(PLATFORM_API_URL)
+
+func new_platform_reporter(url string) *platformReporter {
+	return &platformReporter{url: url}
+}
+
+// disk_usage is the device, size and free space of the file system of path,
+// replaced in tests
+var disk_usage = func(path string) (uint64, uint64, uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, 0, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	device := uint64(0)
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		device = uint64(stat.Dev)
+	}
+	return device, uint64(fs.Blocks) * uint64(fs.Bsize), uint64(fs.Bavail) * uint64(fs.Bsize), nil
+}
+
+// platform_report is the state of the shares and their disks
+func platform_report(shares *HdaShares) *platformReport {
+	shares.RLock()
+	list := make([]HdaShare, 0, len(shares.Shares))
+	for _, share := range shares.Shares {
+		list = append(list, HdaShare{name: share.name, path: share.path, problem: share.problem, network: share.network})
+	}
+	shares.RUnlock()
+	report := &platformReport{Version: VERSION, Platform: PLATFORM, Shares: []platformShare{}, Disks: []platformDisk{}}
+	disks := make(map[uint64]int)
+	for _, share := range list {
+		report.Shares = append(report.Shares, platformShare{Name: share.name, Available: share.problem == "", Problem: share.problem})
+		// the disks of network shares are someone else's, and may hang
+		if share.problem != "" || share.network {
+			continue
+		}
+		device, total, free, err := disk_usage(share.path)
+		if err != nil || total == 0 {
+			continue
+		}
+		if i, ok := disks[device]; ok {
+			report.Disks[i].Shares = append(report.Disks[i].Shares, share.name)
+			continue
+		}
+		used := int((total - free) * 100 / total)
+		disks[device] = len(report.Disks)
+		report.Disks = append(report.Disks, platformDisk{
+			Path:        share.path,
+			Shares:      []string{share.name},
+			Total:       total,
+			UsedPercent: used,
+			Alert:       used >= config.Platform.DiskAlert,
+		})
+	}
+	sort.Slice(report.Shares, func(i, j int) bool { return report.Shares[i].Name < report.Shares[j].Name })
+	return report
+}
+
+// send posts a report to the platform
+func (this *platformReporter) send(data []byte, creds relayCredentials) error {
+	request, err := http.NewRequest("POST", this.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Api-Key", creds.api_key)
+	request.Header.Set("Authorization", fmt.Sprintf("Token %s", creds.token))
+	client := &http.Client{Timeout: PLATFORM_REPORT_TIMEOUT}
+	sent := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	clock.observe(sent, response)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s", response.Status)
+	}
+	return nil
+}
+
+// job reports the state of the shares when it changed, with the credentials
+// of the relay
+func (this *platformReporter) job(shares *HdaShares, credentials func() relayCredentials) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		data, err := json.Marshal(platform_report(shares))
+		if err != nil {
+			return "", err
+		}
+		this.Lock()
+		unchanged := bytes.Equal(data, this.last) && time.Since(this.last_sent) < PLATFORM_REPORT_REFRESH
+		this.Unlock()
+		if unchanged {
+			return "nothing changed", nil
+		}
+		err = this.send(data, credentials())
+		this.Lock()
+		defer this.Unlock()
+		if err != nil {
+			this.failed++
+			this.last_err = err.Error()
+			return "", err
+		}
+		this.last, this.last_sent, this.last_err = data, time.Now(), ""
+		this.sent++
+		return fmt.Sprintf("reported %d bytes", len(data)), nil
+	}
+}
+
+func (this *platformReporter) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	status := map[string]interface{}{"sent": this.sent, "failed": this.failed}
+	if !this.last_sent.IsZero() {
+		status["last_sent"] = this.last_sent
+	}
+	if this.last_err != "" {
+		status["last_error"] = this.last_err
+	}
+	return status
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPlatformReport(t *testing.T) {
+	reports := []platformReport{}
+	status := 200
+	platform := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Api-Key") != "key" || request.Header.Get("Authorization") != "Token token" {
+			t.Errorf("Wrong credentials: %v", request.Header)
+		}
+		var report platformReport
+		data, _ := ioutil.ReadAll(request.Body)
+		json.Unmarshal(data, &report)
+		reports = append(reports, report)
+		writer.WriteHeader(status)
+	}))
+	defer platform.Close()
+
+	saved := disk_usage
+	defer func() { disk_usage = saved }()
+	usage := map[string][3]uint64{"/data/movies": {1, 1000, 500}, "/data/music": {1, 1000, 500}, "/backup": {2, 1000, 50}}
+	disk_usage = func(path string) (uint64, uint64, uint64, error) {
+		if u, ok := usage[path]; ok {
+			return u[0], u[1], u[2], nil
+		}
+		return 0, 0, 0, errors.New("no such disk")
+	}
+	shares := &HdaShares{Shares: []*HdaShare{
+		{name: "Movies", path: "/data/movies"},
+		{name: "Music", path: "/data/music"},
+		{name: "Backups", path: "/backup"},
+		{name: "NAS", path: "/mnt/nas", network: true},
+	}}
+	reporter := new_platform_reporter(platform.URL)
+	run := reporter.job(shares, func() relayCredentials { return relayCredentials{api_key: "key", token: "token"} })
+
+	if _, err := run(func(done, total int64) {}); err != nil || len(reports) != 1 {
+		t.Fatalf("The state was not reported: %v", err)
+	}
+	report := reports[0]
+	if report.Version != VERSION || len(report.Shares) != 4 || report.Shares[0].Name != "Backups" || !report.Shares[0].Available {
+		t.Errorf("Wrong shares: %+v", report)
+	}
+	if len(report.Disks) != 2 || len(report.Disks[0].Shares) != 2 || report.Disks[0].UsedPercent != 50 || report.Disks[0].Alert ||
+		report.Disks[1].UsedPercent != 95 || !report.Disks[1].Alert {
+		t.Errorf("Wrong disks: %+v", report.Disks)
+	}
+
+	// only changes are reported
+	run(func(done, total int64) {})
+	if len(reports) != 1 {
+		t.Errorf("An unchanged state was reported")
+	}
+	shares.Shares[2].problem = "the path does not exist"
+	status = 500
+	if _, err := run(func(done, total int64) {}); err == nil || len(reports) != 2 {
+		t.Errorf("The failure was not seen: %v", err)
+	}
+	status = 200
+	run(func(done, total int64) {})
+	if len(reports) != 3 || reports[2].Shares[0].Available || len(reports[2].Disks) != 1 {
+		t.Errorf("The unavailable share was not reported again: %+v", reports)
+	}
+	if s := reporter.status(); s["sent"] != int64(2) || s["failed"] != int64(1) || s["last_error"] != nil {
+		t.Errorf("Wrong status: %v", s)
+	}
+}
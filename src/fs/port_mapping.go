@@ -0,0 +1,365 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the port mappings of the router, asked for with NAT-PMP, or else with
+// UPnP IGD, for direct connections to the local server, see direct.go
+
+type portMapper interface {
+	name() string
+	external_ip() (net.IP, error)
+	// add maps external to internal for lease, and returns the port mapped,
+	// which the router can change
+	add(internal, external int, lease time.Duration) (int, error)
+	remove(internal, external int) error
+}
+
+// NAT-PMP, RFC 6886
+
+const NAT_PMP_VERSION = 0
+const NAT_PMP_OP_EXTERNAL = 0
+const NAT_PMP_OP_TCP = 2
+
+// the tries of a request, the first after 250ms and doubling, short of
+// the 9 of the RFC, as the relay is always there to fall back on
+const NAT_PMP_TRIES = 4
+
+// for the tests
+var nat_pmp_port = 5351
+
+type natPMP struct {
+	gateway string
+}
+
+func new_nat_pmp(gateway net.IP) *natPMP {
+	return &natPMP{gateway: net.JoinHostPort(gateway.String(), strconv.Itoa(nat_pmp_port))}
+}
+
+func (this *natPMP) name() string {
+	return "nat-pmp"
+}
+
+// call sends request to the gateway and returns its answer to op
+func (this *natPMP) call(request []byte, op byte, size int) ([]byte, error) {
+	conn, err := net.Dial("udp", this.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	response := make([]byte, 16)
+	wait := 250 * time.Millisecond
+	for try := 0; try < NAT_PMP_TRIES; try++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+		n, err := conn.Read(response)
+		wait *= 2
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		if n < size || response[0] != NAT_PMP_VERSION || response[1] != op+128 {
+			continue
+		}
+		if result := binary.BigEndian.Uint16(response[2:4]); result != 0 {
+			return nil, fmt.Errorf("NAT-PMP error %d", result)
+		}
+		return response[:n], nil
+	}
+	return nil, errors.New("no answer to NAT-PMP")
+}
+
+func (this *natPMP) external_ip() (net.IP, error) {
+	response, err := this.call([]byte{NAT_PMP_VERSION, NAT_PMP_OP_EXTERNAL}, NAT_PMP_OP_EXTERNAL, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(append([]byte{}, response[8:12]...)), nil
+}
+
+func (this *natPMP) add(internal, external int, lease time.Duration) (int, error) {
+	request := make([]byte, 12)
+	request[0], request[1] = NAT_PMP_VERSION, NAT_PMP_OP_TCP
+	binary.BigEndian.PutUint16(request[4:6], uint16(internal))
+	binary.BigEndian.PutUint16(request[6:8], uint16(external))
+	binary.BigEndian.PutUint32(request[8:12], uint32(lease/time.Second))
+	response, err := this.call(request, NAT_PMP_OP_TCP, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(response[10:12])), nil
+}
+
+// remove is a mapping with no lease
+func (this *natPMP) remove(internal, external int) error {
+	_, err := this.add(internal, 0, 0)
+	return err
+}
+
+// UPnP IGD
+
+const UPNP_SEARCH = "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n"
+const UPNP_SEARCH_TIMEOUT = 3 * time.Second
+
+// upnp_discover finds the description of the router with SSDP. a var for
+// the tests
+var upnp_discover = func() (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	group, _ := net.ResolveUDPAddr("udp4", "239.255.255.250:1900")
+	if _, err := conn.WriteTo([]byte(UPNP_SEARCH), group); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(UPNP_SEARCH_TIMEOUT))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", errors.New("no UPnP router found")
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\r\n") {
+			if parts := strings.SplitN(line, ":", 2); len(parts) == 2 && strings.EqualFold(parts[0], "location") {
+				return strings.TrimSpace(parts[1]), nil
+			}
+		}
+	}
+}
+
+type upnpService struct {
+	Type       string `xml:"serviceType"`
+	ControlURL string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+// wan_service finds the service that maps ports, in device or below it
+func (this upnpDevice) wan_service() *upnpService {
+	for i, service := range this.Services {
+		if strings.Contains(service.Type, ":WANIPConnection:") || strings.Contains(service.Type, ":WANPPPConnection:") {
+			return &this.Services[i]
+		}
+	}
+	for _, device := range this.Devices {
+		if service := device.wan_service(); service != nil {
+			return service
+		}
+	}
+	return nil
+}
+
+type upnpIGD struct {
+	control, service_type string
+	// the address of the HDA as the router sees it
+	client string
+}
+
+// new_upnp reads the description of the router at location
+func new_upnp(location string) (*upnpIGD, error) {
+	client := &http.Client{Timeout: UPNP_SEARCH_TIMEOUT}
+	response, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var description struct {
+		Device upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&description); err != nil {
+		return nil, err
+	}
+	service := description.Device.wan_service()
+	if service == nil {
+		return nil, errors.New("the UPnP router cannot map ports")
+	}
+	base, _ := url.Parse(location)
+	control, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+	// the local address that reaches the router
+	conn, err := net.Dial("udp", base.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr).IP.String()
+	return &upnpIGD{control: control.String(), service_type: service.Type, client: local}, nil
+}
+
+func (this *upnpIGD) name() string {
+	return "upnp"
+}
+
+// call makes a SOAP call of action with args, in order, and returns the
+// value of the element named result of the answer, if any
+func (this *upnpIGD) call(action string, args [][2]string, result string) (string, error) {
+	body := new(bytes.Buffer)
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(body, `<u:%s xmlns:u="%s">`, action, this.service_type)
+	for _, arg := range args {
+		fmt.Fprintf(body, "<%s>", arg[0])
+		xml.EscapeText(body, []byte(arg[1]))
+		fmt.Fprintf(body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(body, "</u:%s></s:Body></s:Envelope>", action)
+	request, err := http.NewRequest("POST", this.control, body)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", `"`+this.service_type+"#"+action+`"`)
+	client := &http.Client{Timeout: UPNP_SEARCH_TIMEOUT}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode != http.StatusOK {
+		if code := xml_element(data, "errorCode"); code != "" {
+			return "", fmt.Errorf("UPnP error %s %s", code, xml_element(data, "errorDescription"))
+		}
+		return "", fmt.Errorf("UPnP error %s", response.Status)
+	}
+	if result == "" {
+		return "", nil
+	}
+	return xml_element(data, result), nil
+}
+
+// xml_element is the text of the first element named name in data
+func xml_element(data []byte, name string) string {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == name {
+			var text string
+			decoder.DecodeElement(&text, &start)
+			return strings.TrimSpace(text)
+		}
+	}
+}
+
+func (this *upnpIGD) external_ip() (net.IP, error) {
+	value, err := this.call("GetExternalIPAddress", nil, "NewExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid external address %q", value)
+	}
+	return ip, nil
+}
+
+func (this *upnpIGD) add(internal, external int, lease time.Duration) (int, error) {
+	_, err := this.call("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", "TCP"},
+		{"NewInternalPort", strconv.Itoa(internal)},
+		{"NewInternalClient", this.client},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", "Amahi Anywhere"},
+		{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+	}, "")
+	return external, err
+}
+
+func (this *upnpIGD) remove(internal, external int) error {
+	_, err := this.call("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", "TCP"},
+	}, "")
+	return err
+}
+
+// for the tests
+var route_file = "/proc/net/route"
+
+// default_gateway is the router of the default route
+func default_gateway() (net.IP, error) {
+	if config.Direct.Gateway != "" {
+		if ip := net.ParseIP(config.Direct.Gateway); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("invalid gateway %q", config.Direct.Gateway)
+	}
+	data, err := ioutil.ReadFile(route_file)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		// in hex, little endian
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gateway == 0 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gateway))
+		return ip, nil
+	}
+	return nil, errors.New("no default route")
+}
+
+// find_port_mapper finds what the router speaks, NAT-PMP first
+func find_port_mapper() (portMapper, error) {
+	var errs []string
+	gateway, err := default_gateway()
+	if err == nil {
+		nat_pmp := new_nat_pmp(gateway)
+		if _, err = nat_pmp.external_ip(); err == nil {
+			return nat_pmp, nil
+		}
+	}
+	errs = append(errs, err.Error())
+	location, err := upnp_discover()
+	if err == nil {
+		var igd *upnpIGD
+		if igd, err = new_upnp(location); err == nil {
+			return igd, nil
+		}
+	}
+	errs = append(errs, err.Error())
+	return nil, errors.New(strings.Join(errs, "; "))
+}
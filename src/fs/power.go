@@ -0,0 +1,539 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the platform and the relay ask whether the HDA is up with GET /power,
+// which also has what it takes to wake it up: the MAC and broadcast
+// address of its network interfaces. an HDA that is off can only be woken
+// up from its own network, by a helper, like another HDA or a small board
+// running this server, paired with it: POST /power/pair on the local
+// server of the helper reads them from the HDA, and POST /power/wake on
+// the helper, through its relay too, sends the magic packet of
+// Wake-on-LAN. with power.spin_down, the disks of the shares not used for
+// that long are put to sleep, and GET /power says which are asleep and
+// which are waking up, since that takes a while
+
+const POWER_PAIRED_FILE = DATA_DIR + "/power_paired.json"
+const SPIN_DOWN_JOB = "disk-spin-down"
+
+const (
+	POWER_AWAKE  = "awake"
+	POWER_WAKING = "waking"
+	POWER_ASLEEP = "asleep"
+)
+
+var errNoSuchDevice = errors.New("no such paired device")
+var errBadMAC = errors.New("mac must be like 00:11:22:33:44:55")
+
+// the clock of the power state, for the tests
+var power_started = time.Now()
+
+type powerInterface struct {
+	Name      string `json:"name"`
+	MAC       string `json:"mac"`
+	Broadcast string `json:"broadcast"`
+}
+
+// a device paired with this helper, to wake up
+type pairedDevice struct {
+	Name      string    `json:"name"`
+	MAC       string    `json:"mac"`
+	Broadcast string    `json:"broadcast"`
+	Paired    time.Time `json:"paired"`
+	LastWake  time.Time `json:"last_wake,omitempty"`
+}
+
+type diskState struct {
+	Device  string    `json:"device"`
+	Shares  []string  `json:"shares"`
+	State   string    `json:"state"`
+	LastUse time.Time `json:"last_use"`
+	Since   time.Time `json:"since"`
+}
+
+type powerManager struct {
+	file   string
+	paired map[string]*pairedDevice
+	disks  map[string]*diskState
+	// the disk of each share
+	shares map[string]string
+	sync.Mutex
+}
+
+var power = new_power_manager(POWER_PAIRED_FILE)
+
+func new_power_manager(file string) *powerManager {
+	return &powerManager{file: file, disks: make(map[string]*diskState), shares: make(map[string]string)}
+}
+
+// path_disk is the disk a path is on, like /dev/sda, "" if it's not one
+// that can sleep. replaced in tests
+var path_disk = disk_of
+
+// spin_down_disk puts a disk to sleep, replaced in tests
+var spin_down_disk = func(device string) error {
+	out, err := exec.Command("hdparm", "-y", device).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// send_magic_packet sends the Wake-on-LAN packet of mac to the broadcast
+// address, replaced in tests
+var send_magic_packet = func(mac net.HardwareAddr, broadcast string) error {
+	conn, err := net.Dial("udp", net.JoinHostPort(broadcast, "9"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(magic_packet(mac))
+	return err
+}
+
+// magic_packet is six 0xff and the MAC sixteen times
+func magic_packet(mac net.HardwareAddr) []byte {
+	packet := make([]byte, 0, 6+16*len(mac))
+	for i := 0; i < 6; i++ {
+		packet = append(packet, 0xff)
+	}
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+	return packet
+}
+
+// power_interfaces are the interfaces the HDA can be woken up on
+func power_interfaces() []powerInterface {
+	interfaces := []powerInterface{}
+	all, _ := net.Interfaces()
+	for _, iface := range all {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 || len(iface.HardwareAddr) != 6 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			ip, mask := ipnet.IP.To4(), ipnet.Mask
+			broadcast := make(net.IP, 4)
+			for i := range broadcast {
+				broadcast[i] = ip[i] | ^mask[len(mask)-4+i]
+			}
+			interfaces = append(interfaces, powerInterface{Name: iface.Name, MAC: iface.HardwareAddr.String(), Broadcast: broadcast.String()})
+			break
+		}
+	}
+	return interfaces
+}
+
+// load reads the paired devices the first time they are needed. call with
+// the lock held
+func (this *powerManager) load() {
+	if this.paired != nil {
+		return
+	}
+	this.paired = make(map[string]*pairedDevice)
+	data, err := ioutil.ReadFile(this.file)
+	if err != nil {
+		return
+	}
+	devices := []*pairedDevice{}
+	if err := json.Unmarshal(data, &devices); err != nil {
+		log_error("Error reading the paired devices in %s: %s", this.file, err.Error())
+		return
+	}
+	for _, device := range devices {
+		this.paired[device.Name] = device
+	}
+}
+
+// save writes the paired devices. call with the lock held
+func (this *powerManager) save() error {
+	data, err := json.Marshal(this.sorted())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(this.file), 0755); err != nil {
+		return err
+	}
+	return write_file_atomic(this.file, data, 0600)
+}
+
+// sorted lists copies of the paired devices by name. call with the lock
+// held
+func (this *powerManager) sorted() []pairedDevice {
+	devices := make([]pairedDevice, 0, len(this.paired))
+	for _, device := range this.paired {
+		devices = append(devices, *device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices
+}
+
+func (this *powerManager) pair(device *pairedDevice) error {
+	mac, err := net.ParseMAC(device.MAC)
+	if err != nil || len(mac) != 6 {
+		return errBadMAC
+	}
+	if device.Name == "" || strings.ContainsAny(device.Name, "/\x00") {
+		return errors.New("a name is needed")
+	}
+	if device.Broadcast == "" {
+		device.Broadcast = "255.255.255.255"
+	}
+	if net.ParseIP(device.Broadcast).To4() == nil {
+		return errors.New("broadcast must be an IPv4 address")
+	}
+	device.MAC, device.Paired = mac.String(), time.Now()
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	this.paired[device.Name] = device
+	return this.save()
+}
+
+func (this *powerManager) unpair(name string) (bool, error) {
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	if this.paired[name] == nil {
+		return false, nil
+	}
+	delete(this.paired, name)
+	return true, this.save()
+}
+
+// wake sends the magic packet to a paired device
+func (this *powerManager) wake(name string) (pairedDevice, error) {
+	this.Lock()
+	this.load()
+	device := this.paired[name]
+	if device == nil {
+		this.Unlock()
+		return pairedDevice{}, errNoSuchDevice
+	}
+	device.LastWake = time.Now()
+	woken := *device
+	this.Unlock()
+	mac, _ := net.ParseMAC(woken.MAC)
+	return woken, send_magic_packet(mac, woken.Broadcast)
+}
+
+// pair_remote reads the interfaces of the HDA at addr from its GET /power,
+// over TLS if it has it
+func pair_remote(addr string) ([]powerInterface, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, LOCAL_SERVER_PORT)
+	}
+	client := &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{
+		// it's on the same network, and only its MAC is read
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	var response *http.Response
+	var err error
+	for _, scheme := range []string{"https", "http"} {
+		if response, err = client.Get(scheme + "://" + addr + "/power"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var status struct {
+		Interfaces []powerInterface `json:"interfaces"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	if len(status.Interfaces) == 0 {
+		return nil, fmt.Errorf("%s has no interface to wake it up on", addr)
+	}
+	return status.Interfaces, nil
+}
+
+// use is a request for share, which wakes up its disk if it's asleep.
+// done is when it's served
+func (this *powerManager) use(share string) (done func()) {
+	this.Lock()
+	defer this.Unlock()
+	disk := this.disks[this.shares[share]]
+	if disk == nil {
+		return func() {}
+	}
+	now := time.Now()
+	disk.LastUse = now
+	if disk.State != POWER_ASLEEP {
+		return func() {}
+	}
+	debug(2, "Waking up %s for %s", disk.Device, share)
+	disk.State, disk.Since = POWER_WAKING, now
+	return func() {
+		this.Lock()
+		defer this.Unlock()
+		if disk.State == POWER_WAKING {
+			disk.State, disk.Since = POWER_AWAKE, time.Now()
+			debug(2, "%s woke up in %s", disk.Device, time.Since(now).Round(time.Millisecond))
+		}
+	}
+}
+
+// update_disks finds the disks of the shares
+func (this *powerManager) update_disks(shares *HdaShares) {
+	shares.RLock()
+	list := append([]*HdaShare{}, shares.Shares...)
+	shares.RUnlock()
+	found := make(map[string]string)
+	for _, share := range list {
+		if share.path != "" && share.problem == "" {
+			if device := path_disk(share.path); device != "" {
+				found[share.name] = device
+			}
+		}
+	}
+	this.Lock()
+	defer this.Unlock()
+	this.shares = found
+	disks := make(map[string]*diskState)
+	for share, device := range found {
+		disk := disks[device]
+		if disk == nil {
+			disk = this.disks[device]
+			if disk == nil {
+				disk = &diskState{Device: device, State: POWER_AWAKE, LastUse: time.Now(), Since: time.Now()}
+			}
+			disk.Shares = nil
+			disks[device] = disk
+		}
+		disk.Shares = append(disk.Shares, share)
+		sort.Strings(disk.Shares)
+	}
+	this.disks = disks
+}
+
+// spin_down is a job putting the disks not used for a while to sleep
+func (this *powerManager) spin_down(shares *HdaShares) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		idle, err := time.ParseDuration(config.Power.SpinDown)
+		if err != nil || idle <= 0 {
+			return "spin down disabled", nil
+		}
+		this.update_disks(shares)
+		this.Lock()
+		idle_disks := []*diskState{}
+		asleep := 0
+		for _, disk := range this.disks {
+			if disk.State == POWER_AWAKE && time.Since(disk.LastUse) >= idle {
+				idle_disks = append(idle_disks, disk)
+			} else if disk.State == POWER_ASLEEP {
+				asleep++
+			}
+		}
+		this.Unlock()
+		for _, disk := range idle_disks {
+			if err := spin_down_disk(disk.Device); err != nil {
+				debug(2, "Error spinning down %s: %s", disk.Device, err.Error())
+				continue
+			}
+			this.Lock()
+			// unless a request came meanwhile
+			if disk.State == POWER_AWAKE && time.Since(disk.LastUse) >= idle {
+				disk.State, disk.Since = POWER_ASLEEP, time.Now()
+				asleep++
+			}
+			this.Unlock()
+		}
+		return fmt.Sprintf("%d of %d disks asleep", asleep, len(this.disks)), nil
+	}
+}
+
+// status is the power state, awake, waking when a disk is waking up, or
+// asleep when all of them are
+func (this *powerManager) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	disks := []diskState{}
+	state, asleep := POWER_AWAKE, 0
+	for _, disk := range this.disks {
+		disk_copy := *disk
+		disk_copy.Shares = append([]string{}, disk.Shares...)
+		disks = append(disks, disk_copy)
+		switch disk.State {
+		case POWER_WAKING:
+			state = POWER_WAKING
+		case POWER_ASLEEP:
+			asleep++
+		}
+	}
+	if asleep > 0 && asleep == len(disks) {
+		state = POWER_ASLEEP
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i].Device < disks[j].Device })
+	return map[string]interface{}{
+		"state":      state,
+		"up_since":   power_started.Format(time.RFC3339),
+		"uptime":     time.Since(power_started).Seconds(),
+		"disks":      disks,
+		"interfaces": power_interfaces(),
+		"paired":     this.sorted(),
+		"shares":     disk_wakes.status(),
+	}
+}
+
+// asleep says if the disk of share was put to sleep
+func (this *powerManager) asleep(share string) bool {
+	this.Lock()
+	defer this.Unlock()
+	disk := this.disks[this.shares[share]]
+	return disk != nil && disk.State == POWER_ASLEEP
+}
+
+// is_listing says if a request lists a directory, as far as the index
+// knows, without going to the disk
+func is_listing(request *http.Request) bool {
+	if request.Method != "GET" || request.URL.Path != "/files" {
+		return false
+	}
+	path := request.URL.Query().Get("p")
+	if path == "" || path == "/" {
+		return true
+	}
+	is_dir, _ := share_index.is_dir(request.URL.Query().Get("s"), path)
+	return is_dir
+}
+
+// power_access is a middleware waking up the disk of the share of a
+// request, so that GET /power says it's waking up meanwhile. the listings
+// of a share whose disk is spinning up get a 202 until it's up, see
+// disk_wake.go
+func (service *MercuryFsService) power_access(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		share := request.URL.Query().Get("s")
+		if share == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		asleep := power.asleep(share)
+		done := power.use(share)
+		if is_listing(request) {
+			if full_path, err := service.fullPathToFile(share, request.URL.Query().Get("p")); err == nil {
+				if retry, waking := disk_wakes.wait(share, full_path, asleep, done); waking {
+					seconds := int((retry + time.Second - 1) / time.Second)
+					writer.Header().Set("Retry-After", strconv.Itoa(seconds))
+					size := json_response(writer, http.StatusAccepted, map[string]interface{}{"state": POWER_WAKING, "share": share, "retry_after": seconds})
+					service.debug_info.requestServed(size)
+					log("\"GET %s\" 202 %d \"%s\"", pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+					return
+				}
+			}
+		}
+		defer done()
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// GET /power is the power state of the HDA and how to wake it up
+func (service *MercuryFsService) power_status(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	size := json_response(writer, http.StatusOK, power.status())
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
+
+// POST /power/wake?name=<device> sends the magic packet to a paired device
+func (service *MercuryFsService) power_wake(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status, result := http.StatusAccepted, interface{}(nil)
+	device, err := power.wake(request.FormValue("name"))
+	switch {
+	case err == errNoSuchDevice:
+		status, result = http.StatusNotFound, map[string]string{"error": err.Error()}
+	case err != nil:
+		debug(2, "Error waking up %s: %s", device.Name, err.Error())
+		status, result = http.StatusBadGateway, map[string]string{"error": err.Error()}
+	default:
+		result = device
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+}
+
+// POST /power/pair?name=<name>&addr=<host[:port]>, or &mac=<mac>
+// [&broadcast=<ip>], pairs a device to wake up, only on the local server.
+// with addr, its MAC is read from the GET /power of its server
+func (service *MercuryFsService) power_pair(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	device := &pairedDevice{Name: request.FormValue("name"), MAC: request.FormValue("mac"), Broadcast: request.FormValue("broadcast")}
+	status, result := http.StatusCreated, interface{}(device)
+	var err error
+	if addr := request.FormValue("addr"); addr != "" {
+		var interfaces []powerInterface
+		if interfaces, err = pair_remote(addr); err == nil {
+			device.MAC, device.Broadcast = interfaces[0].MAC, interfaces[0].Broadcast
+		} else {
+			status = http.StatusBadGateway
+		}
+	}
+	if err == nil {
+		if err = power.pair(device); err != nil {
+			status = http.StatusBadRequest
+		}
+	}
+	if err != nil {
+		result = map[string]string{"error": err.Error()}
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+}
+
+// DELETE /power/pair/{name} forgets a paired device
+func (service *MercuryFsService) power_unpair(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status := http.StatusNoContent
+	found, err := power.unpair(mux.Vars(request)["name"])
+	switch {
+	case !found:
+		status = http.StatusNotFound
+	case err != nil:
+		status = http.StatusInternalServerError
+	}
+	writer.WriteHeader(status)
+	service.debug_info.requestServed(int64(0))
+	log("\"DELETE %s\" %d 0 \"%s\"", query, status, ua)
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// the partitions of the disks that spin, like /dev/sdb1
+var spinning_partition = regexp.MustCompile(`^(/dev/[sh]d[a-z]+)[0-9]*$`)
+
+// disk_of is the disk path is on, from the mount of its device in
+// /proc/self/mountinfo, "" if it's not one that spins
+func disk_of(path string) string {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return ""
+	}
+	dev := uint64(stat.Dev)
+	device := fmt.Sprintf("%d:%d", (dev>>8)&0xfff|(dev>>32)&^0xfff, dev&0xff|(dev>>12)&^0xff)
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 36 35 8:17 / /mnt/disk1 rw,relatime shared:1 - ext4 /dev/sdb1 rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] != device {
+			continue
+		}
+		for i, field := range fields {
+			if field == "-" && i+2 < len(fields) {
+				if match := spinning_partition.FindStringSubmatch(fields[i+2]); match != nil {
+					return match[1]
+				}
+				return ""
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMagicPacket(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	packet := magic_packet(mac)
+	if len(packet) != 102 || !bytes.Equal(packet[:6], bytes.Repeat([]byte{0xff}, 6)) || !bytes.Equal(packet[96:], mac) {
+		t.Errorf("Wrong packet: %x", packet)
+	}
+}
+
+func TestPowerWake(t *testing.T) {
+	saved_power, saved_send := power, send_magic_packet
+	defer func() { power, send_magic_packet = saved_power, saved_send }()
+	dir, _ := ioutil.TempDir("", "power")
+	defer os.RemoveAll(dir)
+	power = new_power_manager(filepath.Join(dir, "paired.json"))
+	sent := make(chan string, 1)
+	send_magic_packet = func(mac net.HardwareAddr, broadcast string) error {
+		sent <- mac.String() + " " + broadcast
+		return nil
+	}
+
+	// the HDA tells how to wake it up
+	hda := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		json_response(writer, http.StatusOK, map[string]interface{}{"state": POWER_AWAKE,
+			"interfaces": []powerInterface{{Name: "eth0", MAC: "00:11:22:33:44:55", Broadcast: "192.168.1.255"}}})
+	}))
+	defer hda.Close()
+
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/power", service.power_status).Methods("GET")
+	router.HandleFunc("/power/wake", service.power_wake).Methods("POST")
+	router.HandleFunc("/power/pair", service.power_pair).Methods("POST")
+	router.HandleFunc("/power/pair/{name}", service.power_unpair).Methods("DELETE")
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+		return recorder
+	}
+
+	if response := serve("POST", "/power/pair?name=hda&addr="+hda.Listener.Addr().String()); response.Code != 201 {
+		t.Fatalf("Could not pair: %d %s", response.Code, response.Body.String())
+	}
+	if response := serve("POST", "/power/pair?name=nas&mac=nope"); response.Code != 400 {
+		t.Errorf("Paired a wrong MAC: %d", response.Code)
+	}
+	if response := serve("POST", "/power/wake?name=hda"); response.Code != 202 || <-sent != "00:11:22:33:44:55 192.168.1.255" {
+		t.Errorf("Did not wake it up: %d %s", response.Code, response.Body.String())
+	}
+	if response := serve("POST", "/power/wake?name=tv"); response.Code != 404 {
+		t.Errorf("Woke up a device not paired: %d", response.Code)
+	}
+
+	// the pairing is kept
+	power = new_power_manager(filepath.Join(dir, "paired.json"))
+	var status struct {
+		State  string         `json:"state"`
+		Paired []pairedDevice `json:"paired"`
+	}
+	json.Unmarshal(serve("GET", "/power").Body.Bytes(), &status)
+	if status.State != POWER_AWAKE || len(status.Paired) != 1 || status.Paired[0].Broadcast != "192.168.1.255" {
+		t.Errorf("Wrong status: %+v", status)
+	}
+	if serve("DELETE", "/power/pair/hda").Code != 204 || serve("DELETE", "/power/pair/hda").Code != 404 {
+		t.Errorf("Could not unpair")
+	}
+}
+
+func TestSpinDown(t *testing.T) {
+	saved_power, saved_disk, saved_spin, saved_config := power, path_disk, spin_down_disk, config
+	defer func() { power, path_disk, spin_down_disk, config = saved_power, saved_disk, saved_spin, saved_config }()
+	power = new_power_manager("")
+	config = default_config()
+	path_disk = func(path string) string {
+		if path == "/mnt/backups" {
+			return ""
+		}
+		return "/dev/sdb"
+	}
+	spun := []string{}
+	spin_down_disk = func(device string) error {
+		spun = append(spun, device)
+		return nil
+	}
+	shares := &HdaShares{Shares: []*HdaShare{{name: "Movies", path: "/mnt/movies"}, {name: "Music", path: "/mnt/music"}, {name: "Backups", path: "/mnt/backups"}}}
+	job := power.spin_down(shares)
+	if result, _ := job(func(done, total int64) {}); result != "spin down disabled" {
+		t.Errorf("Spun down without spin_down: %s", result)
+	}
+
+	config.Power.SpinDown = "1m"
+	job(func(done, total int64) {})
+	if len(spun) != 0 {
+		t.Errorf("Spun down a disk just used: %v", spun)
+	}
+	power.disks["/dev/sdb"].LastUse = time.Now().Add(-2 * time.Minute)
+	if result, _ := job(func(done, total int64) {}); result != "1 of 1 disks asleep" || len(spun) != 1 {
+		t.Errorf("Did not spin down: %s %v", result, spun)
+	}
+	if state := power.status(); state["state"] != POWER_ASLEEP || state["disks"].([]diskState)[0].Shares[1] != "Music" {
+		t.Errorf("Wrong state: %v", state)
+	}
+
+	// a request for a share on it wakes it up
+	service := &MercuryFsService{}
+	waking := make(chan string, 1)
+	handler := service.power_access(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		waking <- power.status()["state"].(string)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/files?s=Music&p=/a.mp3", nil))
+	if state := <-waking; state != POWER_WAKING || power.status()["state"] != POWER_AWAKE {
+		t.Errorf("Wrong states while waking: %s then %s", state, power.status()["state"])
+	}
+}
@@ -0,0 +1,356 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// videos served over the relay are read ahead from disk, so that seeks and
+// slow disks do not stall the stream. a prefetch session reads the chunks
+// ahead of the client with a few readers in parallel, and keeps about
+// PREFETCH_SECONDS of the video, at the rate the client is reading it.
+//
+// players often fetch a video in consecutive ranges, so a session outlives
+// its request for a while and is picked up by the next request that starts
+// where the previous one ended
+
+const PREFETCH_CHUNK = 1 << 20
+const PREFETCH_MIN = 4 << 20
+const PREFETCH_MAX = 32 << 20
+const PREFETCH_SECONDS = 10
+const PREFETCH_WORKERS = 3
+const PREFETCH_IDLE = 30 * time.Second
+const PREFETCH_SESSIONS = 4
+
+// only videos at least this big are prefetched
+const PREFETCH_MIN_FILE = 16 << 20
+
+type prefetchChunk struct {
+	offset int64
+	data   []byte
+	err    error
+	ready  chan struct{}
+}
+
+type prefetchSession struct {
+	path string
+	file *os.File
+	size int64
+	// consecutive chunks, being read or ready, from the client position on
+	chunks []*prefetchChunk
+	// where the next chunk to read ahead starts
+	next  int64
+	queue chan *prefetchChunk
+	// to estimate the rate of the client
+	consumed int64
+	started  time.Time
+	used     time.Time
+	in_use   bool
+	closed   bool
+	workers  sync.WaitGroup
+	sync.Mutex
+}
+
+type videoPrefetcher struct {
+	sessions     []*prefetchSession
+	hits, misses int64
+	sync.Mutex
+}
+
+var video_prefetcher = &videoPrefetcher{}
+
+type relayRequestKey struct{}
+
+// mark_relay_request flags requests that came through the relay
+func mark_relay_request(request *http.Request) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), relayRequestKey{}, true))
+}
+
+func from_relay(request *http.Request) bool {
+	relay, _ := request.Context().Value(relayRequestKey{}).(bool)
+	return relay
+}
+
+// should_prefetch says if a file is worth reading ahead for a request
+func should_prefetch(request *http.Request, fi os.FileInfo) bool {
+	return from_relay(request) && fi.Size() >= PREFETCH_MIN_FILE && strings.HasPrefix(getContentType(fi.Name()), "video/")
+}
+
+// open returns a reader of the file at full_path that reads ahead, starting
+// at offset, reusing an idle session that is already there
+func (this *videoPrefetcher) open(full_path string, size, offset int64) (*prefetchReader, error) {
+	this.Lock()
+	defer this.Unlock()
+	this.expire()
+
+	for _, session := range this.sessions {
+		if session.path == full_path && session.size == size && session.reuse(offset) {
+			this.hits++
+			return &prefetchReader{session: session, position: offset}, nil
+		}
+	}
+	this.misses++
+
+	file, err := os.Open(full_path)
+	if err != nil {
+		return nil, err
+	}
+	session := new_prefetch_session(full_path, file, size)
+	session.in_use = true
+	if len(this.sessions) >= PREFETCH_SESSIONS {
+		// make room by dropping the least recently used idle session
+		oldest := -1
+		for i, s := range this.sessions {
+			if !s.busy() && (oldest < 0 || s.used.Before(this.sessions[oldest].used)) {
+				oldest = i
+			}
+		}
+		if oldest >= 0 {
+			this.sessions[oldest].close()
+			this.sessions = append(this.sessions[:oldest], this.sessions[oldest+1:]...)
+		}
+	}
+	// with too many streams at the same time, this one is not kept
+	kept := len(this.sessions) < PREFETCH_SESSIONS
+	if kept {
+		this.sessions = append(this.sessions, session)
+	}
+	return &prefetchReader{session: session, position: offset, owned: !kept}, nil
+}
+
+// expire closes the sessions idle for longer than PREFETCH_IDLE. it has
+// to be called with the lock held
+func (this *videoPrefetcher) expire() {
+	sessions := this.sessions[:0]
+	for _, session := range this.sessions {
+		if !session.busy() && time.Since(session.used) > PREFETCH_IDLE {
+			session.close()
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	this.sessions = sessions
+}
+
+// range_start is where the range asked for in a request starts
+func range_start(request *http.Request) int64 {
+	r := request.Header.Get("Range")
+	if !strings.HasPrefix(r, "bytes=") {
+		return 0
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(strings.SplitN(r[len("bytes="):], "-", 2)[0]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return start
+}
+
+func (this *videoPrefetcher) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	buffered := int64(0)
+	for _, session := range this.sessions {
+		buffered += session.buffered()
+	}
+	return map[string]interface{}{"sessions": len(this.sessions), "buffered": buffered, "hits": this.hits, "misses": this.misses}
+}
+
+func new_prefetch_session(path string, file *os.File, size int64) *prefetchSession {
+	session := &prefetchSession{
+		path:    path,
+		file:    file,
+		size:    size,
+		queue:   make(chan *prefetchChunk, PREFETCH_MAX/PREFETCH_CHUNK+1),
+		started: time.Now(),
+		used:    time.Now(),
+	}
+	for i := 0; i < PREFETCH_WORKERS; i++ {
+		session.workers.Add(1)
+		go session.worker()
+	}
+	return session
+}
+
+func (this *prefetchSession) worker() {
+	defer this.workers.Done()
+	for chunk := range this.queue {
+		n, err := this.file.ReadAt(chunk.data, chunk.offset)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		chunk.data, chunk.err = chunk.data[:n], err
+		close(chunk.ready)
+	}
+}
+
+func (this *prefetchSession) busy() bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.in_use
+}
+
+// reuse takes an idle session for a request starting at offset, if it has
+// read ahead from there
+func (this *prefetchSession) reuse(offset int64) bool {
+	this.Lock()
+	defer this.Unlock()
+	if this.in_use || this.closed || len(this.chunks) == 0 || offset < this.chunks[0].offset || offset >= this.next {
+		return false
+	}
+	this.in_use = true
+	return true
+}
+
+func (this *prefetchSession) release() {
+	this.Lock()
+	this.in_use = false
+	this.used = time.Now()
+	this.Unlock()
+}
+
+func (this *prefetchSession) close() {
+	this.Lock()
+	if this.closed {
+		this.Unlock()
+		return
+	}
+	this.closed = true
+	this.chunks = nil
+	close(this.queue)
+	this.Unlock()
+	go func() {
+		this.workers.Wait()
+		this.file.Close()
+	}()
+}
+
+func (this *prefetchSession) buffered() int64 {
+	this.Lock()
+	defer this.Unlock()
+	return this.next - this.position()
+}
+
+// position is where the oldest chunk kept starts. it has to be called with
+// the lock held
+func (this *prefetchSession) position() int64 {
+	if len(this.chunks) == 0 {
+		return this.next
+	}
+	return this.chunks[0].offset
+}
+
+// window is how much to read ahead, for the rate the client is reading at
+func (this *prefetchSession) window() int64 {
+	window := int64(PREFETCH_MIN)
+	if elapsed := time.Since(this.started).Seconds(); elapsed > 1 {
+		window = int64(float64(this.consumed) / elapsed * PREFETCH_SECONDS)
+	}
+	if window < PREFETCH_MIN {
+		window = PREFETCH_MIN
+	} else if window > PREFETCH_MAX {
+		window = PREFETCH_MAX
+	}
+	return window
+}
+
+// chunk_at returns the chunk with offset in it, after dropping the chunks
+// before it and reading ahead from it
+func (this *prefetchSession) chunk_at(offset int64) (*prefetchChunk, error) {
+	this.Lock()
+	defer this.Unlock()
+	if this.closed {
+		return nil, errors.New("prefetch session closed")
+	}
+	if offset < this.position() || offset >= this.next {
+		// a seek, start over from there
+		this.chunks = nil
+		this.next = offset - offset%PREFETCH_CHUNK
+	}
+	for len(this.chunks) > 0 && this.chunks[0].offset+PREFETCH_CHUNK <= offset {
+		this.chunks = this.chunks[1:]
+	}
+	for this.next < this.size && (this.next <= offset || this.next-offset < this.window()) {
+		chunk := &prefetchChunk{offset: this.next, data: make([]byte, PREFETCH_CHUNK), ready: make(chan struct{})}
+		this.chunks = append(this.chunks, chunk)
+		this.next += PREFETCH_CHUNK
+		this.queue <- chunk
+	}
+	if len(this.chunks) == 0 {
+		return nil, io.EOF
+	}
+	return this.chunks[0], nil
+}
+
+// prefetchReader is what serves a request from a prefetch session
+type prefetchReader struct {
+	session  *prefetchSession
+	position int64
+	// sessions that are not kept are closed with the reader
+	owned bool
+}
+
+func (this *prefetchReader) Read(p []byte) (int, error) {
+	if this.position >= this.session.size {
+		return 0, io.EOF
+	}
+	chunk, err := this.session.chunk_at(this.position)
+	if err != nil {
+		return 0, err
+	}
+	<-chunk.ready
+	if chunk.err != nil {
+		return 0, chunk.err
+	}
+	start := int(this.position - chunk.offset)
+	if start >= len(chunk.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, chunk.data[start:])
+	this.position += int64(n)
+	this.session.Lock()
+	this.session.consumed += int64(n)
+	this.session.Unlock()
+	return n, nil
+}
+
+func (this *prefetchReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += this.position
+	case io.SeekEnd:
+		offset += this.session.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	this.position = offset
+	return offset, nil
+}
+
+func (this *prefetchReader) Close() error {
+	if this.owned {
+		this.session.close()
+	} else {
+		this.session.release()
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVideoPrefetcher(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "prefetch")
+	defer os.RemoveAll(dir)
+	data := make([]byte, 3*PREFETCH_CHUNK+12345)
+	rand.New(rand.NewSource(3)).Read(data)
+	full_path := filepath.Join(dir, "movie.mkv")
+	ioutil.WriteFile(full_path, data, 0644)
+
+	prefetcher := &videoPrefetcher{}
+	reader, err := prefetcher.open(full_path, int64(len(data)), 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	all, _ := ioutil.ReadAll(reader)
+	if !bytes.Equal(all, data) {
+		t.Fatalf("Prefetched contents differ")
+	}
+
+	// seeking back and forth
+	reader.Seek(int64(len(data))-100, io.SeekStart)
+	tail, _ := ioutil.ReadAll(reader)
+	reader.Seek(PREFETCH_CHUNK+10, io.SeekStart)
+	middle := make([]byte, 50)
+	io.ReadFull(reader, middle)
+	if !bytes.Equal(tail, data[len(data)-100:]) || !bytes.Equal(middle, data[PREFETCH_CHUNK+10:PREFETCH_CHUNK+60]) {
+		t.Errorf("Wrong contents after seeking")
+	}
+	reader.Close()
+
+	// the next range picks up the session
+	reader, _ = prefetcher.open(full_path, int64(len(data)), PREFETCH_CHUNK+60)
+	rest, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if !bytes.Equal(rest, data[PREFETCH_CHUNK+60:]) {
+		t.Errorf("Wrong contents from a reused session")
+	}
+	if status := prefetcher.status(); status["hits"] != int64(1) || status["sessions"] != 1 {
+		t.Errorf("Session not reused: %v", status)
+	}
+}
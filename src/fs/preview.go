@@ -0,0 +1,285 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// previews of text files: the first or last kb KB of a file, converted to
+// UTF-8, so that configs and logs can be read without downloading them.
+// with follow, the preview is the tail of the file and what is appended to
+// it is sent as Server-Sent Events, like tail -f
+
+const PREVIEW_KB = 64
+const PREVIEW_MAX_KB = 1024
+const PREVIEW_POLL = time.Second
+
+type filePreview struct {
+	Encoding  string `json:"encoding"`
+	Size      int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	Truncated bool   `json:"truncated"`
+	Text      string `json:"text"`
+}
+
+// detect_encoding guesses the encoding of text from a sample, and returns
+// "" if it does not look like text
+func detect_encoding(sample []byte) string {
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xef, 0xbb, 0xbf}):
+		return "utf-8"
+	case bytes.HasPrefix(sample, []byte{0xff, 0xfe}):
+		return "utf-16le"
+	case bytes.HasPrefix(sample, []byte{0xfe, 0xff}):
+		return "utf-16be"
+	}
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return ""
+	}
+	// a sample may end in the middle of a character
+	if utf8.Valid(sample) || utf8.Valid(sample[:len(sample)-incomplete_utf8(sample)]) {
+		return "utf-8"
+	}
+	return "iso-8859-1"
+}
+
+// incomplete_utf8 is how many bytes at the end of data are an incomplete
+// UTF-8 sequence
+func incomplete_utf8(data []byte) int {
+	for i := 1; i <= 3 && i <= len(data); i++ {
+		c := data[len(data)-i]
+		if c < 0x80 {
+			return 0
+		}
+		if c >= 0xc0 {
+			// the first byte of a sequence, check if it's complete
+			if utf8.FullRune(data[len(data)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// decode_text converts data in encoding to UTF-8, dropping a byte order
+// mark and incomplete characters at the end
+func decode_text(data []byte, encoding string) string {
+	switch encoding {
+	case "utf-16le", "utf-16be":
+		var order binary.ByteOrder = binary.LittleEndian
+		if encoding == "utf-16be" {
+			order = binary.BigEndian
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			units = append(units, order.Uint16(data[i:]))
+		}
+		if len(units) > 0 && units[0] == 0xfeff {
+			units = units[1:]
+		}
+		return string(utf16.Decode(units))
+	case "iso-8859-1":
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	}
+	data = bytes.TrimPrefix(data, []byte{0xef, 0xbb, 0xbf})
+	return string(bytes.ToValidUTF8(data[:len(data)-incomplete_utf8(data)], []byte("�")))
+}
+
+// read_preview reads the first, or with tail the last, max bytes of file
+func read_preview(file *os.File, size int64, max int, tail bool) (*filePreview, error) {
+	sample := make([]byte, 512)
+	n, err := file.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	preview := &filePreview{Encoding: detect_encoding(sample[:n]), Size: size}
+	if preview.Encoding == "" {
+		return preview, nil
+	}
+
+	if tail && size > int64(max) {
+		preview.Offset = size - int64(max)
+	}
+	if preview.Encoding == "utf-16le" || preview.Encoding == "utf-16be" {
+		preview.Offset &^= 1
+	}
+	length := size - preview.Offset
+	if length > int64(max) {
+		length = int64(max)
+	}
+	preview.Truncated = length < size
+	data := make([]byte, length)
+	n, err = file.ReadAt(data, preview.Offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	data = data[:n]
+	if preview.Offset > 0 && preview.Encoding != "utf-16le" && preview.Encoding != "utf-16be" {
+		// start at a full line
+		if i := bytes.IndexByte(data, '\n'); i >= 0 && i < len(data)-1 {
+			data = data[i+1:]
+			preview.Offset += int64(i + 1)
+		}
+	}
+	preview.Text = decode_text(data, preview.Encoding)
+	return preview, nil
+}
+
+// GET /files/preview?s=share&p=path[&kb=64][&tail=1][&follow=1]
+func (service *MercuryFsService) file_preview(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	file, fi, _ := service.open_share_file(writer, request)
+	if file == nil {
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	defer file.Close()
+
+	kb, err := strconv.Atoi(q.Get("kb"))
+	if err != nil || kb <= 0 {
+		kb = PREVIEW_KB
+	} else if kb > PREVIEW_MAX_KB {
+		kb = PREVIEW_MAX_KB
+	}
+	follow := q.Get("follow") == "1"
+	preview, err := read_preview(file, fi.Size(), kb*1024, follow || q.Get("tail") == "1")
+	if err != nil {
+		debug(2, "Error reading a preview of %s: %s", file.Name(), err.Error())
+		writer.WriteHeader(http.StatusInternalServerError)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 500 0 \"%s\"", query, ua)
+		return
+	}
+	if preview.Encoding == "" {
+		size := json_response(writer, http.StatusUnsupportedMediaType, map[string]string{"error": "not a text file", "mime_type": getContentType(fi.Name())})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" 415 %d \"%s\"", query, size, ua)
+		return
+	}
+	if !follow {
+		size := json_response(writer, http.StatusOK, preview)
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+		return
+	}
+	log("\"GET %s\" 200 0 \"%s\"", query, ua)
+	service.follow_file(writer, request, file.Name(), preview)
+	service.debug_info.requestServed(int64(0))
+}
+
+// follow_file sends the preview and then what's appended to the file as
+// events, until the client goes away
+func (service *MercuryFsService) follow_file(writer http.ResponseWriter, request *http.Request, full_path string, preview *filePreview) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	file, err := os.Open(full_path)
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+	defer func() { file.Close() }()
+	followed, _ := file.Stat()
+	header := writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache, private")
+	writer.WriteHeader(http.StatusOK)
+
+	send := func(event string, preview *filePreview) bool {
+		data, _ := json.Marshal(preview)
+		_, err := fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+		return err == nil
+	}
+	if !send("preview", preview) {
+		return
+	}
+
+	position := preview.Size
+	poll := time.NewTicker(PREVIEW_POLL)
+	defer poll.Stop()
+	keepalive := time.NewTicker(EVENTS_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-poll.C:
+			// the file may have been rotated, so look at the path again
+			fi, err := os.Stat(full_path)
+			if err != nil {
+				continue
+			}
+			if !os.SameFile(fi, followed) || fi.Size() < position {
+				reopened, err := os.Open(full_path)
+				if err != nil {
+					continue
+				}
+				file.Close()
+				file, followed = reopened, fi
+				position = 0
+				if !send("truncated", &filePreview{Encoding: preview.Encoding, Size: fi.Size()}) {
+					return
+				}
+			}
+			for fi.Size() > position {
+				length := fi.Size() - position
+				if length > PREVIEW_MAX_KB*1024 {
+					length = PREVIEW_MAX_KB * 1024
+				}
+				data := make([]byte, length)
+				n, _ := file.ReadAt(data, position)
+				if n == 0 {
+					break
+				}
+				// incomplete characters are sent with the next chunk
+				if preview.Encoding == "utf-16le" || preview.Encoding == "utf-16be" {
+					n &^= 1
+				} else if preview.Encoding == "utf-8" {
+					n -= incomplete_utf8(data[:n])
+				}
+				if n == 0 {
+					break
+				}
+				chunk := &filePreview{Encoding: preview.Encoding, Size: fi.Size(), Offset: position, Text: decode_text(data[:n], preview.Encoding)}
+				position += int64(n)
+				if !send("append", chunk) {
+					return
+				}
+			}
+		case <-keepalive.C:
+			if _, err := writer.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectEncoding(t *testing.T) {
+	for sample, encoding := range map[string]string{
+		"plain text\n":           "utf-8",
+		"caf\xc3\xa9":            "utf-8",
+		"cut in the middle \xc3": "utf-8",
+		"caf\xe9 latin-1":        "iso-8859-1",
+		"\xff\xfeh\x00i\x00":     "utf-16le",
+		"\x7fELF\x02\x01\x00":    "",
+	} {
+		if got := detect_encoding([]byte(sample)); got != encoding {
+			t.Errorf("detect_encoding(%q) is %q instead of %q", sample, got, encoding)
+		}
+	}
+	if text := decode_text([]byte("\xff\xfeh\x00i\x00"), "utf-16le"); text != "hi" {
+		t.Errorf("Wrong UTF-16 decoding: %q", text)
+	}
+	if text := decode_text([]byte("caf\xe9"), "iso-8859-1"); text != "café" {
+		t.Errorf("Wrong latin-1 decoding: %q", text)
+	}
+	if text := decode_text([]byte("caf\xc3"), "utf-8"); text != "caf" {
+		t.Errorf("Incomplete character not dropped: %q", text)
+	}
+}
+
+func TestReadPreview(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "preview")
+	defer os.RemoveAll(dir)
+	full_path := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(full_path, []byte("first line\nsecond line\nthird line\n"), 0644)
+	file, _ := os.Open(full_path)
+	defer file.Close()
+
+	head, _ := read_preview(file, 34, 16, false)
+	if head.Text != "first line\nsecon" || !head.Truncated || head.Offset != 0 {
+		t.Errorf("Wrong head: %+v", head)
+	}
+	// the tail starts at a full line
+	tail, _ := read_preview(file, 34, 16, true)
+	if tail.Text != "third line\n" || tail.Offset != 23 {
+		t.Errorf("Wrong tail: %+v", tail)
+	}
+	whole, _ := read_preview(file, 34, 1024, true)
+	if whole.Truncated || whole.Encoding != "utf-8" || len(whole.Text) != 34 {
+		t.Errorf("Wrong preview of the whole file: %+v", whole)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"hda_api_key"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the credentials used with the relay (pfe) can be rotated without a
+// restart, with SIGHUP or POST /relay/rotate on the local server. the
+// config file and the API key in the settings DB are read again and, if the
+// credentials changed, a new connection is made with them before the old
+// one is dropped. if the new credentials are rejected, the old connection
+// stays up
+
+type relayCredentials struct {
+	api_key string
+	token   string
+}
+
+type relayLink struct {
+	service     *MercuryFsService
+	host, port  string
+	config_file string
+	// api key given in the command line, which wins in development builds
+	api_key_flag string
+	// which of the connections to the relay this is, and the links of the
+	// others, see relay_pool.go
+	index  int
+	others []*relayLink
+
+	creds relayCredentials
+	// the connection being served, and the one to serve next
+	conn, next net.Conn
+	rotated    time.Time
+	// the state of the link, see relay_manager.go
+	state                 string
+	attempts, connections int64
+	failures              int
+	next_attempt          time.Time
+	connected             time.Time
+	changes               []relayStateChange
+	sync.Mutex
+	// only one rotation at a time
+	rotating sync.Mutex
+}
+
+var relay *relayLink
+
+var errCredentialsUnchanged = errors.New("relay credentials did not change")
+
+// without Amahi, the relay needs relay.api_key
+var errNoApiKey = errors.New("no relay.api_key")
+
+// relay_credentials finds the credentials to use: the API key from the
+// command line (not in production), the config file or the settings DB (or
+// its cache), and the token from the config file or the one built in
+func (this *relayLink) relay_credentials() (relayCredentials, error) {
+	creds := relayCredentials{token: SECRET_TOKEN}
+	if config.Relay.Token != "" {
+		creds.token = config.Relay.Token
+	}
+	if !PRODUCTION && this.api_key_flag != "" {
+		creds.api_key = this.api_key_flag
+		return creds, nil
+	}
+	if config.Relay.ApiKey != "" {
+		creds.api_key = config.Relay.ApiKey
+		return creds, nil
+	}
+	if standalone() {
+		return creds, errNoApiKey
+	}
+	key, err := hda_api_key.HDA_API_key(MYSQL_CREDENTIALS)
+	if err == nil && key != "" {
+		update_settings_cache(func(cache *settingsCache) {
+			cache.ApiKey = key
+		})
+	} else if key = load_settings_cache().ApiKey; key != "" {
+		log("Using the last known API key, the settings DB is not available")
+	} else {
+		return creds, errors.New("Amahi API key was not found")
+	}
+	creds.api_key = key
+	return creds, nil
+}
+
+func (this *relayLink) credentials() relayCredentials {
+	this.Lock()
+	defer this.Unlock()
+	return this.creds
+}
+
+// connect returns the connection made by a rotation, or a new one
+func (this *relayLink) connect() (net.Conn, error) {
+	this.Lock()
+	conn := this.next
+	this.next = nil
+	this.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	return contact_pfe(this.host, this.port, this.credentials(), this.service, this.index)
+}
+
+// serve serves conn until it's lost or replaced
+func (this *relayLink) serve(conn net.Conn) error {
+	this.Lock()
+	this.conn = conn
+	this.Unlock()
+	err := this.service.StartServing(conn)
+	this.Lock()
+	if this.conn == conn {
+		this.conn = nil
+	}
+	this.Unlock()
+	if relay != nil {
+		// the HDA is still reachable through the others
+		if addr := relay.connected_addr(); addr != "" {
+			this.service.info.relay_addr = addr
+		}
+	}
+	return err
+}
+
+// replaced says whether there is a new connection waiting to be served
+func (this *relayLink) replaced() bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.next != nil
+}
+
+// rotate reloads the credentials and, if they changed, reconnects with them
+func (this *relayLink) rotate() error {
+	this.rotating.Lock()
+	defer this.rotating.Unlock()
+
+	if err := load_config(this.config_file); err != nil {
+		return err
+	}
+	creds, err := this.relay_credentials()
+	if err != nil {
+		return err
+	}
+	if creds == this.credentials() {
+		return errCredentialsUnchanged
+	}
+	if err := this.reconnect(creds); err != nil {
+		log("New relay credentials rejected, keeping the current connection")
+		return err
+	}
+	this.Lock()
+	this.rotated = time.Now()
+	this.Unlock()
+	log("Relay credentials rotated")
+	return nil
+}
+
+// announce reconnects with the same credentials, for the relay to get the
+// HDA info again, like a new direct token
+func (this *relayLink) announce() error {
+	this.rotating.Lock()
+	defer this.rotating.Unlock()
+	return this.reconnect(this.credentials())
+}
+
+// reconnect makes a new connection with creds and has the serving loop move
+// on to it. call with the rotating lock held
+func (this *relayLink) reconnect(creds relayCredentials) error {
+	conn, err := contact_pfe(this.host, this.port, creds, this.service, this.index)
+	if err != nil {
+		return err
+	}
+
+	this.Lock()
+	this.creds = creds
+	old := this.conn
+	if this.next != nil {
+		this.next.Close()
+	}
+	this.next = conn
+	this.Unlock()
+	if old != nil {
+		// the serving loop moves on to the new connection
+		old.Close()
+	}
+	return nil
+}
+
+func (this *relayLink) rotate_on_hangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		log("Got SIGHUP, reloading the relay credentials")
+		if err := this.rotate_all(); err != nil && err != errCredentialsUnchanged {
+			log_warn("Relay credentials not rotated: %s", err.Error())
+		}
+	}
+}
+
+func (this *relayLink) status() map[string]interface{} {
+	status := this.own_status()
+	status["heartbeat"] = relay_heartbeat.status()
+	if len(this.others) > 0 {
+		open := 0
+		links := []map[string]interface{}{}
+		for _, link := range this.links() {
+			link_status := link.own_status()
+			if link_status["connected"] == true {
+				open++
+			}
+			links = append(links, link_status)
+		}
+		status["open"] = open
+		status["links"] = links
+	}
+	return status
+}
+
+// own_status is the status of this link alone
+func (this *relayLink) own_status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	status := map[string]interface{}{"connected": this.conn != nil}
+	if len(this.others) > 0 || this.index > 0 {
+		status["endpoint"] = net.JoinHostPort(this.host, this.port)
+	}
+	this.link_status(status)
+	if !this.rotated.IsZero() {
+		status["rotated"] = this.rotated.Format(time.RFC3339)
+	}
+	return status
+}
+
+// POST /relay/rotate, only on the local server
+func (service *MercuryFsService) rotate_relay(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status := http.StatusOK
+	result := map[string]interface{}{"rotated": true}
+	if relay == nil {
+		status = http.StatusServiceUnavailable
+		result = map[string]interface{}{"error": "not connected to a relay"}
+	} else if err := relay.rotate_all(); err == errCredentialsUnchanged {
+		result["rotated"] = false
+	} else if err != nil {
+		debug(2, "Error rotating the relay credentials: %s", err.Error())
+		status = http.StatusBadGateway
+		result = map[string]interface{}{"error": err.Error()}
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+}
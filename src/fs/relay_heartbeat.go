@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// the connection to the relay can go half-open, with the relay gone and no
+// error until a request fails. the HTTP/2 server pings the relay when it
+// has heard nothing for read_idle_timeout, and drops the connection when
+// the ping goes unanswered for RELAY_PING_TIMEOUT, so that it's made again
+// within seconds. the frames going through the connection are watched for
+// the pings and their answers, to know the round trip time, shown in
+// /hda_debug
+
+const HTTP2_PREFACE_SIZE = 24
+const HTTP2_FRAME_HEADER = 9
+const HTTP2_PING = 0x6
+const HTTP2_FLAG_ACK = 0x1
+
+// frameWatcher follows the HTTP/2 frames in one direction of a
+// connection, calling ping with the pings in it
+type frameWatcher struct {
+	// bytes of the client preface still to skip
+	preface int
+	header  [HTTP2_FRAME_HEADER]byte
+	have    int
+	// what's left of the payload of the current frame
+	remaining uint32
+	is_ping   bool
+	flags     byte
+	data      []byte
+	ping      func(flags byte, data uint64)
+}
+
+func (this *frameWatcher) watch(p []byte) {
+	for len(p) > 0 {
+		if this.preface > 0 {
+			n := this.preface
+			if n > len(p) {
+				n = len(p)
+			}
+			this.preface -= n
+			p = p[n:]
+			continue
+		}
+		if this.have < HTTP2_FRAME_HEADER {
+			n := copy(this.header[this.have:], p)
+			this.have += n
+			p = p[n:]
+			if this.have < HTTP2_FRAME_HEADER {
+				return
+			}
+			this.remaining = uint32(this.header[0])<<16 | uint32(this.header[1])<<8 | uint32(this.header[2])
+			this.is_ping = this.header[3] == HTTP2_PING && this.remaining == 8
+			this.flags = this.header[4]
+			this.data = this.data[:0]
+		}
+		n := len(p)
+		if uint32(n) > this.remaining {
+			n = int(this.remaining)
+		}
+		if this.is_ping {
+			this.data = append(this.data, p[:n]...)
+		}
+		this.remaining -= uint32(n)
+		p = p[n:]
+		if this.remaining == 0 {
+			if this.is_ping {
+				this.ping(this.flags, binary.BigEndian.Uint64(this.data))
+			}
+			this.have = 0
+		}
+	}
+}
+
+type relayHeartbeat struct {
+	// the pings sent and not answered yet, by data
+	sent        map[uint64]time.Time
+	rtt         time.Duration
+	last_answer time.Time
+	pings       int64
+	answers     int64
+	sync.Mutex
+}
+
+var relay_heartbeat = &relayHeartbeat{sent: make(map[uint64]time.Time)}
+
+// heartbeatConn is a connection to the relay watched for pings
+type heartbeatConn struct {
+	net.Conn
+	heartbeat     *relayHeartbeat
+	read, written *frameWatcher
+	sync.Mutex
+}
+
+// watch returns conn watched for pings. conn is the server end, which
+// reads the client preface first
+func (this *relayHeartbeat) watch(conn net.Conn) net.Conn {
+	this.Lock()
+	this.sent = make(map[uint64]time.Time)
+	this.Unlock()
+	return &heartbeatConn{
+		Conn:      conn,
+		heartbeat: this,
+		read:      &frameWatcher{preface: HTTP2_PREFACE_SIZE, ping: this.received},
+		written:   &frameWatcher{ping: this.sending},
+	}
+}
+
+func (this *heartbeatConn) Read(p []byte) (int, error) {
+	n, err := this.Conn.Read(p)
+	// only the server goroutine reads
+	this.read.watch(p[:n])
+	return n, err
+}
+
+func (this *heartbeatConn) Write(p []byte) (int, error) {
+	this.Lock()
+	defer this.Unlock()
+	this.written.watch(p)
+	return this.Conn.Write(p)
+}
+
+func (this *relayHeartbeat) sending(flags byte, data uint64) {
+	if flags&HTTP2_FLAG_ACK != 0 {
+		return
+	}
+	this.Lock()
+	this.pings++
+	this.sent[data] = time.Now()
+	this.Unlock()
+}
+
+func (this *relayHeartbeat) received(flags byte, data uint64) {
+	if flags&HTTP2_FLAG_ACK == 0 {
+		return
+	}
+	this.Lock()
+	defer this.Unlock()
+	if sent, ok := this.sent[data]; ok {
+		delete(this.sent, data)
+		this.answers++
+		this.last_answer = time.Now()
+		this.rtt = this.last_answer.Sub(sent)
+	}
+}
+
+func (this *relayHeartbeat) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	status := map[string]interface{}{"pings": this.pings, "answers": this.answers}
+	if !this.last_answer.IsZero() {
+		status["rtt_ms"] = float64(this.rtt) / float64(time.Millisecond)
+		status["last_answer"] = this.last_answer.Format(time.RFC3339)
+	}
+	return status
+}
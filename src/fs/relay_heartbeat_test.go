@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFrameWatcher(t *testing.T) {
+	var stream bytes.Buffer
+	stream.WriteString(http2.ClientPreface)
+	framer := http2.NewFramer(&stream, nil)
+	framer.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1 << 20})
+	framer.WriteData(1, false, []byte("not a ping, but 8"))
+	framer.WritePing(false, [8]byte{0, 0, 0, 0, 0, 0, 0, 42})
+	framer.WritePing(true, [8]byte{0, 0, 0, 0, 0, 0, 0, 43})
+
+	pings := []uint64{}
+	acks := 0
+	watcher := &frameWatcher{preface: HTTP2_PREFACE_SIZE, ping: func(flags byte, data uint64) {
+		pings = append(pings, data)
+		if flags&HTTP2_FLAG_ACK != 0 {
+			acks++
+		}
+	}}
+	// a few bytes at a time
+	data := stream.Bytes()
+	for len(data) > 0 {
+		n := 5
+		if n > len(data) {
+			n = len(data)
+		}
+		watcher.watch(data[:n])
+		data = data[n:]
+	}
+	if len(pings) != 2 || pings[0] != 42 || pings[1] != 43 || acks != 1 {
+		t.Errorf("Wrong pings: %v %d", pings, acks)
+	}
+}
+
+func TestRelayHeartbeat(t *testing.T) {
+	saved, saved_heartbeat := config, relay_heartbeat
+	defer func() { config, relay_heartbeat = saved, saved_heartbeat }()
+	config = default_config()
+	config.Relay.HTTP2.ReadIdleTimeout = "20ms"
+	relay_heartbeat = &relayHeartbeat{sent: make(map[uint64]time.Time)}
+
+	hda, relay_end := net.Pipe()
+	defer relay_end.Close()
+	go relay_http2_server().ServeConn(relay_heartbeat.watch(hda), &http2.ServeConnOpts{Handler: http.NotFoundHandler()})
+	// the relay answers the pings
+	if _, err := new(http2.Transport).NewClientConn(relay_end); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if status := relay_heartbeat.status(); status["answers"].(int64) >= 2 {
+			if _, ok := status["rtt_ms"]; !ok || status["pings"].(int64) < 2 {
+				t.Errorf("Wrong status: %v", status)
+			}
+			return
+		}
+	}
+	t.Errorf("The pings were not answered: %v", relay_heartbeat.status())
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"golang.org/x/net/http2"
+	"time"
+)
+
+// the HTTP/2 server of the connection to the relay, set up from
+// config.Relay.HTTP2. the relay is often far away, and the defaults of
+// http2 (1MB of uploads in flight for the whole connection) cap uploads
+// and the streams sharing the connection at a few MB/s with a long round
+// trip. how fast a download goes is up to the window of the relay; the
+// HDA can only make sure it does not run out of streams, and notices a
+// dead connection by pinging it, see relay_heartbeat.go
+
+const RELAY_PING_TIMEOUT = 5 * time.Second
+
+// relay_duration is a duration of the config, or fallback when it's not
+// one. "0" is none
+func relay_duration(value string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return fallback
+	}
+	return d
+}
+
+func relay_http2_server() *http2.Server {
+	settings := config.Relay.HTTP2
+	return &http2.Server{
+		MaxConcurrentStreams:         settings.MaxConcurrentStreams,
+		MaxReadFrameSize:             settings.MaxReadFrameSize,
+		MaxUploadBufferPerStream:     settings.StreamWindow,
+		MaxUploadBufferPerConnection: settings.ConnectionWindow,
+		IdleTimeout:                  relay_duration(settings.IdleTimeout, 0),
+		ReadIdleTimeout:              relay_duration(settings.ReadIdleTimeout, 10*time.Second),
+		PingTimeout:                  RELAY_PING_TIMEOUT,
+	}
+}
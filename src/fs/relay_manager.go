@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// the connection to the relay is made again when it's lost, after a wait
+// that doubles with every failure in a row, from RELAY_BACKOFF_MIN up to
+// RELAY_BACKOFF_MAX, with jitter so that the HDAs cut off by the same
+// outage do not all come back at once. a connection that stayed up for
+// RELAY_STABLE starts over from the shortest wait. making a connection
+// gives up after RELAY_CONNECT_TIMEOUT, so that a relay that does not
+// answer cannot hang it. the state of the link and its changes are logged
+// and shown in /hda_debug
+
+const RELAY_BACKOFF_MIN = 2 * time.Second
+const RELAY_BACKOFF_MAX = 2 * time.Minute
+const RELAY_STABLE = time.Minute
+const RELAY_CONNECT_TIMEOUT = 30 * time.Second
+
+// how many state changes are shown
+const RELAY_STATE_CHANGES = 10
+
+const (
+	RELAY_CONNECTING = "connecting"
+	RELAY_CONNECTED  = "connected"
+	RELAY_WAITING    = "waiting"
+)
+
+type relayStateChange struct {
+	State string    `json:"state"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// for the tests
+var relay_sleep = time.Sleep
+
+// relay_backoff is how long to wait after failures in a row, between half
+// and all of the doubled wait
+func relay_backoff(failures int) time.Duration {
+	wait := RELAY_BACKOFF_MAX
+	if failures < 16 {
+		if d := RELAY_BACKOFF_MIN << uint(failures-1); d < wait {
+			wait = d
+		}
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// run keeps the link up
+func (this *relayLink) run() {
+	for {
+		if wait := this.attempt(); wait > 0 {
+			relay_sleep(wait)
+		}
+	}
+}
+
+// attempt connects and serves until the connection is lost, and returns
+// how long to wait before the next attempt
+func (this *relayLink) attempt() time.Duration {
+	this.set_state(RELAY_CONNECTING, nil)
+	conn, err := this.connect()
+	if err != nil {
+		log_error("Error contacting the proxy.")
+		debug(2, "Error contacting the proxy: %s", err)
+	} else {
+		this.set_state(RELAY_CONNECTED, nil)
+		started := time.Now()
+		err = this.serve(conn)
+		if this.replaced() {
+			// the credentials were rotated, move on to the new connection
+			return 0
+		}
+		if err != nil {
+			log_error("Error serving requests")
+			debug(2, "Error in StartServing: %s", err)
+		}
+		if time.Since(started) >= RELAY_STABLE {
+			this.Lock()
+			this.failures = 0
+			this.Unlock()
+		}
+	}
+	this.Lock()
+	this.failures++
+	wait := relay_backoff(this.failures)
+	this.next_attempt = time.Now().Add(wait)
+	this.Unlock()
+	this.set_state(RELAY_WAITING, err)
+	return wait
+}
+
+func (this *relayLink) set_state(state string, err error) {
+	change := relayStateChange{State: state, Time: time.Now()}
+	if err != nil {
+		change.Error = err.Error()
+	}
+	this.Lock()
+	defer this.Unlock()
+	switch state {
+	case RELAY_CONNECTING:
+		this.attempts++
+	case RELAY_CONNECTED:
+		this.connections++
+		this.connected = change.Time
+	}
+	if state == this.state {
+		return
+	}
+	this.state = state
+	this.changes = append(this.changes, change)
+	if len(this.changes) > RELAY_STATE_CHANGES {
+		this.changes = this.changes[len(this.changes)-RELAY_STATE_CHANGES:]
+	}
+	if state == RELAY_WAITING {
+		log_warn("Relay connection lost, trying again in %s", this.next_attempt.Sub(change.Time).Round(time.Second))
+	} else {
+		log("Relay connection %s", state)
+	}
+}
+
+// link_status is the state of the link for status. call with the lock held
+func (this *relayLink) link_status(status map[string]interface{}) {
+	status["state"] = this.state
+	status["attempts"] = this.attempts
+	status["connections"] = this.connections
+	status["failures_in_a_row"] = this.failures
+	status["changes"] = append([]relayStateChange{}, this.changes...)
+	status["reconnects"] = int64(0)
+	if this.connections > 1 {
+		status["reconnects"] = this.connections - 1
+	}
+	if this.state == RELAY_CONNECTED {
+		status["uptime"] = time.Since(this.connected).Seconds()
+	}
+	if this.state == RELAY_WAITING {
+		status["next_attempt"] = this.next_attempt.Format(time.RFC3339)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net"
+	"strconv"
+)
+
+// the HDA can keep several connections to the relay at once, set by
+// relay.connections in the config file, for the relay to spread the
+// requests over, so that a busy or stalled connection does not hold up
+// the others, and so that one being made again after a drop does not take
+// the HDA offline. they can go to different relays, relay.endpoints, in
+// turns. each connection is a link of its own, with its own backoff, made
+// after the first one, which keeps the credentials and the rotations. the
+// relay is told which connection of how many each one is, so that it keeps
+// them all instead of replacing one with the next
+
+// more than this would only cost the relay
+const RELAY_MAX_CONNECTIONS = 8
+
+const RELAY_CONNECTION_HEADER = "Fs-Connection"
+const RELAY_CONNECTIONS_HEADER = "Fs-Connections"
+
+// relay_connections is how many connections to keep
+func relay_connections() int {
+	n := config.Relay.Connections
+	if n < 1 {
+		return 1
+	}
+	if n > RELAY_MAX_CONNECTIONS {
+		return RELAY_MAX_CONNECTIONS
+	}
+	return n
+}
+
+// relay_endpoint is the host and port of the relay of connection index,
+// host and port unless there are endpoints in the config file
+func relay_endpoint(index int, host, port string) (string, string) {
+	if len(config.Relay.Endpoints) == 0 {
+		return host, port
+	}
+	endpoint := config.Relay.Endpoints[index%len(config.Relay.Endpoints)]
+	if h, p, err := net.SplitHostPort(endpoint); err == nil {
+		return h, p
+	}
+	// a host alone is on the default port
+	return endpoint, port
+}
+
+// add_links makes the links of the connections after this one
+func (this *relayLink) add_links() {
+	host, port := this.host, this.port
+	this.host, this.port = relay_endpoint(0, host, port)
+	for i := 1; i < relay_connections(); i++ {
+		link := &relayLink{service: this.service, config_file: this.config_file, api_key_flag: this.api_key_flag, index: i, creds: this.creds}
+		link.host, link.port = relay_endpoint(i, host, port)
+		this.others = append(this.others, link)
+	}
+}
+
+// run_all keeps all the links up
+func (this *relayLink) run_all() {
+	for _, link := range this.others {
+		go link.run()
+	}
+	this.run()
+}
+
+// links are this one and the others
+func (this *relayLink) links() []*relayLink {
+	return append([]*relayLink{this}, this.others...)
+}
+
+// rotate_all rotates the credentials of all the links, once the first one
+// made it with the new ones
+func (this *relayLink) rotate_all() error {
+	if err := this.rotate(); err != nil {
+		return err
+	}
+	for _, link := range this.others {
+		if err := link.rotate(); err != nil && err != errCredentialsUnchanged {
+			log_warn("Relay connection %d not rotated: %s", link.index+1, err.Error())
+		}
+	}
+	return nil
+}
+
+// announce_all reconnects all the links, for the relay to get the HDA info
+// again
+func (this *relayLink) announce_all() error {
+	if err := this.announce(); err != nil {
+		return err
+	}
+	for _, link := range this.others {
+		if err := link.announce(); err != nil {
+			log_warn("Relay connection %d not reconnected: %s", link.index+1, err.Error())
+		}
+	}
+	return nil
+}
+
+// connected_addr is the address of a connection still up, if any
+func (this *relayLink) connected_addr() string {
+	for _, link := range this.links() {
+		link.Lock()
+		conn := link.conn
+		link.Unlock()
+		if conn != nil {
+			return conn.RemoteAddr().String()
+		}
+	}
+	return ""
+}
+
+// connection_headers tells the relay which connection a link makes
+func connection_headers(index int) map[string]string {
+	n := relay_connections()
+	if n == 1 {
+		return nil
+	}
+	return map[string]string{
+		RELAY_CONNECTION_HEADER:  strconv.Itoa(index + 1),
+		RELAY_CONNECTIONS_HEADER: strconv.Itoa(n),
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+// how the HDA connects to a relay is a relayProtocol: dial makes the
+// connection, and handshake registers the HDA on it and returns what to
+// serve the requests of the relay on, over HTTP/2. relay.protocol in the
+// config file picks one, "amahi" by default, and relay.host, relay.port,
+// relay.token and relay.tls point it to a relay of the user's own instead
+// of the one of Amahi.
+//
+// amahiRelay is the reference handshake: over TLS, the HDA sends
+//
+//	PUT /fs HTTP/1.1
+//	Api-Key: <api key>
+//	Authorization: Token <token>
+//
+// with the info of the HDA as a JSON body and, once the relay answers
+// 200, the relay sends the requests of the clients on the same connection
+// as an HTTP/2 client, with the HDA as the server
+
+type relayProtocol interface {
+	dial(host, port string) (net.Conn, error)
+	handshake(conn net.Conn, host, port string, creds relayCredentials, service *MercuryFsService, index int) (net.Conn, error)
+}
+
+const RELAY_PROTOCOL_AMAHI = "amahi"
+
+var relay_protocols = map[string]relayProtocol{
+	RELAY_PROTOCOL_AMAHI: amahiRelay{},
+}
+
+// relay_protocol is the protocol set in the config file
+func relay_protocol() (relayProtocol, error) {
+	name := config.Relay.Protocol
+	if name == "" {
+		name = RELAY_PROTOCOL_AMAHI
+	}
+	protocol, ok := relay_protocols[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown relay protocol %q", name)
+	}
+	return protocol, nil
+}
+
+// relay_tls_config is the TLS config to connect to the relay at host with
+func relay_tls_config(host string) (*tls.Config, error) {
+	settings := config.Relay.TLS
+	tls_config := &tls.Config{ServerName: host}
+	if settings.ServerName != "" {
+		tls_config.ServerName = settings.ServerName
+	}
+	if settings.CAFile != "" {
+		pem, err := ioutil.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tls_config.RootCAs = x509.NewCertPool()
+		if !tls_config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", settings.CAFile)
+		}
+	}
+	if DISABLE_CERT_CHECKING || settings.Insecure {
+		warning := "WARNING WARNING WARNING: running without checking TLS certs!!"
+		log(warning)
+		log(warning)
+		log(warning)
+		fmt.Println(warning)
+		fmt.Println(warning)
+		fmt.Println(warning)
+		tls_config.InsecureSkipVerify = true
+	}
+	return tls_config, nil
+}
+
+type amahiRelay struct{}
+
+func (amahiRelay) dial(host, port string) (net.Conn, error) {
+	relay_location := net.JoinHostPort(host, port)
+	log("Contacting Relay at: " + relay_location)
+	addr, err := net.ResolveTCPAddr("tcp", relay_location)
+	if err != nil {
+		debug(2, "Error with ResolveTCPAddr: %s", err)
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", addr.String(), RELAY_CONNECT_TIMEOUT)
+	if err != nil {
+		debug(2, "Error with initial DialTCP: %s", err)
+		return nil, err
+	}
+	tcp_conn := conn.(*net.TCPConn)
+	tcp_conn.SetKeepAlive(true)
+	tcp_conn.SetLinger(0)
+	return tcp_conn, nil
+}
+
+func (amahiRelay) handshake(conn net.Conn, host, port string, creds relayCredentials, service *MercuryFsService, index int) (net.Conn, error) {
+	relay_location := net.JoinHostPort(host, port)
+	// a relay that does not answer does not hang the connection
+	conn.SetDeadline(time.Now().Add(RELAY_CONNECT_TIMEOUT))
+	service.info.relay_addr = relay_location
+
+	// Send the api-key
+	buf := strings.NewReader(service.info.to_json())
+	request, err := http.NewRequest("PUT", "https://"+relay_location+"/fs", buf)
+	if err != nil {
+		debug(2, "Error creating NewRequest: %s", err)
+		return nil, err
+	}
+
+	request.Header.Add("Api-Key", creds.api_key)
+	request.Header.Add("Authorization", fmt.Sprintf("Token %s", creds.token))
+	for header, value := range connection_headers(index) {
+		request.Header.Set(header, value)
+	}
+	raw_request, _ := httputil.DumpRequest(request, true)
+	debug(5, "%s", raw_request)
+
+	var client *httputil.ClientConn
+
+	if DISABLE_HTTPS || config.Relay.TLS.Disabled {
+		warning := "WARNING WARNING: running without TLS!!"
+		log(warning)
+		fmt.Println(warning)
+		client = httputil.NewClientConn(conn, nil)
+	} else {
+		// each connection has its own, as they can be made at the same time
+		tls_config, err := relay_tls_config(host)
+		if err != nil {
+			debug(2, "Error with the TLS settings of the relay: %s", err)
+			return nil, err
+		}
+		client = httputil.NewClientConn(tls.Client(conn, tls_config), nil)
+	}
+
+	sent := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		debug(2, "Error writing to connection with Do: %s", err)
+		return nil, err
+	}
+	clock.observe(sent, response)
+
+	if response.StatusCode != 200 {
+		msg := fmt.Sprintf("Got an error response: %s", response.Status)
+		log(msg)
+		return nil, errors.New(msg)
+	}
+
+	log("Connected to the proxy")
+
+	net_conn, _ := client.Hijack()
+	conn.SetDeadline(time.Time{})
+
+	return net_conn, nil
+}
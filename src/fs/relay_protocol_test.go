@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/pem"
+	"golang.org/x/net/http2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeRelay is a relay of the user's own, with the reference handshake
+type fakeRelay struct {
+	listener net.Listener
+	cert     tls.Certificate
+	api_key  string
+	served   chan string
+}
+
+func (this *fakeRelay) serve() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			return
+		}
+		go this.handshake(conn)
+	}
+}
+
+func (this *fakeRelay) handshake(conn net.Conn) {
+	defer conn.Close()
+	tls_conn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{this.cert}})
+	request, err := http.ReadRequest(bufio.NewReader(tls_conn))
+	if err != nil || request.Method != "PUT" || request.URL.Path != "/fs" || request.Header.Get("Api-Key") != this.api_key {
+		tls_conn.Write([]byte("HTTP/1.1 401 Unauthorized\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	tls_conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	// the HDA serves the requests of the relay on the connection
+	client, err := new(http2.Transport).NewClientConn(tls_conn)
+	if err != nil {
+		this.served <- err.Error()
+		return
+	}
+	response, err := client.RoundTrip(httptest.NewRequest("GET", "https://hda/shares", nil))
+	if err != nil {
+		this.served <- err.Error()
+		return
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	this.served <- string(body)
+}
+
+func TestRelayProtocol(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = default_config()
+
+	// a certificate that is not trusted by the system
+	server := httptest.NewTLSServer(nil)
+	cert, ca := server.TLS.Certificates[0], server.Certificate()
+	server.Close()
+	dir, _ := ioutil.TempDir("", "relay")
+	defer os.RemoveAll(dir)
+	ca_file := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(ca_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644)
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	relay := &fakeRelay{listener: listener, cert: cert, api_key: "key", served: make(chan string, 1)}
+	go relay.serve()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	service := &MercuryFsService{info: new(HdaInfo)}
+
+	if _, err := contact_pfe(host, port, relayCredentials{api_key: "key"}, service, 0); err == nil {
+		t.Errorf("Connected to a relay with a certificate not trusted")
+	}
+	config.Relay.TLS.CAFile = ca_file
+	config.Relay.TLS.ServerName = "example.com"
+	if _, err := contact_pfe(host, port, relayCredentials{api_key: "wrong"}, service, 0); err == nil {
+		t.Errorf("Connected with the wrong key")
+	}
+	conn, err := contact_pfe(host, port, relayCredentials{api_key: "key"}, service, 0)
+	if err != nil {
+		t.Fatalf("Not connected: %s", err)
+	}
+	go relay_http2_server().ServeConn(conn, &http2.ServeConnOpts{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("the shares"))
+	})})
+	if served := <-relay.served; served != "the shares" {
+		t.Errorf("The relay got %q", served)
+	}
+	conn.Close()
+
+	config.Relay.Protocol = "carrier-pigeon"
+	if _, err := contact_pfe(host, port, relayCredentials{api_key: "key"}, service, 0); err == nil {
+		t.Errorf("Connected with an unknown protocol")
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stats of the HTTP/2 streams (requests) on the relay connection, shown in
+// /hda_debug to debug streams slowing each other down.
+//
+// http2 does not say when a stream runs out of flow-control window, but a
+// handler's Write blocks when that happens, so writes that block for longer
+// than RELAY_WINDOW_WAIT are counted as window exhaustion, and a stream that
+// has been blocked in a write for longer than RELAY_STALL is stalled
+
+const RELAY_WINDOW_WAIT = 50 * time.Millisecond
+const RELAY_STALL = 5 * time.Second
+
+// at most this many streams are listed in the diagnostics
+const RELAY_STREAMS_SHOWN = 50
+
+type relayStream struct {
+	id      uint64
+	method  string
+	path    string
+	started time.Time
+	bytes   int64
+	// when the write in progress started, zero if not writing
+	writing      time.Time
+	window_waits int64
+	waited       time.Duration
+}
+
+type relayStreams struct {
+	streams map[uint64]*relayStream
+	next_id uint64
+	// totals of finished and open streams
+	served, window_waits, stalled int64
+	sync.Mutex
+}
+
+type relayStreamStatus struct {
+	ID          uint64  `json:"id"`
+	Method      string  `json:"method"`
+	Path        string  `json:"path"`
+	Age         float64 `json:"age"`
+	Bytes       int64   `json:"bytes"`
+	WindowWaits int64   `json:"window_waits"`
+	Waited      float64 `json:"waited"`
+	BlockedFor  float64 `json:"blocked_for,omitempty"`
+	Stalled     bool    `json:"stalled,omitempty"`
+}
+
+type relayStreamsStatus struct {
+	Open        int                 `json:"open"`
+	Stalled     int                 `json:"stalled"`
+	Served      int64               `json:"served"`
+	WindowWaits int64               `json:"window_waits"`
+	StalledEver int64               `json:"stalled_total"`
+	Streams     []relayStreamStatus `json:"streams"`
+}
+
+var relay_streams = new_relay_streams()
+
+func new_relay_streams() *relayStreams {
+	return &relayStreams{streams: make(map[uint64]*relayStream)}
+}
+
+// wrap tracks every request served by handler as a stream
+func (this *relayStreams) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		stream := this.open(request)
+		defer this.close(stream)
+		handler.ServeHTTP(&streamWriter{ResponseWriter: writer, streams: this, stream: stream}, mark_relay_request(request))
+	})
+}
+
+func (this *relayStreams) open(request *http.Request) *relayStream {
+	this.Lock()
+	defer this.Unlock()
+	this.next_id++
+	stream := &relayStream{id: this.next_id, method: request.Method, path: pathForLog(request.URL), started: time.Now()}
+	this.streams[stream.id] = stream
+	return stream
+}
+
+func (this *relayStreams) close(stream *relayStream) {
+	this.Lock()
+	defer this.Unlock()
+	delete(this.streams, stream.id)
+	this.served++
+}
+
+func (this *relayStreams) write_started(stream *relayStream) {
+	this.Lock()
+	stream.writing = time.Now()
+	this.Unlock()
+}
+
+func (this *relayStreams) write_done(stream *relayStream, n int) {
+	this.Lock()
+	defer this.Unlock()
+	took := time.Since(stream.writing)
+	stream.bytes += int64(n)
+	stream.writing = time.Time{}
+	if took >= RELAY_WINDOW_WAIT {
+		stream.window_waits++
+		stream.waited += took
+		this.window_waits++
+	}
+	if took >= RELAY_STALL {
+		this.stalled++
+	}
+}
+
+func (this *relayStreams) status() *relayStreamsStatus {
+	this.Lock()
+	defer this.Unlock()
+	now := time.Now()
+	status := &relayStreamsStatus{Open: len(this.streams), Served: this.served, WindowWaits: this.window_waits, StalledEver: this.stalled}
+	status.Streams = make([]relayStreamStatus, 0, len(this.streams))
+	for _, stream := range this.streams {
+		s := relayStreamStatus{
+			ID:          stream.id,
+			Method:      stream.method,
+			Path:        stream.path,
+			Age:         now.Sub(stream.started).Seconds(),
+			Bytes:       stream.bytes,
+			WindowWaits: stream.window_waits,
+			Waited:      stream.waited.Seconds(),
+		}
+		if !stream.writing.IsZero() {
+			blocked := now.Sub(stream.writing)
+			s.BlockedFor = blocked.Seconds()
+			s.Stalled = blocked >= RELAY_STALL
+		}
+		if s.Stalled {
+			status.Stalled++
+		}
+		status.Streams = append(status.Streams, s)
+	}
+	// the longest blocked streams first, then the oldest
+	sort.Slice(status.Streams, func(i, j int) bool {
+		a, b := status.Streams[i], status.Streams[j]
+		if a.BlockedFor != b.BlockedFor {
+			return a.BlockedFor > b.BlockedFor
+		}
+		return a.ID < b.ID
+	})
+	if len(status.Streams) > RELAY_STREAMS_SHOWN {
+		status.Streams = status.Streams[:RELAY_STREAMS_SHOWN]
+	}
+	return status
+}
+
+// streamWriter times the writes of a stream
+type streamWriter struct {
+	http.ResponseWriter
+	streams *relayStreams
+	stream  *relayStream
+}
+
+func (this *streamWriter) Write(data []byte) (int, error) {
+	this.streams.write_started(this.stream)
+	n, err := this.ResponseWriter.Write(data)
+	this.streams.write_done(this.stream, n)
+	return n, err
+}
+
+// Flush is needed by /events
+func (this *streamWriter) Flush() {
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		this.streams.write_started(this.stream)
+		flusher.Flush()
+		this.streams.write_done(this.stream, 0)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// blockedWriter blocks every write until released, like a stream without window
+type blockedWriter struct {
+	*httptest.ResponseRecorder
+	release chan bool
+}
+
+func (this *blockedWriter) Write(data []byte) (int, error) {
+	<-this.release
+	return this.ResponseRecorder.Write(data)
+}
+
+func TestRelayStreams(t *testing.T) {
+	streams := new_relay_streams()
+	handler := streams.wrap(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("hello"))
+	}))
+
+	writer := &blockedWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan bool)}
+	done := make(chan bool)
+	go func() {
+		handler.ServeHTTP(writer, httptest.NewRequest("GET", "/files?s=Movies&p=/big.mkv", nil))
+		close(done)
+	}()
+
+	time.Sleep(2 * RELAY_WINDOW_WAIT)
+	status := streams.status()
+	if status.Open != 1 || len(status.Streams) != 1 || status.Streams[0].BlockedFor == 0 {
+		t.Fatalf("Blocked stream not reported: %+v", status)
+	}
+	if status.Streams[0].Path != "/files?s=Movies&p=/big.mkv" || status.Stalled != 0 {
+		t.Errorf("Wrong stream status: %+v", status.Streams[0])
+	}
+
+	writer.release <- true
+	<-done
+	status = streams.status()
+	if status.Open != 0 || status.Served != 1 || status.WindowWaits != 1 {
+		t.Errorf("Wrong totals after the stream finished: %+v", status)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRelayRotate(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	dir, _ := ioutil.TempDir("", "relay")
+	defer os.RemoveAll(dir)
+	config_file := filepath.Join(dir, "fs.conf")
+	ioutil.WriteFile(config_file, []byte(`{"relay": {"api_key": "old-key"}}`), 0600)
+	load_config(config_file)
+
+	link := &relayLink{host: "127.0.0.1", port: "1", config_file: config_file}
+	creds, err := link.relay_credentials()
+	if err != nil || creds.api_key != "old-key" || creds.token != SECRET_TOKEN {
+		t.Fatalf("Wrong credentials from the config file: %v %v", creds, err)
+	}
+	link.creds = creds
+	if err := link.rotate(); err != errCredentialsUnchanged {
+		t.Errorf("Rotating the same credentials: %v", err)
+	}
+
+	// new credentials that cannot connect do not replace the current ones
+	ioutil.WriteFile(config_file, []byte(`{"relay": {"api_key": "new-key", "token": "new-token"}}`), 0600)
+	if err := link.rotate(); err == nil || err == errCredentialsUnchanged {
+		t.Errorf("Rotation without a relay succeeded: %v", err)
+	}
+	if link.credentials() != creds || link.replaced() {
+		t.Errorf("Failed rotation changed the credentials")
+	}
+
+	// the command line wins, except in production
+	link.api_key_flag = "flag-key"
+	if creds, _ := link.relay_credentials(); (creds.api_key == "flag-key") == PRODUCTION || creds.token != "new-token" {
+		t.Errorf("Wrong credentials with a command line key: %v", creds)
+	}
+}
+
+func TestRelayHTTP2Settings(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = default_config()
+	dir, _ := ioutil.TempDir("", "relay")
+	defer os.RemoveAll(dir)
+	config_file := filepath.Join(dir, "fs.conf")
+	ioutil.WriteFile(config_file, []byte(`{"relay": {"http2": {"stream_window": 8388608, "idle_timeout": "1h", "read_idle_timeout": "soon"}}}`), 0600)
+	load_config(config_file)
+
+	server := relay_http2_server()
+	if server.MaxUploadBufferPerStream != 8<<20 || server.MaxUploadBufferPerConnection != 32<<20 || server.MaxConcurrentStreams != 500 {
+		t.Errorf("Wrong windows: %+v", server)
+	}
+	if server.IdleTimeout != time.Hour || server.ReadIdleTimeout != 10*time.Second {
+		t.Errorf("Wrong timeouts: %s %s", server.IdleTimeout, server.ReadIdleTimeout)
+	}
+}
+
+func TestRelayBackoff(t *testing.T) {
+	for failures, max := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 5: 32 * time.Second, 8: 2 * time.Minute, 100: 2 * time.Minute} {
+		for i := 0; i < 20; i++ {
+			if wait := relay_backoff(failures); wait < max/2 || wait > max {
+				t.Errorf("Wrong wait after %d failures: %s", failures, wait)
+			}
+		}
+	}
+
+	// a relay that is not there
+	link := &relayLink{host: "127.0.0.1", port: "1"}
+	waits := []time.Duration{}
+	for i := 0; i < 3; i++ {
+		waits = append(waits, link.attempt())
+	}
+	if waits[2] < 4*time.Second {
+		t.Errorf("The waits do not grow: %v", waits)
+	}
+	status := link.status()
+	if status["state"] != RELAY_WAITING || status["attempts"] != int64(3) || status["failures_in_a_row"] != 3 || status["next_attempt"] == nil {
+		t.Errorf("Wrong status: %v", status)
+	}
+	if changes := status["changes"].([]relayStateChange); len(changes) != 6 || changes[5].Error == "" {
+		t.Errorf("Wrong changes: %v", changes)
+	}
+}
+
+func TestRelayLinks(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = default_config()
+
+	link := &relayLink{host: "relay.amahi.net", port: "443"}
+	link.add_links()
+	if len(link.links()) != 1 || connection_headers(0) != nil {
+		t.Fatalf("More than one link by default")
+	}
+
+	config.Relay.Connections = 3
+	config.Relay.Endpoints = []string{"relay1.example.com:4443", "relay2.example.com"}
+	link = &relayLink{host: "relay.amahi.net", port: "443", creds: relayCredentials{api_key: "key"}}
+	link.add_links()
+	links := link.links()
+	if len(links) != 3 {
+		t.Fatalf("%d links", len(links))
+	}
+	for i, expected := range []string{"relay1.example.com:4443", "relay2.example.com:443", "relay1.example.com:4443"} {
+		if endpoint := links[i].host + ":" + links[i].port; endpoint != expected || links[i].index != i || links[i].creds.api_key != "key" {
+			t.Errorf("Link %d to %s", i, endpoint)
+		}
+	}
+	if headers := connection_headers(2); headers[RELAY_CONNECTION_HEADER] != "3" || headers[RELAY_CONNECTIONS_HEADER] != "3" {
+		t.Errorf("Wrong headers: %v", headers)
+	}
+	config.Relay.Connections = 100
+	if relay_connections() != RELAY_MAX_CONNECTIONS {
+		t.Errorf("Connections not capped")
+	}
+
+	// the others keep the HDA reachable
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	links[2].conn = client
+	if link.connected_addr() != "pipe" {
+		t.Errorf("Wrong address: %s", link.connected_addr())
+	}
+	status := link.status()
+	if status["connected"] != false || status["open"] != 1 || len(status["links"].([]map[string]interface{})) != 3 {
+		t.Errorf("Wrong status: %v", status)
+	}
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// every request has an id, the X-Request-ID of the client when it sends
+// one, or a new one. it's echoed back in the response, is in the error
+// bodies, and is logged with the path of the request, so that what a user
+// sees can be found in the logs. the id is kept in the fragment of the URL,
+// which clients never send, for pathForLog to find it
+
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// ids from clients are only taken when they cannot mess up the logs
+var valid_request_id = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+func new_request_id() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// with_request_id gives the request its id, and echoes it in the response
+func with_request_id(writer http.ResponseWriter, request *http.Request) {
+	id := request.Header.Get(REQUEST_ID_HEADER)
+	if !valid_request_id.MatchString(id) {
+		id = new_request_id()
+		// passed along to the apps too
+		request.Header.Set(REQUEST_ID_HEADER, id)
+	}
+	request.URL.Fragment = id
+	writer.Header().Set(REQUEST_ID_HEADER, id)
+}
+
+// request_id_of is the id of a request
+func request_id_of(request *http.Request) string {
+	return request.URL.Fragment
+}
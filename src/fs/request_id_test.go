@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	service := &MercuryFsService{api_router: mux.NewRouter(), debug_info: new(debugInfo)}
+	service.api_router.HandleFunc("/fail", func(writer http.ResponseWriter, request *http.Request) {
+		seen = pathForLog(request.URL)
+		json_response(writer, http.StatusBadRequest, map[string]string{"error": "bad"})
+	})
+	request := func(id string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/fail?s=Docs", nil)
+		if id != "" {
+			r.Header.Set(REQUEST_ID_HEADER, id)
+		}
+		service.top_vhost_filter(recorder, r)
+		return recorder
+	}
+
+	// the id of the client is echoed, logged and in the error
+	response := request("support-42")
+	if response.Header().Get(REQUEST_ID_HEADER) != "support-42" {
+		t.Errorf("Id not echoed: %v", response.Header())
+	}
+	if seen != "/fail?s=Docs#support-42" {
+		t.Errorf("Id not logged: %s", seen)
+	}
+	if body := response.Body.String(); !strings.Contains(body, `"request_id":"support-42"`) || !strings.Contains(body, `"error":"bad"`) {
+		t.Errorf("Id not in the error: %s", body)
+	}
+
+	// or made when there's none or it cannot be logged
+	for _, id := range []string{"", "a b\n", strings.Repeat("x", 65)} {
+		got := request(id).Header().Get(REQUEST_ID_HEADER)
+		if !valid_request_id.MatchString(got) || got == id {
+			t.Errorf("Wrong id %q for %q", got, id)
+		}
+	}
+	if request("").Header().Get(REQUEST_ID_HEADER) == request("").Header().Get(REQUEST_ID_HEADER) {
+		t.Errorf("Made ids repeat")
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the requests that take longer than logging.slow_request to answer are
+// logged as warnings, with their id and where the time went: in the
+// middlewares, in the steps of the handler that marked them with
+// trace_mark, like "open" or "list", until the headers, and sending the
+// body. streams only count until their headers, they take as long as
+// what they send
+
+type traceMark struct {
+	name string
+	at   time.Time
+}
+
+type requestTrace struct {
+	started time.Time
+	marks   []traceMark
+	sync.Mutex
+}
+
+type requestTraceKey struct{}
+
+// trace_mark ends the step name of the request, since the last one
+func trace_mark(request *http.Request, name string) {
+	trace, _ := request.Context().Value(requestTraceKey{}).(*requestTrace)
+	if trace == nil {
+		return
+	}
+	trace.Lock()
+	trace.marks = append(trace.marks, traceMark{name, time.Now()})
+	trace.Unlock()
+}
+
+// breakdown is how long each step took, like "open 2ms, list 4.1s"
+func (this *requestTrace) breakdown(ended time.Time) string {
+	this.Lock()
+	defer this.Unlock()
+	var buf bytes.Buffer
+	last := this.started
+	for _, mark := range append(this.marks, traceMark{"body", ended}) {
+		if buf.Len() > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%s %s", mark.name, mark.at.Sub(last).Round(time.Millisecond))
+		last = mark.at
+	}
+	return buf.String()
+}
+
+// headers is when the headers were sent, or zero
+func (this *requestTrace) headers() time.Time {
+	this.Lock()
+	defer this.Unlock()
+	for _, mark := range this.marks {
+		if mark.name == "headers" {
+			return mark.at
+		}
+	}
+	return time.Time{}
+}
+
+// tracedWriter marks when the headers are sent
+type tracedWriter struct {
+	*statusWriter
+	request *http.Request
+}
+
+func (this *tracedWriter) WriteHeader(status int) {
+	if this.status == 0 {
+		trace_mark(this.request, "headers")
+	}
+	this.statusWriter.WriteHeader(status)
+}
+
+func (this *tracedWriter) Write(data []byte) (int, error) {
+	if this.status == 0 {
+		trace_mark(this.request, "headers")
+	}
+	return this.statusWriter.Write(data)
+}
+
+func (this *tracedWriter) ReadFrom(reader io.Reader) (int64, error) {
+	if this.status == 0 {
+		trace_mark(this.request, "headers")
+	}
+	return this.statusWriter.ReadFrom(reader)
+}
+
+// traced is the first middleware, tracing the requests when
+// logging.slow_request is set
+func (service *MercuryFsService) traced(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		slow, _ := time.ParseDuration(config.Logging.SlowRequest)
+		if slow <= 0 {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		trace := &requestTrace{started: time.Now()}
+		request = request.WithContext(context.WithValue(request.Context(), requestTraceKey{}, trace))
+		traced_writer := &tracedWriter{statusWriter: &statusWriter{ResponseWriter: writer}, request: request}
+		next.ServeHTTP(traced_writer, request)
+
+		ended := time.Now()
+		took := ended.Sub(trace.started)
+		if headers := trace.headers(); is_stream(request) && !headers.IsZero() {
+			took = headers.Sub(trace.started)
+		}
+		if took > slow {
+			log_warn("\"%s %s\" %d slow, %s: %s", request.Method, pathForLog(request.URL), traced_writer.status,
+				took.Round(time.Millisecond), trace.breakdown(ended))
+		}
+	})
+}
+
+// handler_started is the last middleware, ending the time in the others
+func handler_started(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		trace_mark(request, "middlewares")
+		next.ServeHTTP(writer, request)
+	})
+}
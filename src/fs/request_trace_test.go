@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSlowRequest(t *testing.T) {
+	saved_logger, saved_config := logger, config
+	defer func() { logger, config = saved_logger, saved_config }()
+	var out bytes.Buffer
+	logger = new_leveled_logger(&out)
+	logger.configure(LOG_FORMAT_JSON, "info", nil)
+	config = default_config()
+	config.Logging.SlowRequest = "20ms"
+
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/files", func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Query().Get("p") == "/slow" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		trace_mark(request, "list")
+		writer.Write([]byte("[]"))
+	})
+	router.Use(service.traced, service.recover_errors, handler_started)
+	serve := func(target string) {
+		recorder, request := httptest.NewRecorder(), httptest.NewRequest("GET", target, nil)
+		with_request_id(recorder, request)
+		router.ServeHTTP(recorder, request)
+	}
+
+	serve("/files?s=Movies&p=/fast")
+	if out.Len() != 0 {
+		t.Errorf("Logged a fast request: %s", out.String())
+	}
+	serve("/files?s=Movies&p=/slow")
+	var line logLine
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("Not logged: %q", out.String())
+	}
+	breakdown := regexp.MustCompile(`#` + line.RequestID + `" 200 slow, [3-9]\dms: middlewares [\w.µ]+, list [3-9]\dms, headers [\w.µ]+, body [\w.µ]+$`)
+	if line.Level != "warn" || line.RequestID == "" || !breakdown.MatchString(line.Message) {
+		t.Errorf("Wrong slow request line: %+v", line)
+	}
+
+	// and not at all when it's off
+	out.Reset()
+	config.Logging.SlowRequest = ""
+	serve("/files?s=Movies&p=/slow")
+	if out.Len() != 0 {
+		t.Errorf("Traced with slow_request off: %s", out.String())
+	}
+}
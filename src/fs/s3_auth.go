@@ -0,0 +1,293 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS signature version 4, as used by S3 clients (restic, rclone, aws cli, ...).
+// only header based authentication is supported, not presigned URLs
+
+const S3_SIGNING_ALGORITHM = "AWS4-HMAC-SHA256"
+const S3_UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+const S3_STREAMING_PAYLOAD = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+// the format of X-Amz-Date
+const S3_AMZ_DATE_FORMAT = "20060102T150405Z"
+
+var errS3AccessDenied = errors.New("AccessDenied")
+var errS3BadDigest = errors.New("XAmzContentSHA256Mismatch")
+
+var empty_sha256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// s3Signature is the parsed Authorization header of a request
+type s3Signature struct {
+	access_key     string
+	date           string
+	region         string
+	service        string
+	signed_headers []string
+	signature      string
+}
+
+func parse_s3_authorization(header string) (*s3Signature, error) {
+	if !strings.HasPrefix(header, S3_SIGNING_ALGORITHM+" ") {
+		return nil, errS3AccessDenied
+	}
+	sig := new(s3Signature)
+	for _, field := range strings.Split(strings.TrimPrefix(header, S3_SIGNING_ALGORITHM+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, errS3AccessDenied
+		}
+		switch kv[0] {
+		case "Credential":
+			scope := strings.Split(kv[1], "/")
+			if len(scope) != 5 || scope[4] != "aws4_request" {
+				return nil, errS3AccessDenied
+			}
+			sig.access_key, sig.date, sig.region, sig.service = scope[0], scope[1], scope[2], scope[3]
+		case "SignedHeaders":
+			sig.signed_headers = strings.Split(kv[1], ";")
+		case "Signature":
+			sig.signature = kv[1]
+		}
+	}
+	if sig.access_key == "" || sig.signature == "" || len(sig.signed_headers) == 0 {
+		return nil, errS3AccessDenied
+	}
+	return sig, nil
+}
+
+func (this *s3Signature) scope() string {
+	return this.date + "/" + this.region + "/" + this.service + "/aws4_request"
+}
+
+func hmac_sha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	io.WriteString(h, data)
+	return h.Sum(nil)
+}
+
+func (this *s3Signature) signing_key(secret string) []byte {
+	key := hmac_sha256([]byte("AWS4"+secret), this.date)
+	key = hmac_sha256(key, this.region)
+	key = hmac_sha256(key, this.service)
+	return hmac_sha256(key, "aws4_request")
+}
+
+// s3_uri_encode encodes everything but the unreserved characters, as AWS requires
+func s3_uri_encode(s string, encode_slash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encode_slash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func s3_canonical_request(request *http.Request, signed_headers []string, payload_hash string) string {
+	path := request.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	query := request.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := []string{}
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3_uri_encode(k, true)+"="+s3_uri_encode(v, true))
+		}
+	}
+
+	var headers bytes.Buffer
+	for _, h := range signed_headers {
+		value := ""
+		if h == "host" {
+			value = request.Host
+		} else {
+			value = strings.Join(request.Header[http.CanonicalHeaderKey(h)], ",")
+		}
+		headers.WriteString(h + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	return strings.Join([]string{
+		request.Method,
+		s3_uri_encode(path, false),
+		strings.Join(params, "&"),
+		headers.String(),
+		strings.Join(signed_headers, ";"),
+		payload_hash,
+	}, "\n")
+}
+
+// s3_verify_request checks the signature of the request headers and returns
+// the signature, needed to verify streaming uploads
+func s3_verify_request(request *http.Request, access_key, secret string) (*s3Signature, error) {
+	sig, err := parse_s3_authorization(request.Header.Get("Authorization"))
+	if err != nil {
+		return nil, err
+	}
+	if sig.access_key != access_key {
+		return nil, errS3AccessDenied
+	}
+	amz_date := request.Header.Get("X-Amz-Date")
+	if !strings.HasPrefix(amz_date, sig.date) {
+		return nil, errS3AccessDenied
+	}
+	payload_hash := request.Header.Get("X-Amz-Content-Sha256")
+	if payload_hash == "" {
+		payload_hash = empty_sha256
+	}
+
+	canonical := s3_canonical_request(request, sig.signed_headers, payload_hash)
+	debug(5, "S3 canonical request:\n%s", canonical)
+	string_to_sign := S3_SIGNING_ALGORITHM + "\n" + amz_date + "\n" + sig.scope() + "\n" + sha256_hex([]byte(canonical))
+	expected := hex.EncodeToString(hmac_sha256(sig.signing_key(secret), string_to_sign))
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		return nil, errS3AccessDenied
+	}
+	return sig, nil
+}
+
+// s3_fresh says if a request was signed recently enough, so that old ones
+// cannot be replayed, when the clock can tell
+func s3_fresh(request *http.Request) bool {
+	signed, err := time.Parse(S3_AMZ_DATE_FORMAT, request.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	return !clock.trusted() || clock.within(signed)
+}
+
+func sha256_hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3_body returns a reader for the payload of a signed request that checks,
+// as it is read, that the payload is the one that was signed
+func s3_body(request *http.Request, sig *s3Signature, secret string) io.Reader {
+	payload_hash := request.Header.Get("X-Amz-Content-Sha256")
+	switch payload_hash {
+	case S3_UNSIGNED_PAYLOAD:
+		return request.Body
+	case S3_STREAMING_PAYLOAD:
+		return &s3ChunkedReader{
+			reader:    bufio.NewReader(request.Body),
+			key:       sig.signing_key(secret),
+			amz_date:  request.Header.Get("X-Amz-Date"),
+			scope:     sig.scope(),
+			signature: sig.signature,
+		}
+	case "":
+		payload_hash = empty_sha256
+	}
+	return &s3HashingReader{reader: request.Body, hash: sha256.New(), expected: payload_hash}
+}
+
+// s3HashingReader fails at the end of the body if it does not match the signed hash
+type s3HashingReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func (this *s3HashingReader) Read(p []byte) (int, error) {
+	n, err := this.reader.Read(p)
+	this.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(this.hash.Sum(nil)) != this.expected {
+		return n, errS3BadDigest
+	}
+	return n, err
+}
+
+// s3ChunkedReader decodes an aws-chunked body, checking the signature of every chunk
+type s3ChunkedReader struct {
+	reader    *bufio.Reader
+	key       []byte
+	amz_date  string
+	scope     string
+	signature string
+	chunk     []byte
+	done      bool
+}
+
+func (this *s3ChunkedReader) Read(p []byte) (int, error) {
+	for len(this.chunk) == 0 {
+		if this.done {
+			return 0, io.EOF
+		}
+		if err := this.next_chunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, this.chunk)
+	this.chunk = this.chunk[n:]
+	return n, nil
+}
+
+func (this *s3ChunkedReader) next_chunk() error {
+	// <hex size>;chunk-signature=<signature>\r\n<data>\r\n
+	line, err := this.reader.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	parts := strings.SplitN(strings.TrimSpace(line), ";chunk-signature=", 2)
+	if len(parts) != 2 {
+		return errS3BadDigest
+	}
+	size, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil || size < 0 || size > 16<<20 {
+		return errS3BadDigest
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(this.reader, data); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	data = data[:size]
+
+	string_to_sign := "AWS4-HMAC-SHA256-PAYLOAD\n" + this.amz_date + "\n" + this.scope + "\n" +
+		this.signature + "\n" + empty_sha256 + "\n" + sha256_hex(data)
+	expected := hex.EncodeToString(hmac_sha256(this.key, string_to_sign))
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return errS3BadDigest
+	}
+	this.signature = expected
+	this.chunk = data
+	this.done = size == 0
+	return nil
+}
@@ -0,0 +1,818 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a minimal S3 API on top of the shares, so that backup tools that speak S3
+// (restic, rclone, etc.) can use the HDA directly. every share is a bucket
+// and object keys are paths inside the share.
+
+const S3_XMLNS = "http://s3.amazonaws.com/doc/2006-03-01/"
+const S3_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+const S3_MAX_KEYS = 1000
+const S3_UPLOADS_DIR = DATA_DIR + "/s3-uploads"
+
+// multipart uploads not completed in this long are removed
+const S3_UPLOAD_EXPIRY = 7 * 24 * time.Hour
+
+type s3Gateway struct {
+	service *MercuryFsService
+}
+
+func start_s3_gateway(service *MercuryFsService) {
+	if config.S3.AccessKey == "" || config.S3.SecretKey == "" {
+		log("S3 gateway not started: access_key and secret_key are required")
+		return
+	}
+	scheduler.add("s3-uploads-cleanup", 24*time.Hour, time.Hour, s3_cleanup_uploads)
+
+	server := &http.Server{Addr: ":" + config.S3.Port, Handler: &s3Gateway{service: service}}
+	log("Starting S3 gateway on port %s", config.S3.Port)
+	err := server.ListenAndServe()
+	if err != nil {
+		log_error("S3 gateway could not be started")
+		debug(2, "Error in S3 gateway: %s", err.Error())
+	}
+}
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+func s3_error(writer http.ResponseWriter, request *http.Request, status int, code, message string) {
+	debug(3, "S3 %s %s: %d %s", request.Method, request.URL.Path, status, code)
+	s3_xml(writer, status, &s3ErrorResponse{Code: code, Message: message, Resource: request.URL.Path})
+}
+
+func s3_xml(writer http.ResponseWriter, status int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/xml")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(data)))
+	writer.WriteHeader(status)
+	io.WriteString(writer, xml.Header)
+	writer.Write(data)
+}
+
+// s3_bucket_name is the bucket for a share: lower case and without spaces
+func s3_bucket_name(share string) string {
+	return strings.ToLower(strings.Replace(share, " ", "-", -1))
+}
+
+func (this *s3Gateway) share(bucket string) *HdaShare {
+	shares := this.service.Shares
+	shares.RLock()
+	defer shares.RUnlock()
+	for _, share := range shares.Shares {
+		// there are no users here
+		if s3_bucket_name(share.name) == bucket && !is_homes_share(share.name) {
+			return share
+		}
+	}
+	return nil
+}
+
+// s3_valid_key rejects keys that would step out of the share
+func s3_valid_key(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." || segment == "." {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *s3Gateway) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	sig, err := s3_verify_request(request, config.S3.AccessKey, config.S3.SecretKey)
+	if err != nil {
+		s3_error(writer, request, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+	if !s3_fresh(request) {
+		s3_error(writer, request, http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(request.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	query := request.URL.Query()
+
+	if bucket == "" {
+		if request.Method != "GET" {
+			s3_error(writer, request, http.StatusMethodNotAllowed, "MethodNotAllowed", "Method not allowed")
+			return
+		}
+		this.list_buckets(writer, request)
+		return
+	}
+
+	share := this.share(bucket)
+	if share == nil {
+		this.service.Shares.update_shares()
+		share = this.share(bucket)
+	}
+	if share == nil {
+		s3_error(writer, request, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	if !share_open(share.name, schedule_now()) {
+		s3_error(writer, request, http.StatusForbidden, "AccessDenied", "The bucket is not available at this time")
+		return
+	}
+	if !s3_valid_key(key) {
+		s3_error(writer, request, http.StatusBadRequest, "InvalidArgument", "Invalid key")
+		return
+	}
+	if share.read_only && request.Method != "GET" && request.Method != "HEAD" {
+		s3_error(writer, request, http.StatusForbidden, "AccessDenied", "The bucket is read only")
+		return
+	}
+	_, has_upload_id := query["uploadId"]
+
+	switch {
+	case key == "" && request.Method == "HEAD":
+		writer.WriteHeader(http.StatusOK)
+	case key == "" && request.Method == "GET":
+		if _, ok := query["location"]; ok {
+			s3_xml(writer, http.StatusOK, &s3LocationConstraint{})
+		} else if _, ok := query["uploads"]; ok {
+			s3_xml(writer, http.StatusOK, &s3ListMultipartUploadsResult{Bucket: bucket})
+		} else {
+			this.list_objects(writer, request, bucket, share)
+		}
+	case key == "" && request.Method == "POST":
+		if _, ok := query["delete"]; ok {
+			this.delete_objects(writer, request, sig, share)
+		} else {
+			s3_error(writer, request, http.StatusNotImplemented, "NotImplemented", "Not implemented")
+		}
+	case key == "":
+		// buckets are shares, they cannot be created or removed through S3
+		s3_error(writer, request, http.StatusNotImplemented, "NotImplemented", "Buckets are managed by the HDA")
+	case request.Method == "GET" || request.Method == "HEAD":
+		this.get_object(writer, request, share, key)
+	case request.Method == "PUT" && has_upload_id:
+		this.upload_part(writer, request, sig, bucket, key)
+	case request.Method == "PUT" && request.Header.Get("X-Amz-Copy-Source") != "":
+		s3_error(writer, request, http.StatusNotImplemented, "NotImplemented", "Copying objects is not supported")
+	case request.Method == "PUT":
+		this.put_object(writer, request, sig, share, key)
+	case request.Method == "POST" && has_upload_id:
+		this.complete_multipart(writer, request, sig, bucket, share, key)
+	case request.Method == "POST":
+		if _, ok := query["uploads"]; ok {
+			this.create_multipart(writer, request, bucket, key)
+		} else {
+			s3_error(writer, request, http.StatusNotImplemented, "NotImplemented", "Not implemented")
+		}
+	case request.Method == "DELETE" && has_upload_id:
+		this.abort_multipart(writer, request, bucket, key)
+	case request.Method == "DELETE":
+		this.delete_object(writer, request, share, key)
+	default:
+		s3_error(writer, request, http.StatusMethodNotAllowed, "MethodNotAllowed", "Method not allowed")
+	}
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   string     `xml:"Owner>ID"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3LocationConstraint struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+func (this *s3Gateway) list_buckets(writer http.ResponseWriter, request *http.Request) {
+	shares := this.service.Shares
+	shares.refresh()
+	result := &s3ListAllMyBucketsResult{Xmlns: S3_XMLNS, Owner: "amahi"}
+	shares.RLock()
+	for _, share := range shares.Shares {
+		if is_homes_share(share.name) {
+			continue
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{
+			Name:         s3_bucket_name(share.name),
+			CreationDate: share.updated_at.UTC().Format(S3_TIME_FORMAT),
+		})
+	}
+	shares.RUnlock()
+	s3_xml(writer, http.StatusOK, result)
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	KeyCount              *int             `xml:"KeyCount,omitempty"`
+	Marker                *string          `xml:"Marker,omitempty"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// s3Entry is an object or a common prefix, in listing order
+type s3Entry struct {
+	key string
+	fi  os.FileInfo
+}
+
+func s3_etag(key string, fi os.FileInfo) string {
+	return `"` + sha1string(key+fi.ModTime().UTC().Format(http.TimeFormat)) + `"`
+}
+
+// s3_list returns the objects and common prefixes under prefix, sorted by
+// key, without the symlinks that policy does not follow
+func s3_list(root, prefix, delimiter, policy string) []s3Entry {
+	base := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		base = prefix[:i+1]
+	}
+	entries := []s3Entry{}
+	seen := make(map[string]bool)
+
+	if delimiter == "/" {
+		// only one directory is needed
+		dir, err := os.Open(filepath.Join(root, base))
+		if err != nil {
+			return entries
+		}
+		fis, _ := dir.Readdir(0)
+		dir.Close()
+		fis = symlinks_hidden(nil, root, filepath.Join(root, base), policy).visible(fis)
+		for _, fi := range fis {
+			key := base + fi.Name()
+			if strings.HasPrefix(fi.Name(), ".") || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if fi.IsDir() || isSymlinkDir(fi, filepath.Join(root, base)) {
+				entries = append(entries, s3Entry{key: key + "/"})
+			} else {
+				entries = append(entries, s3Entry{key: key, fi: fi})
+			}
+		}
+	} else {
+		start := filepath.Join(root, base)
+		filepath.Walk(start, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || path == start {
+				return nil
+			}
+			if strings.HasPrefix(fi.Name(), ".") {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if fi.IsDir() || (fi.Mode()&os.ModeSymlink != 0 && !symlink_allowed(path, root, policy)) {
+				return nil
+			}
+			key := filepath.ToSlash(strings.TrimPrefix(path, root+"/"))
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			if delimiter != "" {
+				rest := key[len(prefix):]
+				if i := strings.Index(rest, delimiter); i >= 0 {
+					common := prefix + rest[:i+len(delimiter)]
+					if !seen[common] {
+						seen[common] = true
+						entries = append(entries, s3Entry{key: common})
+					}
+					return nil
+				}
+			}
+			entries = append(entries, s3Entry{key: key, fi: fi})
+			return nil
+		})
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].key < entries[b].key })
+	return entries
+}
+
+func (this *s3Gateway) list_objects(writer http.ResponseWriter, request *http.Request, bucket string, share *HdaShare) {
+	query := request.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	result := &s3ListBucketResult{
+		Xmlns:     S3_XMLNS,
+		Name:      bucket,
+		Prefix:    query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		MaxKeys:   S3_MAX_KEYS,
+	}
+	// the prefix is a directory to read, held to the share like the keys
+	if !s3_valid_key(result.Prefix) {
+		s3_error(writer, request, http.StatusBadRequest, "InvalidArgument", "Invalid prefix")
+		return
+	}
+	if max, err := strconv.Atoi(query.Get("max-keys")); err == nil && max >= 0 && max < S3_MAX_KEYS {
+		result.MaxKeys = max
+	}
+	url_encode := query.Get("encoding-type") == "url"
+	if url_encode {
+		result.EncodingType = "url"
+	}
+
+	after := ""
+	if v2 {
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+		after = result.StartAfter
+		if result.ContinuationToken != "" {
+			token, err := base64.URLEncoding.DecodeString(result.ContinuationToken)
+			if err != nil {
+				s3_error(writer, request, http.StatusBadRequest, "InvalidArgument", "Invalid continuation token")
+				return
+			}
+			after = string(token)
+		}
+	} else {
+		marker := query.Get("marker")
+		result.Marker = &marker
+		after = marker
+	}
+
+	encode := func(key string) string {
+		if url_encode {
+			return s3_uri_encode(key, false)
+		}
+		return key
+	}
+
+	last := ""
+	count := 0
+	for _, entry := range s3_list(share.path, result.Prefix, result.Delimiter, symlinks_policy(share.name)) {
+		if entry.key <= after {
+			continue
+		}
+		if count == result.MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if entry.fi == nil {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry.key)})
+		} else {
+			result.Contents = append(result.Contents, s3Object{
+				Key:          encode(entry.key),
+				LastModified: entry.fi.ModTime().UTC().Format(S3_TIME_FORMAT),
+				ETag:         s3_etag(entry.key, entry.fi),
+				Size:         entry.fi.Size(),
+				StorageClass: "STANDARD",
+			})
+		}
+		last = entry.key
+		count++
+	}
+
+	if v2 {
+		result.KeyCount = &count
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+		}
+	} else if result.IsTruncated {
+		result.NextMarker = encode(last)
+	}
+	s3_xml(writer, http.StatusOK, result)
+}
+
+func (this *s3Gateway) get_object(writer http.ResponseWriter, request *http.Request, share *HdaShare, key string) {
+	full_path, err := this.service.fullPathToFile(share.name, "/"+key)
+	if err != nil {
+		s3_error(writer, request, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+	file, err := os.Open(full_path)
+	if err != nil {
+		s3_error(writer, request, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil || fi.IsDir() {
+		s3_error(writer, request, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+	writer.Header().Set("ETag", s3_etag(key, fi))
+	writer.Header().Set("Content-Type", getContentType(fi.Name()))
+	http.ServeContent(writer, request, fi.Name(), fi.ModTime(), file)
+	this.service.debug_info.requestServed(fi.Size())
+}
+
+// s3_write_file writes body to path through a temporary file, so that a failed
+// upload never leaves a partial file behind. it returns the md5 of the contents.
+// with shares, a file being replaced is kept as a version
+func s3_write_file(shares *HdaShares, path string, body io.Reader) ([]byte, int64, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".s3-upload-")
+	if err != nil {
+		return nil, 0, err
+	}
+	sum := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sum), body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		if shares != nil {
+			keep_version(shares, path)
+		}
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	return sum.Sum(nil), size, nil
+}
+
+func (this *s3Gateway) write_error(writer http.ResponseWriter, request *http.Request, err error) {
+	if err == errS3BadDigest {
+		s3_error(writer, request, http.StatusBadRequest, "BadDigest", "The content does not match its signature")
+	} else {
+		debug(2, "S3 write error: %s", err.Error())
+		s3_error(writer, request, http.StatusInternalServerError, "InternalError", "Error writing the object")
+	}
+}
+
+func (this *s3Gateway) put_object(writer http.ResponseWriter, request *http.Request, sig *s3Signature, share *HdaShare, key string) {
+	if no_upload {
+		debug(2, "NOTICE: Running in no-upload mode.")
+		s3_error(writer, request, http.StatusForbidden, "AccessDenied", "Uploads are disabled")
+		return
+	}
+	full_path, err := this.service.fullPathToFile(share.name, "/"+key)
+	if is_path_limit(err) {
+		s3_error(writer, request, http.StatusBadRequest, "KeyTooLongError", "Your key is too long: "+err.Error())
+		return
+	} else if err != nil {
+		s3_error(writer, request, http.StatusBadRequest, "InvalidArgument", "Invalid key")
+		return
+	}
+
+	// "directory" markers
+	if strings.HasSuffix(key, "/") {
+		err = os.MkdirAll(full_path, 0755)
+		if err != nil {
+			this.write_error(writer, request, err)
+			return
+		}
+		writer.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+		writer.WriteHeader(http.StatusOK)
+		return
+	}
+
+	sum, size, err := s3_write_file(this.service.Shares, full_path, s3_body(request, sig, config.S3.SecretKey))
+	if err != nil {
+		this.write_error(writer, request, err)
+		return
+	}
+	if content_md5 := request.Header.Get("Content-Md5"); content_md5 != "" && content_md5 != base64.StdEncoding.EncodeToString(sum) {
+		os.Remove(full_path)
+		s3_error(writer, request, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what was received")
+		return
+	}
+	debug(3, "S3 stored %s (%d bytes)", full_path, size)
+	writer.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (this *s3Gateway) delete_object(writer http.ResponseWriter, request *http.Request, share *HdaShare, key string) {
+	err := this.remove(share, key)
+	if err != nil && !os.IsNotExist(err) {
+		debug(2, "S3 error removing %s: %s", key, err.Error())
+		s3_error(writer, request, http.StatusInternalServerError, "InternalError", "Error removing the object")
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (this *s3Gateway) remove(share *HdaShare, key string) error {
+	full_path, err := this.service.fullPathToFile(share.name, "/"+key)
+	if err != nil || strings.Trim(key, "/") == "" {
+		return os.ErrNotExist
+	}
+	if no_delete {
+		debug(2, "NOTICE: Running in no-delete mode. Would have deleted: %s", full_path)
+		return nil
+	}
+	if strings.HasSuffix(key, "/") {
+		// "directory" markers, only when empty
+		return os.Remove(full_path)
+	}
+	// deleted objects go to the trash of the share
+	return delete_path_to_trash(this.service.Shares, full_path)
+}
+
+type s3Delete struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type s3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []s3CommonKey   `xml:"Deleted"`
+	Errors  []s3DeleteError `xml:"Error"`
+}
+
+type s3CommonKey struct {
+	Key string `xml:"Key"`
+}
+
+func (this *s3Gateway) delete_objects(writer http.ResponseWriter, request *http.Request, sig *s3Signature, share *HdaShare) {
+	data, err := ioutil.ReadAll(io.LimitReader(s3_body(request, sig, config.S3.SecretKey), 4<<20))
+	if err != nil {
+		this.write_error(writer, request, err)
+		return
+	}
+	var req s3Delete
+	if err := xml.Unmarshal(data, &req); err != nil {
+		s3_error(writer, request, http.StatusBadRequest, "MalformedXML", "Malformed XML")
+		return
+	}
+	result := &s3DeleteResult{Xmlns: S3_XMLNS}
+	for _, object := range req.Objects {
+		if !s3_valid_key(object.Key) {
+			result.Errors = append(result.Errors, s3DeleteError{Key: object.Key, Code: "InvalidArgument", Message: "Invalid key"})
+			continue
+		}
+		err := this.remove(share, object.Key)
+		if err != nil && !os.IsNotExist(err) {
+			result.Errors = append(result.Errors, s3DeleteError{Key: object.Key, Code: "InternalError", Message: err.Error()})
+		} else if !req.Quiet {
+			result.Deleted = append(result.Deleted, s3CommonKey{Key: object.Key})
+		}
+	}
+	s3_xml(writer, http.StatusOK, result)
+}
+
+// multipart uploads are kept in S3_UPLOADS_DIR/<upload id>/ until completed
+
+type s3Upload struct {
+	Bucket  string    `json:"bucket"`
+	Key     string    `json:"key"`
+	Started time.Time `json:"started"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type s3ListMultipartUploadsResult struct {
+	XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+	Bucket  string   `xml:"Bucket"`
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+func s3_upload_dir(upload_id string) string {
+	return filepath.Join(S3_UPLOADS_DIR, upload_id)
+}
+
+// s3_upload returns the upload, checking that it is for this bucket and key
+func s3_upload(upload_id, bucket, key string) (*s3Upload, bool) {
+	if upload_id == "" || strings.ContainsAny(upload_id, "./") {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s3_upload_dir(upload_id), "upload.json"))
+	if err != nil {
+		return nil, false
+	}
+	upload := new(s3Upload)
+	if json.Unmarshal(data, upload) != nil || upload.Bucket != bucket || upload.Key != key {
+		return nil, false
+	}
+	return upload, true
+}
+
+func (this *s3Gateway) create_multipart(writer http.ResponseWriter, request *http.Request, bucket, key string) {
+	if no_upload {
+		s3_error(writer, request, http.StatusForbidden, "AccessDenied", "Uploads are disabled")
+		return
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	upload_id := hex.EncodeToString(id)
+	data, _ := json.Marshal(&s3Upload{Bucket: bucket, Key: key, Started: time.Now()})
+	err := os.MkdirAll(s3_upload_dir(upload_id), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(s3_upload_dir(upload_id), "upload.json"), data, 0600)
+	}
+	if err != nil {
+		this.write_error(writer, request, err)
+		return
+	}
+	s3_xml(writer, http.StatusOK, &s3InitiateMultipartUploadResult{Xmlns: S3_XMLNS, Bucket: bucket, Key: key, UploadId: upload_id})
+}
+
+func s3_part_file(upload_id string, part int) string {
+	return filepath.Join(s3_upload_dir(upload_id), fmt.Sprintf("part-%05d", part))
+}
+
+func (this *s3Gateway) upload_part(writer http.ResponseWriter, request *http.Request, sig *s3Signature, bucket, key string) {
+	query := request.URL.Query()
+	upload_id := query.Get("uploadId")
+	if _, ok := s3_upload(upload_id, bucket, key); !ok {
+		s3_error(writer, request, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	part, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || part < 1 || part > 10000 {
+		s3_error(writer, request, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+		return
+	}
+	sum, _, err := s3_write_file(nil, s3_part_file(upload_id, part), s3_body(request, sig, config.S3.SecretKey))
+	if err == nil {
+		err = ioutil.WriteFile(s3_part_file(upload_id, part)+".md5", []byte(hex.EncodeToString(sum)), 0600)
+	}
+	if err != nil {
+		this.write_error(writer, request, err)
+		return
+	}
+	writer.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (this *s3Gateway) complete_multipart(writer http.ResponseWriter, request *http.Request, sig *s3Signature, bucket string, share *HdaShare, key string) {
+	upload_id := request.URL.Query().Get("uploadId")
+	if _, ok := s3_upload(upload_id, bucket, key); !ok {
+		s3_error(writer, request, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(s3_body(request, sig, config.S3.SecretKey), 4<<20))
+	if err != nil {
+		this.write_error(writer, request, err)
+		return
+	}
+	var complete s3CompleteMultipartUpload
+	if xml.Unmarshal(data, &complete) != nil || len(complete.Parts) == 0 {
+		s3_error(writer, request, http.StatusBadRequest, "MalformedXML", "Malformed XML")
+		return
+	}
+	full_path, err := this.service.fullPathToFile(share.name, "/"+key)
+	if err != nil {
+		s3_error(writer, request, http.StatusBadRequest, "InvalidArgument", "Invalid key")
+		return
+	}
+
+	// check all the parts before putting them together
+	readers := []io.Reader{}
+	sums := md5.New()
+	for i, part := range complete.Parts {
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+			s3_error(writer, request, http.StatusBadRequest, "InvalidPartOrder", "The parts are not in ascending order")
+			return
+		}
+		sum, err := ioutil.ReadFile(s3_part_file(upload_id, part.PartNumber) + ".md5")
+		if err != nil || strings.Trim(part.ETag, `"`) != string(sum) {
+			s3_error(writer, request, http.StatusBadRequest, "InvalidPart", "One or more of the parts could not be found")
+			return
+		}
+		raw, _ := hex.DecodeString(string(sum))
+		sums.Write(raw)
+		file, err := os.Open(s3_part_file(upload_id, part.PartNumber))
+		if err != nil {
+			s3_error(writer, request, http.StatusBadRequest, "InvalidPart", "One or more of the parts could not be found")
+			return
+		}
+		defer file.Close()
+		readers = append(readers, file)
+	}
+
+	_, _, err = s3_write_file(this.service.Shares, full_path, io.MultiReader(readers...))
+	if err != nil {
+		this.write_error(writer, request, err)
+		return
+	}
+	os.RemoveAll(s3_upload_dir(upload_id))
+
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sums.Sum(nil)), len(complete.Parts))
+	s3_xml(writer, http.StatusOK, &s3CompleteMultipartUploadResult{Xmlns: S3_XMLNS, Bucket: bucket, Key: key, ETag: etag})
+}
+
+func (this *s3Gateway) abort_multipart(writer http.ResponseWriter, request *http.Request, bucket, key string) {
+	upload_id := request.URL.Query().Get("uploadId")
+	if _, ok := s3_upload(upload_id, bucket, key); !ok {
+		s3_error(writer, request, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	os.RemoveAll(s3_upload_dir(upload_id))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// s3_cleanup_uploads removes multipart uploads that were never completed
+func s3_cleanup_uploads(progress func(done, total int64)) (string, error) {
+	dir, err := os.Open(S3_UPLOADS_DIR)
+	if os.IsNotExist(err) {
+		return "no uploads", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	fis, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return "", err
+	}
+	removed := 0
+	for _, fi := range fis {
+		if fi.IsDir() && time.Since(fi.ModTime()) > S3_UPLOAD_EXPIRY {
+			os.RemoveAll(filepath.Join(S3_UPLOADS_DIR, fi.Name()))
+			removed++
+		}
+	}
+	return fmt.Sprintf("%d expired uploads removed", removed), nil
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net/http"
+)
+
+// security headers are added to the responses, from the config, by class
+// of route: the JSON API, the files served, which must not run as pages of
+// the HDA, and the apps behind a vhost, whose own headers win. the
+// headers of the apps that tell about their insides are not passed along
+
+const (
+	HEADERS_API   = "api"
+	HEADERS_FILES = "files"
+	HEADERS_APPS  = "apps"
+)
+
+func default_security_headers() headersConfig {
+	return headersConfig{
+		API: map[string]string{
+			"X-Content-Type-Options":  "nosniff",
+			"Referrer-Policy":         "no-referrer",
+			"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+		},
+		Files: map[string]string{
+			"X-Content-Type-Options":  "nosniff",
+			"Referrer-Policy":         "no-referrer",
+			"Content-Security-Policy": "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; sandbox",
+		},
+		Apps: map[string]string{
+			"X-Content-Type-Options":  "nosniff",
+			"Referrer-Policy":         "same-origin",
+			"Content-Security-Policy": "frame-ancestors 'self'",
+		},
+		Strip: []string{"Server", "X-Powered-By", "X-Runtime", "X-AspNet-Version"},
+	}
+}
+
+// headers_class is the class of an API request
+func headers_class(request *http.Request) string {
+	if is_stream(request) {
+		return HEADERS_FILES
+	}
+	return HEADERS_API
+}
+
+func security_headers(class string) map[string]string {
+	switch class {
+	case HEADERS_FILES:
+		return config.Headers.Files
+	case HEADERS_APPS:
+		return config.Headers.Apps
+	}
+	return config.Headers.API
+}
+
+// add_security_headers sets the headers of class, "" being none
+func add_security_headers(header http.Header, class string) {
+	for name, value := range security_headers(class) {
+		if value != "" {
+			header.Set(name, value)
+		}
+	}
+}
+
+// harden_app_response is for the responses of the apps
+func harden_app_response(response *http.Response) error {
+	for _, name := range config.Headers.Strip {
+		response.Header.Del(name)
+	}
+	for name, value := range security_headers(HEADERS_APPS) {
+		if value != "" && response.Header.Get(name) == "" {
+			response.Header.Set(name, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	saved := config.Headers
+	defer func() { config.Headers = saved }()
+	config.Headers = default_security_headers()
+
+	service := &MercuryFsService{api_router: mux.NewRouter(), debug_info: new(debugInfo)}
+	service.api_router.HandleFunc("/{path:.*}", func(writer http.ResponseWriter, request *http.Request) {})
+	app := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("X-Powered-By", "PHP/5.4")
+		writer.Header().Set("Content-Security-Policy", "default-src 'self'")
+		writer.Write([]byte("<html></html>"))
+	}))
+	defer app.Close()
+	request := func(target, ua string) http.Header {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("User-Agent", ua)
+		service.top_vhost_filter(recorder, r)
+		return recorder.Header()
+	}
+
+	api := request("/shares", "")
+	if api.Get("X-Content-Type-Options") != "nosniff" || api.Get("Referrer-Policy") != "no-referrer" {
+		t.Errorf("Wrong API headers: %v", api)
+	}
+	if files := request("/files?s=Docs&p=/page.html", ""); !strings.HasSuffix(files.Get("Content-Security-Policy"), "sandbox") {
+		t.Errorf("Files are not sandboxed: %v", files)
+	}
+
+	// the apps keep their own policy, but not their insides
+	apps := request("/", "Vhost/"+strings.TrimPrefix(app.URL, "http://"))
+	if apps.Get("X-Powered-By") != "" || apps.Get("Content-Security-Policy") != "default-src 'self'" || apps.Get("Referrer-Policy") != "same-origin" {
+		t.Errorf("Wrong app headers: %v", apps)
+	}
+
+	// a header can be left out
+	config.Headers.API["Referrer-Policy"] = ""
+	if api := request("/shares", ""); api.Get("Referrer-Policy") != "" || api.Get("X-Content-Type-Options") == "" {
+		t.Errorf("Wrong headers once configured: %v", api)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// files are handed to http.ServeContent as the plain *os.File whenever
+// possible: on a plain TCP connection the server then sends them with
+// sendfile(2), without copying them through buffers, which on the LAN is
+// most of the CPU of streaming a big video. only the requests that need
+// the data on its way, like videos read ahead for the relay, get a wrapped
+// reader. TLS and HTTP/2 connections copy anyway
+//
+// BenchmarkServeFile measures both, 64MB over the loopback
+
+type sendfileStats struct {
+	zero_copy, copied             int64
+	zero_copy_bytes, copied_bytes int64
+}
+
+var sendfile_stats = new(sendfileStats)
+
+// file_content is what to serve file with for request, and what to do
+// once served
+func file_content(request *http.Request, file *os.File, full_path string, fi os.FileInfo) (io.ReadSeeker, func()) {
+	if range_start(request) == 0 && strings.HasPrefix(getContentType(fi.Name()), "video/") {
+		transcode_pregen.played(full_path)
+	}
+	if should_prefetch(request, fi) {
+		if reader, err := video_prefetcher.open(full_path, fi.Size(), range_start(request)); err == nil {
+			return reader, func() { reader.Close() }
+		}
+	}
+	return file, func() {}
+}
+
+// can_sendfile says if a response with content can skip the copies
+func can_sendfile(request *http.Request, content io.ReadSeeker) bool {
+	_, plain := content.(*os.File)
+	return plain && request.TLS == nil && request.ProtoMajor == 1 && !from_relay(request)
+}
+
+func (this *sendfileStats) served(request *http.Request, content io.ReadSeeker, size int64) {
+	if can_sendfile(request, content) {
+		atomic.AddInt64(&this.zero_copy, 1)
+		atomic.AddInt64(&this.zero_copy_bytes, size)
+	} else {
+		atomic.AddInt64(&this.copied, 1)
+		atomic.AddInt64(&this.copied_bytes, size)
+	}
+}
+
+func (this *sendfileStats) status() map[string]int64 {
+	return map[string]int64{
+		"zero_copy":       atomic.LoadInt64(&this.zero_copy),
+		"zero_copy_bytes": atomic.LoadInt64(&this.zero_copy_bytes),
+		"copied":          atomic.LoadInt64(&this.copied),
+		"copied_bytes":    atomic.LoadInt64(&this.copied_bytes),
+	}
+}
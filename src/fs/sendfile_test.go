@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSendfile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sendfile")
+	defer os.RemoveAll(dir)
+	full_path := filepath.Join(dir, "movie.mkv")
+	ioutil.WriteFile(full_path, make([]byte, 1<<20), 0644)
+	file, _ := os.Open(full_path)
+	defer file.Close()
+	fi, _ := file.Stat()
+
+	local := httptest.NewRequest("GET", "/files?s=Movies&p=/movie.mkv", nil)
+	content, done := file_content(local, file, full_path, fi)
+	done()
+	if content != file || !can_sendfile(local, content) {
+		t.Errorf("The local server does not send the plain file")
+	}
+	secure := httptest.NewRequest("GET", "/files?s=Movies&p=/movie.mkv", nil)
+	secure.TLS = &tls.ConnectionState{}
+	relayed := mark_relay_request(local)
+	for _, request := range []*http.Request{secure, relayed} {
+		if can_sendfile(request, file) {
+			t.Errorf("sendfile without a plain connection")
+		}
+	}
+	if can_sendfile(local, struct{ io.ReadSeeker }{file}) {
+		t.Errorf("sendfile of a wrapped file")
+	}
+
+	stats := new(sendfileStats)
+	stats.served(local, file, 10)
+	stats.served(relayed, file, 5)
+	if status := stats.status(); status["zero_copy_bytes"] != 10 || status["copied"] != 1 {
+		t.Errorf("Wrong stats: %v", status)
+	}
+}
+
+// the plain file is sent with sendfile, the wrapped one is copied
+func BenchmarkServeFile(b *testing.B) {
+	dir, _ := ioutil.TempDir("", "sendfile")
+	defer os.RemoveAll(dir)
+	full_path := filepath.Join(dir, "movie.mkv")
+	const size = 64 << 20
+	ioutil.WriteFile(full_path, make([]byte, size), 0644)
+
+	for _, wrapped := range []bool{false, true} {
+		name := "plain"
+		if wrapped {
+			name = "wrapped"
+		}
+		b.Run(name, func(b *testing.B) {
+			server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				file, _ := os.Open(full_path)
+				defer file.Close()
+				var content io.ReadSeeker = file
+				if wrapped {
+					content = struct{ io.ReadSeeker }{file}
+				}
+				http.ServeContent(writer, request, "movie.mkv", time.Time{}, content)
+			}))
+			defer server.Close()
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				response, err := http.Get(server.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, response.Body)
+				response.Body.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// a share with a FIFO, a socket and a symlink to the FIFO in it
+func special_files_share(t *testing.T) (*MercuryFsService, string) {
+	dir, _ := ioutil.TempDir("", "special")
+	if err := syscall.Mkfifo(filepath.Join(dir, "pipe"), 0644); err != nil {
+		t.Skipf("cannot make a FIFO: %s", err)
+	}
+	if listener, err := net.Listen("unix", filepath.Join(dir, "socket")); err == nil {
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		listener.Close()
+	}
+	os.Symlink("pipe", filepath.Join(dir, "link"))
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0644)
+	service := &MercuryFsService{
+		Shares:     &HdaShares{Shares: []*HdaShare{{name: "Special", path: dir}}},
+		debug_info: new(debugInfo),
+	}
+	return service, dir
+}
+
+func TestServeSpecialFiles(t *testing.T) {
+	service, dir := special_files_share(t)
+	defer os.RemoveAll(dir)
+
+	for path, kind := range map[string]string{"/pipe": "fifo", "/link": "fifo", "/socket": "socket"} {
+		recorder := httptest.NewRecorder()
+		done := make(chan bool)
+		go func() {
+			service.serve_file(recorder, httptest.NewRequest("GET", "/files?s=Special&p="+path, nil))
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Serving %s hangs", path)
+		}
+		var result map[string]string
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		if recorder.Code != 415 || result["type"] != kind {
+			t.Errorf("Wrong answer for %s: %d %v", path, recorder.Code, result)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	service.serve_file(recorder, httptest.NewRequest("GET", "/files?s=Special&p=/notes.txt", nil))
+	if recorder.Code != 200 || recorder.Body.String() != "hello" {
+		t.Errorf("A regular file was not served: %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestServeDirectoryListing(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "listing")
+	defer os.RemoveAll(dir)
+	for i := 0; i < 50; i++ {
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file \"%02d\"\t.txt", i)), []byte("x"), 0644)
+	}
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Docs", path: dir}}}, debug_info: new(debugInfo)}
+	get := func(inm string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/files?s=Docs&p=/", nil)
+		request.Header.Set("If-None-Match", inm)
+		service.serve_file(recorder, request)
+		return recorder
+	}
+
+	// streamed, but with the length and ETag of the whole listing
+	recorder := get("")
+	var entries []fileEntry
+	if err := json.Unmarshal(recorder.Body.Bytes(), &entries); err != nil || len(entries) != 50 || entries[7].Name != "file \"07\"\t.txt" {
+		t.Fatalf("Wrong listing: %v %s", err, recorder.Body.String())
+	}
+	if recorder.Header().Get("Content-Length") != fmt.Sprint(recorder.Body.Len()) {
+		t.Errorf("Wrong length: %s for %d bytes", recorder.Header().Get("Content-Length"), recorder.Body.Len())
+	}
+	etag := recorder.Header().Get("ETag")
+	if etag != `"`+sha1bytes(recorder.Body.Bytes())+`"` {
+		t.Errorf("Wrong ETag %s", etag)
+	}
+	if recorder = get(etag); recorder.Code != 304 {
+		t.Errorf("%d instead of 304", recorder.Code)
+	}
+}
+
+func TestHdaDebug(t *testing.T) {
+	service := &MercuryFsService{Shares: &HdaShares{}, debug_info: &debugInfo{server: "debug-test"}, info: new(HdaInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/hda_debug", service.hda_debug).Methods("GET")
+	router.HandleFunc("/files", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("a movie"))
+	}).Methods("GET")
+	router.Use(service.recover_errors)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/files?s=Movies&p=/a.mkv", nil))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/hda_debug", nil))
+	var result map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Invalid JSON: %v %s", err, recorder.Body.String())
+	}
+	if _, ok := result["goroutines"]; !ok || result["connected"] != false {
+		t.Errorf("Wrong debug info: %s", recorder.Body.String())
+	}
+	memory, _ := result["memory"].(map[string]interface{})
+	gc, _ := result["gc"].(map[string]interface{})
+	if memory["sys"] == nil || gc["pause_quantiles_ms"] == nil || result["open_fds"].(float64) < 1 {
+		t.Errorf("No runtime internals: %v %v %v", memory, gc, result["open_fds"])
+	}
+	movies, _ := result["share_requests"].(map[string]interface{})["Movies"].(map[string]interface{})
+	if movies["requests"] != 1.0 || movies["bytes"] != 7.0 {
+		t.Errorf("Wrong share counters: %v", result["share_requests"])
+	}
+	// the request for /hda_debug is being served
+	transfers, _ := result["transfers"].([]interface{})
+	if len(transfers) != 1 || transfers[0].(map[string]interface{})["path"] != "/hda_debug" {
+		t.Errorf("Wrong transfers: %v", result["transfers"])
+	}
+}
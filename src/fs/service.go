@@ -13,6 +13,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/amahi/go-metadata"
@@ -23,6 +24,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"path"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -79,9 +81,70 @@ func NewMercuryFSService(root_dir, local_addr string) (service *MercuryFsService
 	api_router.HandleFunc("/files", service.serve_file).Methods("GET")
 	api_router.HandleFunc("/files", service.delete_file).Methods("DELETE")
 	api_router.HandleFunc("/files", service.upload_file).Methods("POST")
+	api_router.HandleFunc("/files/signature", service.file_signature).Methods("GET")
+	api_router.HandleFunc("/files/delta", service.download_delta).Methods("POST")
+	api_router.HandleFunc("/files/delta", service.upload_delta).Methods("PATCH")
+	api_router.HandleFunc("/files/chunks", service.file_chunks).Methods("GET")
+	api_router.HandleFunc("/files/chunks", service.commit_chunks).Methods("POST")
+	api_router.HandleFunc("/files/chunks/data", service.upload_chunk).Methods("PUT")
+	api_router.HandleFunc("/files/preview", service.file_preview).Methods("GET")
+	api_router.HandleFunc("/files/thumbnail", service.serve_thumbnail).Methods("GET")
+	api_router.HandleFunc("/files/thumbnails", service.serve_thumbnails).Methods("POST")
+	api_router.HandleFunc("/files/recall", service.recall_archived).Methods("POST")
+	api_router.HandleFunc("/files/arrangement", service.get_arrangement).Methods("GET")
+	api_router.HandleFunc("/files/arrangement", service.put_arrangement).Methods("PUT")
+	api_router.HandleFunc("/files/stat", service.file_stat).Methods("GET")
+	api_router.HandleFunc("/files/permissions", service.file_permissions).Methods("PUT")
+	api_router.HandleFunc("/collections", service.collections_list).Methods("GET")
+	api_router.HandleFunc("/collections", service.collections_save).Methods("POST")
+	api_router.HandleFunc("/collections/{name}", service.collection_files).Methods("GET")
+	api_router.HandleFunc("/collections/{name}", service.collections_remove).Methods("DELETE")
+	api_router.HandleFunc("/transcode", service.start_transcode).Methods("POST")
+	api_router.HandleFunc("/transcode/{session}/{file}", service.serve_transcode).Methods("GET")
+	api_router.HandleFunc("/transcode/{session}/{rung}/{file}", service.serve_transcode).Methods("GET")
+	api_router.HandleFunc("/transcode/{session}/report", service.report_transcode).Methods("POST")
+	api_router.HandleFunc("/transcode/{session}", service.transcode_session).Methods("GET")
+	api_router.HandleFunc("/transcode/{session}", service.stop_transcode).Methods("DELETE")
+	api_router.HandleFunc("/files/image", service.serve_image_file).Methods("GET")
+	api_router.HandleFunc("/subtitles", service.serve_subtitles).Methods("GET")
+	api_router.HandleFunc("/files/versions", service.file_versions).Methods("GET")
+	api_router.HandleFunc("/files/versions/restore", service.restore_file_version).Methods("POST")
 	api_router.HandleFunc("/apps", service.apps_list).Methods("GET")
 	api_router.HandleFunc("/md", service.get_metadata).Methods("GET")
+	api_router.HandleFunc("/md/artwork", service.serve_artwork).Methods("GET")
+	api_router.HandleFunc("/music/artists", service.music_artists).Methods("GET")
+	api_router.HandleFunc("/music/albums", service.music_albums).Methods("GET")
+	api_router.HandleFunc("/music/tracks", service.music_tracks).Methods("GET")
+	api_router.HandleFunc("/music/art", service.music_art).Methods("GET")
+	api_router.HandleFunc("/photos/timeline", service.photos_timeline).Methods("GET")
+	api_router.HandleFunc("/photos/places", service.photos_places).Methods("GET")
+	api_router.HandleFunc("/feed", service.serve_feed).Methods("GET")
 	api_router.HandleFunc("/hda_debug", service.hda_debug).Methods("GET")
+	api_router.HandleFunc("/capabilities", service.server_capabilities).Methods("GET")
+	api_router.HandleFunc("/shares/refresh", service.refresh_shares).Methods("POST")
+	api_router.HandleFunc("/shares/usage", service.shares_usage).Methods("GET")
+	api_router.HandleFunc("/shares/{name}/rescan", service.rescan_share).Methods("POST")
+	api_router.HandleFunc("/shares/{name}/snapshots", service.list_snapshots).Methods("GET")
+	api_router.HandleFunc("/shares/{name}/snapshots", service.take_snapshot).Methods("POST")
+	api_router.HandleFunc("/jobs", service.jobs_status).Methods("GET")
+	api_router.HandleFunc("/downloads", service.queue_download).Methods("POST")
+	api_router.HandleFunc("/downloads", service.list_downloads).Methods("GET")
+	api_router.HandleFunc("/downloads/{id}", service.fetch_download).Methods("GET")
+	api_router.HandleFunc("/downloads/{id}", service.cancel_download).Methods("DELETE")
+	api_router.HandleFunc("/power", service.power_status).Methods("GET")
+	api_router.HandleFunc("/power/wake", service.power_wake).Methods("POST")
+	api_router.HandleFunc("/events", service.serve_events).Methods("GET")
+	api_router.HandleFunc("/sync/manifest", service.sync_manifest).Methods("GET")
+	api_router.HandleFunc("/trash", service.trash_list).Methods("GET")
+	api_router.HandleFunc("/trash", service.trash_empty).Methods("DELETE")
+	api_router.HandleFunc("/trash/restore", service.trash_restore).Methods("POST")
+	api_router.HandleFunc("/speedtest/download", service.speedtest_download).Methods("GET")
+	api_router.HandleFunc("/speedtest/upload", service.speedtest_upload).Methods("POST")
+	api_router.HandleFunc("/state/{app}", service.app_state_list).Methods("GET")
+	api_router.HandleFunc("/state/{app}/{key}", service.app_state_get).Methods("GET")
+	api_router.HandleFunc("/state/{app}/{key}", service.app_state_put).Methods("PUT")
+	api_router.HandleFunc("/state/{app}/{key}", service.app_state_delete).Methods("DELETE")
+	api_router.Use(service.traced, service.shadow, service.recover_errors, service.compress_json, service.compat_shims, service.guest_access, service.home_access, service.parental_access, service.schedule_access, service.share_mount_access, service.share_write_access, service.stream_access, service.power_access, handler_started)
 
 	service.api_router = api_router
 
@@ -118,40 +181,133 @@ func (service *MercuryFsService) String() string {
 	return service.Shares.to_json()
 }
 
+// hdaDebug is what /hda_debug reports
+type hdaDebug struct {
+	Goroutines        int                         `json:"goroutines"`
+	Connected         bool                        `json:"connected"`
+	LastRequest       string                      `json:"last_request"`
+	Received          int64                       `json:"received"`
+	Served            int64                       `json:"served"`
+	Outstanding       int64                       `json:"outstanding"`
+	BytesServed       int64                       `json:"bytes_served"`
+	ShareOverlaps     []shareOverlap              `json:"share_overlaps"`
+	Settings          map[string]interface{}      `json:"settings"`
+	UnavailableShares []shareProblem              `json:"unavailable_shares"`
+	Relay             map[string]interface{}      `json:"relay,omitempty"`
+	RelayStreams      *relayStreamsStatus         `json:"relay_streams"`
+	Prefetch          map[string]interface{}      `json:"prefetch"`
+	MetadataCache     map[string]int64            `json:"metadata_cache"`
+	MetadataPrefetch  map[string]interface{}      `json:"metadata_prefetch"`
+	MusicLibrary      map[string]int              `json:"music_library"`
+	PhotoLibrary      map[string]int              `json:"photo_library"`
+	LocalTLS          map[string]interface{}      `json:"local_tls,omitempty"`
+	PlatformReport    map[string]interface{}      `json:"platform_report"`
+	Transcode         map[string]interface{}      `json:"transcode"`
+	Tiering           map[string]interface{}      `json:"tiering"`
+	EtagCache         map[string]int64            `json:"etag_cache"`
+	Clock             map[string]interface{}      `json:"clock"`
+	Sendfile          map[string]int64            `json:"sendfile"`
+	Streams           map[string]interface{}      `json:"streams"`
+	Errors            []endpointErrors            `json:"errors"`
+	Compression       map[string]interface{}      `json:"compression"`
+	Speedtests        []speedtestResult           `json:"speedtests"`
+	Direct            map[string]interface{}      `json:"direct"`
+	Memory            map[string]interface{}      `json:"memory"`
+	GC                map[string]interface{}      `json:"gc"`
+	OpenFds           int                         `json:"open_fds"`
+	ShareRequests     map[string]map[string]int64 `json:"share_requests"`
+	Transfers         []transferStatus            `json:"transfers"`
+	AppCache          map[string]interface{}      `json:"app_cache"`
+	Shadow            map[string]interface{}      `json:"shadow"`
+}
+
 func (service *MercuryFsService) hda_debug(writer http.ResponseWriter, request *http.Request) {
 	// I am purposely not calling any of the update methods of debugInfo to actually provide valuable info
-	result := "{\n"
-	result += fmt.Sprintf("\"goroutines\": %d\n", runtime.NumGoroutine())
-	relay_addr := service.info.relay_addr
-	result += `"connected": `
-	if relay_addr != "" {
-		result += "true\n"
-	} else {
-		result += "false\n"
-	}
 	last, received, served, num_bytes := service.debug_info.everything()
-	actualDate := ""
+	result := &hdaDebug{
+		Goroutines:  runtime.NumGoroutine(),
+		Connected:   service.info.relay_addr != "",
+		Received:    received,
+		Served:      served,
+		Outstanding: received - served,
+		BytesServed: num_bytes,
+	}
 	if served != 0 {
-		actualDate = last.Format(http.TimeFormat)
+		result.LastRequest = last.Format(http.TimeFormat)
 	}
-	outstanding := received - served
-	if outstanding < 0 {
-		outstanding = 0
+	if result.Outstanding < 0 {
+		result.Outstanding = 0
 	}
-	result += fmt.Sprintf("\"last_request\": \"%s\"\n", actualDate)
-	result += fmt.Sprintf("\"received\": %d\n", received)
-	result += fmt.Sprintf("\"served\": %d\n", served)
-	result += fmt.Sprintf("\"outstanding\": %d\n", outstanding)
-	result += fmt.Sprintf("\"bytes_served\": %d\n", num_bytes)
+	result.ShareOverlaps = service.Shares.share_overlaps()
+	result.Settings = settings_cache_status()
+	result.UnavailableShares = service.Shares.unavailable()
+	if relay != nil {
+		result.Relay = relay.status()
+	}
+	result.RelayStreams = relay_streams.status()
+	result.Prefetch = video_prefetcher.status()
+	result.Sendfile = sendfile_stats.status()
+	result.Streams = stream_limits.status()
+	result.Errors = error_budget.status()
+	result.Compression = compress_stats.status()
+	result.Speedtests = speedtest_results.status()
+	result.Direct = direct_connection.status()
+	result.MetadataCache = metadata_cache.status()
+	result.MetadataPrefetch = metadata_prefetch.status()
+	result.MusicLibrary = music_library.status()
+	result.PhotoLibrary = photo_library.status()
+	result.LocalTLS = local_tls.info()
+	result.PlatformReport = platform_reporter.status()
+	result.Transcode = transcoders.status()
+	result.Tiering = tiering.status()
+	result.EtagCache = etag_cache.status()
+	result.Clock = clock.status()
+	result.Memory, result.GC = memory_status()
+	result.OpenFds, _ = open_fds()
+	result.ShareRequests = service.debug_info.share_requests()
+	result.Transfers = active_requests.status()
+	result.AppCache = app_cache.status()
+	result.Shadow = shadow_traffic.status()
+
+	json_response(writer, http.StatusOK, result)
+}
 
-	result += "}"
-	writer.WriteHeader(200)
-	writer.Write([]byte(result))
+// json_response writes v as an uncached JSON response and returns its size
+func json_response(writer http.ResponseWriter, status int, v interface{}) int64 {
+	// errors say which request they are for
+	if id := writer.Header().Get(REQUEST_ID_HEADER); status >= 400 && id != "" {
+		switch body := v.(type) {
+		case map[string]string:
+			with_id := map[string]string{"request_id": id}
+			for k, value := range body {
+				with_id[k] = value
+			}
+			v = with_id
+		case map[string]interface{}:
+			with_id := map[string]interface{}{"request_id": id}
+			for k, value := range body {
+				with_id[k] = value
+			}
+			v = with_id
+		}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		debug(2, "Error encoding JSON response: %s", err.Error())
+		writer.WriteHeader(http.StatusInternalServerError)
+		return 0
+	}
+	writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-cache, private")
+	writer.WriteHeader(status)
+	writer.Write(data)
+	return int64(len(data))
 }
 
-func directory(fi os.FileInfo, js string, w http.ResponseWriter, request *http.Request) (status, size int64) {
-	json := []byte(js)
-	etag := `"` + sha1bytes(json) + `"`
+// directory answers with the listing of a directory, streamed
+func directory(fi os.FileInfo, file_infos []fileInfo, w http.ResponseWriter, request *http.Request) (status, size int64) {
+	etag, length := etag_cache.listing_etag(request.URL.RequestURI(), file_infos)
 	w.Header().Set("ETag", etag)
 	inm := request.Header.Get("If-None-Match")
 	if inm == etag {
@@ -161,18 +317,53 @@ func directory(fi os.FileInfo, js string, w http.ResponseWriter, request *http.R
 		status = 304
 	} else {
 		debug(4, "If-None-Match (%s) match NOT found for Etag %s", inm, etag)
-		size = int64(len(json))
-		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
-		w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		w.Header().Set("Last-Modified", last_modified(fi.ModTime()).UTC().Format(http.TimeFormat))
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
 		w.WriteHeader(http.StatusOK)
-		w.Write(json)
+		size, _ = write_listing(w, file_infos)
 		status = 200
 	}
 	return status, size
 }
 
+// the continuation of a directory listing that has more pages
+const CONTINUATION_HEADER = "X-Continuation"
+
+// listing_limit is how many directory entries to return, config.Listing.MaxEntries
+// unless the client asked for fewer with limit
+func listing_limit(request *http.Request) int {
+	limit := config.Listing.MaxEntries
+	if is_legacy_client(request) {
+		// older apps do not know the continuations
+		return 0
+	}
+	if l, err := strconv.Atoi(request.URL.Query().Get("limit")); err == nil && l > 0 && (limit <= 0 || l < limit) {
+		limit = l
+	}
+	return limit
+}
+
+// wants_ndjson returns true if the client asked for the directory listing as a stream
+func wants_ndjson(request *http.Request) bool {
+	return strings.Contains(request.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// directory_ndjson streams the directory listing as newline-delimited JSON.
+// there is no ETag since the full listing is never built in memory
+func directory_ndjson(fi os.FileInfo, osFile *os.File, full_path string, w http.ResponseWriter, continuation string, limit int, hidden listingFilter, pins map[string]int, posix bool) (status, size int64) {
+	w.Header().Set("Last-Modified", last_modified(fi.ModTime()).UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache, private")
+	w.WriteHeader(http.StatusOK)
+	size, err := dirPageToNDJSON(osFile, full_path, w, continuation, limit, hidden, pins, posix)
+	if err != nil {
+		debug(2, "Error streaming directory %s: %s", full_path, err.Error())
+	}
+	return 200, size
+}
+
 // fullPathToFile creates the full path to the requested file and checks to make sure that
 // there aren't any  '..' to prevent unauthorized access
 func (service *MercuryFsService) fullPathToFile(shareName, relativePath string) (string, error) {
@@ -184,24 +375,52 @@ func (service *MercuryFsService) fullPathToFile(shareName, relativePath string)
 		return "", errors.New(fmt.Sprintf("path %s contains ..", relativePath))
 	}
 
+	// the snapshots of the share, read only
+	if full_path, ok, err := snapshot_path(share, relativePath); ok {
+		if err == nil {
+			err = check_path_limits(full_path, relativePath)
+		}
+		return full_path, err
+	}
+
 	path := share.Path() + relativePath
 	debug(3, "Full path: %s", path)
+	if err := check_path_limits(path, relativePath); err != nil {
+		return "", err
+	}
+	if err := check_symlinks(share.Path(), path, symlinks_policy(shareName)); err != nil {
+		return "", err
+	}
 	return path, nil
 }
 
+// share_problem checks, right now, whether the path of a share is usable,
+// so that files in a missing share are not reported as simply not found
+func (service *MercuryFsService) share_problem(name string) string {
+	share := service.Shares.Get(name)
+	if share == nil {
+		return ""
+	}
+	return check_share_path(share.path)
+}
+
 // serve requests with the ServeConn function over HTTP/2, in goroutines, until we get some error
 func (service *MercuryFsService) StartServing(conn net.Conn) error {
 	log("Connection to the proxy established.")
 
 	service.info.relay_addr = conn.RemoteAddr().String()
 
-	serveConnOpts := &http2.ServeConnOpts{BaseConfig: service.server}
-	server2 := new(http2.Server)
+	// the pings to the relay are timed
+	conn = relay_heartbeat.watch(conn)
+
+	// requests over the relay are tracked as streams for the diagnostics
+	serveConnOpts := &http2.ServeConnOpts{BaseConfig: service.server, Handler: relay_streams.wrap(access_logged(service.server.Handler))}
+	server2 := relay_http2_server()
 
 	// start serving over http2 on provided conn and block until connection is lost
 	server2.ServeConn(conn, serveConnOpts)
 
-	log("Lost connection to the proxy.")
+	log_warn("Lost connection to the proxy.")
 	service.info.relay_addr = ""
 
 	return errors.New("connection is no longer readable")
@@ -219,6 +438,13 @@ func (service *MercuryFsService) serve_file(writer http.ResponseWriter, request
 	service.print_request(request)
 
 	full_path, err := service.fullPathToFile(share, path)
+	trace_mark(request, "path")
+	if is_path_limit(err) {
+		size := json_response(writer, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" 400 %d \"%s\"", query, size, ua)
+		return
+	}
 	if err != nil {
 		debug(2, "File not found: %s", err)
 		http.NotFound(writer, request)
@@ -226,9 +452,25 @@ func (service *MercuryFsService) serve_file(writer http.ResponseWriter, request
 		log("\"GET %s\" 404 0 \"%s\"", query, ua)
 		return
 	}
+	// opening a FIFO would block until something writes to it
+	if fi, err := os.Stat(full_path); err == nil {
+		if kind := special_file_type(fi); kind != "" {
+			size := json_response(writer, http.StatusUnsupportedMediaType, map[string]string{"error": "not a regular file", "type": kind})
+			service.debug_info.requestServed(size)
+			log("\"GET %s\" 415 %d \"%s\"", query, size, ua)
+			return
+		}
+	}
 	osFile, err := os.Open(full_path)
+	trace_mark(request, "open")
 	if err != nil {
 		debug(2, "Error opening file: %s", err.Error())
+		if problem := service.share_problem(share); problem != "" {
+			size := json_response(writer, http.StatusServiceUnavailable, map[string]string{"error": "share unavailable", "problem": problem})
+			service.debug_info.requestServed(size)
+			log("\"GET %s\" 503 %d \"%s\"", query, size, ua)
+			return
+		}
 		http.NotFound(writer, request)
 		service.debug_info.requestServed(int64(0))
 		log("\"GET %s\" 404 0 \"%s\"", query, ua)
@@ -238,10 +480,42 @@ func (service *MercuryFsService) serve_file(writer http.ResponseWriter, request
 
 	// This shouldn't return an error since we just opened the file
 	fi, _ := osFile.Stat()
+	profile := parental_profile_of(request)
 
 	// If the file is a directory, return the all the files within the directory...
 	if fi.IsDir() || isSymlinkDir(fi, full_path) {
-		jsonDir, err := dirToJSON(osFile, full_path)
+		hidden := profile.hide(service.Shares.Get(share))
+		if found := service.Shares.Get(share); found != nil {
+			hidden = symlinks_hidden(hidden, found.Path(), full_path, symlinks_policy(share))
+		}
+		continuation, limit := q.Query().Get("continuation"), listing_limit(request)
+		kind := "n"
+		if wants_ndjson(request) {
+			kind = "o"
+		}
+		if _, err := decode_continuation(continuation, kind); err != nil {
+			size := json_response(writer, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			service.debug_info.requestServed(size)
+			log("\"GET %s\" 400 %d \"%s\"", query, size, ua)
+			return
+		}
+		// as the user arranged the folder
+		arranged := arrangements.get(home_user_of(request), share, path)
+		if arranged.Sort != "" {
+			writer.Header().Set(SORT_HEADER, arranged.Sort)
+		}
+		pins := arranged.pins()
+		if wants_ndjson(request) {
+			status, size := directory_ndjson(fi, osFile, full_path, writer, continuation, limit, hidden, pins, wants_posix(request))
+			service.debug_info.requestServed(size)
+			log("\"GET %s\" %d %d \"%s\"", query, status, size, ua)
+			return
+		}
+		file_infos, next, err := dirPage(osFile, full_path, continuation, limit, hidden)
+		trace_mark(request, "list")
+		if next != "" {
+			writer.Header().Set(CONTINUATION_HEADER, next)
+		}
 		if err != nil {
 			debug(2, "Error converting dir to JSON: %s", err.Error())
 			log("\"GET %s\" 404 0 \"%s\"", query, ua)
@@ -249,16 +523,44 @@ func (service *MercuryFsService) serve_file(writer http.ResponseWriter, request
 			service.debug_info.requestServed(int64(0))
 			return
 		}
-		debug(5, "%s", jsonDir)
-		status, size := directory(fi, jsonDir, writer, request)
+		debug(5, "%d entries", len(file_infos))
+		posix := wants_posix(request)
+		for i := range file_infos {
+			file_infos[i].pinned = pins[file_infos[i].name]
+			if !posix {
+				continue
+			}
+			entry_path := full_path + "/" + file_infos[i].name
+			if fi, err := os.Lstat(entry_path); err == nil {
+				file_infos[i].posix = posix_entry(entry_path, fi)
+			}
+		}
+		status, size := directory(fi, file_infos, writer, request)
 		service.debug_info.requestServed(size)
 		log("\"GET %s\" %d %d \"%s\"", query, status, size, ua)
 		return
 	}
 
+	if service.parental_block(writer, request, profile, share, full_path) {
+		return
+	}
+
+	// convert the file if the client said it cannot handle it
+	writer.Header().Add("Vary", CAPABILITIES_HEADER)
+	if convert := converter_for(request, full_path); convert != nil {
+		size, err := convert(writer, request, full_path)
+		if err == nil {
+			log("\"GET %s\" %d %d \"%s\"", query, 200, size, ua)
+			service.debug_info.requestServed(size)
+			return
+		}
+		debug(2, "Error converting %s, serving the original: %s", full_path, err.Error())
+	}
+
 	// we use for etag the sha1sum of the full path followed the mtime
-	mtime := fi.ModTime().UTC().Format(http.TimeFormat)
-	etag := `"`+sha1string(path+mtime)+`"`
+	modified := last_modified(fi.ModTime())
+	mtime := modified.UTC().Format(http.TimeFormat)
+	etag := file_etag(path, fi)
 	inm := request.Header.Get("If-None-Match")
 	if inm == etag {
 		debug(4, "If-None-Match match found for %s", etag)
@@ -269,7 +571,11 @@ func (service *MercuryFsService) serve_file(writer http.ResponseWriter, request
 		writer.Header().Set("ETag", etag)
 		writer.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
 		debug(4, "Etag sent: %s", etag)
-		http.ServeContent(writer, request, full_path, fi.ModTime(), osFile)
+		// the plain file when possible, for sendfile
+		content, done := file_content(request, osFile, full_path, fi)
+		defer done()
+		http.ServeContent(writer, request, full_path, modified, content)
+		sendfile_stats.served(request, content, fi.Size())
 		log("\"GET %s\" %d %d \"%s\"", query, 200, fi.Size(), ua)
 		service.debug_info.requestServed(fi.Size())
 	}
@@ -278,11 +584,20 @@ func (service *MercuryFsService) serve_file(writer http.ResponseWriter, request
 }
 
 func (service *MercuryFsService) serve_shares(writer http.ResponseWriter, request *http.Request) {
-	service.Shares.update_shares()
+	service.Shares.refresh()
 	debug(5, "========= DEBUG Share request: %d", len(service.Shares.Shares))
-	json := service.Shares.to_json()
+	var keep func(name string) bool
+	key := "/shares"
+	if pass := guest_pass_of(request); pass != nil {
+		// guests only see the shares of their pass
+		keep, key = func(name string) bool { return pass.allows(name) && !is_homes_share(name) }, "/shares?guest="+pass.ID
+	} else if home_user_of(request) == "" && config.Homes.Share != "" {
+		// the home share is only for users
+		keep, key = func(name string) bool { return !is_homes_share(name) }, "/shares?without="+config.Homes.Share
+	}
+	// only made again when the shares changed
+	json, etag := service.Shares.listing(key, keep)
 	debug(5, "Share JSON: %s", json)
-	etag := `"` + sha1bytes([]byte(json)) + `"`
 	inm := request.Header.Get("If-None-Match")
 	if inm == etag {
 		debug(4, "If-None-Match match found for %s", etag)
@@ -302,15 +617,119 @@ func (service *MercuryFsService) serve_shares(writer http.ResponseWriter, reques
 	}
 }
 
+// POST /shares/refresh reads the shares again, after a change the server
+// cannot see, like a share added in the database
+func (service *MercuryFsService) refresh_shares(writer http.ResponseWriter, request *http.Request) {
+	service.Shares.invalidate()
+	status := http.StatusNoContent
+	if err := service.Shares.refresh(); err != nil {
+		debug(2, "Error refreshing the shares: %s", err.Error())
+		status = http.StatusServiceUnavailable
+	}
+	writer.WriteHeader(status)
+	service.debug_info.requestServed(int64(0))
+	log("\"POST %s\" %d 0 \"%s\"", pathForLog(request.URL), status, request.Header.Get("User-Agent"))
+}
+
+// force a re-index and metadata refresh of one share
+func (service *MercuryFsService) rescan_share(writer http.ResponseWriter, request *http.Request) {
+	name := mux.Vars(request)["name"]
+	service.Shares.update_shares()
+	share := service.Shares.Get(name)
+	if share == nil {
+		debug(2, "rescan: share %s not found", name)
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		return
+	}
+	job_name := scan_job_name(share.name)
+	if _, ok := scheduler.get(job_name); !ok {
+		// the scheduler has not seen this share yet
+		scheduler.add(job_name, scan_interval(share), 0, scan_share_job(service.Shares, share, service.metadata))
+	}
+	j, err := scheduler.trigger(job_name)
+	if err != nil {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		service.debug_info.requestServed(int64(0))
+		return
+	}
+	size := json_response(writer, http.StatusAccepted, j)
+	service.debug_info.requestServed(size)
+}
+
+type syncManifest struct {
+	Share   string       `json:"share"`
+	Cursor  string       `json:"cursor"`
+	Full    bool         `json:"full"`
+	Entries []indexEntry `json:"entries"`
+}
+
+// sync_manifest lists what changed in a share since the cursor returned by
+// the previous call, so sync clients do not have to compare whole trees.
+// without a cursor, or with one that is too old, everything is listed
+func (service *MercuryFsService) sync_manifest(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL.Query()
+	name := q.Get("s")
+	share := service.Shares.Get(name)
+	if share == nil {
+		debug(2, "sync manifest: share %s not found", name)
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		return
+	}
+	entries, cursor, full, err := share_index.changes(share.name, q.Get("since"))
+	if err != nil {
+		writer.Header().Set("Retry-After", "60")
+		size := json_response(writer, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		service.debug_info.requestServed(size)
+		return
+	}
+	size := json_response(writer, http.StatusOK, &syncManifest{Share: share.name, Cursor: cursor, Full: full, Entries: entries})
+	service.debug_info.requestServed(size)
+}
+
+// status of the background jobs
+func (service *MercuryFsService) jobs_status(writer http.ResponseWriter, request *http.Request) {
+	size := json_response(writer, http.StatusOK, append(scheduler.status(), download_queue.jobs()...))
+	service.debug_info.requestServed(size)
+}
+
 func GetLocalAddr(root_dir string) (string, error) {
 
+	if config.LocalAddr != "" {
+		return config.LocalAddr, nil
+	}
 	if root_dir != "" {
 		return "127.0.0.1", nil
 	}
+	if standalone() {
+		return outbound_addr()
+	}
+
+	addr, err := read_sql_local_addr()
+	db_status(err)
+	if err == nil {
+		update_settings_cache(func(cache *settingsCache) {
+			cache.LocalAddr = addr
+		})
+		return addr, nil
+	}
 
+	// without the DB, use the last known address or the one of the network interface
+	if addr := load_settings_cache().LocalAddr; addr != "" {
+		return addr, nil
+	}
+	addr, oerr := outbound_addr()
+	if oerr != nil {
+		return "", err
+	}
+	log("Using %s as the local address", addr)
+	return addr, nil
+}
+
+func read_sql_local_addr() (string, error) {
 	dbconn, err := sql.Open("mysql", MYSQL_CREDENTIALS)
 	if err != nil {
-		log(err.Error())
 		return "", err
 	}
 	defer dbconn.Close()
@@ -320,7 +739,6 @@ func GetLocalAddr(root_dir string) (string, error) {
 	row := dbconn.QueryRow(q)
 	err = row.Scan(&prefix)
 	if err != nil {
-		log(err.Error())
 		return "", err
 	}
 
@@ -328,7 +746,7 @@ func GetLocalAddr(root_dir string) (string, error) {
 	row = dbconn.QueryRow(q)
 	err = row.Scan(&addr)
 	if err != nil {
-		log("Error scanning self-address: %s\n", err.Error())
+		debug(2, "Error scanning self-address: %s\n", err.Error())
 		return "", err
 	}
 
@@ -350,6 +768,47 @@ func pathForLog(u *url.URL) string {
 	return buf.String()
 }
 
+// the query parameters carrying the tokens of guests, users and profiles
+var token_params = []string{"guest", "user", "profile"}
+
+// without_tokens is u without the tokens in its query, for what is logged
+// before the access handlers take them out
+func without_tokens(u *url.URL) *url.URL {
+	q := u.Query()
+	found := false
+	for _, param := range token_params {
+		if _, ok := q[param]; ok {
+			q.Del(param)
+			found = true
+		}
+	}
+	if !found {
+		return u
+	}
+	stripped := *u
+	stripped.RawQuery = q.Encode()
+	return &stripped
+}
+
+// special_file_type is the kind of a file that cannot be served, like a
+// FIFO or a device, or "" for regular files and directories
+func special_file_type(fi os.FileInfo) string {
+	mode := fi.Mode()
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "block device"
+	case mode&os.ModeIrregular != 0:
+		return "irregular file"
+	}
+	return ""
+}
+
 func isSymlinkDir(m os.FileInfo, fullpath string) bool {
 	// debug(1, "isSymlinkDir(%s)", m.Name())
 	// not a symlink, so return
@@ -395,10 +854,14 @@ func (service *MercuryFsService) apps_list(writer http.ResponseWriter, request *
 	}
 	service.Apps = apps
 	service.Apps.list()
+	if config.Apps.CheckInterval != "" {
+		// the apps new since the last check
+		apps_health.check(apps.Apps, false)
+	}
 	debug(5, "========= DEBUG apps_list request: %d", len(service.Shares.Shares))
-	json := service.Apps.to_json()
+	json := service.Apps.to_json(api_client(request))
 	debug(5, "App JSON: %s", json)
-	etag := `"` + sha1bytes([]byte(json)) + `"`
+	etag := etag_cache.string_etag("/apps", json)
 	inm := request.Header.Get("If-None-Match")
 	if inm == etag {
 		debug(4, "If-None-Match match found for %s", etag)
@@ -432,18 +895,31 @@ func (service *MercuryFsService) get_metadata(writer http.ResponseWriter, reques
 		http.NotFound(writer, request)
 		return
 	}
+	// with the share and path of the file, its embedded tags are added
+	var tags *mediaTags
+	if share, p := q.Query().Get("s"), q.Query().Get("p"); share != "" && p != "" {
+		if full_path, err := service.fullPathToFile(share, p); err == nil {
+			tags, _ = read_media_tags(full_path)
+		}
+		if filename == "" {
+			filename = path.Base(p)
+		}
+	}
 	debug(5, "metadata filename: %s", filename)
 	debug(5, "metadata hint: %s", hint)
-	// FIXME
-	json, err := service.metadata.GetMetadata(filename, hint)
+	json, err := metadata_cache.lookup(service.metadata, filename, hint)
+	if tags != nil {
+		json, err = merge_media_tags(json, err, tags)
+	}
 	if err != nil {
 		debug(3, "metadata error: %s", err)
 		http.NotFound(writer, request)
 		return
 	}
+	json = metadata_prefetch.local_artwork(json)
 	debug(5, "========= DEBUG get_metadata request: %d", len(service.Shares.Shares))
 	debug(5, "metadata JSON: %s", json)
-	etag := `"` + sha1bytes([]byte(json)) + `"`
+	etag := etag_cache.string_etag(request.URL.RequestURI(), json)
 	inm := request.Header.Get("If-None-Match")
 	if inm == etag {
 		debug(4, "If-None-Match match found for %s", etag)
@@ -476,6 +952,7 @@ func (service *MercuryFsService) print_request(request *http.Request) {
 func (service *MercuryFsService) top_vhost_filter(writer http.ResponseWriter, request *http.Request) {
 
 	header := writer.Header()
+	with_request_id(writer, request)
 
 	ua := request.Header.Get("User-Agent")
 	// since data will change with the session, we should indicate that to keep caching!
@@ -483,6 +960,7 @@ func (service *MercuryFsService) top_vhost_filter(writer http.ResponseWriter, re
 	if ua == "" {
 		service.print_request(request)
 		// if no UA, it's an API call
+		add_security_headers(header, headers_class(request))
 		service.api_router.ServeHTTP(writer, request)
 		return
 	}
@@ -494,6 +972,7 @@ func (service *MercuryFsService) top_vhost_filter(writer http.ResponseWriter, re
 	if len(matches) != 2 {
 		service.print_request(request)
 		// if no vhost, default to API?
+		add_security_headers(header, headers_class(request))
 		service.api_router.ServeHTTP(writer, request)
 		return
 	}
@@ -507,19 +986,13 @@ func (service *MercuryFsService) top_vhost_filter(writer http.ResponseWriter, re
 	request.URL.Host = "hda"
 	request.Host = vhost
 
-	// FIXME - support https and other ports later
-	remote, err := url.Parse("http://" + vhost)
-	if err != nil {
-		debug(5, "REQUEST ERROR: %s", err)
-		http.NotFound(writer, request)
+	// since data will change with the UA, we should indicate that to keep caching!
+	header.Add("Vary", "User-Agent")
+	if service.app_access_denied(writer, request, vhost) {
 		return
 	}
-
 	// proxy the app request
-	proxy := httputil.NewSingleHostReverseProxy(remote)
-	// since data will change with the UA, we should indicate that to keep caching!
-	header.Add("Vary", "User-Agent")
-	proxy.ServeHTTP(writer, request)
+	service.serve_app(writer, request, vhost)
 }
 
 // delete a file!
@@ -538,6 +1011,12 @@ func (service *MercuryFsService) delete_file(writer http.ResponseWriter, request
 
 	// if using the welcome server, just return OK without deleting anything
 	if (!no_delete) {
+		if is_path_limit(err) {
+			size := json_response(writer, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			service.debug_info.requestServed(size)
+			log("\"DELETE %s\" 400 %d \"%s\"", query, size, ua)
+			return
+		}
 		if err != nil {
 			debug(2, "File not found: %s", err)
 			http.NotFound(writer, request)
@@ -545,7 +1024,8 @@ func (service *MercuryFsService) delete_file(writer http.ResponseWriter, request
 			log("\"DELETE %s\" 404 0 \"%s\"", query, ua)
 			return
 		}
-		err = os.Remove(full_path)
+		// deleted files go to the trash of the share
+		err = delete_to_trash(service.Shares.Get(share), path)
 		if err != nil {
 			debug(2, "Error removing file: %s", err.Error())
 			writer.WriteHeader(http.StatusExpectationFailed)
@@ -588,9 +1068,26 @@ func (service *MercuryFsService) upload_file(writer http.ResponseWriter, request
 		// 	return
 		// }
 
+		if upload_too_big(request.ContentLength) {
+			size := json_response(writer, http.StatusRequestEntityTooLarge, map[string]string{"error": "the upload is too big"})
+			service.debug_info.requestServed(size)
+			log("\"POST %s\" 413 %d \"%s\"", query, size, ua)
+			return
+		}
+		if max := max_upload(); max > 0 {
+			request.Body = http.MaxBytesReader(writer, request.Body, max)
+		}
+
 		// max size is 20MB of memory
 		err := request.ParseMultipartForm(32 << 20)
 
+		if too_big := new(http.MaxBytesError); errors.As(err, &too_big) {
+			upload_rejected()
+			size := json_response(writer, http.StatusRequestEntityTooLarge, map[string]string{"error": "the upload is too big"})
+			service.debug_info.requestServed(size)
+			log("\"POST %s\" 413 %d \"%s\"", query, size, ua)
+			return
+		}
 		if err != nil {
 			debug(2, "Error parsing imag: %s", err.Error())
 			writer.WriteHeader(http.StatusPreconditionFailed)
@@ -611,9 +1108,17 @@ func (service *MercuryFsService) upload_file(writer http.ResponseWriter, request
 		defer file.Close()
 
 		// FIXME -- check the filename so it does not start with dots, or slashes!
-		full_path, _ := service.fullPathToFile(share, path+"/"+handler.Filename)
+		full_path, err := service.fullPathToFile(share, path+"/"+handler.Filename)
+		if is_path_limit(err) {
+			size := json_response(writer, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			service.debug_info.requestServed(size)
+			log("\"POST %s\" 400 %d \"%s\"", query, size, ua)
+			return
+		}
 
-		f, err := os.OpenFile(full_path, os.O_WRONLY|os.O_CREATE, 0644)
+		// an upload over an existing file keeps the previous contents as a version
+		keep_version(service.Shares, full_path)
+		f, err := os.OpenFile(full_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
 			debug(2, "Error creating uploaded file: %s", err.Error())
 			writer.WriteHeader(http.StatusServiceUnavailable)
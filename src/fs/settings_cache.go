@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// what was last read from the settings DB is kept in a cache file, so that
+// the service starts without waiting for the DB and keeps serving the known
+// shares and apps while MySQL is down. the DB is retried every time the
+// shares or apps are refreshed
+
+const SETTINGS_CACHE_FILE = DATA_DIR + "/settings_cache.json"
+
+// the cache is reported as stale in /hda_debug when it's in use and older than this
+const SETTINGS_CACHE_STALE = 24 * time.Hour
+
+type cachedShare struct {
+	Name      string    `json:"name"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Path      string    `json:"path"`
+	Tags      string    `json:"tags"`
+}
+
+type settingsCache struct {
+	Updated   time.Time     `json:"updated"`
+	ApiKey    string        `json:"api_key,omitempty"`
+	LocalAddr string        `json:"local_addr,omitempty"`
+	Shares    []cachedShare `json:"shares"`
+	Apps      []*HdaApp     `json:"apps"`
+}
+
+var settings_cache_lock sync.Mutex
+
+// db_down is set while the settings DB cannot be reached, and the
+// in_use flags while the shares or apps come from the cache
+var db_down, shares_from_cache, apps_from_cache bool
+
+func load_settings_cache() *settingsCache {
+	cache := new(settingsCache)
+	data, err := ioutil.ReadFile(SETTINGS_CACHE_FILE)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, cache); err != nil {
+		debug(2, "Error reading %s: %s", SETTINGS_CACHE_FILE, err.Error())
+	}
+	return cache
+}
+
+// update_settings_cache changes the cache file with update. the file is
+// replaced atomically, and only written when something changed
+func update_settings_cache(update func(cache *settingsCache)) {
+	settings_cache_lock.Lock()
+	defer settings_cache_lock.Unlock()
+	cache := load_settings_cache()
+	before, _ := json.Marshal(cache)
+	update(cache)
+	after, _ := json.Marshal(cache)
+	if string(before) == string(after) {
+		return
+	}
+	cache.Updated = time.Now()
+	data, _ := json.Marshal(cache)
+	if err := write_file_atomic(SETTINGS_CACHE_FILE, data, 0600); err != nil {
+		debug(2, "Error writing %s: %s", SETTINGS_CACHE_FILE, err.Error())
+	}
+}
+
+// db_status records whether the last DB access worked, logging the changes
+func db_status(err error) {
+	settings_cache_lock.Lock()
+	defer settings_cache_lock.Unlock()
+	if err != nil && !db_down {
+		log_warn("Settings DB is unreachable, using the last known settings: %s", err.Error())
+	} else if err == nil && db_down {
+		log("Settings DB is reachable again")
+	}
+	db_down = err != nil
+}
+
+func set_from_cache(flag *bool, value bool) {
+	settings_cache_lock.Lock()
+	*flag = value
+	settings_cache_lock.Unlock()
+}
+
+// settings_cache_status is what /hda_debug shows about the DB and the cache
+func settings_cache_status() map[string]interface{} {
+	cache := load_settings_cache()
+	settings_cache_lock.Lock()
+	defer settings_cache_lock.Unlock()
+	in_use := shares_from_cache || apps_from_cache
+	status := map[string]interface{}{
+		"db":     "ok",
+		"in_use": in_use,
+		"shares": shares_from_cache,
+		"apps":   apps_from_cache,
+		"stale":  in_use && time.Since(cache.Updated) > SETTINGS_CACHE_STALE,
+	}
+	if db_down {
+		status["db"] = "unreachable"
+	}
+	if !cache.Updated.IsZero() {
+		status["updated"] = cache.Updated.Format(time.RFC3339)
+		status["age"] = time.Since(cache.Updated).Truncate(time.Second).String()
+	}
+	return status
+}
+
+func cache_shares(shares []*HdaShare) []cachedShare {
+	result := make([]cachedShare, 0, len(shares))
+	for _, share := range shares {
+		result = append(result, cachedShare{Name: share.name, UpdatedAt: share.updated_at, Path: share.path, Tags: share.tags})
+	}
+	return result
+}
+
+func (this *settingsCache) hda_shares() []*HdaShare {
+	result := make([]*HdaShare, 0, len(this.Shares))
+	for _, s := range this.Shares {
+		result = append(result, &HdaShare{name: s.Name, updated_at: s.UpdatedAt, path: s.Path, tags: s.Tags})
+	}
+	return result
+}
+
+// outbound_addr is the address of the interface used to reach other
+// hosts, the last resort to find the local address without the DB.
+// no packets are sent
+func outbound_addr() (string, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:53")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
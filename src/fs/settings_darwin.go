@@ -17,8 +17,18 @@ const MYSQL_CREDENTIALS = "amahihda:AmahiHDARulez@unix(/tmp/mysql.sock)/hda_deve
 const SQL_SELECT_SHARES = "SELECT name, updated_at, path FROM shares WHERE visible = 1 ORDER BY name ASC"
 const SQL_SELECT_APPS = "SELECT webapps.name, apps.name, apps.logo_url FROM webapps LEFT OUTER JOIN apps on apps.webapp_id = webapps.id ORDER BY apps.name ASC"
 
+// the column with the names of the shares, and whether they have tags,
+// for changing them with /admin/shares
+const SQL_SHARES_NAME = "name"
+const SQL_SHARES_TAGS = false
+
 const METADATA_FILE = "/tmp/aamd.db"
 
 const PLATFORM = "macos"
 
 const PID_FILE = "/var/run/amahi-anywhere.pid"
+
+const CONFIG_FILE = "/usr/local/etc/amahi-anywhere.conf"
+
+// directory where the fs keeps its own state (keys, caches, etc.)
+const DATA_DIR = "/tmp/amahi-anywhere"
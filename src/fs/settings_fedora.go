@@ -17,8 +17,18 @@ const MYSQL_CREDENTIALS = "amahihda:AmahiHDARulez@unix(/var/lib/mysql/mysql.sock
 const SQL_SELECT_SHARES = "SELECT name, updated_at, path, tags FROM shares WHERE visible = 1 ORDER BY name ASC"
 const SQL_SELECT_APPS = "SELECT webapps.name, apps.name, apps.logo_url FROM webapps LEFT OUTER JOIN apps on apps.webapp_id = webapps.id ORDER BY apps.name ASC"
 
+// the column with the names of the shares, and whether they have tags,
+// for changing them with /admin/shares
+const SQL_SHARES_NAME = "name"
+const SQL_SHARES_TAGS = true
+
 const METADATA_FILE = "/var/hda/tmp/aamd.db"
 
 const PLATFORM = "fedora"
 
 const PID_FILE = "/run/amahi-anywhere.pid"
+
+const CONFIG_FILE = "/etc/amahi-anywhere.conf"
+
+// directory where the fs keeps its own state (keys, caches, etc.)
+const DATA_DIR = "/var/hda/amahi-anywhere"
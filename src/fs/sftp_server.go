@@ -0,0 +1,413 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// start_sftp_server serves the shares over SFTP (sftp, scp in sftp mode, sshfs, etc.).
+// users authenticate with a public key listed in the authorized keys file.
+// shell and exec requests are not supported, only the sftp subsystem
+
+// the extension of the ssh permissions with the user of a key
+const SFTP_USER_EXTENSION = "amahi-user"
+
+func start_sftp_server(service *MercuryFsService) {
+	ssh_config, err := sftp_ssh_config()
+	if err != nil {
+		log_error("SFTP server could not be configured")
+		debug(2, "Error configuring SFTP server: %s", err.Error())
+		return
+	}
+
+	listener, err := net.Listen("tcp", ":"+config.Sftp.Port)
+	if err != nil {
+		log_error("SFTP server could not be started")
+		debug(2, "Error on SFTP Listen: %s", err.Error())
+		return
+	}
+	defer listener.Close()
+
+	log("Starting SFTP server on port %s", config.Sftp.Port)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			debug(2, "SFTP accept error: %s", err.Error())
+			continue
+		}
+		go service.serve_sftp_conn(conn, ssh_config)
+	}
+}
+
+func sftp_ssh_config() (*ssh.ServerConfig, error) {
+	signer, err := sftp_host_key(config.Sftp.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	ssh_config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			// read the keys every time, so that they can be changed without a restart
+			authorized, err := sftp_authorized_keys(config.Sftp.AuthorizedKeys)
+			if err != nil {
+				return nil, err
+			}
+			user, ok := authorized[string(key.Marshal())]
+			if !ok {
+				return nil, fmt.Errorf("unknown public key for %s", meta.User())
+			}
+			if user == "" {
+				return nil, nil
+			}
+			return &ssh.Permissions{Extensions: map[string]string{SFTP_USER_EXTENSION: user}}, nil
+		},
+	}
+	ssh_config.AddHostKey(signer)
+	return ssh_config, nil
+}
+
+// sftp_host_key loads the host key, generating one the first time around
+func sftp_host_key(key_file string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(key_file)
+	if os.IsNotExist(err) {
+		_, private_key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(private_key, "amahi-anywhere")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		os.MkdirAll(filepath.Dir(key_file), 0700)
+		err = ioutil.WriteFile(key_file, data, 0600)
+		if err != nil {
+			return nil, err
+		}
+		log("Generated a new SFTP host key in %s", key_file)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// sftp_authorized_keys returns the user of each key of keys_file, given
+// with a user="<name>" option before the key, or "" for the keys of no
+// user in particular
+func sftp_authorized_keys(keys_file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(keys_file)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]string)
+	for len(data) > 0 {
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		data = rest
+		user := ""
+		for _, option := range options {
+			if strings.HasPrefix(option, "user=") {
+				user = strings.Trim(strings.TrimPrefix(option, "user="), "\"")
+			}
+		}
+		if user != "" && !valid_home_name(user) {
+			log_warn("SFTP key %s skipped, %q is not a valid user name", comment, user)
+			continue
+		}
+		keys[string(key.Marshal())] = user
+	}
+	return keys, nil
+}
+
+func (service *MercuryFsService) serve_sftp_conn(conn net.Conn, ssh_config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	server_conn, channels, requests, err := ssh.NewServerConn(conn, ssh_config)
+	if err != nil {
+		debug(2, "SFTP handshake failed from %s: %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+	defer server_conn.Close()
+	user := ""
+	if server_conn.Permissions != nil {
+		user = server_conn.Permissions.Extensions[SFTP_USER_EXTENSION]
+	}
+	log("SFTP connection from %s (%s)", server_conn.RemoteAddr(), server_conn.User())
+	go ssh.DiscardRequests(requests)
+
+	for new_channel := range channels {
+		if new_channel.ChannelType() != "session" {
+			new_channel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := new_channel.Accept()
+		if err != nil {
+			debug(2, "SFTP could not accept channel: %s", err.Error())
+			return
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				// only the sftp subsystem is supported
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}(requests)
+
+		// the users of their keys get their home folder
+		fs := &sftpFS{service: service, user: user}
+		handlers := sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+		server := sftp.NewRequestServer(channel, handlers)
+		err = server.Serve()
+		if err != nil && err != io.EOF {
+			debug(2, "SFTP session error: %s", err.Error())
+		}
+		server.Close()
+	}
+}
+
+// sftpFS maps the sftp namespace onto the shares: "/" lists the shares
+// and "/<share>/<path>" is the file inside that share. the home share is
+// the home folder of user, the one of the SFTP key or the FTP login, and
+// is not there without one
+type sftpFS struct {
+	service *MercuryFsService
+	user    string
+}
+
+// resolve returns the full path on disk for an sftp path, and whether it's
+// the root or a share root, which cannot be modified
+func (this *sftpFS) resolve(p string) (full_path string, top bool, err error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return "", true, nil
+	}
+	parts := strings.SplitN(p[1:], "/", 2)
+	relative := ""
+	if len(parts) == 2 {
+		relative = "/" + parts[1]
+	}
+	if !share_open(parts[0], schedule_now()) {
+		return "", relative == "", os.ErrPermission
+	}
+	if is_homes_share(parts[0]) {
+		share := this.service.Shares.Get(parts[0])
+		if share == nil || this.user == "" {
+			return "", false, os.ErrNotExist
+		}
+		if _, err := home_folder(share, this.user); err != nil {
+			return "", false, err
+		}
+		full_path, err = this.service.fullPathToFile(parts[0], home_relative(this.user, relative))
+		if is_path_limit(err) {
+			return "", false, err
+		} else if err != nil {
+			return "", false, os.ErrNotExist
+		}
+		return full_path, relative == "", nil
+	}
+	full_path, err = this.service.fullPathToFile(parts[0], relative)
+	if is_path_limit(err) {
+		return "", false, err
+	} else if err != nil {
+		return "", false, os.ErrNotExist
+	}
+	return full_path, relative == "", nil
+}
+
+func (this *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	full_path, _, err := this.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if full_path == "" {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	return os.Open(full_path)
+}
+
+func (this *sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if no_upload {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	full_path, top, err := this.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if top || this.service.Shares.read_only(full_path) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	pflags := r.Pflags()
+	flags := os.O_WRONLY | os.O_CREATE
+	if pflags.Read {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+		keep_version(this.service.Shares, full_path)
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return os.OpenFile(full_path, flags, 0644)
+}
+
+func (this *sftpFS) Filecmd(r *sftp.Request) error {
+	full_path, top, err := this.resolve(r.Filepath)
+	if err != nil {
+		return err
+	}
+	// read only shares are like the top
+	top = top || this.service.Shares.read_only(full_path)
+
+	switch r.Method {
+	case "Remove", "Rmdir":
+		if no_delete || top {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		if r.Method == "Remove" {
+			// deleted files go to the trash of the share
+			return delete_path_to_trash(this.service.Shares, full_path)
+		}
+		return os.Remove(full_path)
+	case "Mkdir":
+		if no_upload || top {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		return os.Mkdir(full_path, 0755)
+	case "Rename":
+		target, target_top, err := this.resolve(r.Target)
+		if err != nil {
+			return err
+		}
+		if no_upload || top || target_top || this.service.Shares.read_only(target) {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		keep_version(this.service.Shares, target)
+		return os.Rename(full_path, target)
+	case "Setstat":
+		if no_upload || top {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		return sftp_setstat(full_path, r)
+	}
+	// symlinks and hard links could point outside of the shares
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func sftp_setstat(full_path string, r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		if err := os.Truncate(full_path, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(full_path, attrs.FileMode()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(full_path, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	full_path, _, err := this.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "List":
+		if full_path == "" {
+			return this.share_list(), nil
+		}
+		dir, err := os.Open(full_path)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+		fis, err := dir.Readdir(0)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListing(symlinks_listed(this.service.Shares, full_path, fis)), nil
+	case "Stat":
+		if full_path == "" {
+			return sftpListing{&shareFileInfo{name: "/", mtime: time.Now()}}, nil
+		}
+		fi, err := os.Stat(full_path)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListing{fi}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (this *sftpFS) share_list() sftpListing {
+	shares := this.service.Shares
+	shares.refresh()
+	shares.RLock()
+	defer shares.RUnlock()
+	listing := make(sftpListing, 0, len(shares.Shares))
+	for _, share := range shares.Shares {
+		if is_homes_share(share.name) && this.user == "" {
+			continue
+		}
+		listing = append(listing, &shareFileInfo{name: share.name, mtime: share.updated_at})
+	}
+	return listing
+}
+
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(fis []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(fis, l[offset:])
+	if n < len(fis) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// shareFileInfo is the os.FileInfo for the virtual directories of the shares
+type shareFileInfo struct {
+	name  string
+	mtime time.Time
+}
+
+func (fi *shareFileInfo) Name() string       { return fi.name }
+func (fi *shareFileInfo) Size() int64        { return 0 }
+func (fi *shareFileInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (fi *shareFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *shareFileInfo) IsDir() bool        { return true }
+func (fi *shareFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSftpAuthorizedKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sftp")
+	defer os.RemoveAll(dir)
+	keys := []ssh.PublicKey{}
+	for i := 0; i < 3; i++ {
+		public, _, _ := ed25519.GenerateKey(rand.Reader)
+		key, _ := ssh.NewPublicKey(public)
+		keys = append(keys, key)
+	}
+	line := func(key ssh.PublicKey) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	}
+	file := filepath.Join(dir, "authorized_keys")
+	ioutil.WriteFile(file, []byte(line(keys[0])+" shared@nas\n"+
+		`user="ann" `+line(keys[1])+" ann@laptop\n"+
+		`user="../bob" `+line(keys[2])+" bob@laptop\n"), 0600)
+	authorized, err := sftp_authorized_keys(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, ok := authorized[string(keys[0].Marshal())]; !ok || user != "" {
+		t.Errorf("Wrong shared key: %q %v", user, ok)
+	}
+	if user := authorized[string(keys[1].Marshal())]; user != "ann" {
+		t.Errorf("Wrong user of the key: %q", user)
+	}
+	if _, ok := authorized[string(keys[2].Marshal())]; ok {
+		t.Errorf("Key of an invalid user accepted")
+	}
+}
+
+func TestSftpFS(t *testing.T) {
+	saved_config, saved_upload, saved_delete := config, no_upload, no_delete
+	defer func() { config, no_upload, no_delete = saved_config, saved_upload, saved_delete }()
+	config = default_config()
+	config.Homes.Share = "Homes"
+	dir, _ := ioutil.TempDir("", "sftp")
+	defer os.RemoveAll(dir)
+	docs, archive, homes := filepath.Join(dir, "Docs"), filepath.Join(dir, "Archive"), filepath.Join(dir, "Homes")
+	for _, d := range []string{filepath.Join(docs, "Taxes"), archive, homes} {
+		os.MkdirAll(d, 0755)
+	}
+	ioutil.WriteFile(filepath.Join(docs, "Taxes", "2018.pdf"), []byte("taxes"), 0644)
+	ioutil.WriteFile(filepath.Join(archive, "old.txt"), []byte("old"), 0644)
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Docs", path: docs},
+		{name: "Archive", path: archive, read_only: true}, {name: "Homes", path: homes}}}, debug_info: new(debugInfo)}
+	fs := &sftpFS{service: service}
+
+	for _, c := range []struct {
+		path, full_path string
+		top             bool
+		err             error
+	}{
+		{"/", "", true, nil},
+		{"", "", true, nil},
+		{"/Docs", docs, true, nil},
+		{"/Docs/Taxes/2018.pdf", filepath.Join(docs, "Taxes", "2018.pdf"), false, nil},
+		{"/Docs/../../etc/passwd", "", false, os.ErrNotExist},
+		{"/Nowhere/a.txt", "", false, os.ErrNotExist},
+		// no home without a user
+		{"/Homes/a.txt", "", false, os.ErrNotExist},
+	} {
+		full_path, top, err := fs.resolve(c.path)
+		if full_path != c.full_path || top != c.top || err != c.err {
+			t.Errorf("%s resolved to %q %v %v", c.path, full_path, top, err)
+		}
+	}
+	names := func(fs *sftpFS) string {
+		listing := fs.share_list()
+		list := []string{}
+		for _, fi := range listing {
+			list = append(list, fi.Name())
+		}
+		return strings.Join(list, ",")
+	}
+	if list := names(fs); list != "Docs,Archive" {
+		t.Errorf("Wrong shares without a user: %s", list)
+	}
+
+	// the users of keys get their home folder
+	ann := &sftpFS{service: service, user: "ann"}
+	if list := names(ann); list != "Docs,Archive,Homes" {
+		t.Errorf("Wrong shares of a user: %s", list)
+	}
+	if full_path, top, err := ann.resolve("/Homes/../Homes/notes.txt"); err != nil || top || full_path != filepath.Join(homes, "ann", "notes.txt") {
+		t.Errorf("Wrong path in the home folder: %q %v %v", full_path, top, err)
+	}
+	if full_path, _, err := ann.resolve("/Homes/../../Homes/bob/notes.txt"); err != nil || full_path != filepath.Join(homes, "ann", "bob", "notes.txt") {
+		t.Errorf("Out of the home folder: %q %v", full_path, err)
+	}
+
+	// the top and the shares cannot be changed, nor read only shares
+	command := func(method, p, target string) error {
+		request := sftp.NewRequest(method, p)
+		request.Target = target
+		return fs.Filecmd(request)
+	}
+	for _, c := range []struct {
+		method, path, target string
+		err                  error
+	}{
+		// not a share
+		{"Mkdir", "/New", "", os.ErrNotExist},
+		{"Rename", "/Docs", "/Papers", os.ErrNotExist},
+		{"Rename", "/Docs/Taxes", "/Taxes", os.ErrNotExist},
+		{"Remove", "/", "", sftp.ErrSSHFxPermissionDenied},
+		{"Remove", "/Docs", "", sftp.ErrSSHFxPermissionDenied},
+		{"Rmdir", "/Docs", "", sftp.ErrSSHFxPermissionDenied},
+		{"Rename", "/Docs", "/Archive/Docs", sftp.ErrSSHFxPermissionDenied},
+		{"Rename", "/Docs/Taxes", "/Docs", sftp.ErrSSHFxPermissionDenied},
+		{"Rename", "/Docs/Taxes", "/Archive/Taxes", sftp.ErrSSHFxPermissionDenied},
+		{"Rename", "/Archive/old.txt", "/Docs/old.txt", sftp.ErrSSHFxPermissionDenied},
+		{"Remove", "/Archive/old.txt", "", sftp.ErrSSHFxPermissionDenied},
+		{"Mkdir", "/Archive/New", "", sftp.ErrSSHFxPermissionDenied},
+	} {
+		if err := command(c.method, c.path, c.target); err != c.err {
+			t.Errorf("%s %s %s: %v", c.method, c.path, c.target, err)
+		}
+	}
+	if _, err := fs.Filewrite(sftp.NewRequest("Put", "/Archive/new.txt")); err != sftp.ErrSSHFxPermissionDenied {
+		t.Errorf("Wrote to a read only share: %v", err)
+	}
+	if !exists(filepath.Join(docs, "Taxes", "2018.pdf")) || !exists(filepath.Join(archive, "old.txt")) || exists(filepath.Join(archive, "Taxes")) {
+		t.Errorf("Changed by the commands denied")
+	}
+
+	// renames and removes in a share
+	if err := command("Rename", "/Docs/Taxes/2018.pdf", "/Docs/Taxes/2018-final.pdf"); err != nil || !exists(filepath.Join(docs, "Taxes", "2018-final.pdf")) {
+		t.Errorf("Not renamed: %v", err)
+	}
+	if err := command("Rmdir", "/Docs/Taxes", ""); err == nil || !exists(filepath.Join(docs, "Taxes", "2018-final.pdf")) {
+		t.Errorf("Removed a folder that is not empty: %v", err)
+	}
+	no_delete = true
+	if err := command("Remove", "/Docs/Taxes/2018-final.pdf", ""); err != sftp.ErrSSHFxPermissionDenied {
+		t.Errorf("Removed with no_delete: %v", err)
+	}
+	no_delete = false
+	if err := command("Remove", "/Docs/Taxes/2018-final.pdf", ""); err != nil || exists(filepath.Join(docs, "Taxes", "2018-final.pdf")) {
+		t.Errorf("Not removed: %v", err)
+	}
+	if items, _ := list_trash(service.Shares.Get("Docs")); len(items) != 1 || items[0].Path != "/Taxes/2018-final.pdf" {
+		t.Errorf("Not in the trash: %+v", items)
+	}
+	if err := command("Rmdir", "/Docs/Taxes", ""); err != nil || exists(filepath.Join(docs, "Taxes")) {
+		t.Errorf("Empty folder not removed: %v", err)
+	}
+}
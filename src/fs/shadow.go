@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// to try a new version of the fs on the real use of a household before
+// switching to it, a percent of the reads, shadow.percent of the GET and
+// HEAD requests, are sent as well to the one at shadow.url. what it
+// answers is thrown away, after its status is compared with the one the
+// client got, and how long both took until their headers: the body of the
+// shadow instance is not read past them. the streams of events, which do
+// not end, are not sent. the counts, by
+// endpoint, and the last requests answered differently, without the
+// tokens in their query, are in /hda_debug.
+// at most SHADOW_MAX_INFLIGHT are sent at a time, those over it are
+// skipped, so that a slow instance does not pile them up
+
+const SHADOW_MAX_INFLIGHT = 16
+
+// how much of the body of an answer is read before closing it
+const SHADOW_DRAIN = 64 << 10
+
+// how many of the requests answered differently are kept
+const SHADOW_MISMATCHES = 20
+
+// the header the shadow instance gets, for its logs
+const SHADOW_HEADER = "X-Shadow"
+
+// the headers of the connection, not passed along
+var shadow_hop_headers = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+type shadowEndpoint struct {
+	Endpoint   string  `json:"endpoint"`
+	Requests   int64   `json:"requests"`
+	Matched    int64   `json:"matched"`
+	Mismatched int64   `json:"mismatched"`
+	Errors     int64   `json:"errors"`
+	PrimaryMs  float64 `json:"primary_ms"`
+	ShadowMs   float64 `json:"shadow_ms"`
+
+	// in all, for the averages
+	primary time.Duration
+	shadow  time.Duration
+}
+
+type shadowMismatch struct {
+	At      time.Time `json:"at"`
+	Request string    `json:"request"`
+	Primary int       `json:"primary"`
+	Shadow  int       `json:"shadow,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// what the shadow instance answered
+type shadowResult struct {
+	status int
+	took   time.Duration
+	err    error
+}
+
+type shadowTraffic struct {
+	endpoints  map[string]*shadowEndpoint
+	mismatches []shadowMismatch
+	skipped    int64
+	inflight   chan bool
+	client     *http.Client
+	// the requests sent and not recorded yet
+	pending sync.WaitGroup
+	sync.Mutex
+}
+
+var shadow_traffic = new_shadow_traffic()
+
+func new_shadow_traffic() *shadowTraffic {
+	return &shadowTraffic{
+		endpoints: make(map[string]*shadowEndpoint),
+		inflight:  make(chan bool, SHADOW_MAX_INFLIGHT),
+		client: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			// redirects are compared like any other answer
+			return http.ErrUseLastResponse
+		}},
+	}
+}
+
+// shadowed says whether request is sent to the shadow instance too
+func shadowed(request *http.Request) bool {
+	if config.Shadow.URL == "" || config.Shadow.Percent <= 0 || (request.Method != "GET" && request.Method != "HEAD") ||
+		request.Header.Get("Upgrade") != "" || request.Header.Get(SHADOW_HEADER) != "" || shadow_streaming(request) {
+		return false
+	}
+	return rand.Float64()*100 < config.Shadow.Percent
+}
+
+// shadow_streaming says if request is for a stream that does not end
+func shadow_streaming(request *http.Request) bool {
+	return request.URL.Path == "/events" || strings.Contains(request.Header.Get("Accept"), "text/event-stream")
+}
+
+// send makes the request to the shadow instance, timing it until its
+// headers
+func (this *shadowTraffic) send(method, target string, header http.Header) shadowResult {
+	timeout, err := time.ParseDuration(config.Shadow.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return shadowResult{err: err}
+	}
+	for key, values := range header {
+		if !shadow_hop_headers[key] {
+			request.Header[key] = values
+		}
+	}
+	request.Header.Set(SHADOW_HEADER, "1")
+	started := time.Now()
+	response, err := this.client.Do(request)
+	if err != nil {
+		return shadowResult{err: err}
+	}
+	took := time.Since(started)
+	// a short body is read, for the connection to be used again, a file
+	// is not read a second time
+	io.CopyN(ioutil.Discard, response.Body, SHADOW_DRAIN)
+	response.Body.Close()
+	return shadowResult{status: response.StatusCode, took: took}
+}
+
+// record counts a request to endpoint, answered with status after took
+// to the client, and what the shadow instance answered
+func (this *shadowTraffic) record(endpoint, query string, status int, took time.Duration, result shadowResult) {
+	this.Lock()
+	defer this.Unlock()
+	counts := this.endpoints[endpoint]
+	if counts == nil {
+		counts = &shadowEndpoint{Endpoint: endpoint}
+		this.endpoints[endpoint] = counts
+	}
+	counts.Requests++
+	if result.err != nil {
+		counts.Errors++
+	} else {
+		counts.primary += took
+		counts.shadow += result.took
+		if result.status == status {
+			counts.Matched++
+			return
+		}
+		counts.Mismatched++
+	}
+	mismatch := shadowMismatch{At: time.Now(), Request: query, Primary: status, Shadow: result.status}
+	if result.err != nil {
+		mismatch.Error = result.err.Error()
+	}
+	debug(2, "Shadow answered \"%s\" with %d instead of %d %s", query, result.status, status, mismatch.Error)
+	this.mismatches = append(this.mismatches, mismatch)
+	if len(this.mismatches) > SHADOW_MISMATCHES {
+		this.mismatches = this.mismatches[len(this.mismatches)-SHADOW_MISMATCHES:]
+	}
+}
+
+func (this *shadowTraffic) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	endpoints := []shadowEndpoint{}
+	for _, counts := range this.endpoints {
+		endpoint := *counts
+		if timed := endpoint.Matched + endpoint.Mismatched; timed > 0 {
+			endpoint.PrimaryMs = float64(endpoint.primary/time.Microsecond) / 1000 / float64(timed)
+			endpoint.ShadowMs = float64(endpoint.shadow/time.Microsecond) / 1000 / float64(timed)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Requests > endpoints[j].Requests })
+	return map[string]interface{}{
+		"url":        config.Shadow.URL,
+		"percent":    config.Shadow.Percent,
+		"skipped":    atomic.LoadInt64(&this.skipped),
+		"endpoints":  endpoints,
+		"mismatches": append([]shadowMismatch{}, this.mismatches...),
+	}
+}
+
+// shadowWriter keeps when the headers were sent
+type shadowWriter struct {
+	*statusWriter
+	headers time.Time
+}
+
+func (this *shadowWriter) WriteHeader(status int) {
+	if this.headers.IsZero() {
+		this.headers = time.Now()
+	}
+	this.statusWriter.WriteHeader(status)
+}
+
+func (this *shadowWriter) Write(data []byte) (int, error) {
+	if this.headers.IsZero() {
+		this.headers = time.Now()
+	}
+	return this.statusWriter.Write(data)
+}
+
+func (this *shadowWriter) ReadFrom(reader io.Reader) (int64, error) {
+	if this.headers.IsZero() {
+		this.headers = time.Now()
+	}
+	return this.statusWriter.ReadFrom(reader)
+}
+
+// shadow is a middleware sending some of the reads to the shadow instance
+// as well, while they are served
+func (service *MercuryFsService) shadow(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !shadowed(request) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		select {
+		case shadow_traffic.inflight <- true:
+		default:
+			atomic.AddInt64(&shadow_traffic.skipped, 1)
+			next.ServeHTTP(writer, request)
+			return
+		}
+		endpoint, query := endpoint_of(request), request.Method+" "+pathForLog(without_tokens(request.URL))
+		target := strings.TrimSuffix(config.Shadow.URL, "/") + request.URL.RequestURI()
+		result := make(chan shadowResult, 1)
+		shadow_traffic.pending.Add(1)
+		go func(header http.Header) {
+			answer := shadow_traffic.send(request.Method, target, header)
+			<-shadow_traffic.inflight
+			result <- answer
+		}(request.Header.Clone())
+
+		started := time.Now()
+		shadow_writer := &shadowWriter{statusWriter: &statusWriter{ResponseWriter: writer}}
+		next.ServeHTTP(shadow_writer, request)
+		ended := shadow_writer.headers
+		if ended.IsZero() {
+			ended = time.Now()
+		}
+		status := shadow_writer.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		go func() {
+			defer shadow_traffic.pending.Done()
+			shadow_traffic.record(endpoint, query, status, ended.Sub(started), <-result)
+		}()
+	})
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShadow(t *testing.T) {
+	saved_config, saved_traffic := config, shadow_traffic
+	defer func() { config, shadow_traffic = saved_config, saved_traffic }()
+	config = default_config()
+	shadow_traffic = new_shadow_traffic()
+
+	var shadowed, marked int64
+	staging := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt64(&shadowed, 1)
+		if request.Header.Get(SHADOW_HEADER) == "1" && request.Header.Get("Session") == "abc" {
+			atomic.AddInt64(&marked, 1)
+		}
+		if request.URL.Path == "/shares" {
+			writer.Write([]byte("[]"))
+			return
+		}
+		http.NotFound(writer, request)
+	}))
+	defer staging.Close()
+	config.Shadow.URL = staging.URL + "/"
+	config.Shadow.Percent = 100
+
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.Use(service.shadow)
+	ok := func(writer http.ResponseWriter, request *http.Request) { writer.Write([]byte("ok")) }
+	router.HandleFunc("/shares", ok).Methods("GET")
+	router.HandleFunc("/files", ok).Methods("GET", "POST")
+	router.HandleFunc("/events", ok).Methods("GET")
+	// the streams of events are not sent
+	for _, request := range []*http.Request{httptest.NewRequest("GET", "/shares", nil), httptest.NewRequest("GET", "/shares", nil),
+		httptest.NewRequest("GET", "/files?s=a&p=b&guest=secret", nil), httptest.NewRequest("POST", "/files?s=a&p=b", nil), httptest.NewRequest("GET", "/events", nil)} {
+		request.Header.Set("Session", "abc")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != 200 || recorder.Body.String() != "ok" {
+			t.Errorf("Wrong answer to the client: %d %s", recorder.Code, recorder.Body.String())
+		}
+	}
+	shadow_traffic.pending.Wait()
+
+	if shadowed != 3 || marked != 3 {
+		t.Errorf("%d requests shadowed, %d of them marked", shadowed, marked)
+	}
+	status := shadow_traffic.status()
+	endpoints := status["endpoints"].([]shadowEndpoint)
+	if len(endpoints) != 2 || endpoints[0].Endpoint != "GET /shares" || endpoints[0].Matched != 2 || endpoints[1].Mismatched != 1 {
+		t.Errorf("Wrong counts: %+v", endpoints)
+	}
+	mismatches := status["mismatches"].([]shadowMismatch)
+	if len(mismatches) != 1 || mismatches[0].Primary != 200 || mismatches[0].Shadow != 404 {
+		t.Errorf("Wrong mismatches: %+v", mismatches)
+	} else if mismatches[0].Request != "GET /files?p=b&s=a" {
+		// the tokens are not kept
+		t.Errorf("Wrong request of the mismatch: %s", mismatches[0].Request)
+	}
+
+	// an instance that is down is counted as errors
+	staging.Close()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/shares", nil))
+	shadow_traffic.pending.Wait()
+	if endpoints := shadow_traffic.status()["endpoints"].([]shadowEndpoint); endpoints[0].Errors != 1 || endpoints[0].Requests != 3 {
+		t.Errorf("Wrong counts with the instance down: %+v", endpoints)
+	}
+
+	config.Shadow.Percent = 0
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/shares", nil))
+	shadow_traffic.pending.Wait()
+	if endpoints := shadow_traffic.status()["endpoints"].([]shadowEndpoint); endpoints[0].Requests != 3 {
+		t.Errorf("Shadowed with no percent: %+v", endpoints)
+	}
+}
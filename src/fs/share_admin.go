@@ -0,0 +1,445 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// the shares can be added, renamed, hidden and removed with /admin/shares
+// on the local server, with the admin token of /admin/config, instead of
+// the dashboard and a restart. with the settings DB, they are its rows,
+// hidden ones having visible = 0. without Amahi, they are the shares of
+// the config file, which is written. with -r, they are the directories: a
+// new share is a new directory, a hidden one starts with a dot, and only
+// an empty one can be removed. the files of a share are never removed.
+// the shares are read again right away, and the clients get a "shares"
+// event. the network shares have /network/mounts instead
+
+var (
+	errShareExists   = errors.New("there is a share with that name")
+	errShareNotFound = errors.New("no such share")
+	errShareName     = errors.New("share names cannot be empty, start with a dot or have a /")
+	errShareNetwork  = errors.New("network shares are changed with /network/mounts")
+	errShareNotEmpty = errors.New("the directory of the share is not empty")
+	errShareDirOnly  = errors.New("the shares of -r are its directories, only their names can be set")
+)
+
+// adminShare is a share as shown by /admin/shares
+type adminShare struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Tags     string `json:"tags"`
+	Hidden   bool   `json:"hidden"`
+	Network  bool   `json:"network,omitempty"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+	Problem  string `json:"problem,omitempty"`
+}
+
+// shareChange is what to change of a share, nil for what stays
+type shareChange struct {
+	Name   *string `json:"name"`
+	Path   *string `json:"path"`
+	Tags   *string `json:"tags"`
+	Hidden *bool   `json:"hidden"`
+}
+
+func valid_share_name(name string) bool {
+	return name != "" && len(name) <= 64 && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\x00")
+}
+
+// exec_sql runs a statement on the settings DB
+func exec_sql(query string, args ...interface{}) error {
+	dbconn, err := sql.Open("mysql", MYSQL_CREDENTIALS)
+	if err != nil {
+		return err
+	}
+	defer dbconn.Close()
+	_, err = dbconn.Exec(query, args...)
+	return err
+}
+
+// hidden_shares are the shares not listed
+func (this *HdaShares) hidden_shares() ([]adminShare, error) {
+	hidden := []adminShare{}
+	if this.root_dir != "" {
+		fis, err := ioutil.ReadDir(this.root_dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if name := strings.TrimPrefix(fi.Name(), "."); fi.IsDir() && fi.Name() != name && valid_share_name(name) {
+				hidden = append(hidden, adminShare{Name: name, Path: filepath.Join(this.root_dir, fi.Name()), Tags: name, Hidden: true})
+			}
+		}
+		return hidden, nil
+	}
+	if standalone() {
+		for _, share := range config.Shares {
+			if !share.Visible {
+				hidden = append(hidden, adminShare{Name: share.Name, Path: share.Path, Tags: strings.Join(share.Tags, ", "),
+					Hidden: true, ReadOnly: !share.Writable})
+			}
+		}
+		return hidden, nil
+	}
+	columns := SQL_SHARES_NAME + ", path"
+	if SQL_SHARES_TAGS {
+		columns += ", tags"
+	}
+	dbconn, err := sql.Open("mysql", MYSQL_CREDENTIALS)
+	if err != nil {
+		return nil, err
+	}
+	defer dbconn.Close()
+	rows, err := dbconn.Query("SELECT " + columns + " FROM shares WHERE visible = 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		share := adminShare{Hidden: true}
+		if SQL_SHARES_TAGS {
+			var tags sql.NullString
+			rows.Scan(&share.Name, &share.Path, &tags)
+			share.Tags = tags.String
+		} else {
+			rows.Scan(&share.Name, &share.Path)
+		}
+		hidden = append(hidden, share)
+	}
+	return hidden, rows.Err()
+}
+
+// admin_shares are all the shares, hidden ones included, by name
+func (this *HdaShares) admin_shares() ([]adminShare, error) {
+	hidden, err := this.hidden_shares()
+	if err != nil {
+		return nil, err
+	}
+	this.RLock()
+	shares := hidden
+	for _, share := range this.Shares {
+		shares = append(shares, adminShare{Name: share.name, Path: share.path, Tags: share.tags, Network: share.network,
+			ReadOnly: share.read_only, Problem: share.problem})
+	}
+	this.RUnlock()
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Name < shares[j].Name })
+	return shares, nil
+}
+
+// find_admin_share is the share named name, hidden or not
+func (this *HdaShares) find_admin_share(name string) (*adminShare, error) {
+	shares, err := this.admin_shares()
+	if err != nil {
+		return nil, err
+	}
+	for i := range shares {
+		if shares[i].Name == name {
+			return &shares[i], nil
+		}
+	}
+	return nil, errShareNotFound
+}
+
+// add_share adds a share, with the directory at path, made if needed
+func (this *HdaShares) add_share(name, path, tags string) error {
+	if !valid_share_name(name) {
+		return errShareName
+	}
+	if _, err := this.find_admin_share(name); err != errShareNotFound {
+		if err == nil {
+			err = errShareExists
+		}
+		return err
+	}
+	if this.root_dir != "" {
+		if path != "" || tags != "" {
+			return errShareDirOnly
+		}
+		if err := os.Mkdir(filepath.Join(this.root_dir, name), 0775); err != nil {
+			return err
+		}
+		return this.update_shares()
+	}
+	if !filepath.IsAbs(path) {
+		return errors.New("the path of a share must be absolute")
+	}
+	if err := os.MkdirAll(path, 0775); err != nil {
+		return err
+	}
+	if standalone() {
+		share := shareConfig{Name: name, Path: path, Tags: (&HdaShare{tags: tags}).tags_list(), Writable: true, Visible: true}
+		if err := save_config_shares(append(append([]shareConfig{}, config.Shares...), share)); err != nil {
+			return err
+		}
+		return this.update_shares()
+	}
+	columns, values, args := SQL_SHARES_NAME+", path", "?, ?", []interface{}{name, path}
+	if SQL_SHARES_NAME != "name" {
+		columns, values, args = columns+", name", values+", ?", append(args, name)
+	}
+	if SQL_SHARES_TAGS {
+		columns, values, args = columns+", tags", values+", ?", append(args, tags)
+	}
+	err := exec_sql("INSERT INTO shares ("+columns+", visible, created_at, updated_at) VALUES ("+values+", 1, NOW(), NOW())", args...)
+	if err != nil {
+		return err
+	}
+	return this.update_shares()
+}
+
+// change_share renames, moves, tags, hides or shows a share
+func (this *HdaShares) change_share(name string, change shareChange) error {
+	share, err := this.find_admin_share(name)
+	if err != nil {
+		return err
+	}
+	if share.Network {
+		return errShareNetwork
+	}
+	if change.Name != nil && *change.Name != name {
+		if !valid_share_name(*change.Name) {
+			return errShareName
+		}
+		if _, err := this.find_admin_share(*change.Name); err != errShareNotFound {
+			if err == nil {
+				err = errShareExists
+			}
+			return err
+		}
+	}
+	if this.root_dir != "" {
+		if change.Path != nil || change.Tags != nil {
+			return errShareDirOnly
+		}
+		new_name, hidden := name, share.Hidden
+		if change.Name != nil {
+			new_name = *change.Name
+		}
+		if change.Hidden != nil {
+			hidden = *change.Hidden
+		}
+		if hidden {
+			new_name = "." + new_name
+		}
+		if err := os.Rename(share.Path, filepath.Join(this.root_dir, new_name)); err != nil {
+			return err
+		}
+		return this.update_shares()
+	}
+	if change.Path != nil && !filepath.IsAbs(*change.Path) {
+		return errors.New("the path of a share must be absolute")
+	}
+	if standalone() {
+		shares := append([]shareConfig{}, config.Shares...)
+		for i := range shares {
+			if shares[i].Name != name {
+				continue
+			}
+			if change.Name != nil {
+				shares[i].Name = *change.Name
+			}
+			if change.Path != nil {
+				shares[i].Path = *change.Path
+			}
+			if change.Tags != nil {
+				shares[i].Tags = (&HdaShare{tags: *change.Tags}).tags_list()
+			}
+			if change.Hidden != nil {
+				shares[i].Visible = !*change.Hidden
+			}
+		}
+		if err := save_config_shares(shares); err != nil {
+			return err
+		}
+		return this.update_shares()
+	}
+	sets, args := []string{}, []interface{}{}
+	if change.Name != nil {
+		sets, args = append(sets, SQL_SHARES_NAME+" = ?"), append(args, *change.Name)
+	}
+	if change.Path != nil {
+		sets, args = append(sets, "path = ?"), append(args, *change.Path)
+	}
+	if change.Tags != nil && SQL_SHARES_TAGS {
+		sets, args = append(sets, "tags = ?"), append(args, *change.Tags)
+	}
+	if change.Hidden != nil {
+		visible := 1
+		if *change.Hidden {
+			visible = 0
+		}
+		sets, args = append(sets, "visible = ?"), append(args, visible)
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	err = exec_sql("UPDATE shares SET "+strings.Join(sets, ", ")+", updated_at = NOW() WHERE "+SQL_SHARES_NAME+" = ?", append(args, name)...)
+	if err != nil {
+		return err
+	}
+	return this.update_shares()
+}
+
+// remove_share removes a share, leaving its files
+func (this *HdaShares) remove_share(name string) error {
+	share, err := this.find_admin_share(name)
+	if err != nil {
+		return err
+	}
+	if share.Network {
+		return errShareNetwork
+	}
+	if this.root_dir != "" {
+		if err := os.Remove(share.Path); err != nil {
+			if fis, _ := ioutil.ReadDir(share.Path); len(fis) > 0 {
+				return errShareNotEmpty
+			}
+			return err
+		}
+		return this.update_shares()
+	}
+	if standalone() {
+		shares := []shareConfig{}
+		for _, declared := range config.Shares {
+			if declared.Name != name {
+				shares = append(shares, declared)
+			}
+		}
+		if err := save_config_shares(shares); err != nil {
+			return err
+		}
+		return this.update_shares()
+	}
+	if err := exec_sql("DELETE FROM shares WHERE "+SQL_SHARES_NAME+" = ?", name); err != nil {
+		return err
+	}
+	return this.update_shares()
+}
+
+// share_admin_status is the status of the answers to err
+func share_admin_status(err error) int {
+	switch err {
+	case errShareNotFound, errPermissionsPath, errPermissionsFile:
+		return http.StatusNotFound
+	case errShareExists, errShareNetwork, errShareNotEmpty, errPermissionsRunning:
+		return http.StatusConflict
+	case errPermissionsReadOnly:
+		return http.StatusForbidden
+	}
+	if os.IsPermission(err) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// share_admin_denied answers the requests without the admin token
+func (service *MercuryFsService) share_admin_denied(writer http.ResponseWriter, request *http.Request) bool {
+	if admin_allowed(request) {
+		return false
+	}
+	size := json_response(writer, http.StatusUnauthorized, map[string]string{"error": "the admin token is needed"})
+	service.debug_info.requestServed(size)
+	log("\"%s %s\" 401 %d \"%s\"", request.Method, pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+	return true
+}
+
+// share_admin_answer answers a change of shares, with result or err
+func (service *MercuryFsService) share_admin_answer(writer http.ResponseWriter, request *http.Request, status int, result interface{}, err error) {
+	if err != nil {
+		status = share_admin_status(err)
+		result = map[string]string{"error": err.Error()}
+	}
+	size := int64(0)
+	if status == http.StatusNoContent {
+		writer.WriteHeader(status)
+	} else {
+		size = json_response(writer, status, result)
+	}
+	service.debug_info.requestServed(size)
+	log("\"%s %s\" %d %d \"%s\"", request.Method, pathForLog(request.URL), status, size, request.Header.Get("User-Agent"))
+}
+
+// GET /admin/shares lists the shares, hidden ones included
+func (service *MercuryFsService) share_admin_list(writer http.ResponseWriter, request *http.Request) {
+	if service.share_admin_denied(writer, request) {
+		return
+	}
+	shares, err := service.Shares.admin_shares()
+	if err != nil {
+		log_error("Could not list the shares: %s", err.Error())
+	}
+	service.share_admin_answer(writer, request, http.StatusOK, shares, err)
+}
+
+// POST /admin/shares with {"name", "path", "tags"} adds a share
+func (service *MercuryFsService) share_admin_add(writer http.ResponseWriter, request *http.Request) {
+	if service.share_admin_denied(writer, request) {
+		return
+	}
+	var share adminShare
+	err := json.NewDecoder(io.LimitReader(request.Body, 64<<10)).Decode(&share)
+	if err == nil {
+		err = service.Shares.add_share(share.Name, share.Path, share.Tags)
+	}
+	var added *adminShare
+	if err == nil {
+		log("Share %s added", share.Name)
+		added, err = service.Shares.find_admin_share(share.Name)
+	}
+	service.share_admin_answer(writer, request, http.StatusCreated, added, err)
+}
+
+// PATCH /admin/shares/{name} with {"name", "path", "tags", "hidden"}, or
+// some of them, changes a share
+func (service *MercuryFsService) share_admin_change(writer http.ResponseWriter, request *http.Request) {
+	if service.share_admin_denied(writer, request) {
+		return
+	}
+	name := mux.Vars(request)["name"]
+	var change shareChange
+	err := json.NewDecoder(io.LimitReader(request.Body, 64<<10)).Decode(&change)
+	if err == nil {
+		err = service.Shares.change_share(name, change)
+	}
+	var changed *adminShare
+	if err == nil {
+		if change.Name != nil {
+			name = *change.Name
+		}
+		log("Share %s changed", name)
+		changed, err = service.Shares.find_admin_share(name)
+	}
+	service.share_admin_answer(writer, request, http.StatusOK, changed, err)
+}
+
+// DELETE /admin/shares/{name} removes a share, but not its files
+func (service *MercuryFsService) share_admin_remove(writer http.ResponseWriter, request *http.Request) {
+	if service.share_admin_denied(writer, request) {
+		return
+	}
+	name := mux.Vars(request)["name"]
+	err := service.Shares.remove_share(name)
+	if err == nil {
+		log("Share %s removed", name)
+	}
+	service.share_admin_answer(writer, request, http.StatusNoContent, nil, err)
+}
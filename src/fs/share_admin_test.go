@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestShareAdmin(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = default_config()
+	config.Admin.Token = "letmein"
+	dir, _ := ioutil.TempDir("", "shares")
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "Movies"), 0755)
+	shares, err := NewHdaShares(dir)
+	if err != nil {
+		t.Fatalf("NewHdaShares failed: %s", err)
+	}
+
+	service := &MercuryFsService{Shares: shares, debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/shares", service.share_admin_list).Methods("GET")
+	router.HandleFunc("/admin/shares", service.share_admin_add).Methods("POST")
+	router.HandleFunc("/admin/shares/{name}", service.share_admin_change).Methods("PATCH")
+	router.HandleFunc("/admin/shares/{name}", service.share_admin_remove).Methods("DELETE")
+	serve := func(method, target, body string) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer letmein")
+		router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	listed := func() string {
+		names := []string{}
+		for _, share := range shares.Shares {
+			names = append(names, share.name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("POST", "/admin/shares", strings.NewReader(`{"name": "Music"}`)))
+	if recorder.Code != 401 || exists(filepath.Join(dir, "Music")) {
+		t.Errorf("Added a share without the token: %d", recorder.Code)
+	}
+
+	if code := serve("POST", "/admin/shares", `{"name": "Music"}`); code != 201 || listed() != "Movies,Music" {
+		t.Errorf("Not added: %d %s", code, listed())
+	}
+	for body, status := range map[string]int{`{"name": "Music"}`: 409, `{"name": ".hidden"}`: 400, `{"name": "a/b"}`: 400,
+		`{"name": "Docs", "path": "/srv/docs"}`: 400} {
+		if code := serve("POST", "/admin/shares", body); code != status {
+			t.Errorf("%d instead of %d for %s", code, status, body)
+		}
+	}
+
+	if code := serve("PATCH", "/admin/shares/Music", `{"name": "Songs"}`); code != 200 || listed() != "Movies,Songs" {
+		t.Errorf("Not renamed: %d %s", code, listed())
+	}
+	if code := serve("PATCH", "/admin/shares/Songs", `{"name": "Movies"}`); code != 409 {
+		t.Errorf("Renamed over another share: %d", code)
+	}
+	if code := serve("PATCH", "/admin/shares/Songs", `{"hidden": true}`); code != 200 || listed() != "Movies" {
+		t.Errorf("Not hidden: %d %s", code, listed())
+	}
+	// hidden shares are still there for the admin
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/admin/shares", nil)
+	request.Header.Set("Authorization", "Bearer letmein")
+	router.ServeHTTP(recorder, request)
+	var all []adminShare
+	json.Unmarshal(recorder.Body.Bytes(), &all)
+	if len(all) != 2 || all[1].Name != "Songs" || !all[1].Hidden {
+		t.Errorf("Wrong shares: %+v", all)
+	}
+	if code := serve("PATCH", "/admin/shares/Songs", `{"hidden": false}`); code != 200 || listed() != "Movies,Songs" {
+		t.Errorf("Not shown again: %d %s", code, listed())
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "Movies", "movie.mkv"), []byte("video"), 0644)
+	if code := serve("DELETE", "/admin/shares/Movies", ""); code != 409 || !exists(filepath.Join(dir, "Movies", "movie.mkv")) {
+		t.Errorf("Removed a share with files: %d", code)
+	}
+	if code := serve("DELETE", "/admin/shares/Songs", ""); code != 204 || listed() != "Movies" {
+		t.Errorf("Not removed: %d %s", code, listed())
+	}
+	if code := serve("DELETE", "/admin/shares/Songs", ""); code != 404 {
+		t.Errorf("Removed a missing share: %d", code)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the share of export in the config is made into a static site, to host
+// elsewhere, by the export job: index.json has its files and folders, and
+// index.html shows them, with the thumbnails of the photos and videos in
+// thumbnails/. the files themselves are not copied. only what changed is
+// made again, and the thumbnails of the files that are gone are removed.
+// the hidden files are left out, and so are the shares inside the share
+
+const EXPORT_JOB = "export"
+const EXPORT_THUMBNAILS = "thumbnails"
+
+var errExportDir = errors.New("the export dir must be an absolute path outside of the share")
+
+type exportEntry struct {
+	Path      string `json:"path"`
+	MimeType  string `json:"mime_type"`
+	Size      int64  `json:"size,omitempty"`
+	Mtime     string `json:"mtime"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+type exportIndex struct {
+	Share     string        `json:"share"`
+	Generated time.Time     `json:"generated"`
+	Entries   []exportEntry `json:"entries"`
+}
+
+var export_page = template.Must(template.New("export").Funcs(template.FuncMap{
+	"depth":  func(path string) int { return strings.Count(path, "/") - 1 },
+	"base":   filepath.Base,
+	"is_dir": func(mime_type string) bool { return mime_type == "text/directory" },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Share}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+li { list-style: none; margin: 0.3em 0; }
+img { width: 80px; vertical-align: middle; margin-right: 0.5em; }
+small { color: #888; }
+</style>
+</head>
+<body>
+<h1>{{.Share}}</h1>
+<ul>
+{{range .Entries}}<li style="margin-left: {{depth .Path}}em">{{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="">{{end}}{{if is_dir .MimeType}}<b>{{base .Path}}/</b>{{else}}{{base .Path}} <small>{{.Size}} bytes, {{.Mtime}}</small>{{end}}</li>
+{{end}}</ul>
+<p><small>{{.Generated.Format "2006-01-02 15:04"}}</small></p>
+</body>
+</html>
+`))
+
+// export_thumbnail is the name of the thumbnail of an entry, the same while
+// the file does not change
+func export_thumbnail(path string, fi os.FileInfo) string {
+	return EXPORT_THUMBNAILS + "/" + sha1string(fmt.Sprintf("%s\x00%d\x00%d", path, fi.Size(), fi.ModTime().UnixNano())) + ".jpg"
+}
+
+// export_share writes the static site of share to dir
+func export_share(share *HdaShare, skip []string, dir string, thumbnails bool, progress func(done, total int64)) (string, error) {
+	if !filepath.IsAbs(dir) || dir == share.path || path_inside(dir, share.path) {
+		return "", errExportDir
+	}
+	if err := os.MkdirAll(filepath.Join(dir, EXPORT_THUMBNAILS), 0755); err != nil {
+		return "", err
+	}
+	total, _ := share_index.stats(share.name)
+	index := exportIndex{Share: share.name, Generated: time.Now().UTC(), Entries: []exportEntry{}}
+	kept := make(map[string]bool)
+	made := 0
+	err := filepath.Walk(share.path, func(full_path string, fi os.FileInfo, err error) error {
+		if err != nil || full_path == share.path {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".") || fi.Mode()&os.ModeSymlink != 0 {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		for _, nested := range skip {
+			if fi.IsDir() && full_path == nested {
+				return filepath.SkipDir
+			}
+		}
+		path := strings.TrimPrefix(full_path, share.path)
+		entry := exportEntry{Path: path, Mtime: fi.ModTime().UTC().Format(time.RFC3339), MimeType: "text/directory"}
+		if !fi.IsDir() {
+			entry.MimeType, entry.Size = getContentType(fi.Name()), fi.Size()
+		}
+		if thumbnails && (strings.HasPrefix(entry.MimeType, "image/") || strings.HasPrefix(entry.MimeType, "video/")) {
+			name := export_thumbnail(path, fi)
+			target := filepath.Join(dir, filepath.FromSlash(name))
+			if exists(target) {
+				entry.Thumbnail = name
+			} else if thumbnail, err := thumbnail_cache.thumbnail(full_path, fi, THUMBNAIL_WIDTH); err == nil {
+				if data, err := ioutil.ReadFile(thumbnail); err == nil && write_file_atomic(target, data, 0644) == nil {
+					entry.Thumbnail = name
+					made++
+				}
+			}
+			if entry.Thumbnail != "" {
+				kept[filepath.Base(name)] = true
+			}
+		}
+		index.Entries = append(index.Entries, entry)
+		if progress != nil && len(index.Entries)%1000 == 0 {
+			progress(int64(len(index.Entries)), int64(total))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(index.Entries, func(a, b int) bool { return index.Entries[a].Path < index.Entries[b].Path })
+
+	data, err := json.MarshalIndent(index, "", " ")
+	if err != nil {
+		return "", err
+	}
+	if err := write_file_atomic(filepath.Join(dir, "index.json"), data, 0644); err != nil {
+		return "", err
+	}
+	var page bytes.Buffer
+	if err := export_page.Execute(&page, index); err != nil {
+		return "", err
+	}
+	if err := write_file_atomic(filepath.Join(dir, "index.html"), page.Bytes(), 0644); err != nil {
+		return "", err
+	}
+
+	// the thumbnails of the files changed or gone
+	removed := 0
+	if fis, err := ioutil.ReadDir(filepath.Join(dir, EXPORT_THUMBNAILS)); err == nil {
+		for _, fi := range fis {
+			if !kept[fi.Name()] && os.Remove(filepath.Join(dir, EXPORT_THUMBNAILS, fi.Name())) == nil {
+				removed++
+			}
+		}
+	}
+	return fmt.Sprintf("%d entries, %d thumbnails made, %d removed", len(index.Entries), made, removed), nil
+}
+
+// export_job exports the share of the config, as it is when it runs
+func export_job(shares *HdaShares) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		name, dir := config.Export.Share, config.Export.Dir
+		if name == "" {
+			return "no share to export", nil
+		}
+		shares.RLock()
+		var share *HdaShare
+		if found := shares.Get(name); found != nil {
+			share = &HdaShare{name: found.name, path: found.path, problem: found.problem}
+		}
+		shares.RUnlock()
+		if share == nil || is_homes_share(name) {
+			return "", errShareNotFound
+		}
+		if share_offline(share) {
+			return "", errShareOffline
+		}
+		if share.problem != "" {
+			return "", errors.New(share.problem)
+		}
+		return export_share(share, shares.nested_paths(name), dir, config.Export.Thumbnails, progress)
+	}
+}
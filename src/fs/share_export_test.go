@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareExport(t *testing.T) {
+	saved_config, saved_cache, saved_frame := config, thumbnail_cache, video_frame
+	defer func() { config, thumbnail_cache, video_frame = saved_config, saved_cache, saved_frame }()
+	dir, _ := ioutil.TempDir("", "export")
+	defer os.RemoveAll(dir)
+	config = default_config()
+	config.Export.Share, config.Export.Dir = "Photos", filepath.Join(dir, "site")
+	thumbnail_cache = new_thumbnail_cache(filepath.Join(dir, "cache"))
+	video_frame = func(full_path string, width int) ([]byte, error) { return nil, errNoThumbnail }
+
+	photos := filepath.Join(dir, "Photos")
+	os.MkdirAll(filepath.Join(photos, "Trip"), 0755)
+	os.MkdirAll(filepath.Join(photos, ".private"), 0755)
+	var picture bytes.Buffer
+	png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 100, 50)))
+	ioutil.WriteFile(filepath.Join(photos, "Trip", "beach.png"), picture.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(photos, "Trip", "<notes>.txt"), []byte("text"), 0644)
+	ioutil.WriteFile(filepath.Join(photos, "clip.mkv"), []byte("video"), 0644)
+	ioutil.WriteFile(filepath.Join(photos, ".private", "secret.png"), picture.Bytes(), 0644)
+	shares := &HdaShares{Shares: []*HdaShare{{name: "Photos", path: photos}}}
+	run := export_job(shares)
+
+	if _, err := run(func(done, total int64) {}); err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+	var index exportIndex
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "site", "index.json"))
+	if err := json.Unmarshal(data, &index); err != nil || index.Share != "Photos" {
+		t.Fatalf("Wrong index: %v %s", err, data)
+	}
+	paths := []string{}
+	for _, entry := range index.Entries {
+		paths = append(paths, entry.Path)
+	}
+	if strings.Join(paths, ",") != "/Trip,/Trip/<notes>.txt,/Trip/beach.png,/clip.mkv" {
+		t.Errorf("Wrong entries: %q", paths)
+	}
+	beach := index.Entries[2]
+	if beach.MimeType != "image/png" || beach.Size != int64(picture.Len()) || beach.Thumbnail == "" || index.Entries[3].Thumbnail != "" {
+		t.Errorf("Wrong thumbnails: %+v", index.Entries)
+	}
+	if !exists(filepath.Join(dir, "site", filepath.FromSlash(beach.Thumbnail))) {
+		t.Errorf("No thumbnail %s", beach.Thumbnail)
+	}
+	page, _ := ioutil.ReadFile(filepath.Join(dir, "site", "index.html"))
+	if !strings.Contains(string(page), `<img src="`+beach.Thumbnail+`"`) || !strings.Contains(string(page), "&lt;notes&gt;.txt") {
+		t.Errorf("Wrong page: %s", page)
+	}
+
+	// the thumbnail of a changed file is made again, the old one removed
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(photos, "Trip", "beach.png"), later, later)
+	if result, err := run(func(done, total int64) {}); err != nil || !strings.Contains(result, "1 thumbnails made, 1 removed") {
+		t.Errorf("Wrong second export: %q %v", result, err)
+	}
+	if fis, _ := ioutil.ReadDir(filepath.Join(dir, "site", EXPORT_THUMBNAILS)); len(fis) != 1 {
+		t.Errorf("%d thumbnails left", len(fis))
+	}
+
+	config.Export.Dir = filepath.Join(photos, "site")
+	if _, err := run(func(done, total int64) {}); err != errExportDir {
+		t.Errorf("Exported into the share: %v", err)
+	}
+	config.Export.Share = "Nope"
+	if _, err := run(func(done, total int64) {}); err != errShareNotFound {
+		t.Errorf("Exported an unknown share: %v", err)
+	}
+}
@@ -0,0 +1,621 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amahi/go-metadata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexEntry is what the index knows about one file or directory in a share.
+// added is when it was put in the share, as far as the file system knows
+type indexEntry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Mtime    time.Time `json:"mtime"`
+	Added    time.Time `json:"added"`
+	MimeType string    `json:"mime_type"`
+	IsDir    bool      `json:"is_dir"`
+	Deleted  bool      `json:"deleted,omitempty"`
+	// when it was deleted, for the tombstones
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// position in the journal of the share, 0 for what the first scan found
+	Seq uint64 `json:"seq"`
+}
+
+// deleted entries are remembered, so that sync clients learn about them,
+// up to this many per share, for config.Sync.TombstoneRetention. they are
+// kept on disk too, so that they are not lost with a restart
+const MAX_TOMBSTONES = 10000
+const TOMBSTONES_DIR = DATA_DIR + "/tombstones"
+const TOMBSTONES_JOB = "tombstones"
+
+type shareIndex struct {
+	// entries by path relative to the share root, starting with "/"
+	entries map[string]*indexEntry
+	scanned time.Time
+	// the journal: every change gets the next seq. tombstones are the
+	// deleted entries; changes before min_seq are no longer all known
+	seq        uint64
+	min_seq    uint64
+	tombstones map[string]*indexEntry
+	// the bytes of the files, kept up to date with the entries
+	used int64
+}
+
+// hdaIndex keeps an in-memory index of the contents of every share,
+// refreshed by the share scan jobs and kept up to date by the watcher
+type hdaIndex struct {
+	shares map[string]*shareIndex
+	// changes with every start, as the index is rebuilt from scratch
+	generation string
+	// where the tombstones are kept, "" for nowhere, and the shares whose
+	// tombstones changed since
+	dir   string
+	dirty map[string]bool
+	sync.RWMutex
+}
+
+var share_index = new_hda_index()
+
+var errIndexNotReady = errors.New("share not indexed yet")
+
+func new_hda_index() *hdaIndex {
+	return &hdaIndex{
+		shares:     make(map[string]*shareIndex),
+		generation: strconv.FormatInt(time.Now().UnixNano(), 36),
+		dirty:      make(map[string]bool),
+	}
+}
+
+// tombstone_retention is how long deleted entries are remembered
+func tombstone_retention() time.Duration {
+	d, err := time.ParseDuration(config.Sync.TombstoneRetention)
+	if err != nil || d <= 0 {
+		return 2160 * time.Hour
+	}
+	return d
+}
+
+// keep_tombstones keeps the tombstones of the shares in dir
+func (this *hdaIndex) keep_tombstones(dir string) {
+	this.Lock()
+	this.dir = dir
+	this.Unlock()
+}
+
+func (this *hdaIndex) tombstones_file(name string) string {
+	return filepath.Join(this.dir, sha1string(name)+".json")
+}
+
+// stored_tombstones reads the tombstones of a share kept before a restart
+func (this *hdaIndex) stored_tombstones(name string) []*indexEntry {
+	this.RLock()
+	dir := this.dir
+	this.RUnlock()
+	if dir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(this.tombstones_file(name))
+	if err != nil {
+		return nil
+	}
+	var tombstones []*indexEntry
+	if err := json.Unmarshal(data, &tombstones); err != nil {
+		debug(2, "Error reading the tombstones of %s: %s", name, err.Error())
+		return nil
+	}
+	return tombstones
+}
+
+// save_tombstones writes the tombstones of the shares that changed
+func (this *hdaIndex) save_tombstones() (int, error) {
+	this.Lock()
+	if this.dir == "" {
+		this.Unlock()
+		return 0, nil
+	}
+	files := make(map[string][]byte)
+	count := 0
+	for name := range this.dirty {
+		si := this.shares[name]
+		if si == nil {
+			continue
+		}
+		list := make([]*indexEntry, 0, len(si.tombstones))
+		for _, tombstone := range si.tombstones {
+			list = append(list, tombstone)
+		}
+		sort.Slice(list, func(a, b int) bool { return list[a].Path < list[b].Path })
+		data, err := json.Marshal(list)
+		if err != nil {
+			continue
+		}
+		files[this.tombstones_file(name)] = data
+		count += len(list)
+	}
+	this.dirty = make(map[string]bool)
+	this.Unlock()
+	var last_err error
+	for file, data := range files {
+		if err := write_file_atomic(file, data, 0644); err != nil {
+			last_err = err
+		}
+	}
+	return count, last_err
+}
+
+// tombstones_job forgets the tombstones past their retention, and keeps
+// the others on disk
+func (this *hdaIndex) tombstones_job() jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		this.Lock()
+		for name, si := range this.shares {
+			if si.prune() {
+				this.dirty[name] = true
+			}
+		}
+		shares := len(this.dirty)
+		this.Unlock()
+		count, err := this.save_tombstones()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d tombstones saved for %d shares", count, shares), nil
+	}
+}
+
+// scan walks the share and replaces its index, returning the number
+// of entries added, changed and removed since the previous scan.
+// the directories in skip (nested shares) are left out. if there was a
+// previous scan, every difference is also passed to changes, if not nil
+func (this *hdaIndex) scan(name, root string, skip []string, progress func(done, total int64), changes func(event fileEvent)) (added, changed, removed int, err error) {
+	// the watcher may change the index while the share is walked
+	this.RLock()
+	old := this.shares[name]
+	var old_entries map[string]*indexEntry
+	if old != nil {
+		old_entries = make(map[string]*indexEntry, len(old.entries))
+		for path, entry := range old.entries {
+			old_entries[path] = entry
+		}
+	}
+	this.RUnlock()
+	// the deletions from before a restart are still known
+	var stored []*indexEntry
+	if old == nil {
+		stored = this.stored_tombstones(name)
+	}
+	old_total := int64(len(old_entries))
+	// added and changed entries, which get new sequence numbers
+	fresh := []*indexEntry{}
+
+	entries := make(map[string]*indexEntry, len(old_entries))
+	var done int64
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// unreadable parts of the share are skipped, not fatal
+			debug(3, "index: skipping %s: %s", path, err.Error())
+			if fi != nil && fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path == root {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			for _, nested := range skip {
+				if path == nested {
+					return filepath.SkipDir
+				}
+			}
+		}
+		// archived files are indexed as they were
+		fi = stub_info(fi, filepath.Dir(path))
+		entry := &indexEntry{
+			Path:  strings.TrimPrefix(path, root),
+			Mtime: fi.ModTime(),
+			IsDir: fi.IsDir(),
+			Added: change_time(fi),
+		}
+		if entry.IsDir {
+			entry.MimeType = "text/directory"
+		} else {
+			entry.MimeType = getContentType(fi.Name())
+			entry.Size = fi.Size()
+		}
+		entries[entry.Path] = entry
+
+		prev, ok := old_entries[entry.Path]
+		if ok {
+			entry.Seq = prev.Seq
+		}
+		if !ok {
+			added++
+			if old != nil {
+				fresh = append(fresh, entry)
+			}
+			if old != nil && changes != nil {
+				changes(fileEvent{Share: name, Path: entry.Path, Op: "create", IsDir: entry.IsDir, Time: time.Now()})
+			}
+		} else if !prev.Mtime.Equal(entry.Mtime) || prev.Size != entry.Size {
+			changed++
+			fresh = append(fresh, entry)
+			if changes != nil {
+				changes(fileEvent{Share: name, Path: entry.Path, Op: "modify", IsDir: entry.IsDir, Time: time.Now()})
+			}
+		}
+		done++
+		if progress != nil && done%1000 == 0 {
+			progress(done, old_total)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	gone := []*indexEntry{}
+	for path, entry := range old_entries {
+		if _, ok := entries[path]; !ok {
+			removed++
+			gone = append(gone, entry)
+			if changes != nil {
+				changes(fileEvent{Share: name, Path: path, Op: "delete", IsDir: entry.IsDir, Time: time.Now()})
+			}
+		}
+	}
+
+	var used int64
+	for _, entry := range entries {
+		used += entry.Size
+	}
+
+	this.Lock()
+	si := &shareIndex{entries: entries, scanned: time.Now(), tombstones: make(map[string]*indexEntry), used: used}
+	if cur := this.shares[name]; cur != nil {
+		si.seq, si.min_seq, si.tombstones = cur.seq, cur.min_seq, cur.tombstones
+		// keep what the watcher changed during the walk in the journal
+		for path, entry := range entries {
+			if c := cur.entries[path]; c != nil && c.Seq > entry.Seq {
+				entry.Seq = c.Seq
+			}
+		}
+	}
+	for _, tombstone := range stored {
+		// from another generation, so they are part of the first listing
+		if _, ok := entries[tombstone.Path]; !ok && tombstone.DeletedAt != nil {
+			tombstone.Seq = 0
+			si.tombstones[tombstone.Path] = tombstone
+		}
+	}
+	for _, entry := range fresh {
+		si.seq++
+		entry.Seq = si.seq
+		delete(si.tombstones, entry.Path)
+	}
+	for _, entry := range gone {
+		si.bury(entry)
+	}
+	si.prune()
+	if len(fresh) > 0 || len(gone) > 0 || len(stored) > 0 {
+		this.dirty[name] = true
+	}
+	this.shares[name] = si
+	this.Unlock()
+	return added, changed, removed, nil
+}
+
+// bury records that an entry was deleted
+func (this *shareIndex) bury(entry *indexEntry) {
+	this.seq++
+	now := time.Now()
+	tombstone := *entry
+	tombstone.Deleted = true
+	tombstone.DeletedAt = &now
+	tombstone.Seq = this.seq
+	this.tombstones[entry.Path] = &tombstone
+}
+
+// prune forgets the tombstones past their retention, and the oldest ones
+// if there are too many. it says if it forgot any
+func (this *shareIndex) prune() bool {
+	before := time.Now().Add(-tombstone_retention())
+	pruned := false
+	for path, tombstone := range this.tombstones {
+		if tombstone.DeletedAt == nil || tombstone.DeletedAt.Before(before) {
+			delete(this.tombstones, path)
+			if tombstone.Seq > this.min_seq {
+				this.min_seq = tombstone.Seq
+			}
+			pruned = true
+		}
+	}
+	if len(this.tombstones) <= MAX_TOMBSTONES {
+		return pruned
+	}
+	all := make([]*indexEntry, 0, len(this.tombstones))
+	for _, tombstone := range this.tombstones {
+		all = append(all, tombstone)
+	}
+	sort.Slice(all, func(a, b int) bool { return all[a].Seq < all[b].Seq })
+	for _, tombstone := range all[:len(all)-MAX_TOMBSTONES] {
+		delete(this.tombstones, tombstone.Path)
+		if tombstone.Seq > this.min_seq {
+			this.min_seq = tombstone.Seq
+		}
+	}
+	return true
+}
+
+// apply updates the index of a share with a change seen by the watcher
+func (this *hdaIndex) apply(share *HdaShare, event fileEvent) {
+	var entry *indexEntry
+	if event.Op == "create" || event.Op == "modify" {
+		fi, err := os.Stat(share.path + event.Path)
+		if err != nil {
+			return
+		}
+		entry = &indexEntry{Path: event.Path, Mtime: fi.ModTime(), IsDir: fi.IsDir(), Added: change_time(fi)}
+		if entry.IsDir {
+			entry.MimeType = "text/directory"
+		} else {
+			entry.MimeType = getContentType(fi.Name())
+			entry.Size = fi.Size()
+		}
+	}
+
+	this.Lock()
+	defer this.Unlock()
+	si := this.shares[share.name]
+	if si == nil {
+		// not scanned yet, the first scan will pick it up
+		return
+	}
+	if entry != nil {
+		si.seq++
+		entry.Seq = si.seq
+		if old := si.entries[entry.Path]; old != nil {
+			si.used -= old.Size
+		}
+		si.used += entry.Size
+		si.entries[entry.Path] = entry
+		if _, ok := si.tombstones[entry.Path]; ok {
+			delete(si.tombstones, entry.Path)
+			this.dirty[share.name] = true
+		}
+		return
+	}
+	// deleted or renamed away, with everything under it
+	for path, old := range si.entries {
+		if path == event.Path || strings.HasPrefix(path, event.Path+"/") {
+			delete(si.entries, path)
+			si.used -= old.Size
+			si.bury(old)
+			this.dirty[share.name] = true
+		}
+	}
+	si.prune()
+}
+
+// changes returns the entries of a share that changed after cursor, as
+// returned by a previous call, including the deleted ones. when the cursor
+// is empty or too old, all the entries are returned and full is set, with
+// the tombstones still known, so that clients away for a while remove their
+// copies of what was deleted instead of uploading them again
+func (this *hdaIndex) changes(name, cursor string) (entries []indexEntry, next string, full bool, err error) {
+	this.RLock()
+	defer this.RUnlock()
+	si := this.shares[name]
+	if si == nil {
+		return nil, "", false, errIndexNotReady
+	}
+	next = this.generation + "-" + strconv.FormatUint(si.seq, 10)
+
+	var since uint64
+	full = true
+	if parts := strings.SplitN(cursor, "-", 2); len(parts) == 2 && parts[0] == this.generation {
+		since, err = strconv.ParseUint(parts[1], 10, 64)
+		full = err != nil || since < si.min_seq || since > si.seq
+		err = nil
+	}
+
+	if full {
+		entries = make([]indexEntry, 0, len(si.entries)+len(si.tombstones))
+		for _, entry := range si.entries {
+			entries = append(entries, *entry)
+		}
+		for _, tombstone := range si.tombstones {
+			entries = append(entries, *tombstone)
+		}
+		sort.Slice(entries, func(a, b int) bool { return entries[a].Path < entries[b].Path })
+		return entries, next, true, nil
+	}
+	entries = []indexEntry{}
+	for _, entry := range si.entries {
+		if entry.Seq > since {
+			entries = append(entries, *entry)
+		}
+	}
+	for _, tombstone := range si.tombstones {
+		if tombstone.Seq > since {
+			entries = append(entries, *tombstone)
+		}
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Seq < entries[b].Seq })
+	return entries, next, false, nil
+}
+
+// forget drops the index of a share that no longer exists
+func (this *hdaIndex) forget(name string) {
+	this.Lock()
+	delete(this.shares, name)
+	this.Unlock()
+}
+
+// stats returns the number of entries and the time of the last scan of a share
+func (this *hdaIndex) stats(name string) (count int, scanned time.Time) {
+	this.RLock()
+	defer this.RUnlock()
+	si := this.shares[name]
+	if si == nil {
+		return 0, time.Time{}
+	}
+	return len(si.entries), si.scanned
+}
+
+// usage returns the bytes of the files of a share and the time of its last
+// scan, without walking it
+func (this *hdaIndex) usage(name string) (used int64, scanned time.Time, err error) {
+	this.RLock()
+	defer this.RUnlock()
+	si := this.shares[name]
+	if si == nil {
+		return 0, time.Time{}, errIndexNotReady
+	}
+	return si.used, si.scanned, nil
+}
+
+// is_dir says if path is a directory of a share, and if the index knows
+func (this *hdaIndex) is_dir(name, path string) (is_dir, known bool) {
+	this.RLock()
+	defer this.RUnlock()
+	si := this.shares[name]
+	if si == nil {
+		return false, false
+	}
+	entry := si.entries[strings.TrimSuffix(path, "/")]
+	if entry == nil || entry.Deleted {
+		return false, false
+	}
+	return entry.IsDir, true
+}
+
+// search returns copies of the entries of a share that match
+func (this *hdaIndex) search(name string, match func(entry *indexEntry) bool) ([]indexEntry, error) {
+	this.RLock()
+	defer this.RUnlock()
+	si := this.shares[name]
+	if si == nil {
+		return nil, errIndexNotReady
+	}
+	entries := []indexEntry{}
+	for _, entry := range si.entries {
+		if match(entry) {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+// scan_interval returns how often a share should be scanned, by share name
+// first and then by its tags, e.g. hourly for media and weekly for backups
+func scan_interval(share *HdaShare) time.Duration {
+	interval := config.Scan.Shares[share.name]
+	if interval == "" {
+		for _, tag := range share.tags_list() {
+			if i, ok := config.Scan.Tags[strings.ToLower(tag)]; ok {
+				interval = i
+				break
+			}
+		}
+	}
+	if interval == "" {
+		interval = config.Scan.Default
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		log_warn("Invalid scan interval %q for share %s", interval, share.name)
+		d = 24 * time.Hour
+	}
+	// without a watcher, changes are only seen by scanning
+	if share_watcher.is_degraded(share) {
+		if fallback, err := time.ParseDuration(config.Scan.Fallback); err == nil && fallback < d {
+			d = fallback
+		}
+	}
+	return d
+}
+
+func scan_job_name(share string) string {
+	return "scan:" + share
+}
+
+// scan_share_job re-indexes a share and refreshes its metadata
+func scan_share_job(shares *HdaShares, share *HdaShare, library *metadata.Library) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		// all the files of a disk not mounted would be taken for deleted
+		if share_offline(share) {
+			return "", errShareOffline
+		}
+		// changes missed by the watcher are found by the scan
+		var changes func(event fileEvent)
+		if share_watcher.is_degraded(share) {
+			changes = events.publish
+		}
+		added, changed, removed, err := share_index.scan(share.name, share.path, shares.nested_paths(share.name), progress, changes)
+		if err != nil {
+			return "", err
+		}
+		// the metadata of new videos is looked up in the background
+		if library != nil && share.metadata_hint() != "" && (added > 0 || changed > 0) {
+			scheduler.trigger(METADATA_PREFETCH_JOB)
+		}
+		// and the music and photo libraries pick up the files that changed
+		if added > 0 || changed > 0 || removed > 0 {
+			if share.is_music() {
+				scheduler.trigger(MUSIC_LIBRARY_JOB)
+			}
+			if share.is_photos() {
+				scheduler.trigger(PHOTO_LIBRARY_JOB)
+			}
+		}
+		count, _ := share_index.stats(share.name)
+		return fmt.Sprintf("%d entries, %d added, %d changed, %d removed", count, added, changed, removed), nil
+	}
+}
+
+// sync_scan_jobs keeps one scan job per share, as shares come and go
+func sync_scan_jobs(shares *HdaShares, library *metadata.Library) {
+	shares.update_shares()
+	shares.RLock()
+	current := make(map[string]bool)
+	for i, share := range shares.Shares {
+		name := scan_job_name(share.name)
+		current[name] = true
+		// stagger the first scans a bit after startup
+		delay := 30*time.Second + time.Duration(i)*10*time.Second
+		scheduler.add(name, scan_interval(share), delay, scan_share_job(shares, share, library))
+	}
+	shares.RUnlock()
+
+	for _, j := range scheduler.status() {
+		if strings.HasPrefix(j.Name, "scan:") && !current[j.Name] {
+			scheduler.remove(j.Name)
+			share_index.forget(strings.TrimPrefix(j.Name, "scan:"))
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndexScanAndApply(t *testing.T) {
+	err := os.MkdirAll("test/share/dir", 0777)
+	if err != nil {
+		t.Fatalf("Mkdir failed: %s", err.Error())
+	}
+	defer os.RemoveAll("test")
+	root, _ := filepath.Abs("test/share")
+	ioutil.WriteFile(root+"/dir/a.txt", []byte("a"), 0644)
+
+	index := new_hda_index()
+	added, _, _, err := index.scan("share", root, nil, nil, nil)
+	if err != nil || added != 2 {
+		t.Fatalf("First scan: %d added, %v", added, err)
+	}
+
+	// later scans report what changed
+	ioutil.WriteFile(root+"/b.txt", []byte("b"), 0644)
+	os.Remove(root + "/dir/a.txt")
+	changes := map[string]string{}
+	index.scan("share", root, nil, nil, func(event fileEvent) { changes[event.Path] = event.Op })
+	if changes["/b.txt"] != "create" || changes["/dir/a.txt"] != "delete" {
+		t.Errorf("Unexpected changes: %v", changes)
+	}
+
+	// changes from the watcher
+	share := &HdaShare{name: "share", path: root}
+	ioutil.WriteFile(root+"/dir/c.txt", []byte("c"), 0644)
+	index.apply(share, fileEvent{Share: "share", Path: "/dir/c.txt", Op: "create"})
+	if count, _ := index.stats("share"); count != 3 {
+		t.Errorf("Expected 3 entries after a create, got %d", count)
+	}
+	index.apply(share, fileEvent{Share: "share", Path: "/dir", Op: "delete"})
+	if count, _ := index.stats("share"); count != 1 {
+		t.Errorf("Expected 1 entry after deleting a directory, got %d", count)
+	}
+}
+
+func TestIndexChanges(t *testing.T) {
+	err := os.MkdirAll("test/share", 0777)
+	if err != nil {
+		t.Fatalf("Mkdir failed: %s", err.Error())
+	}
+	defer os.RemoveAll("test")
+	root, _ := filepath.Abs("test/share")
+	ioutil.WriteFile(root+"/a.txt", []byte("a"), 0644)
+
+	index := new_hda_index()
+	if _, _, _, err := index.changes("share", ""); err != errIndexNotReady {
+		t.Errorf("Expected errIndexNotReady, got %v", err)
+	}
+	index.scan("share", root, nil, nil, nil)
+	entries, cursor, full, _ := index.changes("share", "")
+	if !full || len(entries) != 1 {
+		t.Fatalf("Expected a full listing, got %v %v", full, entries)
+	}
+
+	share := &HdaShare{name: "share", path: root}
+	ioutil.WriteFile(root+"/b.txt", []byte("b"), 0644)
+	index.apply(share, fileEvent{Path: "/b.txt", Op: "create"})
+	index.apply(share, fileEvent{Path: "/a.txt", Op: "delete"})
+	entries, next, full, _ := index.changes("share", cursor)
+	if full || len(entries) != 2 || entries[0].Path != "/b.txt" || !entries[1].Deleted {
+		t.Fatalf("Unexpected changes: %v %v", full, entries)
+	}
+	if entries, _, _, _ := index.changes("share", next); len(entries) != 0 {
+		t.Errorf("Expected no changes, got %v", entries)
+	}
+
+	// cursors from another run of the server start over
+	restarted := new_hda_index()
+	restarted.generation = "other"
+	restarted.scan("share", root, nil, nil, nil)
+	if _, _, full, _ := restarted.changes("share", next); !full {
+		t.Errorf("Expected a full listing with a cursor from another run")
+	}
+}
+
+func TestIndexTombstones(t *testing.T) {
+	saved := config.Sync
+	defer func() { config.Sync = saved }()
+
+	dir, _ := ioutil.TempDir("", "tombstones")
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "share")
+	os.MkdirAll(root, 0755)
+	for _, name := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+		ioutil.WriteFile(root+name, []byte(name), 0644)
+	}
+	index := new_hda_index()
+	index.keep_tombstones(filepath.Join(dir, "tombstones"))
+	index.scan("share", root, nil, nil, nil)
+	share := &HdaShare{name: "share", path: root}
+	os.Remove(root + "/a.txt")
+	index.apply(share, fileEvent{Path: "/a.txt", Op: "delete"})
+	if result, err := index.tombstones_job()(func(done, total int64) {}); err != nil || result != "1 tombstones saved for 1 shares" {
+		t.Fatalf("Wrong save: %s %v", result, err)
+	}
+	// the client that was away learns about it after a restart
+	restarted := new_hda_index()
+	restarted.keep_tombstones(filepath.Join(dir, "tombstones"))
+	restarted.scan("share", root, nil, nil, nil)
+	entries, _, full, _ := restarted.changes("share", "old-cursor")
+	deleted := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Deleted && entry.DeletedAt != nil {
+			deleted[entry.Path] = true
+		}
+	}
+	if !full || len(entries) != 3 || !deleted["/a.txt"] {
+		t.Errorf("Wrong full listing after a restart: %v %+v", full, entries)
+	}
+	os.Remove(root + "/b.txt")
+	restarted.scan("share", root, nil, nil, nil)
+	entries, _, _, _ = restarted.changes("share", "")
+	if len(entries) != 3 {
+		t.Errorf("Wrong tombstones after a scan: %+v", entries)
+	}
+
+	// the same path again is not deleted any more
+	ioutil.WriteFile(root+"/a.txt", []byte("again"), 0644)
+	restarted.apply(share, fileEvent{Path: "/a.txt", Op: "create"})
+	entries, _, _, _ = restarted.changes("share", "")
+	for _, entry := range entries {
+		if entry.Path == "/a.txt" && entry.Deleted {
+			t.Errorf("Tombstone of a file that is back")
+		}
+	}
+
+	// and they are forgotten after the retention
+	config.Sync.TombstoneRetention = "1ns"
+	time.Sleep(time.Millisecond)
+	restarted.tombstones_job()(func(done, total int64) {})
+	if entries, _, _, _ = restarted.changes("share", ""); len(entries) != 2 || entries[0].Deleted || entries[1].Deleted {
+		t.Errorf("Tombstones were kept past their retention: %+v", entries)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// a share on a disk that is not mounted, like a USB drive unplugged, is an
+// empty directory of the system disk, and the apps would show it as empty
+// and put their uploads on the wrong disk. the shares under a mount point
+// of /etc/fstab, or one seen mounted since the start, are offline when it
+// is not mounted: they are listed with the status "offline" in /shares,
+// their requests get a 503, nothing is written to them, and they are not
+// scanned, which would take all their files for deleted. an "offline" or
+// "online" event is sent when it changes. the mounts are read from
+// /proc/mounts, or found by the device of the mount point elsewhere
+
+const SHARE_NOT_MOUNTED = "disk not mounted"
+const SHARE_MOUNTS_JOB = "share-mounts"
+
+// the mounts are read again after MOUNTS_TTL
+const MOUNTS_TTL = 2 * time.Second
+
+var errShareOffline = errors.New("the disk of the share is not mounted")
+
+type shareMounts struct {
+	// the mounts of the system, replaced in tests
+	mounts string
+	// the mount points that the shares under them need, and those mounted
+	expected map[string]bool
+	mounted  map[string]bool
+	read     time.Time
+	sync.Mutex
+}
+
+var share_mounts = new_share_mounts("/etc/fstab", "/proc/mounts")
+
+func new_share_mounts(fstab, mounts string) *shareMounts {
+	this := &shareMounts{mounts: mounts, expected: make(map[string]bool)}
+	for _, point := range mount_points(fstab) {
+		this.expected[point] = true
+	}
+	return this
+}
+
+// unescape_mount is a field of fstab or /proc/mounts, with the \040 of
+// the spaces and such turned back to them
+func unescape_mount(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var result strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				result.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		result.WriteByte(field[i])
+	}
+	return result.String()
+}
+
+// mount_points are the mount points in a file like fstab, but the root
+// and the swap
+func mount_points(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	points := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		point := filepath.Clean(unescape_mount(fields[1]))
+		if point == "/" || !filepath.IsAbs(point) || len(fields) > 2 && fields[2] == "swap" {
+			continue
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// load reads the mounts when they are older than MOUNTS_TTL. the ones
+// mounted are expected from then on. call with the lock held
+func (this *shareMounts) load() {
+	if time.Since(this.read) < MOUNTS_TTL {
+		return
+	}
+	this.read = time.Now()
+	if _, err := os.Stat(this.mounts); err != nil {
+		this.mounted = nil
+		return
+	}
+	this.mounted = make(map[string]bool)
+	for _, point := range mount_points(this.mounts) {
+		this.mounted[point] = true
+		this.expected[point] = true
+	}
+}
+
+// is_mounted says if something is mounted on point, by its device when
+// the mounts are not known
+func (this *shareMounts) is_mounted(point string) bool {
+	if this.mounted != nil {
+		return this.mounted[point]
+	}
+	fi, err := os.Stat(point)
+	if err != nil {
+		return false
+	}
+	parent, err := os.Stat(filepath.Dir(point))
+	if err != nil {
+		return false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	parent_stat, parent_ok := parent.Sys().(*syscall.Stat_t)
+	return !ok || !parent_ok || stat.Dev != parent_stat.Dev
+}
+
+// mount_point is the mount point that path needs, the deepest one, or ""
+func (this *shareMounts) mount_point(path string) string {
+	path = filepath.Clean(path)
+	found := ""
+	for point := range this.expected {
+		if (path == point || path_inside(path, point)) && len(point) > len(found) {
+			found = point
+		}
+	}
+	return found
+}
+
+// offline says if the disk that path needs is not mounted
+func (this *shareMounts) offline(path string) bool {
+	if path == "" {
+		return false
+	}
+	this.Lock()
+	defer this.Unlock()
+	this.load()
+	point := this.mount_point(path)
+	return point != "" && !this.is_mounted(point)
+}
+
+// share_offline says if share is a local share whose disk is not mounted
+func share_offline(share *HdaShare) bool {
+	return share != nil && !share.network && share_mounts.offline(share.path)
+}
+
+// mounts_changed says if a share went offline or came back since the
+// shares were read
+func mounts_changed(shares *HdaShares) bool {
+	shares.RLock()
+	list := make([]HdaShare, 0, len(shares.Shares))
+	for _, share := range shares.Shares {
+		list = append(list, HdaShare{name: share.name, path: share.path, problem: share.problem, network: share.network})
+	}
+	shares.RUnlock()
+	for i := range list {
+		if !list[i].network && share_offline(&list[i]) != (list[i].problem == SHARE_NOT_MOUNTED) {
+			return true
+		}
+	}
+	return false
+}
+
+// job reads the shares again when a disk was mounted or unmounted
+func (this *shareMounts) job(shares *HdaShares) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		if !mounts_changed(shares) {
+			return "no changes", nil
+		}
+		shares.update_shares()
+		return fmt.Sprintf("%d shares offline", len(offline_shares(shares))), nil
+	}
+}
+
+// offline_shares are the names of the shares whose disk is not mounted
+func offline_shares(shares *HdaShares) []string {
+	shares.RLock()
+	defer shares.RUnlock()
+	names := []string{}
+	for _, share := range shares.Shares {
+		if share.problem == SHARE_NOT_MOUNTED {
+			names = append(names, share.name)
+		}
+	}
+	return names
+}
+
+// share_mount_access is a middleware answering the requests for the files
+// of an offline share, rather than listing an empty directory or writing
+// to the wrong disk
+func (service *MercuryFsService) share_mount_access(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		name := request.URL.Query().Get("s")
+		if name == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		service.Shares.RLock()
+		share := find_share(service.Shares.Shares, name)
+		var found HdaShare
+		if share != nil {
+			found = HdaShare{name: share.name, path: share.path, problem: share.problem, network: share.network}
+		}
+		service.Shares.RUnlock()
+		if share == nil || !share_offline(&found) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		// the shares are listed offline from now on, with the event
+		if found.problem != SHARE_NOT_MOUNTED {
+			service.Shares.update_shares()
+		}
+		size := json_response(writer, http.StatusServiceUnavailable, map[string]string{"error": "share offline", "problem": SHARE_NOT_MOUNTED})
+		service.debug_info.requestServed(size)
+		log("\"%s %s\" 503 %d \"%s\"", request.Method, pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+	})
+}
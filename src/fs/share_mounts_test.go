@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareMounts(t *testing.T) {
+	saved_config, saved_mounts := config, share_mounts
+	defer func() { config, share_mounts = saved_config, saved_mounts }()
+	config = default_config()
+	dir, _ := ioutil.TempDir("", "mounts")
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "shares")
+	os.MkdirAll(filepath.Join(root, "USB Disk"), 0755)
+	os.MkdirAll(filepath.Join(root, "Docs"), 0755)
+	usb := filepath.Join(root, "USB Disk")
+	fstab, mounts := filepath.Join(dir, "fstab"), filepath.Join(dir, "mounts")
+	ch := events.subscribe("USB Disk", "")
+	defer events.unsubscribe(ch)
+	escaped := strings.Replace(usb, " ", `\040`, -1)
+	ioutil.WriteFile(fstab, []byte("# the disks\nUUID=1 / ext4 defaults 0 1\nUUID=2 none swap sw 0 0\nUUID=3 "+escaped+" ext4 nofail 0 2\n"), 0644)
+	next_event := func() string {
+		for {
+			select {
+			case event := <-ch:
+				if event.Op != "shares" && event.Share == "USB Disk" {
+					return event.Op
+				}
+			case <-time.After(5 * time.Second):
+				return ""
+			}
+		}
+	}
+	mount := func(mounted bool) {
+		table := "/dev/sda1 / ext4 rw 0 0\n"
+		if mounted {
+			table += "/dev/sdb1 " + escaped + " ext4 rw 0 0\n"
+		}
+		ioutil.WriteFile(mounts, []byte(table), 0644)
+		share_mounts.Lock()
+		share_mounts.read = time.Time{}
+		share_mounts.Unlock()
+	}
+	share_mounts = new_share_mounts(fstab, mounts)
+	if points := mount_points(fstab); len(points) != 1 || points[0] != usb {
+		t.Fatalf("Wrong mount points: %q", points)
+	}
+
+	mount(true)
+	shares, err := NewHdaShares(root)
+	if err != nil {
+		t.Fatalf("NewHdaShares failed: %s", err)
+	}
+	if entry := shares.Get("USB Disk").entry(); entry.Status != "ok" || mounts_changed(shares) {
+		t.Errorf("Offline while mounted: %+v", entry)
+	}
+
+	// the disk is unplugged
+	mount(false)
+	if !mounts_changed(shares) {
+		t.Fatalf("The unmounted disk was not seen")
+	}
+	service := &MercuryFsService{Shares: shares, debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.Use(service.share_mount_access)
+	ok := func(writer http.ResponseWriter, request *http.Request) { writer.WriteHeader(http.StatusOK) }
+	router.HandleFunc("/files", ok).Methods("GET", "POST")
+	for target, status := range map[string]int{"/files?s=USB+Disk&p=/": 503, "/files?s=Docs&p=/": 200} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("POST", target, nil))
+		if recorder.Code != status {
+			t.Errorf("%d instead of %d for %s", recorder.Code, status, target)
+		}
+	}
+	if op := next_event(); op != "offline" {
+		t.Errorf("No offline event: %q", op)
+	}
+	var listed []shareEntry
+	json.Unmarshal([]byte(shares.to_json()), &listed)
+	if listed[1].Name != "USB Disk" || listed[1].Status != "offline" || listed[1].Problem != SHARE_NOT_MOUNTED {
+		t.Errorf("Wrong listing: %+v", listed)
+	}
+	if !shares.read_only(filepath.Join(usb, "a.txt")) || shares.read_only(filepath.Join(root, "Docs", "a.txt")) {
+		t.Errorf("Writes to the wrong disk allowed")
+	}
+	if _, err := scan_share_job(shares, shares.Get("USB Disk"), nil)(func(done, total int64) {}); err != errShareOffline {
+		t.Errorf("Offline share scanned: %v", err)
+	}
+
+	// and plugged back
+	mount(true)
+	if _, err := share_mounts.job(shares)(func(done, total int64) {}); err != nil || shares.Get("USB Disk").problem != "" {
+		t.Errorf("Still offline: %v", err)
+	}
+	if op := next_event(); op != "online" {
+		t.Errorf("No online event: %q", op)
+	}
+}
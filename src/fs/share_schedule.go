@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// shares can be made available only at some hours, say a backups share at
+// night for the backup client, with config.Availability. windows are
+// "HH:MM-HH:MM" in local time, going past midnight when the end is before
+// the start, separated by commas. outside of them, the share is listed as
+// closed and cannot be used over any protocol. a schedule that cannot be
+// read leaves the share available
+
+var errBadWindow = errors.New("windows must be like 22:00-06:00")
+
+// the clock of the schedules, for the tests
+var schedule_now = time.Now
+
+// timeWindow is from and to, in minutes since midnight
+type timeWindow struct {
+	from, to int
+}
+
+func parse_clock(s string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes); err != nil || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || (hours == 24 && minutes > 0) {
+		return 0, errBadWindow
+	}
+	return hours*60 + minutes, nil
+}
+
+func parse_windows(spec string) ([]timeWindow, error) {
+	windows := []timeWindow{}
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.Split(strings.TrimSpace(part), "-")
+		if len(bounds) != 2 {
+			return nil, errBadWindow
+		}
+		from, err := parse_clock(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, err
+		}
+		to, err := parse_clock(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, timeWindow{from, to})
+	}
+	return windows, nil
+}
+
+func (this timeWindow) contains(minute int) bool {
+	if this.from <= this.to {
+		return minute >= this.from && minute < this.to
+	}
+	// past midnight
+	return minute >= this.from || minute < this.to
+}
+
+// share_hours is the schedule of a share, "" if it has none
+func share_hours(name string) string {
+	return config.Availability.Shares[name]
+}
+
+// share_open says if share name can be used at now
+func share_open(name string, now time.Time) bool {
+	spec := share_hours(name)
+	if spec == "" {
+		return true
+	}
+	windows, err := parse_windows(spec)
+	if err != nil {
+		debug(2, "Bad schedule %q of share %s: %s", spec, name, err.Error())
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range windows {
+		if window.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// closed_shares are the names of the shares closed now
+func closed_shares() []string {
+	now := schedule_now()
+	closed := []string{}
+	for name := range config.Availability.Shares {
+		if !share_open(name, now) {
+			closed = append(closed, name)
+		}
+	}
+	sort.Strings(closed)
+	return closed
+}
+
+// schedule_access is a middleware turning down the requests to a share
+// outside of its hours
+func (service *MercuryFsService) schedule_access(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		share := request.URL.Query().Get("s")
+		if share == "" || share_open(share, schedule_now()) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		size := json_response(writer, http.StatusForbidden, map[string]string{"error": "share not available now", "hours": share_hours(share)})
+		service.debug_info.requestServed(size)
+		log("\"%s %s\" 403 %d \"%s\"", request.Method, pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+	})
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareSchedule(t *testing.T) {
+	saved, saved_now := config.Availability, schedule_now
+	defer func() { config.Availability, schedule_now = saved, saved_now }()
+	config.Availability.Shares = map[string]string{"Backups": "22:00-06:00, 12:00-12:30", "Docs": "whenever"}
+	at := func(clock string) time.Time {
+		t, _ := time.ParseInLocation("15:04", clock, time.Local)
+		return t
+	}
+
+	for clock, open := range map[string]bool{"23:00": true, "00:10": true, "05:59": true, "06:00": false, "12:15": true, "18:00": false} {
+		if share_open("Backups", at(clock)) != open {
+			t.Errorf("Backups open at %s: %v", clock, !open)
+		}
+	}
+	if !share_open("Docs", at("03:00")) || !share_open("Movies", at("03:00")) {
+		t.Errorf("Shares without a good schedule closed")
+	}
+	for _, spec := range []string{"22:00", "25:00-01:00", "10:60-11:00"} {
+		if _, err := parse_windows(spec); err == nil {
+			t.Errorf("%q is a schedule", spec)
+		}
+	}
+
+	dir, _ := ioutil.TempDir("", "schedule")
+	defer os.RemoveAll(dir)
+	backups := filepath.Join(dir, "Backups")
+	os.MkdirAll(backups, 0755)
+	service := &MercuryFsService{
+		Shares:     &HdaShares{Shares: []*HdaShare{{name: "Backups", path: backups}}},
+		debug_info: new(debugInfo),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/shares", service.serve_shares).Methods("GET")
+	router.HandleFunc("/files", service.serve_file).Methods("GET")
+	router.Use(service.schedule_access)
+	request := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+
+	schedule_now = func() time.Time { return at("18:00") }
+	if response := request("/files?s=Backups&p=/"); response.Code != 403 || !strings.Contains(response.Body.String(), "22:00-06:00") {
+		t.Errorf("Closed share served: %d %s", response.Code, response.Body.String())
+	}
+	if body := request("/shares").Body.String(); !strings.Contains(body, `"status":"closed"`) {
+		t.Errorf("Not listed as closed: %s", body)
+	}
+	if _, _, err := (&sftpFS{service: service}).resolve("/Backups/disk.img"); !os.IsPermission(err) {
+		t.Errorf("Closed share over sftp: %v", err)
+	}
+
+	// the listing changes when it opens
+	schedule_now = func() time.Time { return at("23:00") }
+	if response := request("/files?s=Backups&p=/"); response.Code != 200 {
+		t.Errorf("%d for an open share", response.Code)
+	}
+	if body := request("/shares").Body.String(); !strings.Contains(body, `"status":"ok"`) {
+		t.Errorf("Not listed as open: %s", body)
+	}
+}
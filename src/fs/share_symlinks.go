@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the symlinks in a share are followed anywhere they point by default, as
+// they always were, which serves any file of the HDA that one of them
+// points to. with "share" they are only followed when they point inside
+// the share, or to the archive of cold storage, and with "never" they are
+// not followed at all. the symlinks not followed are left out of the
+// listings, and the files through them are not found. it is set for all
+// the shares with symlinks.default in the config, and by share name with
+// symlinks.shares
+
+const SYMLINKS_ANY = "any"
+const SYMLINKS_SHARE = "share"
+const SYMLINKS_NEVER = "never"
+
+var errSymlinkDenied = errors.New("symlink not followed")
+
+// check_symlinks_config checks the policies of the config
+func check_symlinks_config(c *symlinksConfig) error {
+	policies := map[string]string{"": c.Default}
+	for name, policy := range c.Shares {
+		policies[name] = policy
+	}
+	for name, policy := range policies {
+		switch policy {
+		case "", SYMLINKS_ANY, SYMLINKS_SHARE, SYMLINKS_NEVER:
+		default:
+			if name == "" {
+				return fmt.Errorf("invalid symlinks policy %q", policy)
+			}
+			return fmt.Errorf("invalid symlinks policy %q of share %s", policy, name)
+		}
+	}
+	return nil
+}
+
+// symlinks_policy is how the symlinks of a share are followed
+func symlinks_policy(share string) string {
+	if policy := config.Symlinks.Shares[share]; policy != "" {
+		return policy
+	}
+	if config.Symlinks.Default == "" {
+		return SYMLINKS_ANY
+	}
+	return config.Symlinks.Default
+}
+
+// symlink_allowed says if the symlink at link, in the share at root, is
+// followed with policy
+func symlink_allowed(link, root, policy string) bool {
+	switch policy {
+	case SYMLINKS_ANY:
+		return true
+	case SYMLINKS_SHARE:
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			// dangling, or a loop
+			return false
+		}
+		root = real_path(root)
+		if target == root || path_inside(target, root) {
+			return true
+		}
+		archive := config.Tiering.Archive
+		return archive != "" && path_inside(target, real_path(archive))
+	}
+	return false
+}
+
+// check_symlinks checks the symlinks on the way from the share at root to
+// full_path, up to the first that does not exist yet
+func check_symlinks(root, full_path, policy string) error {
+	if policy == SYMLINKS_ANY || !path_inside(full_path, root) {
+		return nil
+	}
+	p := strings.TrimSuffix(root, "/")
+	for _, name := range strings.Split(strings.TrimPrefix(full_path, p+"/"), "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		p += "/" + name
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink != 0 && !symlink_allowed(p, root, policy) {
+			return errSymlinkDenied
+		}
+	}
+	return nil
+}
+
+// symlinks_hidden adds to hidden the symlinks of the directory dir of a
+// share at root that are not followed
+func symlinks_hidden(hidden listingFilter, root, dir, policy string) listingFilter {
+	if policy == SYMLINKS_ANY {
+		return hidden
+	}
+	return func(name string) bool {
+		if hidden != nil && hidden(name) {
+			return true
+		}
+		link := filepath.Join(dir, name)
+		fi, err := os.Lstat(link)
+		return err == nil && fi.Mode()&os.ModeSymlink != 0 && !symlink_allowed(link, root, policy)
+	}
+}
+
+// symlinks_listed leaves out of fis, the entries of the directory dir, the
+// symlinks that the policy of its share does not follow, for the listings
+// of FTP, SFTP and gRPC
+func symlinks_listed(shares *HdaShares, dir string, fis []os.FileInfo) []os.FileInfo {
+	share, _ := shares.owner(dir)
+	if share == nil {
+		return fis
+	}
+	return symlinks_hidden(nil, share.Path(), dir, symlinks_policy(share.name)).visible(fis)
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/sftp"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestShareSymlinks(t *testing.T) {
+	saved_config := config
+	defer func() { config = saved_config }()
+	config = default_config()
+	dir, _ := ioutil.TempDir("", "symlinks")
+	defer os.RemoveAll(dir)
+	docs, secrets, archive := filepath.Join(dir, "Docs"), filepath.Join(dir, "secrets"), filepath.Join(dir, "archive")
+	config.Tiering.Archive = archive
+	for _, d := range []string{filepath.Join(docs, "Taxes"), secrets, archive} {
+		os.MkdirAll(d, 0755)
+	}
+	ioutil.WriteFile(filepath.Join(docs, "Taxes", "2018.pdf"), []byte("taxes"), 0644)
+	ioutil.WriteFile(filepath.Join(secrets, "passwords.txt"), []byte("secret"), 0644)
+	ioutil.WriteFile(filepath.Join(archive, "old.mkv"), []byte("video"), 0644)
+	os.Symlink("Taxes", filepath.Join(docs, "Latest"))
+	os.Symlink(secrets, filepath.Join(docs, "Outside"))
+	os.Symlink(filepath.Join(archive, "old.mkv"), filepath.Join(docs, "old.mkv"))
+	os.Symlink(filepath.Join(dir, "nowhere"), filepath.Join(docs, "Dangling"))
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Docs", path: docs}}}, debug_info: new(debugInfo)}
+	listing := func() string {
+		recorder := httptest.NewRecorder()
+		service.serve_file(recorder, httptest.NewRequest("GET", "/files?s=Docs&p=/", nil))
+		var entries []fileEntry
+		json.Unmarshal(recorder.Body.Bytes(), &entries)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	s3_listing := func(delimiter string) string {
+		keys := []string{}
+		for _, entry := range s3_list(docs, "", delimiter, symlinks_policy("Docs")) {
+			keys = append(keys, entry.key)
+		}
+		return strings.Join(keys, ",")
+	}
+	sftp_listing := func() string {
+		lister, err := (&sftpFS{service: service}).Filelist(sftp.NewRequest("List", "/Docs"))
+		if err != nil {
+			return err.Error()
+		}
+		fis := make([]os.FileInfo, 10)
+		n, _ := lister.ListAt(fis, 0)
+		names := []string{}
+		for _, fi := range fis[:n] {
+			names = append(names, fi.Name())
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	cases := []struct {
+		policy  string
+		allowed map[string]bool
+		listed  string
+		// the S3 listings of the top, and of everything
+		s3_top, s3_all string
+	}{
+		{SYMLINKS_ANY, map[string]bool{"/Latest/2018.pdf": true, "/Outside/passwords.txt": true, "/old.mkv": true}, "Dangling,Latest,Outside,Taxes,old.mkv",
+			"Dangling,Latest/,Outside/,Taxes/,old.mkv", "Dangling,Latest,Outside,Taxes/2018.pdf,old.mkv"},
+		{SYMLINKS_SHARE, map[string]bool{"/Latest/2018.pdf": true, "/Outside/passwords.txt": false, "/old.mkv": true}, "Latest,Taxes,old.mkv",
+			"Latest/,Taxes/,old.mkv", "Latest,Taxes/2018.pdf,old.mkv"},
+		{SYMLINKS_NEVER, map[string]bool{"/Latest/2018.pdf": false, "/Outside/passwords.txt": false, "/old.mkv": false}, "Taxes",
+			"Taxes/", "Taxes/2018.pdf"},
+	}
+	for _, c := range cases {
+		config.Symlinks.Shares = map[string]string{"Docs": c.policy}
+		for p, allowed := range c.allowed {
+			if _, err := service.fullPathToFile("Docs", p); (err == nil) != allowed {
+				t.Errorf("%s with %q: %v", p, c.policy, err)
+			}
+		}
+		if _, err := service.fullPathToFile("Docs", "/Taxes/new.pdf"); err != nil {
+			t.Errorf("New file refused with %q: %s", c.policy, err)
+		}
+		if names := listing(); names != c.listed {
+			t.Errorf("Listed with %q: %s", c.policy, names)
+		}
+		// and the same over the other protocols
+		if names := sftp_listing(); names != c.listed {
+			t.Errorf("Listed over SFTP with %q: %s", c.policy, names)
+		}
+		if keys := s3_listing("/"); keys != c.s3_top {
+			t.Errorf("Listed over S3 with %q: %s", c.policy, keys)
+		}
+		if keys := s3_listing(""); keys != c.s3_all {
+			t.Errorf("Listed all over S3 with %q: %s", c.policy, keys)
+		}
+	}
+
+	config.Symlinks.Default = "sometimes"
+	if err := check_symlinks_config(&config.Symlinks); err == nil {
+		t.Errorf("Invalid policy accepted")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// the tags of a share come from the settings DB, the shares of the config
+// file, or the name of the directory with -r, and share_tags in the config
+// adds more, by share, for the shares of the DB that cannot have tags. the
+// tags give a share its category in /shares, so that the apps show it
+// right away with the right browser: "movies", "music", "photos", "docs",
+// "backups", or "files" for the rest. the first tag with a category gives
+// it, in the order of the tags
+
+// the categories, and the tags that give them
+var share_categories = map[string]string{
+	"movie":     "movies",
+	"movies":    "movies",
+	"film":      "movies",
+	"films":     "movies",
+	"video":     "movies",
+	"videos":    "movies",
+	"tv":        "movies",
+	"music":     "music",
+	"audio":     "music",
+	"songs":     "music",
+	"photo":     "photos",
+	"photos":    "photos",
+	"pictures":  "photos",
+	"images":    "photos",
+	"doc":       "docs",
+	"docs":      "docs",
+	"documents": "docs",
+	"books":     "docs",
+	"backup":    "backups",
+	"backups":   "backups",
+	"archive":   "backups",
+	"archives":  "backups",
+}
+
+const SHARE_CATEGORY_FILES = "files"
+
+// category is what the share has, from its tags
+func (s *HdaShare) category() string {
+	for _, tag := range s.tags_list() {
+		if category, ok := share_categories[strings.ToLower(tag)]; ok {
+			return category
+		}
+	}
+	return SHARE_CATEGORY_FILES
+}
+
+// share_tags_key is the tags of share_tags, the same for the same tags
+func share_tags_key() string {
+	if len(config.ShareTags) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(config.ShareTags))
+	for name := range config.ShareTags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name + "=" + strings.Join(config.ShareTags[name], ",") + ";")
+	}
+	return key.String()
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShareCategories(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = default_config()
+	dir, _ := ioutil.TempDir("", "categories")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"Movies", "Pictures", "Stuff", "Videos"} {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+	}
+	shares, err := NewHdaShares(dir)
+	if err != nil {
+		t.Fatalf("NewHdaShares failed: %s", err)
+	}
+	categories := func() map[string]shareEntry {
+		json_text, _ := shares.listing("all", nil)
+		var listed []shareEntry
+		json.Unmarshal([]byte(json_text), &listed)
+		entries := make(map[string]shareEntry)
+		for _, entry := range listed {
+			entries[entry.Name] = entry
+		}
+		return entries
+	}
+
+	entries := categories()
+	for name, category := range map[string]string{"Movies": "movies", "Pictures": "photos", "Stuff": "files", "Videos": "movies"} {
+		if entries[name].Category != category {
+			t.Errorf("%s is %q instead of %q", name, entries[name].Category, category)
+		}
+	}
+
+	// the tags of the config are added, and listed right away
+	config.ShareTags = map[string][]string{"Stuff": {"Music", "docs"}, "Videos": {"videos", "tv"}}
+	entries = categories()
+	if stuff := entries["Stuff"]; stuff.Category != "music" || len(stuff.Tags) != 3 || stuff.Tags[1] != "Music" {
+		t.Errorf("Wrong tags of the config: %+v", stuff)
+	}
+	if videos := entries["Videos"]; len(videos.Tags) != 2 {
+		t.Errorf("Repeated tags: %+v", videos)
+	}
+	if !shares.Get("Stuff").is_music() || shares.Get("Videos").metadata_hint() != "tv" {
+		t.Errorf("Tags of the config not used")
+	}
+}
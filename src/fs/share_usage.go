@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// GET /shares/usage has the size and free space of the disk of every
+// share, and the bytes of its files, so that the apps warn before an
+// upload fails with a full disk. the bytes come from the index of the
+// share, kept up to date by the watcher, and are null until its first
+// scan; the disks of network shares and of shares with a problem are
+// not looked at, as they may hang
+
+type shareUsage struct {
+	Name string `json:"name"`
+	// bytes of the files, null until the share is indexed
+	Used    *int64     `json:"used"`
+	Scanned *time.Time `json:"scanned,omitempty"`
+	// size and free space of the disk, for the local shares
+	Total   uint64 `json:"total,omitempty"`
+	Free    uint64 `json:"free,omitempty"`
+	Problem string `json:"problem,omitempty"`
+}
+
+type sharesUsage struct {
+	Shares []shareUsage `json:"shares"`
+	// the largest upload, 0 for no limit
+	MaxUpload int64 `json:"max_upload"`
+}
+
+// shares_usage is the usage of the shares kept
+func shares_usage(shares *HdaShares, keep func(name string) bool) *sharesUsage {
+	shares.RLock()
+	list := make([]HdaShare, 0, len(shares.Shares))
+	for _, share := range shares.Shares {
+		if keep == nil || keep(share.name) {
+			list = append(list, HdaShare{name: share.name, path: share.path, problem: share.problem, network: share.network})
+		}
+	}
+	shares.RUnlock()
+	usage := &sharesUsage{Shares: make([]shareUsage, 0, len(list)), MaxUpload: max_upload()}
+	for _, share := range list {
+		entry := shareUsage{Name: share.name, Problem: share.problem}
+		if used, scanned, err := share_index.usage(share.name); err == nil {
+			entry.Used, entry.Scanned = &used, &scanned
+		}
+		if share.problem == "" && !share.network {
+			if _, total, free, err := disk_usage(share.path); err == nil {
+				entry.Total, entry.Free = total, free
+			} else {
+				debug(2, "Error reading the disk of %s: %s", share.name, err.Error())
+			}
+		}
+		usage.Shares = append(usage.Shares, entry)
+	}
+	return usage
+}
+
+func (service *MercuryFsService) shares_usage(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	service.Shares.refresh()
+	var keep func(name string) bool
+	if home_user_of(request) == "" && config.Homes.Share != "" {
+		// the home share is only for users
+		keep = func(name string) bool { return !is_homes_share(name) }
+	}
+	size := json_response(writer, http.StatusOK, shares_usage(service.Shares, keep))
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" %d %d \"%s\"", query, http.StatusOK, size, ua)
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSharesUsage(t *testing.T) {
+	saved_config, saved_index, saved_usage := config, share_index, disk_usage
+	defer func() { config, share_index, disk_usage = saved_config, saved_index, saved_usage }()
+	config = default_config()
+	config.Limits.MaxUpload = 10
+	share_index = new_hda_index()
+	disk_usage = func(path string) (uint64, uint64, uint64, error) {
+		if path == "/data/nas" {
+			t.Errorf("The disk of a network share was read")
+		}
+		if path == "/data/gone" {
+			return 0, 0, 0, errors.New("no such disk")
+		}
+		return 1, 1000, 300, nil
+	}
+	dir, _ := ioutil.TempDir("", "usage")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), make([]byte, 100), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "b.txt"), make([]byte, 50), 0644)
+	share := &HdaShare{name: "Docs", path: dir}
+	shares := &HdaShares{Shares: []*HdaShare{share, {name: "NAS", path: "/data/nas", network: true},
+		{name: "Gone", path: "/data/gone"}}}
+	share_index.scan("Docs", dir, nil, nil, nil)
+
+	used := func() int64 {
+		usage := shares_usage(shares, nil)
+		if docs := usage.Shares[0]; docs.Used != nil {
+			return *docs.Used
+		}
+		return -1
+	}
+	if used() != 150 {
+		t.Errorf("Wrong bytes after the scan: %d", used())
+	}
+	// the changes seen by the watcher are counted without a scan
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), make([]byte, 200), 0644)
+	share_index.apply(share, fileEvent{Path: "/a.txt", Op: "modify"})
+	ioutil.WriteFile(filepath.Join(dir, "c.txt"), make([]byte, 10), 0644)
+	share_index.apply(share, fileEvent{Path: "/c.txt", Op: "create"})
+	share_index.apply(share, fileEvent{Path: "/sub", Op: "delete"})
+	if used() != 210 {
+		t.Errorf("Wrong bytes after the changes: %d", used())
+	}
+
+	service := &MercuryFsService{Shares: shares, debug_info: new(debugInfo)}
+	recorder := httptest.NewRecorder()
+	service.shares_usage(recorder, httptest.NewRequest("GET", "/shares/usage", nil))
+	var usage sharesUsage
+	json.Unmarshal(recorder.Body.Bytes(), &usage)
+	if recorder.Code != 200 || len(usage.Shares) != 3 || usage.MaxUpload != 10<<20 {
+		t.Fatalf("Wrong usage: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if docs := usage.Shares[0]; docs.Total != 1000 || docs.Free != 300 || docs.Scanned == nil {
+		t.Errorf("Wrong usage of Docs: %+v", docs)
+	}
+	// not indexed yet, and no disk known
+	if nas := usage.Shares[1]; nas.Used != nil || nas.Total != 0 {
+		t.Errorf("Wrong usage of NAS: %+v", nas)
+	}
+	if gone := usage.Shares[2]; gone.Total != 0 || gone.Free != 0 {
+		t.Errorf("Wrong usage of Gone: %+v", gone)
+	}
+}
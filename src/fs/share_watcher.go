@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shareWatcher watches the directories of all the shares with fsnotify
+// and hands what it sees, as file events, to its listeners: the events
+// channel, the share index and the metadata prefetcher.
+//
+// when the kernel runs out of watches for a share, the share is marked as
+// degraded and falls back to being rescanned every config.Scan.Fallback
+type shareWatcher struct {
+	shares  *HdaShares
+	watcher *fsnotify.Watcher
+	// share roots being watched, by share path, and those that could
+	// not be watched completely
+	roots     map[string]bool
+	degraded  map[string]bool
+	listeners []watchListener
+	// closed when run is done
+	stopped chan bool
+	sync.Mutex
+}
+
+// watchListener is told about every change in the shares
+type watchListener func(share *HdaShare, event fileEvent)
+
+var share_watcher *shareWatcher
+
+var errWatchAborted = errors.New("watch aborted")
+
+// new_share_watcher returns a watcher for the shares, or nil if that is not
+// possible. shares are added to it by sync
+func new_share_watcher(shares *HdaShares) *shareWatcher {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log("File watcher could not be started, shares will be rescanned every %s", config.Scan.Fallback)
+		debug(2, "Error creating the file watcher: %s", err.Error())
+		return nil
+	}
+	sw := &shareWatcher{
+		shares:   shares,
+		watcher:  watcher,
+		roots:    make(map[string]bool),
+		degraded: make(map[string]bool),
+		stopped:  make(chan bool),
+	}
+	go sw.run()
+	return sw
+}
+
+// listen adds a listener for all the changes from now on
+func (this *shareWatcher) listen(listener watchListener) {
+	this.Lock()
+	this.listeners = append(this.listeners, listener)
+	this.Unlock()
+}
+
+// sync starts watching new shares and stops watching removed ones
+func (this *shareWatcher) sync() {
+	this.shares.RLock()
+	current := make(map[string]bool, len(this.shares.Shares))
+	for _, share := range this.shares.Shares {
+		if share.path != "" && share.problem == "" {
+			current[share.path] = true
+		}
+	}
+	this.shares.RUnlock()
+
+	this.Lock()
+	defer this.Unlock()
+	for root := range current {
+		if !this.roots[root] {
+			this.roots[root] = true
+			this.watch_tree(root, root)
+		}
+	}
+	for root := range this.roots {
+		if !current[root] {
+			delete(this.roots, root)
+			delete(this.degraded, root)
+			this.unwatch_tree(root)
+		}
+	}
+}
+
+// is_degraded says if changes in a share may be missed, because the
+// share is not watched (completely)
+func (this *shareWatcher) is_degraded(share *HdaShare) bool {
+	if this == nil {
+		return true
+	}
+	this.Lock()
+	defer this.Unlock()
+	return this.degraded[share.path] || !this.roots[share.path]
+}
+
+// watch_tree adds a watch to dir and every directory below it. it has to
+// be called with the lock held
+func (this *shareWatcher) watch_tree(root, dir string) {
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(fi.Name(), ".") {
+			return filepath.SkipDir
+		}
+		err = this.watcher.Add(path)
+		if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE) {
+			if !this.degraded[root] {
+				log_warn("out of file watches in %s, it will be rescanned every %s instead (see fs.inotify.max_user_watches)", root, config.Scan.Fallback)
+				this.degraded[root] = true
+			}
+			return errWatchAborted
+		} else if err != nil {
+			debug(2, "Error watching %s: %s", path, err.Error())
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+func (this *shareWatcher) unwatch_tree(dir string) {
+	for _, path := range this.watcher.WatchList() {
+		if path == dir || path_inside(path, dir) {
+			this.watcher.Remove(path)
+		}
+	}
+}
+
+// close stops watching, once the changes seen are handled
+func (this *shareWatcher) close() {
+	this.watcher.Close()
+	<-this.stopped
+}
+
+func (this *shareWatcher) run() {
+	defer close(this.stopped)
+	for {
+		select {
+		case ev, ok := <-this.watcher.Events:
+			if !ok {
+				return
+			}
+			this.handle(ev)
+		case err, ok := <-this.watcher.Errors:
+			if !ok {
+				return
+			}
+			if err == fsnotify.ErrEventOverflow {
+				// some changes were lost, the only way to catch up is a rescan
+				log("File watcher overflow, rescanning the shares")
+				this.rescan_all()
+			} else {
+				debug(2, "File watcher error: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (this *shareWatcher) rescan_all() {
+	this.shares.RLock()
+	defer this.shares.RUnlock()
+	for _, share := range this.shares.Shares {
+		scheduler.trigger(scan_job_name(share.name))
+	}
+}
+
+func (this *shareWatcher) handle(ev fsnotify.Event) {
+	if strings.HasPrefix(filepath.Base(ev.Name), ".") {
+		return
+	}
+	// files in nested shares belong to the innermost share only
+	share, relative := this.shares.owner(ev.Name)
+	if share == nil {
+		return
+	}
+
+	event := fileEvent{Share: share.name, Path: relative, Time: time.Now()}
+	switch {
+	case ev.Has(fsnotify.Create):
+		event.Op = "create"
+		if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+			event.IsDir = true
+			this.Lock()
+			this.watch_tree(share.path, ev.Name)
+			this.Unlock()
+		}
+	case ev.Has(fsnotify.Write):
+		event.Op = "modify"
+	case ev.Has(fsnotify.Remove):
+		event.Op = "delete"
+	case ev.Has(fsnotify.Rename):
+		// the new name, if it's still in a share, comes as a create
+		event.Op = "rename"
+	default:
+		return
+	}
+
+	this.Lock()
+	listeners := this.listeners
+	this.Unlock()
+	for _, listener := range listeners {
+		listener(share, event)
+	}
+}
+
+// publish_event is the listener for the events channel
+func publish_event(share *HdaShare, event fileEvent) {
+	events.publish(event)
+}
@@ -10,9 +10,8 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha1"
-	"fmt"
+	"encoding/hex"
 	"io"
 )
 
@@ -20,14 +19,11 @@ import (
 func sha1string(value string) string {
 	sum := sha1.New()
 	io.WriteString(sum, value)
-	str := fmt.Sprintf("%x", sum.Sum(nil))
-	return str
+	return hex.EncodeToString(sum.Sum(nil))
 }
 
 // compute the sha1-encoded value for the byte array
 func sha1bytes(value []byte) string {
-	sum := sha1.New()
-	io.WriteString(sum, bytes.NewBuffer(value).String())
-	str := fmt.Sprintf("%x", sum.Sum(nil))
-	return str
+	sum := sha1.Sum(value)
+	return hex.EncodeToString(sum[:])
 }
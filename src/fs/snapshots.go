@@ -0,0 +1,268 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshots of the shares on btrfs or ZFS, taken every
+// config.Snapshots.Interval, of which the last config.Snapshots.Keep are
+// kept. snapshots taken by someone else are listed too, but never removed.
+//
+// the snapshots of a share can be browsed, read only, under the virtual
+// directory /@snapshots of the share, like .zfs/snapshot in ZFS:
+// /@snapshots/<snapshot>/<path> is <path> in the share as it was then
+//
+// on btrfs the share has to be a subvolume, and its snapshots are kept in
+// .snapshots in it. on ZFS they are snapshots of the dataset of the share
+
+const SNAPSHOTS_DIR = "@snapshots"
+const SNAPSHOT_PREFIX = "amahi-"
+const SNAPSHOT_TIME_FORMAT = "20060102T150405Z"
+
+var errSnapshotsUnsupported = errors.New("snapshots are not supported on this file system")
+
+// snapshotVolume is where the snapshots of a share are
+type snapshotVolume struct {
+	kind string
+	// directory with one entry per snapshot
+	root string
+	// for ZFS, the dataset, and where the share is inside of it
+	dataset  string
+	relative string
+}
+
+type snapshotInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Amahi   bool      `json:"amahi"`
+}
+
+// snapshot_volume finds how the snapshots of a share are made
+func snapshot_volume(share *HdaShare) (*snapshotVolume, error) {
+	switch filesystem_type(share.path) {
+	case "btrfs":
+		return &snapshotVolume{kind: "btrfs", root: filepath.Join(share.path, ".snapshots")}, nil
+	case "zfs":
+		out, err := exec.Command("zfs", "list", "-H", "-o", "name,mountpoint", share.path).Output()
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Split(strings.TrimSpace(string(out)), "\t")
+		if len(fields) != 2 {
+			return nil, errSnapshotsUnsupported
+		}
+		relative := strings.TrimPrefix(share.path, fields[1])
+		return &snapshotVolume{kind: "zfs", root: filepath.Join(fields[1], ".zfs", "snapshot"), dataset: fields[0], relative: relative}, nil
+	}
+	return nil, errSnapshotsUnsupported
+}
+
+func valid_snapshot_name(name string) bool {
+	return name != "" && filepath.Base(name) == name && !strings.HasPrefix(name, ".")
+}
+
+// path_in is where relative, in the share, is in a snapshot
+func (this *snapshotVolume) path_in(snapshot, relative string) string {
+	return filepath.Join(this.root, snapshot, this.relative, relative)
+}
+
+func (this *snapshotVolume) list() ([]snapshotInfo, error) {
+	fis, err := ioutil.ReadDir(this.root)
+	if os.IsNotExist(err) {
+		return []snapshotInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	snapshots := make([]snapshotInfo, 0, len(fis))
+	for _, fi := range fis {
+		if !fi.IsDir() || !valid_snapshot_name(fi.Name()) {
+			continue
+		}
+		snapshot := snapshotInfo{Name: fi.Name(), Created: fi.ModTime()}
+		if strings.HasPrefix(fi.Name(), SNAPSHOT_PREFIX) {
+			if created, err := time.Parse(SNAPSHOT_TIME_FORMAT, strings.TrimPrefix(fi.Name(), SNAPSHOT_PREFIX)); err == nil {
+				snapshot.Created, snapshot.Amahi = created, true
+			}
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.After(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+func (this *snapshotVolume) take(share *HdaShare) (string, error) {
+	name := SNAPSHOT_PREFIX + time.Now().UTC().Format(SNAPSHOT_TIME_FORMAT)
+	var command *exec.Cmd
+	if this.kind == "btrfs" {
+		if err := os.MkdirAll(this.root, 0755); err != nil {
+			return "", err
+		}
+		command = exec.Command("btrfs", "subvolume", "snapshot", "-r", share.path, filepath.Join(this.root, name))
+	} else {
+		command = exec.Command("zfs", "snapshot", this.dataset+"@"+name)
+	}
+	return name, run_command(command)
+}
+
+func (this *snapshotVolume) remove(name string) error {
+	if this.kind == "btrfs" {
+		return run_command(exec.Command("btrfs", "subvolume", "delete", filepath.Join(this.root, name)))
+	}
+	return run_command(exec.Command("zfs", "destroy", this.dataset+"@"+name))
+}
+
+// prune removes the oldest snapshots taken by us, keeping keep of them
+func (this *snapshotVolume) prune(keep int) int {
+	snapshots, _ := this.list()
+	removed, kept := 0, 0
+	for _, snapshot := range snapshots {
+		if !snapshot.Amahi {
+			continue
+		}
+		if kept < keep {
+			kept++
+			continue
+		}
+		if err := this.remove(snapshot.Name); err != nil {
+			debug(2, "Error removing snapshot %s: %s", snapshot.Name, err.Error())
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+func run_command(command *exec.Cmd) error {
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// snapshot_path maps a path under /@snapshots of a share to where it is on
+// disk. ok is false for paths that are not in /@snapshots
+func snapshot_path(share *HdaShare, relative string) (full_path string, ok bool, err error) {
+	relative = path.Clean("/" + relative)
+	if relative != "/"+SNAPSHOTS_DIR && !strings.HasPrefix(relative, "/"+SNAPSHOTS_DIR+"/") {
+		return "", false, nil
+	}
+	volume, err := snapshot_volume(share)
+	if err != nil {
+		return "", true, err
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(relative, "/"+SNAPSHOTS_DIR), "/")
+	if rest == "" {
+		return volume.root, true, nil
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	if !valid_snapshot_name(parts[0]) {
+		return "", true, errors.New("invalid snapshot name")
+	}
+	inside := ""
+	if len(parts) == 2 {
+		inside = parts[1]
+	}
+	return volume.path_in(parts[0], inside), true, nil
+}
+
+// snapshot_job takes and prunes the snapshots of the shares that support them
+func snapshot_job(shares *HdaShares) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		shares.RLock()
+		list := append([]*HdaShare{}, shares.Shares...)
+		shares.RUnlock()
+		taken, removed, failed := 0, 0, 0
+		for i, share := range list {
+			progress(int64(i), int64(len(list)))
+			if share.path == "" || share.problem != "" {
+				continue
+			}
+			volume, err := snapshot_volume(share)
+			if err != nil {
+				continue
+			}
+			if _, err := volume.take(share); err != nil {
+				log_error("Error taking a snapshot of share %s: %s", share.name, err.Error())
+				failed++
+				continue
+			}
+			taken++
+			removed += volume.prune(config.Snapshots.Keep)
+		}
+		summary := fmt.Sprintf("%d snapshots taken, %d removed", taken, removed)
+		if failed > 0 {
+			return summary, fmt.Errorf("%d snapshots failed", failed)
+		}
+		return summary, nil
+	}
+}
+
+// GET /shares/{name}/snapshots
+func (service *MercuryFsService) list_snapshots(writer http.ResponseWriter, request *http.Request) {
+	service.snapshots_request(writer, request, func(share *HdaShare, volume *snapshotVolume) (int, interface{}) {
+		snapshots, err := volume.list()
+		if err != nil {
+			return http.StatusInternalServerError, map[string]string{"error": err.Error()}
+		}
+		return http.StatusOK, snapshots
+	})
+}
+
+// POST /shares/{name}/snapshots takes a snapshot now
+func (service *MercuryFsService) take_snapshot(writer http.ResponseWriter, request *http.Request) {
+	service.snapshots_request(writer, request, func(share *HdaShare, volume *snapshotVolume) (int, interface{}) {
+		if no_upload {
+			return http.StatusForbidden, map[string]string{"error": "changes are disabled"}
+		}
+		name, err := volume.take(share)
+		if err != nil {
+			return http.StatusInternalServerError, map[string]string{"error": err.Error()}
+		}
+		volume.prune(config.Snapshots.Keep)
+		return http.StatusOK, map[string]string{"name": name}
+	})
+}
+
+func (service *MercuryFsService) snapshots_request(writer http.ResponseWriter, request *http.Request, handle func(*HdaShare, *snapshotVolume) (int, interface{})) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status, size := http.StatusNotFound, int64(0)
+	if share := service.Shares.Get(mux.Vars(request)["name"]); share == nil {
+		http.NotFound(writer, request)
+	} else if volume, err := snapshot_volume(share); err != nil {
+		status = http.StatusNotImplemented
+		size = json_response(writer, status, map[string]string{"error": err.Error()})
+	} else {
+		var result interface{}
+		status, result = handle(share, volume)
+		size = json_response(writer, status, result)
+	}
+	service.debug_info.requestServed(size)
+	log("\"%s %s\" %d %d \"%s\"", request.Method, query, status, size, ua)
+}
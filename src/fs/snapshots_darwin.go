@@ -0,0 +1,15 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+// there are no snapshots of shares on the Mac
+func filesystem_type(path string) string {
+	return ""
+}
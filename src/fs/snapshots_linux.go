@@ -0,0 +1,32 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"syscall"
+)
+
+const BTRFS_SUPER_MAGIC = 0x9123683e
+const ZFS_SUPER_MAGIC = 0x2fc12fc1
+
+// filesystem_type is "btrfs" or "zfs" for the file systems with snapshots
+func filesystem_type(path string) string {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return ""
+	}
+	switch uint32(fs.Type) {
+	case BTRFS_SUPER_MAGIC:
+		return "btrfs"
+	case ZFS_SUPER_MAGIC:
+		return "zfs"
+	}
+	return ""
+}
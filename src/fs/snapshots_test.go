@@ -0,0 +1,46 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotVolume(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snapshots")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"amahi-20260101T000000Z", "amahi-20260102T000000Z", "manual", ".hidden"} {
+		os.MkdirAll(filepath.Join(dir, name), 0755)
+	}
+
+	volume := &snapshotVolume{kind: "zfs", root: dir, dataset: "tank/shares", relative: "/movies"}
+	snapshots, err := volume.list()
+	if err != nil || len(snapshots) != 3 {
+		t.Fatalf("Wrong snapshots: %+v %v", snapshots, err)
+	}
+	if snapshots[len(snapshots)-1].Name != "amahi-20260101T000000Z" || !snapshots[len(snapshots)-1].Amahi {
+		t.Errorf("Snapshots not sorted by date: %+v", snapshots)
+	}
+	if p := volume.path_in("manual", "a/b.mkv"); p != filepath.Join(dir, "manual", "movies", "a", "b.mkv") {
+		t.Errorf("Wrong path in a snapshot: %s", p)
+	}
+
+	// paths outside /@snapshots are left alone
+	share := &HdaShare{name: "Movies", path: dir}
+	if _, ok, _ := snapshot_path(share, "/@snapshotsfoo/x"); ok {
+		t.Errorf("Path outside of the snapshots mapped")
+	}
+	if _, ok, err := snapshot_path(share, "/@snapshots/manual"); !ok || err != errSnapshotsUnsupported {
+		t.Errorf("Snapshots of a share without them: %v %v", ok, err)
+	}
+}
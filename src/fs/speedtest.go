@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// speed tests, to tell a slow uplink of the user from a slow HDA: GET
+// /speedtest/download sends a blob of random data, which does not
+// compress, of ?size= megabytes, and POST /speedtest/upload reads and
+// drops what it is sent. both work on the local server and through the
+// relay, and the last results are in /hda_debug with the path they took,
+// so that both can be compared. the time of a download is until the last
+// byte was handed to the connection, the client times its own end
+
+const SPEEDTEST_DEFAULT_MB = 10
+const SPEEDTEST_MAX_MB = 100
+
+// how many results are kept
+const SPEEDTEST_RESULTS = 20
+
+const (
+	SPEEDTEST_DOWNLOAD = "download"
+	SPEEDTEST_UPLOAD   = "upload"
+)
+
+type speedtestResult struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	// local or relay
+	Path   string  `json:"path"`
+	Client string  `json:"client"`
+	Bytes  int64   `json:"bytes"`
+	Ms     int64   `json:"ms"`
+	Mbps   float64 `json:"mbps"`
+	Error  string  `json:"error,omitempty"`
+}
+
+type speedtests struct {
+	results []speedtestResult
+	sync.Mutex
+}
+
+var speedtest_results = new(speedtests)
+
+// a megabyte of random data, made once
+var speedtest_block []byte
+var speedtest_block_once sync.Once
+
+func speedtest_data() []byte {
+	speedtest_block_once.Do(func() {
+		speedtest_block = make([]byte, 1<<20)
+		rand.Read(speedtest_block)
+	})
+	return speedtest_block
+}
+
+// speedtest_size is the size asked for in request, in bytes
+func speedtest_size(request *http.Request) (int64, bool) {
+	size := request.URL.Query().Get("size")
+	if size == "" {
+		return SPEEDTEST_DEFAULT_MB << 20, true
+	}
+	mb, err := strconv.Atoi(size)
+	if err != nil || mb < 1 || mb > SPEEDTEST_MAX_MB {
+		return 0, false
+	}
+	return int64(mb) << 20, true
+}
+
+func (this *speedtests) record(request *http.Request, direction string, bytes int64, took time.Duration, err error) speedtestResult {
+	result := speedtestResult{Time: time.Now(), Direction: direction, Path: "local", Client: client_ip(request), Bytes: bytes, Ms: took.Nanoseconds() / int64(time.Millisecond)}
+	if from_relay(request) {
+		result.Path = "relay"
+	}
+	if took > 0 {
+		result.Mbps = float64(bytes*8) / took.Seconds() / 1e6
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	this.Lock()
+	defer this.Unlock()
+	this.results = append(this.results, result)
+	if len(this.results) > SPEEDTEST_RESULTS {
+		this.results = this.results[len(this.results)-SPEEDTEST_RESULTS:]
+	}
+	return result
+}
+
+// status has the results, the last first
+func (this *speedtests) status() []speedtestResult {
+	this.Lock()
+	defer this.Unlock()
+	result := make([]speedtestResult, 0, len(this.results))
+	for i := len(this.results) - 1; i >= 0; i-- {
+		result = append(result, this.results[i])
+	}
+	return result
+}
+
+// GET /speedtest/download?size=megabytes
+func (service *MercuryFsService) speedtest_download(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	size, ok := speedtest_size(request)
+	if !ok {
+		n := json_response(writer, http.StatusBadRequest, map[string]string{"error": "size is from 1 to " + strconv.Itoa(SPEEDTEST_MAX_MB) + " MB"})
+		service.debug_info.requestServed(n)
+		log("\"GET %s\" 400 %d \"%s\"", query, n, ua)
+		return
+	}
+	block := speedtest_data()
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	started := time.Now()
+	var sent int64
+	var err error
+	for sent < size && err == nil {
+		chunk := block
+		if size-sent < int64(len(chunk)) {
+			chunk = chunk[:size-sent]
+		}
+		var n int
+		n, err = writer.Write(chunk)
+		sent += int64(n)
+	}
+	result := speedtest_results.record(request, SPEEDTEST_DOWNLOAD, sent, time.Since(started), err)
+	service.debug_info.requestServed(sent)
+	log("\"GET %s\" 200 %d \"%s\" %.1fMbps", query, sent, ua, result.Mbps)
+}
+
+// POST /speedtest/upload
+func (service *MercuryFsService) speedtest_upload(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	started := time.Now()
+	// one byte over the cap tells a body too big
+	received, err := io.Copy(ioutil.Discard, io.LimitReader(request.Body, SPEEDTEST_MAX_MB<<20+1))
+	took := time.Since(started)
+	status := http.StatusOK
+	var response interface{}
+	if received > SPEEDTEST_MAX_MB<<20 {
+		status = http.StatusRequestEntityTooLarge
+		response = map[string]string{"error": "uploads are up to " + strconv.Itoa(SPEEDTEST_MAX_MB) + " MB"}
+	} else {
+		response = speedtest_results.record(request, SPEEDTEST_UPLOAD, received, took, err)
+	}
+	size := json_response(writer, status, response)
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+}
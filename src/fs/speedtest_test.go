@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSpeedtest(t *testing.T) {
+	saved := speedtest_results
+	defer func() { speedtest_results = saved }()
+	speedtest_results = new(speedtests)
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+
+	recorder := httptest.NewRecorder()
+	service.speedtest_download(recorder, httptest.NewRequest("GET", "/speedtest/download?size=3", nil))
+	if recorder.Code != 200 || recorder.Body.Len() != 3<<20 || recorder.Header().Get("Content-Length") != "3145728" {
+		t.Fatalf("Wrong download: %d, %d bytes", recorder.Code, recorder.Body.Len())
+	}
+	for _, size := range []string{"0", "101", "lots"} {
+		recorder := httptest.NewRecorder()
+		service.speedtest_download(recorder, httptest.NewRequest("GET", "/speedtest/download?size="+size, nil))
+		if recorder.Code != 400 {
+			t.Errorf("%d for a size of %s", recorder.Code, size)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	request := mark_relay_request(httptest.NewRequest("POST", "/speedtest/upload", bytes.NewReader(make([]byte, 2<<20))))
+	service.speedtest_upload(recorder, request)
+	var result speedtestResult
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil || result.Bytes != 2<<20 || result.Path != "relay" || result.Direction != SPEEDTEST_UPLOAD {
+		t.Errorf("Wrong upload: %s %v", recorder.Body.String(), err)
+	}
+	recorder = httptest.NewRecorder()
+	service.speedtest_upload(recorder, httptest.NewRequest("POST", "/speedtest/upload", bytes.NewReader(make([]byte, SPEEDTEST_MAX_MB<<20+1))))
+	if recorder.Code != 413 {
+		t.Errorf("%d for an upload too big", recorder.Code)
+	}
+
+	results := speedtest_results.status()
+	if len(results) != 2 || results[0].Direction != SPEEDTEST_UPLOAD || results[1].Path != "local" || results[1].Bytes != 3<<20 {
+		t.Errorf("Wrong results: %+v", results)
+	}
+}
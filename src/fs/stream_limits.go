@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// the files being served at a time are capped, in all and by client, so
+// that a client making lots of range requests in parallel does not take
+// over a small HDA. the requests over the cap get a 503, with a
+// Retry-After. clients on the local network are told apart by address,
+// and over the relay, where they all come from the relay, by the Session
+// the relay sends
+
+const STREAM_RETRY_AFTER = "2"
+
+// the requests that stream files
+var stream_paths = map[string]bool{
+	"/files":       true,
+	"/files/image": true,
+	"/subtitles":   true,
+	"/md/artwork":  true,
+	"/music/art":   true,
+}
+
+type streamLimits struct {
+	open     int
+	clients  map[string]int
+	rejected int64
+	sync.Mutex
+}
+
+var stream_limits = &streamLimits{clients: make(map[string]int)}
+
+func is_stream(request *http.Request) bool {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		return false
+	}
+	return stream_paths[request.URL.Path] || strings.HasPrefix(request.URL.Path, "/transcode/") ||
+		strings.HasPrefix(request.URL.Path, "/downloads/")
+}
+
+// stream_client is who makes a request, for the cap by client
+func stream_client(request *http.Request) string {
+	if from_relay(request) {
+		return "relay " + request.Header.Get("Session")
+	}
+	return client_ip(request)
+}
+
+// client_ip is the address of the client of a request. over the relay,
+// it's the one the relay forwarded, if any
+func client_ip(request *http.Request) string {
+	if from_relay(request) {
+		if forwarded := request.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+		return "relay"
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// acquire takes a stream for client, if there's room
+func (this *streamLimits) acquire(client string) bool {
+	this.Lock()
+	defer this.Unlock()
+	max, max_client := config.Limits.MaxStreams, config.Limits.MaxClientStreams
+	if (max > 0 && this.open >= max) || (max_client > 0 && this.clients[client] >= max_client) {
+		this.rejected++
+		return false
+	}
+	this.open++
+	this.clients[client]++
+	return true
+}
+
+func (this *streamLimits) release(client string) {
+	this.Lock()
+	defer this.Unlock()
+	this.open--
+	if this.clients[client]--; this.clients[client] <= 0 {
+		delete(this.clients, client)
+	}
+}
+
+func (this *streamLimits) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	return map[string]interface{}{
+		"open":     this.open,
+		"clients":  len(this.clients),
+		"rejected": this.rejected,
+	}
+}
+
+// stream_access is a middleware holding the requests that stream files to
+// the caps
+func (service *MercuryFsService) stream_access(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !is_stream(request) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		client := stream_client(request)
+		if !stream_limits.acquire(client) {
+			writer.Header().Set("Retry-After", STREAM_RETRY_AFTER)
+			size := json_response(writer, http.StatusServiceUnavailable, map[string]string{"error": "too many streams"})
+			service.debug_info.requestServed(size)
+			log("\"%s %s\" 503 %d \"%s\"", request.Method, pathForLog(request.URL), size, request.Header.Get("User-Agent"))
+			return
+		}
+		defer stream_limits.release(client)
+		next.ServeHTTP(writer, request)
+	})
+}
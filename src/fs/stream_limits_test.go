@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestStreamLimits(t *testing.T) {
+	saved := config.Limits
+	defer func() { config.Limits = saved }()
+	config.Limits.MaxStreams, config.Limits.MaxClientStreams = 3, 1
+	stream_limits = &streamLimits{clients: make(map[string]int)}
+
+	started, release := make(chan bool), make(chan bool)
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	handler := service.stream_access(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Session") != "done" {
+			started <- true
+			<-release
+		}
+	}))
+	stream := func(remote, session string, relay bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/files?s=Movies&p=/movie.mkv", nil)
+		request.RemoteAddr = remote
+		request.Header.Set("Session", session)
+		if relay {
+			request = mark_relay_request(request)
+		}
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+	var held sync.WaitGroup
+	hold := func(remote, session string, relay bool) {
+		held.Add(1)
+		go func() {
+			defer held.Done()
+			stream(remote, session, relay)
+		}()
+		<-started
+	}
+
+	hold("192.168.1.10:5000", "", false)
+	if response := stream("192.168.1.10:5001", "", false); response.Code != 503 || response.Header().Get("Retry-After") == "" {
+		t.Errorf("A second stream of a client: %d %v", response.Code, response.Header())
+	}
+	// the clients over the relay are told apart by session
+	hold("10.0.0.1:443", "phone", true)
+	hold("10.0.0.1:443", "tablet", true)
+	if response := stream("192.168.1.11:5000", "", false); response.Code != 503 {
+		t.Errorf("%d instead of 503 over the cap", response.Code)
+	}
+	// others are not held
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/shares", nil)
+	request.Header.Set("Session", "done")
+	handler.ServeHTTP(recorder, request)
+	if status := stream_limits.status(); status["open"] != 3 || status["clients"] != 3 || status["rejected"] != int64(2) {
+		t.Errorf("Wrong status: %v", status)
+	}
+
+	close(release)
+	held.Wait()
+	if response := stream("192.168.1.11:5000", "done", false); response.Code != 200 {
+		t.Errorf("%d once the streams are done", response.Code)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// the subtitles of a video: the sidecar files next to it, like
+// Movie.en.srt for Movie.mkv, and the text tracks in the video itself,
+// found with ffprobe and extracted with ffmpeg when they are installed.
+// they are all served in UTF-8, whatever encoding the files are in
+
+const SUBTITLE_MAX_SIZE = 10 << 20
+const SUBTITLE_EXTRACT_TIMEOUT = 2 * time.Minute
+
+var errNoSubtitle = errors.New("no such subtitle")
+
+// the content types of subtitle formats
+var subtitle_formats = map[string]string{
+	"srt": "application/x-subrip",
+	"ass": "text/x-ssa",
+	"ssa": "text/x-ssa",
+	"vtt": "text/vtt",
+	"sub": "text/plain",
+}
+
+// the formats embedded text subtitles are extracted to, by codec
+var subtitle_codecs = map[string]string{
+	"subrip":   "srt",
+	"mov_text": "srt",
+	"ass":      "ass",
+	"ssa":      "ass",
+	"webvtt":   "vtt",
+}
+
+// the characters of windows-1252 where iso-8859-1 has control characters,
+// as subtitles that are not in UTF-8 are usually in windows-1252
+var windows_1252 = map[byte]rune{
+	0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡', 0x88: 'ˆ', 0x89: '‰',
+	0x8a: 'Š', 0x8b: '‹', 0x8c: 'Œ', 0x8e: 'Ž', 0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•',
+	0x96: '–', 0x97: '—', 0x98: '˜', 0x99: '™', 0x9a: 'š', 0x9b: '›', 0x9c: 'œ', 0x9e: 'ž', 0x9f: 'Ÿ',
+}
+
+type subtitleTrack struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Format   string `json:"format"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Forced   bool   `json:"forced,omitempty"`
+	URL      string `json:"url"`
+	// the stream of an embedded track
+	stream int
+}
+
+// probe_subtitles lists the text subtitle tracks embedded in a video,
+// replaced in tests
+var probe_subtitles = ffprobe_subtitles
+
+// extract_subtitle extracts an embedded track in format, replaced in tests
+var extract_subtitle = ffmpeg_subtitle
+
+// subtitle_sidecars finds the subtitle files for the video at full_path
+func subtitle_sidecars(full_path string) []subtitleTrack {
+	dir, video := filepath.Dir(full_path), filepath.Base(full_path)
+	base := strings.ToLower(strings.TrimSuffix(video, filepath.Ext(video)))
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	tracks := []subtitleTrack{}
+	for _, fi := range names {
+		name := fi.Name()
+		format := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+		lower := strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+		if subtitle_formats[format] == "" || fi.IsDir() || (lower != base && !strings.HasPrefix(lower, base+".")) {
+			continue
+		}
+		track := subtitleTrack{Name: name, Kind: "sidecar", Format: format}
+		// Movie.en.forced.srt
+		for _, part := range strings.Split(strings.TrimPrefix(lower, base), ".") {
+			switch {
+			case part == "forced":
+				track.Forced = true
+			case len(part) == 2 || len(part) == 3 || (len(part) == 5 && part[2] == '-'):
+				track.Language = part
+			}
+		}
+		tracks = append(tracks, track)
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].Name < tracks[j].Name })
+	return tracks
+}
+
+// ffprobe_subtitles lists the text subtitle tracks of a video with ffprobe,
+// none when it is not installed
+func ffprobe_subtitles(full_path string) []subtitleTrack {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "s",
+		"-show_entries", "stream=index,codec_name:stream_tags=language,title:stream_disposition=forced",
+		"-of", "json", full_path).Output()
+	if err != nil {
+		debug(2, "Error probing the subtitles of %s: %s", full_path, err.Error())
+		return nil
+	}
+	var probe struct {
+		Streams []struct {
+			Index       int               `json:"index"`
+			Codec       string            `json:"codec_name"`
+			Tags        map[string]string `json:"tags"`
+			Disposition map[string]int    `json:"disposition"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil
+	}
+	tracks := []subtitleTrack{}
+	for _, stream := range probe.Streams {
+		format := subtitle_codecs[stream.Codec]
+		if format == "" {
+			// pictures, like DVD and Blu-ray subtitles
+			continue
+		}
+		tracks = append(tracks, subtitleTrack{
+			Name:     strconv.Itoa(stream.Index),
+			Kind:     "embedded",
+			Format:   format,
+			Language: stream.Tags["language"],
+			Title:    stream.Tags["title"],
+			Forced:   stream.Disposition["forced"] == 1,
+			stream:   stream.Index,
+		})
+	}
+	return tracks
+}
+
+// ffmpeg_subtitle extracts the track in stream of a video as format
+func ffmpeg_subtitle(full_path string, stream int, format string) ([]byte, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, err
+	}
+	muxer := map[string]string{"srt": "srt", "ass": "ass", "vtt": "webvtt"}[format]
+	ctx, cancel := context.WithTimeout(context.Background(), SUBTITLE_EXTRACT_TIMEOUT)
+	defer cancel()
+	command := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-i", full_path, "-map", "0:"+strconv.Itoa(stream), "-f", muxer, "-")
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+	out, err := command.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// subtitle_utf8 converts a subtitle file to UTF-8
+func subtitle_utf8(data []byte) string {
+	sample := data
+	if len(sample) > 4096 {
+		sample = sample[:4096]
+	}
+	encoding := detect_encoding(sample)
+	if encoding == "" && !bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}) {
+		// NULs in the middle of text, probably UTF-16 without a BOM
+		encoding = "utf-16le"
+		if len(data) > 1 && data[0] == 0 {
+			encoding = "utf-16be"
+		}
+	}
+	// all of it, as the sample may be valid UTF-8 and the rest not
+	if encoding == "utf-8" && !bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}) && !utf8.Valid(data) {
+		encoding = "iso-8859-1"
+	}
+	if encoding != "iso-8859-1" {
+		return decode_text(data, encoding)
+	}
+	runes := make([]rune, len(data))
+	for i, c := range data {
+		if r, ok := windows_1252[c]; ok {
+			runes[i] = r
+		} else {
+			runes[i] = rune(c)
+		}
+	}
+	return string(runes)
+}
+
+// video_subtitles lists the subtitles of the video at full_path, with the
+// URLs to get them from the video in share and path
+func video_subtitles(full_path, share, path string) []subtitleTrack {
+	tracks := append([]subtitleTrack{}, subtitle_sidecars(full_path)...)
+	tracks = append(tracks, probe_subtitles(full_path)...)
+	for i := range tracks {
+		q := url.Values{"s": {share}, "p": {path}}
+		if tracks[i].Kind == "embedded" {
+			q.Set("stream", tracks[i].Name)
+		} else {
+			q.Set("file", tracks[i].Name)
+		}
+		tracks[i].URL = "/subtitles?" + q.Encode()
+	}
+	return tracks
+}
+
+// read_subtitle reads a sidecar file next to the video at full_path, or
+// extracts the track in stream of the video
+func read_subtitle(full_path, file, stream string) (string, []byte, error) {
+	if file != "" {
+		if strings.ContainsAny(file, "/\\") {
+			return "", nil, errNoSubtitle
+		}
+		for _, track := range subtitle_sidecars(full_path) {
+			if track.Name != file {
+				continue
+			}
+			subtitle := filepath.Join(filepath.Dir(full_path), file)
+			if fi, err := os.Stat(subtitle); err != nil || fi.Size() > SUBTITLE_MAX_SIZE {
+				return "", nil, errNoSubtitle
+			}
+			data, err := ioutil.ReadFile(subtitle)
+			return track.Format, data, err
+		}
+		return "", nil, errNoSubtitle
+	}
+	for _, track := range probe_subtitles(full_path) {
+		if track.Name == stream {
+			data, err := extract_subtitle(full_path, track.stream, track.Format)
+			return track.Format, data, err
+		}
+	}
+	return "", nil, errNoSubtitle
+}
+
+// GET /subtitles?s=<share>&p=<video> lists the subtitles of a video, and
+// with file=<name> or stream=<n> serves one of them
+func (service *MercuryFsService) serve_subtitles(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	full_path, err := service.fullPathToFile(q.Get("s"), q.Get("p"))
+	if err == nil {
+		if fi, serr := os.Stat(full_path); serr != nil || !fi.Mode().IsRegular() {
+			err = errNoSubtitle
+		}
+	}
+	if err != nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	if service.parental_block(writer, request, parental_profile_of(request), q.Get("s"), full_path) {
+		return
+	}
+
+	if q.Get("file") == "" && q.Get("stream") == "" {
+		size := json_response(writer, http.StatusOK, video_subtitles(full_path, q.Get("s"), q.Get("p")))
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+		return
+	}
+	format, data, err := read_subtitle(full_path, q.Get("file"), q.Get("stream"))
+	if err != nil {
+		status := http.StatusNotFound
+		if err != errNoSubtitle {
+			debug(2, "Error reading a subtitle of %s: %s", full_path, err.Error())
+			status = http.StatusInternalServerError
+		}
+		size := json_response(writer, status, map[string]string{"error": err.Error()})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" %d %d \"%s\"", query, status, size, ua)
+		return
+	}
+	text := subtitle_utf8(data)
+	writer.Header().Set("Content-Type", subtitle_formats[format]+"; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(text)))
+	writer.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte(text))
+	service.debug_info.requestServed(int64(len(text)))
+	log("\"GET %s\" 200 %d \"%s\"", query, len(text), ua)
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSubtitles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "subtitles")
+	defer os.RemoveAll(dir)
+	saved_probe, saved_extract := probe_subtitles, extract_subtitle
+	defer func() { probe_subtitles, extract_subtitle = saved_probe, saved_extract }()
+	probe_subtitles = func(full_path string) []subtitleTrack {
+		return []subtitleTrack{{Name: "2", Kind: "embedded", Format: "ass", Language: "fre", stream: 2}}
+	}
+	extract_subtitle = func(full_path string, stream int, format string) ([]byte, error) {
+		return []byte("[Script Info]\n"), nil
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "Movie.mkv"), []byte("video"), 0644)
+	// "Caf\xe9 \x93ol\xe9\x94" is in windows-1252
+	ioutil.WriteFile(filepath.Join(dir, "Movie.es.srt"), []byte("1\n00:00:01,000 --> 00:00:02,000\nCaf\xe9 \x93ol\xe9\x94\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "movie.en.forced.srt"), []byte("1\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "Movie 2.srt"), []byte("1\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "Movie.nfo"), []byte("x"), 0644)
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Movies", path: dir}}}, debug_info: new(debugInfo)}
+
+	recorder := httptest.NewRecorder()
+	service.serve_subtitles(recorder, httptest.NewRequest("GET", "/subtitles?s=Movies&p=/Movie.mkv", nil))
+	tracks := []subtitleTrack{}
+	json.Unmarshal(recorder.Body.Bytes(), &tracks)
+	if len(tracks) != 3 || tracks[0].Name != "Movie.es.srt" || tracks[0].Language != "es" ||
+		tracks[1].Language != "en" || !tracks[1].Forced || tracks[2].Kind != "embedded" {
+		t.Fatalf("Wrong subtitles: %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	service.serve_subtitles(recorder, httptest.NewRequest("GET", tracks[0].URL, nil))
+	if recorder.Body.String() != "1\n00:00:01,000 --> 00:00:02,000\nCafé “olé”\n" ||
+		recorder.Header().Get("Content-Type") != "application/x-subrip; charset=utf-8" {
+		t.Errorf("Wrong subtitle: %s %q", recorder.Header().Get("Content-Type"), recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	service.serve_subtitles(recorder, httptest.NewRequest("GET", tracks[2].URL, nil))
+	if recorder.Body.String() != "[Script Info]\n" || recorder.Header().Get("Content-Type") != "text/x-ssa; charset=utf-8" {
+		t.Errorf("Wrong embedded subtitle: %s %q", recorder.Header().Get("Content-Type"), recorder.Body.String())
+	}
+	for _, target := range []string{
+		"/subtitles?s=Movies&p=/Movie.mkv&file=Movie.nfo",
+		"/subtitles?s=Movies&p=/Movie.mkv&file=../Movie.es.srt",
+		"/subtitles?s=Movies&p=/Movie.mkv&stream=5",
+		"/subtitles?s=Movies&p=/Missing.mkv",
+	} {
+		recorder = httptest.NewRecorder()
+		service.serve_subtitles(recorder, httptest.NewRequest("GET", target, nil))
+		if recorder.Code != 404 {
+			t.Errorf("%d instead of 404 for %s", recorder.Code, target)
+		}
+	}
+}
+
+func TestSubtitleUTF8(t *testing.T) {
+	for data, text := range map[string]string{
+		"\xef\xbb\xbfcaf\xc3\xa9": "café",
+		"caf\xc3\xa9":             "café",
+		"\xff\xfec\x00a\x00":      "ca",
+		"c\x00a\x00f\x00":         "caf",
+		"caf\xe9 \x85":            "café …",
+	} {
+		if got := subtitle_utf8([]byte(data)); got != text {
+			t.Errorf("subtitle_utf8(%q) is %q instead of %q", data, got, text)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// a gallery shows dozens of thumbnails at once, each a round trip through
+// the relay. POST /files/thumbnails takes the paths of all of them and
+// answers with the thumbnails in one response, a multipart/mixed with a
+// part by path, in order, or a zip. a few are made at a time, while the
+// ones made are sent
+
+// the most paths in a batch
+const THUMBNAIL_BATCH_MAX = 200
+
+// how many thumbnails of a batch are made at a time
+const THUMBNAIL_BATCH_WORKERS = 4
+
+type batchThumbnail struct {
+	path      string
+	thumbnail string
+	err       error
+	done      chan bool
+}
+
+// thumbnail_width is the width of the thumbnails asked for by request
+func thumbnail_width(request *http.Request) int {
+	width, _ := strconv.Atoi(request.URL.Query().Get("w"))
+	if caps := devices().capabilities(request); width <= 0 && caps != nil {
+		width = caps.MaxThumbnail
+	}
+	if width <= 0 {
+		width = THUMBNAIL_WIDTH
+	}
+	return artwork_width(width)
+}
+
+// batch_thumbnail makes the thumbnail of path in share, if it can be seen
+func (service *MercuryFsService) batch_thumbnail(request *http.Request, share, path string, width int) (string, error) {
+	full_path, err := service.fullPathToFile(share, path)
+	if err != nil {
+		return "", os.ErrNotExist
+	}
+	fi, err := os.Stat(full_path)
+	if err != nil {
+		return "", os.ErrNotExist
+	}
+	if !fi.Mode().IsRegular() {
+		return "", errNoThumbnail
+	}
+	if profile := parental_profile_of(request); profile != nil {
+		if blocked, _ := profile.blocks(service.Shares.Get(share), fi.Name(), service.metadata_library()); blocked {
+			return "", os.ErrPermission
+		}
+	}
+	return thumbnail_cache.thumbnail(full_path, fi, width)
+}
+
+// POST /files/thumbnails?s=<share>[&w=<width>][&format=zip] with a JSON
+// list of paths sends their thumbnails
+func (service *MercuryFsService) serve_thumbnails(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	share := q.Get("s")
+	var paths []string
+	err := json.NewDecoder(io.LimitReader(request.Body, 1<<20)).Decode(&paths)
+	if err != nil || len(paths) == 0 || len(paths) > THUMBNAIL_BATCH_MAX {
+		size := json_response(writer, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("a list of 1 to %d paths is needed", THUMBNAIL_BATCH_MAX)})
+		service.debug_info.requestServed(size)
+		log("\"POST %s\" 400 %d \"%s\"", query, size, ua)
+		return
+	}
+	if service.Shares.Get(share) == nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"POST %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	width := thumbnail_width(request)
+
+	batch := make([]*batchThumbnail, len(paths))
+	workers := make(chan bool, THUMBNAIL_BATCH_WORKERS)
+	for i, path := range paths {
+		batch[i] = &batchThumbnail{path: path, done: make(chan bool)}
+	}
+	go func() {
+		for _, item := range batch {
+			workers <- true
+			go func(item *batchThumbnail) {
+				defer func() { <-workers }()
+				item.thumbnail, item.err = service.batch_thumbnail(request, share, item.path, width)
+				close(item.done)
+			}(item)
+		}
+	}()
+
+	out := &countingWriter{writer: writer}
+	if q.Get("format") == "zip" || strings.Contains(request.Header.Get("Accept"), "application/zip") {
+		writer.Header().Set("Content-Type", "application/zip")
+		writer.WriteHeader(http.StatusOK)
+		archive := zip.NewWriter(out)
+		for _, item := range batch {
+			<-item.done
+			if item.err != nil {
+				continue
+			}
+			// JPEGs do not get smaller
+			entry, err := archive.CreateHeader(&zip.FileHeader{Name: strings.TrimPrefix(item.path, "/") + ".jpg", Method: zip.Store})
+			if err == nil {
+				copy_file_to(entry, item.thumbnail)
+			}
+		}
+		archive.Close()
+	} else {
+		parts := multipart.NewWriter(out)
+		writer.Header().Set("Content-Type", "multipart/mixed; boundary="+parts.Boundary())
+		writer.WriteHeader(http.StatusOK)
+		for _, item := range batch {
+			<-item.done
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Location", "/files/thumbnail?s="+url.QueryEscape(share)+"&p="+url.QueryEscape(item.path))
+			if item.err != nil {
+				header.Set("Content-Type", "application/json")
+				part, _ := parts.CreatePart(header)
+				json.NewEncoder(part).Encode(map[string]string{"path": item.path, "error": batch_thumbnail_error(item.err)})
+				continue
+			}
+			header.Set("Content-Type", "image/jpeg")
+			if part, err := parts.CreatePart(header); err == nil {
+				copy_file_to(part, item.thumbnail)
+			}
+		}
+		parts.Close()
+	}
+	service.debug_info.requestServed(out.count)
+	log("\"POST %s\" 200 %d \"%s\"", query, out.count, ua)
+}
+
+func batch_thumbnail_error(err error) string {
+	switch {
+	case os.IsNotExist(err):
+		return "not found"
+	case os.IsPermission(err):
+		return "blocked by parental controls"
+	}
+	return err.Error()
+}
+
+// copy_file_to copies the file at path to writer
+func copy_file_to(writer io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
+}
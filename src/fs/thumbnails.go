@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// thumbnails of the pictures and videos in the shares, as JPEGs at most as
+// wide as asked, or as the client said it wants with thumb= in its
+// capabilities. the frame of a video is taken a tenth of the way in with
+// ffmpeg, and videos have no thumbnail when it is not installed, so that
+// clients show their usual icon. thumbnails are kept until the file changes
+// or they are not asked for in a while. a thumbnail asked for again while
+// it's being made waits for it instead of making it twice, and only as many
+// pictures as there are CPUs are shrunk at a time
+
+const THUMBNAIL_DIR = DATA_DIR + "/thumbnails"
+const THUMBNAIL_WIDTH = 320
+const THUMBNAIL_TIMEOUT = 30 * time.Second
+const THUMBNAIL_TTL = 30 * 24 * time.Hour
+
+var errNoThumbnail = errors.New("no thumbnail")
+
+type thumbnailCache struct {
+	dir string
+	// only a few videos are decoded at a time, and pictures shrunk
+	frames chan bool
+	images chan bool
+	// the thumbnails being made, closed when they are
+	making map[string]*thumbnailMaking
+	sync.Mutex
+}
+
+type thumbnailMaking struct {
+	done chan bool
+	err  error
+}
+
+var thumbnail_cache = new_thumbnail_cache(THUMBNAIL_DIR)
+
+func new_thumbnail_cache(dir string) *thumbnailCache {
+	return &thumbnailCache{dir: dir, frames: make(chan bool, 2), images: make(chan bool, runtime.NumCPU()),
+		making: make(map[string]*thumbnailMaking)}
+}
+
+// video_frame extracts a frame of a video as a JPEG width wide, replaced in
+// tests
+var video_frame = ffmpeg_frame
+
+// video_duration is the length of a video in seconds, 0 if not known
+func video_duration(full_path string) float64 {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), THUMBNAIL_TIMEOUT)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", full_path).Output()
+	if err != nil {
+		return 0
+	}
+	duration, _ := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	return duration
+}
+
+// ffmpeg_frame takes the frame a tenth of the way into a video
+func ffmpeg_frame(full_path string, width int) ([]byte, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, errNoThumbnail
+	}
+	at := video_duration(full_path) / 10
+	ctx, cancel := context.WithTimeout(context.Background(), THUMBNAIL_TIMEOUT)
+	defer cancel()
+	command := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-ss", strconv.FormatFloat(at, 'f', 2, 64),
+		"-i", full_path, "-frames:v", "1", "-vf", fmt.Sprintf("scale='min(%d,iw)':-2", width),
+		"-f", "image2", "-c:v", "mjpeg", "-")
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+	out, err := command.Output()
+	if err != nil || len(out) == 0 {
+		debug(2, "Error taking a frame of %s: %v %s", full_path, err, strings.TrimSpace(stderr.String()))
+		return nil, errNoThumbnail
+	}
+	return out, nil
+}
+
+// image_thumbnail shrinks a picture to width, as a JPEG
+func image_thumbnail(full_path string, width int) ([]byte, error) {
+	file, err := os.Open(full_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil || config.Width*config.Height > ARTWORK_MAX_PIXELS {
+		return nil, errNoThumbnail
+	}
+	file.Seek(0, 0)
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, errNoThumbnail
+	}
+	if config.Width > width {
+		height := config.Height * width / config.Width
+		if height < 1 {
+			height = 1
+		}
+		img = scale_image(img, width, height)
+	}
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: ARTWORK_QUALITY}); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// thumbnail returns where the thumbnail of the file at full_path is kept,
+// making it if needed
+func (this *thumbnailCache) thumbnail(full_path string, fi os.FileInfo, width int) (string, error) {
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%d", full_path, fi.Size(), fi.ModTime().UnixNano(), width)
+	thumbnail := filepath.Join(this.dir, sha1string(key)+".jpg")
+	if exists(thumbnail) {
+		// kept as long as it's asked for
+		now := time.Now()
+		os.Chtimes(thumbnail, now, now)
+		return thumbnail, nil
+	}
+	this.Lock()
+	if making, ok := this.making[thumbnail]; ok {
+		this.Unlock()
+		<-making.done
+		if making.err != nil {
+			return "", making.err
+		}
+		return thumbnail, nil
+	}
+	making := &thumbnailMaking{done: make(chan bool)}
+	this.making[thumbnail] = making
+	this.Unlock()
+
+	making.err = this.make(full_path, thumbnail, width)
+	this.Lock()
+	delete(this.making, thumbnail)
+	this.Unlock()
+	close(making.done)
+	if making.err != nil {
+		return "", making.err
+	}
+	return thumbnail, nil
+}
+
+// make makes the thumbnail of the file at full_path
+func (this *thumbnailCache) make(full_path, thumbnail string, width int) error {
+	var data []byte
+	var err error
+	switch mime_type := getContentType(full_path); {
+	case strings.HasPrefix(mime_type, "image/"):
+		this.images <- true
+		data, err = image_thumbnail(full_path, width)
+		<-this.images
+	case strings.HasPrefix(mime_type, "video/"):
+		this.frames <- true
+		data, err = video_frame(full_path, width)
+		<-this.frames
+	default:
+		err = errNoThumbnail
+	}
+	if err != nil {
+		return err
+	}
+	return write_file_atomic(thumbnail, data, 0644)
+}
+
+// cleanup is a job removing the thumbnails not asked for in a while
+func (this *thumbnailCache) cleanup() jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		fis, err := ioutil.ReadDir(this.dir)
+		if os.IsNotExist(err) {
+			return "no thumbnails", nil
+		} else if err != nil {
+			return "", err
+		}
+		removed := 0
+		for i, fi := range fis {
+			progress(int64(i), int64(len(fis)))
+			if time.Since(fi.ModTime()) >= THUMBNAIL_TTL && os.Remove(filepath.Join(this.dir, fi.Name())) == nil {
+				removed++
+			}
+		}
+		return fmt.Sprintf("%d of %d thumbnails expired", removed, len(fis)), nil
+	}
+}
+
+// GET /files/thumbnail?s=<share>&p=<path>[&w=<width>] serves the thumbnail
+// of a picture or a video
+func (service *MercuryFsService) serve_thumbnail(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	full_path, err := service.fullPathToFile(q.Get("s"), q.Get("p"))
+	var fi os.FileInfo
+	if err == nil {
+		if fi, err = os.Stat(full_path); err == nil && !fi.Mode().IsRegular() {
+			err = errNoThumbnail
+		}
+	}
+	if err != nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	if service.parental_block(writer, request, parental_profile_of(request), q.Get("s"), full_path) {
+		return
+	}
+	thumbnail, err := thumbnail_cache.thumbnail(full_path, fi, thumbnail_width(request))
+	if err != nil {
+		status := http.StatusNotFound
+		if err != errNoThumbnail {
+			debug(2, "Error making the thumbnail of %s: %s", full_path, err.Error())
+			status = http.StatusInternalServerError
+		}
+		size := json_response(writer, status, map[string]string{"error": err.Error()})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" %d %d \"%s\"", query, status, size, ua)
+		return
+	}
+	file, err := os.Open(thumbnail)
+	if err != nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	defer file.Close()
+	tfi, _ := file.Stat()
+	writer.Header().Set("Content-Type", "image/jpeg")
+	writer.Header().Set("Cache-Control", "max-age=86400, private")
+	// the thumbnail changes with the file
+	http.ServeContent(writer, request, "", fi.ModTime(), file)
+	service.debug_info.requestServed(tfi.Size())
+	log("\"GET %s\" 200 %d \"%s\"", query, tfi.Size(), ua)
+}
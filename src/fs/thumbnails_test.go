@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThumbnails(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "thumbnails")
+	defer os.RemoveAll(dir)
+	saved_cache, saved_frame := thumbnail_cache, video_frame
+	defer func() { thumbnail_cache, video_frame = saved_cache, saved_frame }()
+	thumbnail_cache = new_thumbnail_cache(filepath.Join(dir, "cache"))
+	frames := 0
+	video_frame = func(full_path string, width int) ([]byte, error) {
+		frames++
+		if filepath.Base(full_path) == "broken.mkv" {
+			return nil, errNoThumbnail
+		}
+		var buffer bytes.Buffer
+		jpeg.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, width, width*9/16)), nil)
+		return buffer.Bytes(), nil
+	}
+
+	files := filepath.Join(dir, "files")
+	os.MkdirAll(files, 0755)
+	var picture bytes.Buffer
+	png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 1000, 500)))
+	ioutil.WriteFile(filepath.Join(files, "photo.png"), picture.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(files, "movie.mkv"), []byte("video"), 0644)
+	ioutil.WriteFile(filepath.Join(files, "broken.mkv"), []byte("video"), 0644)
+	ioutil.WriteFile(filepath.Join(files, "notes.txt"), []byte("text"), 0644)
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Files", path: files}}}, debug_info: new(debugInfo)}
+	thumbnail := func(target string) (int, image.Config) {
+		recorder := httptest.NewRecorder()
+		service.serve_thumbnail(recorder, httptest.NewRequest("GET", target, nil))
+		config, _ := jpeg.DecodeConfig(recorder.Body)
+		return recorder.Code, config
+	}
+
+	if code, config := thumbnail("/files/thumbnail?s=Files&p=/photo.png&w=100"); code != 200 || config.Width != 160 || config.Height != 80 {
+		t.Errorf("Wrong picture thumbnail: %d %+v", code, config)
+	}
+	if code, config := thumbnail("/files/thumbnail?s=Files&p=/photo.png"); code != 200 || config.Width != THUMBNAIL_WIDTH {
+		t.Errorf("Wrong default thumbnail: %d %+v", code, config)
+	}
+	for i := 0; i < 2; i++ {
+		if code, config := thumbnail("/files/thumbnail?s=Files&p=/movie.mkv&w=480"); code != 200 || config.Width != 480 {
+			t.Errorf("Wrong video thumbnail: %d %+v", code, config)
+		}
+	}
+	if frames != 1 {
+		t.Errorf("%d frames taken instead of 1", frames)
+	}
+	for _, target := range []string{
+		"/files/thumbnail?s=Files&p=/broken.mkv",
+		"/files/thumbnail?s=Files&p=/notes.txt",
+		"/files/thumbnail?s=Files&p=/missing.png",
+		"/files/thumbnail?s=Files&p=/",
+	} {
+		if code, _ := thumbnail(target); code != 404 {
+			t.Errorf("%d instead of 404 for %s", code, target)
+		}
+	}
+
+	// a changed file gets a new thumbnail
+	ioutil.WriteFile(filepath.Join(files, "movie.mkv"), []byte("another video"), 0644)
+	thumbnail("/files/thumbnail?s=Files&p=/movie.mkv&w=480")
+	if frames != 3 {
+		t.Errorf("%d frames taken instead of 3", frames)
+	}
+}
+
+func TestThumbnailBatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "thumbnails")
+	defer os.RemoveAll(dir)
+	saved_cache, saved_frame := thumbnail_cache, video_frame
+	defer func() { thumbnail_cache, video_frame = saved_cache, saved_frame }()
+	thumbnail_cache = new_thumbnail_cache(filepath.Join(dir, "cache"))
+	var frames int32
+	video_frame = func(full_path string, width int) ([]byte, error) {
+		atomic.AddInt32(&frames, 1)
+		time.Sleep(20 * time.Millisecond)
+		var buffer bytes.Buffer
+		jpeg.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, width, width*9/16)), nil)
+		return buffer.Bytes(), nil
+	}
+
+	files := filepath.Join(dir, "files")
+	os.MkdirAll(files, 0755)
+	var picture bytes.Buffer
+	png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 1000, 500)))
+	ioutil.WriteFile(filepath.Join(files, "photo.png"), picture.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(files, "movie.mkv"), []byte("video"), 0644)
+	ioutil.WriteFile(filepath.Join(files, "notes.txt"), []byte("text"), 0644)
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Files", path: files}}}, debug_info: new(debugInfo)}
+	batch := func(target, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		service.serve_thumbnails(recorder, httptest.NewRequest("POST", target, strings.NewReader(body)))
+		return recorder
+	}
+
+	// asked for together, a video is taken a frame of once
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch("/files/thumbnails?s=Files&w=160", `["/movie.mkv"]`)
+		}()
+	}
+	wg.Wait()
+	if frames != 1 {
+		t.Errorf("%d frames taken instead of 1", frames)
+	}
+
+	response := batch("/files/thumbnails?s=Files&w=160", `["/photo.png", "/missing.png", "/notes.txt", "/movie.mkv"]`)
+	media_type, params, _ := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	if response.Code != 200 || media_type != "multipart/mixed" {
+		t.Fatalf("Wrong batch: %d %s", response.Code, media_type)
+	}
+	parts := multipart.NewReader(response.Body, params["boundary"])
+	want := []string{"image/jpeg /photo.png", "application/json /missing.png", "application/json /notes.txt", "image/jpeg /movie.mkv"}
+	for _, expected := range want {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatalf("Missing part for %s: %s", expected, err)
+		}
+		data, _ := ioutil.ReadAll(part)
+		location, _ := url.Parse(part.Header.Get("Content-Location"))
+		if got := part.Header.Get("Content-Type") + " " + location.Query().Get("p"); got != expected {
+			t.Errorf("Wrong part: %s instead of %s", got, expected)
+		}
+		if config, err := jpeg.DecodeConfig(bytes.NewReader(data)); strings.HasPrefix(expected, "image/") && (err != nil || config.Width != 160) {
+			t.Errorf("Wrong thumbnail for %s: %+v", expected, config)
+		}
+	}
+
+	response = batch("/files/thumbnails?s=Files&format=zip", `["/photo.png", "/notes.txt"]`)
+	archive, err := zip.NewReader(bytes.NewReader(response.Body.Bytes()), int64(response.Body.Len()))
+	if err != nil || len(archive.File) != 1 || archive.File[0].Name != "photo.png.jpg" {
+		t.Errorf("Wrong zip: %v %v", err, archive)
+	}
+
+	for _, body := range []string{"", "[]", `{"p": "/photo.png"}`} {
+		if response := batch("/files/thumbnails?s=Files", body); response.Code != 400 {
+			t.Errorf("%d instead of 400 for %q", response.Code, body)
+		}
+	}
+	if response := batch("/files/thumbnails?s=Nope", `["/photo.png"]`); response.Code != 404 {
+		t.Errorf("%d instead of 404 for a missing share", response.Code)
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the files of the shares with a policy in the tiering section of the
+// config that were not used in a while are moved to the archive, a
+// directory on a secondary disk, in the same relative path:
+//
+//	<archive>/<share>/<dir>/<file>
+//
+// and replaced with a symlink to it, so that they are listed and served as
+// before, by every protocol. POST /files/recall moves one back. files
+// smaller than TIERING_MIN_SIZE are not worth it and stay
+
+const TIERING_JOB = "cold-storage"
+const TIERING_MIN_SIZE = 1 << 20
+
+var errNoArchive = errors.New("the archive is not available")
+var errNotArchived = errors.New("not in the archive")
+
+type tieringState struct {
+	archived   int64
+	recalled   int64
+	bytes      int64
+	last_error string
+	sync.Mutex
+}
+
+var tiering = new(tieringState)
+
+// tiering_after is how long the files of share are kept when not used,
+// 0 for ever
+func tiering_after(share *HdaShare) time.Duration {
+	if config.Tiering.Archive == "" {
+		return 0
+	}
+	after, err := time.ParseDuration(config.Tiering.Shares[share.name])
+	if err != nil || after <= 0 {
+		return 0
+	}
+	return after
+}
+
+// archive_path is where the file at relative in share goes in the archive
+func archive_path(share *HdaShare, relative string) string {
+	return filepath.Join(config.Tiering.Archive, share.name, filepath.FromSlash(relative))
+}
+
+// last_used is the last time a file was read or written, as far as the
+// file system knows
+func last_used(fi os.FileInfo) time.Time {
+	used := fi.ModTime()
+	if atime := access_time(fi); atime.After(used) {
+		used = atime
+	}
+	return used
+}
+
+// stub_info is what a symlink to a file, like the ones left for archived
+// files, is listed as: the file it points to. dir is where it is
+func stub_info(fi os.FileInfo, dir string) os.FileInfo {
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return fi
+	}
+	target, err := os.Stat(filepath.Join(dir, fi.Name()))
+	if err != nil || !target.Mode().IsRegular() {
+		return fi
+	}
+	return target
+}
+
+// copy_file copies the file at from to to, through a temporary file so
+// that there is never half of it, with the mode and times of fi
+func copy_file(from, to string, fi os.FileInfo) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(to), "."+filepath.Base(to))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, source)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), fi.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), access_time(fi), fi.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), to)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// archive moves the file at relative in share to the archive, leaving a
+// symlink to it. nothing is done if it changes in the meantime
+func archive_file(share *HdaShare, relative string, fi os.FileInfo) error {
+	full_path := filepath.Join(share.path, filepath.FromSlash(relative))
+	archived := archive_path(share, relative)
+	if err := copy_file(full_path, archived, fi); err != nil {
+		return err
+	}
+	stub := filepath.Join(filepath.Dir(full_path), "."+filepath.Base(full_path)+".stub")
+	os.Remove(stub)
+	err := os.Symlink(archived, stub)
+	if err == nil {
+		if now, serr := os.Lstat(full_path); serr != nil || now.Size() != fi.Size() || !now.ModTime().Equal(fi.ModTime()) {
+			err = fmt.Errorf("%s changed", relative)
+		}
+	}
+	if err == nil {
+		err = os.Rename(stub, full_path)
+	}
+	if err != nil {
+		os.Remove(stub)
+		os.Remove(archived)
+	}
+	return err
+}
+
+// recall_file moves an archived file back in place of its symlink
+func recall_file(share *HdaShare, relative string) error {
+	full_path := filepath.Join(share.path, filepath.FromSlash(relative))
+	archived := archive_path(share, relative)
+	if config.Tiering.Archive == "" {
+		return errNotArchived
+	}
+	if target, err := os.Readlink(full_path); err != nil || target != archived {
+		return errNotArchived
+	}
+	fi, err := os.Stat(archived)
+	if err != nil {
+		return errNoArchive
+	}
+	// the copy replaces the symlink
+	if err := copy_file(archived, full_path, fi); err != nil {
+		return err
+	}
+	os.Remove(archived)
+	// it was just asked for
+	now := time.Now()
+	os.Chtimes(full_path, now, fi.ModTime())
+	tiering.Lock()
+	tiering.recalled++
+	tiering.Unlock()
+	return nil
+}
+
+// tiering_job archives the files of the shares not used in a while
+func tiering_job(shares *HdaShares) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		if config.Tiering.Archive == "" {
+			return "no archive", nil
+		}
+		if fi, err := os.Stat(config.Tiering.Archive); err != nil || !fi.IsDir() {
+			// not mounted, most likely. it is not made here, so as not to
+			// fill the disk it's mounted on
+			tiering.Lock()
+			tiering.last_error = errNoArchive.Error()
+			tiering.Unlock()
+			return "", errNoArchive
+		}
+		shares.RLock()
+		list := make([]HdaShare, 0, len(shares.Shares))
+		for _, share := range shares.Shares {
+			list = append(list, HdaShare{name: share.name, path: share.path, problem: share.problem, network: share.network})
+		}
+		shares.RUnlock()
+		archived, size := 0, int64(0)
+		var last_err error
+		for i := range list {
+			share := &list[i]
+			after := tiering_after(share)
+			if after == 0 || share.problem != "" || share.network {
+				continue
+			}
+			filepath.Walk(share.path, func(full_path string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				if strings.HasPrefix(fi.Name(), ".") && full_path != share.path {
+					if fi.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if !fi.Mode().IsRegular() || fi.Size() < TIERING_MIN_SIZE || time.Since(last_used(fi)) < after {
+					return nil
+				}
+				relative := path.Clean("/" + filepath.ToSlash(strings.TrimPrefix(full_path, share.path)))
+				if err := archive_file(share, relative, fi); err != nil {
+					debug(2, "Error archiving %s: %s", full_path, err.Error())
+					last_err = err
+					return nil
+				}
+				archived++
+				size += fi.Size()
+				return nil
+			})
+		}
+		tiering.Lock()
+		tiering.archived += int64(archived)
+		tiering.bytes += size
+		tiering.last_error = ""
+		if last_err != nil {
+			tiering.last_error = last_err.Error()
+		}
+		tiering.Unlock()
+		return fmt.Sprintf("%d files archived, %d bytes", archived, size), nil
+	}
+}
+
+func (this *tieringState) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	status := map[string]interface{}{"archive": config.Tiering.Archive, "archived": this.archived, "recalled": this.recalled, "bytes": this.bytes}
+	if this.last_error != "" {
+		status["last_error"] = this.last_error
+	}
+	return status
+}
+
+// POST /files/recall?s=<share>&p=<path> moves an archived file back
+func (service *MercuryFsService) recall_archived(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	share := service.Shares.Get(q.Get("s"))
+	relative := path.Clean("/" + q.Get("p"))
+	status := http.StatusOK
+	result := map[string]string{"path": relative}
+	if share == nil || relative == "/" {
+		status, result = http.StatusNotFound, map[string]string{"error": "no such file"}
+	} else if no_upload {
+		debug(2, "NOTICE: Running in no-upload mode.")
+		status, result = http.StatusForbidden, map[string]string{"error": "uploads are disabled"}
+	} else if err := recall_file(share, relative); err != nil {
+		debug(2, "Error recalling %s: %s", relative, err.Error())
+		switch err {
+		case errNotArchived:
+			status = http.StatusNotFound
+		case errNoArchive:
+			status = http.StatusServiceUnavailable
+		default:
+			status = http.StatusInternalServerError
+		}
+		result = map[string]string{"error": err.Error()}
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+}
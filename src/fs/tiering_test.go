@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestColdStorage(t *testing.T) {
+	saved := config.Tiering
+	defer func() { config.Tiering = saved }()
+
+	dir, _ := ioutil.TempDir("", "tiering")
+	defer os.RemoveAll(dir)
+	movies, archive := filepath.Join(dir, "Movies"), filepath.Join(dir, "archive")
+	config.Tiering.Archive = archive
+	config.Tiering.Shares = map[string]string{"Movies": "720h"}
+	share := &HdaShare{name: "Movies", path: movies}
+	shares := &HdaShares{Shares: []*HdaShare{share, {name: "Docs", path: filepath.Join(dir, "Docs")}}}
+
+	big := bytes.Repeat([]byte("x"), TIERING_MIN_SIZE)
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	for name, data := range map[string][]byte{"/Old/movie.mkv": big, "/new.mkv": big, "/small.srt": []byte("subs"), "/.trash/movie.mkv": big} {
+		full_path := filepath.Join(movies, name)
+		os.MkdirAll(filepath.Dir(full_path), 0755)
+		ioutil.WriteFile(full_path, data, 0644)
+		if name != "/new.mkv" {
+			os.Chtimes(full_path, old, old)
+		}
+	}
+
+	// nothing is done while the archive is not mounted
+	if _, err := tiering_job(shares)(func(done, total int64) {}); err != errNoArchive {
+		t.Fatalf("Archived without an archive: %v", err)
+	}
+	os.MkdirAll(archive, 0755)
+	if result, err := tiering_job(shares)(func(done, total int64) {}); err != nil || !strings.HasPrefix(result, "1 files archived") {
+		t.Fatalf("Wrong files archived: %s %v", result, err)
+	}
+	full_path := filepath.Join(movies, "Old", "movie.mkv")
+	if target, err := os.Readlink(full_path); err != nil || target != filepath.Join(archive, "Movies", "Old", "movie.mkv") {
+		t.Fatalf("No symlink to the archive: %q %v", target, err)
+	}
+	if data, _ := ioutil.ReadFile(full_path); !bytes.Equal(data, big) {
+		t.Errorf("The archived file cannot be read")
+	}
+
+	// listed as it was
+	file, _ := os.Open(filepath.Join(movies, "Old"))
+	listing, _ := dirToJSON(file, filepath.Join(movies, "Old"))
+	file.Close()
+	if !strings.Contains(listing, `"size":1048576`) || !strings.Contains(listing, "video/") {
+		t.Errorf("Wrong listing of an archived file: %s", listing)
+	}
+
+	service := &MercuryFsService{Shares: shares, debug_info: new(debugInfo)}
+	recall := func(target string) int {
+		recorder := httptest.NewRecorder()
+		service.recall_archived(recorder, httptest.NewRequest("POST", target, nil))
+		return recorder.Code
+	}
+	if code := recall("/files/recall?s=Movies&p=/new.mkv"); code != 404 {
+		t.Errorf("Recalled a file that is not archived: %d", code)
+	}
+	if code := recall("/files/recall?s=Movies&p=/Old/movie.mkv"); code != 200 {
+		t.Fatalf("Could not recall a file: %d", code)
+	}
+	if fi, err := os.Lstat(full_path); err != nil || !fi.Mode().IsRegular() || fi.Size() != int64(len(big)) || fi.ModTime().Unix() != old.Unix() {
+		t.Errorf("Wrong recalled file: %v %v", fi, err)
+	}
+	if exists(filepath.Join(archive, "Movies", "Old", "movie.mkv")) {
+		t.Errorf("The archived copy was left")
+	}
+}
@@ -0,0 +1,627 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// videos the client cannot play, like MKV or HEVC on most phones, are
+// transcoded to HLS with ffmpeg while they are watched. a transcode is a
+// session, started with POST /transcode or by asking for the file with
+// GET /files, which redirects to the playlist of the session:
+//
+//	/transcode/<session>/index.m3u8
+//
+// the quality is the best of the ladder that is not bigger than the video
+// and fits in the bitrate asked for, if any. H.264 videos that do not need
+// to be scaled are only repackaged. the encoder is the first of the
+// hardware ones that works, or libx264, unless one is set in the transcode
+// section of the config, see transcode_backends.go. sessions not watched
+// for a while are stopped and their segments removed. videos transcoded
+// ahead of time are served as they are, see transcode_pregen.go. with the
+// quality "auto", several qualities are transcoded at once for the client
+// to switch between, see transcode_adaptive.go
+
+const TRANSCODE_DIR = DATA_DIR + "/transcode"
+const TRANSCODE_JOB = "transcode-cleanup"
+const TRANSCODE_SEGMENT = 6
+const TRANSCODE_IDLE = 5 * time.Minute
+
+// running sessions not watched for this long make room for new ones
+const TRANSCODE_EVICT = 30 * time.Second
+
+// how long to wait for the first segment, or for the next one
+const TRANSCODE_WAIT = 30 * time.Second
+
+var errNoTranscoder = errors.New("no video encoder")
+var errTooManyTranscodes = errors.New("too many transcodes")
+var errNoSuchTranscode = errors.New("no such transcode")
+
+var transcode_segment_pattern = regexp.MustCompile(`^seg[0-9]{5}\.ts$`)
+
+// a step of the bitrate ladder, in kbit/s
+type transcodeRung struct {
+	Name   string `json:"name"`
+	Height int    `json:"height"`
+	Video  int    `json:"video"`
+	Audio  int    `json:"audio"`
+}
+
+var transcode_ladder = []transcodeRung{
+	{Name: "1080p", Height: 1080, Video: 5000, Audio: 192},
+	{Name: "720p", Height: 720, Video: 2800, Audio: 128},
+	{Name: "480p", Height: 480, Video: 1400, Audio: 128},
+	{Name: "360p", Height: 360, Video: 800, Audio: 96},
+	{Name: "240p", Height: 240, Video: 400, Audio: 64},
+}
+
+type videoInfo struct {
+	Codec   string
+	Height  int
+	NoAudio bool
+}
+
+// probe_video finds the codec and height of a video, replaced in tests
+var probe_video = ffprobe_video
+
+// run_ffmpeg runs ffmpeg until it's done or ctx is cancelled, replaced in
+// tests
+var run_ffmpeg = func(ctx context.Context, args []string) error {
+	command := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%s: %s", err.Error(), message)
+		}
+		return err
+	}
+	return nil
+}
+
+func ffprobe_video(full_path string) videoInfo {
+	info := videoInfo{}
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return info
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error",
+		"-show_entries", "stream=codec_type,codec_name,height", "-of", "json", full_path).Output()
+	if err != nil {
+		debug(2, "Error probing %s: %s", full_path, err.Error())
+		return info
+	}
+	var probe struct {
+		Streams []struct {
+			Type   string `json:"codec_type"`
+			Codec  string `json:"codec_name"`
+			Height int    `json:"height"`
+		} `json:"streams"`
+	}
+	if json.Unmarshal(out, &probe) != nil {
+		return info
+	}
+	info.NoAudio = true
+	for _, stream := range probe.Streams {
+		switch {
+		case stream.Type == "video" && info.Codec == "":
+			info.Codec, info.Height = stream.Codec, stream.Height
+		case stream.Type == "audio":
+			info.NoAudio = false
+		}
+	}
+	return info
+}
+
+// pick_rung is the step of the ladder for a video height pixels high (0
+// if not known), named name or not more than max_kbps if given
+func pick_rung(height, max_kbps int, name string) (transcodeRung, bool) {
+	if height <= 0 {
+		height = 720
+	}
+	for _, rung := range transcode_ladder {
+		if name != "" {
+			if rung.Name == name {
+				return rung, true
+			}
+			continue
+		}
+		if rung.Height > height && rung != transcode_ladder[len(transcode_ladder)-1] {
+			continue
+		}
+		if max_kbps > 0 && rung.Video+rung.Audio > max_kbps {
+			continue
+		}
+		return rung, true
+	}
+	if name != "" {
+		return transcodeRung{}, false
+	}
+	return transcode_ladder[len(transcode_ladder)-1], true
+}
+
+// transcode_args are the arguments of ffmpeg to transcode full_path into
+// dir, copying the video when encoder is "copy"
+func transcode_args(full_path, dir string, rung transcodeRung, encoder string) []string {
+	args := []string{"-v", "error"}
+	video := []string{"-c:v", "copy"}
+	if encoder != "copy" {
+		e := find_encoder(encoder)
+		args = append(args, e.input_args()...)
+		filter := fmt.Sprintf("scale=-2:'min(%d,ih)'", rung.Height)
+		if e.filter != "" {
+			filter += "," + e.filter
+		}
+		video = append([]string{"-vf", filter, "-c:v", e.name}, e.args...)
+		video = append(video, "-b:v", fmt.Sprintf("%dk", rung.Video), "-maxrate", fmt.Sprintf("%dk", rung.Video),
+			"-bufsize", fmt.Sprintf("%dk", 2*rung.Video),
+			"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", TRANSCODE_SEGMENT))
+	}
+	args = append(args, "-i", full_path, "-map", "0:v:0", "-map", "0:a:0?", "-sn")
+	args = append(args, video...)
+	args = append(args, "-c:a", "aac", "-ac", "2", "-b:a", fmt.Sprintf("%dk", rung.Audio),
+		"-f", "hls", "-hls_time", strconv.Itoa(TRANSCODE_SEGMENT), "-hls_playlist_type", "event",
+		"-hls_segment_filename", filepath.Join(dir, "seg%05d.ts"), filepath.Join(dir, "index.m3u8"))
+	return args
+}
+
+type transcodeSession struct {
+	ID         string    `json:"id"`
+	File       string    `json:"file"`
+	Rung       string    `json:"rung"`
+	Encoder    string    `json:"encoder"`
+	Started    time.Time `json:"started"`
+	LastAccess time.Time `json:"last_access"`
+	Running    bool      `json:"running"`
+	Fallback   bool      `json:"fallback,omitempty"`
+	Pregen     bool      `json:"pregenerated,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	// the qualities of adaptive sessions, and what the client watched
+	Rungs    []string       `json:"rungs,omitempty"`
+	Segments map[string]int `json:"segments,omitempty"`
+	Switches int            `json:"switches"`
+	Waits    int            `json:"waits"`
+	Stalls   int            `json:"stalls"`
+	// in kbit/s, as reported by the client
+	Bandwidth int `json:"bandwidth,omitempty"`
+	current   string
+	dir       string
+	cancel    context.CancelFunc
+	done      chan bool
+}
+
+type transcoder struct {
+	dir      string
+	sessions map[string]*transcodeSession
+	encoder  string
+	detected sync.Once
+	sync.Mutex
+}
+
+var transcoders = new_transcoder(TRANSCODE_DIR)
+
+func new_transcoder(dir string) *transcoder {
+	return &transcoder{dir: dir, sessions: make(map[string]*transcodeSession)}
+}
+
+func init() {
+	converters["application/x-mpegURL"] = transcode_converter
+}
+
+func (this *transcoder) video_encoder() string {
+	this.detected.Do(func() {
+		if config.Transcode.Encoder != "" {
+			this.encoder = config.Transcode.Encoder
+		} else {
+			this.encoder = detect_encoder()
+		}
+		if this.encoder != "" {
+			log("Transcoding videos with %s", this.encoder)
+		}
+	})
+	return this.encoder
+}
+
+// start transcodes the video at full_path, or returns the session already
+// doing it
+func (this *transcoder) start(full_path string, max_kbps int, name string) (*transcodeSession, error) {
+	info := probe_video(full_path)
+	var rung transcodeRung
+	var rungs []transcodeRung
+	ok := true
+	if name == TRANSCODE_AUTO {
+		rungs = adaptive_rungs(info.Height, max_kbps)
+		rung.Name = TRANSCODE_AUTO
+	} else {
+		rung, ok = pick_rung(info.Height, max_kbps, name)
+	}
+	if !ok {
+		return nil, fmt.Errorf("no such quality: %s", name)
+	}
+	pregenerated := transcode_pregen.find(full_path, rung.Name)
+	encoder := this.video_encoder()
+	if rungs == nil && info.Codec == "h264" && info.Height > 0 && info.Height <= rung.Height && max_kbps <= 0 {
+		encoder = "copy"
+	} else if encoder == "" && pregenerated == "" {
+		return nil, errNoTranscoder
+	}
+	args := func(dir, encoder string) []string {
+		if rungs != nil {
+			return adaptive_args(full_path, dir, rungs, encoder, !info.NoAudio)
+		}
+		return transcode_args(full_path, dir, rung, encoder)
+	}
+
+	this.Lock()
+	defer this.Unlock()
+	running := []*transcodeSession{}
+	for _, session := range this.sessions {
+		if session.File == full_path && session.Rung == rung.Name && session.Error == "" {
+			session.LastAccess = time.Now()
+			return session, nil
+		}
+		if session.Running {
+			running = append(running, session)
+		}
+	}
+	transcode_pregen.played(full_path)
+	if pregenerated != "" {
+		session := new_transcode_session(full_path, rung.Name, "")
+		session.dir, session.Pregen, session.Running = pregenerated, true, false
+		session.cancel = func() {}
+		close(session.done)
+		this.sessions[session.ID] = session
+		debug(2, "Serving %s at %s as pregenerated", full_path, rung.Name)
+		return session, nil
+	}
+	if max := config.Transcode.MaxSessions; max > 0 && len(running) >= max {
+		sort.Slice(running, func(i, j int) bool { return running[i].LastAccess.Before(running[j].LastAccess) })
+		if time.Since(running[0].LastAccess) < TRANSCODE_EVICT {
+			return nil, errTooManyTranscodes
+		}
+		this.remove(running[0])
+	}
+
+	session := new_transcode_session(full_path, rung.Name, encoder)
+	session.dir = filepath.Join(this.dir, session.ID)
+	if err := os.MkdirAll(session.dir, 0755); err != nil {
+		return nil, err
+	}
+	if rungs != nil {
+		for _, rung := range rungs {
+			session.Rungs = append(session.Rungs, rung.Name)
+		}
+		if err := write_master_playlist(session.dir, rungs); err != nil {
+			os.RemoveAll(session.dir)
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	session.cancel = cancel
+	this.sessions[session.ID] = session
+	run := run_ffmpeg
+	go func() {
+		err := run(ctx, args(session.dir, encoder))
+		if software := software_fallback(encoder); err != nil && ctx.Err() == nil && software != "" && !this.started(session) {
+			log("Transcoding %s with %s failed, transcoding in software", full_path, encoder)
+			debug(2, "Error transcoding %s with %s: %s", full_path, encoder, err.Error())
+			this.Lock()
+			session.Encoder, session.Fallback = software, true
+			this.Unlock()
+			err = run(ctx, args(session.dir, software))
+		}
+		this.Lock()
+		session.Running = false
+		if err != nil && ctx.Err() == nil {
+			debug(2, "Error transcoding %s: %s", full_path, err.Error())
+			session.Error = err.Error()
+		}
+		this.Unlock()
+		close(session.done)
+	}()
+	debug(2, "Transcoding %s at %s with %s", full_path, rung.Name, encoder)
+	return session, nil
+}
+
+func new_transcode_session(full_path, rung, encoder string) *transcodeSession {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &transcodeSession{
+		ID:         hex.EncodeToString(id),
+		File:       full_path,
+		Rung:       rung,
+		Encoder:    encoder,
+		Started:    time.Now(),
+		LastAccess: time.Now(),
+		Running:    true,
+		Segments:   make(map[string]int),
+		done:       make(chan bool),
+	}
+}
+
+// started says if a session has made a segment
+func (this *transcoder) started(session *transcodeSession) bool {
+	playlist := filepath.Join(session.dir, "index.m3u8")
+	if len(session.Rungs) > 0 {
+		playlist = filepath.Join(session.dir, session.Rungs[0], "index.m3u8")
+	}
+	data, err := ioutil.ReadFile(playlist)
+	return err == nil && bytes.Contains(data, []byte("#EXTINF"))
+}
+
+// remove stops a session and removes its segments, with the lock held.
+// pregenerated ones stay
+func (this *transcoder) remove(session *transcodeSession) {
+	session.cancel()
+	delete(this.sessions, session.ID)
+	if session.Pregen {
+		return
+	}
+	go func() {
+		<-session.done
+		os.RemoveAll(session.dir)
+	}()
+}
+
+func (this *transcoder) stop(id string) bool {
+	this.Lock()
+	defer this.Unlock()
+	session := this.sessions[id]
+	if session != nil {
+		this.remove(session)
+	}
+	return session != nil
+}
+
+// file waits for a file of a session to be ready and returns its path. the
+// playlist is ready with its first segment, and segments once they are in
+// the playlist. the files of the qualities of adaptive sessions are in a
+// directory of each, like "480p/seg00003.ts"
+func (this *transcoder) file(id, name string, timeout time.Duration) (string, error) {
+	rung, file := "", name
+	if i := strings.Index(name, "/"); i >= 0 {
+		rung, file = name[:i], name[i+1:]
+	}
+	this.Lock()
+	session := this.sessions[id]
+	if session != nil {
+		session.LastAccess = time.Now()
+	}
+	this.Unlock()
+	if session == nil || (file != "index.m3u8" && !transcode_segment_pattern.MatchString(file)) {
+		if session != nil && name == TRANSCODE_MASTER && len(session.Rungs) > 0 {
+			return filepath.Join(session.dir, TRANSCODE_MASTER), nil
+		}
+		return "", errNoSuchTranscode
+	}
+	if (rung == "") != (len(session.Rungs) == 0) || (rung != "" && !session.has_rung(rung)) {
+		return "", errNoSuchTranscode
+	}
+	playlist := filepath.Join(session.dir, rung, "index.m3u8")
+	wanted := []byte("#EXTINF")
+	if file != "index.m3u8" {
+		wanted = []byte(file)
+	}
+	waited := false
+	deadline := time.Now().Add(timeout)
+	for {
+		finished := false
+		select {
+		case <-session.done:
+			finished = true
+		default:
+		}
+		if data, err := ioutil.ReadFile(playlist); err == nil && bytes.Contains(data, wanted) {
+			if file != "index.m3u8" {
+				// the client waiting for a segment past the first ran out of video
+				this.watched(session, rung, waited && file != "seg00000.ts")
+			}
+			return filepath.Join(session.dir, rung, file), nil
+		}
+		if finished {
+			if session.Error != "" {
+				return "", errors.New(session.Error)
+			}
+			return "", errNoSuchTranscode
+		}
+		if time.Now().After(deadline) {
+			return "", errNoSuchTranscode
+		}
+		waited = true
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// cleanup is a job stopping the sessions not watched in a while
+func (this *transcoder) cleanup() jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		this.Lock()
+		removed := 0
+		for _, session := range this.sessions {
+			if time.Since(session.LastAccess) >= TRANSCODE_IDLE {
+				this.remove(session)
+				removed++
+			}
+		}
+		sessions := len(this.sessions)
+		// and what is left of the sessions before a restart
+		fis, _ := ioutil.ReadDir(this.dir)
+		for _, fi := range fis {
+			if this.sessions[fi.Name()] == nil && time.Since(fi.ModTime()) >= TRANSCODE_IDLE {
+				os.RemoveAll(filepath.Join(this.dir, fi.Name()))
+			}
+		}
+		this.Unlock()
+		return fmt.Sprintf("%d transcodes stopped, %d left", removed, sessions), nil
+	}
+}
+
+func (this *transcoder) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	sessions := []transcodeSession{}
+	for _, session := range this.sessions {
+		sessions = append(sessions, session.snapshot())
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	return map[string]interface{}{"encoder": this.encoder, "sessions": sessions, "backends": encoder_probes.status(),
+		"pregenerated": transcode_pregen.status(), "qualities": transcode_quality_stats()}
+}
+
+// running is how many videos are being transcoded
+func (this *transcoder) running() int {
+	this.Lock()
+	defer this.Unlock()
+	running := 0
+	for _, session := range this.sessions {
+		if session.Running {
+			running++
+		}
+	}
+	return running
+}
+
+func transcode_playlist(id string) string {
+	return "/transcode/" + id + "/index.m3u8"
+}
+
+// transcode_converter sends the clients that cannot play a video to the
+// playlist of its transcode. guests get the original
+func transcode_converter(writer http.ResponseWriter, request *http.Request, full_path string) (int64, error) {
+	if guest_pass_of(request) != nil {
+		return 0, errNoTranscoder
+	}
+	max_kbps, _ := strconv.Atoi(request.URL.Query().Get("b"))
+	session, err := transcoders.start(full_path, max_kbps, request.URL.Query().Get("q"))
+	if err != nil {
+		return 0, err
+	}
+	playlist := transcode_playlist(session.ID)
+	if len(session.Rungs) > 0 {
+		playlist = adaptive_playlist(session.ID)
+	}
+	http.Redirect(writer, request, playlist, http.StatusFound)
+	return 0, nil
+}
+
+// POST /transcode?s=<share>&p=<path>[&q=<quality>][&b=<kbit/s>] starts
+// transcoding a video
+func (service *MercuryFsService) start_transcode(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	full_path, err := service.fullPathToFile(q.Get("s"), q.Get("p"))
+	if err == nil {
+		if fi, serr := os.Stat(full_path); serr != nil || !fi.Mode().IsRegular() {
+			err = errNoSuchTranscode
+		}
+	}
+	if err != nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"POST %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	if service.parental_block(writer, request, parental_profile_of(request), q.Get("s"), full_path) {
+		return
+	}
+	status := http.StatusCreated
+	var result interface{}
+	max_kbps, _ := strconv.Atoi(q.Get("b"))
+	session, err := transcoders.start(full_path, max_kbps, q.Get("q"))
+	switch {
+	case err == errNoTranscoder:
+		status, result = http.StatusNotImplemented, map[string]string{"error": err.Error()}
+	case err == errTooManyTranscodes:
+		status, result = http.StatusServiceUnavailable, map[string]string{"error": err.Error()}
+	case err != nil:
+		status, result = http.StatusBadRequest, map[string]string{"error": err.Error()}
+	case len(session.Rungs) > 0:
+		result = map[string]interface{}{"session": session.ID, "playlist": adaptive_playlist(session.ID), "quality": session.Rung,
+			"qualities": session.Rungs, "encoder": session.Encoder}
+	default:
+		result = map[string]string{"session": session.ID, "playlist": transcode_playlist(session.ID), "quality": session.Rung, "encoder": session.Encoder}
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+}
+
+// GET /transcode/{session}/index.m3u8 and the segments it lists, and
+// GET /transcode/{session}/{rung}/{file} for adaptive sessions
+func (service *MercuryFsService) serve_transcode(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	vars := mux.Vars(request)
+	name := vars["file"]
+	if vars["rung"] != "" {
+		name = vars["rung"] + "/" + name
+	}
+	path, err := transcoders.file(vars["session"], name, TRANSCODE_WAIT)
+	var file *os.File
+	if err == nil {
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		status := http.StatusNotFound
+		if err != errNoSuchTranscode {
+			status = http.StatusInternalServerError
+		}
+		size := json_response(writer, status, map[string]string{"error": err.Error()})
+		service.debug_info.requestServed(size)
+		log("\"GET %s\" %d %d \"%s\"", query, status, size, ua)
+		return
+	}
+	defer file.Close()
+	fi, _ := file.Stat()
+	if strings.HasSuffix(name, ".m3u8") {
+		// it grows while the video is transcoded
+		writer.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		writer.Header().Set("Cache-Control", "no-cache")
+	} else {
+		writer.Header().Set("Content-Type", "video/MP2T")
+	}
+	http.ServeContent(writer, request, "", fi.ModTime(), file)
+	service.debug_info.requestServed(fi.Size())
+	log("\"GET %s\" 200 %d \"%s\"", query, fi.Size(), ua)
+}
+
+// DELETE /transcode/{session} stops a transcode
+func (service *MercuryFsService) stop_transcode(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status := http.StatusNoContent
+	if !transcoders.stop(mux.Vars(request)["session"]) {
+		status = http.StatusNotFound
+	}
+	writer.WriteHeader(status)
+	service.debug_info.requestServed(int64(0))
+	log("\"DELETE %s\" %d 0 \"%s\"", query, status, ua)
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// a transcode at the quality "auto" is adaptive: the best qualities of the
+// ladder for the video, adaptive_rungs of them, are transcoded at once by
+// the same ffmpeg, with their segments at the same times, and listed in a
+// master playlist for the client to switch between as its bandwidth goes:
+//
+//	/transcode/<session>/master.m3u8
+//	/transcode/<session>/<quality>/index.m3u8
+//
+// the segments the client gets of each quality, how often it switches, the
+// segments it had to wait for and the stalls it reports are kept with the
+// session, and by quality in the metrics, to tell which qualities the
+// ladder should have
+
+const TRANSCODE_AUTO = "auto"
+const TRANSCODE_MASTER = "master.m3u8"
+
+// adaptive_rungs are the steps of the ladder of an adaptive transcode of a
+// video height pixels high, not more than max_kbps if given
+func adaptive_rungs(height, max_kbps int) []transcodeRung {
+	top, _ := pick_rung(height, max_kbps, "")
+	count := config.Transcode.AdaptiveRungs
+	if count <= 0 {
+		count = 1
+	}
+	rungs := []transcodeRung{}
+	for _, rung := range transcode_ladder {
+		if rung.Height <= top.Height && len(rungs) < count {
+			rungs = append(rungs, rung)
+		}
+	}
+	return rungs
+}
+
+// adaptive_args are the arguments of ffmpeg to transcode full_path into a
+// directory of dir for each of rungs
+func adaptive_args(full_path, dir string, rungs []transcodeRung, encoder string, audio bool) []string {
+	e := find_encoder(encoder)
+	args := append([]string{"-v", "error"}, e.input_args()...)
+	args = append(args, "-i", full_path, "-sn")
+	split := fmt.Sprintf("[0:v:0]split=%d", len(rungs))
+	scales := ""
+	for i, rung := range rungs {
+		split += fmt.Sprintf("[s%d]", i)
+		scales += fmt.Sprintf(";[s%d]scale=-2:'min(%d,ih)'", i, rung.Height)
+		if e.filter != "" {
+			scales += "," + e.filter
+		}
+		scales += fmt.Sprintf("[v%d]", i)
+	}
+	args = append(args, "-filter_complex", split+scales)
+	streams := []string{}
+	for i, rung := range rungs {
+		args = append(args, "-map", fmt.Sprintf("[v%d]", i))
+		if audio {
+			args = append(args, "-map", "0:a:0")
+			streams = append(streams, fmt.Sprintf("v:%d,a:%d,name:%s", i, i, rung.Name))
+		} else {
+			streams = append(streams, fmt.Sprintf("v:%d,name:%s", i, rung.Name))
+		}
+	}
+	args = append(append(args, "-c:v", e.name), e.args...)
+	for i, rung := range rungs {
+		args = append(args, fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", rung.Video),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", rung.Video),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", 2*rung.Video))
+	}
+	args = append(args, "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", TRANSCODE_SEGMENT))
+	if audio {
+		args = append(args, "-c:a", "aac", "-ac", "2")
+		for i, rung := range rungs {
+			args = append(args, fmt.Sprintf("-b:a:%d", i), fmt.Sprintf("%dk", rung.Audio))
+		}
+	}
+	args = append(args, "-f", "hls", "-hls_time", strconv.Itoa(TRANSCODE_SEGMENT), "-hls_playlist_type", "event",
+		"-hls_segment_filename", filepath.Join(dir, "%v", "seg%05d.ts"), "-var_stream_map", strings.Join(streams, " "),
+		filepath.Join(dir, "%v", "index.m3u8"))
+	return args
+}
+
+// write_master_playlist writes the master playlist of rungs in dir, with
+// their directories
+func write_master_playlist(dir string, rungs []transcodeRung) error {
+	var master bytes.Buffer
+	master.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, rung := range rungs {
+		if err := os.MkdirAll(filepath.Join(dir, rung.Name), 0755); err != nil {
+			return err
+		}
+		fmt.Fprintf(&master, "#EXT-X-STREAM-INF:BANDWIDTH=%d,NAME=\"%s\"\n%s/index.m3u8\n", (rung.Video+rung.Audio)*1000, rung.Name, rung.Name)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, TRANSCODE_MASTER), master.Bytes(), 0644)
+}
+
+func adaptive_playlist(id string) string {
+	return "/transcode/" + id + "/" + TRANSCODE_MASTER
+}
+
+func (this *transcodeSession) has_rung(name string) bool {
+	for _, rung := range this.Rungs {
+		if rung == name {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot is a copy of the session, with the lock of the transcoder held
+func (this *transcodeSession) snapshot() transcodeSession {
+	copied := *this
+	copied.Segments = make(map[string]int)
+	for rung, count := range this.Segments {
+		copied.Segments[rung] = count
+	}
+	return copied
+}
+
+// watched counts a segment of rung, "" for the one of the session, served
+// to the client, after waiting for it or not
+func (this *transcoder) watched(session *transcodeSession, rung string, waited bool) {
+	if rung == "" {
+		rung = session.Rung
+	}
+	this.Lock()
+	defer this.Unlock()
+	session.Segments[rung]++
+	if session.current != "" && session.current != rung {
+		session.Switches++
+	}
+	session.current = rung
+	if waited {
+		session.Waits++
+		metric_transcode_waits.inc(rung)
+	}
+	metric_transcode_segments.inc(rung)
+}
+
+func (this *transcoder) session(id string) (transcodeSession, bool) {
+	this.Lock()
+	defer this.Unlock()
+	session := this.sessions[id]
+	if session == nil {
+		return transcodeSession{}, false
+	}
+	return session.snapshot(), true
+}
+
+// report keeps the stalls and the bandwidth, in kbit/s, the client of a
+// session saw, at the quality it was watching
+func (this *transcoder) report(id string, stalls, kbps int) bool {
+	this.Lock()
+	defer this.Unlock()
+	session := this.sessions[id]
+	if session == nil {
+		return false
+	}
+	session.Stalls += stalls
+	if kbps > 0 {
+		session.Bandwidth = kbps
+	}
+	rung := session.current
+	if rung == "" {
+		rung = session.Rung
+	}
+	if stalls > 0 {
+		metric_transcode_stalls.add(float64(stalls), rung)
+	}
+	return true
+}
+
+// transcode_quality_stats are the segments served, waited for and the
+// stalls, by quality, since the start
+func transcode_quality_stats() map[string]map[string]int64 {
+	stats := make(map[string]map[string]int64)
+	for _, rung := range transcode_ladder {
+		stats[rung.Name] = map[string]int64{
+			"segments": int64(metric_transcode_segments.value(rung.Name)),
+			"waits":    int64(metric_transcode_waits.value(rung.Name)),
+			"stalls":   int64(metric_transcode_stalls.value(rung.Name)),
+		}
+	}
+	return stats
+}
+
+// GET /transcode/{session} is a session, with what its client watched
+func (service *MercuryFsService) transcode_session(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	status, result := http.StatusOK, interface{}(nil)
+	if session, ok := transcoders.session(mux.Vars(request)["session"]); ok {
+		result = session
+	} else {
+		status, result = http.StatusNotFound, map[string]string{"error": errNoSuchTranscode.Error()}
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" %d %d \"%s\"", query, status, size, ua)
+}
+
+// POST /transcode/{session}/report[?stalls=<count>][&bandwidth=<kbit/s>]
+// is what the client of a session saw while playing it
+func (service *MercuryFsService) report_transcode(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	stalls, serr := strconv.Atoi(request.FormValue("stalls"))
+	kbps, berr := strconv.Atoi(request.FormValue("bandwidth"))
+	status := http.StatusNoContent
+	switch {
+	case (serr != nil && request.FormValue("stalls") != "") || (berr != nil && request.FormValue("bandwidth") != "") || stalls < 0:
+		status = http.StatusBadRequest
+	case !transcoders.report(mux.Vars(request)["session"], stalls, kbps):
+		status = http.StatusNotFound
+	}
+	writer.WriteHeader(status)
+	service.debug_info.requestServed(int64(0))
+	log("\"POST %s\" %d 0 \"%s\"", query, status, ua)
+}
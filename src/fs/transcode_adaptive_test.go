@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdaptiveLadder(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = default_config()
+	names := func(rungs []transcodeRung) string {
+		list := []string{}
+		for _, rung := range rungs {
+			list = append(list, rung.Name)
+		}
+		return strings.Join(list, " ")
+	}
+	if got := names(adaptive_rungs(1080, 0)); got != "1080p 720p 480p" {
+		t.Errorf("Wrong qualities: %s", got)
+	}
+	if got := names(adaptive_rungs(1080, 2000)); got != "480p 360p 240p" {
+		t.Errorf("Wrong qualities under 2000 kbit/s: %s", got)
+	}
+	config.Transcode.AdaptiveRungs = 2
+	if got := names(adaptive_rungs(360, 0)); got != "360p 240p" {
+		t.Errorf("Wrong qualities of a small video: %s", got)
+	}
+
+	args := strings.Join(adaptive_args("/m.mkv", "/t", transcode_ladder[1:3], "h264_vaapi", true), " ")
+	for _, want := range []string{
+		"-v error -vaapi_device /dev/dri/renderD128 -i /m.mkv",
+		"[0:v:0]split=2[s0][s1];[s0]scale=-2:'min(720,ih)',format=nv12,hwupload[v0];[s1]scale=-2:'min(480,ih)',format=nv12,hwupload[v1]",
+		"-map [v0] -map 0:a:0 -map [v1] -map 0:a:0 -c:v h264_vaapi",
+		"-b:v:1 1400k", "-b:a:0 128k",
+		"-hls_segment_filename /t/%v/seg%05d.ts -var_stream_map v:0,a:0,name:720p v:1,a:1,name:480p /t/%v/index.m3u8",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("No %s in %s", want, args)
+		}
+	}
+	if args := strings.Join(adaptive_args("/m.mkv", "/t", transcode_ladder[1:3], "libx264", false), " "); strings.Contains(args, "0:a:0") || !strings.Contains(args, "v:0,name:720p v:1,name:480p") {
+		t.Errorf("Wrong arguments without audio: %s", args)
+	}
+}
+
+func TestAdaptiveSessions(t *testing.T) {
+	saved_transcoders, saved_probe, saved_run, saved_detect, saved_config := transcoders, probe_video, run_ffmpeg, detect_encoder, config
+	defer func() {
+		transcoders, probe_video, run_ffmpeg, detect_encoder, config = saved_transcoders, saved_probe, saved_run, saved_detect, saved_config
+	}()
+
+	dir, _ := ioutil.TempDir("", "adaptive")
+	defer os.RemoveAll(dir)
+	config = default_config()
+	transcoders = new_transcoder(filepath.Join(dir, "transcode"))
+	detect_encoder = func() string { return "libx264" }
+	probe_video = func(full_path string) videoInfo { return videoInfo{Codec: "h264", Height: 720} }
+	runs := make(chan []string, 10)
+	run_ffmpeg = func(ctx context.Context, args []string) error {
+		runs <- args
+		template := args[len(args)-1]
+		for _, rung := range []string{"720p", "480p", "360p"} {
+			playlist := strings.Replace(template, "%v", rung, 1)
+			ioutil.WriteFile(filepath.Join(filepath.Dir(playlist), "seg00000.ts"), []byte(rung), 0644)
+			ioutil.WriteFile(filepath.Join(filepath.Dir(playlist), "seg00001.ts"), []byte(rung), 0644)
+			ioutil.WriteFile(playlist, []byte("#EXTM3U\n#EXTINF:6.0,\nseg00000.ts\n#EXTINF:6.0,\nseg00001.ts\n"), 0644)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	os.MkdirAll(filepath.Join(dir, "Movies"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "Movies", "movie.mp4"), []byte("not really"), 0644)
+
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Movies", path: filepath.Join(dir, "Movies")}}}, debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/transcode", service.start_transcode).Methods("POST")
+	router.HandleFunc("/transcode/{session}/{file}", service.serve_transcode).Methods("GET")
+	router.HandleFunc("/transcode/{session}/{rung}/{file}", service.serve_transcode).Methods("GET")
+	router.HandleFunc("/transcode/{session}/report", service.report_transcode).Methods("POST")
+	router.HandleFunc("/transcode/{session}", service.transcode_session).Methods("GET")
+	router.HandleFunc("/transcode/{session}", service.stop_transcode).Methods("DELETE")
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+		return recorder
+	}
+
+	response := serve("POST", "/transcode?s=Movies&p=/movie.mp4&q=auto")
+	var started struct {
+		Session, Playlist, Quality string
+		Qualities                  []string
+	}
+	if response.Code != 201 || json.Unmarshal(response.Body.Bytes(), &started) != nil || started.Quality != "auto" || strings.Join(started.Qualities, " ") != "720p 480p 360p" {
+		t.Fatalf("Could not start an adaptive transcode: %d %s", response.Code, response.Body.String())
+	}
+	// even H.264 is transcoded, for the qualities to switch at the same times
+	if args := strings.Join(<-runs, " "); !strings.Contains(args, "-c:v libx264") || !strings.Contains(args, "-var_stream_map") {
+		t.Errorf("Wrong arguments: %s", args)
+	}
+
+	response = serve("GET", started.Playlist)
+	if response.Code != 200 || !strings.Contains(response.Body.String(), "BANDWIDTH=2928000,NAME=\"720p\"\n720p/index.m3u8") ||
+		response.Header().Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Fatalf("Wrong master playlist: %d %s", response.Code, response.Body.String())
+	}
+	base := "/transcode/" + started.Session
+	if response := serve("GET", base+"/480p/index.m3u8"); response.Code != 200 || !strings.Contains(response.Body.String(), "seg00001.ts") {
+		t.Errorf("Wrong playlist of a quality: %d %s", response.Code, response.Body.String())
+	}
+	if response := serve("GET", base+"/480p/seg00000.ts"); response.Code != 200 || response.Body.String() != "480p" {
+		t.Errorf("Wrong segment: %d %s", response.Code, response.Body.String())
+	}
+	serve("GET", base+"/720p/seg00001.ts")
+	for _, target := range []string{base + "/1080p/seg00000.ts", base + "/seg00000.ts", base + "/480p/index.json"} {
+		if response := serve("GET", target); response.Code != 404 {
+			t.Errorf("Served %s: %d", target, response.Code)
+		}
+	}
+
+	if response := serve("POST", base+"/report?stalls=2&bandwidth=2500"); response.Code != 204 {
+		t.Errorf("Could not report: %d", response.Code)
+	}
+	if response := serve("POST", base+"/report?stalls=many"); response.Code != 400 {
+		t.Errorf("Took a wrong report: %d", response.Code)
+	}
+	response = serve("GET", base)
+	var session transcodeSession
+	if response.Code != 200 || json.Unmarshal(response.Body.Bytes(), &session) != nil {
+		t.Fatalf("Wrong session: %d %s", response.Code, response.Body.String())
+	}
+	if session.Segments["480p"] != 1 || session.Segments["720p"] != 1 || session.Switches != 1 || session.Stalls != 2 || session.Bandwidth != 2500 {
+		t.Errorf("Wrong stats: %s", response.Body.String())
+	}
+	if stats := transcode_quality_stats(); stats["720p"]["stalls"] < 2 || stats["480p"]["segments"] < 1 {
+		t.Errorf("Wrong stats by quality: %v", stats)
+	}
+
+	serve("DELETE", base)
+	if response := serve("GET", base); response.Code != 404 {
+		t.Errorf("Stopped session still there: %d", response.Code)
+	}
+}
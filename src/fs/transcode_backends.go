@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the backends that encode the transcodes of videos: the hardware of
+// NVIDIA (NVENC), of Intel (QSV, or VAAPI, on most HDAs) and of Apple, and
+// libx264 in software. they are all probed at startup, on a blank frame,
+// as ffmpeg having an encoder does not mean the hardware is there, and the
+// first that works is used, unless transcode.backend in the config file
+// picks one, or transcode.encoder names the encoder of ffmpeg. a hardware
+// transcode that fails before its first segment is done again in
+// software. what works is in /capabilities and /hda_debug
+
+const TRANSCODE_SOFTWARE = "software"
+const TRANSCODE_SOFTWARE_ENCODER = "libx264"
+
+// how long the probe of an encoder can take
+const TRANSCODE_PROBE_TIMEOUT = 20 * time.Second
+
+var errNoFFmpeg = errors.New("ffmpeg is not installed")
+
+// videoEncoder is how ffmpeg uses an H.264 encoder
+type videoEncoder struct {
+	name     string
+	backend  string
+	hardware bool
+	// before the input, and after the scaling
+	input  []string
+	filter string
+	args   []string
+}
+
+// the encoders, the preferred first
+var video_encoders = []videoEncoder{
+	{name: "h264_nvenc", backend: "nvenc", hardware: true, args: []string{"-preset", "fast"}},
+	{name: "h264_qsv", backend: "qsv", hardware: true, filter: "format=nv12"},
+	{name: "h264_vaapi", backend: "vaapi", hardware: true, filter: "format=nv12,hwupload"},
+	{name: "h264_videotoolbox", backend: "videotoolbox", hardware: true},
+	{name: TRANSCODE_SOFTWARE_ENCODER, backend: TRANSCODE_SOFTWARE, args: []string{"-preset", "veryfast"}},
+}
+
+// find_encoder is the encoder named name. encoders set in the config that
+// are not known are used as is
+func find_encoder(name string) videoEncoder {
+	for _, known := range video_encoders {
+		if known.name == name {
+			return known
+		}
+	}
+	return videoEncoder{name: name}
+}
+
+// input_args are the arguments of ffmpeg before the input
+func (this videoEncoder) input_args() []string {
+	if this.backend == "vaapi" {
+		return []string{"-vaapi_device", config.Transcode.VaapiDevice}
+	}
+	return this.input
+}
+
+// encoderProbe is whether an encoder works
+type encoderProbe struct {
+	Backend   string `json:"backend"`
+	Encoder   string `json:"encoder"`
+	Hardware  bool   `json:"hardware"`
+	Available bool   `json:"available"`
+	Error     string `json:"error,omitempty"`
+}
+
+type encoderProbes struct {
+	probes []encoderProbe
+	sync.Mutex
+}
+
+var encoder_probes = new(encoderProbes)
+
+// probe_encoder says whether an encoder works, replaced in tests
+var probe_encoder = ffmpeg_probe_encoder
+
+// detect_encoder finds the encoder to use, "" for none, replaced in tests
+var detect_encoder = func() string {
+	return choose_encoder(encoder_probes.probe_all(), config.Transcode.Backend)
+}
+
+// ffmpeg_encoders is what ffmpeg -encoders lists
+var ffmpeg_encoders = func() ([]byte, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, errNoFFmpeg
+	}
+	return exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+}
+
+// ffmpeg_probe_encoder encodes a blank frame with encoder
+func ffmpeg_probe_encoder(encoder videoEncoder) error {
+	ctx, cancel := context.WithTimeout(context.Background(), TRANSCODE_PROBE_TIMEOUT)
+	defer cancel()
+	args := append(append([]string{"-v", "error"}, encoder.input_args()...), "-f", "lavfi", "-i", "color=black:s=256x144",
+		"-frames:v", "1", "-vf", strings.TrimPrefix("scale=256:144,"+encoder.filter, ","), "-c:v", encoder.name, "-f", "null", "-")
+	var stderr bytes.Buffer
+	command := exec.CommandContext(ctx, "ffmpeg", args...)
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			// the first line says why
+			return errors.New(strings.SplitN(message, "\n", 2)[0])
+		}
+		return err
+	}
+	return nil
+}
+
+// probe_all probes all the encoders
+func (this *encoderProbes) probe_all() []encoderProbe {
+	probes := []encoderProbe{}
+	listed, err := ffmpeg_encoders()
+	for _, encoder := range video_encoders {
+		probe := encoderProbe{Backend: encoder.backend, Encoder: encoder.name, Hardware: encoder.hardware}
+		switch {
+		case err != nil:
+			probe.Error = err.Error()
+		case !bytes.Contains(listed, []byte(" "+encoder.name+" ")):
+			probe.Error = "not in ffmpeg"
+		default:
+			if err := probe_encoder(encoder); err != nil {
+				debug(3, "Video encoder %s does not work: %s", encoder.name, err.Error())
+				probe.Error = err.Error()
+			} else {
+				probe.Available = true
+			}
+		}
+		probes = append(probes, probe)
+	}
+	this.Lock()
+	this.probes = probes
+	this.Unlock()
+	return probes
+}
+
+func (this *encoderProbes) status() []encoderProbe {
+	this.Lock()
+	defer this.Unlock()
+	return append([]encoderProbe{}, this.probes...)
+}
+
+// available says whether encoder works, or is not known not to
+func (this *encoderProbes) available(encoder string) bool {
+	this.Lock()
+	defer this.Unlock()
+	for _, probe := range this.probes {
+		if probe.Encoder == encoder {
+			return probe.Available
+		}
+	}
+	return true
+}
+
+// choose_encoder is the encoder of backend, or the first that works, or
+// software when backend does not work
+func choose_encoder(probes []encoderProbe, backend string) string {
+	first := ""
+	for _, probe := range probes {
+		if !probe.Available {
+			continue
+		}
+		if probe.Backend == backend {
+			return probe.Encoder
+		}
+		if first == "" {
+			first = probe.Encoder
+		}
+	}
+	if backend != "" {
+		log_warn("The %s video backend does not work, transcoding in software", backend)
+		for _, probe := range probes {
+			if probe.Available && !probe.Hardware {
+				return probe.Encoder
+			}
+		}
+		return ""
+	}
+	return first
+}
+
+// software_fallback is the encoder to transcode with again when encoder
+// failed, "" for none
+func software_fallback(encoder string) string {
+	if !find_encoder(encoder).hardware || !encoder_probes.available(TRANSCODE_SOFTWARE_ENCODER) {
+		return ""
+	}
+	return TRANSCODE_SOFTWARE_ENCODER
+}
+
+// capabilities are what the transcodes can do, for /capabilities
+func (this *transcoder) capabilities() map[string]interface{} {
+	encoder := this.video_encoder()
+	qualities := []string{}
+	for _, rung := range transcode_ladder {
+		qualities = append(qualities, rung.Name)
+	}
+	video := map[string]interface{}{
+		"encoder":   encoder,
+		"backend":   find_encoder(encoder).backend,
+		"hardware":  find_encoder(encoder).hardware,
+		"codecs":    []string{},
+		"formats":   []string{},
+		"qualities": qualities,
+		"backends":  encoder_probes.status(),
+	}
+	if encoder != "" {
+		video["codecs"] = []string{"h264", "aac"}
+		video["formats"] = []string{"hls"}
+		video["qualities"] = append(qualities, TRANSCODE_AUTO)
+	}
+	return video
+}
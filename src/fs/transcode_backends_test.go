@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncoderProbes(t *testing.T) {
+	saved_config, saved_list, saved_probe, saved_probes := config, ffmpeg_encoders, probe_encoder, encoder_probes
+	defer func() {
+		config, ffmpeg_encoders, probe_encoder, encoder_probes = saved_config, saved_list, saved_probe, saved_probes
+	}()
+	config = default_config()
+	encoder_probes = new(encoderProbes)
+
+	// an Intel HDA, with an ffmpeg built with NVENC
+	ffmpeg_encoders = func() ([]byte, error) {
+		return []byte(" V....D h264_nvenc   NVIDIA NVENC H.264 encoder\n V....D h264_vaapi   H.264/AVC (VAAPI)\n V....D libx264      libx264 H.264\n"), nil
+	}
+	probed := []string{}
+	probe_encoder = func(encoder videoEncoder) error {
+		probed = append(probed, strings.Join(encoder.input_args(), " "))
+		if encoder.backend == "nvenc" {
+			return errors.New("Cannot load libcuda.so.1")
+		}
+		return nil
+	}
+	probes := encoder_probes.probe_all()
+	if len(probes) != len(video_encoders) || probes[0].Available || probes[0].Error != "Cannot load libcuda.so.1" || probes[1].Error != "not in ffmpeg" || !probes[2].Available {
+		t.Fatalf("Wrong probes: %+v", probes)
+	}
+	if probed[1] != "-vaapi_device /dev/dri/renderD128" {
+		t.Errorf("Wrong VAAPI device: %v", probed)
+	}
+
+	for backend, expected := range map[string]string{"": "h264_vaapi", "software": "libx264", "vaapi": "h264_vaapi", "nvenc": "libx264"} {
+		if encoder := choose_encoder(probes, backend); encoder != expected {
+			t.Errorf("%s instead of %s for %q", encoder, expected, backend)
+		}
+	}
+	if software_fallback("h264_vaapi") != "libx264" || software_fallback("libx264") != "" || software_fallback("hevc_custom") != "" {
+		t.Errorf("Wrong fallbacks")
+	}
+
+	// without ffmpeg
+	ffmpeg_encoders = func() ([]byte, error) { return nil, errNoFFmpeg }
+	if encoder := choose_encoder(encoder_probes.probe_all(), ""); encoder != "" {
+		t.Errorf("Encoder without ffmpeg: %s", encoder)
+	}
+	if software_fallback("h264_vaapi") != "" {
+		t.Errorf("Fallback without ffmpeg")
+	}
+}
+
+func TestTranscodeFallback(t *testing.T) {
+	saved_transcoders, saved_probe, saved_run, saved_detect := transcoders, probe_video, run_ffmpeg, detect_encoder
+	defer func() {
+		transcoders, probe_video, run_ffmpeg, detect_encoder = saved_transcoders, saved_probe, saved_run, saved_detect
+	}()
+	dir, _ := ioutil.TempDir("", "transcode")
+	defer os.RemoveAll(dir)
+	transcoders = new_transcoder(filepath.Join(dir, "transcode"))
+	detect_encoder = func() string { return "h264_vaapi" }
+	probe_video = func(full_path string) videoInfo { return videoInfo{Codec: "hevc", Height: 2160} }
+	runs := make(chan string, 2)
+	run_ffmpeg = func(ctx context.Context, args []string) error {
+		joined := strings.Join(args, " ")
+		runs <- joined
+		if strings.Contains(joined, "-c:v h264_vaapi") {
+			return errors.New("Failed to initialise VAAPI connection")
+		}
+		playlist := args[len(args)-1]
+		return ioutil.WriteFile(playlist, []byte("#EXTM3U\n#EXTINF:6.0,\nseg00000.ts\n"), 0644)
+	}
+
+	session, err := transcoders.start(filepath.Join(dir, "movie.mkv"), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-session.done
+	if first, second := <-runs, <-runs; !strings.Contains(first, "-c:v h264_vaapi") || !strings.Contains(second, "-c:v libx264") {
+		t.Errorf("Wrong runs: %s, %s", first, second)
+	}
+	if session.Encoder != "libx264" || !session.Fallback || session.Error != "" {
+		t.Errorf("Not transcoded in software: %+v", session)
+	}
+
+	service := &MercuryFsService{debug_info: new(debugInfo)}
+	recorder := httptest.NewRecorder()
+	service.server_capabilities(recorder, httptest.NewRequest("GET", "/capabilities", nil))
+	var capabilities struct {
+		Video struct {
+			Encoder  string   `json:"encoder"`
+			Backend  string   `json:"backend"`
+			Hardware bool     `json:"hardware"`
+			Codecs   []string `json:"codecs"`
+		} `json:"video"`
+		Audio struct {
+			Formats []string `json:"formats"`
+		} `json:"audio"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &capabilities); err != nil || capabilities.Video.Backend != "vaapi" || !capabilities.Video.Hardware ||
+		len(capabilities.Video.Codecs) == 0 || strings.Join(capabilities.Audio.Formats, ",") != "aac,mp3" {
+		t.Errorf("Wrong capabilities: %s", recorder.Body.String())
+	}
+}
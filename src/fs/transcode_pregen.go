@@ -0,0 +1,434 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the videos added lately, or watched often, are transcoded ahead of time,
+// at the hours set in transcode.pregenerate of the config, when no one is
+// watching a transcode, so that they play right away, and on a phone. a
+// pregenerated rendition is the HLS of the quality a transcode of the video
+// would get, or the one set, kept in PREGEN_DIR, and served by the
+// transcodes asking for it instead of transcoding again. the renditions
+// fill up to cache_size, the most watched and the newest first. a video is
+// done at a time, and the job runs again while there are more
+
+const PREGEN_DIR = DATA_DIR + "/pregenerated"
+const PREGEN_JOB = "transcode-pregenerate"
+
+// how often a pregeneration checks it can go on
+const PREGEN_CHECK = 10 * time.Second
+
+// pregenRendition is a video transcoded ahead of time
+type pregenRendition struct {
+	File    string    `json:"file"`
+	Rung    string    `json:"rung"`
+	Encoder string    `json:"encoder"`
+	Size    int64     `json:"size"`
+	Mtime   time.Time `json:"mtime"`
+	Created time.Time `json:"created"`
+	Used    time.Time `json:"used"`
+}
+
+type transcodePregen struct {
+	dir string
+	// by path of the video
+	renditions map[string]*pregenRendition
+	plays      map[string]int
+	// the videos that could not be done, with their mtime then
+	failed                   map[string]time.Time
+	generated, hits, watched int64
+	last_error               string
+	loaded                   sync.Once
+	sync.Mutex
+}
+
+var transcode_pregen = new_transcode_pregen(PREGEN_DIR)
+
+func new_transcode_pregen(dir string) *transcodePregen {
+	return &transcodePregen{
+		dir:        dir,
+		renditions: make(map[string]*pregenRendition),
+		plays:      make(map[string]int),
+		failed:     make(map[string]time.Time),
+	}
+}
+
+func (this *transcodePregen) state_file() string {
+	return filepath.Join(this.dir, "state.json")
+}
+
+type pregenState struct {
+	Renditions map[string]*pregenRendition `json:"renditions"`
+	Plays      map[string]int              `json:"plays"`
+}
+
+// load reads what was pregenerated and watched before a restart
+func (this *transcodePregen) load() {
+	this.loaded.Do(func() {
+		data, err := ioutil.ReadFile(this.state_file())
+		if err != nil {
+			return
+		}
+		var state pregenState
+		if err := json.Unmarshal(data, &state); err != nil {
+			debug(2, "Error reading %s: %s", this.state_file(), err.Error())
+			return
+		}
+		this.Lock()
+		defer this.Unlock()
+		for file, rendition := range state.Renditions {
+			if _, err := os.Stat(filepath.Join(this.rendition_dir(file), "index.m3u8")); err == nil {
+				this.renditions[file] = rendition
+			}
+		}
+		for file, plays := range state.Plays {
+			this.plays[file] += plays
+		}
+	})
+}
+
+// save writes the state, with the lock held
+func (this *transcodePregen) save() error {
+	data, err := json.Marshal(pregenState{Renditions: this.renditions, Plays: this.plays})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(this.dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(this.state_file(), data, 0644)
+}
+
+// rendition_dir is where the rendition of the video at full_path goes
+func (this *transcodePregen) rendition_dir(full_path string) string {
+	sum := sha1.Sum([]byte(full_path))
+	return filepath.Join(this.dir, hex.EncodeToString(sum[:]))
+}
+
+// played counts a time the video at full_path was watched
+func (this *transcodePregen) played(full_path string) {
+	if !config.Transcode.Pregenerate.Enabled {
+		return
+	}
+	this.Lock()
+	this.plays[full_path]++
+	this.watched++
+	this.Unlock()
+}
+
+// find is the directory of the rendition of the video at full_path at
+// rung, "" for none
+func (this *transcodePregen) find(full_path, rung string) string {
+	if !config.Transcode.Pregenerate.Enabled {
+		return ""
+	}
+	fi, err := os.Stat(full_path)
+	if err != nil {
+		return ""
+	}
+	this.Lock()
+	defer this.Unlock()
+	rendition := this.renditions[full_path]
+	if rendition == nil || rendition.Rung != rung || !rendition.Mtime.Equal(fi.ModTime()) {
+		return ""
+	}
+	rendition.Used = time.Now()
+	this.hits++
+	return this.rendition_dir(full_path)
+}
+
+// pregen_open says if videos can be pregenerated at now
+func pregen_open(now time.Time) bool {
+	hours := config.Transcode.Pregenerate.Hours
+	if hours == "" {
+		return true
+	}
+	windows, err := parse_windows(hours)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range windows {
+		if window.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// busy says if someone is watching a transcode
+func (this *transcoder) busy() bool {
+	this.Lock()
+	defer this.Unlock()
+	for _, session := range this.sessions {
+		if session.Running {
+			return true
+		}
+	}
+	return false
+}
+
+type pregenCandidate struct {
+	file  string
+	mtime time.Time
+	added time.Time
+	plays int
+}
+
+// candidates are the videos to have renditions of, the most watched and
+// then the newest first
+func (this *transcodePregen) candidates(shares *HdaShares) []pregenCandidate {
+	recent, err := time.ParseDuration(config.Transcode.Pregenerate.Recent)
+	if err != nil {
+		recent = 0
+	}
+	min_plays := config.Transcode.Pregenerate.MinPlays
+	shares.RLock()
+	list := append([]*HdaShare{}, shares.Shares...)
+	shares.RUnlock()
+	this.Lock()
+	defer this.Unlock()
+	candidates := []pregenCandidate{}
+	for _, share := range list {
+		entries, err := share_index.search(share.name, func(entry *indexEntry) bool {
+			return !entry.IsDir && !entry.Deleted && strings.HasPrefix(entry.MimeType, "video/")
+		})
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			file := filepath.Join(share.path, filepath.FromSlash(entry.Path))
+			plays := this.plays[file]
+			if (recent <= 0 || time.Since(entry.Added) > recent) && (min_plays <= 0 || plays < min_plays) {
+				continue
+			}
+			if failed, ok := this.failed[file]; ok && failed.Equal(entry.Mtime) {
+				continue
+			}
+			candidates = append(candidates, pregenCandidate{file: file, mtime: entry.Mtime, added: entry.Added, plays: plays})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].plays != candidates[j].plays {
+			return candidates[i].plays > candidates[j].plays
+		}
+		return candidates[i].added.After(candidates[j].added)
+	})
+	return candidates
+}
+
+func (this *transcodePregen) cache_size() int64 {
+	return config.Transcode.Pregenerate.CacheSize << 20
+}
+
+// bytes is the size of the renditions, with the lock held
+func (this *transcodePregen) bytes() int64 {
+	total := int64(0)
+	for _, rendition := range this.renditions {
+		total += rendition.Size
+	}
+	return total
+}
+
+// worst is the rendition that goes first to make room, by the rank of its
+// video, the least used first when not a candidate. with the lock held
+func (this *transcodePregen) worst(rank map[string]int) string {
+	worst := ""
+	for file, rendition := range this.renditions {
+		if worst == "" {
+			worst = file
+			continue
+		}
+		r, ok := rank[file]
+		w, worst_ok := rank[worst]
+		switch {
+		case !ok && worst_ok, ok && worst_ok && r > w:
+			worst = file
+		case !ok && !worst_ok && rendition.Used.Before(this.renditions[worst].Used):
+			worst = file
+		}
+	}
+	return worst
+}
+
+// evict removes the rendition of the video at file, with the lock held
+func (this *transcodePregen) evict(file string) {
+	delete(this.renditions, file)
+	os.RemoveAll(this.rendition_dir(file))
+}
+
+// generate transcodes the video at file, and returns the rendition, unless
+// ctx is cancelled
+func (this *transcodePregen) generate(ctx context.Context, file string) (*pregenRendition, error) {
+	info := probe_video(file)
+	rung, ok := pick_rung(info.Height, 0, config.Transcode.Pregenerate.Quality)
+	if !ok {
+		return nil, fmt.Errorf("no such quality: %s", config.Transcode.Pregenerate.Quality)
+	}
+	encoder := transcoders.video_encoder()
+	if info.Codec == "h264" && info.Height > 0 && info.Height <= rung.Height {
+		encoder = "copy"
+	} else if encoder == "" {
+		return nil, errNoTranscoder
+	}
+	dir := this.rendition_dir(file)
+	partial := dir + ".partial"
+	os.RemoveAll(partial)
+	if err := os.MkdirAll(partial, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(partial)
+	err := run_ffmpeg(ctx, transcode_args(file, partial, rung, encoder))
+	if software := software_fallback(encoder); err != nil && ctx.Err() == nil && software != "" {
+		debug(2, "Error pregenerating %s with %s: %s", file, encoder, err.Error())
+		encoder = software
+		err = run_ffmpeg(ctx, transcode_args(file, partial, rung, encoder))
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := int64(0)
+	fis, _ := ioutil.ReadDir(partial)
+	for _, fi := range fis {
+		size += fi.Size()
+	}
+	os.RemoveAll(dir)
+	if err := os.Rename(partial, dir); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &pregenRendition{File: file, Rung: rung.Name, Encoder: encoder, Size: size, Created: now, Used: now}, nil
+}
+
+// job pregenerates the next video, and runs again soon while there are more
+func (this *transcodePregen) job(shares *HdaShares) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		this.load()
+		if !pregen_open(schedule_now()) {
+			return "not at this time", nil
+		}
+		if transcoders.busy() {
+			return "videos are being watched", nil
+		}
+		candidates := this.candidates(shares)
+		rank := make(map[string]int)
+		for i, candidate := range candidates {
+			rank[candidate.file] = i
+		}
+
+		this.Lock()
+		var next *pregenCandidate
+		done := 0
+		for i := range candidates {
+			rendition := this.renditions[candidates[i].file]
+			if rendition != nil && rendition.Mtime.Equal(candidates[i].mtime) {
+				done++
+				continue
+			}
+			if next == nil {
+				next = &candidates[i]
+			}
+		}
+		if next != nil && this.bytes() >= this.cache_size() {
+			// only for a video before one that is there
+			worst := this.worst(rank)
+			if r, ok := rank[worst]; worst == "" || (ok && r < rank[next.file]) {
+				next = nil
+			}
+		}
+		this.Unlock()
+		if next == nil {
+			this.Lock()
+			this.save()
+			this.Unlock()
+			return fmt.Sprintf("%d videos pregenerated", done), nil
+		}
+		progress(int64(done), int64(len(candidates)))
+
+		// the viewers go first
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			ticker := time.NewTicker(PREGEN_CHECK)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if !pregen_open(schedule_now()) || transcoders.busy() {
+						cancel()
+					}
+				}
+			}
+		}()
+		rendition, err := this.generate(ctx, next.file)
+
+		this.Lock()
+		defer this.Unlock()
+		if err == context.Canceled {
+			return "stopped for the viewers", nil
+		}
+		if err != nil {
+			this.failed[next.file] = next.mtime
+			this.last_error = err.Error()
+			this.save()
+			return "", fmt.Errorf("%s: %s", next.file, err.Error())
+		}
+		rendition.Mtime = next.mtime
+		this.renditions[next.file] = rendition
+		this.generated++
+		for this.bytes() > this.cache_size() {
+			worst := this.worst(rank)
+			if worst == next.file {
+				this.failed[next.file] = next.mtime
+			}
+			this.evict(worst)
+		}
+		this.save()
+		if this.renditions[next.file] == nil {
+			return fmt.Sprintf("%s does not fit in the cache", next.file), nil
+		}
+		scheduler.trigger(PREGEN_JOB)
+		return fmt.Sprintf("%s pregenerated at %s, %d of %d", next.file, rendition.Rung, done+1, len(candidates)), nil
+	}
+}
+
+func (this *transcodePregen) status() map[string]interface{} {
+	this.Lock()
+	defer this.Unlock()
+	return map[string]interface{}{
+		"enabled":    config.Transcode.Pregenerate.Enabled,
+		"renditions": len(this.renditions),
+		"bytes":      this.bytes(),
+		"cache_size": this.cache_size(),
+		"generated":  this.generated,
+		"hits":       this.hits,
+		"plays":      this.watched,
+		"last_error": this.last_error,
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPregenHours(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = default_config()
+	day := time.Date(2018, 5, 1, 0, 0, 0, 0, time.Local)
+	if !pregen_open(day.Add(3*time.Hour)) || pregen_open(day.Add(12*time.Hour)) {
+		t.Errorf("Wrong default hours")
+	}
+	config.Transcode.Pregenerate.Hours = ""
+	if !pregen_open(day.Add(12 * time.Hour)) {
+		t.Errorf("Not at any time")
+	}
+}
+
+func TestTranscodePregen(t *testing.T) {
+	saved_config, saved_index, saved_transcoders, saved_pregen := config, share_index, transcoders, transcode_pregen
+	saved_probe, saved_run, saved_detect, saved_now := probe_video, run_ffmpeg, detect_encoder, schedule_now
+	defer func() {
+		config, share_index, transcoders, transcode_pregen = saved_config, saved_index, saved_transcoders, saved_pregen
+		probe_video, run_ffmpeg, detect_encoder, schedule_now = saved_probe, saved_run, saved_detect, saved_now
+	}()
+	dir, _ := ioutil.TempDir("", "pregen")
+	defer os.RemoveAll(dir)
+	config = default_config()
+	config.Transcode.Pregenerate.Enabled = true
+	config.Transcode.Pregenerate.CacheSize = 2
+	share_index = new_hda_index()
+	transcoders = new_transcoder(filepath.Join(dir, "transcode"))
+	transcode_pregen = new_transcode_pregen(filepath.Join(dir, "pregenerated"))
+	detect_encoder = func() string { return "libx264" }
+	probe_video = func(full_path string) videoInfo { return videoInfo{Codec: "hevc", Height: 1080} }
+	schedule_now = func() time.Time { return time.Date(2018, 5, 1, 3, 0, 0, 0, time.Local) }
+	// renditions of 700KB, two fit
+	ran := []string{}
+	run_ffmpeg = func(ctx context.Context, args []string) error {
+		for i := range args {
+			if args[i] == "-i" {
+				ran = append(ran, args[i+1])
+			}
+		}
+		playlist := args[len(args)-1]
+		ioutil.WriteFile(filepath.Join(filepath.Dir(playlist), "seg00000.ts"), make([]byte, 700<<10), 0644)
+		return ioutil.WriteFile(playlist, []byte("#EXTM3U\n#EXTINF:6.0,\nseg00000.ts\n#EXT-X-ENDLIST\n"), 0644)
+	}
+
+	movies := filepath.Join(dir, "movies")
+	os.MkdirAll(movies, 0755)
+	for _, name := range []string{"Up.mkv", "Cars.mkv", "Coco.mkv", "Brave.mkv", "notes.txt"} {
+		ioutil.WriteFile(filepath.Join(movies, name), []byte("x"), 0644)
+	}
+	share := &HdaShare{name: "Movies", path: movies}
+	shares := &HdaShares{Shares: []*HdaShare{share}}
+	share_index.scan(share.name, share.path, nil, nil, nil)
+	up, coco, brave := filepath.Join(movies, "Up.mkv"), filepath.Join(movies, "Coco.mkv"), filepath.Join(movies, "Brave.mkv")
+	// everything was just added, Up is watched the most, then Coco
+	config.Transcode.Pregenerate.Recent = "0"
+	for i := 0; i < 5; i++ {
+		transcode_pregen.played(up)
+	}
+	for i := 0; i < 4; i++ {
+		transcode_pregen.played(coco)
+	}
+	run := transcode_pregen.job(shares)
+	progress := func(done, total int64) {}
+	for i := 0; i < 3; i++ {
+		if _, err := run(progress); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ran) != 2 || ran[0] != up || ran[1] != coco {
+		t.Fatalf("Wrong videos pregenerated: %v", ran)
+	}
+
+	// served without transcoding
+	session, err := transcoders.start(up, 0, "")
+	if err != nil || !session.Pregen || session.Running {
+		t.Fatalf("Not pregenerated: %+v %v", session, err)
+	}
+	if path, err := transcoders.file(session.ID, "seg00000.ts", time.Second); err != nil || !strings.HasPrefix(path, transcode_pregen.dir) {
+		t.Errorf("Wrong segment: %s %v", path, err)
+	}
+	transcoders.stop(session.ID)
+	time.Sleep(10 * time.Millisecond)
+	if transcode_pregen.find(up, "1080p") == "" {
+		t.Errorf("Removed with its session")
+	}
+
+	// a video watched the most takes the room of the others, Up was
+	// watched once more with its session
+	for i := 0; i < 7; i++ {
+		transcode_pregen.played(brave)
+	}
+	config.Transcode.Pregenerate.CacheSize = 1
+	run(progress)
+	if len(ran) != 3 || ran[2] != brave || transcode_pregen.find(brave, "1080p") == "" || transcode_pregen.find(up, "1080p") != "" || transcode_pregen.find(coco, "1080p") != "" {
+		t.Errorf("Wrong renditions: %v %v", ran, transcode_pregen.status())
+	}
+
+	// not while someone is watching a transcode, nor during the day
+	ioutil.WriteFile(up, []byte("xx"), 0644)
+	share_index.scan(share.name, share.path, nil, nil, nil)
+	config.Transcode.Pregenerate.CacheSize = 20
+	watched, _ := transcoders.start(filepath.Join(movies, "Cars.mkv"), 0, "")
+	if result, _ := run(progress); result != "videos are being watched" {
+		t.Errorf("Ran while watched: %s", result)
+	}
+	transcoders.stop(watched.ID)
+	schedule_now = func() time.Time { return time.Date(2018, 5, 1, 12, 0, 0, 0, time.Local) }
+	if result, _ := run(progress); result != "not at this time" {
+		t.Errorf("Ran during the day: %s", result)
+	}
+
+	// and what was done is known after a restart
+	restarted := new_transcode_pregen(transcode_pregen.dir)
+	restarted.load()
+	if restarted.find(brave, "1080p") == "" || restarted.plays[up] != 6 {
+		t.Errorf("Not kept: %v %v", restarted.renditions, restarted.plays)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscodeLadder(t *testing.T) {
+	for _, test := range []struct {
+		height, max_kbps int
+		name, want       string
+	}{
+		{2160, 0, "", "1080p"},
+		{1080, 0, "", "1080p"},
+		{0, 0, "", "720p"},
+		{576, 0, "", "480p"},
+		{1080, 2000, "", "480p"},
+		{144, 0, "", "240p"},
+		{1080, 100, "", "240p"},
+		{480, 0, "720p", "720p"},
+	} {
+		if rung, _ := pick_rung(test.height, test.max_kbps, test.name); rung.Name != test.want {
+			t.Errorf("%d pixels at %d kbit/s: %s instead of %s", test.height, test.max_kbps, rung.Name, test.want)
+		}
+	}
+	if _, ok := pick_rung(1080, 0, "4k"); ok {
+		t.Errorf("Picked an unknown quality")
+	}
+
+	args := strings.Join(transcode_args("/m.mkv", "/t", transcode_ladder[1], "h264_vaapi"), " ")
+	if !strings.HasPrefix(args, "-v error -vaapi_device /dev/dri/renderD128 -i /m.mkv") || !strings.Contains(args, "scale=-2:'min(720,ih)',format=nv12,hwupload -c:v h264_vaapi") {
+		t.Errorf("Wrong arguments: %s", args)
+	}
+	if args := strings.Join(transcode_args("/m.mkv", "/t", transcode_ladder[0], "copy"), " "); !strings.Contains(args, "-c:v copy") || strings.Contains(args, "scale") {
+		t.Errorf("Wrong arguments to copy the video: %s", args)
+	}
+}
+
+func TestTranscodeSessions(t *testing.T) {
+	saved_transcoders, saved_probe, saved_run, saved_detect := transcoders, probe_video, run_ffmpeg, detect_encoder
+	defer func() {
+		transcoders, probe_video, run_ffmpeg, detect_encoder = saved_transcoders, saved_probe, saved_run, saved_detect
+	}()
+
+	dir, _ := ioutil.TempDir("", "transcode")
+	defer os.RemoveAll(dir)
+	transcoders = new_transcoder(filepath.Join(dir, "transcode"))
+	detect_encoder = func() string { return "libx264" }
+	probe_video = func(full_path string) videoInfo { return videoInfo{Codec: "hevc", Height: 1080} }
+	runs := make(chan []string, 10)
+	run_ffmpeg = func(ctx context.Context, args []string) error {
+		runs <- args
+		playlist := args[len(args)-1]
+		ioutil.WriteFile(filepath.Join(filepath.Dir(playlist), "seg00000.ts"), []byte("segment"), 0644)
+		ioutil.WriteFile(playlist, []byte("#EXTM3U\n#EXTINF:6.0,\nseg00000.ts\n"), 0644)
+		// still transcoding until stopped
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	os.MkdirAll(filepath.Join(dir, "Movies"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "Movies", "movie.mkv"), []byte("not really"), 0644)
+
+	service := &MercuryFsService{Shares: &HdaShares{Shares: []*HdaShare{{name: "Movies", path: filepath.Join(dir, "Movies")}}}, debug_info: new(debugInfo)}
+	router := mux.NewRouter()
+	router.HandleFunc("/transcode", service.start_transcode).Methods("POST")
+	router.HandleFunc("/transcode/{session}/{file}", service.serve_transcode).Methods("GET")
+	router.HandleFunc("/transcode/{session}", service.stop_transcode).Methods("DELETE")
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+		return recorder
+	}
+
+	response := serve("POST", "/transcode?s=Movies&p=/movie.mkv&b=3000")
+	var started map[string]string
+	if response.Code != 201 || json.Unmarshal(response.Body.Bytes(), &started) != nil || started["quality"] != "720p" || started["encoder"] != "libx264" {
+		t.Fatalf("Could not start a transcode: %d %s", response.Code, response.Body.String())
+	}
+	if args := strings.Join(<-runs, " "); !strings.Contains(args, "-c:v libx264") || !strings.Contains(args, "-b:v 2800k") {
+		t.Errorf("Wrong arguments: %s", args)
+	}
+	// the same video at the same quality is the same session
+	if again := serve("POST", "/transcode?s=Movies&p=/movie.mkv&b=3000"); !strings.Contains(again.Body.String(), started["session"]) {
+		t.Errorf("Started another session: %s", again.Body.String())
+	}
+
+	response = serve("GET", started["playlist"])
+	if response.Code != 200 || !strings.Contains(response.Body.String(), "seg00000.ts") || response.Header().Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Fatalf("Wrong playlist: %d %s", response.Code, response.Body.String())
+	}
+	if response := serve("GET", "/transcode/"+started["session"]+"/seg00000.ts"); response.Code != 200 || response.Body.String() != "segment" {
+		t.Errorf("Wrong segment: %d %s", response.Code, response.Body.String())
+	}
+	if response := serve("GET", "/transcode/"+started["session"]+"/index.json"); response.Code != 404 {
+		t.Errorf("Served a file that is not a segment: %d", response.Code)
+	}
+
+	// only two videos are transcoded at a time, unless one is not watched
+	serve("POST", "/transcode?s=Movies&p=/movie.mkv&q=480p")
+	if response := serve("POST", "/transcode?s=Movies&p=/movie.mkv&q=360p"); response.Code != 503 {
+		t.Errorf("Started a third transcode: %d", response.Code)
+	}
+	transcoders.Lock()
+	transcoders.sessions[started["session"]].LastAccess = time.Now().Add(-time.Minute)
+	transcoders.Unlock()
+	response = serve("POST", "/transcode?s=Movies&p=/movie.mkv&q=360p")
+	if response.Code != 201 || transcoders.stop(started["session"]) {
+		t.Errorf("The session not watched was not stopped: %d", response.Code)
+	}
+
+	if response := serve("DELETE", "/transcode/nope"); response.Code != 404 {
+		t.Errorf("Stopped an unknown session: %d", response.Code)
+	}
+	transcoders.Lock()
+	for _, session := range transcoders.sessions {
+		session.LastAccess = time.Now().Add(-TRANSCODE_IDLE)
+	}
+	transcoders.Unlock()
+	if result, _ := transcoders.cleanup()(func(done, total int64) {}); result != "2 transcodes stopped, 0 left" {
+		t.Errorf("Wrong cleanup: %s", result)
+	}
+}
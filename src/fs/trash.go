@@ -0,0 +1,379 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// deleted files are moved to the trash of their share, .trash at the top of
+// the share, and removed for good after config.Trash.Retention. the trash
+// has the deleted files in files/ and, for each one, a JSON file in info/
+// with where it was and when it was deleted
+
+const TRASH_DIR = ".trash"
+
+var errTrashNotFound = errors.New("not in the trash")
+var errTrashConflict = errors.New("a file already exists where it would be restored")
+
+type trashItem struct {
+	ID      string    `json:"id"`
+	Share   string    `json:"share"`
+	Path    string    `json:"path"`
+	Deleted time.Time `json:"deleted"`
+	Size    int64     `json:"size"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+// trash_retention is how long deleted files are kept, 0 if there is no trash
+func trash_retention() time.Duration {
+	if config.Trash.Retention == "" || config.Trash.Retention == "0" {
+		return 0
+	}
+	d, err := time.ParseDuration(config.Trash.Retention)
+	if err != nil {
+		log_warn("Invalid trash retention %q, using 720h", config.Trash.Retention)
+		return 720 * time.Hour
+	}
+	return d
+}
+
+func trash_files(share *HdaShare) string {
+	return filepath.Join(share.path, TRASH_DIR, "files")
+}
+
+func trash_info(share *HdaShare) string {
+	return filepath.Join(share.path, TRASH_DIR, "info")
+}
+
+// valid_trash_id checks that id names an item in the trash and not
+// anything else
+func valid_trash_id(id string) bool {
+	return id != "" && filepath.Base(id) == id && !strings.HasPrefix(id, ".")
+}
+
+// move_to_trash moves the file or directory at relative, in the share, to
+// the trash
+func move_to_trash(share *HdaShare, relative string) (*trashItem, error) {
+	relative = path.Clean("/" + relative)
+	if relative == "/" || relative == "/"+TRASH_DIR || strings.HasPrefix(relative, "/"+TRASH_DIR+"/") {
+		return nil, os.ErrPermission
+	}
+	full_path := filepath.Join(share.path, relative)
+	fi, err := os.Lstat(full_path)
+	if err != nil {
+		return nil, err
+	}
+	item := &trashItem{Share: share.name, Path: relative, Deleted: time.Now(), IsDir: fi.IsDir(), Size: fi.Size()}
+	item.ID = fmt.Sprintf("%d-%s", item.Deleted.UnixNano(), filepath.Base(relative))
+	if item.IsDir {
+		item.Size = 0
+		filepath.Walk(full_path, func(_ string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				item.Size += fi.Size()
+			}
+			return nil
+		})
+	}
+
+	if err := os.MkdirAll(trash_files(share), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(trash_info(share), 0755); err != nil {
+		return nil, err
+	}
+	data, _ := json.Marshal(item)
+	info := filepath.Join(trash_info(share), item.ID+".json")
+	if err := write_file_atomic(info, data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(full_path, filepath.Join(trash_files(share), item.ID)); err != nil {
+		os.Remove(info)
+		return nil, err
+	}
+	return item, nil
+}
+
+// delete_to_trash deletes a file of a share, keeping it in the trash when
+// there is one and it's possible
+func delete_to_trash(share *HdaShare, relative string) error {
+	if trash_retention() == 0 {
+		return os.Remove(filepath.Join(share.path, relative))
+	}
+	_, err := move_to_trash(share, relative)
+	if errors.Is(err, syscall.EXDEV) {
+		// on another file system mounted in the share, it cannot be kept
+		log_warn("%s in share %s is on another file system, deleting it without a trash", relative, share.name)
+		return os.Remove(filepath.Join(share.path, relative))
+	}
+	return err
+}
+
+// delete_path_to_trash is delete_to_trash for the full path of a file, for
+// the servers that find the files themselves, like FTP or SFTP
+func delete_path_to_trash(shares *HdaShares, full_path string) error {
+	share, relative := shares.owner(full_path)
+	if share == nil {
+		return os.Remove(full_path)
+	}
+	return delete_to_trash(share, relative)
+}
+
+func read_trash_item(share *HdaShare, id string) (*trashItem, error) {
+	if !valid_trash_id(id) {
+		return nil, errTrashNotFound
+	}
+	data, err := ioutil.ReadFile(filepath.Join(trash_info(share), id+".json"))
+	if os.IsNotExist(err) {
+		return nil, errTrashNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	item := new(trashItem)
+	if err := json.Unmarshal(data, item); err != nil {
+		return nil, err
+	}
+	item.ID, item.Share = id, share.name
+	return item, nil
+}
+
+// list_trash returns what is in the trash of a share, the latest first
+func list_trash(share *HdaShare) ([]*trashItem, error) {
+	fis, err := ioutil.ReadDir(trash_info(share))
+	if os.IsNotExist(err) {
+		return []*trashItem{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	items := make([]*trashItem, 0, len(fis))
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		item, err := read_trash_item(share, strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil {
+			debug(3, "Error reading trash item %s: %s", fi.Name(), err.Error())
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	return items, nil
+}
+
+// restore_from_trash moves an item back where it was, or to relative if
+// it's not empty
+func restore_from_trash(share *HdaShare, id, relative string) (*trashItem, error) {
+	item, err := read_trash_item(share, id)
+	if err != nil {
+		return nil, err
+	}
+	if relative != "" {
+		item.Path = path.Clean("/" + relative)
+	}
+	if item.Path == "/" || strings.HasPrefix(item.Path, "/"+TRASH_DIR) {
+		return nil, os.ErrPermission
+	}
+	target := filepath.Join(share.path, item.Path)
+	if _, err := os.Lstat(target); err == nil {
+		return nil, errTrashConflict
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(filepath.Join(trash_files(share), id), target); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errTrashNotFound
+		}
+		return nil, err
+	}
+	os.Remove(filepath.Join(trash_info(share), id+".json"))
+	return item, nil
+}
+
+// remove_from_trash deletes an item for good
+func remove_from_trash(share *HdaShare, id string) error {
+	if !valid_trash_id(id) {
+		return errTrashNotFound
+	}
+	if err := os.RemoveAll(filepath.Join(trash_files(share), id)); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(trash_info(share), id+".json"))
+}
+
+// empty_trash deletes everything in the trash of a share deleted before
+// the given time, and returns how many items were removed
+func empty_trash(share *HdaShare, before time.Time) (int, error) {
+	items, err := list_trash(share)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, item := range items {
+		if item.Deleted.After(before) {
+			continue
+		}
+		if err := remove_from_trash(share, item.ID); err != nil {
+			debug(2, "Error removing %s from the trash: %s", item.ID, err.Error())
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// trash_expiry is the job that removes what has been in the trash for
+// longer than the retention
+func trash_expiry(shares *HdaShares) jobFunc {
+	return func(progress func(done, total int64)) (string, error) {
+		retention := trash_retention()
+		if retention == 0 {
+			return "trash disabled", nil
+		}
+		shares.RLock()
+		list := append([]*HdaShare{}, shares.Shares...)
+		shares.RUnlock()
+		removed := 0
+		for i, share := range list {
+			if share.path != "" && share.problem == "" {
+				n, err := empty_trash(share, time.Now().Add(-retention))
+				if err != nil {
+					debug(2, "Error expiring the trash of %s: %s", share.name, err.Error())
+				}
+				removed += n
+			}
+			progress(int64(i+1), int64(len(list)))
+		}
+		return fmt.Sprintf("%d expired items removed", removed), nil
+	}
+}
+
+func trash_status(err error) int {
+	switch {
+	case err == errTrashNotFound:
+		return http.StatusNotFound
+	case err == errTrashConflict:
+		return http.StatusConflict
+	case os.IsPermission(err):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// GET /trash lists the trash of share s, or of all the shares
+func (service *MercuryFsService) trash_list(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	name := request.URL.Query().Get("s")
+	var shares []*HdaShare
+	service.Shares.RLock()
+	for _, share := range service.Shares.Shares {
+		// the trash of the home share has the files of every user
+		if (name == "" || share.name == name) && share.problem == "" && !is_homes_share(share.name) {
+			shares = append(shares, share)
+		}
+	}
+	service.Shares.RUnlock()
+	if name != "" && len(shares) == 0 {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+
+	items := []*trashItem{}
+	for _, share := range shares {
+		list, err := list_trash(share)
+		if err != nil {
+			debug(2, "Error listing the trash of %s: %s", share.name, err.Error())
+			continue
+		}
+		items = append(items, list...)
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	size := json_response(writer, http.StatusOK, items)
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
+
+// POST /trash/restore?s=share&id=item puts an item back, at p if given
+func (service *MercuryFsService) trash_restore(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	status, size := http.StatusNotFound, int64(0)
+	if share := service.Shares.Get(q.Get("s")); share != nil {
+		item, err := restore_from_trash(share, q.Get("id"), q.Get("p"))
+		if err != nil {
+			debug(2, "Error restoring %s from the trash: %s", q.Get("id"), err.Error())
+			status = trash_status(err)
+			size = json_response(writer, status, map[string]string{"error": err.Error()})
+		} else {
+			status = http.StatusOK
+			size = json_response(writer, status, item)
+		}
+	} else {
+		http.NotFound(writer, request)
+	}
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+}
+
+// DELETE /trash?s=share empties the trash of a share, or only removes the
+// item id if given
+func (service *MercuryFsService) trash_empty(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	q := request.URL.Query()
+	share := service.Shares.Get(q.Get("s"))
+	if share == nil {
+		http.NotFound(writer, request)
+		service.debug_info.requestServed(int64(0))
+		log("\"DELETE %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	var err error
+	removed := 0
+	if no_delete {
+		debug(2, "NOTICE: Running in no-delete mode. Would have emptied the trash of %s", share.name)
+	} else if id := q.Get("id"); id != "" {
+		if err = remove_from_trash(share, id); err == nil {
+			removed = 1
+		}
+	} else {
+		removed, err = empty_trash(share, time.Now())
+	}
+	status := http.StatusOK
+	var size int64
+	if err != nil {
+		debug(2, "Error emptying the trash of %s: %s", share.name, err.Error())
+		if os.IsNotExist(err) {
+			err = errTrashNotFound
+		}
+		status = trash_status(err)
+		size = json_response(writer, status, map[string]string{"error": err.Error()})
+	} else {
+		size = json_response(writer, status, map[string]int{"removed": removed})
+	}
+	service.debug_info.requestServed(size)
+	log("\"DELETE %s\" %d %d \"%s\"", query, status, size, ua)
+}
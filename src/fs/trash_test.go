@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "trash")
+	defer os.RemoveAll(dir)
+	share := &HdaShare{name: "Docs", path: dir}
+	os.MkdirAll(filepath.Join(dir, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a", "b.txt"), []byte("hello"), 0644)
+
+	item, err := move_to_trash(share, "/a/b.txt")
+	if err != nil {
+		t.Fatalf("move_to_trash: %s", err)
+	}
+	if exists(filepath.Join(dir, "a", "b.txt")) || item.Path != "/a/b.txt" || item.Size != 5 {
+		t.Errorf("Wrong trash item: %+v", item)
+	}
+	for _, bad := range []string{"/", "/..", "/.trash/files"} {
+		if _, err := move_to_trash(share, bad); !os.IsPermission(err) {
+			t.Errorf("Moving %s to the trash: %v", bad, err)
+		}
+	}
+
+	items, _ := list_trash(share)
+	if len(items) != 1 || items[0].ID != item.ID {
+		t.Fatalf("Wrong trash list: %+v", items)
+	}
+	if _, err := restore_from_trash(share, "../../etc", ""); err != errTrashNotFound {
+		t.Errorf("Restored an invalid id: %v", err)
+	}
+
+	// restoring over a new file with the same name is refused
+	ioutil.WriteFile(filepath.Join(dir, "a", "b.txt"), []byte("new"), 0644)
+	if _, err := restore_from_trash(share, item.ID, ""); err != errTrashConflict {
+		t.Errorf("Restored over an existing file: %v", err)
+	}
+	if _, err := restore_from_trash(share, item.ID, "/old/b.txt"); err != nil {
+		t.Fatalf("restore_from_trash: %s", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "old", "b.txt")); string(data) != "hello" {
+		t.Errorf("Restored the wrong contents: %q", data)
+	}
+
+	// expiry only removes what's older than the retention
+	move_to_trash(share, "/a")
+	if n, _ := empty_trash(share, time.Now().Add(-time.Hour)); n != 0 {
+		t.Errorf("Expired %d recent items", n)
+	}
+	if n, _ := empty_trash(share, time.Now()); n != 1 {
+		t.Errorf("Expired %d items instead of 1", n)
+	}
+	if items, _ := list_trash(share); len(items) != 0 {
+		t.Errorf("Trash not empty: %+v", items)
+	}
+}
+
+func TestDeletePathToTrash(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = default_config()
+	dir, _ := ioutil.TempDir("", "trash")
+	defer os.RemoveAll(dir)
+	share := &HdaShare{name: "Docs", path: dir}
+	shares := &HdaShares{Shares: []*HdaShare{share}}
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644)
+
+	// like FTP, SFTP, gRPC and S3 do
+	if err := delete_path_to_trash(shares, filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatalf("delete_path_to_trash: %s", err)
+	}
+	items, _ := list_trash(share)
+	if exists(filepath.Join(dir, "a.txt")) || len(items) != 1 || items[0].Path != "/a.txt" {
+		t.Errorf("Not in the trash: %+v", items)
+	}
+
+	// without a trash, it's gone
+	config.Trash.Retention = "0"
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("hello"), 0644)
+	if err := delete_path_to_trash(shares, filepath.Join(dir, "b.txt")); err != nil || exists(filepath.Join(dir, "b.txt")) {
+		t.Errorf("Not deleted without a trash: %v", err)
+	}
+	if items, _ := list_trash(share); len(items) != 1 {
+		t.Errorf("In the trash with no retention: %+v", items)
+	}
+}
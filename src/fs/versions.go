@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// when a file is overwritten, by an upload or a move over it, the previous
+// contents are kept as a version in .versions at the top of its share, in
+// the same relative path plus the time of the change:
+//
+//	.versions/<dir>/<file>/<YYYYmmddTHHMMSS.nnnnnnnnnZ>
+//
+// only the last config.Versions.Keep versions of each file are kept. the
+// versions of the files in chunked folders are lists of chunks instead, in
+// <id>.chunks, see chunked.go
+
+const VERSIONS_DIR = ".versions"
+const VERSION_ID_FORMAT = "20060102T150405.000000000Z"
+
+var errNoSuchVersion = errors.New("no such version")
+
+type fileVersion struct {
+	ID    string    `json:"id"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+}
+
+func versions_dir(share *HdaShare, relative string) string {
+	return filepath.Join(share.path, VERSIONS_DIR, relative)
+}
+
+// versioned says whether changes of a file of a share are kept. hidden
+// files, like the ones in the trash or the versions, are not
+func versioned(relative string) bool {
+	if config.Versions.Keep <= 0 {
+		return false
+	}
+	for _, part := range strings.Split(relative, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return relative != "/"
+}
+
+// keep_version copies the file at full_path as a version of itself, before
+// it's overwritten. the file stays in place, so that it is still there when
+// writing the new contents fails. nothing is done for files outside of the
+// shares, or that do not exist
+func keep_version(shares *HdaShares, full_path string) {
+	share, relative := shares.owner(full_path)
+	if share == nil || !versioned(relative) {
+		return
+	}
+	fi, err := os.Lstat(full_path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	if _, err := save_version(share, relative, full_path); err != nil {
+		debug(2, "Error keeping a version of %s: %s", full_path, err.Error())
+	}
+}
+
+func save_version(share *HdaShare, relative, full_path string) (string, error) {
+	dir := versions_dir(share, relative)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	id := time.Now().UTC().Format(VERSION_ID_FORMAT)
+	saved := false
+	if chunked_folder(share, relative) {
+		err := save_chunked_version(share, full_path, filepath.Join(dir, id+CHUNK_MANIFEST_EXT))
+		if err != nil {
+			debug(2, "Error keeping %s as chunks, keeping it whole: %s", full_path, err.Error())
+		}
+		saved = err == nil
+	}
+	if !saved {
+		fi, err := os.Stat(full_path)
+		if err != nil {
+			return "", err
+		}
+		if err := copy_file(full_path, filepath.Join(dir, id), fi); err != nil {
+			return "", err
+		}
+	}
+	prune_versions(share, relative, config.Versions.Keep)
+	return id, nil
+}
+
+// list_versions returns the versions of a file, the latest first
+func list_versions(share *HdaShare, relative string) ([]fileVersion, error) {
+	fis, err := ioutil.ReadDir(versions_dir(share, relative))
+	if os.IsNotExist(err) {
+		return []fileVersion{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	versions := make([]fileVersion, 0, len(fis))
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		id, size := fi.Name(), fi.Size()
+		if strings.HasSuffix(id, CHUNK_MANIFEST_EXT) {
+			manifest, err := read_chunk_manifest(filepath.Join(versions_dir(share, relative), id))
+			if err != nil {
+				continue
+			}
+			id, size = strings.TrimSuffix(id, CHUNK_MANIFEST_EXT), manifest.Size
+		}
+		if _, err := time.Parse(VERSION_ID_FORMAT, id); err != nil {
+			continue
+		}
+		versions = append(versions, fileVersion{ID: id, Size: size, Mtime: fi.ModTime()})
+	}
+	// the ids sort by time
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID > versions[j].ID })
+	return versions, nil
+}
+
+func prune_versions(share *HdaShare, relative string, keep int) {
+	versions, err := list_versions(share, relative)
+	if err != nil || len(versions) <= keep {
+		return
+	}
+	for _, version := range versions[keep:] {
+		os.Remove(filepath.Join(versions_dir(share, relative), version.ID))
+		os.Remove(filepath.Join(versions_dir(share, relative), version.ID+CHUNK_MANIFEST_EXT))
+	}
+}
+
+// restore_version puts a version back in place, keeping the current
+// contents as a new version
+func restore_version(share *HdaShare, relative, id string) error {
+	if _, err := time.Parse(VERSION_ID_FORMAT, id); err != nil {
+		return errNoSuchVersion
+	}
+	version := filepath.Join(versions_dir(share, relative), id)
+	var manifest *chunkManifest
+	if _, err := os.Stat(version); err != nil {
+		if manifest, err = read_chunk_manifest(version + CHUNK_MANIFEST_EXT); err != nil {
+			return errNoSuchVersion
+		}
+	}
+	full_path := filepath.Join(share.path, relative)
+	fi, err := os.Lstat(full_path)
+	exists := err == nil
+	if exists && !fi.Mode().IsRegular() {
+		return os.ErrExist
+	}
+	if err := os.MkdirAll(filepath.Dir(full_path), 0755); err != nil {
+		return err
+	}
+	// take the version out first, so that keeping the current contents
+	// does not prune it
+	tmp := filepath.Join(filepath.Dir(full_path), "."+filepath.Base(full_path)+".restore")
+	if manifest != nil {
+		if err := assemble_version(share, manifest, tmp); err != nil {
+			return err
+		}
+	} else if err := os.Rename(version, tmp); err != nil {
+		return err
+	}
+	if exists {
+		if _, err := save_version(share, relative, full_path); err != nil {
+			if manifest == nil {
+				os.Rename(tmp, version)
+			} else {
+				os.Remove(tmp)
+			}
+			return err
+		}
+	}
+	if manifest != nil {
+		os.Remove(version + CHUNK_MANIFEST_EXT)
+	}
+	if err := os.Rename(tmp, full_path); err != nil {
+		return err
+	}
+	// touch it, so that clients see it changed
+	now := time.Now()
+	os.Chtimes(full_path, now, now)
+	return nil
+}
+
+// share_file returns the share and relative path of a file request,
+// answering it when they are not valid
+func (service *MercuryFsService) share_file(writer http.ResponseWriter, request *http.Request) (*HdaShare, string) {
+	q := request.URL.Query()
+	share := service.Shares.Get(q.Get("s"))
+	relative := path.Clean("/" + q.Get("p"))
+	if share == nil || !versioned(relative) {
+		http.NotFound(writer, request)
+		return nil, ""
+	}
+	return share, relative
+}
+
+// GET /files/versions?s=share&p=path lists the versions kept of a file
+func (service *MercuryFsService) file_versions(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	share, relative := service.share_file(writer, request)
+	if share == nil {
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	versions, err := list_versions(share, relative)
+	if err != nil {
+		debug(2, "Error listing the versions of %s: %s", relative, err.Error())
+		writer.WriteHeader(http.StatusInternalServerError)
+		service.debug_info.requestServed(int64(0))
+		log("\"GET %s\" 500 0 \"%s\"", query, ua)
+		return
+	}
+	size := json_response(writer, http.StatusOK, versions)
+	service.debug_info.requestServed(size)
+	log("\"GET %s\" 200 %d \"%s\"", query, size, ua)
+}
+
+// POST /files/versions/restore?s=share&p=path&id=version
+func (service *MercuryFsService) restore_file_version(writer http.ResponseWriter, request *http.Request) {
+	ua := request.Header.Get("User-Agent")
+	query := pathForLog(request.URL)
+	share, relative := service.share_file(writer, request)
+	if share == nil {
+		service.debug_info.requestServed(int64(0))
+		log("\"POST %s\" 404 0 \"%s\"", query, ua)
+		return
+	}
+	status := http.StatusOK
+	result := map[string]string{"id": request.URL.Query().Get("id")}
+	if no_upload {
+		debug(2, "NOTICE: Running in no-upload mode.")
+		status = http.StatusForbidden
+		result = map[string]string{"error": "uploads are disabled"}
+	} else if err := restore_version(share, relative, result["id"]); err != nil {
+		debug(2, "Error restoring a version of %s: %s", relative, err.Error())
+		switch {
+		case err == errNoSuchVersion:
+			status = http.StatusNotFound
+		case os.IsExist(err):
+			status = http.StatusConflict
+		default:
+			status = http.StatusInternalServerError
+		}
+		result = map[string]string{"error": err.Error()}
+	}
+	size := json_response(writer, status, result)
+	service.debug_info.requestServed(size)
+	log("\"POST %s\" %d %d \"%s\"", query, status, size, ua)
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileVersions(t *testing.T) {
+	keep := config.Versions.Keep
+	defer func() { config.Versions.Keep = keep }()
+	config.Versions.Keep = 2
+
+	dir, _ := ioutil.TempDir("", "versions")
+	defer os.RemoveAll(dir)
+	share := &HdaShare{name: "Docs", path: dir}
+	shares := &HdaShares{Shares: []*HdaShare{share}}
+	full_path := filepath.Join(dir, "notes.txt")
+
+	// three overwrites, of which the last two are kept
+	for _, contents := range []string{"one", "two", "three", "four"} {
+		keep_version(shares, full_path)
+		ioutil.WriteFile(full_path, []byte(contents), 0644)
+	}
+	versions, _ := list_versions(share, "/notes.txt")
+	if len(versions) != 2 || versions[0].Size != 5 || versions[1].Size != 3 {
+		t.Fatalf("Wrong versions: %+v", versions)
+	}
+
+	// restoring the oldest one keeps it even though there's no room
+	if err := restore_version(share, "/notes.txt", versions[1].ID); err != nil {
+		t.Fatalf("restore_version: %s", err)
+	}
+	if data, _ := ioutil.ReadFile(full_path); string(data) != "two" {
+		t.Errorf("Restored the wrong contents: %q", data)
+	}
+	versions, _ = list_versions(share, "/notes.txt")
+	if len(versions) != 2 || versions[0].Size != 4 {
+		t.Errorf("The current contents were not kept: %+v", versions)
+	}
+	if err := restore_version(share, "/notes.txt", "../../notes.txt"); err != errNoSuchVersion {
+		t.Errorf("Restored an invalid version: %v", err)
+	}
+
+	// hidden files are not versioned
+	hidden := filepath.Join(dir, ".trash", "x")
+	os.MkdirAll(filepath.Dir(hidden), 0755)
+	ioutil.WriteFile(hidden, []byte("x"), 0644)
+	keep_version(shares, hidden)
+	if exists(filepath.Join(dir, VERSIONS_DIR, ".trash")) {
+		t.Errorf("A hidden file was versioned")
+	}
+
+	// the file stays until it is written over
+	keep_version(shares, full_path)
+	if data, _ := ioutil.ReadFile(full_path); string(data) != "two" {
+		t.Errorf("The file was moved away: %q", data)
+	}
+}
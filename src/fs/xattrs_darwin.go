@@ -0,0 +1,15 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+// get_xattr is the extended attribute name of the file at path, none here
+func get_xattr(path, name string) (string, bool) {
+	return "", false
+}
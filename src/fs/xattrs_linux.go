@@ -0,0 +1,22 @@
+/*
+ * Copyright (c) 2013-2018 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import "syscall"
+
+// get_xattr is the extended attribute name of the file at path
+func get_xattr(path, name string) (string, bool) {
+	buf := make([]byte, 4096)
+	n, err := syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return "", false
+	}
+	return string(buf[:n]), true
+}